@@ -18,11 +18,23 @@ interface Worker {
   healthy: boolean;
   currentLoad: number;
   enabled: boolean;
+  draining?: boolean;
+  saturated?: boolean;
   totalRequests: number;
   failedRequests: number;
   circuitOpen: boolean;
   status?: string;
   queueDepth?: number;
+  displayName?: string;
+  description?: string;
+  icon?: string;
+  revision?: number;
+  // 直近 1 分間の統計
+  rps?: number;
+  errorRate?: number;
+  p50Ms?: number;
+  p95Ms?: number;
+  p99Ms?: number;
 }
 
 interface WorkerConfig {
@@ -45,6 +57,9 @@ interface TaskResult {
 interface LoadBalancerStatus {
   algorithm: string;
   workers: Worker[];
+  // 多数のワーカーがいる場合、ブロードキャストは変化したワーカーだけを含む要約形式になる
+  broadcastMode?: "full" | "summary";
+  removedWorkers?: string[];
 }
 
 interface AlgorithmInfo {
@@ -76,6 +91,30 @@ const defaultRanges: UIConfigRanges = {
   queue_size: { min: 1, max: 1000, step: 1 },
 };
 
+/**
+ * 要約形式のブロードキャストを直前の状態に適用します。含まれるワーカーは置き換え、removedWorkers のワーカーは取り除きます。
+ */
+function mergeSummary(
+  prev: LoadBalancerStatus | null,
+  summary: LoadBalancerStatus
+): LoadBalancerStatus {
+  if (!prev) {
+    return summary;
+  }
+  const updated = new Map(summary.workers.map((w) => [w.name, w]));
+  const removed = new Set(summary.removedWorkers ?? []);
+  const workers = prev.workers
+    .filter((w) => !removed.has(w.name))
+    .map((w) => updated.get(w.name) ?? w);
+  const known = new Set(prev.workers.map((w) => w.name));
+  for (const w of summary.workers) {
+    if (!known.has(w.name)) {
+      workers.push(w);
+    }
+  }
+  return { ...summary, workers };
+}
+
 const WS_URL = process.env.REACT_APP_WS_URL || "ws://localhost:8000/ws";
 
 const algorithms = [
@@ -86,7 +125,26 @@ const algorithms = [
     desc: "最も空いているワーカーへ",
   },
   { id: "weighted", name: "重み付け", desc: "重みに基づいて振り分け" },
+  {
+    id: "smooth-weighted",
+    name: "スムーズ重み付け",
+    desc: "重みに基づいて均等に織り交ぜて振り分け",
+  },
   { id: "random", name: "ランダム", desc: "ランダムに選択" },
+  { id: "p2c", name: "P2C", desc: "ランダムな 2 台のうち空いている方へ" },
+  { id: "lru-worker", name: "LRU ワーカー", desc: "1 台に集中させて順に切替" },
+  { id: "ip-hash", name: "IP ハッシュ", desc: "同じクライアントを同じワーカーへ" },
+  { id: "sticky", name: "スティッキー", desc: "セッションクッキーで同じワーカーへ" },
+  {
+    id: "resource-aware",
+    name: "リソース考慮",
+    desc: "ワーカー自身が報告する負荷とキューが最小のワーカーへ",
+  },
+  {
+    id: "least-latency",
+    name: "最小レイテンシ",
+    desc: "応答時間の指数移動平均が最も短いワーカーへ",
+  },
 ];
 
 // Log entry color based on response time
@@ -148,8 +206,12 @@ function App() {
 
       ws.onmessage = (event) => {
         try {
-          const data = JSON.parse(event.data);
-          setStatus(data);
+          const data: LoadBalancerStatus = JSON.parse(event.data);
+          if (data.broadcastMode === "summary") {
+            setStatus((prev) => mergeSummary(prev, data));
+          } else {
+            setStatus(data);
+          }
         } catch (e) {
           console.error("Failed to parse WebSocket message:", e);
         }
@@ -664,7 +726,12 @@ function App() {
                       style={{ borderColor: worker.color }}
                     >
                       <div className="flex items-center justify-between mb-2">
-                        <span className="font-medium">{worker.name}</span>
+                        <span
+                          className="font-medium"
+                          title={worker.description || worker.name}
+                        >
+                          {worker.displayName || worker.name}
+                        </span>
                         <div className="flex items-center gap-2">
                           <span
                             className={`w-3 h-3 rounded-full ${getStatusColor(worker)}`}
@@ -741,6 +808,13 @@ function App() {
                           <span className="text-slate-400">キュー</span>
                           <span>{worker.queueDepth ?? 0}</span>
                         </div>
+                        <div className="flex justify-between text-sm">
+                          <span className="text-slate-400">直近 1 分</span>
+                          <span>
+                            {(worker.rps ?? 0).toFixed(1)} rps / p95{" "}
+                            {Math.round(worker.p95Ms ?? 0)}ms
+                          </span>
+                        </div>
                         <div className="flex justify-between items-center text-sm">
                           <span className="text-slate-400">重み</span>
                           <label
@@ -888,6 +962,16 @@ function App() {
                         {!worker.enabled && (
                           <div className="text-yellow-400 text-sm">⏸ 無効</div>
                         )}
+                        {worker.draining && (
+                          <div className="text-yellow-400 text-sm">
+                            ⏳ ドレイン中
+                          </div>
+                        )}
+                        {worker.saturated && (
+                          <div className="text-orange-400 text-sm">
+                            🈵 最大負荷
+                          </div>
+                        )}
                         {worker.circuitOpen && (
                           <div className="text-red-400 text-sm">
                             ⚡ サーキット開放中
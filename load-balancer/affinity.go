@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Worker affinity hint headers. Require routes to exactly the named worker or
+// fails with 409; prefer falls back to normal selection and reports the
+// fallback in fallbackHeader. selectorHeader restricts selection to workers
+// whose labels match all key=value pairs. maxLatencyHeader (see
+// latencyhint.go) restricts it to workers expected to be fast enough.
+const (
+	requireWorkerHeader = "X-LB-Require-Worker"
+	preferWorkerHeader  = "X-LB-Prefer-Worker"
+	fallbackHeader      = "X-LB-Fallback-From"
+	selectorHeader      = "X-LB-Worker-Selector"
+)
+
+// routeHints are the per-request constraints on worker selection
+type routeHints struct {
+	require  string
+	prefer   string
+	selector map[string]string
+	// exclude are workers that must not be selected, e.g. ones that already
+	// failed or rejected the request
+	exclude []string
+	// maxLatency, when set, excludes workers whose latency estimate does
+	// not fit it
+	maxLatency time.Duration
+	// algorithm, when set, overrides the pool's algorithm, e.g. for the
+	// arm of a running experiment the request was assigned to
+	algorithm string
+	// clientIP is the address ip-hash selects on
+	clientIP string
+	// session is the session ID sticky routes on; see requestSession
+	session string
+	// phases, when the request is sampled for profiling, is told about
+	// pacing delays and retry backoff
+	phases *phaseTimer
+}
+
+// excludes reports whether the named worker must not be selected
+func (h routeHints) excludes(name string) bool {
+	for _, n := range h.exclude {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// affinityConflict is returned when the required worker is not eligible
+type affinityConflict struct {
+	worker   string
+	eligible []string
+}
+
+func (e *affinityConflict) Error() string {
+	return fmt.Sprintf("Required worker %s is not eligible", e.worker)
+}
+
+// parseRouteHints reads the affinity and selector headers
+func parseRouteHints(r *http.Request) (routeHints, error) {
+	h := routeHints{
+		require: strings.TrimSpace(r.Header.Get(requireWorkerHeader)),
+		prefer:  strings.TrimSpace(r.Header.Get(preferWorkerHeader)),
+		// ip-hash selects on the client address, sticky on the session
+		clientIP: clientIP(r),
+	}
+	if h.require != "" && h.prefer != "" {
+		return h, fmt.Errorf("%s and %s are mutually exclusive", requireWorkerHeader, preferWorkerHeader)
+	}
+	session, err := requestSession(r)
+	if err != nil {
+		return h, err
+	}
+	h.session = session
+	if raw := r.Header.Get(selectorHeader); raw != "" {
+		sel, err := parseLabels(raw)
+		if err != nil {
+			return h, fmt.Errorf("Invalid %s: %v", selectorHeader, err)
+		}
+		h.selector = sel
+	}
+	if raw := strings.TrimSpace(r.Header.Get(maxLatencyHeader)); raw != "" {
+		ms, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || ms <= 0 {
+			return h, fmt.Errorf("Invalid %s: must be a positive number of milliseconds", maxLatencyHeader)
+		}
+		h.maxLatency = time.Duration(ms) * time.Millisecond
+	}
+	return h, nil
+}
+
+// parseLabels parses "key=value,key2=value2"
+func parseLabels(raw string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(raw, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", pair)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+// matchesLabels reports whether the worker carries every selector label
+func (w *Worker) matchesLabels(selector map[string]string) bool {
+	for k, v := range selector {
+		if w.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// SetWorkerLabels replaces the labels of the named worker
+func (lb *LoadBalancer) SetWorkerLabels(name string, labels map[string]string) bool {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	for _, w := range lb.workers {
+		if w.Name == name {
+			w.Labels = labels
+			return true
+		}
+	}
+	return false
+}
+
+// selectWorker picks a worker honouring the request's hints. It returns the
+// name of the preferred worker when a prefer hint had to fall back, an
+// *affinityConflict when a required worker is not eligible, and a nil worker
+// with a *noEligibleWorkers when nothing is eligible. When pacing delays the
+// task it returns once the delay has passed.
+func (lb *LoadBalancer) selectWorker(h routeHints) (*Worker, string, error) {
+	if lb.routesOnResources(h) {
+		lb.refreshResourceScores(context.Background())
+	}
+	w, fallback, delay, err := func() (*Worker, string, time.Duration, error) {
+		lb.mu.Lock()
+		defer lb.mu.Unlock()
+		w, fallback, delay, err := lb.selectWorkerLocked(h)
+		if w != nil {
+			lb.admitProbeLocked(w)
+		}
+		return w, fallback, delay, err
+	}()
+	if delay > 0 {
+		lb.sleepCtx(context.Background(), delay)
+		h.phases.waited(delay)
+	}
+	return w, fallback, err
+}
+
+// selectWorkerLocked is selectWorker without the pacing delay, which it
+// returns instead. Must be called with lb.mu held.
+func (lb *LoadBalancer) selectWorkerLocked(h routeHints) (*Worker, string, time.Duration, error) {
+	available := lb.eligibleWorkersLocked()
+	if len(h.exclude) > 0 {
+		filtered := available[:0]
+		for _, w := range available {
+			if !h.excludes(w.Name) {
+				filtered = append(filtered, w)
+			}
+		}
+		available = filtered
+	}
+	if len(h.selector) > 0 {
+		filtered := available[:0]
+		for _, w := range available {
+			if w.matchesLabels(h.selector) {
+				filtered = append(filtered, w)
+			}
+		}
+		available = filtered
+	}
+	if h.maxLatency > 0 {
+		filtered := available[:0]
+		for _, w := range available {
+			if w.latency.fits(h.maxLatency) {
+				filtered = append(filtered, w)
+			}
+		}
+		available = filtered
+	}
+	available, saturated := withoutSaturated(available)
+
+	if h.require != "" {
+		for _, w := range saturated {
+			if w.Name == h.require {
+				return nil, "", 0, &noEligibleWorkers{excluded: map[string]string{w.Name: excludedSaturated}}
+			}
+		}
+		for _, w := range available {
+			if w.Name == h.require {
+				lb.metrics.requireWorkerTotal.WithLabelValues("routed").Inc()
+				w, delay := lb.paceLocked(w, nil)
+				return w, "", delay, nil
+			}
+		}
+		lb.metrics.requireWorkerTotal.WithLabelValues("conflict").Inc()
+		eligible := make([]string, 0, len(available))
+		for _, w := range available {
+			eligible = append(eligible, w.Name)
+		}
+		sort.Strings(eligible)
+		return nil, "", 0, &affinityConflict{worker: h.require, eligible: eligible}
+	}
+
+	var fallback string
+	if h.prefer != "" {
+		for _, w := range available {
+			if w.Name == h.prefer {
+				lb.metrics.preferWorkerTotal.WithLabelValues("routed").Inc()
+				w, delay := lb.paceLocked(w, nil)
+				return w, "", delay, nil
+			}
+		}
+		lb.metrics.preferWorkerTotal.WithLabelValues("fallback").Inc()
+		fallback = h.prefer
+	}
+
+	if len(available) == 0 {
+		return nil, fallback, 0, lb.noEligibleLocked(h)
+	}
+	algorithm := lb.algorithm
+	if h.algorithm != "" {
+		algorithm = h.algorithm
+	}
+	w, delay := lb.paceLocked(lb.selectWithLocked(algorithm, available, h), available)
+	return w, fallback, delay, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/network-sandbox/load-balancer/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newAffinityLB builds a three-worker pool: go-worker-1 and go-worker-2 in
+// zone a, rust-worker-1 in zone b
+func newAffinityLB(t *testing.T) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true})
+	}))
+	t.Cleanup(srv.Close)
+
+	lb = NewLoadBalancer("round-robin")
+	t.Cleanup(lb.stopControl)
+	lb.AddWorker("go-worker-1", srv.URL, "#3B82F6", 1)
+	lb.AddWorker("go-worker-2", srv.URL, "#6366F1", 1)
+	lb.AddWorker("rust-worker-1", srv.URL, "#F97316", 1)
+	lb.SetWorkerLabels("go-worker-1", map[string]string{"zone": "a"})
+	lb.SetWorkerLabels("go-worker-2", map[string]string{"zone": "a"})
+	lb.SetWorkerLabels("rust-worker-1", map[string]string{"zone": "b"})
+}
+
+func doTask(headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/task", bytes.NewBufferString(`{"id":"t","weight":1}`))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	handleTask(rec, req)
+	return rec
+}
+
+func servedBy(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	var resp api.TaskResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return resp.Worker
+}
+
+func TestRequireWorker(t *testing.T) {
+	newAffinityLB(t)
+	routed := testutil.ToFloat64(lb.metrics.requireWorkerTotal.WithLabelValues("routed"))
+
+	for i := 0; i < 3; i++ {
+		rec := doTask(map[string]string{requireWorkerHeader: "go-worker-2"})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status code = %d, want %d", rec.Code, http.StatusOK)
+		}
+		if got := servedBy(t, rec); got != "go-worker-2" {
+			t.Fatalf("served by %s, want go-worker-2", got)
+		}
+	}
+	if got := testutil.ToFloat64(lb.metrics.requireWorkerTotal.WithLabelValues("routed")) - routed; got != 3 {
+		t.Errorf("routed counter delta = %v, want 3", got)
+	}
+}
+
+func TestRequireWorkerConflict(t *testing.T) {
+	tests := []struct {
+		name         string
+		setup        func()
+		headers      map[string]string
+		wantEligible []string
+	}{
+		{
+			name:         "disabled",
+			setup:        func() { f := false; lb.UpdateWorker("go-worker-2", &f, nil) },
+			headers:      map[string]string{requireWorkerHeader: "go-worker-2"},
+			wantEligible: []string{"go-worker-1", "rust-worker-1"},
+		},
+		{
+			name:         "circuit open",
+			setup:        func() { lb.openCircuitLocked(lb.workers[1]) },
+			headers:      map[string]string{requireWorkerHeader: "go-worker-2"},
+			wantEligible: []string{"go-worker-1", "rust-worker-1"},
+		},
+		{
+			name:         "unknown worker",
+			setup:        func() {},
+			headers:      map[string]string{requireWorkerHeader: "nope"},
+			wantEligible: []string{"go-worker-1", "go-worker-2", "rust-worker-1"},
+		},
+		{
+			name:         "excluded by selector",
+			setup:        func() {},
+			headers:      map[string]string{requireWorkerHeader: "rust-worker-1", selectorHeader: "zone=a"},
+			wantEligible: []string{"go-worker-1", "go-worker-2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newAffinityLB(t)
+			tt.setup()
+			conflicts := testutil.ToFloat64(lb.metrics.requireWorkerTotal.WithLabelValues("conflict"))
+
+			rec := doTask(tt.headers)
+			if rec.Code != http.StatusConflict {
+				t.Fatalf("status code = %d, want %d", rec.Code, http.StatusConflict)
+			}
+			var body api.ErrorResponse
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if body.Worker != tt.headers[requireWorkerHeader] {
+				t.Errorf("worker = %q, want %q", body.Worker, tt.headers[requireWorkerHeader])
+			}
+			if len(body.Eligible) != len(tt.wantEligible) {
+				t.Fatalf("eligible = %v, want %v", body.Eligible, tt.wantEligible)
+			}
+			for i := range body.Eligible {
+				if body.Eligible[i] != tt.wantEligible[i] {
+					t.Errorf("eligible = %v, want %v", body.Eligible, tt.wantEligible)
+				}
+			}
+			if got := testutil.ToFloat64(lb.metrics.requireWorkerTotal.WithLabelValues("conflict")) - conflicts; got != 1 {
+				t.Errorf("conflict counter delta = %v, want 1", got)
+			}
+			// Never silently re-balanced
+			for _, w := range lb.workers {
+				if w.TotalRequests != 0 {
+					t.Errorf("%s received a request", w.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestPreferWorker(t *testing.T) {
+	newAffinityLB(t)
+
+	rec := doTask(map[string]string{preferWorkerHeader: "rust-worker-1"})
+	if rec.Code != http.StatusOK || rec.Header().Get(fallbackHeader) != "" {
+		t.Fatalf("status = %d, fallback = %q", rec.Code, rec.Header().Get(fallbackHeader))
+	}
+	if got := servedBy(t, rec); got != "rust-worker-1" {
+		t.Fatalf("served by %s, want rust-worker-1", got)
+	}
+
+	f := false
+	lb.UpdateWorker("rust-worker-1", &f, nil)
+	fallbacks := testutil.ToFloat64(lb.metrics.preferWorkerTotal.WithLabelValues("fallback"))
+
+	rec = doTask(map[string]string{preferWorkerHeader: "rust-worker-1"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status code = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if got := rec.Header().Get(fallbackHeader); got != "rust-worker-1" {
+		t.Errorf("%s = %q, want rust-worker-1", fallbackHeader, got)
+	}
+	if got := servedBy(t, rec); got == "rust-worker-1" {
+		t.Error("disabled preferred worker should not serve the request")
+	}
+	if got := testutil.ToFloat64(lb.metrics.preferWorkerTotal.WithLabelValues("fallback")) - fallbacks; got != 1 {
+		t.Errorf("fallback counter delta = %v, want 1", got)
+	}
+}
+
+func TestPreferWorkerWithSelector(t *testing.T) {
+	newAffinityLB(t)
+
+	// The fallback stays within the selector
+	for i := 0; i < 4; i++ {
+		rec := doTask(map[string]string{preferWorkerHeader: "rust-worker-1", selectorHeader: "zone=a"})
+		if rec.Code != http.StatusOK || rec.Header().Get(fallbackHeader) != "rust-worker-1" {
+			t.Fatalf("status = %d, fallback = %q", rec.Code, rec.Header().Get(fallbackHeader))
+		}
+		if got := servedBy(t, rec); got == "rust-worker-1" {
+			t.Fatalf("served by %s outside zone=a", got)
+		}
+	}
+
+	rec := doTask(map[string]string{selectorHeader: "zone=c"})
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("empty selector match status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	rec = doTask(map[string]string{selectorHeader: "zone"})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("malformed selector status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	rec = doTask(map[string]string{requireWorkerHeader: "go-worker-1", preferWorkerHeader: "go-worker-2"})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("require+prefer status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
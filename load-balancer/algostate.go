@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// selectorState is the warm state an algorithm hands to the next one when the
+// algorithm is switched. Fields the exporting algorithm does not track are
+// left empty. Only round-robin and lru-worker keep state today; the other
+// algorithms are stateless and always start cold.
+type selectorState struct {
+	// next is the worker round-robin would pick next
+	next string
+	// hot is the worker lru-worker concentrates traffic on
+	hot string
+}
+
+// exportStateLocked returns the warm state of algo, or false when algo has
+// none. Must be called with lb.mu held.
+func (lb *LoadBalancer) exportStateLocked(algo string) (selectorState, bool) {
+	switch algo {
+	case "round-robin":
+		if lb.roundRobinIdx == 0 || len(lb.workers) == 0 {
+			return selectorState{}, false
+		}
+		return selectorState{next: lb.workers[lb.roundRobinIdx%len(lb.workers)].Name}, true
+	case "lru-worker":
+		if lb.lru.hot == "" {
+			return selectorState{}, false
+		}
+		return selectorState{hot: lb.lru.hot}, true
+	}
+	return selectorState{}, false
+}
+
+// importStateLocked seeds algo from st and describes what was taken over.
+// Must be called with lb.mu held.
+func (lb *LoadBalancer) importStateLocked(algo, from string, st selectorState) []string {
+	switch algo {
+	case "round-robin":
+		// Continue after the worker that has been carrying the traffic
+		if st.hot == "" {
+			return nil
+		}
+		for pos, w := range lb.workers {
+			if w.Name == st.hot {
+				lb.roundRobinIdx = pos + 1
+				return []string{"round-robin resumes after " + st.hot}
+			}
+		}
+	case "lru-worker":
+		if st.next == "" || lb.findWorkerLocked(st.next) == nil {
+			return nil
+		}
+		lb.lru.hot = st.next
+		lb.lru.since = time.Now()
+		lb.lru.reason = "handed over from " + from
+		return []string{"lru-worker concentrates on " + st.next}
+	}
+	return nil
+}
+
+// handoffLocked carries the warm state of the algorithm from over to to and
+// returns what was transferred; nil means to starts cold. Must be called with
+// lb.mu held.
+func (lb *LoadBalancer) handoffLocked(from, to string) []string {
+	st, ok := lb.exportStateLocked(from)
+	if !ok {
+		return nil
+	}
+	return lb.importStateLocked(to, from, st)
+}
+
+// logHandoff logs the state taken over on an algorithm switch, if any
+func logHandoff(from, to string, handoff []string) {
+	if len(handoff) == 0 {
+		return
+	}
+	log.Printf("Algorithm %s took over from %s: %s", to, from, strings.Join(handoff, "; "))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newHandoffTestBalancer(algo string) *LoadBalancer {
+	lb := NewLoadBalancer(algo)
+	lb.SetLRUWorkerConfig(LRUWorkerConfig{LoadThreshold: 1, WindowMs: 60000, SwitchOn: lruSwitchTime, Order: lruOrderWeight})
+	lb.AddWorker("worker-1", "http://localhost:8081", "#FF0000", 1)
+	lb.AddWorker("worker-2", "http://localhost:8082", "#00FF00", 5)
+	lb.AddWorker("worker-3", "http://localhost:8083", "#0000FF", 3)
+	return lb
+}
+
+func TestHandoffRoundRobinToLRUWorker(t *testing.T) {
+	lb := newHandoffTestBalancer("round-robin")
+	// Cold, lru-worker would start on the heaviest worker, worker-2. After a
+	// full cycle round-robin's next worker is worker-1.
+	for i := 0; i < 3; i++ {
+		lb.SelectWorker()
+	}
+	lb.SetAlgorithm("lru-worker")
+
+	if w := lb.SelectWorker(); w.Name != "worker-1" {
+		t.Errorf("pick after handoff = %s, want worker-1 (round-robin's next)", w.Name)
+	}
+	lb.mu.RLock()
+	reason := lb.lru.reason
+	lb.mu.RUnlock()
+	if reason != "handed over from round-robin" {
+		t.Errorf("lru reason = %q", reason)
+	}
+}
+
+func TestHandoffLRUWorkerToRoundRobin(t *testing.T) {
+	lb := newHandoffTestBalancer("lru-worker")
+	for i := 0; i < 3; i++ {
+		if w := lb.SelectWorker(); w.Name != "worker-2" {
+			t.Fatalf("lru pick = %s, want worker-2", w.Name)
+		}
+	}
+
+	lb.SetAlgorithm("round-robin")
+	var got []string
+	for i := 0; i < 3; i++ {
+		got = append(got, lb.SelectWorker().Name)
+	}
+	want := []string{"worker-3", "worker-1", "worker-2"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("round-robin after handoff = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestHandoffStatelessStartsCold(t *testing.T) {
+	lb := newHandoffTestBalancer("least-connections")
+	lb.SelectWorker()
+	lb.SetAlgorithm("round-robin")
+	if w := lb.SelectWorker(); w.Name != "worker-1" {
+		t.Errorf("pick = %s, want a cold round-robin start", w.Name)
+	}
+
+	events := lb.events.since(0, 100)
+	last := events[len(events)-1]
+	if last.Type != "algorithm" {
+		t.Fatalf("last event = %s, want algorithm", last.Type)
+	}
+	if h, ok := last.Data["handoff"].([]string); !ok || len(h) != 0 {
+		t.Errorf("handoff = %#v, want empty", last.Data["handoff"])
+	}
+}
+
+func TestAlgorithmSessionWarmup(t *testing.T) {
+	lb := newHandoffTestBalancer("round-robin")
+	clk := newFakeClock()
+	lb.clock = clk
+	lb.sessions.warmup = 5 * time.Second
+
+	lb.SelectWorker()
+	lb.SetAlgorithm("lru-worker")
+	report := lb.AlgorithmReport()
+	if len(report) != 2 {
+		t.Fatalf("sessions = %d, want 2", len(report))
+	}
+	first, cur := report[0], report[1]
+	if first.WarmupEndsAt != nil || first.WarmingUp {
+		t.Errorf("the initial session should have no warm-up: %+v", first)
+	}
+	if cur.WarmupEndsAt == nil || !cur.WarmingUp {
+		t.Fatalf("the session after a switch should be warming up: %+v", cur)
+	}
+	if !cur.WarmupEndsAt.Equal(cur.StartedAt.Add(5 * time.Second)) {
+		t.Errorf("warmupEndsAt = %v, want start + 5s", cur.WarmupEndsAt)
+	}
+	if len(cur.Handoff) != 1 || cur.Handoff[0] != "lru-worker concentrates on worker-2" {
+		t.Errorf("handoff = %v", cur.Handoff)
+	}
+
+	clk.Advance(5 * time.Second)
+	if cur := lb.AlgorithmReport()[1]; cur.WarmingUp {
+		t.Error("warm-up should be over after 5s")
+	}
+}
+
+func TestTransactionHandsOffState(t *testing.T) {
+	lb = newHandoffTestBalancer("lru-worker")
+	lb.SelectWorker()
+	if rec := postTransaction(`{"steps":[{"op":"setAlgorithm","algorithm":"round-robin"}]}`); rec.Code != 200 {
+		t.Fatalf("transaction: %d %s", rec.Code, rec.Body.String())
+	}
+	if w := lb.SelectWorker(); w.Name != "worker-3" {
+		t.Errorf("pick = %s, want worker-3 (after lru-worker's hot worker-2)", w.Name)
+	}
+}
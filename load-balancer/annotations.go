@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Grafana annotations. GET /annotations serves the events of the event
+// store in the format of Grafana's simple annotations, so an annotation
+// query pointed at the LB overlays algorithm switches, circuit transitions,
+// drains and the like on the dashboards. An event is tagged with the part
+// of its type before the first underscore ("circuit" for circuit_opened),
+// its full type and, when it concerns one, the worker's name.
+const (
+	defaultAnnotationRange = time.Hour
+	maxAnnotationRange     = 24 * time.Hour
+	defaultAnnotationLimit = 100
+	maxAnnotationLimit     = 1000
+
+	// annotationNextHeader carries the after value that fetches the next
+	// page when a page was cut short by the limit
+	annotationNextHeader = "X-Next-After"
+)
+
+// Annotation is one event as a Grafana simple annotation. Time is in epoch
+// milliseconds.
+type Annotation struct {
+	ID    int64    `json:"id"`
+	Time  int64    `json:"time"`
+	Title string   `json:"title"`
+	Text  string   `json:"text"`
+	Tags  []string `json:"tags"`
+}
+
+// eventTags returns the annotation tags of e
+func eventTags(e Event) []string {
+	category, _, _ := strings.Cut(e.Type, "_")
+	tags := []string{category}
+	if e.Type != category {
+		tags = append(tags, e.Type)
+	}
+	if worker, ok := e.Data["worker"].(string); ok && worker != "" {
+		tags = append(tags, worker)
+	}
+	return tags
+}
+
+// between returns up to limit events with a sequence number greater than
+// after, from from up to and including to, that carry one of tags if any
+// are given. more reports whether the limit cut the page short.
+func (s *eventStore) between(from, to time.Time, tags map[string]bool, after int64, limit int) (events []Event, more bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events = make([]Event, 0)
+	for _, e := range s.events {
+		if e.Seq <= after || e.Time.Before(from) || e.Time.After(to) || !matchesTags(e, tags) {
+			continue
+		}
+		if len(events) == limit {
+			return events, true
+		}
+		events = append(events, e)
+	}
+	return events, false
+}
+
+func matchesTags(e Event, tags map[string]bool) bool {
+	if len(tags) == 0 {
+		return true
+	}
+	for _, tag := range eventTags(e) {
+		if tags[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAnnotationTime parses a from/to bound given as epoch milliseconds,
+// as Grafana sends them, or as RFC 3339
+func parseAnnotationTime(raw string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return time.UnixMilli(ms).UTC(), nil
+	}
+	return time.Parse(time.RFC3339, raw)
+}
+
+// annotationQuery is a parsed GET /annotations request
+type annotationQuery struct {
+	from, to time.Time
+	tags     map[string]bool
+	after    int64
+	limit    int
+}
+
+// parseAnnotationQuery reads the query of r. The range defaults to the
+// defaultAnnotationRange up to now and may span at most maxAnnotationRange.
+func parseAnnotationQuery(r *http.Request, now time.Time) (annotationQuery, *MetadataError) {
+	q := r.URL.Query()
+	a := annotationQuery{to: now, limit: defaultAnnotationLimit}
+	if raw := q.Get("to"); raw != "" {
+		t, err := parseAnnotationTime(raw)
+		if err != nil {
+			return a, &MetadataError{"to", "must be epoch milliseconds or an RFC 3339 time"}
+		}
+		a.to = t
+	}
+	a.from = a.to.Add(-defaultAnnotationRange)
+	if raw := q.Get("from"); raw != "" {
+		t, err := parseAnnotationTime(raw)
+		if err != nil {
+			return a, &MetadataError{"from", "must be epoch milliseconds or an RFC 3339 time"}
+		}
+		a.from = t
+	}
+	if a.from.After(a.to) {
+		return a, &MetadataError{"from", "must not be after to"}
+	}
+	if a.to.Sub(a.from) > maxAnnotationRange {
+		return a, &MetadataError{"from", fmt.Sprintf("range must not exceed %s", maxAnnotationRange)}
+	}
+	for _, tag := range strings.Split(q.Get("tags"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			if a.tags == nil {
+				a.tags = make(map[string]bool)
+			}
+			a.tags[tag] = true
+		}
+	}
+	if raw := q.Get("after"); raw != "" {
+		after, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || after < 0 {
+			return a, &MetadataError{"after", "must be a non-negative sequence number"}
+		}
+		a.after = after
+	}
+	if raw := q.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxAnnotationLimit {
+			return a, &MetadataError{"limit", fmt.Sprintf("must be between 1 and %d", maxAnnotationLimit)}
+		}
+		a.limit = limit
+	}
+	return a, nil
+}
+
+// handleAnnotations は GET /annotations?from=&to= でイベントログを Grafana の simple annotation 形式 (id, time, title, text, tags) の配列で返す HTTP ハンドラです。
+// from/to はエポックミリ秒または RFC 3339 で指定し、省略時は直近 1 時間、範囲は最大 24 時間です。?tags=circuit,algorithm でいずれかのタグを持つイベントに絞り込めます。
+// 1 ページは ?limit=<n> 件 (既定 100、最大 1000) までで、続きがある場合は X-Next-After ヘッダーの値を ?after= に渡すと次のページを取得できます。
+func handleAnnotations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := parseAnnotationQuery(r, lb.clock.Now())
+	if err != nil {
+		writeMetadataError(w, err)
+		return
+	}
+	events, more := lb.events.between(q.from, q.to, q.tags, q.after, q.limit)
+	annotations := make([]Annotation, 0, len(events))
+	for _, e := range events {
+		annotations = append(annotations, Annotation{
+			ID:    e.Seq,
+			Time:  e.Time.UnixMilli(),
+			Title: e.Type,
+			Text:  e.Message,
+			Tags:  eventTags(e),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if more {
+		w.Header().Set(annotationNextHeader, strconv.FormatInt(events[len(events)-1].Seq, 10))
+	}
+	json.NewEncoder(w).Encode(annotations)
+}
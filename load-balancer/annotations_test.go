@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func getAnnotations(t *testing.T, query string) (*httptest.ResponseRecorder, []map[string]interface{}) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/annotations?"+query, nil))
+	if rec.Code != http.StatusOK {
+		return rec, nil
+	}
+	var out []map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	return rec, out
+}
+
+func annotationIDs(annotations []map[string]interface{}) []int64 {
+	ids := []int64{}
+	for _, a := range annotations {
+		ids = append(ids, int64(a["id"].(float64)))
+	}
+	return ids
+}
+
+func TestAnnotationsRange(t *testing.T) {
+	clk := newFakeClock()
+	lb = NewLoadBalancer("round-robin")
+	lb.clock = clk
+	base := clk.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	at := func(min int) string {
+		return strconv.FormatInt(base.Add(time.Duration(min)*time.Minute).UnixMilli(), 10)
+	}
+	lb.events.add(Event{Time: base, Type: "algorithm", Message: "Algorithm changed from round-robin to random"})
+	lb.events.add(Event{Time: base.Add(10 * time.Minute), Type: "circuit_opened", Message: "Circuit of worker worker-1 opened after 3 failures", Data: map[string]interface{}{"worker": "worker-1"}})
+	lb.events.add(Event{Time: base.Add(20 * time.Minute), Type: "settings", Message: "Settings updated"})
+	lb.events.add(Event{Time: base.Add(30 * time.Minute), Type: "circuit_closed", Message: "Circuit of worker worker-1 closed", Data: map[string]interface{}{"worker": "worker-1"}})
+
+	_, out := getAnnotations(t, "from="+at(10)+"&to="+at(20))
+	if got := annotationIDs(out); !reflect.DeepEqual(got, []int64{2, 3}) {
+		t.Fatalf("10m-20m: ids %v, want [2 3]", got)
+	}
+	want := map[string]interface{}{
+		"id":    float64(2),
+		"time":  float64(base.Add(10 * time.Minute).UnixMilli()),
+		"title": "circuit_opened",
+		"text":  "Circuit of worker worker-1 opened after 3 failures",
+		"tags":  []interface{}{"circuit", "circuit_opened", "worker-1"},
+	}
+	if !reflect.DeepEqual(out[0], want) {
+		t.Errorf("annotation = %v, want %v", out[0], want)
+	}
+
+	// RFC 3339 bounds, and the last hour by default
+	_, out = getAnnotations(t, "from="+base.Add(25*time.Minute).Format(time.RFC3339Nano)+"&to="+base.Add(time.Hour).Format(time.RFC3339Nano))
+	if got := annotationIDs(out); !reflect.DeepEqual(got, []int64{4}) {
+		t.Errorf("RFC 3339 range: ids %v, want [4]", got)
+	}
+	_, out = getAnnotations(t, "")
+	if got := annotationIDs(out); !reflect.DeepEqual(got, []int64{1, 2, 3, 4}) {
+		t.Errorf("default range: ids %v, want all", got)
+	}
+
+	// Any of the tags matches
+	_, out = getAnnotations(t, "tags=circuit,algorithm")
+	if got := annotationIDs(out); !reflect.DeepEqual(got, []int64{1, 2, 4}) {
+		t.Errorf("tags=circuit,algorithm: ids %v, want [1 2 4]", got)
+	}
+	_, out = getAnnotations(t, "tags=circuit_closed")
+	if got := annotationIDs(out); !reflect.DeepEqual(got, []int64{4}) {
+		t.Errorf("tags=circuit_closed: ids %v, want [4]", got)
+	}
+
+	for _, query := range []string{
+		"from=" + at(20) + "&to=" + at(10),
+		"from=" + at(-24*60) + "&to=" + at(1),
+		"from=yesterday",
+		"limit=0",
+		"limit=5000",
+		"after=-1",
+	} {
+		if rec, _ := getAnnotations(t, query); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, rec.Code)
+		}
+	}
+}
+
+func TestAnnotationsPagination(t *testing.T) {
+	clk := newFakeClock()
+	lb = NewLoadBalancer("round-robin")
+	lb.clock = clk
+	for i := 0; i < 5; i++ {
+		lb.events.add(Event{Time: clk.Now().Add(-time.Duration(5-i) * time.Minute), Type: "settings", Message: "Settings updated"})
+	}
+
+	var pages [][]int64
+	after := "0"
+	for after != "" {
+		rec, out := getAnnotations(t, "limit=2&after="+after)
+		pages = append(pages, annotationIDs(out))
+		after = rec.Header().Get(annotationNextHeader)
+		if len(pages) > 5 {
+			t.Fatal("pagination never ended")
+		}
+	}
+	if want := [][]int64{{1, 2}, {3, 4}, {5}}; !reflect.DeepEqual(pages, want) {
+		t.Errorf("pages = %v, want %v", pages, want)
+	}
+}
+
+func TestCircuitEventsAnnotated(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", "http://localhost:8081", "#FF0000", 1)
+	w := lb.workers[0]
+	for i := 0; i < lb.circuitThreshold; i++ {
+		lb.recordFailure(w)
+	}
+	lb.mu.Lock()
+	w.CircuitState = circuitHalfOpen
+	lb.mu.Unlock()
+	lb.recordSuccess(w)
+
+	_, out := getAnnotations(t, "tags=circuit")
+	if len(out) != 2 || out[0]["title"] != "circuit_opened" || out[1]["title"] != "circuit_closed" {
+		t.Fatalf("circuit annotations = %v, want opened then closed", out)
+	}
+}
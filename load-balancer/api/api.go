@@ -0,0 +1,515 @@
+// Package api defines the request and response documents of the load
+// balancer's HTTP API. The server and the Go client both use these types so
+// the wire format cannot drift between them.
+package api
+
+import "time"
+
+// TaskRequest is the task payload accepted by /task and forwarded to workers
+type TaskRequest struct {
+	ID     string  `json:"id"`
+	Weight float64 `json:"weight"`
+	// Synthetic marks LB-generated tasks (startup verification and probes)
+	// so workers can exclude them from their own stats
+	Synthetic bool `json:"synthetic,omitempty"`
+	// Tags are free-form labels carried through to the worker and the LB's
+	// per-tag accounting. At most 8, with keys of up to 32 characters from
+	// [A-Za-z0-9_.-] and values of up to 64 characters.
+	Tags map[string]string `json:"tags,omitempty"`
+	// SessionID binds the task to a sticky session when the request has no
+	// X-Session-ID header
+	SessionID string `json:"sessionId,omitempty"`
+}
+
+// TaskResponse is a worker's reply to a task, annotated by the LB with the
+// worker that served it and the end-to-end processing time
+type TaskResponse struct {
+	ID               string `json:"id"`
+	Worker           string `json:"worker"`
+	WorkerColor      string `json:"workerColor"`
+	Color            string `json:"color,omitempty"`
+	ProcessingTimeMs int64  `json:"processingTimeMs"`
+	Timestamp        string `json:"timestamp,omitempty"`
+	// Tags echoes the task's tags
+	Tags map[string]string `json:"tags,omitempty"`
+	// Retries is how many other attempts failed before the one that
+	// answered
+	Retries int `json:"retries"`
+}
+
+// ErrorResponse is the structured error body returned by the API. Field is
+// set when a specific input field was rejected; Worker and Eligible are set
+// when a required worker could not be used. Excluded maps every worker to the
+// reason it was not a candidate when a task found no eligible worker.
+type ErrorResponse struct {
+	Error    string            `json:"error"`
+	Field    string            `json:"field,omitempty"`
+	Worker   string            `json:"worker,omitempty"`
+	Eligible []string          `json:"eligible,omitempty"`
+	Excluded map[string]string `json:"excluded,omitempty"`
+	Unknown  []string          `json:"unknown,omitempty"`
+	// ElapsedMs is how long a task that timed out had run
+	ElapsedMs int64 `json:"elapsedMs,omitempty"`
+	// RequestID identifies the request in the LB's logs; set on internal
+	// errors
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// WorkerStatus is a worker's entry in the status document
+type WorkerStatus struct {
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	Color       string `json:"color"`
+	Weight      int    `json:"weight"`
+	MaxLoad     int    `json:"maxLoad"`
+	Healthy     bool   `json:"healthy"`
+	CurrentLoad int32  `json:"currentLoad"`
+	Enabled     bool   `json:"enabled"`
+	// Draining is set while a disabled worker finishes its in-flight tasks,
+	// and while a worker drained on its own stays drained
+	Draining bool `json:"draining"`
+	// HealthPath is the path health checks probe on the worker
+	HealthPath string `json:"healthPath"`
+	// HealthIntervalMs and HealthTimeoutMs are the worker's health check
+	// interval and timeout in ms, its own or the pool's
+	HealthIntervalMs int64 `json:"healthIntervalMs"`
+	HealthTimeoutMs  int64 `json:"healthTimeoutMs"`
+	// Saturated is set while the worker has MaxLoad tasks in flight
+	Saturated      bool              `json:"saturated"`
+	TotalRequests  int64             `json:"totalRequests"`
+	FailedRequests int64             `json:"failedRequests"`
+	CircuitOpen    bool              `json:"circuitOpen"`
+	CircuitState   string            `json:"circuitState"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	DisplayName    string            `json:"displayName,omitempty"`
+	Description    string            `json:"description,omitempty"`
+	Icon           string            `json:"icon,omitempty"`
+	Revision       int64             `json:"revision"`
+	Probe          *ProbeSummary     `json:"probe,omitempty"`
+	Schedule       *WorkerSchedule   `json:"schedule,omitempty"`
+	Rejections     []Rejection       `json:"rejections,omitempty"`
+	HealthExpr     *HealthExpr       `json:"healthExpr,omitempty"`
+	HealthState    string            `json:"healthState"`
+	HealthReason   string            `json:"healthReason,omitempty"`
+	// ExpectedLatencyMs is the latency the worker advertised in its last
+	// health check
+	ExpectedLatencyMs int64             `json:"expectedLatencyMs,omitempty"`
+	ResolvedIP        string            `json:"resolvedIP,omitempty"`
+	PaceRate          float64           `json:"paceRate,omitempty"`
+	Malformed         *MalformedSummary `json:"malformed,omitempty"`
+	// ReportedName is the name the worker last reported for itself;
+	// Misconfigured is set while it differs from Name
+	ReportedName  string `json:"reportedName,omitempty"`
+	Misconfigured bool   `json:"misconfigured,omitempty"`
+	// CircuitThreshold is the worker's own circuit threshold, 0 when it
+	// uses the pool's
+	CircuitThreshold int `json:"circuitThreshold,omitempty"`
+	// Runtime is the worker's implementation, inferred from its name
+	// unless set explicitly
+	Runtime string `json:"runtime"`
+	// NextProbeAt is when an open circuit lets its next probe through
+	NextProbeAt *time.Time `json:"nextProbeAt,omitempty"`
+	// NextHealthCheck is when a worker whose health checks back off after
+	// failing is checked next
+	NextHealthCheck *time.Time `json:"nextHealthCheck,omitempty"`
+	// LatencyEWMAMs is the exponentially weighted mean latency of the tasks
+	// the worker served since it last recovered; least-latency routes on it
+	LatencyEWMAMs float64 `json:"latencyEwmaMs,omitempty"`
+	// RequestTimeoutMs caps the deadline of the tasks forwarded to the
+	// worker, when set
+	RequestTimeoutMs int64 `json:"requestTimeoutMs,omitempty"`
+	// Rps, ErrorRate and P50Ms/P95Ms/P99Ms describe the tasks the worker
+	// served in the last minute
+	Rps       float64 `json:"rps"`
+	ErrorRate float64 `json:"errorRate"`
+	P50Ms     float64 `json:"p50Ms"`
+	P95Ms     float64 `json:"p95Ms"`
+	P99Ms     float64 `json:"p99Ms"`
+}
+
+// MalformedSummary counts the 2xx task responses of a worker whose body was
+// not a JSON object. LastSample is the start of the last such body.
+type MalformedSummary struct {
+	Count      int64     `json:"count"`
+	LastSample string    `json:"lastSample"`
+	LastAt     time.Time `json:"lastAt"`
+}
+
+// HealthExpr configures how a worker's health checks are judged. Unhealthy
+// fails the check when true; Degraded marks a passing worker as degraded.
+// Expressions compare fields of the worker's /health body (status,
+// currentLoad, queueDepth) and of the check itself (httpStatus, latencyMs,
+// probeLatencyMs, maxLoad) with number, string and boolean operators, e.g.
+// "queueDepth > 40 || currentLoad / maxLoad > 0.8". When both are empty a
+// worker is healthy exactly when /health returns 200.
+type HealthExpr struct {
+	Unhealthy string `json:"unhealthy,omitempty"`
+	Degraded  string `json:"degraded,omitempty"`
+}
+
+// Rejection is a task the worker turned away for lack of capacity. Reason is
+// queue_full or overloaded.
+type Rejection struct {
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// ScheduleWindow is a repeating window during which Action applies to a
+// worker. Periods are aligned to the Unix epoch: the window is active while
+// (now - OffsetMs) mod PeriodMs < DurationMs.
+type ScheduleWindow struct {
+	PeriodMs   int64  `json:"periodMs"`
+	OffsetMs   int64  `json:"offsetMs"`
+	DurationMs int64  `json:"durationMs"`
+	Action     string `json:"action"`
+}
+
+// WorkerSchedule is a worker's schedule, the actions currently in effect and
+// when the next window starts or ends
+type WorkerSchedule struct {
+	Windows        []ScheduleWindow `json:"windows"`
+	Active         []string         `json:"active"`
+	NextTransition *time.Time       `json:"nextTransition,omitempty"`
+}
+
+// ProbeSummary summarizes the synthetic probes sent to a worker
+type ProbeSummary struct {
+	Sent          int64      `json:"sent"`
+	Failed        int64      `json:"failed"`
+	LastLatencyMs int64      `json:"lastLatencyMs"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastAt        *time.Time `json:"lastAt,omitempty"`
+}
+
+// Status is the document served by /status and pushed over /ws
+type Status struct {
+	Algorithm string                 `json:"algorithm"`
+	Workers   []WorkerStatus         `json:"workers"`
+	Settings  Settings               `json:"settings"`
+	EventSeq  int64                  `json:"eventSeq"`
+	LRUWorker map[string]interface{} `json:"lruWorker,omitempty"`
+	LB        *SelfMetrics           `json:"lb,omitempty"`
+	// ListenAddrs are the addresses the LB is bound to
+	ListenAddrs []string   `json:"listenAddrs,omitempty"`
+	Shed        ShedStatus `json:"shed"`
+	Loops       Loops      `json:"loops"`
+	// Distribution is the verdict of the last distribution verification
+	// window, nil until one completes
+	Distribution *DistributionVerdict `json:"distribution"`
+	// Experiment is the running algorithm experiment, if any. While it runs
+	// requests are split between two algorithms.
+	Experiment *ExperimentStatus `json:"experiment,omitempty"`
+	// Runtimes summarizes the workers by runtime
+	Runtimes []RuntimeSummary `json:"runtimes"`
+	// Pool aggregates every worker, including those a summary leaves out
+	Pool PoolSummary `json:"pool"`
+	// StickySessions is the number of sessions the sticky algorithm tracks
+	StickySessions int `json:"stickySessions"`
+	// BroadcastMode is set on WebSocket messages: "full" lists every
+	// worker, "summary" only those changed since the previous broadcast
+	// plus the busiest, with RemovedWorkers naming the ones that left
+	BroadcastMode  string   `json:"broadcastMode,omitempty"`
+	RemovedWorkers []string `json:"removedWorkers,omitempty"`
+}
+
+// PoolSummary aggregates the pool's workers
+type PoolSummary struct {
+	Workers        int   `json:"workers"`
+	HealthyWorkers int   `json:"healthyWorkers"`
+	EnabledWorkers int   `json:"enabledWorkers"`
+	OpenCircuits   int   `json:"openCircuits"`
+	CurrentLoad    int64 `json:"currentLoad"`
+	TotalRequests  int64 `json:"totalRequests"`
+	FailedRequests int64 `json:"failedRequests"`
+}
+
+// RuntimeSummary aggregates the workers of one runtime (go, rust, python,
+// ...) over their cumulative stats. SuccessRate and the latency
+// percentiles are nil while the runtime has served no requests.
+type RuntimeSummary struct {
+	Runtime        string   `json:"runtime"`
+	Workers        int      `json:"workers"`
+	HealthyWorkers int      `json:"healthyWorkers"`
+	Requests       int64    `json:"requests"`
+	Errors         int64    `json:"errors"`
+	SuccessRate    *float64 `json:"successRate"`
+	P50LatencyMs   *float64 `json:"p50LatencyMs"`
+	P95LatencyMs   *float64 `json:"p95LatencyMs"`
+	P99LatencyMs   *float64 `json:"p99LatencyMs"`
+}
+
+// ExperimentStatus is a running experiment: SplitPercent of the requests
+// are routed with algorithm A, the rest with B, until EndsAt
+type ExperimentStatus struct {
+	ID           int64     `json:"id"`
+	A            string    `json:"a"`
+	B            string    `json:"b"`
+	SplitPercent int       `json:"splitPercent"`
+	StartedAt    time.Time `json:"startedAt"`
+	EndsAt       time.Time `json:"endsAt"`
+}
+
+// Loops reports the LB's periodic background loops
+type Loops struct {
+	Broadcast   LoopStatus `json:"broadcast"`
+	HealthCheck LoopStatus `json:"healthCheck"`
+}
+
+// LoopStatus is a background loop's interval and the time it last ran, nil
+// until it first does. A LastTick older than a few intervals means the loop
+// is stalled.
+type LoopStatus struct {
+	IntervalMs int64      `json:"intervalMs"`
+	LastTick   *time.Time `json:"lastTick"`
+}
+
+// DistributionVerdict is the outcome of comparing one window's per-worker
+// request counts with the split the algorithm should produce. Verdict is
+// "ok", "anomaly" or "skipped", with SkipReason "churn" (membership, weights
+// or algorithm changed), "no_model" (the algorithm or pool has no fixed
+// expected split) or "low_volume". Deviation is the chi-square statistic
+// divided by Requests, so it does not grow with volume; the window is an
+// anomaly when it exceeds Threshold.
+type DistributionVerdict struct {
+	WindowStart time.Time           `json:"windowStart"`
+	WindowEnd   time.Time           `json:"windowEnd"`
+	Algorithm   string              `json:"algorithm"`
+	Requests    int64               `json:"requests"`
+	Verdict     string              `json:"verdict"`
+	SkipReason  string              `json:"skipReason,omitempty"`
+	Deviation   float64             `json:"deviation"`
+	Threshold   float64             `json:"threshold"`
+	Workers     []DistributionShare `json:"workers,omitempty"`
+}
+
+// DistributionShare is a worker's observed and expected share of a window
+type DistributionShare struct {
+	Worker   string  `json:"worker"`
+	Requests int64   `json:"requests"`
+	Observed float64 `json:"observed"`
+	Expected float64 `json:"expected"`
+}
+
+// ShedStatus is the LB's load shedding level: 0 none, 1 probes, 2
+// broadcasts, 3 low_priority. Each level also sheds what the lower ones do.
+// Reason is the threshold that caused the last escalation.
+type ShedStatus struct {
+	Level  int    `json:"level"`
+	Name   string `json:"name"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// SelfMetrics describes the LB process itself. It is sampled at most once per
+// second; SampledAt is the time of the sample.
+type SelfMetrics struct {
+	InstanceID       string    `json:"instanceId"`
+	Version          string    `json:"version"`
+	UptimeSeconds    float64   `json:"uptimeSeconds"`
+	Goroutines       int       `json:"goroutines"`
+	HeapAllocBytes   uint64    `json:"heapAllocBytes"`
+	HeapInuseBytes   uint64    `json:"heapInuseBytes"`
+	GCPauseRate      float64   `json:"gcPauseRate"`
+	InFlightRequests int64     `json:"inFlightRequests"`
+	WSClients        int       `json:"wsClients"`
+	BroadcastQueue   int       `json:"broadcastQueue"`
+	SampledAt        time.Time `json:"sampledAt"`
+}
+
+// Settings is the runtime-tunable configuration of the load balancer. All
+// durations are expressed in milliseconds.
+type Settings struct {
+	CircuitThreshold int `json:"circuitThreshold"`
+	// CircuitResetIntervalMs is how long a worker's circuit stays open before
+	// one probe request is let through; the probe closes it on success and
+	// opens it again for twice as long on failure
+	CircuitResetIntervalMs int64 `json:"circuitResetIntervalMs"`
+	HealthIntervalMs       int64 `json:"healthIntervalMs"`
+	HealthTimeoutMs        int64 `json:"healthTimeoutMs"`
+	// BroadcastIntervalMs is the interval of the WebSocket status broadcast
+	BroadcastIntervalMs int64 `json:"broadcastIntervalMs"`
+	HealthRise          int   `json:"healthRise"`
+	HealthFall          int   `json:"healthFall"`
+	UpstreamTimeoutMs   int64 `json:"upstreamTimeoutMs"`
+	// ProbeEnabled turns on synthetic probe traffic to every enabled worker
+	// at ProbeRps requests per second per worker
+	ProbeEnabled bool    `json:"probeEnabled"`
+	ProbeRps     float64 `json:"probeRps"`
+	// MaxUpstreamBodyBytes caps the response body read from a worker; larger
+	// responses fail with 502. They are charged to the circuit breaker only
+	// if BodyTooLargeTripsCircuit is set.
+	MaxUpstreamBodyBytes     int64 `json:"maxUpstreamBodyBytes"`
+	BodyTooLargeTripsCircuit bool  `json:"bodyTooLargeTripsCircuit"`
+	// RetryOnQueueFull and RetryOnOverloaded retry a task once on another
+	// worker when the selected worker rejects it for that reason
+	RetryOnQueueFull  bool `json:"retryOnQueueFull"`
+	RetryOnOverloaded bool `json:"retryOnOverloaded"`
+	// MaxRetries is how many times a failed task (a worker error, a 5xx or
+	// a rejection covered above) is retried, each time on a worker that has
+	// not failed it yet; 0 disables retries
+	MaxRetries int `json:"maxRetries"`
+	// JournalEnabled appends one JSON line per proxied task to JournalPath,
+	// rotating it to JournalPath.1 once it would exceed JournalMaxBytes.
+	// JournalSampleRate is the fraction of tasks journaled (0..1).
+	JournalEnabled    bool    `json:"journalEnabled"`
+	JournalPath       string  `json:"journalPath"`
+	JournalMaxBytes   int64   `json:"journalMaxBytes"`
+	JournalSampleRate float64 `json:"journalSampleRate"`
+	// DedupWindowMs answers a /task whose id and body match one in flight or
+	// completed less than this long ago from the original instead of
+	// forwarding it again; 0 disables de-duplication. DedupPolicy is
+	// "replay" (return the original's response) or "reject" (409 with the
+	// original's request ID).
+	DedupWindowMs int64  `json:"dedupWindowMs"`
+	DedupPolicy   string `json:"dedupPolicy"`
+	// ShedMaxGoroutines, ShedMaxHeapBytes and ShedMaxSchedLatencyMs are the
+	// self-health thresholds beyond which the LB sheds load one level per
+	// second; 0 disables a threshold. It recovers a level per second once
+	// every reading is below 80% of its threshold.
+	ShedMaxGoroutines     int   `json:"shedMaxGoroutines"`
+	ShedMaxHeapBytes      int64 `json:"shedMaxHeapBytes"`
+	ShedMaxSchedLatencyMs int64 `json:"shedMaxSchedLatencyMs"`
+	// TagCardinalityLimit bounds the distinct values accounted per tag key.
+	// Beyond it TagOverflowPolicy "hash" accounts new values under one of 16
+	// overflow buckets and "reject" answers the task with 400.
+	TagCardinalityLimit int    `json:"tagCardinalityLimit"`
+	TagOverflowPolicy   string `json:"tagOverflowPolicy"`
+	// PacingEnabled paces tasks to each worker's rate with a leaky bucket
+	// holding PacingBurst tasks. A task that would overflow its worker goes
+	// to another candidate with room or, when none has, waits at most
+	// PacingMaxDelayMs; beyond that it is sent anyway.
+	PacingEnabled    bool  `json:"pacingEnabled"`
+	PacingMaxDelayMs int64 `json:"pacingMaxDelayMs"`
+	PacingBurst      int   `json:"pacingBurst"`
+	// MalformedResponseMode is what the LB does with a 2xx task response
+	// that is not a JSON object: "lenient" answers {} plus the LB fields,
+	// "strict" fails the task with 502 (charged to the circuit breaker only
+	// if MalformedTripsCircuit is set) and "passthrough" forwards the body
+	// with its content type and the LB fields in X-LB-* headers.
+	MalformedResponseMode string `json:"malformedResponseMode"`
+	MalformedTripsCircuit bool   `json:"malformedTripsCircuit"`
+	// DistributionThreshold is the deviation (chi-square per request) of a
+	// one-minute window's per-worker counts from the algorithm's expected
+	// split beyond which the LB raises a distribution_anomaly event. Windows
+	// with fewer than DistributionMinRequests requests are skipped.
+	DistributionThreshold   float64 `json:"distributionThreshold"`
+	DistributionMinRequests int64   `json:"distributionMinRequests"`
+	// SlowRequestMs is the duration beyond which a request to the LB's own
+	// endpoints is logged as slow with its request ID; 0 disables the log
+	SlowRequestMs int64 `json:"slowRequestMs"`
+	// IdentityCheck is what the LB does when a worker reports a name other
+	// than its configured one: "off" ignores it, "warn" flags the worker as
+	// misconfigured and "strict" also excludes it from selection
+	IdentityCheck string `json:"identityCheck"`
+	// ResponseDetail is how much a successful /task response carries when
+	// the request does not ask with X-LB-Response-Detail: "none" answers
+	// 204 with the LB fields in X-LB-* headers, "basic" forwards the
+	// worker's body untouched with those headers and "full" merges the LB
+	// fields into the body
+	ResponseDetail string `json:"responseDetail"`
+	// CircuitMaxCooldownMs caps how long failed probes keep a circuit open
+	CircuitMaxCooldownMs int64 `json:"circuitMaxCooldownMs"`
+	// MaxHealthBackoffMs caps how far a worker's health checks back off
+	// while they keep failing; 0 checks failing workers at their interval
+	MaxHealthBackoffMs int64 `json:"maxHealthBackoffMs"`
+	// ResourceCheckTTLMs is how long the resource-aware algorithm reuses a
+	// worker's reported load before checking its /health again
+	ResourceCheckTTLMs int64 `json:"resourceCheckTtlMs"`
+	// BroadcastSummaryThreshold is the worker count from which WebSocket
+	// broadcasts switch to the summary form, unless a client subscribed
+	// with ?full=1; 0 always broadcasts the full form. BroadcastTopN is how
+	// many of the busiest workers a summary carries besides the changed ones.
+	BroadcastSummaryThreshold int `json:"broadcastSummaryThreshold"`
+	BroadcastTopN             int `json:"broadcastTopN"`
+	// PhaseSampleRate times one in this many tasks through the phases of
+	// handling them, reported at /debug/phases; 0 disables the sampling
+	PhaseSampleRate int `json:"phaseSampleRate"`
+	// RateCeilingRps caps the tasks the pool admits per second, shared
+	// fairly between clients over accounting windows of RateWindowMs; 0
+	// disables the ceiling
+	RateCeilingRps float64 `json:"rateCeilingRps"`
+	RateWindowMs   int64   `json:"rateWindowMs"`
+}
+
+// AlgorithmRequest selects the load balancing algorithm
+type AlgorithmRequest struct {
+	Algorithm string `json:"algorithm"`
+}
+
+// AlgorithmResponse reports the current and available algorithms
+type AlgorithmResponse struct {
+	Algorithm string   `json:"algorithm"`
+	Available []string `json:"available"`
+}
+
+// WorkerUpdate changes a worker's enabled flag, weight, display metadata and
+// health expressions; nil fields are left unchanged. Color must be a hex color
+// (#RGB or #RRGGBB). A HealthExpr with both expressions empty removes them.
+// PaceRate is the rate in tasks per second the worker is paced at when
+// pacing is enabled; 0 paces it at its observed rate. CircuitThreshold is
+// the number of consecutive failures that opens the worker's circuit; 0
+// uses the pool's circuitThreshold.
+type WorkerUpdate struct {
+	Enabled     *bool       `json:"enabled,omitempty"`
+	Weight      *int        `json:"weight,omitempty"`
+	Color       *string     `json:"color,omitempty"`
+	DisplayName *string     `json:"displayName,omitempty"`
+	Description *string     `json:"description,omitempty"`
+	Icon        *string     `json:"icon,omitempty"`
+	HealthExpr  *HealthExpr `json:"healthExpr,omitempty"`
+	PaceRate    *float64    `json:"paceRate,omitempty"`
+
+	CircuitThreshold *int `json:"circuitThreshold,omitempty"`
+	// Runtime overrides the runtime inferred from the name; "" restores
+	// the inferred one
+	Runtime *string `json:"runtime,omitempty"`
+	// HealthPath is the path health checks probe; "" restores /health
+	HealthPath *string `json:"healthPath,omitempty"`
+	// HealthIntervalMs and HealthTimeoutMs override the pool's health
+	// check interval and timeout for this worker; 0 restores the pool's
+	HealthIntervalMs *int64 `json:"healthIntervalMs,omitempty"`
+	HealthTimeoutMs  *int64 `json:"healthTimeoutMs,omitempty"`
+	// Draining stops new tasks to an enabled worker while those in flight
+	// finish, without disabling it; false lifts it. A disabled worker
+	// ignores it.
+	Draining *bool `json:"draining,omitempty"`
+	// RequestTimeoutMs caps the deadline of the tasks forwarded to the
+	// worker; 0 removes the cap
+	RequestTimeoutMs *int64 `json:"requestTimeoutMs,omitempty"`
+}
+
+// AddWorkerRequest registers a new worker with the pool. When Color is empty
+// an unused color is assigned from the palette.
+type AddWorkerRequest struct {
+	Name        string            `json:"name"`
+	URL         string            `json:"url"`
+	Color       string            `json:"color,omitempty"`
+	Weight      int               `json:"weight,omitempty"`
+	MaxLoad     int               `json:"maxLoad,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	DisplayName string            `json:"displayName,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Icon        string            `json:"icon,omitempty"`
+	// CircuitThreshold overrides the pool's circuitThreshold when positive
+	CircuitThreshold int `json:"circuitThreshold,omitempty"`
+	// Runtime overrides the runtime inferred from the name
+	Runtime string `json:"runtime,omitempty"`
+	// HealthPath is the path health checks probe, /health when empty
+	HealthPath string `json:"healthPath,omitempty"`
+}
+
+// CircuitState is a worker's circuit breaker state. State is closed, open
+// or half-open; Open is set in the latter two. OpenedAt is when the circuit
+// last opened or was reopened by a failed probe.
+type CircuitState struct {
+	Worker         string     `json:"worker"`
+	Open           bool       `json:"open"`
+	State          string     `json:"state"`
+	OpenedAt       *time.Time `json:"openedAt,omitempty"`
+	Healthy        bool       `json:"healthy"`
+	ConsecFailures int        `json:"consecFailures"`
+	Threshold      int        `json:"threshold"`
+	// NextProbeAt is when an open circuit lets its next probe through and
+	// CooldownMs how long it stays open, doubled by every failed probe
+	NextProbeAt *time.Time `json:"nextProbeAt,omitempty"`
+	CooldownMs  int64      `json:"cooldownMs,omitempty"`
+}
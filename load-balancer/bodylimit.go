@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// Upstream response bodies larger than this are rejected instead of being
+// buffered in full
+const (
+	defaultMaxUpstreamBodyBytes = 10 << 20
+	minMaxUpstreamBodyBytes     = 1 << 10
+)
+
+// errBodyTooLarge is returned by readLimited when the body exceeds the cap
+var errBodyTooLarge = errors.New("upstream response body too large")
+
+// readLimited reads at most limit bytes from r. If r holds more, reading stops
+// after limit+1 bytes and errBodyTooLarge is returned; the caller should then
+// close the body, which aborts the rest of the transfer.
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, errBodyTooLarge
+	}
+	return body, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newEndlessStub streams an endless JSON-looking body until the client goes
+// away
+func newEndlessStub(t *testing.T) *httptest.Server {
+	t.Helper()
+	chunk := bytes.Repeat([]byte("x"), 32<<10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"padding":"`))
+		for {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			select {
+			case <-r.Context().Done():
+				return
+			default:
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestUpstreamBodyTooLarge(t *testing.T) {
+	for _, trips := range []bool{false, true} {
+		name := "not charged"
+		if trips {
+			name = "charged to circuit"
+		}
+		t.Run(name, func(t *testing.T) {
+			srv := newEndlessStub(t)
+			lb = NewLoadBalancer("round-robin")
+			lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+			s := lb.Settings()
+			s.MaxUpstreamBodyBytes = 64 << 10
+			s.BodyTooLargeTripsCircuit = trips
+			s.CircuitThreshold = 1
+			if _, err := lb.UpdateSettings(s); err != nil {
+				t.Fatalf("UpdateSettings: %v", err)
+			}
+			tooLarge := testutil.ToFloat64(lb.metrics.upstreamBodyTooLarge.WithLabelValues("worker-1"))
+
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			start := time.Now()
+			rec := doTask(nil)
+			elapsed := time.Since(start)
+			runtime.ReadMemStats(&after)
+
+			if rec.Code != http.StatusBadGateway {
+				t.Fatalf("status code = %d, want %d", rec.Code, http.StatusBadGateway)
+			}
+			if !bytes.Contains(rec.Body.Bytes(), []byte("exceeds 65536 bytes")) {
+				t.Errorf("body = %s, want size error", rec.Body.String())
+			}
+			if elapsed > 2*time.Second {
+				t.Errorf("took %v, want a prompt response", elapsed)
+			}
+			if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 8<<20 {
+				t.Errorf("allocated %d bytes reading a capped body", alloc)
+			}
+			if got := testutil.ToFloat64(lb.metrics.upstreamBodyTooLarge.WithLabelValues("worker-1")) - tooLarge; got != 1 {
+				t.Errorf("too large counter delta = %v, want 1", got)
+			}
+			if open := lb.workers[0].circuitOpen(); open != trips {
+				t.Errorf("circuit open = %v, want %v", open, trips)
+			}
+		})
+	}
+}
+
+func TestWorkerConfigProxyBodyLimit(t *testing.T) {
+	srv := newEndlessStub(t)
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+	s := lb.Settings()
+	s.MaxUpstreamBodyBytes = 64 << 10
+	lb.UpdateSettings(s)
+	tooLarge := testutil.ToFloat64(lb.metrics.upstreamBodyTooLarge.WithLabelValues("worker-1"))
+
+	rec := httptest.NewRecorder()
+	handleWorkerConfig(rec, httptest.NewRequest(http.MethodGet, "/workers/worker-1/config", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("status code = %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+	if got := testutil.ToFloat64(lb.metrics.upstreamBodyTooLarge.WithLabelValues("worker-1")) - tooLarge; got != 1 {
+		t.Errorf("too large counter delta = %v, want 1", got)
+	}
+
+	s.MaxUpstreamBodyBytes = 10
+	if _, err := lb.UpdateSettings(s); err == nil {
+		t.Error("maxUpstreamBodyBytes below the minimum should be rejected")
+	}
+}
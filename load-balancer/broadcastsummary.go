@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"sort"
+	"sync/atomic"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// Broadcast degradation. With hundreds of workers a full status every
+// broadcast is too large for browsers, so from BroadcastSummaryThreshold
+// workers on the broadcasts carry the pool aggregates, the workers whose
+// entry changed since the previous broadcast and the BroadcastTopN busiest
+// workers. Clients connecting with ?full=1 keep getting the full form, and
+// every client is sent the full form when it connects, which the summaries
+// are applied on top of.
+const (
+	defaultBroadcastSummaryThreshold = 200
+	defaultBroadcastTopN             = 10
+	broadcastFull                    = "full"
+	broadcastSummary                 = "summary"
+)
+
+// PoolSummary aggregates the pool's workers
+type PoolSummary = api.PoolSummary
+
+// poolSummaryLocked aggregates the workers. Must be called with lb.mu held.
+func (lb *LoadBalancer) poolSummaryLocked() PoolSummary {
+	var p PoolSummary
+	for _, w := range lb.workers {
+		p.Workers++
+		if w.Healthy {
+			p.HealthyWorkers++
+		}
+		if w.Enabled {
+			p.EnabledWorkers++
+		}
+		if w.circuitOpen() {
+			p.OpenCircuits++
+		}
+		p.CurrentLoad += int64(atomic.LoadInt32(&w.CurrentLoad))
+		p.TotalRequests += atomic.LoadInt64(&w.TotalRequests)
+		p.FailedRequests += atomic.LoadInt64(&w.FailedRequests)
+	}
+	return p
+}
+
+// broadcastForms returns the full form of status and, when the pool has
+// reached the summary threshold, the summary form. It records the entry of
+// every worker so the next summary can tell which changed. Must be called
+// with lb.wsClientsMu held.
+func (lb *LoadBalancer) broadcastForms(status map[string]interface{}) (full, summary map[string]interface{}) {
+	workers, _ := status["workers"].([]map[string]interface{})
+	digests := make(map[string]uint64, len(workers))
+	changed := make([]bool, len(workers))
+	for i, w := range workers {
+		name, _ := w["name"].(string)
+		data, _ := json.Marshal(w)
+		h := fnv.New64a()
+		h.Write(data)
+		digests[name] = h.Sum64()
+		prev, ok := lb.broadcastDigests[name]
+		changed[i] = !ok || prev != digests[name]
+	}
+	var removed []string
+	for name := range lb.broadcastDigests {
+		if _, ok := digests[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(removed)
+	lb.broadcastDigests = digests
+
+	full = withBroadcastMode(status, broadcastFull)
+	settings, _ := status["settings"].(Settings)
+	if settings.BroadcastSummaryThreshold <= 0 || len(workers) < settings.BroadcastSummaryThreshold {
+		return full, nil
+	}
+	for _, i := range busiestWorkers(workers, settings.BroadcastTopN) {
+		changed[i] = true
+	}
+	kept := make([]map[string]interface{}, 0)
+	for i, w := range workers {
+		if changed[i] {
+			kept = append(kept, w)
+		}
+	}
+	summary = withBroadcastMode(status, broadcastSummary)
+	summary["workers"] = kept
+	if len(removed) > 0 {
+		summary["removedWorkers"] = removed
+	}
+	return full, summary
+}
+
+// busiestWorkers returns the indexes of the n workers with the most
+// requests in flight, ties going to the higher error rate and then the name
+func busiestWorkers(workers []map[string]interface{}, n int) []int {
+	if n <= 0 {
+		return nil
+	}
+	type rank struct {
+		i       int
+		name    string
+		load    int32
+		errRate float64
+	}
+	ranks := make([]rank, len(workers))
+	for i, w := range workers {
+		r := rank{i: i}
+		r.name, _ = w["name"].(string)
+		r.load, _ = w["currentLoad"].(int32)
+		total, _ := w["totalRequests"].(int64)
+		failed, _ := w["failedRequests"].(int64)
+		if total > 0 {
+			r.errRate = float64(failed) / float64(total)
+		}
+		ranks[i] = r
+	}
+	sort.Slice(ranks, func(a, b int) bool {
+		if ranks[a].load != ranks[b].load {
+			return ranks[a].load > ranks[b].load
+		}
+		if ranks[a].errRate != ranks[b].errRate {
+			return ranks[a].errRate > ranks[b].errRate
+		}
+		return ranks[a].name < ranks[b].name
+	})
+	if n > len(ranks) {
+		n = len(ranks)
+	}
+	out := make([]int, n)
+	for k := range out {
+		out[k] = ranks[k].i
+	}
+	return out
+}
+
+// withBroadcastMode returns a copy of status marked with the mode
+func withBroadcastMode(status map[string]interface{}, mode string) map[string]interface{} {
+	out := make(map[string]interface{}, len(status)+1)
+	for k, v := range status {
+		out[k] = v
+	}
+	out["broadcastMode"] = mode
+	return out
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// readBroadcast reads the next status message from conn
+func readBroadcast(t *testing.T, conn *websocket.Conn) api.Status {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var s api.Status
+	if err := conn.ReadJSON(&s); err != nil {
+		t.Fatalf("read broadcast: %v", err)
+	}
+	return s
+}
+
+func workerNames(s api.Status) map[string]bool {
+	out := make(map[string]bool, len(s.Workers))
+	for _, w := range s.Workers {
+		out[w.Name] = true
+	}
+	return out
+}
+
+func TestBroadcastSummary(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	for i := 0; i < defaultBroadcastSummaryThreshold-1; i++ {
+		lb.AddWorker(fmt.Sprintf("worker-%03d", i), fmt.Sprintf("http://10.0.0.1:%d", 9000+i), "#FF0000", 1)
+	}
+	srv := httptest.NewServer(newMux())
+	defer srv.Close()
+	plain := dialWS(t, srv, "", nil)
+	full := dialWS(t, srv, "?full=1", nil)
+
+	// Below the threshold everyone gets the full form
+	lb.BroadcastStatus()
+	for _, conn := range []*websocket.Conn{plain, full} {
+		if s := readBroadcast(t, conn); s.BroadcastMode != broadcastFull || len(s.Workers) != defaultBroadcastSummaryThreshold-1 {
+			t.Fatalf("below the threshold: mode %q with %d workers", s.BroadcastMode, len(s.Workers))
+		}
+	}
+
+	// Reaching it switches to the summary: the new worker plus the busiest
+	lb.AddWorker("worker-new", "http://10.0.0.2:9000", "#00FF00", 1)
+	atomic.StoreInt32(&lb.workers[150].CurrentLoad, 3)
+	lb.BroadcastStatus()
+	s := readBroadcast(t, plain)
+	names := workerNames(s)
+	if s.BroadcastMode != broadcastSummary || len(s.Workers) != defaultBroadcastTopN+1 {
+		t.Fatalf("at the threshold: mode %q with %d workers", s.BroadcastMode, len(s.Workers))
+	}
+	if !names["worker-new"] || !names["worker-150"] {
+		t.Errorf("summary workers = %v, want the added and the busiest worker", names)
+	}
+	if s.Pool.Workers != defaultBroadcastSummaryThreshold || s.Pool.CurrentLoad != 3 {
+		t.Errorf("pool = %+v", s.Pool)
+	}
+	if f := readBroadcast(t, full); f.BroadcastMode != broadcastFull || len(f.Workers) != defaultBroadcastSummaryThreshold {
+		t.Errorf("full subscriber got mode %q with %d workers", f.BroadcastMode, len(f.Workers))
+	}
+
+	// Only what changed since the last broadcast, besides the top N
+	lb.mu.Lock()
+	lb.workers[42].Healthy = false
+	lb.mu.Unlock()
+	lb.AddWorker("worker-extra", "http://10.0.0.2:9001", "#0000FF", 1)
+	if _, err := lb.unregisterWorker("worker-007", true); err != nil {
+		t.Fatal(err)
+	}
+	lb.BroadcastStatus()
+	s = readBroadcast(t, plain)
+	names = workerNames(s)
+	if s.BroadcastMode != broadcastSummary || len(s.Workers) != defaultBroadcastTopN+2 || !names["worker-042"] || !names["worker-extra"] || names["worker-new"] {
+		t.Errorf("changed-only summary = %v, want the top %d, worker-042 and worker-extra", names, defaultBroadcastTopN)
+	}
+	if len(s.RemovedWorkers) != 1 || s.RemovedWorkers[0] != "worker-007" {
+		t.Errorf("removed = %v, want [worker-007]", s.RemovedWorkers)
+	}
+	if s.Pool.Workers != defaultBroadcastSummaryThreshold || s.Pool.HealthyWorkers != s.Pool.Workers-1 {
+		t.Errorf("pool = %+v", s.Pool)
+	}
+	readBroadcast(t, full)
+
+	// The threshold is a setting; 0 turns summaries off
+	resp, err := http.Post(srv.URL+"/settings", "application/json", bytes.NewBufferString(`{"broadcastSummaryThreshold":0}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if s := readBroadcast(t, plain); s.BroadcastMode != broadcastFull || len(s.Workers) != defaultBroadcastSummaryThreshold {
+		t.Errorf("summaries off: mode %q with %d workers", s.BroadcastMode, len(s.Workers))
+	}
+	readBroadcast(t, full)
+	for _, c := range listWSClients(t, srv) {
+		if c.Full != (c.RemoteAddr == full.LocalAddr().String()) {
+			t.Errorf("client %s full = %v", c.RemoteAddr, c.Full)
+		}
+	}
+}
+
+func TestBroadcastSummarySettings(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	for _, body := range []string{`{"broadcastSummaryThreshold":-1}`, `{"broadcastTopN":-1}`} {
+		rec := httptest.NewRecorder()
+		handleSettings(rec, httptest.NewRequest(http.MethodPut, "/settings", bytes.NewBufferString(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, rec.Code)
+		}
+	}
+	rec := httptest.NewRecorder()
+	handleSettings(rec, httptest.NewRequest(http.MethodPut, "/settings", bytes.NewBufferString(`{"broadcastSummaryThreshold":5,"broadcastTopN":2}`)))
+	var body struct{ Settings api.Settings }
+	json.NewDecoder(rec.Body).Decode(&body)
+	if rec.Code != http.StatusOK || body.Settings.BroadcastSummaryThreshold != 5 || body.Settings.BroadcastTopN != 2 {
+		t.Errorf("update: %d %+v", rec.Code, body.Settings)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Capacity estimation. Worker configs are fetched concurrently within
+// capacityFetchTimeout and reused for capacityConfigTTL. A "capacity" event
+// is emitted when the pool estimate moves by more than
+// capacityChangeThreshold (relative) from the last reported one.
+const (
+	capacityFetchTimeout    = 2 * time.Second
+	capacityConfigTTL       = 10 * time.Second
+	capacityChangeThreshold = 0.2
+)
+
+// Latency sources of a worker's capacity estimate, from most to least
+// trustworthy
+const (
+	latencyRecent     = "recent"
+	latencyLifetime   = "lifetime"
+	latencyAdvertised = "advertised"
+	latencyConfigured = "configured"
+	latencyNone       = "none"
+)
+
+// workerSimConfig is the part of a worker's /config used for capacity
+// estimates
+type workerSimConfig struct {
+	MaxConcurrentRequests int `json:"max_concurrent_requests"`
+	ResponseDelayMs       int `json:"response_delay_ms"`
+}
+
+// WorkerCapacity is one worker's part of a capacity report. Concurrency is
+// the smaller of the LB's MaxLoad and the worker's own concurrency limit.
+type WorkerCapacity struct {
+	Worker                string   `json:"worker"`
+	Eligible              bool     `json:"eligible"`
+	HealthState           string   `json:"healthState"`
+	MaxLoad               int      `json:"maxLoad"`
+	MaxConcurrentRequests *int     `json:"maxConcurrentRequests"`
+	Concurrency           int      `json:"concurrency"`
+	AvgLatencyMs          *float64 `json:"avgLatencyMs"`
+	LatencySource         string   `json:"latencySource"`
+	EstimatedRps          float64  `json:"estimatedRps"`
+}
+
+// CapacityReport estimates the sustainable throughput of the pool. Notes
+// explain what lowered the confidence.
+type CapacityReport struct {
+	GeneratedAt  time.Time        `json:"generatedAt"`
+	EstimatedRps float64          `json:"estimatedRps"`
+	Confidence   string           `json:"confidence"`
+	Workers      []WorkerCapacity `json:"workers"`
+	Notes        []string         `json:"notes"`
+}
+
+// cachedSimConfig is a worker config fetch result
+type cachedSimConfig struct {
+	config    workerSimConfig
+	err       error
+	fetchedAt time.Time
+}
+
+// capacityEstimator caches worker configs and the last reported estimate
+type capacityEstimator struct {
+	mu      sync.Mutex
+	configs map[string]cachedSimConfig
+	lastRps float64
+	hasLast bool
+}
+
+func newCapacityEstimator() *capacityEstimator {
+	return &capacityEstimator{configs: make(map[string]cachedSimConfig)}
+}
+
+// fetchSimConfig reads the named worker's /config
+func (lb *LoadBalancer) fetchSimConfig(ctx context.Context, name string) (workerSimConfig, error) {
+	var cfg workerSimConfig
+	resp, err := lb.callWorker(ctx, name, http.MethodGet, "/config", nil)
+	if err != nil {
+		return cfg, err
+	}
+	if resp.status != http.StatusOK {
+		return cfg, fmt.Errorf("HTTP %d", resp.status)
+	}
+	if err := json.Unmarshal(resp.body, &cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// simConfigs returns the configs of the named workers, fetching the ones
+// missing from the cache or older than capacityConfigTTL concurrently
+func (lb *LoadBalancer) simConfigs(names []string) map[string]cachedSimConfig {
+	c := lb.capacity
+	now := lb.clock.Now()
+	out := make(map[string]cachedSimConfig, len(names))
+	var stale []string
+	c.mu.Lock()
+	for _, name := range names {
+		if cached, ok := c.configs[name]; ok && now.Sub(cached.fetchedAt) < capacityConfigTTL {
+			out[name] = cached
+		} else {
+			stale = append(stale, name)
+		}
+	}
+	c.mu.Unlock()
+	if len(stale) == 0 {
+		return out
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), capacityFetchTimeout)
+	defer cancel()
+	results := make([]cachedSimConfig, len(stale))
+	var wg sync.WaitGroup
+	for i, name := range stale {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			cfg, err := lb.fetchSimConfig(ctx, name)
+			results[i] = cachedSimConfig{config: cfg, err: err, fetchedAt: now}
+		}(i, name)
+	}
+	wg.Wait()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, name := range stale {
+		c.configs[name] = results[i]
+		out[name] = results[i]
+	}
+	for name := range c.configs {
+		if _, ok := out[name]; !ok {
+			delete(c.configs, name)
+		}
+	}
+	return out
+}
+
+// workerCapacityInput is the LB-side state a worker's estimate is based on
+type workerCapacityInput struct {
+	name     string
+	eligible bool
+	health   string
+	maxLoad  int
+	lifetime statsSnapshot
+	// advertised is the latency the worker advertised in its last health
+	// check, 0 if none
+	advertised int64
+}
+
+// estimateWorker computes one worker's estimate and appends notes about it
+func (lb *LoadBalancer) estimateWorker(in workerCapacityInput, sim cachedSimConfig, notes []string) (WorkerCapacity, []string) {
+	wc := WorkerCapacity{
+		Worker:        in.name,
+		Eligible:      in.eligible,
+		HealthState:   in.health,
+		MaxLoad:       in.maxLoad,
+		Concurrency:   in.maxLoad,
+		LatencySource: latencyNone,
+	}
+	if sim.err != nil {
+		notes = append(notes, fmt.Sprintf("could not read the config of %s (%v); using maxLoad as its concurrency", in.name, sim.err))
+	} else if n := sim.config.MaxConcurrentRequests; n > 0 {
+		wc.MaxConcurrentRequests = &n
+		wc.Concurrency = min(in.maxLoad, n)
+	}
+
+	window := int(defaultTimeseriesWindow / timeseriesInterval)
+	var latency float64
+	if ms, ok := lb.timeseries.meanLatency(in.name, window); ok {
+		latency, wc.LatencySource = ms, latencyRecent
+	} else if in.lifetime.Requests > 0 {
+		latency, wc.LatencySource = in.lifetime.LatencySumMs/float64(in.lifetime.Requests), latencyLifetime
+		notes = append(notes, fmt.Sprintf("no recent latency samples for %s; using its lifetime average", in.name))
+	} else if in.advertised > 0 {
+		latency, wc.LatencySource = float64(in.advertised), latencyAdvertised
+		notes = append(notes, fmt.Sprintf("no latency samples for %s; using the latency it advertises", in.name))
+	} else if sim.err == nil && sim.config.ResponseDelayMs > 0 {
+		latency, wc.LatencySource = float64(sim.config.ResponseDelayMs), latencyConfigured
+		notes = append(notes, fmt.Sprintf("no latency samples for %s; using its configured response delay", in.name))
+	} else {
+		notes = append(notes, fmt.Sprintf("no latency samples for %s", in.name))
+	}
+	if wc.LatencySource != latencyNone {
+		wc.AvgLatencyMs = &latency
+	}
+
+	switch {
+	case !in.eligible:
+		notes = append(notes, fmt.Sprintf("%s is not eligible for traffic and is not counted", in.name))
+	case in.health == "degraded":
+		notes = append(notes, fmt.Sprintf("%s is degraded; its estimate may be optimistic", in.name))
+	}
+	if in.eligible && wc.AvgLatencyMs != nil && latency > 0 {
+		wc.EstimatedRps = float64(wc.Concurrency) * 1000 / latency
+	}
+	return wc, notes
+}
+
+// Capacity estimates the sustainable requests per second of each worker as
+// concurrency / average latency and sums the eligible ones
+func (lb *LoadBalancer) Capacity() CapacityReport {
+	lb.mu.RLock()
+	inputs := make([]workerCapacityInput, 0, len(lb.workers))
+	names := make([]string, 0, len(lb.workers))
+	for _, w := range lb.workers {
+		advertised, _, _ := w.latency.snapshot()
+		inputs = append(inputs, workerCapacityInput{
+			name:       w.Name,
+			eligible:   isEligible(w),
+			health:     w.healthStateLocked(),
+			maxLoad:    w.MaxLoad,
+			lifetime:   w.stats.snapshot(),
+			advertised: advertised,
+		})
+		names = append(names, w.Name)
+	}
+	lb.mu.RUnlock()
+
+	configs := lb.simConfigs(names)
+	report := CapacityReport{
+		GeneratedAt: lb.clock.Now().UTC(),
+		Workers:     make([]WorkerCapacity, 0, len(inputs)),
+		Notes:       []string{},
+	}
+	recent := 0
+	for _, in := range inputs {
+		var wc WorkerCapacity
+		wc, report.Notes = lb.estimateWorker(in, configs[in.name], report.Notes)
+		report.Workers = append(report.Workers, wc)
+		report.EstimatedRps += wc.EstimatedRps
+		if wc.Eligible && wc.LatencySource == latencyRecent {
+			recent++
+		}
+	}
+	switch {
+	case report.EstimatedRps == 0 || recent == 0:
+		report.Confidence = "low"
+	case len(report.Notes) == 0:
+		report.Confidence = "high"
+	default:
+		report.Confidence = "medium"
+	}
+	if len(inputs) == 0 {
+		report.Notes = append(report.Notes, "no workers registered")
+	}
+
+	lb.reportCapacityChange(report.EstimatedRps)
+	return report
+}
+
+// reportCapacityChange emits a "capacity" event when rps differs from the
+// last reported estimate by more than capacityChangeThreshold
+func (lb *LoadBalancer) reportCapacityChange(rps float64) {
+	c := lb.capacity
+	c.mu.Lock()
+	prev, hadLast := c.lastRps, c.hasLast
+	changed := !hadLast || math.Abs(rps-prev) > capacityChangeThreshold*prev || (prev == 0 && rps != 0)
+	if changed {
+		c.lastRps, c.hasLast = rps, true
+	}
+	c.mu.Unlock()
+	if changed && hadLast {
+		lb.emitEvent("capacity", fmt.Sprintf("Estimated capacity changed from %.1f to %.1f rps", prev, rps), map[string]interface{}{
+			"from": prev,
+			"to":   rps,
+		})
+	}
+}
+
+// handleCapacity はプール全体の持続可能なスループットを見積もる HTTP ハンドラです。
+// 各ワーカーについて直近の平均処理時間、MaxLoad とワーカーの /config から取得した max_concurrent_requests、ヘルス状態から RPS を推定し、
+// 合計値と内訳、信頼度を下げた要因の notes を返します。
+func handleCapacity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lb.Capacity())
+}
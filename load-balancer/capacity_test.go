@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newConfigWorker starts a stub worker whose /config reports the given limits
+func newConfigWorker(t *testing.T, maxConcurrent, delayMs int, fetches *int32, sleep time.Duration) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/config" {
+			http.NotFound(w, r)
+			return
+		}
+		if fetches != nil {
+			atomic.AddInt32(fetches, 1)
+		}
+		time.Sleep(sleep)
+		fmt.Fprintf(w, `{"max_concurrent_requests":%d,"response_delay_ms":%d}`, maxConcurrent, delayMs)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func capacityOf(r CapacityReport, name string) WorkerCapacity {
+	for _, w := range r.Workers {
+		if w.Worker == name {
+			return w
+		}
+	}
+	return WorkerCapacity{}
+}
+
+func TestCapacityEstimate(t *testing.T) {
+	var fetches int32
+	fast := newConfigWorker(t, 2, 100, &fetches, 0)
+	cold := newConfigWorker(t, 10, 200, nil, 0)
+
+	lb = NewLoadBalancer("round-robin")
+	clk := newFakeClock()
+	lb.clock = clk
+	lb.AddWorker("worker-1", fast.URL, "#FF0000", 1)
+	lb.AddWorker("worker-2", cold.URL, "#00FF00", 1)
+	lb.AddWorker("worker-3", "http://127.0.0.1:1", "#0000FF", 1)
+	lb.workers[2].Enabled = false
+
+	// worker-1 served 10 requests of 50ms in the last sampling interval
+	lb.sampleTimeseries()
+	for i := 0; i < 10; i++ {
+		lb.workers[0].stats.observe(50*time.Millisecond, false)
+	}
+	lb.sampleTimeseries()
+
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/capacity", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status code = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var report CapacityReport
+	json.NewDecoder(rec.Body).Decode(&report)
+
+	// worker-1: min(maxLoad 3, 2 concurrent) / 50ms = 40 rps
+	w1 := capacityOf(report, "worker-1")
+	if w1.Concurrency != 2 || w1.LatencySource != latencyRecent || math.Abs(w1.EstimatedRps-40) > 1e-9 {
+		t.Errorf("worker-1 = %+v, want concurrency 2, recent latency, 40 rps", w1)
+	}
+	// worker-2 has no samples: min(3, 10) / configured 200ms = 15 rps
+	w2 := capacityOf(report, "worker-2")
+	if w2.Concurrency != 3 || w2.LatencySource != latencyConfigured || math.Abs(w2.EstimatedRps-15) > 1e-9 {
+		t.Errorf("worker-2 = %+v, want concurrency 3, configured latency, 15 rps", w2)
+	}
+	// worker-3 is disabled and unreachable
+	w3 := capacityOf(report, "worker-3")
+	if w3.Eligible || w3.EstimatedRps != 0 || w3.MaxConcurrentRequests != nil {
+		t.Errorf("worker-3 = %+v, want an ineligible worker without a config", w3)
+	}
+	if math.Abs(report.EstimatedRps-55) > 1e-9 || report.Confidence != "medium" {
+		t.Errorf("pool = %v rps (%s), want 55 rps with medium confidence", report.EstimatedRps, report.Confidence)
+	}
+	notes := strings.Join(report.Notes, "\n")
+	for _, want := range []string{
+		"no latency samples for worker-2; using its configured response delay",
+		"could not read the config of worker-3",
+		"worker-3 is not eligible",
+	} {
+		if !strings.Contains(notes, want) {
+			t.Errorf("notes %q are missing %q", report.Notes, want)
+		}
+	}
+
+	// Configs are cached for capacityConfigTTL
+	lb.Capacity()
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("config fetches = %d, want 1 within the TTL", n)
+	}
+	clk.Advance(capacityConfigTTL)
+	lb.Capacity()
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("config fetches = %d, want 2 after the TTL", n)
+	}
+}
+
+func TestCapacityChangeEvent(t *testing.T) {
+	a := newConfigWorker(t, 5, 100, nil, 0)
+	b := newConfigWorker(t, 5, 100, nil, 0)
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", a.URL, "#FF0000", 1)
+	lb.AddWorker("worker-2", b.URL, "#00FF00", 1)
+
+	capacityEvents := func() []Event {
+		var out []Event
+		for _, e := range lb.events.since(0, 1000) {
+			if e.Type == "capacity" {
+				out = append(out, e)
+			}
+		}
+		return out
+	}
+
+	lb.Capacity() // 2 × 3 / 100ms = 60 rps
+	lb.Capacity()
+	if n := len(capacityEvents()); n != 0 {
+		t.Fatalf("capacity events = %d, want 0 without a change", n)
+	}
+
+	lb.workers[1].Enabled = false
+	if got := lb.Capacity().EstimatedRps; got != 30 {
+		t.Fatalf("estimate = %v, want 30", got)
+	}
+	events := capacityEvents()
+	if len(events) != 1 || events[0].Data["from"] != 60.0 || events[0].Data["to"] != 30.0 {
+		t.Errorf("events = %+v, want one 60 -> 30 event", events)
+	}
+}
+
+func TestCapacityConfigFetchesAreConcurrent(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	for i := 0; i < 4; i++ {
+		srv := newConfigWorker(t, 1, 100, nil, 200*time.Millisecond)
+		lb.AddWorker(fmt.Sprintf("worker-%d", i), srv.URL, "", 1)
+	}
+	start := time.Now()
+	report := lb.Capacity()
+	if elapsed := time.Since(start); elapsed > 600*time.Millisecond {
+		t.Errorf("capacity took %v, want the fetches to overlap", elapsed)
+	}
+	if report.EstimatedRps != 40 {
+		t.Errorf("estimate = %v, want 40", report.EstimatedRps)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// circuitState is the state of a worker's circuit breaker. An open circuit
+// lets one probe request through once its cooldown has passed and is
+// half-open while the probe is in flight: a successful probe closes it, a
+// failed one opens it again for twice the cooldown, up to
+// circuitMaxCooldown. The cooldown starts at circuitResetInterval each time
+// the circuit opens from closed. The zero value is closed.
+type circuitState string
+
+const (
+	circuitClosed   circuitState = "closed"
+	circuitOpen     circuitState = "open"
+	circuitHalfOpen circuitState = "half-open"
+)
+
+// Circuit cooldowns: how long a circuit stays open before a probe request
+// is let through, first and at most. LB_CIRCUIT_RESET_INTERVAL_MS and
+// LB_CIRCUIT_COOLDOWN both set the first one (the latter wins when both are
+// given), so it has one default: the 10s LB_CIRCUIT_COOLDOWN is documented
+// with. Set either to 30s for a longer pause before the first probe.
+const (
+	defaultCircuitResetInterval = 10 * time.Second
+	defaultCircuitMaxCooldown   = 5 * time.Minute
+)
+
+// gaugeValue is the value of lb_circuit_state: 0 closed, 1 open, 2 half-open
+func (s circuitState) gaugeValue() float64 {
+	switch s {
+	case circuitOpen:
+		return 1
+	case circuitHalfOpen:
+		return 2
+	}
+	return 0
+}
+
+// circuitOpen reports whether w's circuit is open or half-open
+func (w *Worker) circuitOpen() bool {
+	return w.CircuitState == circuitOpen || w.CircuitState == circuitHalfOpen
+}
+
+// circuitStateName is CircuitState with the zero value spelled out
+func (w *Worker) circuitStateName() string {
+	if w.CircuitState == "" {
+		return string(circuitClosed)
+	}
+	return string(w.CircuitState)
+}
+
+// circuitThresholdLocked returns the consecutive failures that open w's
+// circuit: its own threshold if set, the pool's otherwise. Must be called
+// with lb.mu held.
+func (lb *LoadBalancer) circuitThresholdLocked(w *Worker) int {
+	if w.CircuitThreshold > 0 {
+		return w.CircuitThreshold
+	}
+	return lb.circuitThreshold
+}
+
+// SetWorkerCircuitThreshold sets the named worker's circuit threshold; 0
+// makes it use the pool's again. It returns false if there is no such
+// worker or threshold is negative.
+func (lb *LoadBalancer) SetWorkerCircuitThreshold(name string, threshold int) bool {
+	if threshold < 0 {
+		return false
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	w := lb.findWorkerLocked(name)
+	if w == nil {
+		return false
+	}
+	w.CircuitThreshold = threshold
+	w.revision++
+	return true
+}
+
+func (lb *LoadBalancer) setCircuitLocked(w *Worker, s circuitState) {
+	w.CircuitState = s
+	lb.metrics.circuitState.WithLabelValues(w.Name).Set(s.gaugeValue())
+}
+
+// openCircuitLocked opens w's circuit for the reset interval, or opens it
+// again after a failed probe for twice the previous cooldown, capped at
+// circuitMaxCooldown. Must be called with lb.mu held.
+func (lb *LoadBalancer) openCircuitLocked(w *Worker) {
+	now := lb.clock.Now()
+	switch {
+	case !w.circuitOpen():
+		lb.history.circuitOpened(w.Name, now)
+		lb.emitEvent("circuit_opened", fmt.Sprintf("Circuit of worker %s opened after %d failures", w.Name, w.ConsecFailures), map[string]interface{}{
+			"worker":   w.Name,
+			"failures": w.ConsecFailures,
+		})
+		w.circuitCooldown = lb.circuitResetInterval
+	case w.CircuitState == circuitHalfOpen:
+		w.circuitCooldown *= 2
+	}
+	if w.circuitCooldown > lb.circuitMaxCooldown {
+		w.circuitCooldown = lb.circuitMaxCooldown
+	}
+	if w.circuitCooldown < lb.circuitResetInterval {
+		w.circuitCooldown = lb.circuitResetInterval
+	}
+	w.CircuitOpenedAt = now
+	w.nextProbeAt = now.Add(w.circuitCooldown)
+	lb.setCircuitLocked(w, circuitOpen)
+}
+
+// closeCircuitLocked closes w's circuit. Must be called with lb.mu held.
+func (lb *LoadBalancer) closeCircuitLocked(w *Worker) {
+	if w.circuitOpen() {
+		lb.emitEvent("circuit_closed", fmt.Sprintf("Circuit of worker %s closed", w.Name), map[string]interface{}{
+			"worker": w.Name,
+		})
+	}
+	w.CircuitOpenedAt = time.Time{}
+	w.nextProbeAt = time.Time{}
+	w.circuitCooldown = 0
+	w.ConsecFailures = 0
+	w.latency.restart()
+	lb.setCircuitLocked(w, circuitClosed)
+}
+
+// circuitAdmitsLocked reports whether w's circuit lets a request through:
+// it is closed, or it is open and its next probe is due. A half-open circuit
+// admits nothing while its probe is in flight, unless the probe has gone
+// unanswered for another cooldown. Without a reset interval, as in the
+// self-test sandbox, an open circuit admits nothing. Must be called with
+// lb.mu held.
+func (lb *LoadBalancer) circuitAdmitsLocked(w *Worker) bool {
+	if lb.circuitResetInterval <= 0 {
+		return !w.circuitOpen()
+	}
+	switch w.CircuitState {
+	case circuitOpen:
+		return !lb.clock.Now().Before(w.nextProbeAt)
+	case circuitHalfOpen:
+		return lb.clock.Now().Sub(w.circuitProbeAt) >= w.circuitCooldown
+	}
+	return true
+}
+
+// admitProbeLocked turns the request just routed to w into the probe of its
+// open circuit, so no other request gets through until it is answered. Must
+// be called with lb.mu held.
+func (lb *LoadBalancer) admitProbeLocked(w *Worker) {
+	if !w.circuitOpen() {
+		return
+	}
+	w.circuitProbeAt = lb.clock.Now()
+	lb.setCircuitLocked(w, circuitHalfOpen)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCircuitHalfOpen(t *testing.T) {
+	clk := newFakeClock()
+	lb := NewLoadBalancer("round-robin")
+	lb.clock = clk
+	lb.circuitThreshold = 2
+	lb.circuitResetInterval = 10 * time.Second
+	lb.AddWorker("worker-1", "http://localhost:8081", "#FF0000", 1)
+	w := lb.workers[0]
+	gauge := func() float64 { return testutil.ToFloat64(lb.metrics.circuitState.WithLabelValues("worker-1")) }
+
+	lb.recordFailure(w)
+	lb.recordFailure(w)
+	if w.CircuitState != circuitOpen || gauge() != 1 {
+		t.Fatalf("state = %q, gauge = %v, want open, 1", w.CircuitState, gauge())
+	}
+	if got, _, _ := lb.selectWorker(routeHints{}); got != nil {
+		t.Fatal("open circuit admitted a request before the reset interval")
+	}
+
+	// One probe once the interval has passed, nothing else while it is in flight
+	clk.Advance(10 * time.Second)
+	if got, _, _ := lb.selectWorker(routeHints{}); got != w {
+		t.Fatal("open circuit did not admit a probe after the reset interval")
+	}
+	if w.CircuitState != circuitHalfOpen || gauge() != 2 {
+		t.Fatalf("state = %q, gauge = %v, want half-open, 2", w.CircuitState, gauge())
+	}
+	if got, _, _ := lb.selectWorker(routeHints{}); got != nil {
+		t.Fatal("half-open circuit admitted a second request")
+	}
+
+	// A failed probe opens the circuit for twice the interval
+	clk.Advance(time.Second)
+	lb.recordFailure(w)
+	if w.CircuitState != circuitOpen || !w.CircuitOpenedAt.Equal(clk.Now()) || !w.nextProbeAt.Equal(clk.Now().Add(20*time.Second)) {
+		t.Fatalf("state = %q, openedAt = %v, nextProbeAt = %v after a failed probe", w.CircuitState, w.CircuitOpenedAt, w.nextProbeAt)
+	}
+	clk.Advance(19 * time.Second)
+	if got, _, _ := lb.selectWorker(routeHints{}); got != nil {
+		t.Fatal("reopened circuit admitted a request before the doubled cooldown")
+	}
+
+	// A successful probe closes it
+	clk.Advance(time.Second)
+	if got, _, _ := lb.selectWorker(routeHints{}); got != w {
+		t.Fatal("reopened circuit did not admit a probe")
+	}
+	lb.recordSuccess(w)
+	if w.CircuitState != circuitClosed || w.ConsecFailures != 0 || gauge() != 0 {
+		t.Fatalf("state = %q, failures = %d, gauge = %v after a successful probe", w.CircuitState, w.ConsecFailures, gauge())
+	}
+	for i := 0; i < 3; i++ {
+		if got, _, _ := lb.selectWorker(routeHints{}); got != w {
+			t.Fatal("closed circuit did not admit a request")
+		}
+	}
+
+	s := lb.Settings()
+	s.CircuitResetIntervalMs = 0
+	if _, err := lb.UpdateSettings(s); err == nil {
+		t.Error("circuitResetIntervalMs = 0 should be rejected")
+	}
+	s.CircuitResetIntervalMs = 5000
+	if _, err := lb.UpdateSettings(s); err != nil {
+		t.Fatalf("UpdateSettings: %v", err)
+	}
+	if lb.circuitResetInterval != 5*time.Second {
+		t.Errorf("circuitResetInterval = %v, want 5s", lb.circuitResetInterval)
+	}
+	s.CircuitMaxCooldownMs = 4000
+	if _, err := lb.UpdateSettings(s); err == nil {
+		t.Error("circuitMaxCooldownMs below circuitResetIntervalMs should be rejected")
+	}
+}
+
+func TestPerWorkerCircuitThreshold(t *testing.T) {
+	lb := NewLoadBalancer("round-robin")
+	lb.circuitThreshold = 3
+	lb.AddWorker("busy", "http://localhost:8081", "#FF0000", 4)
+	lb.AddWorker("small", "http://localhost:8082", "#00FF00", 1)
+	if !lb.SetWorkerCircuitThreshold("busy", 6) {
+		t.Fatal("SetWorkerCircuitThreshold failed")
+	}
+	if lb.SetWorkerCircuitThreshold("nope", 6) || lb.SetWorkerCircuitThreshold("busy", -1) {
+		t.Error("SetWorkerCircuitThreshold accepted an unknown worker or a negative threshold")
+	}
+	busy, small := lb.workers[0], lb.workers[1]
+
+	for i := 1; i <= 6; i++ {
+		lb.recordFailure(busy)
+		lb.recordFailure(small)
+		if got, want := small.circuitOpen(), i >= 3; got != want {
+			t.Errorf("small after %d failures: open = %v, want %v", i, got, want)
+		}
+		if got, want := busy.circuitOpen(), i >= 6; got != want {
+			t.Errorf("busy after %d failures: open = %v, want %v", i, got, want)
+		}
+	}
+	if s, _ := lb.CircuitState("busy"); s.Threshold != 6 {
+		t.Errorf("busy threshold = %d, want 6", s.Threshold)
+	}
+	if s, _ := lb.CircuitState("small"); s.Threshold != 3 {
+		t.Errorf("small threshold = %d, want the pool's 3", s.Threshold)
+	}
+
+	// 0 falls back to the pool's threshold
+	zero := 0
+	status, _ := lb.PatchWorker("busy", api.WorkerUpdate{CircuitThreshold: &zero})
+	if status.CircuitThreshold != 0 {
+		t.Errorf("status threshold = %d after reset", status.CircuitThreshold)
+	}
+	if s, _ := lb.CircuitState("busy"); s.Threshold != 3 {
+		t.Errorf("busy threshold = %d after reset, want 3", s.Threshold)
+	}
+	neg := -1
+	if err := validateWorkerUpdate(api.WorkerUpdate{CircuitThreshold: &neg}); err == nil {
+		t.Error("a negative circuitThreshold should be rejected")
+	}
+}
+
+// TestCircuitFlappingBackend drives a worker that fails for a while and then
+// recovers: the breaker opens, probes it with a doubling cooldown through
+// half-open while it is down and closes once it is back
+func TestCircuitFlappingBackend(t *testing.T) {
+	var down atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "flap", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	clk := newFakeClock()
+	lb = NewLoadBalancer("round-robin")
+	lb.clock = clk
+	lb.circuitThreshold = 2
+	lb.circuitResetInterval = 10 * time.Second
+	lb.circuitMaxCooldown = 30 * time.Second
+	lb.AddWorker("flappy", srv.URL, "#FF0000", 1)
+	w := lb.workers[0]
+	// probe admits the next request and forwards it to the backend
+	probe := func() {
+		t.Helper()
+		got, _, _ := lb.selectWorker(routeHints{})
+		if got != w || w.CircuitState != circuitHalfOpen {
+			t.Fatalf("probe not admitted: state = %q", w.CircuitState)
+		}
+		lb.forwardTo(context.Background(), w, TaskRequest{ID: "probe", Weight: 1}, time.Now())
+	}
+
+	down.Store(true)
+	for i := 0; i < 2; i++ {
+		if w.CircuitState != "" && w.CircuitState != circuitClosed {
+			t.Fatalf("state = %q after %d failures, want closed", w.CircuitState, i)
+		}
+		doTask(nil)
+	}
+	if w.CircuitState != circuitOpen {
+		t.Fatalf("state = %q after 2 failures, want open", w.CircuitState)
+	}
+
+	// Each failed probe doubles the cooldown, up to the max
+	for _, cooldown := range []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second} {
+		s, _ := lb.CircuitState("flappy")
+		if s.State != string(circuitOpen) || s.CooldownMs != cooldown.Milliseconds() || s.NextProbeAt == nil || !s.NextProbeAt.Equal(clk.Now().Add(cooldown)) {
+			t.Fatalf("circuit = %+v, want open with a probe due in %v", s, cooldown)
+		}
+		clk.Advance(cooldown - time.Millisecond)
+		if rec := doTask(nil); rec.Code != http.StatusServiceUnavailable || w.CircuitState != circuitOpen {
+			t.Fatalf("task before the probe is due: %d, state %q", rec.Code, w.CircuitState)
+		}
+		clk.Advance(time.Millisecond)
+		probe()
+	}
+
+	// The backend recovers: the next probe closes the circuit
+	down.Store(false)
+	clk.Advance(30 * time.Second)
+	probe()
+	if s, _ := lb.CircuitState("flappy"); s.State != string(circuitClosed) || s.NextProbeAt != nil || s.CooldownMs != 0 {
+		t.Errorf("circuit after recovery = %+v", s)
+	}
+	if rec := doTask(nil); rec.Code != http.StatusOK {
+		t.Errorf("task after recovery: %d", rec.Code)
+	}
+
+	// Opening again from closed starts over at the reset interval
+	down.Store(true)
+	doTask(nil)
+	doTask(nil)
+	if s, _ := lb.CircuitState("flappy"); s.CooldownMs != 10000 {
+		t.Errorf("cooldown after reopening = %dms, want 10000", s.CooldownMs)
+	}
+}
@@ -0,0 +1,179 @@
+// Package lb is a typed Go client for the load balancer's HTTP API.
+//
+//	c := lb.NewClient("http://localhost:8000")
+//	resp, err := c.SubmitTask(ctx, lb.TaskRequest{Weight: 1})
+//
+// Request and response types are shared with the server through the api
+// package and re-exported here for convenience.
+package lb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// Types shared with the server
+type (
+	TaskRequest       = api.TaskRequest
+	TaskResponse      = api.TaskResponse
+	Status            = api.Status
+	WorkerStatus      = api.WorkerStatus
+	Settings          = api.Settings
+	AlgorithmResponse = api.AlgorithmResponse
+	WorkerUpdate      = api.WorkerUpdate
+	AddWorkerRequest  = api.AddWorkerRequest
+	CircuitState      = api.CircuitState
+)
+
+// APIError is returned when the LB answers with a non-2xx status. Body holds
+// the structured error body; for plain-text errors only Body.Error is set.
+type APIError struct {
+	StatusCode int
+	Body       api.ErrorResponse
+}
+
+func (e *APIError) Error() string {
+	if e.Body.Field != "" {
+		return fmt.Sprintf("lb: %d %s (%s)", e.StatusCode, e.Body.Error, e.Body.Field)
+	}
+	return fmt.Sprintf("lb: %d %s", e.StatusCode, e.Body.Error)
+}
+
+// Client talks to a single load balancer
+type Client struct {
+	baseURL string
+
+	// HTTPClient is used for all non-streaming requests
+	HTTPClient *http.Client
+}
+
+// NewClient returns a client for the LB at baseURL (e.g. "http://localhost:8000")
+func NewClient(baseURL string) *Client {
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+// SubmitTask sends a task through the LB and returns the worker's response
+func (c *Client) SubmitTask(ctx context.Context, task TaskRequest) (*TaskResponse, error) {
+	var resp TaskResponse
+	if err := c.do(ctx, http.MethodPost, "/task", task, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Status returns the LB's current status document
+func (c *Client) Status(ctx context.Context) (*Status, error) {
+	var status Status
+	if err := c.do(ctx, http.MethodGet, "/status", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// SetAlgorithm switches the load balancing algorithm
+func (c *Client) SetAlgorithm(ctx context.Context, algorithm string) (*AlgorithmResponse, error) {
+	var resp AlgorithmResponse
+	if err := c.do(ctx, http.MethodPut, "/algorithm", api.AlgorithmRequest{Algorithm: algorithm}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// UpdateWorker enables/disables a worker, changes its weight or metadata and
+// returns the worker as it is after the update
+func (c *Client) UpdateWorker(ctx context.Context, name string, update WorkerUpdate) (*WorkerStatus, error) {
+	var status WorkerStatus
+	if err := c.do(ctx, http.MethodPatch, "/workers/"+url.PathEscape(name), update, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// AddWorker registers a new worker with the pool
+func (c *Client) AddWorker(ctx context.Context, req AddWorkerRequest) (*WorkerStatus, error) {
+	var status WorkerStatus
+	if err := c.do(ctx, http.MethodPost, "/workers", req, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// RemoveWorker removes a worker from the pool and returns the workers left.
+// A worker with requests in flight is only removed when force is set.
+func (c *Client) RemoveWorker(ctx context.Context, name string, force bool) ([]WorkerStatus, error) {
+	path := "/workers/" + url.PathEscape(name)
+	if force {
+		path += "?force=true"
+	}
+	var workers []WorkerStatus
+	if err := c.do(ctx, http.MethodDelete, path, nil, &workers); err != nil {
+		return nil, err
+	}
+	return workers, nil
+}
+
+// Circuit returns the circuit breaker state of a worker
+func (c *Client) Circuit(ctx context.Context, name string) (*CircuitState, error) {
+	var state CircuitState
+	if err := c.do(ctx, http.MethodGet, "/workers/"+url.PathEscape(name)+"/circuit", nil, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// do sends a JSON request and decodes a JSON response into out (if non-nil)
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return decodeError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// decodeError builds an APIError from a JSON or plain-text error response
+func decodeError(resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	apiErr := &APIError{StatusCode: resp.StatusCode}
+	if err := json.Unmarshal(data, &apiErr.Body); err != nil || apiErr.Body.Error == "" {
+		apiErr.Body = api.ErrorResponse{Error: strings.TrimSpace(string(data))}
+	}
+	if apiErr.Body.Error == "" {
+		apiErr.Body.Error = http.StatusText(resp.StatusCode)
+	}
+	return apiErr
+}
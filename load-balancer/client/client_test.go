@@ -0,0 +1,91 @@
+package lb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAPIErrorPlainText(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Invalid algorithm", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	_, err := NewClient(srv.URL).SetAlgorithm(context.Background(), "nope")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("error = %v, want *APIError", err)
+	}
+	if apiErr.StatusCode != http.StatusBadRequest || apiErr.Body.Error != "Invalid algorithm" {
+		t.Errorf("APIError = %+v", apiErr)
+	}
+}
+
+func TestAPIErrorStructured(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"must be at least 1","field":"weight"}`))
+	}))
+	defer srv.Close()
+
+	_, err := NewClient(srv.URL).AddWorker(context.Background(), AddWorkerRequest{Name: "w"})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Body.Field != "weight" {
+		t.Fatalf("error = %#v, want APIError with field", err)
+	}
+}
+
+func TestStreamStatusReconnects(t *testing.T) {
+	var conns int32
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		n := atomic.AddInt32(&conns, 1)
+		data, _ := json.Marshal(Status{Algorithm: "round-robin", EventSeq: int64(n)})
+		conn.WriteMessage(websocket.TextMessage, data)
+		// Drop the connection to force a reconnect
+		conn.Close()
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ch, err := NewClient(srv.URL).StreamStatus(ctx)
+	if err != nil {
+		t.Fatalf("StreamStatus: %v", err)
+	}
+
+	for want := int64(1); want <= 3; want++ {
+		status, ok := <-ch
+		if !ok {
+			t.Fatal("stream closed early")
+		}
+		if status.EventSeq != want {
+			t.Fatalf("status from connection %d, want %d", status.EventSeq, want)
+		}
+	}
+
+	cancel()
+	for range ch {
+	}
+}
+
+func TestStreamStatusUnreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	if _, err := NewClient(srv.URL).StreamStatus(context.Background()); err == nil {
+		t.Fatal("expected an error for an unreachable LB")
+	}
+}
@@ -0,0 +1,38 @@
+package lb_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	lb "github.com/network-sandbox/load-balancer/client"
+)
+
+func ExampleClient_SubmitTask() {
+	c := lb.NewClient("http://localhost:8000")
+	resp, err := c.SubmitTask(context.Background(), lb.TaskRequest{Weight: 1})
+	var apiErr *lb.APIError
+	if errors.As(err, &apiErr) {
+		log.Fatalf("LB rejected the task with %d: %s", apiErr.StatusCode, apiErr.Body.Error)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("served by %s in %dms\n", resp.Worker, resp.ProcessingTimeMs)
+}
+
+func ExampleClient_StreamStatus() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := lb.NewClient("http://localhost:8000")
+	statuses, err := c.StreamStatus(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for status := range statuses {
+		for _, w := range status.Workers {
+			fmt.Printf("%s load=%d healthy=%v\n", w.Name, w.CurrentLoad, w.Healthy)
+		}
+	}
+}
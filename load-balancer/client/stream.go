@@ -0,0 +1,98 @@
+package lb
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Reconnection backoff for StreamStatus
+const (
+	minStreamBackoff = 100 * time.Millisecond
+	maxStreamBackoff = 5 * time.Second
+)
+
+// StreamStatus subscribes to the LB's WebSocket status feed. The first
+// connection is made synchronously so an unreachable LB is reported as an
+// error; afterwards dropped connections are re-established with exponential
+// backoff. The channel is closed when ctx is done.
+func (c *Client) StreamStatus(ctx context.Context) (<-chan Status, error) {
+	wsURL := c.wsURL()
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, wsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan Status)
+	go func() {
+		defer close(ch)
+		backoff := minStreamBackoff
+		for {
+			if conn != nil {
+				if readStatuses(ctx, conn, ch) {
+					backoff = minStreamBackoff
+				}
+				conn = nil
+			}
+			if ctx.Err() != nil {
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > maxStreamBackoff {
+				backoff = maxStreamBackoff
+			}
+			conn, _, _ = websocket.DefaultDialer.DialContext(ctx, wsURL, nil)
+		}
+	}()
+	return ch, nil
+}
+
+// readStatuses forwards status messages until the connection fails or ctx is
+// done, and reports whether at least one message was received
+func readStatuses(ctx context.Context, conn *websocket.Conn, ch chan<- Status) bool {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	received := false
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return received
+		}
+		var status Status
+		if err := json.Unmarshal(data, &status); err != nil {
+			continue
+		}
+		received = true
+		select {
+		case ch <- status:
+		case <-ctx.Done():
+			return received
+		}
+	}
+}
+
+func (c *Client) wsURL() string {
+	switch {
+	case strings.HasPrefix(c.baseURL, "https://"):
+		return "wss://" + strings.TrimPrefix(c.baseURL, "https://") + "/ws"
+	case strings.HasPrefix(c.baseURL, "http://"):
+		return "ws://" + strings.TrimPrefix(c.baseURL, "http://") + "/ws"
+	}
+	return c.baseURL + "/ws"
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+	lbclient "github.com/network-sandbox/load-balancer/client"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newInProcessLB starts the full LB mux with one stub worker and returns a
+// client for it
+func newInProcessLB(t *testing.T) *lbclient.Client {
+	t.Helper()
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var task api.TaskRequest
+		json.NewDecoder(r.Body).Decode(&task)
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": task.ID, "color": "#FF0000"})
+	}))
+	t.Cleanup(worker.Close)
+
+	lb = NewLoadBalancer("round-robin")
+	t.Cleanup(lb.stopControl)
+	lb.AddWorker("worker-1", worker.URL, "#FF0000", 1)
+
+	srv := httptest.NewServer(corsMiddleware(newMux()))
+	t.Cleanup(srv.Close)
+	return lbclient.NewClient(srv.URL)
+}
+
+func TestClientAgainstInProcessLB(t *testing.T) {
+	c := newInProcessLB(t)
+	ctx := context.Background()
+
+	resp, err := c.SubmitTask(ctx, lbclient.TaskRequest{ID: "t-1", Weight: 1})
+	if err != nil {
+		t.Fatalf("SubmitTask: %v", err)
+	}
+	if resp.ID != "t-1" || resp.Worker != "worker-1" || resp.WorkerColor != "#FF0000" {
+		t.Errorf("SubmitTask = %+v", resp)
+	}
+
+	algo, err := c.SetAlgorithm(ctx, "least-connections")
+	if err != nil {
+		t.Fatalf("SetAlgorithm: %v", err)
+	}
+	if algo.Algorithm != "least-connections" || len(algo.Available) == 0 {
+		t.Errorf("SetAlgorithm = %+v", algo)
+	}
+
+	added, err := c.AddWorker(ctx, lbclient.AddWorkerRequest{Name: "worker-2", URL: "http://127.0.0.1:1", Weight: 2})
+	if err != nil {
+		t.Fatalf("AddWorker: %v", err)
+	}
+	if added.Name != "worker-2" || added.Weight != 2 || added.MaxLoad != defaultMaxLoad {
+		t.Errorf("AddWorker = %+v", added)
+	}
+
+	disabled := false
+	updated, err := c.UpdateWorker(ctx, "worker-2", lbclient.WorkerUpdate{Enabled: &disabled})
+	if err != nil {
+		t.Fatalf("UpdateWorker: %v", err)
+	}
+	if updated.Name != "worker-2" || updated.Enabled || updated.Weight != 2 {
+		t.Errorf("UpdateWorker = %+v", updated)
+	}
+
+	status, err := c.Status(ctx)
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	if status.Algorithm != "least-connections" || len(status.Workers) != 2 {
+		t.Fatalf("Status = %+v", status)
+	}
+	if status.Workers[0].TotalRequests != 1 || status.Workers[1].Enabled {
+		t.Errorf("Status workers = %+v", status.Workers)
+	}
+
+	circuit, err := c.Circuit(ctx, "worker-1")
+	if err != nil {
+		t.Fatalf("Circuit: %v", err)
+	}
+	if circuit.Open || circuit.Threshold != 3 {
+		t.Errorf("Circuit = %+v", circuit)
+	}
+}
+
+func TestClientAPIErrors(t *testing.T) {
+	c := newInProcessLB(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		call     func() error
+		wantCode int
+	}{
+		{"invalid algorithm", func() error { _, err := c.SetAlgorithm(ctx, "nope"); return err }, http.StatusBadRequest},
+		{"unknown worker", func() error { _, err := c.UpdateWorker(ctx, "nope", lbclient.WorkerUpdate{}); return err }, http.StatusNotFound},
+		{"duplicate worker", func() error {
+			_, err := c.AddWorker(ctx, lbclient.AddWorkerRequest{Name: "worker-1", URL: "http://127.0.0.1:1"})
+			return err
+		}, http.StatusConflict},
+		{"unknown circuit", func() error { _, err := c.Circuit(ctx, "nope"); return err }, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var apiErr *lbclient.APIError
+			if err := tt.call(); !errors.As(err, &apiErr) {
+				t.Fatalf("error = %v, want *APIError", err)
+			}
+			if apiErr.StatusCode != tt.wantCode || apiErr.Body.Error == "" {
+				t.Errorf("APIError = %+v, want status %d with a message", apiErr, tt.wantCode)
+			}
+		})
+	}
+
+	// Structured error bodies are decoded as-is
+	lb.workers = nil
+	_, err := c.SubmitTask(ctx, lbclient.TaskRequest{Weight: 1})
+	var apiErr *lbclient.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable ||
+		apiErr.Body.Error != "No healthy workers available" {
+		t.Errorf("SubmitTask error = %#v", err)
+	}
+}
+
+func TestRemoveWorker(t *testing.T) {
+	c := newInProcessLB(t)
+	ctx := context.Background()
+	if _, err := c.AddWorker(ctx, lbclient.AddWorkerRequest{Name: "worker-2", URL: "http://127.0.0.1:1"}); err != nil {
+		t.Fatalf("AddWorker: %v", err)
+	}
+	lb.metrics.workerHealth.WithLabelValues("worker-2").Set(1)
+	lb.metrics.requestsTotal.WithLabelValues("worker-2", "error").Inc()
+	w2 := lb.workers[1]
+	atomic.StoreInt32(&w2.CurrentLoad, 2)
+
+	var apiErr *lbclient.APIError
+	if _, err := c.RemoveWorker(ctx, "worker-2", false); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusConflict || apiErr.Body.Worker != "worker-2" {
+		t.Fatalf("removing a busy worker: %v, want 409", err)
+	}
+	if _, err := c.RemoveWorker(ctx, "nope", false); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("removing an unknown worker: %v, want 404", err)
+	}
+	workers, err := c.RemoveWorker(ctx, "worker-2", true)
+	if err != nil {
+		t.Fatalf("RemoveWorker: %v", err)
+	}
+	if len(workers) != 1 || workers[0].Name != "worker-1" {
+		t.Errorf("workers left = %+v, want worker-1", workers)
+	}
+	if n := testutil.CollectAndCount(lb.metrics.workerHealth); n != 0 {
+		t.Errorf("worker health series = %d, want none for a removed worker", n)
+	}
+	if n := testutil.CollectAndCount(lb.metrics.requestsTotal); n != 0 {
+		t.Errorf("request series = %d, want none for a removed worker", n)
+	}
+
+	// In-flight requests of the removed worker still complete and the pool
+	// keeps routing
+	atomic.AddInt32(&w2.CurrentLoad, -2)
+	if resp, err := c.SubmitTask(ctx, lbclient.TaskRequest{ID: "t", Weight: 1}); err != nil || resp.Worker != "worker-1" {
+		t.Errorf("SubmitTask after removal = %+v, %v", resp, err)
+	}
+}
+
+func TestClientStreamStatus(t *testing.T) {
+	c := newInProcessLB(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ch, err := c.StreamStatus(ctx)
+	if err != nil {
+		t.Fatalf("StreamStatus: %v", err)
+	}
+	first := <-ch
+	if first.Algorithm != "round-robin" {
+		t.Fatalf("initial status algorithm = %q", first.Algorithm)
+	}
+
+	if _, err := c.SetAlgorithm(ctx, "random"); err != nil {
+		t.Fatalf("SetAlgorithm: %v", err)
+	}
+	for status := range ch {
+		if status.Algorithm == "random" {
+			cancel()
+			break
+		}
+	}
+}
+
+// TestStatusMatchesAPIDocument guards against the status map drifting from
+// the api.Status type shared with clients
+func TestStatusMatchesAPIDocument(t *testing.T) {
+	lb := NewLoadBalancer("lru-worker")
+	lb.AddWorker("worker-1", "http://localhost:8081", "#FF0000", 1)
+
+	data, err := json.Marshal(lb.GetStatus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var status api.Status
+	if err := dec.Decode(&status); err != nil {
+		t.Fatalf("status does not match api.Status: %v", err)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// Worker history for GET /compare. Every worker's outcomes are counted in
+// historyBucketWidth buckets covering historyRetention, so a comparison
+// window is rounded to whole buckets.
+const (
+	historyBucketWidth   = 10 * time.Second
+	historyRetention     = 15 * time.Minute
+	historySlots         = int(historyRetention / historyBucketWidth)
+	defaultCompareWindow = 5 * time.Minute
+)
+
+// historyBucket counts one worker's outcomes during one bucket
+type historyBucket struct {
+	start          int64 // unix seconds, aligned to historyBucketWidth
+	requests       int64
+	errors         int64
+	latency        []int64
+	queueWaitSumMs float64
+	queueWaits     int64
+	rejections     map[string]int64
+	circuitOpens   int64
+	ejections      int64
+}
+
+// workerHistory keeps a ring of buckets per worker
+type workerHistory struct {
+	mu      sync.Mutex
+	workers map[string][]historyBucket
+}
+
+func newWorkerHistory() *workerHistory {
+	return &workerHistory{workers: make(map[string][]historyBucket)}
+}
+
+// bucket returns worker's bucket for now, resetting a stale slot
+func (h *workerHistory) bucket(worker string, now time.Time) *historyBucket {
+	ring, ok := h.workers[worker]
+	if !ok {
+		ring = make([]historyBucket, historySlots)
+		h.workers[worker] = ring
+	}
+	start := now.Truncate(historyBucketWidth).Unix()
+	b := &ring[(start/int64(historyBucketWidth/time.Second))%int64(historySlots)]
+	if b.start != start {
+		*b = historyBucket{start: start}
+	}
+	return b
+}
+
+// observe records a task forwarded to worker. queueWait is the worker's
+// reported queue wait in ms, if any.
+func (h *workerHistory) observe(worker string, now time.Time, latency time.Duration, failed bool, queueWait *float64) {
+	ms := float64(latency) / float64(time.Millisecond)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	b := h.bucket(worker, now)
+	if b.latency == nil {
+		b.latency = make([]int64, len(statsLatencyBuckets)+1)
+	}
+	b.requests++
+	if failed {
+		b.errors++
+	}
+	b.latency[sort.SearchFloat64s(statsLatencyBuckets, ms)]++
+	if queueWait != nil {
+		b.queueWaitSumMs += *queueWait
+		b.queueWaits++
+	}
+}
+
+// reject records a task worker turned away for reason
+func (h *workerHistory) reject(worker string, now time.Time, reason string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	b := h.bucket(worker, now)
+	if b.rejections == nil {
+		b.rejections = make(map[string]int64)
+	}
+	b.rejections[reason]++
+}
+
+// circuitOpened records that worker's circuit opened
+func (h *workerHistory) circuitOpened(worker string, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.bucket(worker, now).circuitOpens++
+}
+
+// ejected records that health checks took worker out of rotation
+func (h *workerHistory) ejected(worker string, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.bucket(worker, now).ejections++
+}
+
+func (h *workerHistory) size() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for _, ring := range h.workers {
+		for _, b := range ring {
+			if b.start != 0 {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func (h *workerHistory) bounds() storeBounds {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return storeBounds{Capacity: len(h.workers) * historySlots, MaxAgeMs: historyRetention.Milliseconds()}
+}
+
+// sweep clears buckets older than the retention and drops workers with none
+// left
+func (h *workerHistory) sweep(now time.Time) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	cutoff := now.Add(-historyRetention).Unix()
+	evicted := 0
+	for name, ring := range h.workers {
+		live := 0
+		for i := range ring {
+			if ring[i].start == 0 {
+				continue
+			}
+			if ring[i].start < cutoff {
+				ring[i] = historyBucket{}
+				evicted++
+				continue
+			}
+			live++
+		}
+		if live == 0 {
+			delete(h.workers, name)
+		}
+	}
+	return evicted
+}
+
+// WorkerComparison is one worker's column of GET /compare
+type WorkerComparison struct {
+	Worker         string           `json:"worker"`
+	Requests       int64            `json:"requests"`
+	Errors         int64            `json:"errors"`
+	SuccessRate    *float64         `json:"successRate"`
+	P50LatencyMs   float64          `json:"p50LatencyMs"`
+	P95LatencyMs   float64          `json:"p95LatencyMs"`
+	P99LatencyMs   float64          `json:"p99LatencyMs"`
+	AvgQueueWaitMs *float64         `json:"avgQueueWaitMs"`
+	Rejections     map[string]int64 `json:"rejections"`
+	CircuitOpens   int64            `json:"circuitOpens"`
+	Ejections      int64            `json:"ejections"`
+}
+
+// compare sums worker's buckets that started at or after from
+func (h *workerHistory) compare(worker string, from time.Time) WorkerComparison {
+	c := WorkerComparison{Worker: worker, Rejections: map[string]int64{}}
+	snap := statsSnapshot{Buckets: make([]int64, len(statsLatencyBuckets)+1)}
+	var queueWaitSum float64
+	var queueWaits int64
+
+	h.mu.Lock()
+	for _, b := range h.workers[worker] {
+		if b.start == 0 || b.start < from.Unix() {
+			continue
+		}
+		c.Requests += b.requests
+		c.Errors += b.errors
+		for i, n := range b.latency {
+			snap.Buckets[i] += n
+		}
+		queueWaitSum += b.queueWaitSumMs
+		queueWaits += b.queueWaits
+		for reason, n := range b.rejections {
+			c.Rejections[reason] += n
+		}
+		c.CircuitOpens += b.circuitOpens
+		c.Ejections += b.ejections
+	}
+	h.mu.Unlock()
+
+	if c.Requests > 0 {
+		c.SuccessRate = ptr(float64(c.Requests-c.Errors) / float64(c.Requests))
+		c.P50LatencyMs = snap.quantile(0.5)
+		c.P95LatencyMs = snap.quantile(0.95)
+		c.P99LatencyMs = snap.quantile(0.99)
+	}
+	if queueWaits > 0 {
+		c.AvgQueueWaitMs = ptr(queueWaitSum / float64(queueWaits))
+	}
+	return c
+}
+
+// Comparison is the response of GET /compare
+type Comparison struct {
+	WindowMs int64              `json:"windowMs"`
+	From     time.Time          `json:"from"`
+	To       time.Time          `json:"to"`
+	Workers  []WorkerComparison `json:"workers"`
+}
+
+// Compare returns the comparison of the named workers, in the order given,
+// over the last window. It also returns the names that are not workers.
+func (lb *LoadBalancer) Compare(names []string, window time.Duration) (Comparison, []string) {
+	lb.mu.RLock()
+	pool := make([]string, len(lb.workers))
+	known := make(map[string]bool, len(lb.workers))
+	for i, w := range lb.workers {
+		pool[i] = w.Name
+		known[w.Name] = true
+	}
+	lb.mu.RUnlock()
+	if len(names) == 0 {
+		names = pool
+	}
+
+	var unknown []string
+	for _, name := range names {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		return Comparison{}, unknown
+	}
+
+	now := lb.clock.Now()
+	// The oldest bucket included is the one containing now - window + width
+	from := now.Add(-window + historyBucketWidth).Truncate(historyBucketWidth)
+	c := Comparison{WindowMs: window.Milliseconds(), From: from.UTC(), To: now.UTC(), Workers: make([]WorkerComparison, 0, len(names))}
+	for _, name := range names {
+		c.Workers = append(c.Workers, lb.history.compare(name, from))
+	}
+	return c, nil
+}
+
+// reportedQueueWait returns the queue wait in ms a worker reported in its
+// task response as queueWaitMs or queue_wait_ms, if any
+func reportedQueueWait(result map[string]interface{}) *float64 {
+	for _, key := range []string{"queueWaitMs", "queue_wait_ms"} {
+		if v, ok := result[key].(float64); ok && v >= 0 {
+			return &v
+		}
+	}
+	return nil
+}
+
+// parseCompareWindow parses the window parameter, e.g. "5m"
+func parseCompareWindow(raw string) (time.Duration, error) {
+	if raw == "" {
+		return defaultCompareWindow, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d < historyBucketWidth || d > historyRetention {
+		return 0, fmt.Errorf("window must be a duration between %s and %s", historyBucketWidth, historyRetention)
+	}
+	return d, nil
+}
+
+// handleCompare は GET /compare?workers=a,b&window=5m で指定ワーカーのリクエスト数、成功率、レイテンシ p50/p95/p99、平均キュー待ち時間、拒否理由の内訳、サーキットオープン・離脱回数を並べて返す HTTP ハンドラです。
+// workers を省略するとプール順の全ワーカーを、指定した場合はその順で返します。存在しないワーカー名は unknown に列挙して 400 を返します。
+// 集計は 10 秒単位のバケットで行われ、window は 10s から 15m の範囲で指定できます (既定 5m)。
+func handleCompare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	window, err := parseCompareWindow(r.URL.Query().Get("window"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(api.ErrorResponse{Error: err.Error(), Field: "window"})
+		return
+	}
+	var names []string
+	for _, name := range strings.Split(r.URL.Query().Get("workers"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	c, unknown := lb.Compare(names, window)
+	if len(unknown) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(api.ErrorResponse{
+			Error:   "unknown workers: " + strings.Join(unknown, ", "),
+			Field:   "workers",
+			Unknown: unknown,
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(c)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+func getComparison(t *testing.T, srv *httptest.Server, query string) (int, Comparison, api.ErrorResponse) {
+	t.Helper()
+	resp, err := http.Get(srv.URL + "/api/compare" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var c Comparison
+	var e api.ErrorResponse
+	if resp.StatusCode == http.StatusOK {
+		json.NewDecoder(resp.Body).Decode(&c)
+	} else {
+		json.NewDecoder(resp.Body).Decode(&e)
+	}
+	return resp.StatusCode, c, e
+}
+
+func TestCompareWorkers(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	clk := newFakeClock()
+	lb.clock = clk
+	lb.AddWorker("go-worker-1", "http://go", "", 1)
+	lb.AddWorker("rust-worker-1", "http://rust", "", 1)
+	lb.AddWorker("python-worker-1", "http://python", "", 1)
+	srv := httptest.NewServer(newMux())
+	defer srv.Close()
+
+	h := lb.history
+	// Outside a 1m window: go-worker-1 failing slowly
+	for i := 0; i < 10; i++ {
+		h.observe("go-worker-1", clk.Now(), 900*time.Millisecond, true, nil)
+	}
+	h.circuitOpened("go-worker-1", clk.Now())
+	clk.Advance(2 * time.Minute)
+
+	wait := func(ms float64) *float64 { return &ms }
+	for i := 0; i < 90; i++ {
+		h.observe("go-worker-1", clk.Now(), 3*time.Millisecond, false, wait(2))
+	}
+	for i := 0; i < 10; i++ {
+		h.observe("go-worker-1", clk.Now(), 30*time.Millisecond, i < 5, wait(8))
+	}
+	for i := 0; i < 4; i++ {
+		h.observe("rust-worker-1", clk.Now(), 1500*time.Microsecond, false, nil)
+	}
+	h.reject("rust-worker-1", clk.Now(), rejectQueueFull)
+	h.reject("rust-worker-1", clk.Now(), rejectQueueFull)
+	h.reject("rust-worker-1", clk.Now(), rejectOverloaded)
+	h.ejected("rust-worker-1", clk.Now())
+
+	code, c, _ := getComparison(t, srv, "?workers=rust-worker-1,go-worker-1,python-worker-1&window=1m")
+	if code != http.StatusOK || len(c.Workers) != 3 {
+		t.Fatalf("compare: %d %+v", code, c)
+	}
+	if c.WindowMs != time.Minute.Milliseconds() {
+		t.Errorf("windowMs = %d", c.WindowMs)
+	}
+	rust, gow, py := c.Workers[0], c.Workers[1], c.Workers[2]
+	if rust.Worker != "rust-worker-1" || gow.Worker != "go-worker-1" || py.Worker != "python-worker-1" {
+		t.Fatalf("order = %s, %s, %s; want the requested order", rust.Worker, gow.Worker, py.Worker)
+	}
+	if gow.Requests != 100 || gow.Errors != 5 || *gow.SuccessRate != 0.95 {
+		t.Errorf("go counts = %d/%d %v", gow.Requests, gow.Errors, *gow.SuccessRate)
+	}
+	// 90 requests in (2,5] ms and 10 in (20,50] ms
+	if gow.P50LatencyMs <= 2 || gow.P50LatencyMs > 5 || gow.P99LatencyMs <= 20 || gow.P99LatencyMs > 50 {
+		t.Errorf("go latency p50=%v p99=%v", gow.P50LatencyMs, gow.P99LatencyMs)
+	}
+	if gow.AvgQueueWaitMs == nil || *gow.AvgQueueWaitMs != 2.6 {
+		t.Errorf("go queue wait = %v, want 2.6", gow.AvgQueueWaitMs)
+	}
+	if gow.CircuitOpens != 0 {
+		t.Errorf("go circuit opens = %d, want the old one outside the window", gow.CircuitOpens)
+	}
+	if rust.Rejections[rejectQueueFull] != 2 || rust.Rejections[rejectOverloaded] != 1 || rust.Ejections != 1 {
+		t.Errorf("rust = %+v", rust)
+	}
+	if rust.AvgQueueWaitMs != nil {
+		t.Errorf("rust queue wait = %v, want none reported", *rust.AvgQueueWaitMs)
+	}
+	if py.Requests != 0 || py.SuccessRate != nil {
+		t.Errorf("python = %+v, want no requests", py)
+	}
+
+	_, c, _ = getComparison(t, srv, "?workers=go-worker-1&window=5m")
+	if gow := c.Workers[0]; gow.Requests != 110 || gow.CircuitOpens != 1 {
+		t.Errorf("5m window: %d requests, %d circuit opens; want 110, 1", gow.Requests, gow.CircuitOpens)
+	}
+
+	_, c, _ = getComparison(t, srv, "")
+	if len(c.Workers) != 3 || c.Workers[0].Worker != "go-worker-1" {
+		t.Errorf("all workers: %+v, want pool order", c.Workers)
+	}
+}
+
+func TestCompareErrors(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("go-worker-1", "http://go", "", 1)
+	srv := httptest.NewServer(newMux())
+	defer srv.Close()
+
+	code, _, e := getComparison(t, srv, "?workers=go-worker-1,ghost,nobody")
+	if code != http.StatusBadRequest || e.Field != "workers" || len(e.Unknown) != 2 || e.Unknown[0] != "ghost" {
+		t.Errorf("unknown workers: %d %+v", code, e)
+	}
+	for _, window := range []string{"soon", "1s", "1h"} {
+		if code, _, e := getComparison(t, srv, "?window="+window); code != http.StatusBadRequest || e.Field != "window" {
+			t.Errorf("window=%s: %d %+v", window, code, e)
+		}
+	}
+}
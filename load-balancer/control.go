@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Worker control notifications. When a worker starts draining, is disabled
+// or is enabled again, the LB POSTs the action to the worker's /control so
+// it can log it, flip its readiness and turn away new tasks. Delivery is
+// best effort and never holds up the transition: an unreachable worker or a
+// 5xx is retried a few times, and a worker without /control (404) is left
+// alone. Notifications run under the LB's control context: stopControl
+// cancels the ones still retrying and waits for them to return.
+const (
+	controlDrain   = "drain"
+	controlDisable = "disable"
+	controlEnable  = "enable"
+
+	controlAttempts = 3
+
+	defaultControlRetryDelay = 200 * time.Millisecond
+)
+
+// controlRequest is the body of a control notification. Deadline is when
+// the LB expects the action to have taken effect: for a drain, when the
+// tasks in flight will have run out of their upstream timeout. Seq orders
+// the notifications, so a worker can ignore one that arrives late.
+type controlRequest struct {
+	Action   string    `json:"action"`
+	Deadline time.Time `json:"deadline"`
+	Seq      uint64    `json:"seq"`
+}
+
+// notifyWorkerLocked sends action to w in the background. Must be called
+// with lb.mu held.
+func (lb *LoadBalancer) notifyWorkerLocked(w *Worker, action string) {
+	lb.controlSeq++
+	deadline := lb.clock.Now().UTC()
+	if action == controlDrain {
+		deadline = deadline.Add(lb.upstreamTimeout)
+	}
+	req := controlRequest{Action: action, Deadline: deadline, Seq: lb.controlSeq}
+	lb.controlWG.Add(1)
+	go func() {
+		defer lb.controlWG.Done()
+		lb.sendControl(lb.controlCtx, w.Name, req)
+	}()
+}
+
+// stopControl cancels the control notifications in flight and waits for
+// them to return
+func (lb *LoadBalancer) stopControl() {
+	lb.controlCancel()
+	lb.controlWG.Wait()
+}
+
+// sendControl delivers req to the named worker's /control, retrying while
+// the worker is unreachable or answers 5xx, until ctx is done
+func (lb *LoadBalancer) sendControl(ctx context.Context, name string, req controlRequest) {
+	body, _ := json.Marshal(req)
+	for attempt := 1; ; attempt++ {
+		resp, err := lb.callWorker(ctx, name, http.MethodPost, "/control", bytes.NewReader(body))
+		switch {
+		case errors.Is(err, errWorkerNotFound):
+			return
+		case err == nil && resp.status < http.StatusInternalServerError:
+			// 404 and 405 are a worker that does not support control
+			return
+		case err == nil:
+			err = errors.New(http.StatusText(resp.status))
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if attempt == controlAttempts {
+			log.Printf("Failed to notify %s of %s: %v", name, req.Action, err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(lb.controlRetryDelay):
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newControlWorker returns a worker that sends the control requests it gets
+// on the returned channel and answers them with controlStatus. Its tasks
+// wait for release.
+func newControlWorker(t *testing.T, controlStatus int, release <-chan struct{}) (*httptest.Server, <-chan controlRequest) {
+	t.Helper()
+	got := make(chan controlRequest, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/control" {
+			var req controlRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			got <- req
+			w.WriteHeader(controlStatus)
+			return
+		}
+		<-release
+		json.NewEncoder(w).Encode(map[string]interface{}{"worker": "worker-1"})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, got
+}
+
+// nextControl returns the next control request a worker got
+func nextControl(t *testing.T, got <-chan controlRequest) controlRequest {
+	t.Helper()
+	select {
+	case req := <-got:
+		return req
+	case <-time.After(2 * time.Second):
+		t.Fatal("no control request")
+		return controlRequest{}
+	}
+}
+
+func TestControlNotifications(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	t.Cleanup(lb.stopControl)
+	release := make(chan struct{})
+	srv, got := newControlWorker(t, http.StatusOK, release)
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+	done := startBlockedTask(t, lb.workers[0])
+
+	before := time.Now()
+	patchWorker("worker-1", `{"enabled":false}`)
+	drain := nextControl(t, got)
+	if drain.Action != controlDrain || drain.Deadline.Before(before.Add(lb.upstreamTimeout-time.Second)) {
+		t.Errorf("first notification = %+v, want a drain with the upstream timeout as deadline", drain)
+	}
+
+	// Finishing the drain disables the worker
+	close(release)
+	<-done
+	disable := nextControl(t, got)
+	if disable.Action != controlDisable || disable.Seq <= drain.Seq {
+		t.Errorf("second notification = %+v, want a later disable", disable)
+	}
+
+	patchWorker("worker-1", `{"enabled":true}`)
+	if enable := nextControl(t, got); enable.Action != controlEnable || enable.Seq <= disable.Seq {
+		t.Errorf("third notification = %+v, want a later enable", enable)
+	}
+
+	// Updates that change nothing send nothing
+	patchWorker("worker-1", `{"enabled":true,"weight":3}`)
+	select {
+	case req := <-got:
+		t.Errorf("unexpected notification %+v", req)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestControlNotSupported(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.controlRetryDelay = time.Millisecond
+	t.Cleanup(lb.stopControl)
+	srv, got := newControlWorker(t, http.StatusNotFound, nil)
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+
+	rec := patchWorker("worker-1", `{"enabled":false}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("patch status = %d", rec.Code)
+	}
+	nextControl(t, got)
+	select {
+	case req := <-got:
+		t.Errorf("404 was retried: %+v", req)
+	case <-time.After(50 * time.Millisecond):
+	}
+	lb.mu.RLock()
+	enabled := lb.workers[0].Enabled
+	lb.mu.RUnlock()
+	if enabled {
+		t.Error("worker still enabled")
+	}
+}
+
+func TestControlRetries(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < controlAttempts {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+	lb = NewLoadBalancer("round-robin")
+	lb.controlRetryDelay = time.Millisecond
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+
+	lb.sendControl(context.Background(), "worker-1", controlRequest{Action: controlDisable})
+	if n := atomic.LoadInt32(&calls); n != controlAttempts {
+		t.Errorf("%d attempts, want %d", n, controlAttempts)
+	}
+}
+
+func TestDrainingRejectionRetried(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	draining := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(rejectReasonHeader, rejectDraining)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer draining.Close()
+	lb.AddWorker("worker-1", draining.URL, "#FF0000", 1)
+	lb.AddWorker("worker-2", newBlockingWorker(t, "worker-2", closedChan()).URL, "#00FF00", 1)
+
+	if rec := doTask(nil); rec.Code != http.StatusOK || servedBy(t, rec) != "worker-2" {
+		t.Errorf("status %d, want the task retried on worker-2", rec.Code)
+	}
+}
+
+// closedChan returns a closed channel, for workers that never block
+func closedChan() <-chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}
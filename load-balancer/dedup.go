@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// De-duplication of /task requests. A task whose id and body match one that
+// is in flight, or that completed less than the window ago, is answered from
+// the original instead of being forwarded again. Tasks without an id are
+// never de-duplicated.
+const (
+	dedupCapacity    = 10000
+	maxDedupWindowMs = 60000
+)
+
+// De-duplication policies
+const (
+	// dedupReplay waits for the original and returns its response
+	dedupReplay = "replay"
+	// dedupReject answers 409 with the original's request ID
+	dedupReject = "reject"
+)
+
+// dedupOfHeader names the request a replayed response was taken from
+const dedupOfHeader = "X-Deduplicated-Of"
+
+// dedupEntry is an in-flight or recently completed task. status and body are
+// set before done is closed.
+type dedupEntry struct {
+	task      TaskRequest
+	requestID string
+	done      chan struct{}
+	status    int
+	header    http.Header
+	body      []byte
+	expires   time.Time
+}
+
+// expired reports whether the entry completed more than the window ago.
+// In-flight entries never expire.
+func (e *dedupEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// dedupStore holds the de-duplication entries by task id. It is bounded:
+// when full and nothing has expired, new tasks are forwarded untracked.
+type dedupStore struct {
+	mu       sync.Mutex
+	entries  map[string]*dedupEntry
+	capacity int
+}
+
+func newDedupStore(capacity int) *dedupStore {
+	return &dedupStore{entries: make(map[string]*dedupEntry), capacity: capacity}
+}
+
+func (s *dedupStore) size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+func (s *dedupStore) bounds() storeBounds {
+	return storeBounds{Capacity: s.capacity}
+}
+
+// sweep evicts the entries whose window has passed
+func (s *dedupStore) sweep(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sweepLocked(now)
+}
+
+func (s *dedupStore) sweepLocked(now time.Time) int {
+	n := 0
+	for id, e := range s.entries {
+		if e.expired(now) {
+			delete(s.entries, id)
+			n++
+		}
+	}
+	return n
+}
+
+// begin returns the original when task duplicates a tracked one. Otherwise
+// it tracks task and returns the new entry, which the caller must finish;
+// both are nil when the task cannot be tracked.
+func (s *dedupStore) begin(task TaskRequest, requestID string, now time.Time) (entry, original *dedupEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[task.ID]; ok {
+		switch {
+		case e.expired(now):
+			delete(s.entries, task.ID)
+		case sameTask(e.task, task):
+			return nil, e
+		default:
+			// Same id, different task: forward it without tracking
+			return nil, nil
+		}
+	}
+	if len(s.entries) >= s.capacity && s.sweepLocked(now) == 0 {
+		return nil, nil
+	}
+	e := &dedupEntry{task: task, requestID: requestID, done: make(chan struct{})}
+	s.entries[task.ID] = e
+	return e, nil
+}
+
+// finish records the response of e and keeps it for window
+func (s *dedupStore) finish(e *dedupEntry, status int, header http.Header, body []byte, now time.Time, window time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.status, e.header, e.body = status, header, body
+	e.expires = now.Add(window)
+	close(e.done)
+}
+
+// sameTask reports whether a and b are the same task
+func sameTask(a, b TaskRequest) bool {
+	return a.ID == b.ID && a.Weight == b.Weight && a.Synthetic == b.Synthetic && maps.Equal(a.Tags, b.Tags)
+}
+
+// replayedHeaders are the response headers a replay copies from the
+// original: those describing a passed-through body
+var replayedHeaders = []string{"Content-Type", workerHeader, workerColorHeader, processingTimeHeader, upstreamTotalHeader}
+
+// dedupRecorder passes a response through while keeping its status, the
+// replayed headers and body for replay
+type dedupRecorder struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (r *dedupRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+		r.header = make(http.Header)
+		for _, k := range replayedHeaders {
+			if v := r.Header().Get(k); v != "" {
+				r.header.Set(k, v)
+			}
+		}
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *dedupRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// dedupSettings returns the window and policy, with a zero window meaning
+// de-duplication is off
+func (lb *LoadBalancer) dedupSettings() (time.Duration, string) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.dedupWindow, lb.dedupPolicy
+}
+
+// dedupTask handles task de-duplication for handleTask. It returns true when
+// a duplicate has been answered. Otherwise the returned writer must be used
+// for the response and finish called once it is written.
+func (lb *LoadBalancer) dedupTask(w http.ResponseWriter, r *http.Request, task TaskRequest, requestID string) (http.ResponseWriter, func(), bool) {
+	window, policy := lb.dedupSettings()
+	if window <= 0 || task.ID == "" {
+		return w, func() {}, false
+	}
+	entry, original := lb.dedup.begin(task, requestID, lb.clock.Now())
+	if original != nil {
+		lb.metrics.dedupHits.WithLabelValues(policy).Inc()
+		lb.answerDuplicate(w, r, original, policy)
+		return w, nil, true
+	}
+	if entry == nil {
+		return w, func() {}, false
+	}
+	rec := &dedupRecorder{ResponseWriter: w}
+	finish := func() {
+		status := rec.status
+		if status == 0 {
+			status = http.StatusBadGateway
+		}
+		lb.dedup.finish(entry, status, rec.header, rec.body.Bytes(), lb.clock.Now(), window)
+	}
+	return rec, finish, false
+}
+
+// answerDuplicate answers a duplicate of original according to policy
+func (lb *LoadBalancer) answerDuplicate(w http.ResponseWriter, r *http.Request, original *dedupEntry, policy string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(dedupOfHeader, original.requestID)
+	if policy == dedupReject {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error":     fmt.Sprintf("duplicate of request %s", original.requestID),
+			"requestId": original.requestID,
+		})
+		return
+	}
+	select {
+	case <-original.done:
+	case <-r.Context().Done():
+		return
+	}
+	for k, v := range original.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(original.status)
+	w.Write(original.body)
+}
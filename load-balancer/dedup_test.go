@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func setDedup(t *testing.T, windowMs int64, policy string) {
+	t.Helper()
+	s := lb.Settings()
+	s.DedupWindowMs, s.DedupPolicy = windowMs, policy
+	if _, err := lb.UpdateSettings(s); err != nil {
+		t.Fatalf("UpdateSettings: %v", err)
+	}
+}
+
+func postDupTask(body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handleTask(rec, httptest.NewRequest(http.MethodPost, "/task", bytes.NewBufferString(body)))
+	return rec
+}
+
+func TestDedupConcurrentReplay(t *testing.T) {
+	srv, calls := newCountingStub(t, "worker-1", 50*time.Millisecond)
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+	setDedup(t, 1000, dedupReplay)
+
+	recs := make([]*httptest.ResponseRecorder, 2)
+	var wg sync.WaitGroup
+	for i := range recs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			recs[i] = postDupTask(`{"id":"dup","weight":1}`)
+		}(i)
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(calls); n != 1 {
+		t.Fatalf("upstream calls = %d, want 1", n)
+	}
+	for i, rec := range recs {
+		if rec.Code != http.StatusOK {
+			t.Fatalf("caller %d: %d %s", i, rec.Code, rec.Body.String())
+		}
+	}
+	if recs[0].Body.String() != recs[1].Body.String() {
+		t.Errorf("bodies differ: %s / %s", recs[0].Body.String(), recs[1].Body.String())
+	}
+	original, replayed := recs[0], recs[1]
+	if original.Header().Get(dedupOfHeader) != "" {
+		original, replayed = replayed, original
+	}
+	if got := replayed.Header().Get(dedupOfHeader); got == "" || got != original.Header().Get(requestIDHeader) {
+		t.Errorf("%s = %q, want the original's request ID %q", dedupOfHeader, got, original.Header().Get(requestIDHeader))
+	}
+	if hits := testutil.ToFloat64(lb.metrics.dedupHits.WithLabelValues(dedupReplay)); hits != 1 {
+		t.Errorf("dedup hits = %v, want 1", hits)
+	}
+}
+
+func TestDedupRejectPolicy(t *testing.T) {
+	srv, calls := newCountingStub(t, "worker-1", 0)
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+	setDedup(t, 1000, dedupReject)
+
+	first := postDupTask(`{"id":"dup","weight":1}`)
+	second := postDupTask(`{"id":"dup","weight":1}`)
+	if first.Code != http.StatusOK || second.Code != http.StatusConflict {
+		t.Fatalf("codes = %d/%d, want 200/409", first.Code, second.Code)
+	}
+	var body map[string]string
+	json.NewDecoder(second.Body).Decode(&body)
+	if body["requestId"] != first.Header().Get(requestIDHeader) {
+		t.Errorf("requestId = %q, want %q", body["requestId"], first.Header().Get(requestIDHeader))
+	}
+	if n := atomic.LoadInt32(calls); n != 1 {
+		t.Errorf("upstream calls = %d, want 1", n)
+	}
+}
+
+func TestDedupWindowAndIdentity(t *testing.T) {
+	srv, calls := newCountingStub(t, "worker-1", 0)
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+	clk := newFakeClock()
+	lb.clock = clk
+
+	// Off by default
+	postDupTask(`{"id":"dup","weight":1}`)
+	postDupTask(`{"id":"dup","weight":1}`)
+	if n := atomic.LoadInt32(calls); n != 2 {
+		t.Fatalf("upstream calls = %d with de-duplication off, want 2", n)
+	}
+
+	setDedup(t, 100, dedupReplay)
+	postDupTask(`{"id":"dup","weight":1}`)
+	postDupTask(`{"id":"dup","weight":1}`)
+	if n := atomic.LoadInt32(calls); n != 3 {
+		t.Errorf("upstream calls = %d, want the duplicate replayed", n)
+	}
+	// Same id, different body
+	postDupTask(`{"id":"dup","weight":2}`)
+	// No id
+	postDupTask(`{"weight":1}`)
+	postDupTask(`{"weight":1}`)
+	if n := atomic.LoadInt32(calls); n != 6 {
+		t.Errorf("upstream calls = %d, want different and id-less tasks forwarded", n)
+	}
+
+	clk.Advance(100 * time.Millisecond)
+	postDupTask(`{"id":"dup","weight":1}`)
+	if n := atomic.LoadInt32(calls); n != 7 {
+		t.Errorf("upstream calls = %d, want a forward once the window passed", n)
+	}
+	if evicted := lb.dedup.sweep(clk.Now().Add(100 * time.Millisecond)); evicted != 1 || lb.dedup.size() != 0 {
+		t.Errorf("sweep evicted %d, size %d; want 1, 0", evicted, lb.dedup.size())
+	}
+}
+
+func TestDedupStoreBounded(t *testing.T) {
+	s := newDedupStore(2)
+	now := time.Now()
+	a, _ := s.begin(TaskRequest{ID: "a"}, "r1", now)
+	s.begin(TaskRequest{ID: "b"}, "r2", now)
+	if e, orig := s.begin(TaskRequest{ID: "c"}, "r3", now); e != nil || orig != nil {
+		t.Fatal("a full store of in-flight tasks should not track more")
+	}
+	s.finish(a, http.StatusOK, nil, nil, now, time.Second)
+	if e, _ := s.begin(TaskRequest{ID: "c"}, "r3", now.Add(time.Second)); e == nil {
+		t.Fatal("an expired entry should make room")
+	}
+	if s.size() != 2 {
+		t.Errorf("size = %d, want 2", s.size())
+	}
+}
+
+func TestDedupSettingsValidation(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	s := lb.Settings()
+	if s.DedupWindowMs != 0 || s.DedupPolicy != dedupReplay {
+		t.Errorf("defaults = %d %q, want 0 replay", s.DedupWindowMs, s.DedupPolicy)
+	}
+	s.DedupPolicy = "drop"
+	if err := validateSettings(s); err == nil || err.(*SettingsError).Field != "dedupPolicy" {
+		t.Errorf("policy: err = %v", err)
+	}
+	s.DedupPolicy, s.DedupWindowMs = dedupReject, maxDedupWindowMs+1
+	if err := validateSettings(s); err == nil || err.(*SettingsError).Field != "dedupWindowMs" {
+		t.Errorf("window: err = %v", err)
+	}
+}
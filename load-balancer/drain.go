@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Graceful drain. Disabling a worker that has tasks in flight first marks it
+// draining: it gets no new tasks but stays enabled until the tasks it has
+// finish, so they complete normally. Re-enabling it meanwhile cancels the
+// drain. A worker can also be drained on its own, ahead of taking it down:
+// it then stays draining once idle, with a worker_drain_completed event,
+// until the drain is lifted or the worker disabled. Each step is sent to
+// the worker; see notifyWorkerLocked.
+const drainPollInterval = 100 * time.Millisecond
+
+// disableWorkerLocked disables w, draining it first if it is busy. Must be
+// called with lb.mu held.
+func (lb *LoadBalancer) disableWorkerLocked(w *Worker) {
+	if !w.Enabled || (w.Draining && !w.drainOnly) {
+		return
+	}
+	if atomic.LoadInt32(&w.CurrentLoad) == 0 {
+		w.Enabled, w.Draining, w.drainOnly = false, false, false
+		lb.notifyWorkerLocked(w, controlDisable)
+		return
+	}
+	lb.startDrainLocked(w, false)
+}
+
+// setDrainingLocked starts or lifts a drain of w that leaves it enabled.
+// A disabled worker has nothing to drain. Must be called with lb.mu held.
+func (lb *LoadBalancer) setDrainingLocked(w *Worker, draining bool) {
+	switch {
+	case !w.Enabled || draining == w.Draining:
+	case draining:
+		lb.startDrainLocked(w, true)
+	default:
+		w.Draining, w.drainOnly = false, false
+		w.drainGen++
+		lb.notifyWorkerLocked(w, controlEnable)
+	}
+}
+
+// startDrainLocked marks w draining and waits for it in the background;
+// drainOnly keeps it enabled once idle. Must be called with lb.mu held.
+func (lb *LoadBalancer) startDrainLocked(w *Worker, drainOnly bool) {
+	if !w.Draining {
+		lb.notifyWorkerLocked(w, controlDrain)
+	}
+	w.Draining, w.drainOnly = true, drainOnly
+	w.drainGen++
+	go lb.finishDrain(w, w.drainGen)
+}
+
+// SetWorkerDraining drains the named worker without disabling it, or lifts
+// its drain
+func (lb *LoadBalancer) SetWorkerDraining(name string, draining bool) bool {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	w := lb.findWorkerLocked(name)
+	if w == nil {
+		return false
+	}
+	lb.setDrainingLocked(w, draining)
+	w.revision++
+	return true
+}
+
+// finishDrain polls w until it has no tasks in flight and then disables it,
+// or for a drain that keeps it enabled reports it drained, unless drain gen
+// was cancelled or replaced meanwhile
+func (lb *LoadBalancer) finishDrain(w *Worker, gen uint64) {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		idle := atomic.LoadInt32(&w.CurrentLoad) == 0
+		lb.mu.Lock()
+		if !w.Draining || w.drainGen != gen {
+			lb.mu.Unlock()
+			return
+		}
+		if !idle {
+			lb.mu.Unlock()
+			continue
+		}
+		if w.drainOnly {
+			lb.emitEvent("worker_drain_completed", fmt.Sprintf("Worker %s drained", w.Name), map[string]interface{}{
+				"worker": w.Name,
+			})
+			lb.mu.Unlock()
+			return
+		}
+		w.Draining = false
+		w.Enabled = false
+		w.revision++
+		lb.notifyWorkerLocked(w, controlDisable)
+		lb.emitEvent("worker_drained", fmt.Sprintf("Worker %s drained and disabled", w.Name), map[string]interface{}{
+			"worker": w.Name,
+		})
+		lb.mu.Unlock()
+		lb.BroadcastStatus()
+		return
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// newBlockingWorker returns a worker whose tasks wait for release
+func newBlockingWorker(t *testing.T, name string, release <-chan struct{}) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		json.NewEncoder(w).Encode(map[string]interface{}{"worker": name})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// startBlockedTask sends a task to the named worker and waits until the
+// worker has it in flight. The task's response is sent on the returned
+// channel.
+func startBlockedTask(t *testing.T, w *Worker) <-chan *httptest.ResponseRecorder {
+	t.Helper()
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() { done <- doTask(map[string]string{requireWorkerHeader: w.Name}) }()
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&w.CurrentLoad) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("task never reached the worker")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return done
+}
+
+func TestDrainBeforeDisable(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	t.Cleanup(lb.stopControl)
+	release := make(chan struct{})
+	lb.AddWorker("worker-1", newBlockingWorker(t, "worker-1", release).URL, "#FF0000", 1)
+	lb.AddWorker("worker-2", "http://localhost:8082", "#00FF00", 1)
+	w := lb.workers[0]
+	done := startBlockedTask(t, w)
+
+	rec := patchWorker("worker-1", `{"enabled":false}`)
+	var status api.WorkerStatus
+	json.NewDecoder(rec.Body).Decode(&status)
+	if rec.Code != http.StatusOK || !status.Draining || !status.Enabled {
+		t.Fatalf("patch: %d draining=%v enabled=%v, want a draining worker", rec.Code, status.Draining, status.Enabled)
+	}
+	for i := 0; i < 10; i++ {
+		if s := lb.SelectWorker(); s == nil || s.Name != "worker-2" {
+			t.Fatalf("selected %v while worker-1 drains", s)
+		}
+	}
+	workers := lb.GetStatus()["workers"].([]map[string]interface{})
+	if workers[0]["draining"] != true {
+		t.Errorf("status draining = %v, want true", workers[0]["draining"])
+	}
+
+	// The in-flight task completes, then the worker is disabled
+	close(release)
+	if rec := <-done; rec.Code != http.StatusOK {
+		t.Errorf("in-flight task status = %d, want 200", rec.Code)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		lb.mu.RLock()
+		enabled, draining := w.Enabled, w.Draining
+		lb.mu.RUnlock()
+		if !enabled && !draining {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("enabled=%v draining=%v after the drain", enabled, draining)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var drained int
+	for _, e := range lb.events.since(0, 0) {
+		if e.Type == "worker_drained" {
+			drained++
+		}
+	}
+	if drained != 1 {
+		t.Errorf("%d worker_drained events, want 1", drained)
+	}
+
+	// An idle worker is disabled at once
+	rec = patchWorker("worker-2", `{"enabled":false}`)
+	status = api.WorkerStatus{}
+	json.NewDecoder(rec.Body).Decode(&status)
+	if status.Enabled || status.Draining {
+		t.Errorf("idle worker: enabled=%v draining=%v", status.Enabled, status.Draining)
+	}
+}
+
+func TestDrainCancelledByEnable(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	t.Cleanup(lb.stopControl)
+	release := make(chan struct{})
+	lb.AddWorker("worker-1", newBlockingWorker(t, "worker-1", release).URL, "#FF0000", 1)
+	w := lb.workers[0]
+	done := startBlockedTask(t, w)
+
+	patchWorker("worker-1", `{"enabled":false}`)
+	patchWorker("worker-1", `{"enabled":true}`)
+	close(release)
+	<-done
+	time.Sleep(3 * drainPollInterval)
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	if !w.Enabled || w.Draining {
+		t.Errorf("enabled=%v draining=%v, want the drain cancelled", w.Enabled, w.Draining)
+	}
+}
+
+func TestDrainWithoutDisable(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	t.Cleanup(lb.stopControl)
+	release := make(chan struct{})
+	lb.AddWorker("worker-1", newBlockingWorker(t, "worker-1", release).URL, "#FF0000", 1)
+	lb.AddWorker("worker-2", newBlockingWorker(t, "worker-2", closedChan()).URL, "#00FF00", 1)
+	w := lb.workers[0]
+	done := startBlockedTask(t, w)
+
+	rec := patchWorker("worker-1", `{"draining":true}`)
+	var status api.WorkerStatus
+	json.NewDecoder(rec.Body).Decode(&status)
+	if rec.Code != http.StatusOK || !status.Draining || !status.Enabled || status.CurrentLoad != 1 {
+		t.Fatalf("patch: %d %+v, want an enabled draining worker with its task", rec.Code, status)
+	}
+	for i := 0; i < 10; i++ {
+		if rec := doTask(nil); rec.Code != http.StatusOK {
+			t.Fatalf("task %d: status %d while worker-1 drains", i, rec.Code)
+		}
+	}
+	if got := atomic.LoadInt64(&w.TotalRequests); got != 1 {
+		t.Errorf("worker-1 took %d requests, want only the one in flight", got)
+	}
+	if got := atomic.LoadInt64(&lb.workers[1].TotalRequests); got != 10 {
+		t.Errorf("worker-2 took %d requests, want 10", got)
+	}
+
+	// Once the task is done the worker stays enabled and draining
+	close(release)
+	<-done
+	deadline := time.Now().Add(2 * time.Second)
+	for drainEvents("worker_drain_completed") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no worker_drain_completed event")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(2 * drainPollInterval)
+	status, _ = lb.WorkerStatus("worker-1")
+	if !status.Enabled || !status.Draining || status.CurrentLoad != 0 {
+		t.Errorf("drained worker: %+v", status)
+	}
+	if n := drainEvents("worker_drain_completed"); n != 1 || drainEvents("worker_drained") != 0 {
+		t.Errorf("%d worker_drain_completed events, want 1 and no disable", n)
+	}
+
+	// Lifting the drain puts it back in rotation
+	patchWorker("worker-1", `{"draining":false}`)
+	picked := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		picked[lb.SelectWorker().Name] = true
+	}
+	if !picked["worker-1"] {
+		t.Errorf("worker-1 not selected after its drain was lifted: %v", picked)
+	}
+
+	// Disabling a drained worker disables it
+	patchWorker("worker-1", `{"draining":true}`)
+	rec = patchWorker("worker-1", `{"enabled":false}`)
+	status = api.WorkerStatus{}
+	json.NewDecoder(rec.Body).Decode(&status)
+	if status.Enabled || status.Draining {
+		t.Errorf("disabled drained worker: enabled=%v draining=%v", status.Enabled, status.Draining)
+	}
+}
+
+func drainEvents(typ string) int {
+	n := 0
+	for _, e := range lb.events.since(0, 0) {
+		if e.Type == typ {
+			n++
+		}
+	}
+	return n
+}
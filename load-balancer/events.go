@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Event store bounds: at most defaultEventCapacity events are kept, and a
+// cleanup sweep evicts events older than defaultEventMaxAge down to
+// defaultEventFloor of the most recent ones.
+const (
+	defaultEventCapacity = 500
+	defaultEventFloor    = 50
+	defaultEventMaxAge   = time.Hour
+)
+
+// Event is an entry in the LB's audit/event log
+type Event struct {
+	Seq     int64                  `json:"seq"`
+	Time    time.Time              `json:"time"`
+	Type    string                 `json:"type"`
+	Message string                 `json:"message"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+// eventStore is a bounded, sequence-numbered ring of events
+type eventStore struct {
+	mu       sync.Mutex
+	events   []Event
+	capacity int
+	floor    int
+	maxAge   time.Duration
+	lastSeq  int64
+}
+
+func newEventStore(capacity int) *eventStore {
+	return &eventStore{
+		events:   make([]Event, 0, capacity),
+		capacity: capacity,
+		floor:    defaultEventFloor,
+		maxAge:   defaultEventMaxAge,
+	}
+}
+
+// add appends an event, evicting the oldest one when the store is full
+func (s *eventStore) add(e Event) Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSeq++
+	e.Seq = s.lastSeq
+	if len(s.events) == s.capacity {
+		copy(s.events, s.events[1:])
+		s.events = s.events[:len(s.events)-1]
+	}
+	s.events = append(s.events, e)
+	return e
+}
+
+// since returns up to limit events with a sequence number greater than after
+func (s *eventStore) since(after int64, limit int) []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]Event, 0)
+	for _, e := range s.events {
+		if e.Seq <= after {
+			continue
+		}
+		if limit > 0 && len(out) == limit {
+			break
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// replay returns every event with a sequence number greater than after. ok
+// is false when some of them were already evicted, or after is ahead of the
+// log, so the caller cannot be brought up to date from the store.
+func (s *eventStore) replay(after int64) (events []Event, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if after > s.lastSeq {
+		return nil, false
+	}
+	if after < s.lastSeq && (len(s.events) == 0 || s.events[0].Seq > after+1) {
+		return nil, false
+	}
+	for _, e := range s.events {
+		if e.Seq > after {
+			events = append(events, e)
+		}
+	}
+	return events, true
+}
+
+// latestSeq returns the sequence number of the most recent event
+func (s *eventStore) latestSeq() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastSeq
+}
+
+func (s *eventStore) size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.events)
+}
+
+func (s *eventStore) bounds() storeBounds {
+	return storeBounds{Capacity: s.capacity, Floor: s.floor, MaxAgeMs: s.maxAge.Milliseconds()}
+}
+
+// sweep evicts events older than maxAge, always keeping the newest floor
+// events, and returns how many were evicted
+func (s *eventStore) sweep(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cutoff := now.Add(-s.maxAge)
+	n := 0
+	for n < len(s.events)-s.floor && s.events[n].Time.Before(cutoff) {
+		n++
+	}
+	if n > 0 {
+		s.events = append(s.events[:0], s.events[n:]...)
+	}
+	return n
+}
+
+// emitEvent records an event in the LB's event log and pushes it to the
+// WebSocket clients that opened a session
+func (lb *LoadBalancer) emitEvent(typ, message string, data map[string]interface{}) Event {
+	e := lb.events.add(Event{Time: lb.clock.Now().UTC(), Type: typ, Message: message, Data: data})
+	lb.notifyWSEvents()
+	return e
+}
+
+// handleEvents はイベントログを返す HTTP ハンドラです。
+// ?after=<seq> でそのシーケンス番号より新しいイベントのみを、?limit=<n> で最大件数を指定できます。
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	after, _ := strconv.ParseInt(r.URL.Query().Get("after"), 10, 64)
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"latestSeq": lb.events.latestSeq(),
+		"events":    lb.events.since(after, limit),
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Reasons a worker was not a candidate for a task, in the order they are
+// checked
+const (
+	excludedScheduled   = "scheduled_disable"
+	excludedDisabled    = "disabled"
+	excludedDraining    = "draining"
+	excludedUnhealthy   = "unhealthy"
+	excludedCircuitOpen = "circuit_open"
+	excludedMisconfig   = "misconfigured"
+	excludedRetry       = "already_tried"
+	excludedLabels      = "label_mismatch"
+	excludedLatency     = "latency_bound"
+	excludedSaturated   = "saturated"
+)
+
+// noWorkersReason is the dominant reason reported for an empty pool
+const noWorkersReason = "no_workers"
+
+// noEligibleWorkers is returned by selectWorker when no worker is a
+// candidate. Excluded maps every worker to the reason it was left out.
+type noEligibleWorkers struct {
+	excluded map[string]string
+}
+
+func (e *noEligibleWorkers) Error() string {
+	return "No healthy workers available"
+}
+
+// exclusionReasonLocked returns why w is not a candidate for a task with the
+// hints h, or "" if it is. Must be called with lb.mu held.
+func (lb *LoadBalancer) exclusionReasonLocked(w *Worker, h routeHints) string {
+	switch {
+	case !w.Enabled && w.schedule != nil && w.schedule.active[scheduleDisable]:
+		return excludedScheduled
+	case !w.Enabled:
+		return excludedDisabled
+	case w.Draining:
+		return excludedDraining
+	case !w.Healthy:
+		return excludedUnhealthy
+	case !lb.circuitAdmitsLocked(w):
+		return excludedCircuitOpen
+	case lb.quarantinedLocked(w):
+		return excludedMisconfig
+	case h.excludes(w.Name):
+		return excludedRetry
+	case len(h.selector) > 0 && !w.matchesLabels(h.selector):
+		return excludedLabels
+	case h.maxLatency > 0 && !w.latency.fits(h.maxLatency):
+		return excludedLatency
+	case w.saturated():
+		return excludedSaturated
+	}
+	return ""
+}
+
+// noEligibleLocked collects the exclusion reason of every worker. Must be
+// called with lb.mu held.
+func (lb *LoadBalancer) noEligibleLocked(h routeHints) *noEligibleWorkers {
+	e := &noEligibleWorkers{excluded: make(map[string]string, len(lb.workers))}
+	for _, w := range lb.workers {
+		e.excluded[w.Name] = lb.exclusionReasonLocked(w, h)
+	}
+	return e
+}
+
+// counts returns the reasons by number of workers, most common first (ties
+// alphabetically)
+func (e *noEligibleWorkers) counts() ([]string, map[string]int) {
+	counts := make(map[string]int)
+	for _, reason := range e.excluded {
+		counts[reason]++
+	}
+	reasons := make([]string, 0, len(counts))
+	for reason := range counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		if counts[reasons[i]] != counts[reasons[j]] {
+			return counts[reasons[i]] > counts[reasons[j]]
+		}
+		return reasons[i] < reasons[j]
+	})
+	return reasons, counts
+}
+
+// dominantReason returns the most common exclusion reason
+func (e *noEligibleWorkers) dominantReason() string {
+	reasons, _ := e.counts()
+	if len(reasons) == 0 {
+		return noWorkersReason
+	}
+	return reasons[0]
+}
+
+// summary describes the exclusions as e.g. "2 circuit_open, 1 unhealthy"
+func (e *noEligibleWorkers) summary() string {
+	reasons, counts := e.counts()
+	if len(reasons) == 0 {
+		return "no workers registered"
+	}
+	parts := make([]string, len(reasons))
+	for i, reason := range reasons {
+		parts[i] = fmt.Sprintf("%d %s", counts[reason], reason)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// recordSelectionFailure logs and counts a task that found no eligible
+// worker
+func (lb *LoadBalancer) recordSelectionFailure(e *noEligibleWorkers) {
+	lb.metrics.selectionFailed.WithLabelValues(e.dominantReason()).Inc()
+	log.Printf("No eligible worker for task: %s", e.summary())
+}
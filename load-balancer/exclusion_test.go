@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/network-sandbox/load-balancer/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSelectionFailureReportsExclusions(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	t.Cleanup(lb.stopControl)
+	for _, name := range []string{"disabled", "scheduled", "unhealthy", "circuit", "zone-b"} {
+		lb.AddWorker(name, "http://localhost:9000", "", 1)
+	}
+	lb.SetWorkerLabels("zone-b", map[string]string{"zone": "b"})
+	lb.mu.Lock()
+	lb.findWorkerLocked("disabled").Enabled = false
+	scheduled := lb.findWorkerLocked("scheduled")
+	scheduled.schedule = &workerSchedule{active: map[string]bool{}}
+	lb.applyActionLocked(scheduled, scheduleDisable, true)
+	lb.findWorkerLocked("unhealthy").Healthy = false
+	lb.openCircuitLocked(lb.findWorkerLocked("circuit"))
+	lb.mu.Unlock()
+
+	rec := doTask(map[string]string{selectorHeader: "zone=a"})
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status code = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	var resp api.ErrorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	want := map[string]string{
+		"disabled":  excludedDisabled,
+		"scheduled": excludedScheduled,
+		"unhealthy": excludedUnhealthy,
+		"circuit":   excludedCircuitOpen,
+		"zone-b":    excludedLabels,
+	}
+	if resp.Error != "No healthy workers available" || len(resp.Excluded) != len(want) {
+		t.Fatalf("response = %+v", resp)
+	}
+	for name, reason := range want {
+		if resp.Excluded[name] != reason {
+			t.Errorf("excluded[%s] = %q, want %q", name, resp.Excluded[name], reason)
+		}
+	}
+}
+
+func TestSelectionFailureDominantReason(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	for _, name := range []string{"worker-1", "worker-2", "worker-3"} {
+		lb.AddWorker(name, "http://localhost:9000", "", 1)
+	}
+	lb.mu.Lock()
+	lb.openCircuitLocked(lb.workers[0])
+	lb.openCircuitLocked(lb.workers[1])
+	lb.workers[2].Healthy = false
+	lb.mu.Unlock()
+
+	doTask(nil)
+	if got := testutil.ToFloat64(lb.metrics.selectionFailed.WithLabelValues(excludedCircuitOpen)); got != 1 {
+		t.Errorf("selection failures (circuit_open) = %v, want 1", got)
+	}
+
+	lb.mu.Lock()
+	e := lb.noEligibleLocked(routeHints{exclude: []string{"worker-3"}})
+	lb.workers[2].Healthy = true
+	retry := lb.noEligibleLocked(routeHints{exclude: []string{"worker-3"}})
+	lb.mu.Unlock()
+	if e.summary() != "2 circuit_open, 1 unhealthy" {
+		t.Errorf("summary = %q", e.summary())
+	}
+	if retry.excluded["worker-3"] != excludedRetry {
+		t.Errorf("excluded = %v, want worker-3 %s", retry.excluded, excludedRetry)
+	}
+
+	empty := NewLoadBalancer("round-robin")
+	empty.mu.Lock()
+	none := empty.noEligibleLocked(routeHints{})
+	empty.mu.Unlock()
+	if none.dominantReason() != noWorkersReason {
+		t.Errorf("empty pool reason = %q, want %q", none.dominantReason(), noWorkersReason)
+	}
+}
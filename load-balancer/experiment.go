@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// Experiments split live traffic between two algorithms for a fixed time.
+// Each task is assigned to arm A or B by a hash of its request ID, so a
+// request and its retries stay on one arm, and the outcomes of each arm are
+// counted separately. Only one experiment runs at a time.
+const (
+	defaultExperimentSplit    = 50
+	defaultExperimentDuration = 5 * time.Minute
+	maxExperimentDuration     = 24 * time.Hour
+	// experimentMinSamples is the number of requests each arm needs before
+	// the report hints at a difference
+	experimentMinSamples = 30
+	// experimentZ is the z-score of the 95% confidence intervals
+	experimentZ = 1.96
+)
+
+// States of an experiment
+const (
+	experimentRunning   = "running"
+	experimentCompleted = "completed"
+	experimentAborted   = "aborted"
+)
+
+// ExperimentRequest is the body of POST /experiments. SplitPercent is the
+// share of requests sent to arm A.
+type ExperimentRequest struct {
+	A               string `json:"a"`
+	B               string `json:"b"`
+	SplitPercent    int    `json:"splitPercent"`
+	DurationSeconds int    `json:"durationSeconds"`
+}
+
+// ExperimentArm is what one arm of an experiment observed
+type ExperimentArm struct {
+	Algorithm       string           `json:"algorithm"`
+	Requests        int64            `json:"requests"`
+	Errors          int64            `json:"errors"`
+	ErrorRate       float64          `json:"errorRate"`
+	MeanLatencyMs   float64          `json:"meanLatencyMs"`
+	StddevLatencyMs float64          `json:"stddevLatencyMs"`
+	P50LatencyMs    float64          `json:"p50LatencyMs"`
+	P95LatencyMs    float64          `json:"p95LatencyMs"`
+	P99LatencyMs    float64          `json:"p99LatencyMs"`
+	RequestCV       float64          `json:"requestCV"`
+	WorkerRequests  map[string]int64 `json:"workerRequests"`
+}
+
+// ExperimentDiff is the difference B - A of a figure with its 95%
+// confidence interval. Significant is set when both arms have enough
+// samples and the interval excludes zero.
+type ExperimentDiff struct {
+	Diff        float64 `json:"diff"`
+	Low         float64 `json:"low"`
+	High        float64 `json:"high"`
+	Significant bool    `json:"significant"`
+}
+
+// ExperimentComparison compares the arms. The intervals assume normally
+// distributed means, which is crude for latencies but enough to tell noise
+// from a real difference.
+type ExperimentComparison struct {
+	MeanLatencyMs ExperimentDiff `json:"meanLatencyMs"`
+	ErrorRate     ExperimentDiff `json:"errorRate"`
+	Hints         []string       `json:"hints"`
+}
+
+// Experiment is the report of the running or last experiment
+type Experiment struct {
+	ID              int64                `json:"id"`
+	State           string               `json:"state"`
+	SplitPercent    int                  `json:"splitPercent"`
+	DurationSeconds int                  `json:"durationSeconds"`
+	StartedAt       time.Time            `json:"startedAt"`
+	EndsAt          time.Time            `json:"endsAt"`
+	FinishedAt      *time.Time           `json:"finishedAt,omitempty"`
+	A               ExperimentArm        `json:"a"`
+	B               ExperimentArm        `json:"b"`
+	Comparison      ExperimentComparison `json:"comparison"`
+}
+
+// errExperimentInProgress is returned when an experiment is already running
+var errExperimentInProgress = errors.New("an experiment is already running")
+
+// experimentArm accumulates the outcomes of one arm
+type experimentArm struct {
+	algorithm string
+	snap      statsSnapshot
+	sumSqMs   float64
+	workers   map[string]int64
+}
+
+// experiment is the running experiment
+type experiment struct {
+	id        int64
+	split     int
+	duration  time.Duration
+	startedAt time.Time
+	arms      [2]*experimentArm
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+// experimentRunner runs at most one experiment at a time and keeps the
+// report of the last one
+type experimentRunner struct {
+	mu      sync.Mutex
+	seq     int64
+	current *experiment
+	last    *Experiment
+}
+
+func newExperimentRunner() *experimentRunner {
+	return &experimentRunner{}
+}
+
+// validateExperiment fills in the defaults of req and checks it
+func validateExperiment(req *ExperimentRequest) error {
+	if req.SplitPercent == 0 {
+		req.SplitPercent = defaultExperimentSplit
+	}
+	if req.DurationSeconds == 0 {
+		req.DurationSeconds = int(defaultExperimentDuration / time.Second)
+	}
+	if _, ok := validAlgorithms[req.A]; !ok {
+		return &MetadataError{"a", "Invalid algorithm"}
+	}
+	if _, ok := validAlgorithms[req.B]; !ok {
+		return &MetadataError{"b", "Invalid algorithm"}
+	}
+	switch {
+	case req.A == req.B:
+		return &MetadataError{"b", "must differ from a"}
+	case req.SplitPercent < 1 || req.SplitPercent > 99:
+		return &MetadataError{"splitPercent", "must be between 1 and 99"}
+	case req.DurationSeconds < 1 || time.Duration(req.DurationSeconds)*time.Second > maxExperimentDuration:
+		return &MetadataError{"durationSeconds", fmt.Sprintf("must be between 1 and %d", int(maxExperimentDuration/time.Second))}
+	}
+	return nil
+}
+
+// assign returns the arm of the running experiment requestID belongs to, or
+// nil if no experiment is running
+func (r *experimentRunner) assign(requestID string) *experimentArm {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e := r.current
+	if e == nil {
+		return nil
+	}
+	h := fnv.New32a()
+	h.Write([]byte(requestID))
+	if int(h.Sum32()%100) < e.split {
+		return e.arms[0]
+	}
+	return e.arms[1]
+}
+
+// observe records a task of arm served by worker. worker is empty when no
+// worker was reached.
+func (r *experimentRunner) observe(arm *experimentArm, worker string, latency time.Duration, failed bool) {
+	ms := float64(latency) / float64(time.Millisecond)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	arm.snap.Requests++
+	if failed {
+		arm.snap.Errors++
+	}
+	arm.snap.LatencySumMs += ms
+	arm.snap.Buckets[sort.SearchFloat64s(statsLatencyBuckets, ms)]++
+	arm.sumSqMs += ms * ms
+	if worker != "" {
+		arm.workers[worker]++
+	}
+}
+
+// reportLocked returns arm's figures. Must be called with r.mu held.
+func (arm *experimentArm) reportLocked() ExperimentArm {
+	a := ExperimentArm{
+		Algorithm:      arm.algorithm,
+		Requests:       arm.snap.Requests,
+		Errors:         arm.snap.Errors,
+		WorkerRequests: make(map[string]int64, len(arm.workers)),
+	}
+	for name, n := range arm.workers {
+		a.WorkerRequests[name] = n
+	}
+	a.RequestCV = coefficientOfVariation(a.WorkerRequests)
+	if n := float64(a.Requests); n > 0 {
+		a.ErrorRate = float64(a.Errors) / n
+		a.MeanLatencyMs = arm.snap.LatencySumMs / n
+		if n > 1 {
+			a.StddevLatencyMs = math.Sqrt(math.Max(0, (arm.sumSqMs-n*a.MeanLatencyMs*a.MeanLatencyMs)/(n-1)))
+		}
+		a.P50LatencyMs = arm.snap.quantile(0.5)
+		a.P95LatencyMs = arm.snap.quantile(0.95)
+		a.P99LatencyMs = arm.snap.quantile(0.99)
+	}
+	return a
+}
+
+// experimentDiff returns b - a with a 95% interval of half-width z*se
+func experimentDiff(a, b, se float64, enough bool) ExperimentDiff {
+	d := ExperimentDiff{Diff: b - a, Low: b - a - experimentZ*se, High: b - a + experimentZ*se}
+	d.Significant = enough && (d.Low > 0 || d.High < 0)
+	return d
+}
+
+// compareArms computes the differences between the arms and hints at what
+// they mean
+func compareArms(a, b ExperimentArm) ExperimentComparison {
+	enough := a.Requests >= experimentMinSamples && b.Requests >= experimentMinSamples
+	var latencySE, errorSE float64
+	if a.Requests > 0 && b.Requests > 0 {
+		na, nb := float64(a.Requests), float64(b.Requests)
+		latencySE = math.Sqrt(a.StddevLatencyMs*a.StddevLatencyMs/na + b.StddevLatencyMs*b.StddevLatencyMs/nb)
+		errorSE = math.Sqrt(a.ErrorRate*(1-a.ErrorRate)/na + b.ErrorRate*(1-b.ErrorRate)/nb)
+	}
+	c := ExperimentComparison{
+		MeanLatencyMs: experimentDiff(a.MeanLatencyMs, b.MeanLatencyMs, latencySE, enough),
+		ErrorRate:     experimentDiff(a.ErrorRate, b.ErrorRate, errorSE, enough),
+		Hints:         []string{},
+	}
+	if !enough {
+		c.Hints = append(c.Hints, fmt.Sprintf("Too few samples to compare (a: %d, b: %d, want at least %d each)", a.Requests, b.Requests, experimentMinSamples))
+		return c
+	}
+	if d := c.MeanLatencyMs; d.Significant {
+		c.Hints = append(c.Hints, fmt.Sprintf("%s has a %s mean latency than %s by %.1fms (95%% CI %.1f to %.1f)", b.Algorithm, lowerOrHigher(d.Diff), a.Algorithm, math.Abs(d.Diff), d.Low, d.High))
+	} else {
+		c.Hints = append(c.Hints, "No significant difference in mean latency")
+	}
+	if d := c.ErrorRate; d.Significant {
+		c.Hints = append(c.Hints, fmt.Sprintf("%s has a %s error rate than %s by %.2f%% (95%% CI %.2f%% to %.2f%%)", b.Algorithm, lowerOrHigher(d.Diff), a.Algorithm, math.Abs(d.Diff)*100, d.Low*100, d.High*100))
+	} else {
+		c.Hints = append(c.Hints, "No significant difference in error rate")
+	}
+	return c
+}
+
+func lowerOrHigher(diff float64) string {
+	if diff < 0 {
+		return "lower"
+	}
+	return "higher"
+}
+
+// reportLocked returns the report of e in state. Must be called with r.mu
+// held.
+func (e *experiment) reportLocked(state string) Experiment {
+	x := Experiment{
+		ID:              e.id,
+		State:           state,
+		SplitPercent:    e.split,
+		DurationSeconds: int(e.duration / time.Second),
+		StartedAt:       e.startedAt,
+		EndsAt:          e.startedAt.Add(e.duration),
+		A:               e.arms[0].reportLocked(),
+		B:               e.arms[1].reportLocked(),
+	}
+	x.Comparison = compareArms(x.A, x.B)
+	return x
+}
+
+// StartExperiment validates req and starts an experiment that ends after its
+// duration unless aborted first
+func (lb *LoadBalancer) StartExperiment(req ExperimentRequest) (Experiment, error) {
+	if err := validateExperiment(&req); err != nil {
+		return Experiment{}, err
+	}
+	lb.mu.RLock()
+	names := make([]string, 0, len(lb.workers))
+	for _, w := range lb.workers {
+		names = append(names, w.Name)
+	}
+	lb.mu.RUnlock()
+
+	r := lb.experiments
+	r.mu.Lock()
+	if r.current != nil {
+		r.mu.Unlock()
+		return Experiment{}, errExperimentInProgress
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.seq++
+	e := &experiment{
+		id:        r.seq,
+		split:     req.SplitPercent,
+		duration:  time.Duration(req.DurationSeconds) * time.Second,
+		startedAt: lb.clock.Now().UTC(),
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	for i, algo := range []string{req.A, req.B} {
+		// Every worker counts towards the distribution, served or not
+		arm := &experimentArm{algorithm: algo, workers: make(map[string]int64, len(names))}
+		arm.snap.Buckets = make([]int64, len(statsLatencyBuckets)+1)
+		for _, name := range names {
+			arm.workers[name] = 0
+		}
+		e.arms[i] = arm
+	}
+	r.current = e
+	report := e.reportLocked(experimentRunning)
+	timer := lb.clock.NewTimer(e.duration)
+	r.mu.Unlock()
+
+	lb.emitEvent("experiment", fmt.Sprintf("Experiment %d started: %s vs %s, %d%% to %s for %ds", e.id, req.A, req.B, req.SplitPercent, req.A, req.DurationSeconds), map[string]interface{}{
+		"id":              e.id,
+		"state":           experimentRunning,
+		"a":               req.A,
+		"b":               req.B,
+		"splitPercent":    req.SplitPercent,
+		"durationSeconds": req.DurationSeconds,
+	})
+	go func() {
+		state := experimentCompleted
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			state = experimentAborted
+		case <-timer.C():
+		}
+		lb.finishExperiment(e, state)
+	}()
+	lb.BroadcastStatus()
+	return report, nil
+}
+
+// finishExperiment ends e, keeping its final report
+func (lb *LoadBalancer) finishExperiment(e *experiment, state string) {
+	now := lb.clock.Now().UTC()
+	r := lb.experiments
+	r.mu.Lock()
+	report := e.reportLocked(state)
+	report.FinishedAt = &now
+	r.last = &report
+	r.current = nil
+	close(e.done)
+	r.mu.Unlock()
+
+	lb.emitEvent("experiment", fmt.Sprintf("Experiment %d %s", e.id, state), map[string]interface{}{
+		"id":         e.id,
+		"state":      state,
+		"a":          report.A.Algorithm,
+		"b":          report.B.Algorithm,
+		"requestsA":  report.A.Requests,
+		"requestsB":  report.B.Requests,
+		"comparison": report.Comparison,
+	})
+	lb.BroadcastStatus()
+}
+
+// AbortExperiment stops the running experiment and returns its final
+// report. It returns false if no experiment was running.
+func (lb *LoadBalancer) AbortExperiment() (Experiment, bool) {
+	r := lb.experiments
+	r.mu.Lock()
+	e := r.current
+	r.mu.Unlock()
+	if e == nil {
+		return Experiment{}, false
+	}
+	e.cancel()
+	<-e.done
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return *r.last, true
+}
+
+// CurrentExperiment returns the live report of the running experiment, or
+// the final report of the last one. It returns nil if none was started.
+func (lb *LoadBalancer) CurrentExperiment() *Experiment {
+	r := lb.experiments
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.current != nil {
+		report := r.current.reportLocked(experimentRunning)
+		return &report
+	}
+	return r.last
+}
+
+// experimentStatus returns the running experiment for the status, or nil
+func (lb *LoadBalancer) experimentStatus() *api.ExperimentStatus {
+	r := lb.experiments
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e := r.current
+	if e == nil {
+		return nil
+	}
+	return &api.ExperimentStatus{
+		ID:           e.id,
+		A:            e.arms[0].algorithm,
+		B:            e.arms[1].algorithm,
+		SplitPercent: e.split,
+		StartedAt:    e.startedAt,
+		EndsAt:       e.startedAt.Add(e.duration),
+	}
+}
+
+// lastAttemptWorker returns the worker of the last attempt in l, or "" if
+// none was made
+func lastAttemptWorker(l *attemptLog) string {
+	if len(l.attempts) == 0 {
+		return ""
+	}
+	return l.attempts[len(l.attempts)-1].Worker
+}
+
+// handleExperiments は 2 つのアルゴリズムをライブトラフィックで比較する実験を開始する HTTP ハンドラです。
+// POST で {"a", "b", "splitPercent", "durationSeconds"} を受け取り、リクエスト ID のハッシュで splitPercent% を a に、残りを b に振り分けて、
+// durationSeconds (既定 300) の間アームごとのレイテンシ・エラー率・分散の CV を記録します。開始すると 201 とレポートを返し、既に実行中なら 409 を返します。
+// 実行中の実験はステータスの experiment に表示され、開始と終了は experiment イベントとして記録されます。
+func handleExperiments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req ExperimentRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeMetadataError(w, &MetadataError{"body", err.Error()})
+		return
+	}
+	report, err := lb.StartExperiment(req)
+	var me *MetadataError
+	switch {
+	case errors.As(err, &me):
+		writeMetadataError(w, me)
+		return
+	case err != nil:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(api.ErrorResponse{Error: err.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleCurrentExperiment は実行中 (または直近) の実験のレポートを扱う HTTP ハンドラです。
+// GET はアームごとの集計と、サンプル数・平均レイテンシとエラー率の差 (95% 信頼区間) に基づく比較のヒントを返し、実験が一度も無ければ 404 を返します。
+// DELETE は実行中の実験を中止して最終レポートを返し、実行中でなければ 409 を返します。
+func handleCurrentExperiment(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		report := lb.CurrentExperiment()
+		w.Header().Set("Content-Type", "application/json")
+		if report == nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(api.ErrorResponse{Error: "No experiment has been run"})
+			return
+		}
+		json.NewEncoder(w).Encode(report)
+	case http.MethodDelete:
+		report, ok := lb.AbortExperiment()
+		w.Header().Set("Content-Type", "application/json")
+		if !ok {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(api.ErrorResponse{Error: "No experiment in progress"})
+			return
+		}
+		json.NewEncoder(w).Encode(report)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func postExperiment(body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handleExperiments(rec, httptest.NewRequest(http.MethodPost, "/experiments", bytes.NewBufferString(body)))
+	return rec
+}
+
+func experimentEvents() []Event {
+	var out []Event
+	for _, e := range lb.events.since(0, 0) {
+		if e.Type == "experiment" {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func TestExperiment(t *testing.T) {
+	clk := newFakeClock()
+	lb = NewLoadBalancer("round-robin")
+	lb.clock = clk
+	// least-connections always picks the slow worker when requests are
+	// sequential, round-robin alternates
+	lb.AddWorker("slow", newDelayStub(t, "slow", 10*time.Millisecond).URL, "#FF0000", 1)
+	lb.AddWorker("fast", newDelayStub(t, "fast", 0).URL, "#00FF00", 1)
+
+	rec := postExperiment(`{"a":"round-robin","b":"least-connections","splitPercent":50,"durationSeconds":60}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status code = %d, want %d: %s", rec.Code, http.StatusCreated, rec.Body)
+	}
+	if rec := postExperiment(`{"a":"random","b":"weighted"}`); rec.Code != http.StatusConflict {
+		t.Errorf("second experiment status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+	status := lb.experimentStatus()
+	if status == nil || status.A != "round-robin" || status.B != "least-connections" || !status.EndsAt.Equal(clk.Now().Add(time.Minute)) {
+		t.Fatalf("experiment status = %+v", status)
+	}
+
+	const requests = 100
+	for i := 0; i < requests; i++ {
+		if rec := doTask(map[string]string{requestIDHeader: fmt.Sprintf("exp-%d", i)}); rec.Code != http.StatusOK {
+			t.Fatalf("task %d status = %d", i, rec.Code)
+		}
+	}
+	// A request ID always lands on the same arm
+	arm := lb.experiments.assign("exp-7")
+	for i := 0; i < 5; i++ {
+		if lb.experiments.assign("exp-7") != arm {
+			t.Fatal("assignment is not stable for a request ID")
+		}
+	}
+
+	live := lb.CurrentExperiment()
+	if live.State != experimentRunning {
+		t.Errorf("state = %q, want running", live.State)
+	}
+	a, b := live.A, live.B
+	if a.Requests+b.Requests != requests || a.Requests < experimentMinSamples || b.Requests < experimentMinSamples {
+		t.Fatalf("arm requests = %d + %d, want %d with at least %d each", a.Requests, b.Requests, requests, experimentMinSamples)
+	}
+	if a.WorkerRequests["slow"]+a.WorkerRequests["fast"] != a.Requests || a.WorkerRequests["fast"] == 0 {
+		t.Errorf("arm a workers = %v", a.WorkerRequests)
+	}
+	if b.WorkerRequests["slow"] != b.Requests || b.WorkerRequests["fast"] != 0 || b.RequestCV != 1 {
+		t.Errorf("arm b workers = %v, cv = %v, want everything on slow", b.WorkerRequests, b.RequestCV)
+	}
+	if b.MeanLatencyMs < 10 || b.MeanLatencyMs <= a.MeanLatencyMs || b.ErrorRate != 0 {
+		t.Errorf("arm means: a = %.2fms, b = %.2fms, b error rate = %v", a.MeanLatencyMs, b.MeanLatencyMs, b.ErrorRate)
+	}
+	if d := live.Comparison.MeanLatencyMs; !d.Significant || d.Low <= 0 {
+		t.Errorf("latency difference = %+v, want b significantly slower", d)
+	}
+	if live.Comparison.ErrorRate.Significant {
+		t.Error("equal error rates should not differ significantly")
+	}
+
+	// The experiment ends after its duration
+	clk.Advance(time.Minute)
+	deadline := time.Now().Add(2 * time.Second)
+	for lb.experimentStatus() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("experiment did not end")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	final := lb.CurrentExperiment()
+	if final.State != experimentCompleted || final.FinishedAt == nil || final.A.Requests != a.Requests {
+		t.Errorf("final report = %+v", final)
+	}
+	if _, ok := lb.GetStatus()["experiment"]; ok {
+		t.Error("status still flags an experiment")
+	}
+	// Routing is no longer split
+	rec = doTask(map[string]string{requestIDHeader: "after"})
+	if rec.Code != http.StatusOK || lb.CurrentExperiment().A.Requests+lb.CurrentExperiment().B.Requests != requests {
+		t.Error("a task after the experiment was counted")
+	}
+
+	events := experimentEvents()
+	if len(events) != 2 || events[0].Data["state"] != experimentRunning || events[1].Data["state"] != experimentCompleted {
+		t.Fatalf("experiment events = %+v", events)
+	}
+}
+
+func TestExperimentAbort(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", newDelayStub(t, "worker-1", 0).URL, "#FF0000", 1)
+
+	rec := httptest.NewRecorder()
+	handleCurrentExperiment(rec, httptest.NewRequest(http.MethodGet, "/experiments/current", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("report before any experiment status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	if rec := postExperiment(`{"a":"random","b":"weighted","durationSeconds":3600}`); rec.Code != http.StatusCreated {
+		t.Fatalf("status code = %d: %s", rec.Code, rec.Body)
+	}
+	doTask(nil)
+
+	rec = httptest.NewRecorder()
+	handleCurrentExperiment(rec, httptest.NewRequest(http.MethodDelete, "/experiments/current", nil))
+	var report Experiment
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if rec.Code != http.StatusOK || report.State != experimentAborted || report.A.Requests+report.B.Requests != 1 {
+		t.Fatalf("abort = %d, %+v", rec.Code, report)
+	}
+	if got := report.Comparison.Hints; len(got) != 1 {
+		t.Errorf("hints = %v, want a single too-few-samples hint", got)
+	}
+	if lb.experimentStatus() != nil {
+		t.Error("aborted experiment still running")
+	}
+
+	rec = httptest.NewRecorder()
+	handleCurrentExperiment(rec, httptest.NewRequest(http.MethodDelete, "/experiments/current", nil))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("second abort status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+}
+
+func TestExperimentValidation(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	for body, field := range map[string]string{
+		`{"a":"round-robin","b":"round-robin"}`:                       "b",
+		`{"a":"nope","b":"random"}`:                                   "a",
+		`{"a":"random","b":"weighted","splitPercent":100}`:            "splitPercent",
+		`{"a":"random","b":"weighted","durationSeconds":-1}`:          "durationSeconds",
+		`{"a":"random","b":"weighted","durationSeconds":86401}`:       "durationSeconds",
+		`{"a":"random","b":"weighted","durationSeconds":60,"x":true}`: "body",
+	} {
+		rec := postExperiment(body)
+		var resp map[string]string
+		json.NewDecoder(rec.Body).Decode(&resp)
+		if rec.Code != http.StatusBadRequest || resp["field"] != field {
+			t.Errorf("%s: status = %d, field = %q, want 400 on %s", body, rec.Code, resp["field"], field)
+		}
+	}
+	if lb.experimentStatus() != nil {
+		t.Error("an invalid experiment was started")
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Selection fairness is evaluated over consecutive windows of
+// defaultFairnessInterval. Worker eligibility is sampled every
+// fairnessSampleInterval so workers that were ineligible for part of a window
+// (disabled, unhealthy, circuit open) can be excluded from the statistics.
+const (
+	defaultFairnessInterval = 10 * time.Second
+	fairnessSampleInterval  = time.Second
+)
+
+// WorkerShare is a worker's part of a fairness report
+type WorkerShare struct {
+	Worker   string  `json:"worker"`
+	Requests int64   `json:"requests"`
+	Share    float64 `json:"share"`
+	Coverage float64 `json:"coverage"`
+	Included bool    `json:"included"`
+}
+
+// FairnessReport describes how evenly requests were spread over one window.
+// Only workers eligible for the whole window are included in Share, CV and
+// MaxMinRatio. MaxMinRatio is nil when no included worker got requests and
+// +Inf (null in JSON) when one of them got none.
+type FairnessReport struct {
+	WindowStart time.Time     `json:"windowStart"`
+	WindowEnd   time.Time     `json:"windowEnd"`
+	Requests    int64         `json:"requests"`
+	CV          float64       `json:"cv"`
+	MaxMinRatio *float64      `json:"maxMinRatio"`
+	Workers     []WorkerShare `json:"workers"`
+}
+
+// computeFairness builds a report from per-worker request counts and
+// eligibility coverage (0..1) over a window
+func computeFairness(counts map[string]int64, coverage map[string]float64) FairnessReport {
+	var r FairnessReport
+	included := make(map[string]int64)
+	var total int64
+	for name, c := range counts {
+		if coverage[name] >= 1 {
+			included[name] = c
+			total += c
+		}
+	}
+
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ws := WorkerShare{Worker: name, Requests: counts[name], Coverage: coverage[name]}
+		if _, ok := included[name]; ok {
+			ws.Included = true
+			if total > 0 {
+				ws.Share = float64(counts[name]) / float64(total)
+			}
+		}
+		r.Requests += counts[name]
+		r.Workers = append(r.Workers, ws)
+	}
+
+	r.CV = coefficientOfVariation(included)
+	if len(included) > 0 && total > 0 {
+		min, max := int64(math.MaxInt64), int64(0)
+		for _, c := range included {
+			if c < min {
+				min = c
+			}
+			if c > max {
+				max = c
+			}
+		}
+		ratio := math.Inf(1)
+		if min > 0 {
+			ratio = float64(max) / float64(min)
+		}
+		r.MaxMinRatio = &ratio
+	}
+	return r
+}
+
+// fairnessTracker accumulates the current window
+type fairnessTracker struct {
+	mu       sync.Mutex
+	interval time.Duration
+	start    time.Time
+	counts   map[string]int64
+	samples  int
+	eligible map[string]int
+	last     *FairnessReport
+}
+
+func newFairnessTracker(interval time.Duration) *fairnessTracker {
+	if interval <= 0 {
+		interval = defaultFairnessInterval
+	}
+	return &fairnessTracker{interval: interval}
+}
+
+// fairnessIntervalFromEnv reads LB_FAIRNESS_INTERVAL (e.g. "30s")
+func fairnessIntervalFromEnv() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("LB_FAIRNESS_INTERVAL")); err == nil && d >= fairnessSampleInterval {
+		return d
+	}
+	return defaultFairnessInterval
+}
+
+// sampleFairness records worker eligibility and, once the window has lasted
+// the evaluation interval, closes it and publishes the report
+func (lb *LoadBalancer) sampleFairness() {
+	now := lb.clock.Now().UTC()
+	stats := lb.snapshotClientStats()
+	lb.mu.RLock()
+	eligible := make(map[string]bool, len(lb.workers))
+	for _, w := range lb.eligibleWorkersLocked() {
+		eligible[w.Name] = true
+	}
+	lb.mu.RUnlock()
+
+	f := lb.fairness
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.counts == nil {
+		f.resetLocked(now, stats)
+		return
+	}
+
+	f.samples++
+	for name := range stats {
+		if eligible[name] {
+			f.eligible[name]++
+		}
+	}
+	if now.Sub(f.start) < f.interval {
+		return
+	}
+
+	counts := make(map[string]int64, len(stats))
+	coverage := make(map[string]float64, len(stats))
+	for name, snap := range stats {
+		start, seen := f.counts[name]
+		if !seen {
+			// Added during the window: not comparable
+			coverage[name] = 0
+		} else {
+			coverage[name] = float64(f.eligible[name]) / float64(f.samples)
+		}
+		counts[name] = snap.Requests - start
+	}
+	report := computeFairness(counts, coverage)
+	report.WindowStart, report.WindowEnd = f.start, now
+	f.last = &report
+	f.resetLocked(now, stats)
+	lb.metrics.publishFairness(report)
+}
+
+func (f *fairnessTracker) resetLocked(now time.Time, stats map[string]statsSnapshot) {
+	f.start = now
+	f.samples = 0
+	f.counts = make(map[string]int64, len(stats))
+	f.eligible = make(map[string]int, len(stats))
+	for name, snap := range stats {
+		f.counts[name] = snap.Requests
+	}
+}
+
+func (m *lbMetrics) publishFairness(r FairnessReport) {
+	m.distributionCV.Set(r.CV)
+	if r.MaxMinRatio != nil {
+		m.distributionMaxMinRatio.Set(*r.MaxMinRatio)
+	} else {
+		m.distributionMaxMinRatio.Set(math.NaN())
+	}
+	m.distributionShare.Reset()
+	m.distributionCoverage.Reset()
+	for _, ws := range r.Workers {
+		m.distributionCoverage.WithLabelValues(ws.Worker).Set(ws.Coverage)
+		if ws.Included {
+			m.distributionShare.WithLabelValues(ws.Worker).Set(ws.Share)
+		}
+	}
+}
+
+// Fairness returns the report of the last completed window, or nil if no
+// window has completed yet
+func (lb *LoadBalancer) Fairness() *FairnessReport {
+	lb.fairness.mu.Lock()
+	defer lb.fairness.mu.Unlock()
+	return lb.fairness.last
+}
+
+// StartFairness samples eligibility every fairnessSampleInterval and
+// evaluates fairness at the end of each window
+func (lb *LoadBalancer) StartFairness(ctx context.Context) {
+	for {
+		timer := lb.clock.NewTimer(fairnessSampleInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+			lb.sampleFairness()
+		}
+	}
+}
+
+// MarshalJSON encodes an infinite MaxMinRatio as null since JSON has no
+// infinity
+func (r FairnessReport) MarshalJSON() ([]byte, error) {
+	type plain FairnessReport
+	p := plain(r)
+	if p.MaxMinRatio != nil && math.IsInf(*p.MaxMinRatio, 0) {
+		p.MaxMinRatio = nil
+	}
+	return json.Marshal(p)
+}
+
+// handleStats はリクエスト分散の公平性 (直近ウィンドウのワーカー別シェア・変動係数・最大/最小比) を返す HTTP ハンドラです。
+// 最初のウィンドウが終わるまで distribution は null です。
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"distribution": lb.Fairness(),
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestComputeFairness(t *testing.T) {
+	full := map[string]float64{"a": 1, "b": 1, "c": 1, "d": 1}
+
+	r := computeFairness(map[string]int64{"a": 25, "b": 25, "c": 25, "d": 25}, full)
+	if r.CV != 0 || r.MaxMinRatio == nil || *r.MaxMinRatio != 1 {
+		t.Errorf("even: cv = %v, ratio = %v", r.CV, r.MaxMinRatio)
+	}
+	for _, ws := range r.Workers {
+		if ws.Share != 0.25 {
+			t.Errorf("even: %s share = %v, want 0.25", ws.Worker, ws.Share)
+		}
+	}
+
+	// counts 10, 20, 30, 40: mean 25, population stddev sqrt(125)
+	r = computeFairness(map[string]int64{"a": 10, "b": 20, "c": 30, "d": 40}, full)
+	if want := math.Sqrt(125) / 25; math.Abs(r.CV-want) > 1e-9 {
+		t.Errorf("skewed: cv = %v, want %v", r.CV, want)
+	}
+	if *r.MaxMinRatio != 4 || r.Workers[3].Share != 0.4 || r.Requests != 100 {
+		t.Errorf("skewed: ratio = %v, d share = %v, requests = %d", *r.MaxMinRatio, r.Workers[3].Share, r.Requests)
+	}
+
+	// A worker drained for half the window is excluded rather than making
+	// the distribution look unfair
+	r = computeFairness(map[string]int64{"a": 30, "b": 30, "c": 30, "d": 2}, map[string]float64{"a": 1, "b": 1, "c": 1, "d": 0.5})
+	if r.CV != 0 || *r.MaxMinRatio != 1 {
+		t.Errorf("partial coverage: cv = %v, ratio = %v", r.CV, *r.MaxMinRatio)
+	}
+	if d := r.Workers[3]; d.Included || d.Share != 0 || d.Coverage != 0.5 {
+		t.Errorf("partial coverage: d = %+v", d)
+	}
+
+	r = computeFairness(map[string]int64{"a": 10, "b": 0}, map[string]float64{"a": 1, "b": 1})
+	if !math.IsInf(*r.MaxMinRatio, 1) {
+		t.Errorf("starved worker: ratio = %v, want +Inf", *r.MaxMinRatio)
+	}
+	if b, _ := json.Marshal(r); !json.Valid(b) {
+		t.Errorf("report with +Inf ratio does not encode: %s", b)
+	}
+}
+
+func TestFairnessWindow(t *testing.T) {
+	t.Setenv("LB_FAIRNESS_INTERVAL", "3s")
+	clk := newFakeClock()
+	lb = NewLoadBalancer("round-robin")
+	t.Cleanup(lb.stopControl)
+	lb.clock = clk
+	lb.AddWorker("worker-1", "http://localhost:8081", "#FF0000", 1)
+	lb.AddWorker("worker-2", "http://localhost:8082", "#00FF00", 1)
+	lb.AddWorker("worker-3", "http://localhost:8083", "#0000FF", 1)
+
+	lb.sampleFairness() // window start
+	for i := 1; i <= 3; i++ {
+		clk.Advance(time.Second)
+		for n := 0; n < 10*i; n++ {
+			lb.workers[0].stats.observe(time.Millisecond, false)
+		}
+		for n := 0; n < 10; n++ {
+			lb.workers[1].stats.observe(time.Millisecond, false)
+		}
+		if i == 2 {
+			f := false
+			lb.UpdateWorker("worker-3", &f, nil)
+		}
+		lb.sampleFairness()
+	}
+
+	rec := httptest.NewRecorder()
+	handleStats(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var body struct {
+		Distribution *FairnessReport `json:"distribution"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || body.Distribution == nil {
+		t.Fatalf("decode: %v, body = %+v", err, body)
+	}
+	r := body.Distribution
+	if r.Requests != 90 || r.Workers[0].Requests != 60 || r.Workers[1].Requests != 30 {
+		t.Errorf("requests = %d (%+v)", r.Requests, r.Workers)
+	}
+	if r.Workers[2].Included || math.Abs(r.Workers[2].Coverage-1.0/3) > 1e-9 {
+		t.Errorf("worker-3 = %+v, want excluded with coverage 1/3", r.Workers[2])
+	}
+	if *r.MaxMinRatio != 2 {
+		t.Errorf("ratio = %v, want 2", *r.MaxMinRatio)
+	}
+	if got := testutil.ToFloat64(lb.metrics.distributionShare.WithLabelValues("worker-1")); math.Abs(got-2.0/3) > 1e-9 {
+		t.Errorf("lb_distribution_share{worker-1} = %v, want 2/3", got)
+	}
+	if got := testutil.ToFloat64(lb.metrics.distributionMaxMinRatio); got != 2 {
+		t.Errorf("lb_distribution_max_min_ratio = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(lb.metrics.distributionCV); math.Abs(got-1.0/3) > 1e-9 {
+		t.Errorf("lb_distribution_cv = %v, want 1/3", got)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Worker metrics federation. GET /metrics/workers scrapes every worker's
+// /metrics, adds a worker label to each sample and serves the merged
+// exposition. Results are cached so frequent scrapes of the LB do not
+// multiply the load on the workers.
+const (
+	workerScrapeTimeout          = 2 * time.Second
+	defaultWorkerMetricsCacheTTL = 5 * time.Second
+	workerMetricsCacheEnvVar     = "LB_WORKER_METRICS_CACHE_MS"
+	workerLabel                  = "worker"
+	// exportedWorkerLabel keeps a worker label the worker set itself, as
+	// Prometheus does for conflicting target labels
+	exportedWorkerLabel = "exported_worker"
+)
+
+// workerMetricsCache holds the last merged exposition. mu is held while a
+// scrape is in progress so concurrent requests share it.
+type workerMetricsCache struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	body      []byte
+	scrapedAt time.Time
+}
+
+// workerScrape is the result of scraping one worker
+type workerScrape struct {
+	worker   string
+	families map[string]*dto.MetricFamily
+	err      error
+}
+
+// WorkerMetrics returns the merged worker exposition, scraping the workers
+// when the cached one is older than the cache TTL. The scrape is shared by
+// every caller waiting for it, so it does not use a caller's context.
+func (lb *LoadBalancer) WorkerMetrics() []byte {
+	c := &lb.workerMetrics
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := lb.clock.Now()
+	if c.body != nil && now.Sub(c.scrapedAt) < c.ttl {
+		return c.body
+	}
+	c.body = encodeWorkerFamilies(lb.scrapeWorkers(context.Background()))
+	c.scrapedAt = now
+	return c.body
+}
+
+// scrapeWorkers scrapes every worker's /metrics concurrently, each within
+// workerScrapeTimeout, and returns the results in pool order
+func (lb *LoadBalancer) scrapeWorkers(ctx context.Context) []workerScrape {
+	lb.mu.RLock()
+	results := make([]workerScrape, len(lb.workers))
+	for i, w := range lb.workers {
+		results[i].worker = w.Name
+	}
+	lb.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(r *workerScrape) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, workerScrapeTimeout)
+			defer cancel()
+			r.families, r.err = lb.scrapeWorker(ctx, r.worker)
+			if r.err != nil {
+				log.Printf("Failed to scrape metrics of %s: %v", r.worker, r.err)
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+// scrapeWorker fetches and parses one worker's metrics
+func (lb *LoadBalancer) scrapeWorker(ctx context.Context, name string) (map[string]*dto.MetricFamily, error) {
+	resp, err := lb.callWorker(ctx, name, http.MethodGet, "/metrics", nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.status != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.status)
+	}
+	var parser expfmt.TextParser
+	return parser.TextToMetricFamilies(bytes.NewReader(resp.body))
+}
+
+// ptr returns a pointer to v, for the optional fields of the metric protos
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// relabelWorker adds worker="name" to every sample of mf, renaming a worker
+// label already present to exported_worker
+func relabelWorker(mf *dto.MetricFamily, name string) {
+	for _, m := range mf.Metric {
+		for _, lp := range m.Label {
+			if lp.GetName() == workerLabel {
+				lp.Name = ptr(exportedWorkerLabel)
+			}
+		}
+		m.Label = append(m.Label, &dto.LabelPair{Name: ptr(workerLabel), Value: ptr(name)})
+		sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
+	}
+}
+
+// mergeWorkerFamilies relabels and merges the scraped families by name and
+// adds an up{worker} gauge reporting which scrapes succeeded. A family whose
+// type differs from the one already merged under its name is dropped.
+func mergeWorkerFamilies(results []workerScrape) []*dto.MetricFamily {
+	merged := make(map[string]*dto.MetricFamily)
+	up := &dto.MetricFamily{
+		Name: ptr("up"),
+		Help: ptr("Whether the LB could scrape the worker's metrics"),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	for _, r := range results {
+		value := 1.0
+		if r.err != nil {
+			value = 0
+		}
+		up.Metric = append(up.Metric, &dto.Metric{
+			Label: []*dto.LabelPair{{Name: ptr(workerLabel), Value: ptr(r.worker)}},
+			Gauge: &dto.Gauge{Value: ptr(value)},
+		})
+
+		names := make([]string, 0, len(r.families))
+		for name := range r.families {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			mf := r.families[name]
+			if name == "up" {
+				continue
+			}
+			relabelWorker(mf, r.worker)
+			existing, ok := merged[name]
+			if !ok {
+				merged[name] = mf
+				continue
+			}
+			if existing.GetType() != mf.GetType() {
+				log.Printf("Dropping %s from %s: type %s conflicts with %s", name, r.worker, mf.GetType(), existing.GetType())
+				continue
+			}
+			existing.Metric = append(existing.Metric, mf.Metric...)
+		}
+	}
+
+	out := make([]*dto.MetricFamily, 0, len(merged)+1)
+	for _, mf := range merged {
+		out = append(out, mf)
+	}
+	out = append(out, up)
+	sort.Slice(out, func(i, j int) bool { return out[i].GetName() < out[j].GetName() })
+	return out
+}
+
+// encodeWorkerFamilies renders the merged families in the text format
+func encodeWorkerFamilies(results []workerScrape) []byte {
+	var buf bytes.Buffer
+	enc := expfmt.NewEncoder(&buf, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, mf := range mergeWorkerFamilies(results) {
+		if err := enc.Encode(mf); err != nil {
+			log.Printf("Failed to encode %s: %v", mf.GetName(), err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// handleWorkerMetrics は全ワーカーの /metrics を並行して取得し、各サンプルに worker ラベルを付けて結合した Prometheus テキスト形式を返す HTTP ハンドラです。
+// 取得できなかったワーカーは up{worker} が 0 になるだけで、応答全体は失敗しません。結果は LB_WORKER_METRICS_CACHE_MS の間キャッシュされます。
+func handleWorkerMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", string(expfmt.NewFormat(expfmt.TypeTextPlain)))
+	w.Write(lb.WorkerMetrics())
+}
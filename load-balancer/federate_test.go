@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// newMetricsWorker serves a fixed exposition on /metrics and counts scrapes
+func newMetricsWorker(t *testing.T, exposition string) (*httptest.Server, *int32) {
+	t.Helper()
+	var scrapes int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&scrapes, 1)
+		io.WriteString(w, exposition)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &scrapes
+}
+
+func getWorkerMetrics(t *testing.T, srv *httptest.Server) map[string]*dto.MetricFamily {
+	t.Helper()
+	resp, err := http.Get(srv.URL + "/metrics/workers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	return families
+}
+
+// samples renders a family's samples as name{labels}=value, in order
+func samples(mf *dto.MetricFamily) string {
+	var out []string
+	for _, m := range mf.Metric {
+		var labels []string
+		for _, lp := range m.Label {
+			labels = append(labels, lp.GetName()+"="+lp.GetValue())
+		}
+		value := m.GetGauge().GetValue() + m.GetCounter().GetValue()
+		out = append(out, fmt.Sprintf("{%s}=%v", strings.Join(labels, ","), value))
+	}
+	return strings.Join(out, " ")
+}
+
+func TestWorkerMetricsFederation(t *testing.T) {
+	a, aScrapes := newMetricsWorker(t, "# TYPE worker_tasks_total counter\nworker_tasks_total{status=\"ok\"} 3\n# TYPE worker_only_a gauge\nworker_only_a 1\n")
+	b, _ := newMetricsWorker(t, "# TYPE worker_tasks_total counter\nworker_tasks_total{status=\"ok\",worker=\"self\"} 5\n")
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	lb = NewLoadBalancer("round-robin")
+	clk := newFakeClock()
+	lb.clock = clk
+	lb.AddWorker("worker-a", a.URL, "", 1)
+	lb.AddWorker("worker-b", b.URL, "", 1)
+	lb.AddWorker("worker-down", down.URL, "", 1)
+	srv := httptest.NewServer(newMux())
+	defer srv.Close()
+
+	families := getWorkerMetrics(t, srv)
+	if got := samples(families["worker_tasks_total"]); got != "{status=ok,worker=worker-a}=3 {exported_worker=self,status=ok,worker=worker-b}=5" {
+		t.Errorf("worker_tasks_total = %s", got)
+	}
+	if got := samples(families["worker_only_a"]); got != "{worker=worker-a}=1" {
+		t.Errorf("worker_only_a = %s", got)
+	}
+	if got := samples(families["up"]); got != "{worker=worker-a}=1 {worker=worker-b}=1 {worker=worker-down}=0" {
+		t.Errorf("up = %s", got)
+	}
+	if _, ok := families["lb_requests_total"]; ok {
+		t.Error("LB metrics should not be mixed into the worker exposition")
+	}
+
+	getWorkerMetrics(t, srv)
+	if n := atomic.LoadInt32(aScrapes); n != 1 {
+		t.Errorf("scrapes within the cache TTL = %d, want 1", n)
+	}
+	clk.Advance(defaultWorkerMetricsCacheTTL)
+	getWorkerMetrics(t, srv)
+	if n := atomic.LoadInt32(aScrapes); n != 2 {
+		t.Errorf("scrapes after the cache TTL = %d, want 2", n)
+	}
+}
+
+func TestMergeWorkerFamiliesTypeConflict(t *testing.T) {
+	var parser expfmt.TextParser
+	a, _ := parser.TextToMetricFamilies(strings.NewReader("# TYPE x counter\nx 1\n"))
+	b, _ := parser.TextToMetricFamilies(strings.NewReader("# TYPE x gauge\nx 2\n"))
+	merged := mergeWorkerFamilies([]workerScrape{
+		{worker: "a", families: a},
+		{worker: "b", families: b},
+		{worker: "c", err: fmt.Errorf("timeout after %s", time.Second)},
+	})
+	if len(merged) != 2 || merged[1].GetName() != "x" || samples(merged[1]) != "{worker=a}=1" {
+		t.Errorf("merged = %v", merged)
+	}
+}
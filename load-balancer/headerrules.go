@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxHeaderRules bounds the number of outbound header rules
+const maxHeaderRules = 32
+
+// HeaderRule adds a header to tasks forwarded to workers. The value is either
+// Value, a template in which {field} is replaced by a request or selection
+// field (static when it has none), or Hash, a bucket of a field's value.
+// When restricts the rule to workers whose labels match. Rules are applied in
+// order after the worker is selected, so a later rule setting the same
+// header overrides an earlier one.
+type HeaderRule struct {
+	Header string            `json:"header"`
+	Value  string            `json:"value,omitempty"`
+	Hash   *HeaderHash       `json:"hash,omitempty"`
+	When   map[string]string `json:"when,omitempty"`
+}
+
+// HeaderHash sets the header to FNV-1a(value of Field) % Mod
+type HeaderHash struct {
+	Field string `json:"field"`
+	Mod   uint32 `json:"mod"`
+}
+
+// HeaderRulesRequest is the body of PUT /header-rules and of its GET
+type HeaderRulesRequest struct {
+	Rules []HeaderRule `json:"rules"`
+}
+
+// Fields a header rule can refer to. Prefixed fields take the name after
+// the prefix, e.g. task.tag.region or worker.label.zone.
+var headerRuleFields = map[string]bool{
+	"task.id":     true,
+	"task.weight": true,
+	"request.id":  true,
+	"worker.name": true,
+	"algorithm":   true,
+	"attempt":     true,
+}
+
+var headerRuleFieldPrefixes = []string{"task.tag.", "worker.label."}
+
+// reservedHeaders are set by the LB itself and cannot be overridden by rules
+var reservedHeaders = map[string]bool{
+	"Content-Type":                          true,
+	"Content-Length":                        true,
+	"Host":                                  true,
+	http.CanonicalHeaderKey(deadlineHeader): true,
+}
+
+// headerEnv holds the fields available to header rules for one attempt
+type headerEnv struct {
+	task      TaskRequest
+	requestID string
+	worker    *Worker
+	algorithm string
+	attempt   int
+}
+
+// field returns the value of a field validated by validHeaderField. Must be
+// called with lb.mu held for worker labels.
+func (e headerEnv) field(name string) string {
+	switch name {
+	case "task.id":
+		return e.task.ID
+	case "task.weight":
+		return strconv.FormatFloat(e.task.Weight, 'g', -1, 64)
+	case "request.id":
+		return e.requestID
+	case "worker.name":
+		return e.worker.Name
+	case "algorithm":
+		return e.algorithm
+	case "attempt":
+		return strconv.Itoa(e.attempt)
+	}
+	if k, ok := strings.CutPrefix(name, "task.tag."); ok {
+		return e.task.Tags[k]
+	}
+	if k, ok := strings.CutPrefix(name, "worker.label."); ok {
+		return e.worker.Labels[k]
+	}
+	return ""
+}
+
+func validHeaderField(name string) bool {
+	if headerRuleFields[name] {
+		return true
+	}
+	for _, p := range headerRuleFieldPrefixes {
+		if k, ok := strings.CutPrefix(name, p); ok && k != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// templatePart is a literal or, when field is set, a field reference
+type templatePart struct {
+	literal string
+	field   string
+}
+
+// compiledHeaderRule is a HeaderRule parsed once when the rules are set
+type compiledHeaderRule struct {
+	rule   HeaderRule
+	header string
+	parts  []templatePart
+}
+
+// compileTemplate splits a {field} template into parts
+func compileTemplate(tmpl string) ([]templatePart, error) {
+	var parts []templatePart
+	for tmpl != "" {
+		open := strings.IndexByte(tmpl, '{')
+		if open < 0 {
+			parts = append(parts, templatePart{literal: tmpl})
+			break
+		}
+		if open > 0 {
+			parts = append(parts, templatePart{literal: tmpl[:open]})
+		}
+		end := strings.IndexByte(tmpl[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed { at %d", open)
+		}
+		name := tmpl[open+1 : open+end]
+		if !validHeaderField(name) {
+			return nil, fmt.Errorf("unknown field %q", name)
+		}
+		parts = append(parts, templatePart{field: name})
+		tmpl = tmpl[open+end+1:]
+	}
+	return parts, nil
+}
+
+// compileHeaderRules validates rules and compiles their templates
+func compileHeaderRules(rules []HeaderRule) ([]compiledHeaderRule, error) {
+	if len(rules) > maxHeaderRules {
+		return nil, &MetadataError{"rules", fmt.Sprintf("at most %d rules", maxHeaderRules)}
+	}
+	out := make([]compiledHeaderRule, 0, len(rules))
+	for i, r := range rules {
+		field := func(name string) string { return fmt.Sprintf("rules[%d].%s", i, name) }
+		header := http.CanonicalHeaderKey(strings.TrimSpace(r.Header))
+		switch {
+		case !validHeaderName(header):
+			return nil, &MetadataError{field("header"), "must be a valid HTTP header name"}
+		case reservedHeaders[header]:
+			return nil, &MetadataError{field("header"), header + " is set by the LB"}
+		case (r.Value == "") == (r.Hash == nil):
+			return nil, &MetadataError{field("value"), "exactly one of value and hash is required"}
+		}
+		c := compiledHeaderRule{rule: r, header: header}
+		if r.Hash != nil {
+			if !validHeaderField(r.Hash.Field) {
+				return nil, &MetadataError{field("hash.field"), fmt.Sprintf("unknown field %q", r.Hash.Field)}
+			}
+			if r.Hash.Mod == 0 {
+				return nil, &MetadataError{field("hash.mod"), "must be positive"}
+			}
+		} else {
+			parts, err := compileTemplate(r.Value)
+			if err != nil {
+				return nil, &MetadataError{field("value"), err.Error()}
+			}
+			c.parts = parts
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// validHeaderName reports whether name is a non-empty HTTP token
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c > 0x7f || !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// evaluate returns the header value of the rule for env, and false if the
+// rule does not apply to the worker. Must be called with lb.mu held.
+func (c compiledHeaderRule) evaluate(env headerEnv) (string, bool) {
+	if len(c.rule.When) > 0 && !env.worker.matchesLabels(c.rule.When) {
+		return "", false
+	}
+	if c.rule.Hash != nil {
+		h := fnv.New32a()
+		h.Write([]byte(env.field(c.rule.Hash.Field)))
+		return strconv.FormatUint(uint64(h.Sum32()%c.rule.Hash.Mod), 10), true
+	}
+	var b strings.Builder
+	for _, p := range c.parts {
+		if p.field != "" {
+			b.WriteString(env.field(p.field))
+		} else {
+			b.WriteString(p.literal)
+		}
+	}
+	// Field values come from the request and must not break the header
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 && r != '\t' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, b.String()), true
+}
+
+// headerRulesForLocked evaluates the header rules for one attempt and
+// returns the headers to add. Must be called with lb.mu held.
+func (lb *LoadBalancer) headerRulesForLocked(ctx context.Context, task TaskRequest, w *Worker) map[string]string {
+	if len(lb.headerRules) == 0 {
+		return nil
+	}
+	env := headerEnv{task: task, worker: w, algorithm: lb.algorithm, attempt: 1}
+	if l, ok := ctx.Value(attemptLogKey{}).(*attemptLog); ok {
+		env.requestID = l.requestID
+		env.attempt = len(l.attempts) + 1
+	}
+	headers := make(map[string]string)
+	for _, c := range lb.headerRules {
+		if v, ok := c.evaluate(env); ok {
+			headers[c.header] = v
+		}
+	}
+	return headers
+}
+
+// HeaderRules returns the current outbound header rules
+func (lb *LoadBalancer) HeaderRules() []HeaderRule {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	rules := make([]HeaderRule, 0, len(lb.headerRules))
+	for _, c := range lb.headerRules {
+		rules = append(rules, c.rule)
+	}
+	return rules
+}
+
+// SetHeaderRules validates and replaces the outbound header rules
+func (lb *LoadBalancer) SetHeaderRules(rules []HeaderRule) error {
+	compiled, err := compileHeaderRules(rules)
+	if err != nil {
+		return err
+	}
+	lb.mu.Lock()
+	lb.headerRules = compiled
+	lb.mu.Unlock()
+	headers := make([]string, len(compiled))
+	for i, c := range compiled {
+		headers[i] = c.header
+	}
+	lb.emitEvent("header_rules", fmt.Sprintf("%d header rules set", len(compiled)), map[string]interface{}{"headers": headers})
+	return nil
+}
+
+// handleHeaderRules は転送するタスクにヘッダーを追加するルールの一覧を GET で返し、PUT で {"rules": [...]} に置き換える HTTP ハンドラです。
+// ルールは {"header", "value" または "hash": {"field", "mod"}, "when": {ラベル}} で、value の {task.id}・{task.weight}・{task.tag.<key>}・{request.id}・{worker.name}・{worker.label.<key>}・{algorithm}・{attempt} は値に置き換えられます。
+// ワーカー選択後に順に適用され、同じヘッダーは後のルールが上書きします。追加したヘッダーはジャーナルの各 attempt の headers に記録されます。
+// 書き込み時に全て検証し、不正なルールがあれば何も変更せずに 400 と rules[i].<field> を返します。
+func handleHeaderRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req HeaderRulesRequest
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			writeMetadataError(w, &MetadataError{"body", err.Error()})
+			return
+		}
+		if err := lb.SetHeaderRules(req.Rules); err != nil {
+			writeMetadataError(w, err.(*MetadataError))
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(HeaderRulesRequest{Rules: lb.HeaderRules()})
+}
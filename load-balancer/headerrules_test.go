@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// newHeaderWorker records the headers of the last task it received
+func newHeaderWorker(t *testing.T, name string) (*httptest.Server, func() http.Header) {
+	t.Helper()
+	var mu sync.Mutex
+	var last http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		last = r.Header.Clone()
+		mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"worker": name})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() http.Header {
+		mu.Lock()
+		defer mu.Unlock()
+		return last
+	}
+}
+
+func putHeaderRules(t *testing.T, body string) (int, api.ErrorResponse) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/api/header-rules", bytes.NewBufferString(body)))
+	var resp api.ErrorResponse
+	if rec.Code != http.StatusOK {
+		json.NewDecoder(rec.Body).Decode(&resp)
+	}
+	return rec.Code, resp
+}
+
+func TestHeaderRulesReachWorkers(t *testing.T) {
+	shard, shardHeaders := newHeaderWorker(t, "shard")
+	canary, canaryHeaders := newHeaderWorker(t, "canary")
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("shard", shard.URL, "#FF0000", 1)
+	lb.AddWorker("canary", canary.URL, "#00FF00", 1)
+	lb.SetWorkerLabels("shard", map[string]string{"sharded": "true"})
+	lb.SetWorkerLabels("canary", map[string]string{"canary": "true"})
+
+	code, resp := putHeaderRules(t, `{"rules": [
+		{"header": "X-Env", "value": "sandbox"},
+		{"header": "x-route", "value": "{worker.name}/{task.tag.region}#{attempt}"},
+		{"header": "X-Shard", "hash": {"field": "task.id", "mod": 4}, "when": {"sharded": "true"}},
+		{"header": "X-Env", "value": "canary-{algorithm}", "when": {"canary": "true"}},
+		{"header": "X-Canary", "value": "true", "when": {"canary": "true"}}
+	]}`)
+	if code != http.StatusOK {
+		t.Fatalf("PUT: %d %+v", code, resp)
+	}
+
+	task := TaskRequest{ID: "task-7", Weight: 1, Tags: map[string]string{"region": "eu"}}
+	body, _ := json.Marshal(task)
+	for _, worker := range []string{"shard", "canary"} {
+		req := httptest.NewRequest(http.MethodPost, "/task", bytes.NewReader(body))
+		req.Header.Set(requireWorkerHeader, worker)
+		rec := httptest.NewRecorder()
+		handleTask(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("task to %s: %d", worker, rec.Code)
+		}
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte("task-7"))
+	wantShard := strconv.Itoa(int(h.Sum32() % 4))
+	got := shardHeaders()
+	if got.Get("X-Env") != "sandbox" || got.Get("X-Route") != "shard/eu#1" || got.Get("X-Shard") != wantShard || got.Get("X-Canary") != "" {
+		t.Errorf("shard worker got X-Env %q, X-Route %q, X-Shard %q, X-Canary %q", got.Get("X-Env"), got.Get("X-Route"), got.Get("X-Shard"), got.Get("X-Canary"))
+	}
+	// The later X-Env rule overrides the first for the canary
+	got = canaryHeaders()
+	if got.Get("X-Env") != "canary-round-robin" || got.Get("X-Canary") != "true" || got.Get("X-Shard") != "" || got.Get("Content-Type") != "application/json" {
+		t.Errorf("canary worker got X-Env %q, X-Canary %q, X-Shard %q", got.Get("X-Env"), got.Get("X-Canary"), got.Get("X-Shard"))
+	}
+
+	// The injected headers are recorded with the attempt
+	log := &attemptLog{requestID: "req-9"}
+	lb.SetHeaderRules([]HeaderRule{{Header: "X-Request", Value: "{request.id}"}})
+	lb.forwardTo(withAttemptLog(context.Background(), log), lb.workers[0], task, time.Now())
+	if len(log.attempts) != 1 || log.attempts[0].Headers["X-Request"] != "req-9" {
+		t.Errorf("attempts = %+v, want X-Request: req-9 recorded", log.attempts)
+	}
+}
+
+func TestHeaderRulesValidation(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.SetHeaderRules([]HeaderRule{{Header: "X-Env", Value: "sandbox"}})
+
+	tests := []struct {
+		body, field string
+	}{
+		{`{"rules": [{"header": "Content-Type", "value": "text/plain"}]}`, "rules[0].header"},
+		{`{"rules": [{"header": "X-LB-Deadline-Ms", "value": "1"}]}`, "rules[0].header"},
+		{`{"rules": [{"header": "Bad Header", "value": "x"}]}`, "rules[0].header"},
+		{`{"rules": [{"header": "X-A", "value": "a"}, {"header": "X-B"}]}`, "rules[1].value"},
+		{`{"rules": [{"header": "X-A", "value": "a", "hash": {"field": "task.id", "mod": 2}}]}`, "rules[0].value"},
+		{`{"rules": [{"header": "X-A", "value": "{task.nope}"}]}`, "rules[0].value"},
+		{`{"rules": [{"header": "X-A", "value": "{task.id"}]}`, "rules[0].value"},
+		{`{"rules": [{"header": "X-A", "hash": {"field": "worker.label.", "mod": 2}}]}`, "rules[0].hash.field"},
+		{`{"rules": [{"header": "X-A", "hash": {"field": "task.id", "mod": 0}}]}`, "rules[0].hash.mod"},
+	}
+	for _, tt := range tests {
+		code, resp := putHeaderRules(t, tt.body)
+		if code != http.StatusBadRequest || resp.Field != tt.field {
+			t.Errorf("%s: %d %q, want 400 %q", tt.body, code, resp.Field, tt.field)
+		}
+	}
+	if rules := lb.HeaderRules(); len(rules) != 1 || rules[0].Header != "X-Env" {
+		t.Errorf("rules after rejected writes = %+v, want the original", rules)
+	}
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// HealthExpr holds a worker's health evaluator expressions
+type HealthExpr = api.HealthExpr
+
+// maxHealthExprLen bounds the source length of a health expression
+const maxHealthExprLen = 256
+
+// maxHealthBody bounds how much of a /health response is read
+const maxHealthBody = 64 << 10
+
+// Health states reported in worker status
+const (
+	healthStateHealthy   = "healthy"
+	healthStateDegraded  = "degraded"
+	healthStateUnhealthy = "unhealthy"
+)
+
+// exprType is the static type of a health expression
+type exprType int
+
+const (
+	typeNum exprType = iota
+	typeStr
+	typeBool
+)
+
+func (t exprType) String() string {
+	switch t {
+	case typeNum:
+		return "number"
+	case typeStr:
+		return "string"
+	}
+	return "bool"
+}
+
+// healthFields are the names a health expression may refer to. status,
+// currentLoad and queueDepth come from the worker's /health body; the others
+// are filled in by the LB.
+var healthFields = map[string]exprType{
+	"status":         typeStr,
+	"currentLoad":    typeNum,
+	"queueDepth":     typeNum,
+	"httpStatus":     typeNum,
+	"latencyMs":      typeNum,
+	"probeLatencyMs": typeNum,
+	"maxLoad":        typeNum,
+}
+
+// healthEnv is the set of field values a health expression is evaluated
+// against. Values are float64 or string; absent fields are missing.
+type healthEnv map[string]interface{}
+
+// exprError is an evaluation failure, e.g. a field missing from the body
+type exprError struct{ msg string }
+
+func (e *exprError) Error() string { return e.msg }
+
+// exprNode is a node of a compiled health expression
+type exprNode interface {
+	eval(env healthEnv) (interface{}, error)
+}
+
+type literal struct{ v interface{} }
+
+func (n literal) eval(healthEnv) (interface{}, error) { return n.v, nil }
+
+type fieldRef struct {
+	name string
+	typ  exprType
+}
+
+func (n fieldRef) eval(env healthEnv) (interface{}, error) {
+	v, ok := env[n.name]
+	if !ok {
+		return nil, &exprError{fmt.Sprintf("field %s is missing", n.name)}
+	}
+	switch v.(type) {
+	case float64:
+		if n.typ == typeNum {
+			return v, nil
+		}
+	case string:
+		if n.typ == typeStr {
+			return v, nil
+		}
+	}
+	return nil, &exprError{fmt.Sprintf("field %s is not a %s", n.name, n.typ)}
+}
+
+type unaryExpr struct {
+	op string
+	x  exprNode
+}
+
+func (n unaryExpr) eval(env healthEnv) (interface{}, error) {
+	v, err := n.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "!" {
+		return !v.(bool), nil
+	}
+	return -v.(float64), nil
+}
+
+type binaryExpr struct {
+	op   string
+	l, r exprNode
+}
+
+func (n binaryExpr) eval(env healthEnv) (interface{}, error) {
+	l, err := n.l.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	// && and || short-circuit, so "queueDepth > 0 || status == ..." does
+	// not fail on a missing status
+	switch n.op {
+	case "&&":
+		if !l.(bool) {
+			return false, nil
+		}
+		return n.r.eval(env)
+	case "||":
+		if l.(bool) {
+			return true, nil
+		}
+		return n.r.eval(env)
+	}
+	r, err := n.r.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return l == r, nil
+	case "!=":
+		return l != r, nil
+	}
+	a, b := l.(float64), r.(float64)
+	switch n.op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		if b == 0 {
+			return nil, &exprError{"division by zero"}
+		}
+		return a / b, nil
+	case "<":
+		return a < b, nil
+	case "<=":
+		return a <= b, nil
+	case ">":
+		return a > b, nil
+	}
+	return a >= b, nil
+}
+
+// exprToken is a lexical token of a health expression
+type exprToken struct {
+	kind byte // 'n' number, 's' string, 'i' identifier, 'o' operator, 0 end
+	text string
+	pos  int
+}
+
+var exprOperators = []string{"||", "&&", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "*", "/", "(", ")"}
+
+func tokenizeExpr(src string) ([]exprToken, error) {
+	var toks []exprToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c >= '0' && c <= '9' || c == '.':
+			j := i
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.') {
+				j++
+			}
+			toks = append(toks, exprToken{'n', src[i:j], i})
+			i = j
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i
+			for j < len(src) && (src[j] == '_' || src[j] >= 'a' && src[j] <= 'z' || src[j] >= 'A' && src[j] <= 'Z' || src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+			toks = append(toks, exprToken{'i', src[i:j], i})
+			i = j
+		case c == '"' || c == '\'':
+			j := strings.IndexByte(src[i+1:], c)
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			toks = append(toks, exprToken{'s', src[i+1 : i+1+j], i})
+			i += j + 2
+		default:
+			op := ""
+			for _, o := range exprOperators {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+			toks = append(toks, exprToken{'o', op, i})
+			i += len(op)
+		}
+	}
+	return append(toks, exprToken{pos: len(src)}), nil
+}
+
+// exprParser is a recursive descent parser that type-checks as it goes.
+// The grammar has no loops, assignments or calls, so every expression
+// evaluates in time linear in its length.
+//
+//	or   = and { "||" and }
+//	and  = not { "&&" not }
+//	not  = "!" not | cmp
+//	cmp  = sum [ ("<" | "<=" | ">" | ">=" | "==" | "!=") sum ]
+//	sum  = prod { ("+" | "-") prod }
+//	prod = unary { ("*" | "/") unary }
+//	unary = "-" unary | number | string | true | false | field | "(" or ")"
+type exprParser struct {
+	toks []exprToken
+	pos  int
+}
+
+func (p *exprParser) peek() exprToken { return p.toks[p.pos] }
+
+func (p *exprParser) accept(ops ...string) (exprToken, bool) {
+	t := p.peek()
+	if t.kind != 'o' {
+		return t, false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			p.pos++
+			return t, true
+		}
+	}
+	return t, false
+}
+
+func expectType(t exprToken, got, want exprType) error {
+	if got != want {
+		return fmt.Errorf("%q at %d needs a %s operand, got %s", t.text, t.pos, want, got)
+	}
+	return nil
+}
+
+func (p *exprParser) parseLogical(op string, next func() (exprNode, exprType, error)) (exprNode, exprType, error) {
+	l, lt, err := next()
+	if err != nil {
+		return nil, 0, err
+	}
+	for {
+		t, ok := p.accept(op)
+		if !ok {
+			return l, lt, nil
+		}
+		r, rt, err := next()
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := expectType(t, lt, typeBool); err != nil {
+			return nil, 0, err
+		}
+		if err := expectType(t, rt, typeBool); err != nil {
+			return nil, 0, err
+		}
+		l = binaryExpr{op, l, r}
+	}
+}
+
+func (p *exprParser) parseOr() (exprNode, exprType, error) {
+	return p.parseLogical("||", p.parseAnd)
+}
+
+func (p *exprParser) parseAnd() (exprNode, exprType, error) {
+	return p.parseLogical("&&", p.parseNot)
+}
+
+func (p *exprParser) parseNot() (exprNode, exprType, error) {
+	if t, ok := p.accept("!"); ok {
+		x, xt, err := p.parseNot()
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := expectType(t, xt, typeBool); err != nil {
+			return nil, 0, err
+		}
+		return unaryExpr{"!", x}, typeBool, nil
+	}
+	return p.parseCmp()
+}
+
+func (p *exprParser) parseCmp() (exprNode, exprType, error) {
+	l, lt, err := p.parseArith(p.parseProd, "+", "-")
+	if err != nil {
+		return nil, 0, err
+	}
+	t, ok := p.accept("<", "<=", ">", ">=", "==", "!=")
+	if !ok {
+		return l, lt, nil
+	}
+	r, rt, err := p.parseArith(p.parseProd, "+", "-")
+	if err != nil {
+		return nil, 0, err
+	}
+	if t.text == "==" || t.text == "!=" {
+		if lt != rt {
+			return nil, 0, fmt.Errorf("%q at %d compares a %s with a %s", t.text, t.pos, lt, rt)
+		}
+	} else {
+		if err := expectType(t, lt, typeNum); err != nil {
+			return nil, 0, err
+		}
+		if err := expectType(t, rt, typeNum); err != nil {
+			return nil, 0, err
+		}
+	}
+	return binaryExpr{t.text, l, r}, typeBool, nil
+}
+
+func (p *exprParser) parseArith(next func() (exprNode, exprType, error), ops ...string) (exprNode, exprType, error) {
+	l, lt, err := next()
+	if err != nil {
+		return nil, 0, err
+	}
+	for {
+		t, ok := p.accept(ops...)
+		if !ok {
+			return l, lt, nil
+		}
+		r, rt, err := next()
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := expectType(t, lt, typeNum); err != nil {
+			return nil, 0, err
+		}
+		if err := expectType(t, rt, typeNum); err != nil {
+			return nil, 0, err
+		}
+		l = binaryExpr{t.text, l, r}
+	}
+}
+
+func (p *exprParser) parseProd() (exprNode, exprType, error) {
+	return p.parseArith(p.parseUnary, "*", "/")
+}
+
+func (p *exprParser) parseUnary() (exprNode, exprType, error) {
+	if t, ok := p.accept("-"); ok {
+		x, xt, err := p.parseUnary()
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := expectType(t, xt, typeNum); err != nil {
+			return nil, 0, err
+		}
+		return unaryExpr{"-", x}, typeNum, nil
+	}
+	if _, ok := p.accept("("); ok {
+		x, xt, err := p.parseOr()
+		if err != nil {
+			return nil, 0, err
+		}
+		if t, ok := p.accept(")"); !ok {
+			return nil, 0, fmt.Errorf("expected \")\" at %d", t.pos)
+		}
+		return x, xt, nil
+	}
+
+	t := p.peek()
+	switch t.kind {
+	case 'n':
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid number %q at %d", t.text, t.pos)
+		}
+		p.pos++
+		return literal{v}, typeNum, nil
+	case 's':
+		p.pos++
+		return literal{t.text}, typeStr, nil
+	case 'i':
+		p.pos++
+		switch t.text {
+		case "true", "false":
+			return literal{t.text == "true"}, typeBool, nil
+		}
+		typ, ok := healthFields[t.text]
+		if !ok {
+			return nil, 0, fmt.Errorf("unknown field %q at %d", t.text, t.pos)
+		}
+		return fieldRef{t.text, typ}, typ, nil
+	case 0:
+		return nil, 0, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, 0, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+}
+
+// compileHealthExpr parses and type-checks src, which must be a condition
+func compileHealthExpr(src string) (exprNode, error) {
+	if len(src) > maxHealthExprLen {
+		return nil, fmt.Errorf("must be at most %d characters", maxHealthExprLen)
+	}
+	toks, err := tokenizeExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{toks: toks}
+	n, typ, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != 0 {
+		return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+	}
+	if typ != typeBool {
+		return nil, fmt.Errorf("must be a condition, got a %s", typ)
+	}
+	return n, nil
+}
+
+// healthRule is a worker's compiled health expressions. A nil node is not
+// evaluated.
+type healthRule struct {
+	expr      HealthExpr
+	unhealthy exprNode
+	degraded  exprNode
+}
+
+// compileHealthRule compiles both expressions of e. It returns nil when both
+// are empty, which restores the plain status code check.
+func compileHealthRule(e HealthExpr) (*healthRule, error) {
+	if e.Unhealthy == "" && e.Degraded == "" {
+		return nil, nil
+	}
+	rule := &healthRule{expr: e}
+	var err error
+	if e.Unhealthy != "" {
+		if rule.unhealthy, err = compileHealthExpr(e.Unhealthy); err != nil {
+			return nil, &MetadataError{"healthExpr.unhealthy", err.Error()}
+		}
+	}
+	if e.Degraded != "" {
+		if rule.degraded, err = compileHealthExpr(e.Degraded); err != nil {
+			return nil, &MetadataError{"healthExpr.degraded", err.Error()}
+		}
+	}
+	return rule, nil
+}
+
+// applyHealthRuleLocked replaces w's health expressions if the update sets
+// them. The update must already be validated. Must be called with lb.mu
+// held.
+func applyHealthRuleLocked(w *Worker, update api.WorkerUpdate) {
+	if update.HealthExpr == nil {
+		return
+	}
+	w.healthRule, _ = compileHealthRule(*update.HealthExpr)
+}
+
+// newHealthEnv collects the fields of one health check
+func newHealthEnv(code int, body []byte, latency time.Duration, w *Worker) healthEnv {
+	env := healthEnv{
+		"httpStatus": float64(code),
+		"latencyMs":  float64(latency.Milliseconds()),
+		"maxLoad":    float64(w.MaxLoad),
+	}
+	var fields map[string]interface{}
+	if json.Unmarshal(body, &fields) == nil {
+		for _, name := range []string{"status", "currentLoad", "queueDepth"} {
+			if v, ok := fields[name]; ok {
+				env[name] = v
+			}
+		}
+	}
+	if p := w.probe.snapshot(); p != nil && p.LastAt != nil {
+		env["probeLatencyMs"] = float64(p.LastLatencyMs)
+	}
+	return env
+}
+
+// judgeHealthLocked decides the outcome of a health check. Without
+// expressions a 200 is healthy and anything else is not. With expressions
+// the unhealthy one decides failure and the degraded one marks a passing
+// worker as degraded; an expression that cannot be evaluated fails the
+// check with its own reason. Must be called with lb.mu held.
+func (w *Worker) judgeHealthLocked(code int, body []byte, latency time.Duration) (ok, degraded bool, reason string) {
+	rule := w.healthRule
+	if rule == nil {
+		if code != http.StatusOK {
+			return false, false, fmt.Sprintf("HTTP %d", code)
+		}
+		return true, false, ""
+	}
+	env := newHealthEnv(code, body, latency, w)
+	if rule.unhealthy != nil {
+		v, err := rule.unhealthy.eval(env)
+		if err != nil {
+			return false, false, "evaluation failed: " + err.Error()
+		}
+		if v.(bool) {
+			return false, false, "unhealthy: " + rule.expr.Unhealthy
+		}
+	}
+	if rule.degraded != nil {
+		v, err := rule.degraded.eval(env)
+		if err != nil {
+			return false, false, "evaluation failed: " + err.Error()
+		}
+		if v.(bool) {
+			return true, true, "degraded: " + rule.expr.Degraded
+		}
+	}
+	return true, false, ""
+}
+
+// healthStateLocked returns healthy, degraded or unhealthy. Must be called
+// with lb.mu held.
+func (w *Worker) healthStateLocked() string {
+	switch {
+	case !w.Healthy:
+		return healthStateUnhealthy
+	case w.degraded:
+		return healthStateDegraded
+	}
+	return healthStateHealthy
+}
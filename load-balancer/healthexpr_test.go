@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+func TestCompileHealthExpr(t *testing.T) {
+	valid := []string{
+		"queueDepth > 40",
+		"currentLoad / maxLoad > 0.8",
+		"httpStatus != 200",
+		`status == "degraded" || !(latencyMs <= 250)`,
+		"-queueDepth < -3 && probeLatencyMs >= 100 * 2 - 1",
+		"true",
+	}
+	for _, src := range valid {
+		if _, err := compileHealthExpr(src); err != nil {
+			t.Errorf("%s: %v", src, err)
+		}
+	}
+
+	invalid := map[string]string{
+		"queueDepth > 40 &&":        "unexpected end of expression",
+		"queue > 40":                `unknown field "queue" at 0`,
+		`status > 3`:                `">" at 7 needs a number operand, got string`,
+		`status == 3`:               `"==" at 7 compares a string with a number`,
+		"queueDepth + 1":            "must be a condition, got a number",
+		"queueDepth > 1 2":          `unexpected "2" at 15`,
+		`status == "ok`:             "unterminated string at 10",
+		"(queueDepth > 1":           `expected ")" at 15`,
+		"queueDepth > 1 && 5":       `"&&" at 15 needs a bool operand, got number`,
+		"queueDepth = 1":            `unexpected '=' at 11`,
+		"queueDepth > 1.2.3":        `invalid number "1.2.3" at 13`,
+		strings.Repeat("1 + ", 100): "must be at most 256 characters",
+	}
+	for src, want := range invalid {
+		_, err := compileHealthExpr(src)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: err = %v, want %q", src, err, want)
+		}
+	}
+}
+
+func TestEvalHealthExpr(t *testing.T) {
+	env := healthEnv{"status": "ok", "currentLoad": 4.0, "maxLoad": 5.0, "queueDepth": 12.0, "httpStatus": 200.0}
+	tests := []struct {
+		src     string
+		want    bool
+		wantErr string
+	}{
+		{"queueDepth > 40", false, ""},
+		{"currentLoad / maxLoad > 0.75", true, ""},
+		{`status == "ok" && httpStatus == 200`, true, ""},
+		{`status != 'ok'`, false, ""},
+		{"1 + 2 * 3 == 7", true, ""},
+		{"(1 + 2) * 3 == 9", true, ""},
+		{"!(queueDepth >= 12)", false, ""},
+		{"latencyMs > 100", false, "field latencyMs is missing"},
+		{"queueDepth > 1 || latencyMs > 100", true, ""},
+		{"queueDepth > 100 && latencyMs > 100", false, ""},
+		{"currentLoad / (maxLoad - 5) > 1", false, "division by zero"},
+	}
+	for _, tt := range tests {
+		n, err := compileHealthExpr(tt.src)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.src, err)
+		}
+		got, err := n.eval(env)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%s: err = %v, want %q", tt.src, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s = %v, %v; want %v", tt.src, got, err, tt.want)
+		}
+	}
+
+	n, _ := compileHealthExpr("queueDepth > 1")
+	if _, err := n.eval(healthEnv{"queueDepth": "deep"}); err == nil || err.Error() != "field queueDepth is not a number" {
+		t.Errorf("wrong field type: err = %v", err)
+	}
+}
+
+func TestHealthExprChecks(t *testing.T) {
+	var body atomic.Value
+	var code int32 = http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&code)))
+		w.Write([]byte(body.Load().(string)))
+	}))
+	defer srv.Close()
+
+	lb = NewLoadBalancer("round-robin")
+	lb.healthFall = 1
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+	w := lb.workers[0]
+
+	rec := patchWorker("worker-1", `{"healthExpr":{"unhealthy":"queueDepth > 40","degraded":"currentLoad / maxLoad > 0.8"}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PATCH: %d %s", rec.Code, rec.Body.String())
+	}
+	var status api.WorkerStatus
+	json.NewDecoder(rec.Body).Decode(&status)
+	if status.HealthExpr == nil || status.HealthExpr.Unhealthy != "queueDepth > 40" {
+		t.Errorf("status healthExpr = %+v", status.HealthExpr)
+	}
+
+	check := func(b string) (bool, string, string) {
+		body.Store(b)
+		lb.checkWorker(w)
+		lb.mu.RLock()
+		defer lb.mu.RUnlock()
+		return w.Healthy, w.healthStateLocked(), w.healthReason
+	}
+	tests := []struct {
+		body    string
+		healthy bool
+		state   string
+		reason  string
+	}{
+		{`{"status":"healthy","currentLoad":1,"queueDepth":3}`, true, "healthy", ""},
+		{`{"status":"healthy","currentLoad":3,"queueDepth":3}`, true, "degraded", "degraded: currentLoad / maxLoad > 0.8"},
+		{`{"status":"healthy","currentLoad":3,"queueDepth":41}`, false, "unhealthy", "unhealthy: queueDepth > 40"},
+		{`{"status":"healthy","currentLoad":1}`, false, "unhealthy", "evaluation failed: field queueDepth is missing"},
+		{`not json`, false, "unhealthy", "evaluation failed: field queueDepth is missing"},
+		{`{"status":"healthy","currentLoad":0,"queueDepth":0}`, true, "healthy", ""},
+	}
+	for i, tt := range tests {
+		healthy, state, reason := check(tt.body)
+		if healthy != tt.healthy || state != tt.state || reason != tt.reason {
+			t.Errorf("check %d: healthy=%v state=%q reason=%q; want %v %q %q", i, healthy, state, reason, tt.healthy, tt.state, tt.reason)
+		}
+	}
+
+	// The expression, not the status code, decides
+	atomic.StoreInt32(&code, http.StatusServiceUnavailable)
+	if healthy, _, _ := check(`{"currentLoad":0,"queueDepth":0}`); !healthy {
+		t.Error("a 503 should pass when the expression ignores httpStatus")
+	}
+
+	workers := lb.GetStatus()["workers"].([]map[string]interface{})
+	if workers[0]["healthExpr"] == nil || workers[0]["healthState"] != "healthy" {
+		t.Errorf("status = %v, want the active expression and state", workers[0])
+	}
+
+	// Clearing the expressions restores the status code check
+	patchWorker("worker-1", `{"healthExpr":{}}`)
+	if healthy, _, reason := check(`{}`); healthy || reason != "HTTP 503" {
+		t.Errorf("healthy=%v reason=%q after clearing, want unhealthy on HTTP 503", healthy, reason)
+	}
+	if lb.GetStatus()["workers"].([]map[string]interface{})[0]["healthExpr"] != nil {
+		t.Error("status should not show a cleared expression")
+	}
+}
+
+func TestHealthExprValidatedOnPatch(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", "http://localhost:8081", "#FF0000", 1)
+
+	rec := patchWorker("worker-1", `{"weight":4,"healthExpr":{"unhealthy":"queueDepth > 1","degraded":"depth > 1"}}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status code = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	var resp api.ErrorResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp.Field != "healthExpr.degraded" || resp.Error != `unknown field "depth" at 0` {
+		t.Errorf("error = %+v", resp)
+	}
+	if lb.workers[0].healthRule != nil || lb.workers[0].Weight != 1 {
+		t.Error("nothing should be applied when an expression is invalid")
+	}
+}
+
+func TestHealthCheckLatencyField(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+	}))
+	defer srv.Close()
+	lb = NewLoadBalancer("round-robin")
+	lb.healthFall = 1
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+	patchWorker("worker-1", `{"healthExpr":{"unhealthy":"latencyMs >= 30"}}`)
+
+	lb.checkWorker(lb.workers[0])
+	if lb.workers[0].Healthy {
+		t.Error("a slow /health should fail a latency expression")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// defaultHealthPath is where health checks probe a worker that was not
+// given a HealthPath
+const defaultHealthPath = "/health"
+
+// validateHealthPath checks a worker's health check path: an absolute path,
+// optionally with a query. "" stands for defaultHealthPath.
+func validateHealthPath(path string) error {
+	if path == "" {
+		return nil
+	}
+	u, err := url.Parse(path)
+	if err != nil || !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || u.Host != "" || u.Fragment != "" || strings.ContainsAny(path, " \t\r\n") {
+		return &MetadataError{"healthPath", "must be an absolute path such as /health"}
+	}
+	return nil
+}
+
+// healthURL returns the URL health checks probe on w. Must be called with
+// lb.mu held.
+func (w *Worker) healthURL() string {
+	if w.HealthPath == "" {
+		return w.URL + defaultHealthPath
+	}
+	return w.URL + w.HealthPath
+}
+
+// workerHealthURL returns the health check URL of the named worker, or "" if
+// there is none
+func (lb *LoadBalancer) workerHealthURL(name string) string {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	if w := lb.findWorkerLocked(name); w != nil {
+		return w.healthURL()
+	}
+	return ""
+}
+
+// SetWorkerHealthPath changes the path health checks probe on the named
+// worker; "" restores defaultHealthPath. It returns false if there is no
+// such worker or the path is invalid.
+func (lb *LoadBalancer) SetWorkerHealthPath(name, path string) bool {
+	if validateHealthPath(path) != nil {
+		return false
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	w := lb.findWorkerLocked(name)
+	if w == nil {
+		return false
+	}
+	w.HealthPath = path
+	if path == "" {
+		w.HealthPath = defaultHealthPath
+	}
+	w.revision++
+	return true
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// newPathWorker returns a worker that passes health checks only on path
+// and records the paths it was probed on
+func newPathWorker(t *testing.T, path string) (*httptest.Server, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var probed []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		probed = append(probed, r.URL.RequestURI())
+		mu.Unlock()
+		if r.URL.Path != path {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"status":"healthy"}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), probed...)
+	}
+}
+
+func addWorkerVia(body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handleAddWorker(rec, httptest.NewRequest(http.MethodPost, "/workers", bytes.NewBufferString(body)))
+	return rec
+}
+
+func TestHealthPath(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.healthFall = 1
+	ping, pingProbes := newPathWorker(t, "/ping")
+	legacy, legacyProbes := newPathWorker(t, "/health")
+
+	rec := addWorkerVia(`{"name":"worker-ping","url":"` + ping.URL + `","healthPath":"/ping?deep=1"}`)
+	var status api.WorkerStatus
+	json.NewDecoder(rec.Body).Decode(&status)
+	if rec.Code != http.StatusCreated || status.HealthPath != "/ping?deep=1" {
+		t.Fatalf("add: %d %+v", rec.Code, status)
+	}
+	lb.AddWorker("worker-legacy", legacy.URL, "#00FF00", 1)
+
+	for _, w := range lb.workers {
+		lb.checkWorker(w)
+		if !w.Healthy {
+			t.Errorf("%s unhealthy, want its health path probed", w.Name)
+		}
+	}
+	if got := pingProbes(); len(got) != 1 || got[0] != "/ping?deep=1" {
+		t.Errorf("worker-ping probed on %v", got)
+	}
+	if got := legacyProbes(); len(got) != 1 || got[0] != "/health" {
+		t.Errorf("worker-legacy probed on %v", got)
+	}
+
+	// Moving the path elsewhere fails the check; "" restores /health
+	if !lb.SetWorkerHealthPath("worker-ping", "/missing") {
+		t.Fatal("SetWorkerHealthPath failed")
+	}
+	lb.checkWorker(lb.workers[0])
+	if lb.workers[0].Healthy {
+		t.Error("healthy on a path the worker does not serve")
+	}
+	patchWorker("worker-ping", `{"healthPath":""}`)
+	if p := lb.workers[0].HealthPath; p != defaultHealthPath {
+		t.Errorf("health path after reset = %q, want %q", p, defaultHealthPath)
+	}
+	if lb.SetWorkerHealthPath("worker-ping", "ping") || lb.SetWorkerHealthPath("nope", "/ping") {
+		t.Error("SetWorkerHealthPath accepted a relative path or an unknown worker")
+	}
+}
+
+func TestHealthPathValidation(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	for _, path := range []string{"ping", "//evil.example/health", "/health#top", "/he alth"} {
+		body, _ := json.Marshal(api.AddWorkerRequest{Name: "worker-1", URL: "http://localhost:8081", HealthPath: path})
+		rec := addWorkerVia(string(body))
+		var resp api.ErrorResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		if rec.Code != http.StatusBadRequest || resp.Field != "healthPath" {
+			t.Errorf("%q: %d %+v, want 400 on healthPath", path, rec.Code, resp)
+		}
+	}
+	lb.AddWorker("worker-1", "http://localhost:8081", "#FF0000", 1)
+	if rec := patchWorker("worker-1", `{"healthPath":"ping"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("patch with a relative path: %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// Per-worker health check timing. Every worker is checked by its own loop,
+// at its HealthInterval if set and the pool's healthIntervalMs otherwise,
+// with a probe bounded by its HealthTimeout or the pool's healthTimeoutMs.
+// The pool loop's status records the latest check of any worker. A worker
+// whose checks fail is checked less often: after n failures in a row the
+// next check waits interval * 2^n, up to maxHealthBackoffMs, and the first
+// check that passes restores the interval.
+
+// maxWorkerHealthTimeout bounds a worker's own health check timeout
+const maxWorkerHealthTimeout = time.Minute
+
+// validateHealthTiming checks the healthIntervalMs and healthTimeoutMs of a
+// worker update; 0 falls back to the pool's
+func validateHealthTiming(intervalMs, timeoutMs *int64) error {
+	if intervalMs != nil && *intervalMs != 0 && time.Duration(*intervalMs)*time.Millisecond < minHealthInterval {
+		return &MetadataError{"healthIntervalMs", fmt.Sprintf("must be 0 or at least %d", minHealthInterval.Milliseconds())}
+	}
+	if timeoutMs != nil && (*timeoutMs < 0 || time.Duration(*timeoutMs)*time.Millisecond > maxWorkerHealthTimeout) {
+		return &MetadataError{"healthTimeoutMs", fmt.Sprintf("must be between 0 and %d", maxWorkerHealthTimeout.Milliseconds())}
+	}
+	return nil
+}
+
+// applyHealthTimingLocked applies the health check timing of update to w and
+// restarts the wait for its next check. Must be called with lb.mu held.
+func applyHealthTimingLocked(w *Worker, update api.WorkerUpdate) {
+	if update.HealthIntervalMs != nil {
+		w.HealthInterval = time.Duration(*update.HealthIntervalMs) * time.Millisecond
+		if w.healthLoop != nil {
+			w.healthLoop.wake()
+		}
+	}
+	if update.HealthTimeoutMs != nil {
+		w.HealthTimeout = time.Duration(*update.HealthTimeoutMs) * time.Millisecond
+	}
+}
+
+// SetWorkerHealthTiming sets the named worker's health check interval and
+// timeout; 0 uses the pool's. It returns false if there is no such worker
+// or a value is out of range.
+func (lb *LoadBalancer) SetWorkerHealthTiming(name string, interval, timeout time.Duration) bool {
+	intervalMs, timeoutMs := interval.Milliseconds(), timeout.Milliseconds()
+	if validateHealthTiming(&intervalMs, &timeoutMs) != nil {
+		return false
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	w := lb.findWorkerLocked(name)
+	if w == nil {
+		return false
+	}
+	applyHealthTimingLocked(w, api.WorkerUpdate{HealthIntervalMs: &intervalMs, HealthTimeoutMs: &timeoutMs})
+	w.revision++
+	return true
+}
+
+// healthIntervalLocked returns how often w is checked. Must be called with
+// lb.mu held.
+func (lb *LoadBalancer) healthIntervalLocked(w *Worker) time.Duration {
+	if w.HealthInterval > 0 {
+		return w.HealthInterval
+	}
+	return lb.healthInterval
+}
+
+// healthTimeoutLocked returns how long a probe of w may take. Must be called
+// with lb.mu held.
+func (lb *LoadBalancer) healthTimeoutLocked(w *Worker) time.Duration {
+	if w.HealthTimeout > 0 {
+		return w.HealthTimeout
+	}
+	return lb.healthTimeout
+}
+
+// startHealthLoopLocked starts the health check loop of w if health checks
+// are running and it has none yet. The loop ends with HealthCheck or when
+// the worker is removed. Must be called with lb.mu held.
+func (lb *LoadBalancer) startHealthLoopLocked(w *Worker) {
+	if lb.healthCtx == nil || w.healthStop != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(lb.healthCtx)
+	w.healthStop = cancel
+	if w.healthLoop == nil {
+		w.healthLoop = newLoopTicker()
+	}
+	go lb.runLoop(ctx, w.healthLoop, func() time.Duration {
+		lb.mu.RLock()
+		defer lb.mu.RUnlock()
+		return lb.healthIntervalLocked(w)
+	}, func() {
+		now := lb.clock.Now()
+		lb.healthLoop.mark(now)
+		lb.mu.RLock()
+		backingOff := now.Before(w.nextHealthCheck)
+		lb.mu.RUnlock()
+		if !backingOff {
+			lb.startCheck(w)
+		}
+	})
+}
+
+// backOffHealthLocked counts a health check of w started at checkedAt and
+// sets when the next one is due: a failure doubles the wait per failure in
+// a row, a success clears it. Must be called with lb.mu held.
+func (lb *LoadBalancer) backOffHealthLocked(w *Worker, ok bool, checkedAt time.Time) {
+	if ok {
+		w.healthFailures = 0
+		w.nextHealthCheck = time.Time{}
+		return
+	}
+	w.healthFailures++
+	if lb.maxHealthBackoff <= 0 {
+		w.nextHealthCheck = time.Time{}
+		return
+	}
+	wait := lb.healthIntervalLocked(w)
+	for i := 0; i < w.healthFailures && wait < lb.maxHealthBackoff; i++ {
+		wait *= 2
+	}
+	if wait > lb.maxHealthBackoff {
+		wait = lb.maxHealthBackoff
+	}
+	w.nextHealthCheck = checkedAt.Add(wait)
+}
+
+// stopHealthLoopLocked ends the health check loop of w, if any. Must be
+// called with lb.mu held.
+func stopHealthLoopLocked(w *Worker) {
+	if w.healthStop != nil {
+		w.healthStop()
+		w.healthStop = nil
+	}
+}
+
+// wakeHealthLoopsLocked makes every worker's loop recompute its wait, after
+// the pool's interval changed. Must be called with lb.mu held.
+func (lb *LoadBalancer) wakeHealthLoopsLocked() {
+	for _, w := range lb.workers {
+		if w.healthLoop != nil {
+			w.healthLoop.wake()
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// waitForCheckDone waits until w has no health check in flight
+func waitForCheckDone(t *testing.T, w *Worker) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&w.checking) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s health check never completed", w.Name)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPerWorkerHealthInterval(t *testing.T) {
+	var fastHits, slowHits int32
+	answered := make(chan struct{})
+	close(answered)
+	clk := newFakeClock()
+	lb = NewLoadBalancer("round-robin")
+	lb.clock = clk
+	lb.AddWorker("worker-fast", newStalledWorker(t, &fastHits, answered).URL, "#FF0000", 1)
+	lb.AddWorker("worker-slow", newStalledWorker(t, &slowHits, answered).URL, "#00FF00", 1)
+	if rec := patchWorker("worker-fast", `{"healthIntervalMs":500}`); rec.Code != http.StatusOK {
+		t.Fatalf("patch: %d %s", rec.Code, rec.Body)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lb.HealthCheck(ctx, 2*time.Second)
+	clk.waitForTimer(t)
+	clk.waitForTimer(t)
+
+	for i := int32(1); i <= 3; i++ {
+		clk.Advance(500 * time.Millisecond)
+		waitForHits(t, &fastHits, i)
+		waitForCheckDone(t, lb.workers[0])
+		clk.waitForTimer(t)
+	}
+	if got := atomic.LoadInt32(&slowHits); got != 0 {
+		t.Fatalf("worker-slow checked %d times in 1.5s, want 0", got)
+	}
+	clk.Advance(500 * time.Millisecond)
+	waitForHits(t, &slowHits, 1)
+	waitForHits(t, &fastHits, 4)
+	waitForTick(t, lb.healthLoop, clk.Now())
+	clk.waitForTimer(t)
+	clk.waitForTimer(t)
+
+	workers := lb.GetStatus()["workers"].([]map[string]interface{})
+	if workers[0]["healthIntervalMs"] != int64(500) || workers[1]["healthIntervalMs"] != int64(2000) {
+		t.Errorf("status intervals = %v, %v", workers[0]["healthIntervalMs"], workers[1]["healthIntervalMs"])
+	}
+
+	// A worker added while the checks run gets its own loop
+	var addedHits int32
+	lb.AddWorker("worker-added", newStalledWorker(t, &addedHits, answered).URL, "#0000FF", 1)
+	clk.waitForTimer(t)
+	clk.Advance(2 * time.Second)
+	waitForHits(t, &addedHits, 1)
+}
+
+func TestPerWorkerHealthTimeout(t *testing.T) {
+	var hits int32
+	release := make(chan struct{})
+	defer close(release)
+	lb = NewLoadBalancer("round-robin")
+	lb.healthFall = 1
+	lb.healthTimeout = 10 * time.Second
+	lb.AddWorker("worker-1", newStalledWorker(t, &hits, release).URL, "#FF0000", 1)
+	if !lb.SetWorkerHealthTiming("worker-1", 0, 50*time.Millisecond) {
+		t.Fatal("SetWorkerHealthTiming failed")
+	}
+
+	start := time.Now()
+	lb.checkWorker(lb.workers[0])
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("check took %s with a 50ms timeout", d)
+	}
+	if lb.workers[0].Healthy {
+		t.Error("worker still healthy after its probe timed out")
+	}
+}
+
+func TestHealthTimingValidation(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", "http://localhost:8081", "#FF0000", 1)
+
+	for _, body := range []string{`{"healthIntervalMs":100}`, `{"healthTimeoutMs":-1}`, `{"healthTimeoutMs":600000}`} {
+		rec := patchWorker("worker-1", body)
+		var e api.ErrorResponse
+		json.NewDecoder(rec.Body).Decode(&e)
+		if rec.Code != http.StatusBadRequest || e.Field == "" {
+			t.Errorf("%s: %d %+v, want 400 naming the field", body, rec.Code, e)
+		}
+	}
+
+	rec := patchWorker("worker-1", `{"healthIntervalMs":1500,"healthTimeoutMs":250}`)
+	var status api.WorkerStatus
+	json.NewDecoder(rec.Body).Decode(&status)
+	if rec.Code != http.StatusOK || status.HealthIntervalMs != 1500 || status.HealthTimeoutMs != 250 {
+		t.Fatalf("patch: %d %+v", rec.Code, status)
+	}
+
+	// 0 falls back to the pool's
+	rec = patchWorker("worker-1", `{"healthIntervalMs":0,"healthTimeoutMs":0}`)
+	status = api.WorkerStatus{}
+	json.NewDecoder(rec.Body).Decode(&status)
+	if status.HealthIntervalMs != lb.healthInterval.Milliseconds() || status.HealthTimeoutMs != lb.healthTimeout.Milliseconds() {
+		t.Errorf("reset: %+v, want the pool's %s and %s", status, lb.healthInterval, lb.healthTimeout)
+	}
+}
+
+func TestHealthCheckBackoff(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	clk := newFakeClock()
+	lb = NewLoadBalancer("round-robin")
+	lb.clock = clk
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+	w := lb.workers[0]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lb.HealthCheck(ctx, time.Second)
+	clk.waitForTimer(t)
+
+	// Step through 16 intervals, noting the ones that checked the worker
+	var checkedAt []int
+	for step := 1; step <= 16; step++ {
+		clk.Advance(time.Second)
+		clk.waitForTimer(t)
+		waitForCheckDone(t, w)
+		if n := int(atomic.LoadInt32(&hits)); n > len(checkedAt) {
+			checkedAt = append(checkedAt, step)
+		}
+	}
+	if want := []int{1, 3, 7, 15}; !reflect.DeepEqual(checkedAt, want) {
+		t.Fatalf("checked at intervals %v, want %v", checkedAt, want)
+	}
+	if gap := checkedAt[3] - checkedAt[2]; gap < 8 {
+		t.Errorf("%d intervals after 3 failures, want at least 8", gap)
+	}
+	status, _ := lb.WorkerStatus("worker-1")
+	if status.NextHealthCheck == nil || !status.NextHealthCheck.Equal(clk.Now().Add(15*time.Second)) {
+		t.Errorf("nextHealthCheck = %v, want 16s after the last check", status.NextHealthCheck)
+	}
+}
+
+func TestHealthCheckBackoffCapAndReset(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	clk := newFakeClock()
+	lb = NewLoadBalancer("round-robin")
+	lb.clock = clk
+	lb.maxHealthBackoff = 20 * time.Second
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+	w := lb.workers[0]
+
+	for i := 0; i < 5; i++ {
+		lb.checkWorker(w)
+	}
+	// 5s * 2^5 is capped
+	if d := w.nextHealthCheck.Sub(clk.Now()); d != 20*time.Second {
+		t.Errorf("backoff after 5 failures = %s, want the 20s cap", d)
+	}
+
+	failing.Store(false)
+	lb.checkWorker(w)
+	if w.healthFailures != 0 || !w.nextHealthCheck.IsZero() {
+		t.Errorf("after a passed check: %d failures, next check %v", w.healthFailures, w.nextHealthCheck)
+	}
+
+	// 0 turns the backoff off
+	lb.maxHealthBackoff = 0
+	failing.Store(true)
+	lb.checkWorker(w)
+	if !w.nextHealthCheck.IsZero() {
+		t.Errorf("backoff off: next check %v", w.nextHealthCheck)
+	}
+}
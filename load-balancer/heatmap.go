@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Latency heatmaps. Every forwarded attempt is counted in a grid of
+// heatmapColumns time columns of heatmapInterval each by the latency buckets
+// of statsLatencyBuckets, per worker and for the pool. A column is reset
+// when the clock comes round to it again, so a grid holds the last
+// heatmapColumns × heatmapInterval and costs a fixed
+// heatmapColumns × (len(statsLatencyBuckets)+1) × 8 B ≈ 7 KB.
+const (
+	heatmapInterval = 10 * time.Second
+	heatmapColumns  = 60
+)
+
+// HeatmapBucket is one latency row of a heatmap; UpperMs is null for the
+// unbounded last row
+type HeatmapBucket struct {
+	LowerMs float64  `json:"lowerMs"`
+	UpperMs *float64 `json:"upperMs"`
+}
+
+// HeatmapMatrix holds the counts of one grid, Counts[column][bucket], with
+// its largest cell and total for scaling
+type HeatmapMatrix struct {
+	Counts [][]int64 `json:"counts"`
+	Max    int64     `json:"max"`
+	Total  int64     `json:"total"`
+}
+
+// Heatmap is the response of GET /heatmap. Columns run oldest to newest and
+// start at Timestamps (Unix ms); Worker is only set when one was requested.
+type Heatmap struct {
+	IntervalMs int64           `json:"intervalMs"`
+	Timestamps []int64         `json:"timestamps"`
+	Buckets    []HeatmapBucket `json:"buckets"`
+	Worker     *HeatmapMatrix  `json:"worker,omitempty"`
+	Pool       HeatmapMatrix   `json:"pool"`
+}
+
+// heatmapGrid is a ring of time columns; starts holds the start (Unix ms) of
+// the period each column currently counts, 0 when it has none
+type heatmapGrid struct {
+	starts [heatmapColumns]int64
+	counts [heatmapColumns][]int64
+}
+
+// observe counts one latency in the column of now
+func (g *heatmapGrid) observe(now time.Time, bucket int) {
+	start := now.Truncate(heatmapInterval).UnixMilli()
+	i := int(start/heatmapInterval.Milliseconds()) % heatmapColumns
+	if g.starts[i] != start || g.counts[i] == nil {
+		g.starts[i] = start
+		g.counts[i] = make([]int64, len(statsLatencyBuckets)+1)
+	}
+	g.counts[i][bucket]++
+}
+
+// matrix returns the columns starting at each of starts; columns that
+// rolled off or never counted anything are zero
+func (g *heatmapGrid) matrix(starts []int64) HeatmapMatrix {
+	m := HeatmapMatrix{Counts: make([][]int64, len(starts))}
+	for k, start := range starts {
+		col := make([]int64, len(statsLatencyBuckets)+1)
+		if g != nil {
+			i := int(start/heatmapInterval.Milliseconds()) % heatmapColumns
+			if g.starts[i] == start {
+				copy(col, g.counts[i])
+			}
+		}
+		for _, c := range col {
+			m.Total += c
+			if c > m.Max {
+				m.Max = c
+			}
+		}
+		m.Counts[k] = col
+	}
+	return m
+}
+
+// newest returns the start of the most recent column with counts
+func (g *heatmapGrid) newest() int64 {
+	var out int64
+	for _, s := range g.starts {
+		if s > out {
+			out = s
+		}
+	}
+	return out
+}
+
+// heatmapStore holds a grid per worker and one for the pool. Grids of
+// workers with nothing in the window are dropped by sweep.
+type heatmapStore struct {
+	mu      sync.Mutex
+	workers map[string]*heatmapGrid
+	pool    *heatmapGrid
+}
+
+func newHeatmapStore() *heatmapStore {
+	return &heatmapStore{workers: make(map[string]*heatmapGrid), pool: &heatmapGrid{}}
+}
+
+// observe counts one attempt of worker at now
+func (s *heatmapStore) observe(worker string, now time.Time, latency time.Duration) {
+	bucket := sort.SearchFloat64s(statsLatencyBuckets, float64(latency)/float64(time.Millisecond))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.workers[worker]
+	if !ok {
+		g = &heatmapGrid{}
+		s.workers[worker] = g
+	}
+	g.observe(now, bucket)
+	s.pool.observe(now, bucket)
+}
+
+// rename moves the grid of worker from to worker to
+func (s *heatmapStore) rename(from, to string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if g, ok := s.workers[from]; ok {
+		delete(s.workers, from)
+		s.workers[to] = g
+	}
+}
+
+// snapshot returns the heatmap of the window ending at now, with the
+// worker's grid when worker is set
+func (s *heatmapStore) snapshot(worker string, now time.Time) Heatmap {
+	last := now.Truncate(heatmapInterval).UnixMilli()
+	h := Heatmap{
+		IntervalMs: heatmapInterval.Milliseconds(),
+		Timestamps: make([]int64, heatmapColumns),
+		Buckets:    make([]HeatmapBucket, len(statsLatencyBuckets)+1),
+	}
+	for k := range h.Timestamps {
+		h.Timestamps[k] = last - int64(heatmapColumns-1-k)*h.IntervalMs
+	}
+	lower := 0.0
+	for i := range statsLatencyBuckets {
+		upper := statsLatencyBuckets[i]
+		h.Buckets[i] = HeatmapBucket{LowerMs: lower, UpperMs: &upper}
+		lower = upper
+	}
+	h.Buckets[len(statsLatencyBuckets)] = HeatmapBucket{LowerMs: lower}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h.Pool = s.pool.matrix(h.Timestamps)
+	if worker != "" {
+		m := s.workers[worker].matrix(h.Timestamps)
+		h.Worker = &m
+	}
+	return h
+}
+
+func (s *heatmapStore) size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.workers)
+}
+
+func (s *heatmapStore) bounds() storeBounds {
+	return storeBounds{MaxAgeMs: (heatmapColumns * heatmapInterval).Milliseconds()}
+}
+
+// sweep drops the grids of workers that counted nothing in the window
+func (s *heatmapStore) sweep(now time.Time) int {
+	first := now.Truncate(heatmapInterval).Add(-(heatmapColumns - 1) * heatmapInterval).UnixMilli()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for name, g := range s.workers {
+		if g.newest() < first {
+			delete(s.workers, name)
+			n++
+		}
+	}
+	return n
+}
+
+// handleHeatmap は GET /heatmap でダッシュボードのヒートマップ用に、直近 10 分間 (10 秒ごとの列) ×
+// レイテンシバケットのリクエスト数の行列を返す HTTP ハンドラです。
+// ?worker=<name> を指定するとそのワーカーの行列 (worker) をプール全体の行列 (pool) と並べて返します。
+// counts[列][バケット] の列は timestamps (Unix ミリ秒) の順、バケットは buckets の順です。
+func handleHeatmap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	worker := r.URL.Query().Get("worker")
+	if worker != "" {
+		lb.mu.RLock()
+		found := lb.findWorkerLocked(worker) != nil
+		lb.mu.RUnlock()
+		if !found {
+			http.Error(w, "Worker not found", http.StatusNotFound)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lb.heatmap.snapshot(worker, lb.clock.Now()))
+}
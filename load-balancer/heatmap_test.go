@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getHeatmap(t *testing.T, query string) Heatmap {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleHeatmap(rec, httptest.NewRequest(http.MethodGet, "/heatmap"+query, nil))
+	var h Heatmap
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status code = %d: %s", rec.Code, rec.Body)
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&h); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return h
+}
+
+func TestHeatmapBimodal(t *testing.T) {
+	clk := newFakeClock()
+	lb = NewLoadBalancer("round-robin")
+	lb.clock = clk
+	lb.AddWorker("go-worker-1", "http://localhost:8081", "#FF0000", 1)
+	lb.AddWorker("go-worker-2", "http://localhost:8082", "#00FF00", 1)
+
+	// Fast requests with a GC pause every fifth, over three columns
+	for col := 0; col < 3; col++ {
+		if col > 0 {
+			clk.Advance(heatmapInterval)
+		}
+		for i := 0; i < 20; i++ {
+			latency := 4 * time.Millisecond
+			if i%5 == 4 {
+				latency = 800 * time.Millisecond
+			}
+			lb.heatmap.observe("go-worker-1", clk.Now(), latency)
+		}
+		lb.heatmap.observe("go-worker-2", clk.Now(), 30*time.Millisecond)
+	}
+
+	h := getHeatmap(t, "?worker=go-worker-1")
+	if len(h.Timestamps) != heatmapColumns || len(h.Buckets) != len(statsLatencyBuckets)+1 || h.IntervalMs != 10000 {
+		t.Fatalf("shape: %d columns, %d buckets, %dms", len(h.Timestamps), len(h.Buckets), h.IntervalMs)
+	}
+	if last := h.Timestamps[heatmapColumns-1]; last != clk.Now().UnixMilli() {
+		t.Errorf("last column starts at %d, want %d", last, clk.Now().UnixMilli())
+	}
+	fast, slow := 2, 9 // (2, 5] and (500, 1000]
+	if b := h.Buckets[fast]; b.LowerMs != 2 || *b.UpperMs != 5 {
+		t.Errorf("bucket %d = %+v", fast, b)
+	}
+	if b := h.Buckets[len(h.Buckets)-1]; b.UpperMs != nil {
+		t.Errorf("last bucket = %+v, want it unbounded", b)
+	}
+	if h.Worker == nil || h.Worker.Total != 60 || h.Worker.Max != 16 {
+		t.Fatalf("worker matrix = %+v", h.Worker)
+	}
+	for k := heatmapColumns - 3; k < heatmapColumns; k++ {
+		col := h.Worker.Counts[k]
+		if col[fast] != 16 || col[slow] != 4 {
+			t.Errorf("column %d = %v, want 16 fast and 4 slow", k, col)
+		}
+	}
+	if col := h.Worker.Counts[heatmapColumns-4]; col[fast] != 0 || col[slow] != 0 {
+		t.Errorf("column before the stream = %v", col)
+	}
+	if h.Pool.Total != 63 || h.Pool.Counts[heatmapColumns-1][5] != 1 {
+		t.Errorf("pool total = %d, last column %v", h.Pool.Total, h.Pool.Counts[heatmapColumns-1])
+	}
+	if h := getHeatmap(t, ""); h.Worker != nil || h.Pool.Total != 63 {
+		t.Errorf("pool-only heatmap: worker %v, pool total %d", h.Worker, h.Pool.Total)
+	}
+
+	// Columns roll off one interval at a time
+	clk.Advance((heatmapColumns - 1) * heatmapInterval)
+	h = getHeatmap(t, "?worker=go-worker-1")
+	if h.Worker.Total != 20 || h.Worker.Counts[0][fast] != 16 {
+		t.Errorf("after %d intervals: total %d, first column %v", heatmapColumns-1, h.Worker.Total, h.Worker.Counts[0])
+	}
+	clk.Advance(heatmapInterval)
+	if h = getHeatmap(t, "?worker=go-worker-1"); h.Worker.Total != 0 || h.Pool.Total != 0 {
+		t.Errorf("expired: worker total %d, pool total %d", h.Worker.Total, h.Pool.Total)
+	}
+	if n := lb.heatmap.sweep(clk.Now()); n != 2 || lb.heatmap.size() != 0 {
+		t.Errorf("sweep dropped %d grids, %d left", n, lb.heatmap.size())
+	}
+
+	// A column is reused once its period has rolled off
+	lb.heatmap.observe("go-worker-1", clk.Now(), time.Millisecond)
+	if h = getHeatmap(t, "?worker=go-worker-1"); h.Worker.Total != 1 || h.Worker.Counts[heatmapColumns-1][0] != 1 {
+		t.Errorf("after reuse: %+v", h.Worker)
+	}
+}
+
+func TestHeatmapFromTasks(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", newDelayStub(t, "worker-1", 0).URL, "#FF0000", 1)
+	for i := 0; i < 3; i++ {
+		doTask(nil)
+	}
+	if h := getHeatmap(t, "?worker=worker-1"); h.Worker.Total != 3 || h.Pool.Total != 3 {
+		t.Errorf("worker total %d, pool total %d, want 3", h.Worker.Total, h.Pool.Total)
+	}
+
+	rec := httptest.NewRecorder()
+	handleHeatmap(rec, httptest.NewRequest(http.MethodGet, "/heatmap?worker=missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown worker status = %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultSlowRequestMs is the duration beyond which a request to the LB is
+// logged as slow
+const defaultSlowRequestMs = 1000
+
+// Routes the HTTP metrics leave out: a /metrics scrape would count itself,
+// and a /ws request lasts as long as its WebSocket, which the lb_ws_*
+// metrics already cover.
+var uninstrumentedRoutes = map[string]bool{
+	"/metrics": true,
+	"/ws":      true,
+	"/api/ws":  true,
+}
+
+// Routes timed but not logged as slow: a task spends its time in the
+// worker, which the upstream metrics break down
+var slowLogExemptRoutes = map[string]bool{
+	"/task":     true,
+	"/api/task": true,
+}
+
+// statusRecorder remembers the status code written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.code == 0 {
+		s.code = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.code == 0 {
+		s.code = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// httpMetricsMiddleware counts and times every request to next by the mux
+// pattern it matched, so the labels stay bounded whatever the path, and
+// logs requests slower than the slowRequestMs setting. A request without an
+// X-Request-ID is given one, which handlers and the slow log then share.
+func httpMetricsMiddleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		if uninstrumentedRoutes[pattern] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+		requestID := r.Header.Get(requestIDHeader)
+		if requestID == "" {
+			requestID = newRequestID()
+			r.Header.Set(requestIDHeader, requestID)
+		}
+		w.Header().Set(requestIDHeader, requestID)
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		elapsed := time.Since(start)
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+		lb.metrics.httpRequests.WithLabelValues(pattern, r.Method, strconv.Itoa(rec.code)).Inc()
+		lb.metrics.httpDuration.WithLabelValues(pattern, r.Method).Observe(float64(elapsed.Milliseconds()))
+
+		lb.mu.RLock()
+		threshold := lb.slowRequest
+		lb.mu.RUnlock()
+		if threshold > 0 && elapsed > threshold && !slowLogExemptRoutes[pattern] {
+			log.Printf("Warning: slow request %s %s took %dms (> %dms, %s %d, request %s)",
+				r.Method, r.URL.Path, elapsed.Milliseconds(), threshold.Milliseconds(), pattern, rec.code, requestID)
+		}
+	})
+}
+
+// newHandler wraps mux in the middleware every route goes through
+func newHandler(mux *http.ServeMux) http.Handler {
+	return corsMiddleware(httpMetricsMiddleware(mux, recoverMiddleware(mux)))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// syncBuffer is a log output safe to read while handlers log
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestHTTPMetricsMiddleware(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.slowRequest = 20 * time.Millisecond
+	var logs syncBuffer
+	prev := log.Writer()
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(prev) })
+
+	mux := newMux()
+	mux.HandleFunc("/slow/", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := newHandler(mux)
+	serve := func(method, path, requestID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if requestID != "" {
+			req.Header.Set(requestIDHeader, requestID)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	serve(http.MethodGet, "/slow/a", "req-slow")
+	serve(http.MethodGet, "/slow/b", "")
+	if got := testutil.ToFloat64(lb.metrics.httpRequests.WithLabelValues("/slow/", "GET", "418")); got != 2 {
+		t.Errorf("requests to /slow/ = %v, want 2 under the route pattern", got)
+	}
+	if n := testutil.CollectAndCount(lb.metrics.httpDuration); n != 1 {
+		t.Errorf("duration series = %d, want 1", n)
+	}
+	if !strings.Contains(logs.String(), "slow request GET /slow/a") || !strings.Contains(logs.String(), "request req-slow") {
+		t.Errorf("no slow request warning with the request ID in %q", logs.String())
+	}
+
+	// Fast requests are counted by their own route and status but not logged
+	rec := serve(http.MethodGet, "/api/settings", "")
+	if rec.Header().Get(requestIDHeader) == "" {
+		t.Error("a request without an ID should be given one")
+	}
+	serve(http.MethodDelete, "/api/settings", "")
+	serve(http.MethodGet, "/nope", "")
+	serve(http.MethodGet, "/metrics", "")
+	for _, c := range []struct{ path, method, code string }{
+		{"/api/settings", "GET", "200"},
+		{"/api/settings", "DELETE", "405"},
+		{"unmatched", "GET", "404"},
+	} {
+		if got := testutil.ToFloat64(lb.metrics.httpRequests.WithLabelValues(c.path, c.method, c.code)); got != 1 {
+			t.Errorf("%s %s %s = %v, want 1", c.method, c.path, c.code, got)
+		}
+	}
+	if got := testutil.ToFloat64(lb.metrics.httpRequests.WithLabelValues("/metrics", "GET", "200")); got != 0 {
+		t.Errorf("/metrics scrapes counted: %v", got)
+	}
+	if strings.Count(logs.String(), "slow request") != 2 {
+		t.Errorf("warnings = %q, want only the two slow requests", logs.String())
+	}
+}
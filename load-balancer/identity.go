@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Identity check modes. Workers report their own name in /health and task
+// responses; a name other than the configured one usually means two entries
+// point at the same URL. "warn" flags such a worker as misconfigured,
+// "strict" also keeps it out of selection, "off" ignores reported names.
+const (
+	identityOff    = "off"
+	identityWarn   = "warn"
+	identityStrict = "strict"
+)
+
+func validIdentityMode(mode string) bool {
+	return mode == identityOff || mode == identityWarn || mode == identityStrict
+}
+
+// quarantinedLocked reports whether w is kept out of selection for
+// reporting the wrong name. Must be called with lb.mu held.
+func (lb *LoadBalancer) quarantinedLocked(w *Worker) bool {
+	return w.misconfigured && lb.identityMode == identityStrict
+}
+
+// reportedWorkerName returns the "worker" field of a worker response body,
+// or "" if it has none
+func reportedWorkerName(body []byte) string {
+	var r struct {
+		Worker string `json:"worker"`
+	}
+	if json.Unmarshal(body, &r) != nil {
+		return ""
+	}
+	return r.Worker
+}
+
+// identityEvent is a change of a worker's misconfigured flag to report once
+// lb.mu is released
+type identityEvent struct {
+	worker, url, reported, source string
+	misconfigured                 bool
+}
+
+// observeIdentityLocked compares the name w reported in a response from
+// source (health or task) with its configured name and returns the change of
+// its misconfigured flag, if any. A response without a name tells nothing.
+// Must be called with lb.mu held.
+func (lb *LoadBalancer) observeIdentityLocked(w *Worker, reported, source string) *identityEvent {
+	if lb.identityMode == identityOff || reported == "" {
+		return nil
+	}
+	mismatch := reported != w.Name
+	if mismatch {
+		lb.metrics.identityMismatches.WithLabelValues(w.Name, source).Inc()
+	}
+	w.reportedName = reported
+	if mismatch == w.misconfigured {
+		return nil
+	}
+	w.misconfigured = mismatch
+	return &identityEvent{worker: w.Name, url: w.URL, reported: reported, source: source, misconfigured: mismatch}
+}
+
+// observeIdentity is observeIdentityLocked for callers not holding lb.mu
+func (lb *LoadBalancer) observeIdentity(w *Worker, reported, source string) {
+	if reported == "" {
+		return
+	}
+	lb.mu.Lock()
+	e := lb.observeIdentityLocked(w, reported, source)
+	lb.mu.Unlock()
+	lb.emitIdentity(e)
+}
+
+// emitIdentity records a change of a worker's misconfigured flag
+func (lb *LoadBalancer) emitIdentity(e *identityEvent) {
+	if e == nil {
+		return
+	}
+	data := map[string]interface{}{
+		"worker":        e.worker,
+		"url":           e.url,
+		"reported":      e.reported,
+		"source":        e.source,
+		"misconfigured": e.misconfigured,
+	}
+	if e.misconfigured {
+		lb.emitEvent("worker_identity", fmt.Sprintf("Warning: worker %s at %s reports itself as %s", e.worker, e.url, e.reported), data)
+		return
+	}
+	lb.emitEvent("worker_identity", fmt.Sprintf("Worker %s reports its configured name again", e.worker), data)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newNamedWorker answers /health and /task reporting the name returned by
+// name(), like a worker started with that WORKER_NAME
+func newNamedWorker(t *testing.T, name func() string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"worker": name(), "status": "healthy"})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func identityEvents() []Event {
+	var out []Event
+	for _, e := range lb.events.since(0, 0) {
+		if e.Type == "worker_identity" {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func TestWorkerIdentityMismatch(t *testing.T) {
+	var mu sync.Mutex
+	reported := "worker-1"
+	srv := newNamedWorker(t, func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return reported
+	})
+	lb = NewLoadBalancer("round-robin")
+	t.Cleanup(lb.stopControl)
+	// Both entries point at the same worker by mistake
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+	lb.AddWorker("worker-2", srv.URL, "#00FF00", 1)
+	w1, w2 := lb.workers[0], lb.workers[1]
+
+	lb.checkWorker(w1)
+	lb.checkWorker(w2)
+	lb.checkWorker(w2)
+	s1, _ := lb.WorkerStatus("worker-1")
+	s2, _ := lb.WorkerStatus("worker-2")
+	if s1.Misconfigured || !s2.Misconfigured || s2.ReportedName != "worker-1" {
+		t.Errorf("worker-1 misconfigured %v, worker-2 misconfigured %v reporting %q", s1.Misconfigured, s2.Misconfigured, s2.ReportedName)
+	}
+	if got := testutil.ToFloat64(lb.metrics.identityMismatches.WithLabelValues("worker-2", "health")); got != 2 {
+		t.Errorf("health mismatches = %v, want 2", got)
+	}
+	if e := identityEvents(); len(e) != 1 || e[0].Data["worker"] != "worker-2" || e[0].Data["misconfigured"] != true {
+		t.Errorf("identity events = %+v, want one for worker-2", e)
+	}
+
+	// Task responses are checked too; in warn mode worker-2 is still used
+	if _, code, err := lb.forwardTo(context.Background(), w2, TaskRequest{ID: "t", Weight: 1}, time.Now()); err != nil || code != http.StatusOK {
+		t.Fatalf("task to worker-2: %d %v", code, err)
+	}
+	if got := testutil.ToFloat64(lb.metrics.identityMismatches.WithLabelValues("worker-2", "task")); got != 1 {
+		t.Errorf("task mismatches = %v, want 1", got)
+	}
+	picked := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		picked[lb.SelectWorker().Name] = true
+	}
+	if !picked["worker-2"] {
+		t.Error("warn mode should keep worker-2 in selection")
+	}
+
+	// Strict mode excludes it
+	rec := httptest.NewRecorder()
+	handleSettings(rec, httptest.NewRequest(http.MethodPut, "/settings", bytes.NewBufferString(`{"identityCheck": "strict"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("settings: %d %s", rec.Code, rec.Body.String())
+	}
+	for i := 0; i < 4; i++ {
+		if w := lb.SelectWorker(); w != w1 {
+			t.Fatalf("strict mode selected %v, want worker-1", w)
+		}
+	}
+	lb.UpdateWorker("worker-1", ptr(false), nil)
+	lb.mu.RLock()
+	reason := lb.noEligibleLocked(routeHints{}).excluded["worker-2"]
+	lb.mu.RUnlock()
+	if reason != excludedMisconfig {
+		t.Errorf("worker-2 excluded as %q, want %q", reason, excludedMisconfig)
+	}
+
+	// Once it reports the configured name it is trusted again
+	mu.Lock()
+	reported = "worker-2"
+	mu.Unlock()
+	lb.checkWorker(w2)
+	if s2, _ := lb.WorkerStatus("worker-2"); s2.Misconfigured {
+		t.Error("worker-2 still misconfigured after reporting its own name")
+	}
+	if e := identityEvents(); len(e) != 2 || e[1].Data["misconfigured"] != false {
+		t.Errorf("identity events = %+v, want the recovery recorded", e)
+	}
+	if w := lb.SelectWorker(); w != w2 {
+		t.Errorf("selected %v, want worker-2 back in selection", w)
+	}
+
+	rec = httptest.NewRecorder()
+	handleSettings(rec, httptest.NewRequest(http.MethodPut, "/settings", bytes.NewBufferString(`{"identityCheck": "loose"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid identityCheck: %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIP returns the address of the client that sent r: the first entry of
+// X-Forwarded-For when a proxy set it, otherwise the host of RemoteAddr
+func clientIP(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		first, _, _ := strings.Cut(fwd, ",")
+		if ip := strings.TrimSpace(first); ip != "" {
+			return ip
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// ipHash picks the candidate at the FNV-1a hash of ip modulo the number of
+// candidates, so a client keeps landing on the same worker while the
+// candidate list is unchanged. Affinity is best-effort: when a worker goes
+// down, is disabled or added, the modulus changes and clients are remapped.
+// Without an ip it falls back to round-robin.
+func (lb *LoadBalancer) ipHash(workers []*Worker, ip string) *Worker {
+	if ip == "" {
+		return lb.roundRobin(workers)
+	}
+	h := fnv.New32a()
+	h.Write([]byte(ip))
+	return workers[h.Sum32()%uint32(len(workers))]
+}
+
+// SelectWorkerForClient selects a worker based on the current algorithm for a
+// request from the client at ip
+func (lb *LoadBalancer) SelectWorkerForClient(ip string) *Worker {
+	w, _, _ := lb.selectWorker(routeHints{clientIP: ip})
+	return w
+}
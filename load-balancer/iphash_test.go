@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		remoteAddr, forwarded, want string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		{"[2001:db8::1]:1234", "", "2001:db8::1"},
+		{"192.0.2.1:1234", "203.0.113.7, 10.0.0.1", "203.0.113.7"},
+		{"192.0.2.1:1234", " , 10.0.0.1", "192.0.2.1"},
+		{"pipe", "", "pipe"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/task", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("clientIP(%q, %q) = %q, want %q", tt.remoteAddr, tt.forwarded, got, tt.want)
+		}
+	}
+}
+
+func TestIPHash(t *testing.T) {
+	lb := NewLoadBalancer("ip-hash")
+	for i := 1; i <= 4; i++ {
+		lb.AddWorker(fmt.Sprintf("worker-%d", i), fmt.Sprintf("http://localhost:808%d", i), "#FF0000", 1)
+	}
+
+	picked := make(map[string]string)
+	for i := 0; i < 64; i++ {
+		ip := fmt.Sprintf("198.51.100.%d", i)
+		picked[ip] = lb.SelectWorkerForClient(ip).Name
+		for j := 0; j < 3; j++ {
+			if w := lb.SelectWorkerForClient(ip); w.Name != picked[ip] {
+				t.Fatalf("%s moved from %s to %s", ip, picked[ip], w.Name)
+			}
+		}
+	}
+	used := make(map[string]bool)
+	for _, name := range picked {
+		used[name] = true
+	}
+	if len(used) != 4 {
+		t.Errorf("64 clients landed on %d workers, want all 4", len(used))
+	}
+
+	// Best-effort: clients of a worker that goes down are remapped, and
+	// return to it once it is back
+	const ip = "198.51.100.1"
+	home := lb.SelectWorkerForClient(ip)
+	lb.mu.Lock()
+	home.Healthy = false
+	lb.mu.Unlock()
+	if w := lb.SelectWorkerForClient(ip); w == home {
+		t.Fatal("selected an unhealthy worker")
+	}
+	lb.mu.Lock()
+	home.Healthy = true
+	lb.mu.Unlock()
+	if w := lb.SelectWorkerForClient(ip); w != home {
+		t.Errorf("%s did not return to %s", ip, home.Name)
+	}
+}
+
+func TestIPHashTask(t *testing.T) {
+	lb = NewLoadBalancer("ip-hash")
+	for _, name := range []string{"worker-1", "worker-2", "worker-3"} {
+		lb.AddWorker(name, newDelayStub(t, name, 0).URL, "#FF0000", 1)
+	}
+	for _, ip := range []string{"203.0.113.1", "203.0.113.2", "203.0.113.3"} {
+		want := lb.SelectWorkerForClient(ip).Name
+		for i := 0; i < 3; i++ {
+			rec := doTask(map[string]string{"X-Forwarded-For": ip})
+			if got := servedBy(t, rec); got != want {
+				t.Errorf("task from %s served by %s, want %s", ip, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Per-IP rate limit. With a refill rate set (LB_RATE_LIMIT_RPS), every
+// client address has a token bucket of burst tokens (LB_RATE_LIMIT_BURST)
+// refilled at rps tokens per second, and a task finding its bucket empty is
+// answered 429 with Retry-After before handleTask sees it.
+// Clients are told apart by clientAddr, so X-Forwarded-For only counts when
+// a trusted proxy set it. The buckets are a bounded store: the cleanup sweep
+// drops those unused for ipBucketIdle, and once ipBucketCapacity addresses
+// have a bucket, new ones share ipOverflowBuckets buckets by hash. Unlike
+// the pool rate ceiling, which divides a shared budget between clients,
+// this bounds each client on its own.
+const (
+	ipBucketIdle         = 5 * time.Minute
+	ipBucketCapacity     = 10000
+	ipOverflowBuckets    = 16
+	ipRateLimited        = "ip_rate_limit"
+	ipRateLimitErrorText = "Rate limit exceeded for this client address"
+)
+
+// tokenBucket is one client address's bucket
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// ipRateLimiter holds the token bucket of every client address
+type ipRateLimiter struct {
+	// rps is the refill rate as float64 bits, 0 when the limit is off
+	rps     atomic.Uint64
+	burst   atomic.Int64
+	buckets sync.Map
+	count   atomic.Int64 // buckets of client addresses, without the overflow ones
+}
+
+func newIPRateLimiter() *ipRateLimiter {
+	return &ipRateLimiter{}
+}
+
+// configure sets the refill rate in tokens per second, 0 for no limit, and
+// the bucket size; a burst below 1 is rounded up to the rate, and to 1.
+// Buckets already handed out keep their tokens.
+func (l *ipRateLimiter) configure(rps float64, burst int) {
+	if burst < 1 {
+		burst = max(1, int(math.Ceil(rps)))
+	}
+	l.burst.Store(int64(burst))
+	l.rps.Store(math.Float64bits(rps))
+}
+
+func (l *ipRateLimiter) config() (float64, int) {
+	return math.Float64frombits(l.rps.Load()), int(l.burst.Load())
+}
+
+// allow takes a token from ip's bucket at now. When the bucket is empty it
+// returns false and how long until a token is back.
+func (l *ipRateLimiter) allow(ip string, now time.Time) (bool, time.Duration) {
+	rps, burst := l.config()
+	if rps <= 0 {
+		return true, 0
+	}
+	b := l.bucket(ip, float64(burst), now)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(float64(burst), b.tokens+elapsed.Seconds()*rps)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rps * float64(time.Second))
+}
+
+// bucket returns ip's bucket, creating it full, or the overflow bucket ip
+// hashes to once the limiter holds ipBucketCapacity addresses
+func (l *ipRateLimiter) bucket(ip string, tokens float64, now time.Time) *tokenBucket {
+	if v, ok := l.buckets.Load(ip); ok {
+		return v.(*tokenBucket)
+	}
+	key := ip
+	if l.count.Load() >= ipBucketCapacity {
+		key = ipOverflowName(ip)
+	}
+	v, loaded := l.buckets.LoadOrStore(key, &tokenBucket{tokens: tokens, last: now})
+	if !loaded && key == ip {
+		l.count.Add(1)
+	}
+	return v.(*tokenBucket)
+}
+
+// ipOverflowName returns the overflow bucket ip is accounted under
+func ipOverflowName(ip string) string {
+	h := fnv.New32a()
+	h.Write([]byte(ip))
+	return fmt.Sprintf("overflow-%02x", h.Sum32()%ipOverflowBuckets)
+}
+
+func (l *ipRateLimiter) size() int {
+	n := 0
+	l.buckets.Range(func(_, _ interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+func (l *ipRateLimiter) bounds() storeBounds {
+	return storeBounds{Capacity: ipBucketCapacity + ipOverflowBuckets, MaxAgeMs: ipBucketIdle.Milliseconds()}
+}
+
+// sweep drops the buckets unused for ipBucketIdle and returns how many
+func (l *ipRateLimiter) sweep(now time.Time) int {
+	cutoff := now.Add(-ipBucketIdle)
+	n := 0
+	l.buckets.Range(func(k, v interface{}) bool {
+		b := v.(*tokenBucket)
+		b.mu.Lock()
+		idle := b.last.Before(cutoff)
+		b.mu.Unlock()
+		if idle {
+			l.buckets.Delete(k)
+			if !strings.HasPrefix(k.(string), "overflow-") {
+				l.count.Add(-1)
+			}
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// rateLimitMiddleware answers 429 with Retry-After to a task whose client
+// address has run out of tokens, and passes the others on to next
+func rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, retry := lb.ipLimit.allow(lb.clientAddr(r), lb.clock.Now())
+		if ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		lb.metrics.ipRateLimited.Inc()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error":  ipRateLimitErrorText,
+			"reason": ipRateLimited,
+		})
+	})
+}
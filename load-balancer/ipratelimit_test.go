@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// taskFrom sends a task from ip, or through the proxy at ip on behalf of
+// the forwarded addresses
+func taskFrom(ip string, forwarded ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/task", bytes.NewBufferString(`{"id":"t","weight":1}`))
+	req.RemoteAddr = ip + ":1234"
+	for _, f := range forwarded {
+		req.Header.Add("X-Forwarded-For", f)
+	}
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestIPRateLimit(t *testing.T) {
+	clk := newFakeClock()
+	lb = NewLoadBalancer("round-robin")
+	lb.clock = clk
+	lb.AddWorker("worker-1", newDelayStub(t, "worker-1", 0).URL, "#FF0000", 1)
+	lb.ipLimit.configure(2, 3)
+
+	// The burst goes through, then the bucket is empty
+	for i := 0; i < 3; i++ {
+		if rec := taskFrom("10.0.0.1"); rec.Code != http.StatusOK {
+			t.Fatalf("task %d: status %d, want 200", i, rec.Code)
+		}
+	}
+	rec := taskFrom("10.0.0.1")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("over the burst: %d, Retry-After %q; want 429, 1", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	var body map[string]string
+	json.NewDecoder(rec.Body).Decode(&body)
+	if body["reason"] != ipRateLimited {
+		t.Errorf("body = %v, want reason %s", body, ipRateLimited)
+	}
+	if got := testutil.ToFloat64(lb.metrics.ipRateLimited); got != 1 {
+		t.Errorf("rate limited = %v, want 1", got)
+	}
+
+	// Another address has a bucket of its own
+	if rec := taskFrom("10.0.0.2"); rec.Code != http.StatusOK {
+		t.Errorf("other address: status %d, want 200", rec.Code)
+	}
+
+	// Half a second refills one token at 2/s
+	clk.Advance(500 * time.Millisecond)
+	if rec := taskFrom("10.0.0.1"); rec.Code != http.StatusOK {
+		t.Errorf("after refill: status %d, want 200", rec.Code)
+	}
+	if rec := taskFrom("10.0.0.1"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("after one refilled token: status %d, want 429", rec.Code)
+	}
+
+	// Idle buckets are swept
+	clk.Advance(2 * time.Minute)
+	taskFrom("10.0.0.2")
+	clk.Advance(4 * time.Minute)
+	if evicted := lb.Cleanup()["ipBuckets"]; evicted != 1 || lb.ipLimit.size() != 1 {
+		t.Errorf("swept %d buckets, %d left; want 1, 1", evicted, lb.ipLimit.size())
+	}
+
+	// Without a trusted proxy, rotating X-Forwarded-For draws on the sender's bucket
+	for i, ip := range []string{"203.0.113.7", "203.0.113.8", "203.0.113.9", "203.0.113.10"} {
+		want := http.StatusOK
+		if i == 3 {
+			want = http.StatusTooManyRequests
+		}
+		if rec := taskFrom("10.0.0.1", ip); rec.Code != want {
+			t.Errorf("forwarded for %s: status %d, want %d", ip, rec.Code, want)
+		}
+	}
+
+	// Off by default
+	lb.ipLimit.configure(0, 0)
+	for i := 0; i < 5; i++ {
+		if rec := taskFrom("10.0.0.1"); rec.Code != http.StatusOK {
+			t.Fatalf("limit off: status %d", rec.Code)
+		}
+	}
+}
+
+func TestIPRateLimitTrustedProxy(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.clock = newFakeClock()
+	lb.AddWorker("worker-1", newDelayStub(t, "worker-1", 0).URL, "#FF0000", 1)
+	lb.trustedProxies, _ = parseTrustedProxies("10.0.0.1")
+	lb.ipLimit.configure(1, 1)
+
+	// Clients behind the proxy have buckets of their own
+	for _, ip := range []string{"203.0.113.7", "203.0.113.8"} {
+		if rec := taskFrom("10.0.0.1", ip); rec.Code != http.StatusOK {
+			t.Errorf("%s via the proxy: status %d, want 200", ip, rec.Code)
+		}
+	}
+	if rec := taskFrom("10.0.0.1", "203.0.113.7"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("203.0.113.7 again: status %d, want 429", rec.Code)
+	}
+	// An address the client put before the proxy's does not count
+	if rec := taskFrom("10.0.0.1", "198.51.100.1, 203.0.113.7"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("spoofed hop: status %d, want 429", rec.Code)
+	}
+}
+
+func TestIPRateLimitBucketCap(t *testing.T) {
+	l := newIPRateLimiter()
+	l.configure(1, 1)
+	now := time.Now()
+	for i := 0; i < ipBucketCapacity+500; i++ {
+		l.allow(fmt.Sprintf("client-%d", i), now)
+	}
+	if n := l.size(); n != ipBucketCapacity+ipOverflowBuckets {
+		t.Errorf("%d buckets, want %d", n, ipBucketCapacity+ipOverflowBuckets)
+	}
+
+	// Sweeping makes room for addresses of their own again
+	if evicted := l.sweep(now.Add(ipBucketIdle + time.Second)); evicted != ipBucketCapacity+ipOverflowBuckets {
+		t.Errorf("swept %d", evicted)
+	}
+	if ok, _ := l.allow("client-new", now); !ok || l.count.Load() != 1 {
+		t.Errorf("after the sweep: allowed %v, %d addresses", ok, l.count.Load())
+	}
+}
+
+// BenchmarkIPRateLimitAllowed measures the middleware on a task its bucket
+// lets through; it should stay well under a microsecond
+func BenchmarkIPRateLimitAllowed(b *testing.B) {
+	lb = NewLoadBalancer("round-robin")
+	lb.ipLimit.configure(1e12, 1<<30)
+	handler := rateLimitMiddleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	req := httptest.NewRequest(http.MethodPost, "/task", nil)
+	rec := httptest.NewRecorder()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		handler.ServeHTTP(rec, req)
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	mrand "math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Request journal. Entries are queued on a buffered channel and written by a
+// single goroutine, so a slow disk never blocks a request: when the buffer
+// is full the entry is dropped and counted instead.
+const (
+	journalBufferSize      = 1024
+	defaultJournalPath     = "lb-journal.jsonl"
+	defaultJournalMaxBytes = 64 << 20
+	minJournalMaxBytes     = 1 << 10
+)
+
+// requestIDHeader carries the request ID recorded in the journal. An ID sent
+// by the client is kept, otherwise one is generated.
+const requestIDHeader = "X-Request-ID"
+
+// JournalAttempt is one forwarding attempt of a journaled request
+type JournalAttempt struct {
+	Worker    string `json:"worker"`
+	Outcome   string `json:"outcome"`
+	Status    int    `json:"status"`
+	LatencyMs int64  `json:"latencyMs"`
+	TTFBMs    int64  `json:"ttfbMs"`
+	// Headers are the ones added by the outbound header rules
+	Headers map[string]string `json:"headers,omitempty"`
+	// Retry is how the retry after this attempt was scheduled, if it was
+	// rejected and the retry policy covers the reason
+	Retry *RetryDecision `json:"retry,omitempty"`
+}
+
+// JournalLatency breaks a request's time down into the time spent in the LB
+// outside the attempts (parsing, selection, retries), in attempts and in
+// total
+type JournalLatency struct {
+	OverheadMs int64 `json:"overheadMs"`
+	UpstreamMs int64 `json:"upstreamMs"`
+	TotalMs    int64 `json:"totalMs"`
+}
+
+// JournalEntry is one line of the request journal
+type JournalEntry struct {
+	Ts        time.Time         `json:"ts"`
+	RequestID string            `json:"requestId"`
+	Worker    string            `json:"worker"`
+	Outcome   string            `json:"outcome"`
+	Status    int               `json:"status"`
+	Latency   JournalLatency    `json:"latency"`
+	Attempts  []JournalAttempt  `json:"attempts"`
+	Tags      map[string]string `json:"tags,omitempty"`
+}
+
+// JournalStatus is the body of GET /journal/status
+type JournalStatus struct {
+	Enabled      bool    `json:"enabled"`
+	Path         string  `json:"path"`
+	CurrentFile  string  `json:"currentFile"`
+	FileBytes    int64   `json:"fileBytes"`
+	BytesWritten int64   `json:"bytesWritten"`
+	Lines        int64   `json:"lines"`
+	Drops        int64   `json:"drops"`
+	Rotations    int64   `json:"rotations"`
+	Buffered     int     `json:"buffered"`
+	SampleRate   float64 `json:"sampleRate"`
+	MaxBytes     int64   `json:"maxBytes"`
+	LastError    string  `json:"lastError,omitempty"`
+}
+
+// journalConfig is the runtime configuration of the journal
+type journalConfig struct {
+	enabled    bool
+	path       string
+	maxBytes   int64
+	sampleRate float64
+}
+
+// journalOpener opens path for appending and returns its current size. Tests
+// replace it to simulate a slow disk.
+type journalOpener func(path string) (io.WriteCloser, int64, error)
+
+func openJournalFile(path string) (io.WriteCloser, int64, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+// journal writes JournalEntries as JSON lines from a dedicated goroutine,
+// started the first time the journal is enabled
+type journal struct {
+	cfg     atomic.Pointer[journalConfig]
+	entries chan JournalEntry
+	flushes chan chan struct{}
+	started atomic.Bool
+	open    journalOpener
+	metrics *lbMetrics
+
+	bytes, lines, drops, rotations atomic.Int64
+
+	// File state, owned by the writer goroutine; mu guards it for status
+	// reads
+	mu      sync.Mutex
+	file    io.WriteCloser
+	buf     *bufio.Writer
+	path    string
+	size    int64
+	lastErr string
+}
+
+func newJournal(m *lbMetrics) *journal {
+	j := &journal{
+		entries: make(chan JournalEntry, journalBufferSize),
+		flushes: make(chan chan struct{}),
+		open:    openJournalFile,
+		metrics: m,
+	}
+	j.cfg.Store(&journalConfig{path: defaultJournalPath, maxBytes: defaultJournalMaxBytes, sampleRate: 1})
+	return j
+}
+
+func (j *journal) config() journalConfig {
+	return *j.cfg.Load()
+}
+
+// configure stores cfg and starts the writer once the journal is enabled.
+// The writer switches files on its next write when the path changed.
+func (j *journal) configure(cfg journalConfig) {
+	j.cfg.Store(&cfg)
+	if cfg.enabled {
+		if j.started.CompareAndSwap(false, true) {
+			go j.run()
+		}
+	}
+}
+
+// record queues e unless the journal is disabled, e is sampled out or the
+// buffer is full. It never blocks.
+func (j *journal) record(e JournalEntry) {
+	cfg := j.cfg.Load()
+	if !cfg.enabled || (cfg.sampleRate < 1 && mrand.Float64() >= cfg.sampleRate) {
+		return
+	}
+	select {
+	case j.entries <- e:
+	default:
+		j.drops.Add(1)
+		j.metrics.journalDropped.Inc()
+	}
+}
+
+// run is the writer goroutine
+func (j *journal) run() {
+	for {
+		select {
+		case e := <-j.entries:
+			j.write(e)
+			if len(j.entries) == 0 {
+				j.flushBuffer()
+			}
+		case done := <-j.flushes:
+			for drained := false; !drained; {
+				select {
+				case e := <-j.entries:
+					j.write(e)
+				default:
+					drained = true
+				}
+			}
+			j.closeFile()
+			close(done)
+		}
+	}
+}
+
+// write appends e to the journal file, opening or rotating it first as
+// needed
+func (j *journal) write(e JournalEntry) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		j.fail(err)
+		return
+	}
+	line = append(line, '\n')
+	cfg := j.config()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file != nil && j.path != cfg.path {
+		j.closeFileLocked()
+	}
+	if j.file != nil && j.size > 0 && j.size+int64(len(line)) > cfg.maxBytes {
+		j.closeFileLocked()
+		if err := os.Rename(cfg.path, cfg.path+".1"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			j.failLocked(err)
+		}
+		j.rotations.Add(1)
+	}
+	if j.file == nil {
+		f, size, err := j.open(cfg.path)
+		if err != nil {
+			j.failLocked(err)
+			return
+		}
+		j.file, j.buf, j.path, j.size = f, bufio.NewWriter(f), cfg.path, size
+	}
+	n, err := j.buf.Write(line)
+	j.size += int64(n)
+	j.bytes.Add(int64(n))
+	j.metrics.journalBytes.Add(float64(n))
+	if err != nil {
+		j.failLocked(err)
+		return
+	}
+	j.lines.Add(1)
+	j.metrics.journalLines.Inc()
+}
+
+func (j *journal) flushBuffer() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.buf != nil {
+		if err := j.buf.Flush(); err != nil {
+			j.failLocked(err)
+		}
+	}
+}
+
+func (j *journal) closeFile() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.closeFileLocked()
+}
+
+func (j *journal) closeFileLocked() {
+	if j.file == nil {
+		return
+	}
+	if err := j.buf.Flush(); err != nil {
+		j.failLocked(err)
+	}
+	if err := j.file.Close(); err != nil {
+		j.failLocked(err)
+	}
+	j.file, j.buf, j.path, j.size = nil, nil, "", 0
+}
+
+func (j *journal) fail(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.failLocked(err)
+}
+
+func (j *journal) failLocked(err error) {
+	if j.lastErr != err.Error() {
+		log.Printf("Journal: %v", err)
+	}
+	j.lastErr = err.Error()
+}
+
+// Flush writes every queued entry and closes the journal file; the next
+// entry reopens it. It returns ctx's error if the writer does not finish in
+// time, and nil at once if the writer was never started.
+func (j *journal) Flush(ctx context.Context) error {
+	if !j.started.Load() {
+		return nil
+	}
+	done := make(chan struct{})
+	select {
+	case j.flushes <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Status reports the journal's configuration and counters
+func (j *journal) Status() JournalStatus {
+	cfg := j.config()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return JournalStatus{
+		Enabled:      cfg.enabled,
+		Path:         cfg.path,
+		CurrentFile:  j.path,
+		FileBytes:    j.size,
+		BytesWritten: j.bytes.Load(),
+		Lines:        j.lines.Load(),
+		Drops:        j.drops.Load(),
+		Rotations:    j.rotations.Load(),
+		Buffered:     len(j.entries),
+		SampleRate:   cfg.sampleRate,
+		MaxBytes:     cfg.maxBytes,
+		LastError:    j.lastErr,
+	}
+}
+
+// newRequestID returns a random 16 character hex ID
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// attemptLog collects the forwarding attempts of one request
+type attemptLog struct {
+	requestID string
+	attempts  []JournalAttempt
+}
+
+type attemptLogKey struct{}
+
+// withAttemptLog returns ctx carrying l, which forwardTo appends to
+func withAttemptLog(ctx context.Context, l *attemptLog) context.Context {
+	return context.WithValue(ctx, attemptLogKey{}, l)
+}
+
+// recordAttempt appends an attempt to the log carried by ctx, if any
+func recordAttempt(ctx context.Context, a JournalAttempt) {
+	if l, ok := ctx.Value(attemptLogKey{}).(*attemptLog); ok {
+		l.attempts = append(l.attempts, a)
+	}
+}
+
+// priorAttempts returns how many attempts the log carried by ctx holds, which
+// while forwarding is the number of retries before the current attempt
+func priorAttempts(ctx context.Context) int {
+	if l, ok := ctx.Value(attemptLogKey{}).(*attemptLog); ok {
+		return len(l.attempts)
+	}
+	return 0
+}
+
+// attemptOutcome classifies the result of forwarding a task
+func attemptOutcome(code int, err error) string {
+	var rej *workerRejection
+	var malformed *malformedResponse
+	switch {
+	case err == nil:
+		return "success"
+	case errors.As(err, &rej):
+		return "rejected"
+	case errors.As(err, &malformed):
+		return malformedOutcome
+	case code == http.StatusGatewayTimeout:
+		return "timeout"
+	case code == statusClientClosedRequest:
+		return "cancelled"
+	default:
+		return "error"
+	}
+}
+
+// journalRequest records a completed proxied task
+func (lb *LoadBalancer) journalRequest(id string, received time.Time, tags map[string]string, attempts *attemptLog, code int, err error) {
+	done := time.Now()
+	e := JournalEntry{
+		Ts:        done.UTC(),
+		RequestID: id,
+		Outcome:   attemptOutcome(code, err),
+		Status:    code,
+		Attempts:  attempts.attempts,
+		Tags:      tags,
+		Latency:   JournalLatency{TotalMs: done.Sub(received).Milliseconds()},
+	}
+	if e.Attempts == nil {
+		e.Attempts = []JournalAttempt{}
+	}
+	if n := len(e.Attempts); n > 0 {
+		e.Worker = e.Attempts[n-1].Worker
+		for _, a := range e.Attempts {
+			e.Latency.UpstreamMs += a.LatencyMs
+		}
+		e.Latency.OverheadMs = max(e.Latency.TotalMs-e.Latency.UpstreamMs, 0)
+	}
+	lb.journal.record(e)
+}
+
+// handleJournalStatus はリクエストジャーナルの状態 (書き込みバイト数、ドロップ数、現在のファイルなど) を返す HTTP ハンドラです。
+func handleJournalStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lb.journal.Status())
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// enableJournal turns the journal on through the settings endpoint
+func enableJournal(t *testing.T, body string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleSettings(rec, httptest.NewRequest(http.MethodPut, "/settings", bytes.NewBufferString(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("settings: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func readJournal(t *testing.T, path string) []JournalEntry {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []JournalEntry
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e JournalEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("line %q: %v", sc.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestJournalLineFormat(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer ok.Close()
+	rejecter := newRejectingWorker(t, rejectQueueFull, false)
+
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("rejecter", rejecter.URL, "#FF0000", 1)
+	lb.AddWorker("worker-2", ok.URL, "#00FF00", 1)
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	enableJournal(t, `{"journalEnabled":true,"journalPath":"`+path+`"}`)
+
+	// The first task is rejected by "rejecter" and retried on worker-2
+	first := doTask(map[string]string{requestIDHeader: "req-1"})
+	second := doTask(nil)
+	if first.Code != http.StatusOK || second.Code != http.StatusOK {
+		t.Fatalf("status codes = %d, %d", first.Code, second.Code)
+	}
+	if err := lb.journal.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := readJournal(t, path)
+	if len(entries) != 2 {
+		t.Fatalf("lines = %d, want 2", len(entries))
+	}
+	e := entries[0]
+	if e.RequestID != "req-1" || e.Worker != "worker-2" || e.Outcome != "success" || e.Status != http.StatusOK || e.Ts.IsZero() {
+		t.Errorf("entry = %+v", e)
+	}
+	if len(e.Attempts) != 2 || e.Attempts[0].Worker != "rejecter" || e.Attempts[0].Outcome != "rejected" || e.Attempts[1].Outcome != "success" {
+		t.Errorf("attempts = %+v, want a rejection then a success", e.Attempts)
+	}
+	if l := e.Latency; l.TotalMs < l.UpstreamMs || l.OverheadMs != l.TotalMs-l.UpstreamMs {
+		t.Errorf("latency = %+v", l)
+	}
+	if id := second.Header().Get(requestIDHeader); id == "" || entries[1].RequestID != id {
+		t.Errorf("generated request id %q, journaled %q", id, entries[1].RequestID)
+	}
+
+	status := lb.journal.Status()
+	if status.Lines != 2 || status.BytesWritten == 0 || status.Drops != 0 {
+		t.Errorf("status = %+v", status)
+	}
+}
+
+func TestJournalRotation(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	enableJournal(t, `{"journalEnabled":true,"journalPath":"`+path+`","journalMaxBytes":1024}`)
+
+	for i := 0; i < 30; i++ {
+		lb.journal.record(JournalEntry{RequestID: strings.Repeat("x", 64), Outcome: "success", Attempts: []JournalAttempt{}})
+	}
+	if err := lb.journal.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	total := len(readJournal(t, path)) + len(readJournal(t, path+".1"))
+	for _, p := range []string{path, path + ".1"} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 1024 {
+			t.Errorf("%s is %d bytes, want at most 1024", p, info.Size())
+		}
+	}
+	status := lb.journal.Status()
+	if status.Rotations == 0 || status.Lines != 30 {
+		t.Errorf("status = %+v, want rotations and 30 lines", status)
+	}
+	if total == 0 || total > 30 {
+		t.Errorf("lines kept = %d", total)
+	}
+}
+
+// slowWriter simulates a slow disk
+type slowWriter struct {
+	delay  time.Duration
+	writes int32
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	atomic.AddInt32(&w.writes, 1)
+	return len(p), nil
+}
+
+func (w *slowWriter) Close() error { return nil }
+
+func TestJournalNeverBlocks(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	disk := &slowWriter{delay: 5 * time.Millisecond}
+	lb.journal.open = func(string) (io.WriteCloser, int64, error) { return disk, 0, nil }
+	enableJournal(t, `{"journalEnabled":true}`)
+
+	const n = 5000
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		lb.journal.record(JournalEntry{RequestID: strings.Repeat("x", 200)})
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("recording %d entries took %v; the request path must not wait for the disk", n, elapsed)
+	}
+	status := lb.journal.Status()
+	if status.Drops == 0 {
+		t.Error("a full buffer should drop entries")
+	}
+	if err := lb.journal.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if status := lb.journal.Status(); status.Lines+status.Drops != n {
+		t.Errorf("lines %d + drops %d, want %d", status.Lines, status.Drops, n)
+	}
+}
+
+func TestJournalFlushAndSampling(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	enableJournal(t, `{"journalEnabled":true,"journalPath":"`+path+`"}`)
+	for i := 0; i < 100; i++ {
+		lb.journal.record(JournalEntry{RequestID: "r"})
+	}
+	// Flush writes every queued entry, as on shutdown
+	if err := lb.journal.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(readJournal(t, path)); got != 100 {
+		t.Errorf("lines after flush = %d, want 100", got)
+	}
+
+	enableJournal(t, `{"journalSampleRate":0}`)
+	lb.journal.record(JournalEntry{RequestID: "r"})
+	lb.journal.Flush(context.Background())
+	if got := len(readJournal(t, path)); got != 100 {
+		t.Errorf("lines = %d, want nothing sampled at rate 0", got)
+	}
+
+	rec := httptest.NewRecorder()
+	handleSettings(rec, httptest.NewRequest(http.MethodPut, "/settings", bytes.NewBufferString(`{"journalSampleRate":1.5}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("sample rate 1.5: status code = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	rec = httptest.NewRecorder()
+	newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/journal/status", nil))
+	var status JournalStatus
+	json.NewDecoder(rec.Body).Decode(&status)
+	if !status.Enabled || status.Path != path || status.Lines != 100 {
+		t.Errorf("status = %+v", status)
+	}
+}
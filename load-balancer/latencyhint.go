@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// maxLatencyHeader restricts selection to workers expected to answer within
+// the given number of milliseconds
+const maxLatencyHeader = "X-LB-Max-Latency-Ms"
+
+// latencyAlpha is the weight of a new sample in a worker's observed latency
+const latencyAlpha = 0.3
+
+// latencyEstimate tracks how fast a worker is expected to answer. advertised
+// is the expectedLatencyMs of its last /health body, 0 if it sent none.
+// observed is an exponentially weighted mean of the tasks it served, seeded
+// with the advertised latency until it has served one, so latency-aware
+// decisions have a prior from the first health check on. fresh counts the
+// samples since the worker last recovered; see restart.
+type latencyEstimate struct {
+	mu         sync.Mutex
+	advertised int64
+	observed   float64
+	samples    int64
+	fresh      int64
+}
+
+// advertise records the latency a worker advertised in a health check
+func (l *latencyEstimate) advertise(ms int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.advertised = ms
+	if l.samples == 0 {
+		l.observed = float64(ms)
+	}
+}
+
+// observe records the latency of a task the worker served and returns the
+// observed latency
+func (l *latencyEstimate) observe(latency time.Duration) float64 {
+	ms := float64(latency) / float64(time.Millisecond)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.samples == 0 || l.fresh == 0 {
+		l.observed = ms
+	} else {
+		l.observed += latencyAlpha * (ms - l.observed)
+	}
+	l.samples++
+	l.fresh++
+	return l.observed
+}
+
+// restart makes the next sample replace the observed latency, when the
+// worker comes back from being down and what was observed before is stale
+func (l *latencyEstimate) restart() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.fresh = 0
+}
+
+// ewma returns the observed latency and the number of samples it has
+// taken since the worker last recovered
+func (l *latencyEstimate) ewma() (ms float64, fresh int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.observed, l.fresh
+}
+
+// snapshot returns the advertised latency, the expected one and whether
+// there is any estimate at all
+func (l *latencyEstimate) snapshot() (advertised int64, expected float64, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.advertised, l.observed, l.samples > 0 || l.advertised > 0
+}
+
+// fits reports whether both the advertised and the observed latency are
+// within bound. A worker with no estimate yet fits any bound.
+func (l *latencyEstimate) fits(bound time.Duration) bool {
+	advertised, expected, ok := l.snapshot()
+	if !ok {
+		return true
+	}
+	ms := float64(bound) / float64(time.Millisecond)
+	return float64(advertised) <= ms && expected <= ms
+}
+
+// advertisedLatency returns the expectedLatencyMs of a worker's /health body,
+// or 0 if it has none
+func advertisedLatency(body []byte) int64 {
+	var h struct {
+		ExpectedLatencyMs float64 `json:"expectedLatencyMs"`
+	}
+	if json.Unmarshal(body, &h) != nil || h.ExpectedLatencyMs < 0 {
+		return 0
+	}
+	return int64(h.ExpectedLatencyMs)
+}
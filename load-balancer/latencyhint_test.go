@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// newHintWorker serves a /health body advertising expectedLatencyMs and
+// answers tasks right away
+func newHintWorker(t *testing.T, name string, expectedLatencyMs int64) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			json.NewEncoder(w).Encode(map[string]interface{}{"status": "healthy", "expectedLatencyMs": expectedLatencyMs})
+		case "/task":
+			json.NewEncoder(w).Encode(map[string]interface{}{"worker": name})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestMaxLatencyFilter(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("fast", newHintWorker(t, "fast", 50).URL, "#FF0000", 1)
+	lb.AddWorker("medium", newHintWorker(t, "medium", 150).URL, "#00FF00", 1)
+	lb.AddWorker("slow", newHintWorker(t, "slow", 400).URL, "#0000FF", 1)
+	lb.AddWorker("silent", newHintWorker(t, "silent", 0).URL, "#FFFF00", 1)
+	lb.HealthCheckNow()
+
+	served := map[string]int{}
+	for i := 0; i < 8; i++ {
+		rec := doTask(map[string]string{maxLatencyHeader: "200"})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", rec.Code)
+		}
+		served[servedBy(t, rec)]++
+	}
+	if served["slow"] != 0 || served["fast"] == 0 || served["medium"] == 0 || served["silent"] == 0 {
+		t.Errorf("served = %v, want every worker but slow", served)
+	}
+
+	// A worker slower than it advertises is excluded on what was observed
+	for i := 0; i < 5; i++ {
+		lb.workers[1].latency.observe(300 * time.Millisecond)
+		lb.workers[3].latency.observe(500 * time.Millisecond)
+	}
+	rec := doTask(map[string]string{maxLatencyHeader: "40"})
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", rec.Code)
+	}
+	var resp api.ErrorResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	for _, name := range []string{"fast", "medium", "slow", "silent"} {
+		if resp.Excluded[name] != excludedLatency {
+			t.Errorf("%s excluded as %q, want %s", name, resp.Excluded[name], excludedLatency)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if rec := doTask(map[string]string{maxLatencyHeader: "200"}); servedBy(t, rec) != "fast" {
+			t.Fatalf("bound 200 after the observations was not served by fast")
+		}
+	}
+
+	for _, raw := range []string{"0", "-5", "soon"} {
+		if rec := doTask(map[string]string{maxLatencyHeader: raw}); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s %q: %d, want 400", maxLatencyHeader, raw, rec.Code)
+		}
+	}
+}
+
+func TestAdvertisedLatencySeedsEstimates(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", newHintWorker(t, "worker-1", 80).URL, "#FF0000", 1)
+	lb.HealthCheckNow()
+
+	w := lb.workers[0]
+	if advertised, expected, ok := w.latency.snapshot(); !ok || advertised != 80 || expected != 80 {
+		t.Errorf("before any task: advertised %d, expected %v, want both 80", advertised, expected)
+	}
+
+	// Capacity falls back to the advertised latency with no samples, and
+	// to maxLoad for the concurrency since the stub has no /config
+	wc := capacityOf(lb.Capacity(), "worker-1")
+	if wc.LatencySource != latencyAdvertised || math.Abs(wc.EstimatedRps-3*1000.0/80) > 1e-9 {
+		t.Errorf("capacity = %+v, want advertised latency and 37.5 rps", wc)
+	}
+
+	// The first sample replaces the prior; later ones move it gradually
+	w.latency.observe(20 * time.Millisecond)
+	w.latency.observe(120 * time.Millisecond)
+	if _, expected, _ := w.latency.snapshot(); math.Abs(expected-50) > 1e-9 {
+		t.Errorf("expected latency after samples = %v, want 50", expected)
+	}
+	lb.HealthCheckNow()
+	if _, expected, _ := w.latency.snapshot(); math.Abs(expected-50) > 1e-9 {
+		t.Errorf("health check reset the observed latency to %v", expected)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import "sync/atomic"
+
+// The least-latency algorithm picks the candidate with the lowest observed
+// latency (the exponentially weighted mean of the tasks it served, see
+// latencyEstimate), the one with fewer tasks in flight on a tie. A worker
+// that has served fewer than leastLatencyWarmup tasks since it joined the
+// pool or last recovered is still warming up: it is picked first, with no
+// more tasks in flight than it still needs, so a new worker gets an
+// estimate of its own instead of starving behind the measured ones and a
+// recovered one replaces the estimate it had before it went down.
+const leastLatencyWarmup = 3
+
+// warmingUp reports whether w still needs warm-up tasks beyond those it
+// has in flight
+func (w *Worker) warmingUp() bool {
+	_, fresh := w.latency.ewma()
+	return fresh+int64(atomic.LoadInt32(&w.CurrentLoad)) < leastLatencyWarmup
+}
+
+func (lb *LoadBalancer) leastLatency(workers []*Worker) *Worker {
+	var cold *Worker
+	for _, w := range workers {
+		if w.warmingUp() && (cold == nil || atomic.LoadInt32(&w.CurrentLoad) < atomic.LoadInt32(&cold.CurrentLoad)) {
+			cold = w
+		}
+	}
+	if cold != nil {
+		return cold
+	}
+
+	best := workers[0]
+	bestMs, _ := best.latency.ewma()
+	for _, w := range workers[1:] {
+		ms, _ := w.latency.ewma()
+		if ms < bestMs || (ms == bestMs && atomic.LoadInt32(&w.CurrentLoad) < atomic.LoadInt32(&best.CurrentLoad)) {
+			best, bestMs = w, ms
+		}
+	}
+	return best
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLeastLatencyShiftsToFasterWorker(t *testing.T) {
+	lb = NewLoadBalancer("least-latency")
+	lb.AddWorker("worker-slow", newDelayStub(t, "worker-slow", 60*time.Millisecond).URL, "#FF0000", 1)
+	lb.AddWorker("worker-fast", newDelayStub(t, "worker-fast", 5*time.Millisecond).URL, "#00FF00", 1)
+	slow, fast := lb.workers[0], lb.workers[1]
+	served := func() (int64, int64) {
+		return atomic.LoadInt64(&slow.TotalRequests), atomic.LoadInt64(&fast.TotalRequests)
+	}
+
+	// Both warm up on their first tasks, then the faster one takes the rest
+	for i := 0; i < 20; i++ {
+		if rec := doTask(nil); rec.Code != http.StatusOK {
+			t.Fatalf("task %d: status %d", i, rec.Code)
+		}
+	}
+	if s, f := served(); s != leastLatencyWarmup || f != 20-leastLatencyWarmup {
+		t.Fatalf("served slow %d, fast %d; want the slow one only its %d warm-up tasks", s, f, leastLatencyWarmup)
+	}
+
+	status, _ := lb.WorkerStatus("worker-slow")
+	if status.LatencyEWMAMs < 60 {
+		t.Errorf("slow latencyEwmaMs = %v, want at least 60", status.LatencyEWMAMs)
+	}
+	workers := lb.GetStatus()["workers"].([]map[string]interface{})
+	if ms, _ := workers[1]["latencyEwmaMs"].(float64); ms <= 0 || ms >= status.LatencyEWMAMs {
+		t.Errorf("fast latencyEwmaMs = %v, want below the slow one's %v", workers[1]["latencyEwmaMs"], status.LatencyEWMAMs)
+	}
+	if got := testutil.ToFloat64(lb.metrics.workerLatencyEWMA.WithLabelValues("worker-slow")); got != status.LatencyEWMAMs {
+		t.Errorf("gauge = %v, want %v", got, status.LatencyEWMAMs)
+	}
+
+	// A worker that recovers warms up again before it is judged
+	lb.mu.Lock()
+	slow.Healthy = false
+	lb.mu.Unlock()
+	lb.checkWorker(slow)
+	for i := 0; i < 5; i++ {
+		doTask(nil)
+	}
+	if s, f := served(); s != 2*leastLatencyWarmup || f != 22-leastLatencyWarmup {
+		t.Errorf("after recovery: served slow %d, fast %d", s, f)
+	}
+}
+
+func TestLeastLatencyTieBreaksOnLoad(t *testing.T) {
+	lb = NewLoadBalancer("least-latency")
+	for _, name := range []string{"worker-1", "worker-2"} {
+		lb.AddWorker(name, "http://localhost:0", "#FF0000", 1)
+	}
+	for _, w := range lb.workers {
+		for i := 0; i < leastLatencyWarmup; i++ {
+			w.latency.observe(20 * time.Millisecond)
+		}
+	}
+	atomic.StoreInt32(&lb.workers[0].CurrentLoad, 2)
+	if w := lb.SelectWorker(); w.Name != "worker-2" {
+		t.Errorf("picked %s, want the less loaded worker-2", w.Name)
+	}
+}
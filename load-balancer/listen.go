@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// listenAddrsEnvVar lists the addresses the LB listens on, comma separated,
+// e.g. 0.0.0.0:8000,[::]:8000. Repeated --listen flags take precedence; with
+// neither the LB listens on :PORT.
+const listenAddrsEnvVar = "LISTEN_ADDRS"
+
+// listenFlags collects repeated --listen flags
+type listenFlags []string
+
+func (f *listenFlags) String() string { return strings.Join(*f, ",") }
+
+func (f *listenFlags) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// resolveListenAddrs returns the addresses to listen on from the --listen
+// flags, LISTEN_ADDRS or PORT, in that order of precedence. Every address
+// must be host:port with IPv6 hosts in brackets; an empty host listens on all
+// interfaces.
+func resolveListenAddrs(flags []string, env, port string) ([]string, error) {
+	addrs := flags
+	if len(addrs) == 0 && strings.TrimSpace(env) != "" {
+		addrs = strings.Split(env, ",")
+	}
+	if len(addrs) == 0 {
+		addrs = []string{":" + port}
+	}
+
+	out := make([]string, 0, len(addrs))
+	seen := make(map[string]bool, len(addrs))
+	for _, a := range addrs {
+		a = strings.TrimSpace(a)
+		if _, p, err := net.SplitHostPort(a); err != nil {
+			return nil, fmt.Errorf("invalid listen address %q: %v", a, err)
+		} else if p == "" {
+			return nil, fmt.Errorf("invalid listen address %q: missing port", a)
+		}
+		if seen[a] {
+			return nil, fmt.Errorf("duplicate listen address %q", a)
+		}
+		seen[a] = true
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+// listenerGroup serves one handler on several addresses, with an
+// http.Server per address
+type listenerGroup struct {
+	servers   []*http.Server
+	listeners []net.Listener
+}
+
+// listenAll binds every address. If any of them cannot be bound the ones
+// already bound are closed and the error is returned.
+func listenAll(addrs []string, handler http.Handler) (*listenerGroup, error) {
+	g := &listenerGroup{}
+	for _, addr := range addrs {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, bound := range g.listeners {
+				bound.Close()
+			}
+			return nil, fmt.Errorf("listen on %s: %w", addr, err)
+		}
+		g.listeners = append(g.listeners, ln)
+		g.servers = append(g.servers, &http.Server{Addr: addr, Handler: handler})
+	}
+	return g, nil
+}
+
+// Addrs returns the bound addresses, with ephemeral ports resolved
+func (g *listenerGroup) Addrs() []string {
+	out := make([]string, len(g.listeners))
+	for i, ln := range g.listeners {
+		out[i] = ln.Addr().String()
+	}
+	return out
+}
+
+// Serve serves every listener and returns once all servers have stopped. If
+// one fails the others are closed and its error is returned; after Shutdown
+// it returns nil.
+func (g *listenerGroup) Serve() error {
+	errs := make(chan error, len(g.servers))
+	for i, srv := range g.servers {
+		go func(srv *http.Server, ln net.Listener) {
+			errs <- srv.Serve(ln)
+		}(srv, g.listeners[i])
+	}
+	var first error
+	for range g.servers {
+		if err := <-errs; err != nil && !errors.Is(err, http.ErrServerClosed) && first == nil {
+			first = err
+			for _, srv := range g.servers {
+				srv.Close()
+			}
+		}
+	}
+	return first
+}
+
+// Shutdown gracefully shuts every server down concurrently and returns their
+// errors joined
+func (g *listenerGroup) Shutdown(ctx context.Context) error {
+	errs := make([]error, len(g.servers))
+	var wg sync.WaitGroup
+	for i, srv := range g.servers {
+		wg.Add(1)
+		go func(i int, srv *http.Server) {
+			defer wg.Done()
+			errs[i] = srv.Shutdown(ctx)
+		}(i, srv)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// setListenAddrs records the bound addresses for /status
+func (lb *LoadBalancer) setListenAddrs(addrs []string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.listenAddrs = addrs
+}
+
+// validateWorkerURL checks that raw is an absolute http(s) URL. IPv6 literal
+// hosts must be bracketed (http://[::1]:8081), as in any URL.
+func validateWorkerURL(raw string) error {
+	if _, rest, ok := strings.Cut(raw, "://"); ok {
+		host, _, _ := strings.Cut(rest, "/")
+		if strings.Count(host, ":") > 1 && !strings.HasPrefix(host, "[") {
+			return fmt.Errorf("url must put an IPv6 host in brackets (http://[::1]:8081), got %q", raw)
+		}
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an absolute http(s) URL, got %q", raw)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// skipWithoutIPv6 skips the test when the host cannot bind ::1
+func skipWithoutIPv6(t *testing.T) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	ln.Close()
+}
+
+func TestResolveListenAddrs(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags []string
+		env   string
+		want  string
+		err   string
+	}{
+		{"port", nil, "", ":8000", ""},
+		{"env", nil, "0.0.0.0:8000, [::]:8000", "0.0.0.0:8000,[::]:8000", ""},
+		{"flags win", []string{"127.0.0.1:9000", "[::1]:9000"}, "0.0.0.0:8000", "127.0.0.1:9000,[::1]:9000", ""},
+		{"unbracketed ipv6", nil, "::1:8000", "", "too many colons"},
+		{"missing port", nil, "127.0.0.1", "", "missing port"},
+		{"empty port", nil, "127.0.0.1:", "", "missing port"},
+		{"duplicate", []string{":9000", ":9000"}, "", "", `duplicate listen address ":9000"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveListenAddrs(tt.flags, tt.env, "8000")
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || strings.Join(got, ",") != tt.want {
+				t.Errorf("addrs = %v, %v; want %s", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestListenAllDualStack(t *testing.T) {
+	skipWithoutIPv6(t)
+	lb = NewLoadBalancer("round-robin")
+
+	g, err := listenAll([]string{"127.0.0.1:0", "[::1]:0"}, newMux())
+	if err != nil {
+		t.Fatalf("listenAll: %v", err)
+	}
+	lb.setListenAddrs(g.Addrs())
+	served := make(chan error, 1)
+	go func() { served <- g.Serve() }()
+
+	addrs := g.Addrs()
+	if !strings.HasPrefix(addrs[0], "127.0.0.1:") || !strings.HasPrefix(addrs[1], "[::1]:") {
+		t.Fatalf("addrs = %v", addrs)
+	}
+	for _, addr := range addrs {
+		resp, err := http.Get("http://" + addr + "/status")
+		if err != nil {
+			t.Fatalf("GET %s: %v", addr, err)
+		}
+		var status struct {
+			ListenAddrs []string `json:"listenAddrs"`
+		}
+		json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if strings.Join(status.ListenAddrs, ",") != strings.Join(addrs, ",") {
+			t.Errorf("status listenAddrs = %v, want %v", status.ListenAddrs, addrs)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := g.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Serve = %v, want nil after Shutdown", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after Shutdown")
+	}
+	for _, addr := range addrs {
+		if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+			conn.Close()
+			t.Errorf("%s still accepts connections after Shutdown", addr)
+		}
+	}
+}
+
+func TestListenAllBindFailureReleasesOthers(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	freeAddr := free.Addr().String()
+	free.Close()
+
+	if _, err := listenAll([]string{freeAddr, busy.Addr().String()}, http.NotFoundHandler()); err == nil {
+		t.Fatal("listenAll should fail when an address is in use")
+	}
+	ln, err := net.Listen("tcp", freeAddr)
+	if err != nil {
+		t.Fatalf("%s was not released after the failed start: %v", freeAddr, err)
+	}
+	ln.Close()
+}
+
+func TestIPv6WorkerURL(t *testing.T) {
+	skipWithoutIPv6(t)
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/health" {
+			io.WriteString(w, `{"status":"healthy"}`)
+			return
+		}
+		io.WriteString(w, `{"ok":true}`)
+	}))
+	srv.Listener.Close()
+	srv.Listener = ln
+	srv.Start()
+	defer srv.Close()
+	if !strings.HasPrefix(srv.URL, "http://[::1]:") {
+		t.Fatalf("server URL = %s", srv.URL)
+	}
+
+	lb = NewLoadBalancer("round-robin")
+	lb.healthFall = 1
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+	w := lb.workers[0]
+	lb.checkWorker(w)
+	if !w.Healthy {
+		t.Errorf("health check of %s failed: %s", srv.URL, w.healthReason)
+	}
+	if _, code, err := lb.ForwardRequest(TaskRequest{Weight: 1}); err != nil {
+		t.Errorf("forwarding to %s: %d %v", srv.URL, code, err)
+	}
+
+	if err := validateWorkerURL(srv.URL); err != nil {
+		t.Errorf("validateWorkerURL(%s) = %v", srv.URL, err)
+	}
+	if err := validateWorkerURL("http://::1:8081"); err == nil || !strings.Contains(err.Error(), "brackets") {
+		t.Errorf("unbracketed IPv6 URL: err = %v", err)
+	}
+}
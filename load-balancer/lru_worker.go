@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// LRU worker switch criteria
+const (
+	lruSwitchLoad = "load"
+	lruSwitchTime = "time"
+	lruSwitchBoth = "both"
+)
+
+// LRU worker ordering
+const (
+	lruOrderWeight = "weight"
+	lruOrderPool   = "pool"
+)
+
+// LRUWorkerConfig controls how long the lru-worker algorithm concentrates
+// traffic on a single worker before moving on
+type LRUWorkerConfig struct {
+	// LoadThreshold is the fraction of MaxLoad at which the hot worker is
+	// considered saturated
+	LoadThreshold float64 `json:"loadThreshold"`
+	// WindowMs is how long a worker stays hot before traffic moves on
+	WindowMs int64 `json:"windowMs"`
+	// SwitchOn selects the criteria that end a concentration run
+	SwitchOn string `json:"switchOn"`
+	// Order is the order in which workers take turns being hot
+	Order string `json:"order"`
+}
+
+// lruWorkerState tracks the currently hot worker
+type lruWorkerState struct {
+	config LRUWorkerConfig
+	hot    string
+	since  time.Time
+	reason string
+}
+
+func defaultLRUWorkerConfig() LRUWorkerConfig {
+	threshold, err := strconv.ParseFloat(getEnv("LB_LRU_LOAD_THRESHOLD", "0.8"), 64)
+	if err != nil {
+		threshold = 0.8
+	}
+	window, err := strconv.ParseInt(getEnv("LB_LRU_WINDOW_MS", "10000"), 10, 64)
+	if err != nil {
+		window = 10000
+	}
+	cfg := LRUWorkerConfig{
+		LoadThreshold: threshold,
+		WindowMs:      window,
+		SwitchOn:      getEnv("LB_LRU_SWITCH_ON", lruSwitchBoth),
+		Order:         getEnv("LB_LRU_ORDER", lruOrderWeight),
+	}
+	if cfg.Validate() != "" {
+		return LRUWorkerConfig{LoadThreshold: 0.8, WindowMs: 10000, SwitchOn: lruSwitchBoth, Order: lruOrderWeight}
+	}
+	return cfg
+}
+
+// Validate returns a description of the first invalid field, or ""
+func (c LRUWorkerConfig) Validate() string {
+	switch {
+	case c.LoadThreshold <= 0 || c.LoadThreshold > 1:
+		return "loadThreshold must be in (0, 1]"
+	case c.WindowMs <= 0:
+		return "windowMs must be positive"
+	case c.SwitchOn != lruSwitchLoad && c.SwitchOn != lruSwitchTime && c.SwitchOn != lruSwitchBoth:
+		return "switchOn must be one of load, time, both"
+	case c.Order != lruOrderWeight && c.Order != lruOrderPool:
+		return "order must be one of weight, pool"
+	}
+	return ""
+}
+
+// atLoadThreshold reports whether the worker is approaching its MaxLoad
+func (c LRUWorkerConfig) atLoadThreshold(w *Worker) bool {
+	if w.MaxLoad <= 0 {
+		return false
+	}
+	limit := int32(math.Ceil(c.LoadThreshold * float64(w.MaxLoad)))
+	return atomic.LoadInt32(&w.CurrentLoad) >= limit
+}
+
+// lruWorker keeps routing to the hot worker until it approaches MaxLoad or its
+// concentration window expires, then hands over to the next worker in order.
+// Must be called with lb.mu held.
+func (lb *LoadBalancer) lruWorker(workers []*Worker) *Worker {
+	st := &lb.lru
+	cfg := st.config
+
+	workers = lb.withSaturatedHotLocked(workers)
+	ordered := make([]*Worker, len(workers))
+	copy(ordered, workers)
+	if cfg.Order == lruOrderWeight {
+		sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].Weight > ordered[j].Weight })
+	}
+
+	hotIdx := -1
+	for i, w := range ordered {
+		if w.Name == st.hot {
+			hotIdx = i
+			break
+		}
+	}
+
+	now := time.Now()
+	if hotIdx < 0 {
+		reason := "initial"
+		if st.hot != "" {
+			reason = "previous worker " + st.hot + " ineligible"
+		}
+		return lb.lruActivate(ordered, 0, now, reason)
+	}
+
+	hot := ordered[hotIdx]
+	loadHit := cfg.SwitchOn != lruSwitchTime && cfg.atLoadThreshold(hot)
+	timeHit := cfg.SwitchOn != lruSwitchLoad && now.Sub(st.since) >= time.Duration(cfg.WindowMs)*time.Millisecond
+	switch {
+	case loadHit:
+		return lb.lruActivate(ordered, hotIdx+1, now, "load threshold reached on "+hot.Name)
+	case timeHit:
+		return lb.lruActivate(ordered, hotIdx+1, now, "concentration window expired on "+hot.Name)
+	case hot.saturated():
+		return lb.lruActivate(ordered, hotIdx+1, now, "maximum load reached on "+hot.Name)
+	}
+	return hot
+}
+
+// withSaturatedHotLocked returns the candidates with the hot worker put back
+// at its pool position when only its load kept it out, so the hand-over
+// continues after it rather than from the start. Must be called with lb.mu
+// held.
+func (lb *LoadBalancer) withSaturatedHotLocked(workers []*Worker) []*Worker {
+	hot := lb.findWorkerLocked(lb.lru.hot)
+	if hot == nil || slices.Contains(workers, hot) || lb.exclusionReasonLocked(hot, routeHints{}) != excludedSaturated {
+		return workers
+	}
+	out := make([]*Worker, 0, len(workers)+1)
+	i := 0
+	for _, w := range lb.workers {
+		switch {
+		case w == hot:
+			out = append(out, w)
+		case i < len(workers) && workers[i] == w:
+			out = append(out, w)
+			i++
+		}
+	}
+	return out
+}
+
+// lruActivate makes the first worker at or after start (wrapping around) that
+// is below its load threshold the hot worker. Must be called with lb.mu held.
+func (lb *LoadBalancer) lruActivate(ordered []*Worker, start int, now time.Time, reason string) *Worker {
+	next := ordered[start%len(ordered)]
+	for i := 0; i < len(ordered); i++ {
+		candidate := ordered[(start+i)%len(ordered)]
+		if lb.lru.config.SwitchOn == lruSwitchTime || !lb.lru.config.atLoadThreshold(candidate) {
+			next = candidate
+			break
+		}
+	}
+	lb.lru.hot = next.Name
+	lb.lru.since = now
+	lb.lru.reason = reason
+	return next
+}
+
+// lruWorkerStatus returns the hot worker state for status output. Must be
+// called with lb.mu held.
+func (lb *LoadBalancer) lruWorkerStatus() map[string]interface{} {
+	status := map[string]interface{}{
+		"hot":    lb.lru.hot,
+		"reason": lb.lru.reason,
+		"config": lb.lru.config,
+	}
+	if !lb.lru.since.IsZero() {
+		status["since"] = lb.lru.since.UTC()
+	}
+	return status
+}
+
+// SetLRUWorkerConfig replaces the lru-worker configuration and resets the hot
+// worker so the new criteria apply from a clean state
+func (lb *LoadBalancer) SetLRUWorkerConfig(cfg LRUWorkerConfig) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.lru = lruWorkerState{config: cfg}
+}
+
+// handleLRUWorkerConfig は lru-worker アルゴリズムの設定を取得・更新する HTTP ハンドラです。
+// GET では現在の設定とホットなワーカーの状態を返し、PUT/POST では LRUWorkerConfig を検証して反映します。
+// 検証に失敗した場合は 400、許可されていないメソッドには 405 を返します。
+func handleLRUWorkerConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		lb.mu.RLock()
+		cfg := lb.lru.config
+		lb.mu.RUnlock()
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if msg := cfg.Validate(); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		lb.SetLRUWorkerConfig(cfg)
+		lb.BroadcastStatus()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	lb.mu.RLock()
+	status := lb.lruWorkerStatus()
+	lb.mu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newLRUTestBalancer(cfg LRUWorkerConfig) *LoadBalancer {
+	lb := NewLoadBalancer("lru-worker")
+	lb.SetLRUWorkerConfig(cfg)
+	lb.AddWorker("worker-1", "http://localhost:8081", "#FF0000", 1)
+	lb.AddWorker("worker-2", "http://localhost:8082", "#00FF00", 5)
+	lb.AddWorker("worker-3", "http://localhost:8083", "#0000FF", 3)
+	return lb
+}
+
+func TestLRUWorkerLongRunsAndCleanSwitches(t *testing.T) {
+	lb := newLRUTestBalancer(LRUWorkerConfig{LoadThreshold: 1, WindowMs: 60000, SwitchOn: lruSwitchLoad, Order: lruOrderWeight})
+
+	// Each selection holds one in-flight request until the worker saturates,
+	// then everything in flight completes.
+	var sequence []string
+	for i := 0; i < 9; i++ {
+		w := lb.SelectWorker()
+		sequence = append(sequence, w.Name)
+		atomic.AddInt32(&w.CurrentLoad, 1)
+		if atomic.LoadInt32(&w.CurrentLoad) >= int32(w.MaxLoad) {
+			for _, other := range lb.workers {
+				atomic.StoreInt32(&other.CurrentLoad, 0)
+			}
+			atomic.StoreInt32(&w.CurrentLoad, int32(w.MaxLoad))
+		}
+	}
+
+	// Weight-descending order: worker-2 (5), worker-3 (3), worker-1 (1)
+	want := []string{
+		"worker-2", "worker-2", "worker-2",
+		"worker-3", "worker-3", "worker-3",
+		"worker-1", "worker-1", "worker-1",
+	}
+	for i := range want {
+		if sequence[i] != want[i] {
+			t.Fatalf("sequence = %v, want %v", sequence, want)
+		}
+	}
+}
+
+func TestLRUWorkerWindowExpiry(t *testing.T) {
+	lb := newLRUTestBalancer(LRUWorkerConfig{LoadThreshold: 1, WindowMs: 50, SwitchOn: lruSwitchTime, Order: lruOrderPool})
+
+	for i := 0; i < 20; i++ {
+		if w := lb.SelectWorker(); w.Name != "worker-1" {
+			t.Fatalf("selection %d = %s, want worker-1 during the window", i, w.Name)
+		}
+	}
+
+	lb.lru.since = time.Now().Add(-time.Second)
+	if w := lb.SelectWorker(); w.Name != "worker-2" {
+		t.Fatalf("after window expiry got %s, want worker-2", w.Name)
+	}
+	status := lb.GetStatus()["lruWorker"].(map[string]interface{})
+	if status["hot"] != "worker-2" || status["reason"] != "concentration window expired on worker-1" {
+		t.Errorf("lruWorker status = %v", status)
+	}
+}
+
+func TestLRUWorkerResetsWhenHotWorkerIneligible(t *testing.T) {
+	lb := newLRUTestBalancer(LRUWorkerConfig{LoadThreshold: 0.8, WindowMs: 60000, SwitchOn: lruSwitchBoth, Order: lruOrderWeight})
+
+	if w := lb.SelectWorker(); w.Name != "worker-2" {
+		t.Fatalf("first selection = %s, want worker-2", w.Name)
+	}
+	lb.openCircuitLocked(lb.workers[1])
+
+	w := lb.SelectWorker()
+	if w.Name != "worker-3" {
+		t.Fatalf("selection after circuit open = %s, want worker-3", w.Name)
+	}
+	if lb.lru.reason != "previous worker worker-2 ineligible" {
+		t.Errorf("reason = %q", lb.lru.reason)
+	}
+}
+
+func TestLRUWorkerConfigValidation(t *testing.T) {
+	lb = NewLoadBalancer("lru-worker")
+
+	for _, body := range []string{
+		`{"loadThreshold": 0}`,
+		`{"loadThreshold": 1.5}`,
+		`{"windowMs": -1}`,
+		`{"switchOn": "never"}`,
+		`{"order": "name"}`,
+		`not json`,
+	} {
+		req := httptest.NewRequest(http.MethodPut, "/algorithm/lru-worker", bytes.NewBufferString(body))
+		rec := httptest.NewRecorder()
+		handleLRUWorkerConfig(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("body %s: status code = %d, want %d", body, rec.Code, http.StatusBadRequest)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "/algorithm/lru-worker", bytes.NewBufferString(`{"windowMs": 2500, "switchOn": "time"}`))
+	rec := httptest.NewRecorder()
+	handleLRUWorkerConfig(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status code = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if lb.lru.config.WindowMs != 2500 || lb.lru.config.SwitchOn != lruSwitchTime || lb.lru.config.Order != lruOrderWeight {
+		t.Errorf("config = %+v", lb.lru.config)
+	}
+}
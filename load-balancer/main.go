@@ -1,84 +1,230 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"log"
 	"math/rand"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/network-sandbox/load-balancer/api"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // Worker represents a backend worker
 type Worker struct {
-	Name           string `json:"name"`
-	URL            string `json:"url"`
-	Color          string `json:"color"`
-	Weight         int    `json:"weight"`
-	MaxLoad        int    `json:"maxLoad"`
-	Healthy        bool   `json:"healthy"`
-	CurrentLoad    int    `json:"currentLoad"`
-	Enabled        bool   `json:"enabled"`
-	TotalRequests  int64  `json:"totalRequests"`
-	FailedRequests int64  `json:"failedRequests"`
-	CircuitOpen    bool   `json:"circuitOpen"`
-	ConsecFailures int    `json:"consecFailures"`
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	Color       string `json:"color"`
+	Weight      int    `json:"weight"`
+	MaxLoad     int    `json:"maxLoad"`
+	Healthy     bool   `json:"healthy"`
+	CurrentLoad int32  `json:"currentLoad"`
+	Enabled     bool   `json:"enabled"`
+	// Draining is set while a disabled worker finishes its in-flight tasks;
+	// it gets no new ones and is disabled once they are done, unless
+	// drainOnly
+	Draining        bool              `json:"draining"`
+	TotalRequests   int64             `json:"totalRequests"`
+	FailedRequests  int64             `json:"failedRequests"`
+	CircuitState    circuitState      `json:"circuitState"`
+	CircuitOpenedAt time.Time         `json:"circuitOpenedAt"`
+	ConsecFailures  int               `json:"consecFailures"`
+	LastChecked     time.Time         `json:"lastChecked"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	DisplayName     string            `json:"displayName,omitempty"`
+	Description     string            `json:"description,omitempty"`
+	Icon            string            `json:"icon,omitempty"`
+	// CircuitThreshold overrides the pool's circuit threshold when set
+	CircuitThreshold int `json:"circuitThreshold,omitempty"`
+	// Runtime overrides the runtime inferred from the name when set
+	Runtime string `json:"runtime,omitempty"`
+	// HealthPath is the path health checks probe, defaultHealthPath unless
+	// the worker was registered with another
+	HealthPath string `json:"healthPath"`
+	// HealthInterval and HealthTimeout override the pool's health check
+	// interval and timeout when set
+	HealthInterval time.Duration `json:"-"`
+	HealthTimeout  time.Duration `json:"-"`
+	// RequestTimeout caps the deadline of a task forwarded to the worker
+	// when set
+	RequestTimeout time.Duration `json:"-"`
+
+	consecSuccesses int
+	circuitProbeAt  time.Time
+	// nextProbeAt is when an open circuit lets its next probe through;
+	// circuitCooldown is the current open period, doubled by failed probes
+	nextProbeAt     time.Time
+	circuitCooldown time.Duration
+	stats           rollingStats
+	window          recentWindow
+	probe           probeState
+	conns           connReuse
+	rejections      rejectionLog
+	malformed       malformedLog
+	pacer           workerPacer
+	schedule        *workerSchedule
+	scheduledFail   bool
+	healthRule      *healthRule
+	degraded        bool
+	healthReason    string
+	latency         latencyEstimate
+	// reportedName is the name the worker last reported for itself;
+	// misconfigured is set while it differs from Name
+	reportedName  string
+	misconfigured bool
+	// currentWeight is the smooth-weighted running weight
+	currentWeight int64
+	// checking is set while a health check of the worker is in flight
+	checking int32
+	// healthLoop paces the worker's health checks; healthStop ends it
+	healthLoop *loopTicker
+	healthStop context.CancelFunc
+	// healthFailures counts the worker's consecutive failed health checks;
+	// its loop skips ticks before nextHealthCheck while they back off
+	healthFailures  int
+	nextHealthCheck time.Time
+	// drainOnly keeps a drained worker enabled; drainGen tells a drain's
+	// finishDrain apart from a later one's
+	drainOnly bool
+	drainGen  uint64
+	// revision is bumped on every change made through the mutation paths
+	// so clients can detect stale reads
+	revision int64
 }
 
+// TaskRequest is the task payload accepted by /task and forwarded to workers
+type TaskRequest = api.TaskRequest
+
+// HealthResponse is the body returned by a worker's /health endpoint
+type HealthResponse struct {
+	Status      string `json:"status"`
+	CurrentLoad int32  `json:"currentLoad"`
+	QueueDepth  int    `json:"queueDepth"`
+}
+
+// defaultMaxLoad is the MaxLoad assigned to workers added via AddWorker
+const defaultMaxLoad = 3
+
+// defaultUpstreamTimeout bounds a proxied task from arrival to response
+const defaultUpstreamTimeout = 30 * time.Second
+
+// deadlineHeader carries the remaining deadline budget to the worker
+const deadlineHeader = "X-LB-Deadline-Ms"
+
 // LoadBalancer manages workers and distribution
 type LoadBalancer struct {
 	mu            sync.RWMutex
 	workers       []*Worker
 	algorithm     string
-	roundRobinIdx int
-	wsClients     map[*websocket.Conn]bool
-	wsClientsMu   sync.Mutex
-}
-
-// Prometheus metrics
-var (
-	requestsTotal = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "lb_requests_total",
-			Help: "Total requests processed by worker",
-		},
-		[]string{"worker", "status"},
-	)
-	requestDuration = prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "lb_request_duration_ms",
-			Help:    "Request duration in milliseconds",
-			Buckets: prometheus.ExponentialBuckets(1, 2, 15),
-		},
-		[]string{"worker"},
-	)
-	workerHealth = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "lb_worker_health",
-			Help: "Worker health status (1=healthy, 0=unhealthy)",
-		},
-		[]string{"worker"},
-	)
-	workerActiveConnections = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "lb_worker_active_connections",
-			Help: "Active connections per worker",
-		},
-		[]string{"worker"},
-	)
-)
+	roundRobinIdx int // pool position the next round-robin scan starts at
+	// selectHook, when set, picks among the candidates instead of the
+	// algorithm; tests use it to inject selection faults
+	selectHook           func(available []*Worker) *Worker
+	circuitThreshold     int
+	circuitResetInterval time.Duration
+	circuitMaxCooldown   time.Duration
+	upstreamTimeout      time.Duration
+	lru                  lruWorkerState
+	healthInterval       time.Duration
+	healthLoop           *loopTicker
+	healthCtx            context.Context // set while HealthCheck runs
+	broadcastInterval    time.Duration
+	broadcastLoop        *loopTicker
+	rolling              *rollingRestarter
+	experiments          *experimentRunner
+	snapshots            *snapshotStore
+	headerRules          []compiledHeaderRule
+	healthTimeout        time.Duration
+	maxHealthBackoff     time.Duration
+	healthRise           int
+	healthFall           int
+	probeEnabled         bool
+	probeRps             float64
+	maxUpstreamBody      int64
+	bodyTooLargeTrips    bool
+	malformedMode        string
+	malformedTrips       bool
+	identityMode         string
+	defaultDetail        string
+	// Distribution verification
+	distributionThreshold     float64
+	distributionMinRequests   int64
+	slowRequest               time.Duration
+	retryQueueFull            bool
+	maxRetries                int
+	retryOverloaded           bool
+	dedupWindow               time.Duration
+	dedupPolicy               string
+	resourceCheckTTL          time.Duration
+	resourceScores            sync.Map // worker name -> resourceScore
+	broadcastSummaryThreshold int
+	broadcastTopN             int
+	controlSeq                uint64 // last control notification sent to a worker
+	controlRetryDelay         time.Duration
+	controlCtx                context.Context // cancelled by stopControl
+	controlCancel             context.CancelFunc
+	controlWG                 sync.WaitGroup // control notifications in flight
+	tags                      *tagStats
+	phases                    *phaseProfiler
+	rateLimit                 *rateLimiter
+	ipLimit                   *ipRateLimiter
+	trustedProxies            []netip.Prefix // peers whose X-Forwarded-For is believed; see clientAddr
+	history                   *workerHistory
+	heatmap                   *heatmapStore
+	recent                    *recentRequests
+	replays                   replayLimiter
+	stickySessions            *stickySessions
+	workerMetrics             workerMetricsCache
+	shedThresholds            shedThresholds
+	pacing                    pacingConfig
+	shed                      shedder
+	healthStartedAt           time.Time
+	clock                     clock
+	events                    *eventStore
+	resources                 *resourceManager
+	sessions                  *sessionStore
+	timeseries                *timeseriesStore
+	fairness                  *fairnessTracker
+	verifier                  *distributionVerifier
+	capacity                  *capacityEstimator
+	journal                   *journal
+	dedup                     *dedupStore
+	startupReport             *StartupReport
+	client                    *http.Client
+	healthClient              *http.Client
+	shuttingDown              atomic.Bool
+	wsClients                 map[*websocket.Conn]*wsClient
+	wsClientsMu               sync.Mutex
+	wsClientCount             int32
+	wsSessions                *wsSessionStore
+	wsEventClients            int32
+	wsEventPending            atomic.Bool
+	broadcastPending          int32
+	broadcastDigests          map[string]uint64 // worker name -> entry digest at the last broadcast; guarded by wsClientsMu
+	inFlight                  int64
+	startedAt                 time.Time
+	instanceID                string
+	listenAddrs               []string
+	self                      selfSampler
+	metrics                   *lbMetrics
+	registerer                prometheus.Registerer
+	gatherer                  prometheus.Gatherer
+}
 
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
@@ -94,75 +240,231 @@ var upgrader = websocket.Upgrader{
 			}
 		}
 		log.Printf("WebSocket connection rejected from origin: %s", origin)
+		lb.metrics.wsErrorCloses.WithLabelValues(wsOriginRejected).Inc()
 		return false
 	},
 }
 
-func init() {
-	prometheus.MustRegister(requestsTotal, requestDuration, workerHealth, workerActiveConnections)
+// NewLoadBalancer creates a new load balancer using the given algorithm. Its
+// metrics are kept in a registry of its own; see NewLoadBalancerWithRegistry.
+func NewLoadBalancer(algorithm string) *LoadBalancer {
+	reg := prometheus.NewRegistry()
+	return NewLoadBalancerWithRegistry(algorithm, reg, reg)
 }
 
-// NewLoadBalancer creates a new load balancer
-func NewLoadBalancer() *LoadBalancer {
-	return &LoadBalancer{
-		workers:   make([]*Worker, 0),
-		algorithm: "round-robin",
-		wsClients: make(map[*websocket.Conn]bool),
+// NewLoadBalancerWithRegistry creates a new load balancer whose metrics are
+// registered with reg and served from gatherer
+func NewLoadBalancerWithRegistry(algorithm string, reg prometheus.Registerer, gatherer prometheus.Gatherer) *LoadBalancer {
+	lb := &LoadBalancer{
+		workers:                   make([]*Worker, 0),
+		algorithm:                 algorithm,
+		circuitThreshold:          3,
+		upstreamTimeout:           defaultUpstreamTimeout,
+		healthInterval:            defaultHealthInterval,
+		healthLoop:                newLoopTicker(),
+		broadcastInterval:         defaultBroadcastInterval,
+		broadcastLoop:             newLoopTicker(),
+		rolling:                   newRollingRestarter(),
+		experiments:               newExperimentRunner(),
+		snapshots:                 newSnapshotStore(),
+		healthTimeout:             defaultHealthTimeout,
+		maxHealthBackoff:          defaultMaxHealthBackoff,
+		healthRise:                1,
+		healthFall:                3,
+		probeRps:                  defaultProbeRps,
+		maxUpstreamBody:           defaultMaxUpstreamBodyBytes,
+		retryQueueFull:            true,
+		maxRetries:                defaultMaxRetries,
+		dedupPolicy:               dedupReplay,
+		malformedMode:             malformedLenient,
+		identityMode:              identityWarn,
+		defaultDetail:             detailFull,
+		circuitResetInterval:      defaultCircuitResetInterval,
+		circuitMaxCooldown:        defaultCircuitMaxCooldown,
+		resourceCheckTTL:          defaultResourceCheckTTL,
+		broadcastSummaryThreshold: defaultBroadcastSummaryThreshold,
+		broadcastTopN:             defaultBroadcastTopN,
+		distributionThreshold:     defaultDistributionThreshold,
+		distributionMinRequests:   defaultDistributionMinRequests,
+		slowRequest:               defaultSlowRequestMs * time.Millisecond,
+		controlRetryDelay:         defaultControlRetryDelay,
+		pacing:                    pacingConfig{maxDelay: defaultPacingMaxDelay, burst: defaultPacingBurst},
+		clock:                     realClock{},
+		events:                    newEventStore(defaultEventCapacity),
+		resources:                 newResourceManager(),
+		sessions:                  newSessionStore(defaultSessionCapacity),
+		timeseries:                newTimeseriesStore(timeseriesRetentionFromEnv()),
+		fairness:                  newFairnessTracker(fairnessIntervalFromEnv()),
+		verifier:                  newDistributionVerifier(),
+		capacity:                  newCapacityEstimator(),
+		dedup:                     newDedupStore(dedupCapacity),
+		tags:                      newTagStats(),
+		phases:                    newPhaseProfiler(),
+		rateLimit:                 newRateLimiter(),
+		ipLimit:                   newIPRateLimiter(),
+		history:                   newWorkerHistory(),
+		heatmap:                   newHeatmapStore(),
+		recent:                    newRecentRequests(),
+		stickySessions:            newStickySessions(sessionTTLFromEnv()),
+		lru:                       lruWorkerState{config: defaultLRUWorkerConfig()},
+		wsClients:                 make(map[*websocket.Conn]*wsClient),
+		wsSessions:                newWSSessionStore(wsSessionCapacity),
+		startedAt:                 time.Now(),
+		instanceID:                newInstanceID(),
+		registerer:                reg,
+		gatherer:                  gatherer,
 	}
+	lb.controlCtx, lb.controlCancel = context.WithCancel(context.Background())
+	lb.metrics = newLBMetrics(reg, lb)
+	lb.shed.source = runtimeSelfHealth{lb}
+	lb.workerMetrics.ttl = defaultWorkerMetricsCacheTTL
+	lb.journal = newJournal(lb.metrics)
+	lb.client = lb.resources.client()
+	lb.healthClient = lb.resources.timeoutClient(0)
+	lb.resources.register("events", lb.events)
+	lb.resources.register("sessions", lb.sessions)
+	lb.resources.register("timeseries", lb.timeseries)
+	lb.resources.register("dedup", lb.dedup)
+	lb.resources.register("wsSessions", lb.wsSessions)
+	lb.resources.register("tags", lb.tags)
+	lb.resources.register("history", lb.history)
+	lb.resources.register("heatmap", lb.heatmap)
+	lb.resources.register("recentRequests", lb.recent)
+	lb.resources.register("stickySessions", lb.stickySessions)
+	lb.resources.register("ipBuckets", lb.ipLimit)
+	lb.startSession(algorithm, 0, nil)
+	return lb
 }
 
-// AddWorker adds a worker to the pool
-func (lb *LoadBalancer) AddWorker(name, url, color string, weight, maxLoad int) {
+// AddWorker adds a worker to the pool. An empty color is replaced by an
+// unused palette color.
+func (lb *LoadBalancer) AddWorker(name, url, color string, weight int) {
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
+	if color == "" {
+		color = lb.nextColorLocked()
+	}
 	lb.workers = append(lb.workers, &Worker{
-		Name:    name,
-		URL:     url,
-		Color:   color,
-		Weight:  weight,
-		MaxLoad: maxLoad,
-		Healthy: true,
-		Enabled: true,
+		Name:       name,
+		URL:        url,
+		Color:      color,
+		Weight:     weight,
+		MaxLoad:    defaultMaxLoad,
+		Healthy:    true,
+		Enabled:    true,
+		HealthPath: defaultHealthPath,
 	})
+	lb.startHealthLoopLocked(lb.workers[len(lb.workers)-1])
 }
 
-// SelectWorker selects a worker based on the current algorithm
-func (lb *LoadBalancer) SelectWorker() *Worker {
+// SetWorkerMaxLoad changes the MaxLoad of the named worker
+func (lb *LoadBalancer) SetWorkerMaxLoad(name string, maxLoad int) bool {
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
+	for _, w := range lb.workers {
+		if w.Name == name {
+			w.MaxLoad = maxLoad
+			return true
+		}
+	}
+	return false
+}
+
+// getHealthyWorkers returns the workers currently eligible for selection
+func (lb *LoadBalancer) getHealthyWorkers() []*Worker {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.eligibleWorkersLocked()
+}
 
-	available := make([]*Worker, 0)
+func (lb *LoadBalancer) eligibleWorkersLocked() []*Worker {
+	available := make([]*Worker, 0, len(lb.workers))
 	for _, w := range lb.workers {
-		if w.Healthy && w.Enabled && !w.CircuitOpen {
+		if w.Healthy && w.Enabled && !w.Draining && lb.circuitAdmitsLocked(w) && !lb.quarantinedLocked(w) {
 			available = append(available, w)
 		}
 	}
-	if len(available) == 0 {
-		return nil
-	}
+	return available
+}
 
-	switch lb.algorithm {
+// SelectWorker selects a worker based on the current algorithm
+func (lb *LoadBalancer) SelectWorker() *Worker {
+	w, _, _ := lb.selectWorker(routeHints{})
+	return w
+}
+
+// selectFromLocked applies the current algorithm to a non-empty candidate
+// list, without any request hints. Must be called with lb.mu held.
+func (lb *LoadBalancer) selectFromLocked(available []*Worker) *Worker {
+	return lb.selectWithLocked(lb.algorithm, available, routeHints{})
+}
+
+// selectWithLocked applies algorithm to a non-empty candidate list for a
+// request with hints h; ip-hash uses its client address and sticky its
+// session. Must be called with lb.mu held.
+func (lb *LoadBalancer) selectWithLocked(algorithm string, available []*Worker, h routeHints) *Worker {
+	if lb.selectHook != nil {
+		return lb.selectHook(available)
+	}
+	switch algorithm {
 	case "least-connections":
 		return lb.leastConnections(available)
 	case "weighted":
 		return lb.weighted(available)
+	case "smooth-weighted":
+		return lb.smoothWeighted(available)
+	case "resource-aware":
+		return lb.resourceAware(available)
+	case "least-latency":
+		return lb.leastLatency(available)
 	case "random":
-		return available[rand.Intn(len(available))]
+		return lb.random(available)
+	case "p2c":
+		return lb.p2c(available)
+	case "lru-worker":
+		return lb.lruWorker(available)
+	case "ip-hash":
+		return lb.ipHash(available, h.clientIP)
+	case "sticky":
+		return lb.sticky(available, h.session)
 	default:
 		return lb.roundRobin(available)
 	}
 }
 
+// roundRobin picks the first candidate at or after the pool position
+// roundRobinIdx, wrapping around, and moves the cursor past it. The cursor is
+// a position in lb.workers rather than in the candidate list, so it stays
+// meaningful when workers are added, enabled or disabled between picks: every
+// candidate is picked once per cycle and none twice in a row while another
+// is eligible. workers must be in pool order.
 func (lb *LoadBalancer) roundRobin(workers []*Worker) *Worker {
-	w := workers[lb.roundRobinIdx%len(workers)]
-	lb.roundRobinIdx++
-	return w
+	pick, pickPos := workers[0], -1
+	j := 0
+	for pos, w := range lb.workers {
+		if j == len(workers) {
+			break
+		}
+		if w != workers[j] {
+			continue
+		}
+		if j == 0 {
+			pickPos = pos
+		}
+		if pos >= lb.roundRobinIdx {
+			pick, pickPos = w, pos
+			break
+		}
+		j++
+	}
+	lb.roundRobinIdx = pickPos + 1
+	return pick
 }
 
 func (lb *LoadBalancer) leastConnections(workers []*Worker) *Worker {
 	minLoad := workers[0]
 	for _, w := range workers[1:] {
-		if w.CurrentLoad < minLoad.CurrentLoad {
+		if atomic.LoadInt32(&w.CurrentLoad) < atomic.LoadInt32(&minLoad.CurrentLoad) {
 			minLoad = w
 		}
 	}
@@ -187,92 +489,284 @@ func (lb *LoadBalancer) weighted(workers []*Worker) *Worker {
 	return workers[len(workers)-1]
 }
 
-// SetAlgorithm changes the load balancing algorithm
-func (lb *LoadBalancer) SetAlgorithm(algo string) {
+func (lb *LoadBalancer) random(workers []*Worker) *Worker {
+	return workers[rand.Intn(len(workers))]
+}
+
+// recordSuccess resets the worker's consecutive failure streak and closes
+// its circuit if the request was its half-open probe
+func (lb *LoadBalancer) recordSuccess(w *Worker) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	w.ConsecFailures = 0
+	if w.CircuitState == circuitHalfOpen {
+		lb.closeCircuitLocked(w)
+	}
+}
+
+// recordFailure counts a failed request and opens the circuit once the
+// consecutive failure threshold is reached. A failed half-open probe opens
+// it again at once.
+func (lb *LoadBalancer) recordFailure(w *Worker) {
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
+	w.ConsecFailures++
+	if w.CircuitState == circuitHalfOpen || (w.ConsecFailures >= lb.circuitThresholdLocked(w) && !w.circuitOpen()) {
+		lb.openCircuitLocked(w)
+	}
+}
+
+// SetAlgorithm changes the load balancing algorithm. Warm state the new
+// algorithm can use is handed over from the old one; see handoffLocked.
+func (lb *LoadBalancer) SetAlgorithm(algo string) {
+	lb.mu.Lock()
+	prev := lb.algorithm
 	lb.algorithm = algo
+	var handoff []string
+	if prev != algo {
+		handoff = lb.handoffLocked(prev, algo)
+	}
+	lb.mu.Unlock()
+
+	if prev == algo {
+		return
+	}
+	logHandoff(prev, algo, handoff)
+	e := lb.emitEvent("algorithm", fmt.Sprintf("Algorithm changed from %s to %s", prev, algo), map[string]interface{}{
+		"from":    prev,
+		"to":      algo,
+		"handoff": handoff,
+	})
+	lb.startSession(algo, e.Seq, handoff)
 }
 
 // GetStatus returns the current status
 func (lb *LoadBalancer) GetStatus() map[string]interface{} {
+	self := lb.SelfMetrics()
 	lb.mu.RLock()
 	defer lb.mu.RUnlock()
 	workers := make([]map[string]interface{}, len(lb.workers))
 	for i, w := range lb.workers {
 		workers[i] = map[string]interface{}{
-			"name":           w.Name,
-			"url":            w.URL,
-			"color":          w.Color,
-			"weight":         w.Weight,
-			"maxLoad":        w.MaxLoad,
-			"healthy":        w.Healthy,
-			"currentLoad":    w.CurrentLoad,
-			"enabled":        w.Enabled,
-			"totalRequests":  w.TotalRequests,
-			"failedRequests": w.FailedRequests,
-			"circuitOpen":    w.CircuitOpen,
-		}
-	}
-	return map[string]interface{}{
+			"name":             w.Name,
+			"url":              w.URL,
+			"color":            w.Color,
+			"weight":           w.Weight,
+			"maxLoad":          w.MaxLoad,
+			"healthy":          w.Healthy,
+			"currentLoad":      atomic.LoadInt32(&w.CurrentLoad),
+			"enabled":          w.Enabled,
+			"draining":         w.Draining,
+			"healthPath":       w.HealthPath,
+			"healthIntervalMs": lb.healthIntervalLocked(w).Milliseconds(),
+			"healthTimeoutMs":  lb.healthTimeoutLocked(w).Milliseconds(),
+			"saturated":        w.saturated(),
+			"totalRequests":    atomic.LoadInt64(&w.TotalRequests),
+			"failedRequests":   atomic.LoadInt64(&w.FailedRequests),
+			"circuitOpen":      w.circuitOpen(),
+			"circuitState":     w.circuitStateName(),
+			"labels":           w.Labels,
+			"displayName":      w.DisplayName,
+			"description":      w.Description,
+			"icon":             w.Icon,
+			"revision":         w.revision,
+			"healthState":      w.healthStateLocked(),
+		}
+		if w.healthRule != nil {
+			workers[i]["healthExpr"] = w.healthRule.expr
+		}
+		if w.healthReason != "" {
+			workers[i]["healthReason"] = w.healthReason
+		}
+		if ms, _, _ := w.latency.snapshot(); ms > 0 {
+			workers[i]["expectedLatencyMs"] = ms
+		}
+		if ms, fresh := w.latency.ewma(); fresh > 0 {
+			workers[i]["latencyEwmaMs"] = ms
+		}
+		if p := w.probe.snapshot(); p != nil {
+			workers[i]["probe"] = p
+		}
+		if w.schedule != nil {
+			s := w.scheduleStatusLocked(lb.clock.Now())
+			workers[i]["schedule"] = &s
+		}
+		if r := w.rejections.snapshot(); r != nil {
+			workers[i]["rejections"] = r
+		}
+		if m := w.malformed.snapshot(); m != nil {
+			workers[i]["malformed"] = m
+		}
+		if w.CircuitThreshold > 0 {
+			workers[i]["circuitThreshold"] = w.CircuitThreshold
+		}
+		if w.RequestTimeout > 0 {
+			workers[i]["requestTimeoutMs"] = w.RequestTimeout.Milliseconds()
+		}
+		recent := w.window.stats(lb.clock.Now())
+		workers[i]["rps"] = recent.Rps
+		workers[i]["errorRate"] = recent.ErrorRate
+		workers[i]["p50Ms"] = recent.P50Ms
+		workers[i]["p95Ms"] = recent.P95Ms
+		workers[i]["p99Ms"] = recent.P99Ms
+		workers[i]["runtime"] = w.runtime()
+		if w.CircuitState == circuitOpen {
+			workers[i]["nextProbeAt"] = w.nextProbeAt.UTC()
+		}
+		if !w.nextHealthCheck.IsZero() {
+			workers[i]["nextHealthCheck"] = w.nextHealthCheck.UTC()
+		}
+	}
+	status := map[string]interface{}{
 		"algorithm": lb.algorithm,
 		"workers":   workers,
 	}
+	status["settings"] = lb.settingsLocked()
+	status["eventSeq"] = lb.events.latestSeq()
+	status["loops"] = lb.loopsLocked()
+	status["lb"] = &self
+	status["shed"] = lb.ShedStatus()
+	status["distribution"] = lb.DistributionVerdict()
+	if e := lb.experimentStatus(); e != nil {
+		status["experiment"] = e
+	}
+	if len(lb.listenAddrs) > 0 {
+		status["listenAddrs"] = lb.listenAddrs
+	}
+	if lb.algorithm == "lru-worker" {
+		status["lruWorker"] = lb.lruWorkerStatus()
+	}
+	status["runtimes"] = lb.runtimeSummaryLocked()
+	status["pool"] = lb.poolSummaryLocked()
+	status["stickySessions"] = lb.stickySessions.size()
+	return status
 }
 
-// HealthCheck runs periodic health checks on workers
+// HealthCheck runs periodic health checks on workers until ctx is done,
+// each worker in its own loop (see startHealthLoopLocked), workers added
+// meanwhile included. A change of an interval restarts the wait for the
+// next check.
 func (lb *LoadBalancer) HealthCheck(ctx context.Context, interval time.Duration) {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			lb.checkAllWorkers()
-		}
+	lb.mu.Lock()
+	if interval > 0 {
+		lb.healthInterval = interval
 	}
-}
+	lb.healthStartedAt = lb.clock.Now()
+	lb.healthCtx = ctx
+	for _, w := range lb.workers {
+		lb.startHealthLoopLocked(w)
+	}
+	lb.mu.Unlock()
 
-func (lb *LoadBalancer) checkAllWorkers() {
-	lb.mu.RLock()
-	workers := make([]*Worker, len(lb.workers))
-	copy(workers, lb.workers)
-	lb.mu.RUnlock()
+	<-ctx.Done()
+	lb.mu.Lock()
+	lb.healthCtx = nil
+	for _, w := range lb.workers {
+		stopHealthLoopLocked(w)
+	}
+	lb.mu.Unlock()
+}
 
-	for _, w := range workers {
-		go lb.checkWorker(w)
+// startCheck probes w in the background
+func (lb *LoadBalancer) startCheck(w *Worker) {
+	if w.beginCheck() {
+		go func() {
+			defer w.endCheck()
+			lb.checkWorker(w)
+		}()
 	}
 }
 
+// beginCheck claims the worker's health check slot and reports whether it
+// was free. A worker slower than its interval is skipped on the ticks its
+// previous check is still running, so each has at most one probe in flight.
+func (w *Worker) beginCheck() bool {
+	return atomic.CompareAndSwapInt32(&w.checking, 0, 1)
+}
+
+func (w *Worker) endCheck() {
+	atomic.StoreInt32(&w.checking, 0)
+}
+
+// checkWorker probes the worker's HealthPath with the shared health check
+// client, within its health check timeout. A DNS failure or refused connection flushes the worker's idle
+// connections and resolves its host again. Failed checks back off; see
+// backOffHealthLocked. A worker is marked
+// unhealthy after healthFall consecutive failures (its circuit opens at
+// circuitThreshold) and healthy again after healthRise consecutive successes.
+// Whether a check failed is decided by the worker's health expressions, if
+// any; see judgeHealthLocked.
 func (lb *LoadBalancer) checkWorker(w *Worker) {
-	client := &http.Client{Timeout: 2 * time.Second}
-	resp, err := client.Get(w.URL + "/health")
+	lb.mu.RLock()
+	timeout := lb.healthTimeoutLocked(w)
+	healthURL := w.healthURL()
+	lb.mu.RUnlock()
+	checkedAt := lb.clock.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	var resp *http.Response
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, healthURL, nil)
+	if err == nil {
+		resp, err = lb.healthClient.Do(req)
+	}
+	latency := time.Since(start)
+	var body []byte
+	if err == nil {
+		body, _ = readLimited(resp.Body, maxHealthBody)
+		resp.Body.Close()
+	} else if reason := connFailureReason(err); reason == connFailureDNS || reason == connFailureRefused {
+		lb.flushUpstream(w, err, true)
+	}
 
+	var identity *identityEvent
+	defer func() { lb.emitIdentity(identity) }()
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
 
-	if err != nil || resp.StatusCode != http.StatusOK {
+	w.LastChecked = time.Now()
+	ok, degraded := false, false
+	if err != nil {
+		w.healthReason = "request failed: " + err.Error()
+	} else {
+		ok, degraded, w.healthReason = w.judgeHealthLocked(resp.StatusCode, body, latency)
+		w.latency.advertise(advertisedLatency(body))
+		identity = lb.observeIdentityLocked(w, reportedWorkerName(body), "health")
+	}
+	w.degraded = degraded
+	lb.backOffHealthLocked(w, ok, checkedAt)
+	if !ok {
+		w.consecSuccesses = 0
 		w.ConsecFailures++
-		if w.ConsecFailures >= 3 {
-			w.CircuitOpen = true
+		if w.ConsecFailures >= lb.healthFall && w.Healthy {
+			w.Healthy = false
+			lb.history.ejected(w.Name, lb.clock.Now())
+		}
+		if w.ConsecFailures >= lb.circuitThresholdLocked(w) {
+			if w.CircuitState != circuitOpen {
+				lb.openCircuitLocked(w)
+			}
 			w.Healthy = false
 		}
 	} else {
 		w.ConsecFailures = 0
-		w.Healthy = true
-		w.CircuitOpen = false
-	}
-	if resp != nil {
-		resp.Body.Close()
+		w.consecSuccesses++
+		if !w.Healthy && w.consecSuccesses >= lb.healthRise {
+			w.latency.restart()
+		}
+		if w.Healthy || w.consecSuccesses >= lb.healthRise {
+			w.Healthy = true
+		}
 	}
 
 	healthVal := 0.0
 	if w.Healthy {
 		healthVal = 1.0
 	}
-	workerHealth.WithLabelValues(w.Name).Set(healthVal)
-	workerActiveConnections.WithLabelValues(w.Name).Set(float64(w.CurrentLoad))
+	lb.metrics.workerHealth.WithLabelValues(w.Name).Set(healthVal)
+	lb.metrics.circuitState.WithLabelValues(w.Name).Set(w.CircuitState.gaugeValue())
+	lb.metrics.workerActiveConnections.WithLabelValues(w.Name).Set(float64(atomic.LoadInt32(&w.CurrentLoad)))
 }
 
 // UpdateWorker updates worker settings
@@ -281,124 +775,561 @@ func (lb *LoadBalancer) UpdateWorker(name string, enabled *bool, weight *int) bo
 	defer lb.mu.Unlock()
 	for _, w := range lb.workers {
 		if w.Name == name {
-			if enabled != nil {
-				w.Enabled = *enabled
-			}
-			if weight != nil && *weight > 0 {
-				w.Weight = *weight
-			}
+			lb.updateWorkerLocked(w, enabled, weight)
+			w.revision++
 			return true
 		}
 	}
 	return false
 }
 
-// BroadcastStatus sends status to all WebSocket clients
+// updateWorkerLocked applies an enabled/weight update to w. A busy worker
+// is drained before it is disabled; enabling cancels a drain. Must be called
+// with lb.mu held.
+func (lb *LoadBalancer) updateWorkerLocked(w *Worker, enabled *bool, weight *int) {
+	switch {
+	case enabled == nil:
+	case *enabled:
+		if !w.Enabled || w.Draining {
+			lb.notifyWorkerLocked(w, controlEnable)
+		}
+		w.Enabled, w.Draining, w.drainOnly = true, false, false
+	default:
+		lb.disableWorkerLocked(w)
+	}
+	if weight != nil && *weight > 0 {
+		w.Weight = *weight
+	}
+}
+
+// PatchWorker applies enabled/weight and metadata changes to the named
+// worker in one step and returns its resulting status. The update must
+// already be validated. Concurrent patches are serialized by lb.mu and each
+// gets its own revision.
+func (lb *LoadBalancer) PatchWorker(name string, update api.WorkerUpdate) (api.WorkerStatus, bool) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	for _, w := range lb.workers {
+		if w.Name == name {
+			lb.updateWorkerLocked(w, update.Enabled, update.Weight)
+			if update.Draining != nil {
+				lb.setDrainingLocked(w, *update.Draining)
+			}
+			applyMetadataLocked(w, update)
+			applyHealthRuleLocked(w, update)
+			applyHealthTimingLocked(w, update)
+			applyRequestTimeoutLocked(w, update)
+			if update.PaceRate != nil {
+				w.pacer.setRate(*update.PaceRate)
+			}
+			if update.CircuitThreshold != nil {
+				w.CircuitThreshold = *update.CircuitThreshold
+			}
+			w.revision++
+			return lb.workerStatusLocked(w), true
+		}
+	}
+	return api.WorkerStatus{}, false
+}
+
+// WorkerStatus returns the status document of the named worker
+func (lb *LoadBalancer) WorkerStatus(name string) (api.WorkerStatus, bool) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	for _, w := range lb.workers {
+		if w.Name == name {
+			return lb.workerStatusLocked(w), true
+		}
+	}
+	return api.WorkerStatus{}, false
+}
+
+// workerStatusLocked returns the status document of w. Must be called with
+// lb.mu held.
+func (lb *LoadBalancer) workerStatusLocked(w *Worker) api.WorkerStatus {
+	s := api.WorkerStatus{
+		Name:             w.Name,
+		URL:              w.URL,
+		Color:            w.Color,
+		Weight:           w.Weight,
+		MaxLoad:          w.MaxLoad,
+		Healthy:          w.Healthy,
+		CurrentLoad:      atomic.LoadInt32(&w.CurrentLoad),
+		Enabled:          w.Enabled,
+		Draining:         w.Draining,
+		HealthPath:       w.HealthPath,
+		HealthIntervalMs: lb.healthIntervalLocked(w).Milliseconds(),
+		HealthTimeoutMs:  lb.healthTimeoutLocked(w).Milliseconds(),
+		Saturated:        w.saturated(),
+		TotalRequests:    atomic.LoadInt64(&w.TotalRequests),
+		FailedRequests:   atomic.LoadInt64(&w.FailedRequests),
+		CircuitOpen:      w.circuitOpen(),
+		CircuitState:     w.circuitStateName(),
+		Labels:           w.Labels,
+		DisplayName:      w.DisplayName,
+		Description:      w.Description,
+		Icon:             w.Icon,
+		Revision:         w.revision,
+		Probe:            w.probe.snapshot(),
+		Rejections:       w.rejections.snapshot(),
+		HealthState:      w.healthStateLocked(),
+		HealthReason:     w.healthReason,
+		PaceRate:         w.pacer.configuredRate(),
+		Malformed:        w.malformed.snapshot(),
+		Misconfigured:    w.misconfigured,
+		ReportedName:     w.reportedName,
+	}
+	s.CircuitThreshold = w.CircuitThreshold
+	s.Runtime = w.runtime()
+	if w.CircuitState == circuitOpen {
+		next := w.nextProbeAt.UTC()
+		s.NextProbeAt = &next
+	}
+	if !w.nextHealthCheck.IsZero() {
+		next := w.nextHealthCheck.UTC()
+		s.NextHealthCheck = &next
+	}
+	s.RequestTimeoutMs = w.RequestTimeout.Milliseconds()
+	recent := w.window.stats(lb.clock.Now())
+	s.Rps, s.ErrorRate = recent.Rps, recent.ErrorRate
+	s.P50Ms, s.P95Ms, s.P99Ms = recent.P50Ms, recent.P95Ms, recent.P99Ms
+	if ms, fresh := w.latency.ewma(); fresh > 0 {
+		s.LatencyEWMAMs = ms
+	}
+	if host, _, ok := workerHost(w.URL); ok {
+		s.ResolvedIP = lb.resources.conns.resolvedIP(host)
+	}
+	if w.healthRule != nil {
+		expr := w.healthRule.expr
+		s.HealthExpr = &expr
+	}
+	if w.schedule != nil {
+		sched := w.scheduleStatusLocked(lb.clock.Now())
+		s.Schedule = &sched
+	}
+	return s
+}
+
+// BroadcastStatus sends status to all WebSocket clients, omitting the fields
+// each client excluded when it connected. Past the summary threshold clients
+// that did not subscribe to the full form are sent the summary form; see
+// broadcastsummary.go.
 func (lb *LoadBalancer) BroadcastStatus() {
+	atomic.AddInt32(&lb.broadcastPending, 1)
 	lb.wsClientsMu.Lock()
+	atomic.AddInt32(&lb.broadcastPending, -1)
 	defer lb.wsClientsMu.Unlock()
-	status := lb.GetStatus()
-	data, err := json.Marshal(status)
-	if err != nil {
-		log.Printf("Failed to marshal status for broadcast: %v", err)
+	if len(lb.wsClients) == 0 {
 		return
 	}
-	for client := range lb.wsClients {
-		if err := client.WriteMessage(websocket.TextMessage, data); err != nil {
-			client.Close()
-			delete(lb.wsClients, client)
+	full, summary := lb.broadcastForms(lb.GetStatus())
+	encoded := make(map[string][]byte)
+	for conn, client := range lb.wsClients {
+		form, mode := full, broadcastFull
+		if summary != nil && !client.full {
+			form, mode = summary, broadcastSummary
+		}
+		key := mode + "|" + strings.Join(client.exclude, ",")
+		data, ok := encoded[key]
+		if !ok {
+			var err error
+			if data, err = json.Marshal(filterStatus(form, client.exclude)); err != nil {
+				log.Printf("Failed to marshal status for broadcast: %v", err)
+				return
+			}
+			encoded[key] = data
+		}
+		if err := lb.sendWSLocked(client, data); err != nil {
+			lb.removeWSClientLocked(conn, wsWriteCloseReason(err))
 		}
 	}
 }
 
-// StartBroadcast starts periodic status broadcasts
+// StartBroadcast starts periodic status broadcasts. While broadcasts are
+// being shed only every shedBroadcastEvery-th tick is sent. A change of the
+// interval in the settings restarts the wait for the next broadcast.
 func (lb *LoadBalancer) StartBroadcast(ctx context.Context, interval time.Duration) {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ctx.Done():
+	if interval > 0 {
+		lb.mu.Lock()
+		lb.broadcastInterval = interval
+		lb.mu.Unlock()
+	}
+	var ticks int
+	lb.runLoop(ctx, lb.broadcastLoop, func() time.Duration {
+		lb.mu.RLock()
+		defer lb.mu.RUnlock()
+		return lb.broadcastInterval
+	}, func() {
+		if ticks++; lb.shedding(shedBroadcasts) && ticks%shedBroadcastEvery != 0 {
+			lb.metrics.shedActions.WithLabelValues(shedActionBroadcast).Inc()
 			return
-		case <-ticker.C:
-			lb.BroadcastStatus()
 		}
-	}
+		lb.BroadcastStatus()
+	})
 }
 
-var lb *LoadBalancer
+// ForwardRequest selects a worker, forwards the task to it and returns the
+// response body annotated with the worker's name, color and processing time.
+// On failure the returned status code is the one to send to the client.
+func (lb *LoadBalancer) ForwardRequest(task TaskRequest) ([]byte, int, error) {
+	return lb.forwardTask(context.Background(), task, time.Now())
+}
 
-func handleTask(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
+// forwardTask forwards the task with a deadline of upstreamTimeout, or the
+// one the request asked for, measured from received. The remaining budget is passed to the worker in the
+// X-LB-Deadline-Ms header so it can fail fast instead of overrunning it.
+func (lb *LoadBalancer) forwardTask(ctx context.Context, task TaskRequest, received time.Time) ([]byte, int, error) {
+	return lb.forwardTo(ctx, lb.SelectWorker(), task, received)
+}
 
-	worker := lb.SelectWorker()
+// forwardTo forwards the task to an already selected worker; a nil worker
+// means none was eligible.
+func (lb *LoadBalancer) forwardTo(ctx context.Context, worker *Worker, task TaskRequest, received time.Time) (out []byte, code int, err error) {
 	if worker == nil {
-		requestsTotal.WithLabelValues("none", "error").Inc()
-		http.Error(w, `{"error": "No healthy workers available"}`, http.StatusServiceUnavailable)
-		return
+		lb.metrics.requestsTotal.WithLabelValues("none", "error").Inc()
+		return nil, http.StatusServiceUnavailable, fmt.Errorf("No healthy workers available")
 	}
 
-	var taskReq map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&taskReq); err != nil {
-		taskReq = map[string]interface{}{"weight": 1.0}
+	atomic.AddInt32(&worker.CurrentLoad, 1)
+	atomic.AddInt64(&worker.TotalRequests, 1)
+	atomic.AddInt64(&lb.inFlight, 1)
+	defer atomic.AddInt32(&worker.CurrentLoad, -1)
+	defer atomic.AddInt64(&lb.inFlight, -1)
+	// A panic while forwarding counts against the worker like any other
+	// failure before recoverMiddleware answers the client
+	defer func() {
+		if p := recover(); p != nil {
+			atomic.AddInt64(&worker.FailedRequests, 1)
+			lb.recordFailure(worker)
+			lb.metrics.requestsTotal.WithLabelValues(worker.Name, "error").Inc()
+			panic(p)
+		}
+	}()
+
+	start := time.Now()
+	failed, abandoned := true, false
+	var timing upstreamTiming
+	var queueWait *float64
+	var injected map[string]string
+	defer func() {
+		// A task its client gave up on tells nothing about the worker
+		if abandoned {
+			return
+		}
+		worker.stats.observe(time.Since(start), failed)
+		worker.window.observe(lb.clock.Now(), time.Since(start), failed)
+		if !failed {
+			lb.metrics.workerLatencyEWMA.WithLabelValues(worker.Name).Set(worker.latency.observe(time.Since(start)))
+		}
+		lb.history.observe(worker.Name, lb.clock.Now(), time.Since(start), failed, queueWait)
+		lb.heatmap.observe(worker.Name, lb.clock.Now(), time.Since(start))
+	}()
+	defer func() {
+		recordAttempt(ctx, JournalAttempt{
+			Worker:    worker.Name,
+			Outcome:   attemptOutcome(code, err),
+			Status:    code,
+			LatencyMs: time.Since(start).Milliseconds(),
+			TTFBMs:    timing.ttfb().Milliseconds(),
+			Headers:   injected,
+		})
+	}()
+
+	lb.mu.RLock()
+	injected = lb.headerRulesForLocked(ctx, task, worker)
+	timeout := upstreamTimeoutFrom(ctx, lb.upstreamTimeout)
+	if worker.RequestTimeout > 0 {
+		timeout = min(timeout, worker.RequestTimeout)
 	}
+	maxBody, bodyTrips := lb.maxUpstreamBody, lb.bodyTooLargeTrips
+	malformedMode, malformedTrips := lb.malformedMode, lb.malformedTrips
+	scheduledFail := worker.scheduledFail
+	lb.mu.RUnlock()
 
-	lb.mu.Lock()
-	worker.CurrentLoad++
-	worker.TotalRequests++
-	lb.mu.Unlock()
+	if scheduledFail {
+		atomic.AddInt64(&worker.FailedRequests, 1)
+		lb.recordFailure(worker)
+		lb.metrics.requestsTotal.WithLabelValues(worker.Name, "error").Inc()
+		return nil, http.StatusServiceUnavailable, &workerFailure{worker: worker.Name, msg: "Scheduled failure"}
+	}
 
-	start := time.Now()
+	budget := timeout - time.Since(received)
+	if budget <= 0 {
+		atomic.AddInt64(&worker.FailedRequests, 1)
+		lb.metrics.deadlineExceeded.WithLabelValues(worker.Name, "lb").Inc()
+		lb.metrics.requestsTotal.WithLabelValues(worker.Name, "timeout").Inc()
+		return nil, http.StatusGatewayTimeout, &workerTimeout{worker: worker.Name, elapsed: time.Since(received), msg: "Deadline exceeded before forwarding"}
+	}
+	client := ctx
+	ctx, cancel := context.WithTimeout(ctx, budget)
+	defer cancel()
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	body, _ := json.Marshal(taskReq)
-	resp, err := client.Post(worker.URL+"/task", "application/json", strings.NewReader(string(body)))
+	body, _ := json.Marshal(task)
+	req, err := http.NewRequestWithContext(timing.withTrace(ctx), http.MethodPost, worker.URL+"/task", bytes.NewReader(body))
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	for k, v := range injected {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(deadlineHeader, strconv.FormatInt(budget.Milliseconds(), 10))
+	resp, err := lb.client.Do(req)
+	if err != nil && client.Err() != nil {
+		abandoned = true
+		lb.metrics.requestsTotal.WithLabelValues(worker.Name, "cancelled").Inc()
+		return nil, statusClientClosedRequest, &clientClosed{worker: worker.Name}
+	}
+	if err == nil {
+		defer func() { timing.observe(lb.metrics, worker, time.Since(timing.start)) }()
+	} else {
+		lb.flushUpstream(worker, err, false)
+	}
 
 	duration := float64(time.Since(start).Milliseconds())
-	requestDuration.WithLabelValues(worker.Name).Observe(duration)
+	lb.metrics.requestDuration.WithLabelValues(worker.Name).Observe(duration)
 
-	lb.mu.Lock()
-	worker.CurrentLoad--
-	lb.mu.Unlock()
+	// A worker that gave up because of the budget did the right thing and is
+	// not charged to the circuit breaker; an LB-side deadline is.
+	if err == nil && resp.StatusCode == http.StatusGatewayTimeout {
+		resp.Body.Close()
+		atomic.AddInt64(&worker.FailedRequests, 1)
+		lb.metrics.deadlineExceeded.WithLabelValues(worker.Name, "worker").Inc()
+		lb.metrics.requestsTotal.WithLabelValues(worker.Name, "timeout").Inc()
+		return nil, http.StatusGatewayTimeout, &workerTimeout{worker: worker.Name, elapsed: time.Since(received), msg: "Worker deadline exceeded"}
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		atomic.AddInt64(&worker.FailedRequests, 1)
+		lb.recordFailure(worker)
+		lb.metrics.deadlineExceeded.WithLabelValues(worker.Name, "lb").Inc()
+		lb.metrics.requestsTotal.WithLabelValues(worker.Name, "timeout").Inc()
+		return nil, http.StatusGatewayTimeout, &workerTimeout{worker: worker.Name, elapsed: time.Since(received), msg: "Worker timed out"}
+	}
+	// A worker turning the task away for lack of capacity is told apart
+	// from a failure so capacity problems show up on their own
+	if err == nil && resp.StatusCode == http.StatusServiceUnavailable {
+		if reason := rejectionReason(resp); reason != "" {
+			resp.Body.Close()
+			atomic.AddInt64(&worker.FailedRequests, 1)
+			lb.recordFailure(worker)
+			worker.rejections.record(reason, lb.clock.Now())
+			worker.pacer.observe(lb.clock.Now(), true)
+			lb.history.reject(worker.Name, lb.clock.Now(), reason)
+			lb.metrics.upstreamRejections.WithLabelValues(worker.Name, reason).Inc()
+			lb.metrics.requestsTotal.WithLabelValues(worker.Name, "rejected").Inc()
+			return nil, http.StatusServiceUnavailable, &workerRejection{worker: worker.Name, reason: reason, retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), lb.clock.Now())}
+		}
+	}
+	if err == nil && resp.StatusCode >= 500 {
+		resp.Body.Close()
+		err = fmt.Errorf("worker returned status %d", resp.StatusCode)
+	}
+	if err != nil {
+		atomic.AddInt64(&worker.FailedRequests, 1)
+		lb.recordFailure(worker)
+		lb.metrics.requestsTotal.WithLabelValues(worker.Name, "error").Inc()
+		return nil, http.StatusServiceUnavailable, &workerFailure{worker: worker.Name, msg: "Worker failed"}
+	}
+	defer resp.Body.Close()
 
-	if err != nil || resp.StatusCode >= 500 {
-		lb.mu.Lock()
-		worker.FailedRequests++
-		worker.ConsecFailures++
-		if worker.ConsecFailures >= 3 {
-			worker.CircuitOpen = true
+	raw, err := readLimited(resp.Body, maxBody)
+	total := time.Since(timing.start)
+	if err == errBodyTooLarge {
+		atomic.AddInt64(&worker.FailedRequests, 1)
+		lb.metrics.upstreamBodyTooLarge.WithLabelValues(worker.Name).Inc()
+		if bodyTrips {
+			lb.recordFailure(worker)
 		}
-		lb.mu.Unlock()
-		requestsTotal.WithLabelValues(worker.Name, "error").Inc()
-		http.Error(w, `{"error": "Worker failed"}`, http.StatusServiceUnavailable)
-		return
+		lb.metrics.requestsTotal.WithLabelValues(worker.Name, "error").Inc()
+		return nil, http.StatusBadGateway, fmt.Errorf("Worker response body exceeds %d bytes", maxBody)
 	}
 
-	lb.mu.Lock()
-	worker.ConsecFailures = 0
-	lb.mu.Unlock()
+	var result map[string]interface{}
+	malformed := err == nil && (json.Unmarshal(raw, &result) != nil || result == nil)
+	if malformed {
+		worker.malformed.record(raw, lb.clock.Now())
+		lb.metrics.malformedResponses.WithLabelValues(worker.Name, malformedMode).Inc()
+		if malformedMode == malformedStrict {
+			atomic.AddInt64(&worker.FailedRequests, 1)
+			if malformedTrips {
+				lb.recordFailure(worker)
+			}
+			lb.metrics.requestsTotal.WithLabelValues(worker.Name, malformedOutcome).Inc()
+			return nil, http.StatusBadGateway, &malformedResponse{worker: worker.Name}
+		}
+	}
 
-	requestsTotal.WithLabelValues(worker.Name, "success").Inc()
+	lb.recordSuccess(worker)
+	worker.pacer.observe(lb.clock.Now(), false)
+	lb.metrics.requestsTotal.WithLabelValues(worker.Name, "success").Inc()
+	failed = false
 
-	var result map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	queueWait = reportedQueueWait(result)
+	if reported, ok := result["worker"].(string); ok {
+		lb.observeIdentity(worker, reported, "task")
+	}
+	detail := responseDetailFrom(ctx)
+	if (detail != detailFull || malformed && malformedMode == malformedPassthrough) && setPassthrough(ctx, passthroughResponse{
+		contentType:      resp.Header.Get("Content-Type"),
+		worker:           worker.Name,
+		workerColor:      worker.Color,
+		processingTimeMs: int(duration),
+		upstreamTotalMs:  total.Milliseconds(),
+		retries:          priorAttempts(ctx),
+	}) {
+		if detail == detailNone {
+			return nil, http.StatusOK, nil
+		}
+		return raw, http.StatusOK, nil
+	}
+	if result == nil {
 		result = map[string]interface{}{}
 	}
-	resp.Body.Close()
-
 	result["worker"] = worker.Name
 	result["workerColor"] = worker.Color
 	result["processingTimeMs"] = int(duration)
+	result["ttfbMs"] = timing.ttfb().Milliseconds()
+	result["upstreamTotalMs"] = total.Milliseconds()
+	result["connReused"] = timing.reused
+	result["retries"] = priorAttempts(ctx)
+
+	out, err = json.Marshal(result)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return out, http.StatusOK, nil
+}
+
+var lb *LoadBalancer
 
+// handleTask は POST /task を受け付け、タスクを選択したワーカーへ転送して結果を JSON で返します。
+// ボディが不正な場合は weight=1 のタスクとして扱い、転送に失敗した場合は {"error": "..."} を返します。
+// 転送の前に負荷制御 (shedTask)、レート上限 (limitTask)、重複排除 (dedupTask)、タグの検証 (admitTags) を行い、転送と再試行は forwardWithRetry が行います。
+// 候補となるワーカーがいない場合の 503 には、ワーカーごとの除外理由を "excluded" として含めます。
+func handleTask(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	received := time.Now()
+	requestID := r.Header.Get(requestIDHeader)
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+	w.Header().Set(requestIDHeader, requestID)
+	if lb.shedTask(w, r) || lb.limitTask(w, r) {
+		return
+	}
+	phases := lb.phases.sample(received)
+	defer lb.finishPhases(requestID, phases)
+	var task TaskRequest
+	if err := json.NewDecoder(r.Body).Decode(&task); err != nil {
+		task = TaskRequest{Weight: 1.0}
+	}
+	w, finish, answered := lb.dedupTask(w, r, task, requestID)
+	if answered {
+		return
+	}
+	defer finish()
+
+	accounted, ok := lb.admitTags(w, task.Tags)
+	if !ok {
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(result)
+	hints, err := parseRouteHints(r)
+	if err == nil && task.SessionID != "" && r.Header.Get(sessionHeader) == "" {
+		hints.session = task.SessionID
+		err = validateSessionID(task.SessionID, "sessionId")
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	detail, err := lb.responseDetail(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	timeout, err := parseRequestTimeout(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	arm := lb.experiments.assign(requestID)
+	if arm != nil {
+		hints.algorithm = arm.algorithm
+	}
+	phases.mark(phaseDecode)
+	hints.phases = phases
+	worker, fallback, err := lb.selectWorker(hints)
+	phases.mark(phaseSelect)
+	var conflict *affinityConflict
+	if errors.As(err, &conflict) {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(api.ErrorResponse{
+			Error:    conflict.Error(),
+			Worker:   conflict.worker,
+			Eligible: conflict.eligible,
+		})
+		return
+	}
+	var none *noEligibleWorkers
+	if errors.As(err, &none) {
+		lb.recordSelectionFailure(none)
+		if none.saturated() {
+			lb.writeSaturated(w, none)
+			return
+		}
+	}
+	if fallback != "" {
+		w.Header().Set(fallbackHeader, fallback)
+	}
 
-	lb.BroadcastStatus()
+	attempts := &attemptLog{requestID: requestID}
+	passthrough := &passthroughResponse{}
+	ctx := withResponseDetail(withPassthrough(withAttemptLog(r.Context(), attempts), passthrough), detail)
+	ctx = withUpstreamTimeout(ctx, timeout)
+	respBody, statusCode, err := lb.forwardWithRetry(ctx, hints, worker, task, received)
+	phases.mark(phaseUpstream)
+	lb.journalRequest(requestID, received, task.Tags, attempts, statusCode, err)
+	lb.recordRecent(requestID, received, task, attempts, statusCode, respBody, err)
+	lb.tags.observe(accounted, time.Since(received), err != nil)
+	if arm != nil {
+		lb.experiments.observe(arm, lastAttemptWorker(attempts), time.Since(received), err != nil)
+	}
+	if err != nil {
+		w.WriteHeader(statusCode)
+		if none != nil {
+			json.NewEncoder(w).Encode(api.ErrorResponse{Error: err.Error(), Excluded: none.excluded})
+			return
+		}
+		var timedOut *workerTimeout
+		if errors.As(err, &timedOut) {
+			json.NewEncoder(w).Encode(api.ErrorResponse{Error: err.Error(), Worker: timedOut.worker, ElapsedMs: timedOut.elapsed.Milliseconds()})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	lb.bindSession(w, hints, lastAttemptWorker(attempts))
+	passthrough.writeHeaders(w.Header())
+	if detail == detailNone {
+		w.Header().Del("Content-Type")
+		statusCode = http.StatusNoContent
+	}
+	w.WriteHeader(statusCode)
+	w.Write(respBody)
+
+	lb.broadcastAfterTask()
 }
 
 // handleStatus はロードバランサーの現在の状態をJSONで返すHTTPハンドラです。
+// ?exclude=lb,lruWorker のように指定したトップレベルのフィールドは省略されます。
 // GET以外のメソッドに対してはステータス405 (Method Not Allowed) を返します。
 func handleStatus(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -406,10 +1337,10 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(lb.GetStatus())
+	json.NewEncoder(w).Encode(filterStatus(lb.GetStatus(), parseStatusExclude(r.URL.Query().Get("exclude"))))
 }
 
-var availableAlgorithms = []string{"round-robin", "least-connections", "weighted", "random"}
+var availableAlgorithms = []string{"round-robin", "least-connections", "weighted", "smooth-weighted", "random", "p2c", "lru-worker", "ip-hash", "sticky", "resource-aware", "least-latency"}
 
 // validAlgorithms は availableAlgorithms から生成されたバリデーション用の map
 var validAlgorithms = func() map[string]struct{} {
@@ -431,15 +1362,10 @@ func handleAlgorithm(w http.ResponseWriter, r *http.Request) {
 		algo := lb.algorithm
 		lb.mu.RUnlock()
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"algorithm": algo,
-			"available": availableAlgorithms,
-		})
+		json.NewEncoder(w).Encode(api.AlgorithmResponse{Algorithm: algo, Available: availableAlgorithms})
 
 	case http.MethodPut, http.MethodPost:
-		var req struct {
-			Algorithm string `json:"algorithm"`
-		}
+		var req api.AlgorithmRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, "Invalid request", http.StatusBadRequest)
 			return
@@ -450,10 +1376,7 @@ func handleAlgorithm(w http.ResponseWriter, r *http.Request) {
 		}
 		lb.SetAlgorithm(req.Algorithm)
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"algorithm": req.Algorithm,
-			"available": availableAlgorithms,
-		})
+		json.NewEncoder(w).Encode(api.AlgorithmResponse{Algorithm: req.Algorithm, Available: availableAlgorithms})
 		lb.BroadcastStatus()
 
 	default:
@@ -461,8 +1384,12 @@ func handleAlgorithm(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleWorker はワーカーの有効/無効・重み・表示情報を部分更新する HTTP ハンドラです。
+// すべてのフィールドを検証してから一括で反映し、更新後の WorkerStatus (revision を含む) を返します。
+// ?strict=true では未知のフィールドを 400 で拒否します。GET では最後に解決した IP を含む WorkerStatus を返します。
+// DELETE ではワーカーとそのメトリクス系列を削除し、残ったワーカーの一覧を返します。処理中のリクエストがある場合は ?force=true がない限り 409 を返します。
 func handleWorker(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPatch {
+	if r.Method != http.MethodPatch && r.Method != http.MethodGet && r.Method != http.MethodDelete {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
@@ -476,26 +1403,287 @@ func handleWorker(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Worker name required", http.StatusBadRequest)
 		return
 	}
+	if r.Method == http.MethodGet {
+		status, ok := lb.WorkerStatus(name)
+		if !ok {
+			http.Error(w, "Worker not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		found, err := lb.unregisterWorker(name, r.URL.Query().Get("force") == "true")
+		if !found {
+			http.Error(w, "Worker not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(api.ErrorResponse{Error: err.Error(), Worker: name})
+			return
+		}
+		lb.emitEvent("worker_removed", fmt.Sprintf("Worker %s removed", name), map[string]interface{}{
+			"worker": name,
+		})
+		json.NewEncoder(w).Encode(lb.WorkerStatuses())
+		lb.BroadcastStatus()
+		return
+	}
+
+	var req api.WorkerUpdate
+	dec := json.NewDecoder(r.Body)
+	if r.URL.Query().Get("strict") == "true" {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(&req); err != nil {
+		writeMetadataError(w, &MetadataError{"body", err.Error()})
+		return
+	}
+	if err := validateWorkerUpdate(req); err != nil {
+		writeMetadataError(w, err.(*MetadataError))
+		return
+	}
+
+	status, ok := lb.PatchWorker(name, req)
+	if !ok {
+		http.Error(w, "Worker not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+	lb.BroadcastStatus()
+}
+
+// validateWorkerUpdate checks every field of a PATCH before anything is
+// applied
+func validateWorkerUpdate(req api.WorkerUpdate) error {
+	if req.Weight != nil && *req.Weight <= 0 {
+		return &MetadataError{"weight", "must be positive"}
+	}
+	if req.PaceRate != nil && (*req.PaceRate < 0 || *req.PaceRate > maxPaceRate) {
+		return &MetadataError{"paceRate", fmt.Sprintf("must be between 0 and %d", maxPaceRate)}
+	}
+	if req.CircuitThreshold != nil && *req.CircuitThreshold < 0 {
+		return &MetadataError{"circuitThreshold", "must not be negative"}
+	}
+	if req.HealthExpr != nil {
+		if _, err := compileHealthRule(*req.HealthExpr); err != nil {
+			return err
+		}
+	}
+	if req.Runtime != nil {
+		if err := validateRuntime(*req.Runtime); err != nil {
+			return err
+		}
+	}
+	if req.HealthPath != nil {
+		if err := validateHealthPath(*req.HealthPath); err != nil {
+			return err
+		}
+	}
+	if err := validateHealthTiming(req.HealthIntervalMs, req.HealthTimeoutMs); err != nil {
+		return err
+	}
+	if err := validateWorkerRequestTimeout(req.RequestTimeoutMs); err != nil {
+		return err
+	}
+	return validateWorkerMetadata(req.Color, req.DisplayName, req.Description, req.Icon)
+}
+
+// registerWorker adds a worker unless one with the same name already exists
+func (lb *LoadBalancer) registerWorker(req api.AddWorkerRequest) (api.WorkerStatus, bool) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	for _, w := range lb.workers {
+		if w.Name == req.Name {
+			return api.WorkerStatus{}, false
+		}
+	}
+	w := &Worker{
+		Name:        req.Name,
+		URL:         req.URL,
+		Color:       normalizeColor(req.Color),
+		Weight:      req.Weight,
+		MaxLoad:     req.MaxLoad,
+		Healthy:     true,
+		Enabled:     true,
+		Labels:      req.Labels,
+		DisplayName: req.DisplayName,
+		Description: req.Description,
+		Icon:        req.Icon,
+
+		CircuitThreshold: req.CircuitThreshold,
+		Runtime:          req.Runtime,
+		HealthPath:       req.HealthPath,
+	}
+	if w.HealthPath == "" {
+		w.HealthPath = defaultHealthPath
+	}
+	if w.Color == "" {
+		w.Color = lb.nextColorLocked()
+	}
+	if w.Weight <= 0 {
+		w.Weight = 1
+	}
+	if w.MaxLoad <= 0 {
+		w.MaxLoad = defaultMaxLoad
+	}
+	lb.workers = append(lb.workers, w)
+	lb.startHealthLoopLocked(w)
+	return lb.workerStatusLocked(w), true
+}
+
+// workerBusy is returned when a worker with requests in flight is removed
+// without force
+type workerBusy struct {
+	worker   string
+	inFlight int32
+}
 
-	var req struct {
-		Enabled *bool `json:"enabled,omitempty"`
-		Weight  *int  `json:"weight,omitempty"`
+func (e *workerBusy) Error() string {
+	return fmt.Sprintf("Worker %s has %d requests in flight", e.worker, e.inFlight)
+}
+
+// unregisterWorker removes the named worker and its metric series. It
+// refuses with a *workerBusy while the worker has requests in flight unless
+// force is set; those requests still complete. It reports whether the worker
+// existed.
+func (lb *LoadBalancer) unregisterWorker(name string, force bool) (bool, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	for i, w := range lb.workers {
+		if w.Name != name {
+			continue
+		}
+		if n := atomic.LoadInt32(&w.CurrentLoad); n > 0 && !force {
+			return true, &workerBusy{worker: name, inFlight: n}
+		}
+		lb.workers = append(lb.workers[:i:i], lb.workers[i+1:]...)
+		stopHealthLoopLocked(w)
+		// Keep the round-robin cursor on the worker it pointed at
+		if lb.roundRobinIdx > i {
+			lb.roundRobinIdx--
+		}
+		lb.metrics.deleteWorker(name)
+		lb.resourceScores.Delete(name)
+		return true, nil
 	}
+	return false, nil
+}
+
+// WorkerStatuses returns the status of every worker in pool order
+func (lb *LoadBalancer) WorkerStatuses() []api.WorkerStatus {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	out := make([]api.WorkerStatus, 0, len(lb.workers))
+	for _, w := range lb.workers {
+		out = append(out, lb.workerStatusLocked(w))
+	}
+	return out
+}
+
+// CircuitState returns the circuit breaker state of the named worker
+func (lb *LoadBalancer) CircuitState(name string) (api.CircuitState, bool) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	for _, w := range lb.workers {
+		if w.Name == name {
+			s := api.CircuitState{
+				Worker:         w.Name,
+				Open:           w.circuitOpen(),
+				State:          w.circuitStateName(),
+				Healthy:        w.Healthy,
+				ConsecFailures: w.ConsecFailures,
+				Threshold:      lb.circuitThresholdLocked(w),
+			}
+			if w.circuitOpen() {
+				openedAt := w.CircuitOpenedAt.UTC()
+				s.OpenedAt = &openedAt
+				s.CooldownMs = w.circuitCooldown.Milliseconds()
+			}
+			if w.CircuitState == circuitOpen {
+				next := w.nextProbeAt.UTC()
+				s.NextProbeAt = &next
+			}
+			return s, true
+		}
+	}
+	return api.CircuitState{}, false
+}
+
+// handleAddWorker はワーカーをプールに追加する HTTP ハンドラです。
+// 名前と URL は必須で、同名のワーカーが既に存在する場合は 409 を返します。
+func handleAddWorker(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req api.AddWorkerRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
+	if req.Name == "" || req.URL == "" {
+		http.Error(w, "Worker name and url required", http.StatusBadRequest)
+		return
+	}
+	if err := validateWorkerURL(req.URL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var color *string
+	if req.Color != "" {
+		color = &req.Color
+	}
+	if err := validateWorkerMetadata(color, &req.DisplayName, &req.Description, &req.Icon); err != nil {
+		writeMetadataError(w, err.(*MetadataError))
+		return
+	}
+	if err := validateRuntime(req.Runtime); err != nil {
+		writeMetadataError(w, err.(*MetadataError))
+		return
+	}
+	if err := validateHealthPath(req.HealthPath); err != nil {
+		writeMetadataError(w, err.(*MetadataError))
+		return
+	}
 
-	if !lb.UpdateWorker(name, req.Enabled, req.Weight) {
-		http.Error(w, "Worker not found", http.StatusNotFound)
+	status, ok := lb.registerWorker(req)
+	if !ok {
+		http.Error(w, "Worker already exists", http.StatusConflict)
 		return
 	}
+	lb.emitEvent("worker_added", fmt.Sprintf("Worker %s added", req.Name), map[string]interface{}{
+		"worker": req.Name,
+		"url":    req.URL,
+	})
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "updated"})
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(status)
 	lb.BroadcastStatus()
 }
 
+// handleWorkerCircuit はワーカーのサーキットブレーカー状態を返す HTTP ハンドラです。
+func handleWorkerCircuit(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	state, ok := lb.CircuitState(name)
+	if !ok {
+		http.Error(w, "Worker not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
 // handleHealth は HTTP レスポンスとして JSON `{"status":"healthy"}` を 200 OK で返します。
 // レスポンスの Content-Type は "application/json" に設定されます。
 func handleHealth(w http.ResponseWriter, r *http.Request) {
@@ -518,77 +1706,17 @@ func handleWorkerConfig(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid path", http.StatusBadRequest)
 		return
 	}
-	workerName := parts[0]
-
-	// Find worker URL
-	lb.mu.RLock()
-	var workerURL string
-	for _, worker := range lb.workers {
-		if worker.Name == workerName {
-			workerURL = worker.URL
-			break
-		}
-	}
-	lb.mu.RUnlock()
-
-	if workerURL == "" {
-		http.Error(w, "Worker not found", http.StatusNotFound)
-		return
-	}
-
-	// Proxy the request to the worker
-	client := &http.Client{Timeout: 5 * time.Second}
-	var proxyReq *http.Request
-	var err error
-
 	switch r.Method {
 	case http.MethodGet:
-		proxyReq, err = http.NewRequestWithContext(r.Context(), http.MethodGet, workerURL+"/config", nil)
+		proxyToWorker(w, r, parts[0], "/config", nil)
 	case http.MethodPut, http.MethodPost:
-		proxyReq, err = http.NewRequestWithContext(r.Context(), r.Method, workerURL+"/config", r.Body)
-		if proxyReq != nil {
-			proxyReq.Header.Set("Content-Type", "application/json")
-		}
+		proxyToWorker(w, r, parts[0], "/config", r.Body)
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	if err != nil {
-		http.Error(w, "Failed to create request", http.StatusInternalServerError)
-		return
-	}
-
-	resp, err := client.Do(proxyReq)
-	if err != nil {
-		http.Error(w, "Failed to reach worker", http.StatusBadGateway)
-		return
-	}
-	defer resp.Body.Close()
-
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		http.Error(w, "Failed to read worker response", http.StatusBadGateway)
-		return
-	}
-
-	// Try to decode as JSON and add worker field
-	var result map[string]interface{}
-	if err := json.Unmarshal(body, &result); err == nil {
-		result["worker"] = workerName
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(resp.StatusCode)
-		json.NewEncoder(w).Encode(result)
-	} else {
-		// If not JSON, copy raw response
-		if ct := resp.Header.Get("Content-Type"); ct != "" {
-			w.Header().Set("Content-Type", ct)
-		} else {
-			w.Header().Set("Content-Type", "application/octet-stream")
+		if lb.workerURL(parts[0]) == "" {
+			http.Error(w, "Worker not found", http.StatusNotFound)
+			return
 		}
-		w.WriteHeader(resp.StatusCode)
-		w.Write(body)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
@@ -600,16 +1728,21 @@ func handleConfigRanges(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"requests_per_second": map[string]int{"min": 1, "max": 100},
-		"task_weight": map[string]float64{"min": 0.1, "max": 10},
-		"response_delay_ms": map[string]int{"min": 0, "max": 5000},
-		"failure_rate": map[string]int{"min": 0, "max": 100},
+		"requests_per_second":     map[string]int{"min": 1, "max": 100},
+		"task_weight":             map[string]float64{"min": 0.1, "max": 10},
+		"response_delay_ms":       map[string]int{"min": 0, "max": 5000},
+		"failure_rate":            map[string]int{"min": 0, "max": 100},
 		"max_concurrent_requests": map[string]int{"min": 1, "max": 50},
 	})
 }
 
 // handleWebSocket は HTTP 接続を WebSocket にアップグレードし、クライアントを登録して状態を送信し、接続が切断されるまで受信を監視します。
 // クライアントが接続されると現在のロードバランサ状態を JSON で送信し、読み取りエラーが発生した時点でクライアントを登録解除して接続を閉じます。
+// 切断はクライアントからのクローズフレームなら正常、それ以外はエラーとして理由別にメトリクスへ記録されます。
+// /status と同様に ?exclude= で指定したフィールドは以降のブロードキャストでも省略されます。
+// ?session=1 で接続すると再接続用トークンと現在のイベントシーケンス番号が返され、以降のイベントも配信されます。
+// ?resume=<token>&after=<seq> で再接続すると取りこぼしたイベントを再送し、再送できない場合は resyncRequired を通知します。
+// ワーカー数が broadcastSummaryThreshold 以上になるとブロードキャストは要約形式 (broadcastMode: "summary") に切り替わりますが、?full=1 で接続したクライアントには常に全ワーカーを送ります。
 func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -617,19 +1750,16 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	lb.wsClientsMu.Lock()
-	lb.wsClients[conn] = true
-	lb.wsClientsMu.Unlock()
-
-	status := lb.GetStatus()
-	data, _ := json.Marshal(status)
-	conn.WriteMessage(websocket.TextMessage, data)
-
+	// The connection stays with the load balancer it registered with
+	hub := lb
+	q := r.URL.Query()
+	full, _ := strconv.ParseBool(q.Get("full"))
+	hub.addWSClient(conn, parseStatusExclude(q.Get("exclude")), full, parseWSSessionRequest(q))
 	for {
 		if _, _, err := conn.ReadMessage(); err != nil {
-			lb.wsClientsMu.Lock()
-			delete(lb.wsClients, conn)
-			lb.wsClientsMu.Unlock()
+			hub.wsClientsMu.Lock()
+			hub.removeWSClientLocked(conn, wsReadCloseReason(err))
+			hub.wsClientsMu.Unlock()
 			conn.Close()
 			break
 		}
@@ -649,119 +1779,357 @@ func corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// getEnv は環境変数 key の値を返し、未設定または空の場合は defaultVal を返します。
+func getEnv(key, defaultVal string) string {
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+	return defaultVal
+}
+
 // main はロードバランサーを初期化し、ワーカー構成を環境変数から読み込んでバックグラウンド処理を開始し、HTTP サーバを起動してグレースフルシャットダウンを管理します.
 // 環境変数 LB_ALGORITHM でアルゴリズムを設定し、個々の WORKER_*_URL と任意の <WORKER_NAME>_WEIGHT に基づいてワーカーを追加します。
 // また、ヘルスチェックとステータスのブロードキャストをバックグラウンドで開始し、/task、/status、/algorithm、/health、/ws、/workers/*、/metrics の各ハンドラを登録してリクエストを処理します。
 // SIGINT/SIGTERM を受け取るとバックグラウンド処理を停止し、30秒のタイムアウトで HTTP サーバを順次停止します。
-func main() {
-	lb = NewLoadBalancer()
-
-	if algo := os.Getenv("LB_ALGORITHM"); algo != "" {
-		lb.SetAlgorithm(algo)
-	}
-
-	workerConfigs := []struct {
-		envVar  string
-		name    string
-		color   string
-		weight  int
-		maxLoad int
-	}{
-		{"WORKER_GO_1_URL", "go-worker-1", "#3B82F6", 5, 3},
-		{"WORKER_GO_2_URL", "go-worker-2", "#6366F1", 2, 3},
-		{"WORKER_RUST_1_URL", "rust-worker-1", "#F97316", 6, 3},
-		{"WORKER_RUST_2_URL", "rust-worker-2", "#EAB308", 1, 3},
-		{"WORKER_PYTHON_1_URL", "python-worker-1", "#10B981", 1, 3},
-		{"WORKER_PYTHON_2_URL", "python-worker-2", "#14B8A6", 3, 3},
-	}
-
-	for _, cfg := range workerConfigs {
-		if url := os.Getenv(cfg.envVar); url != "" {
-			// Check for weight override from environment
-			weightEnvKey := strings.ToUpper(strings.ReplaceAll(cfg.name, "-", "_")) + "_WEIGHT"
-			weight := cfg.weight
-			if wStr := os.Getenv(weightEnvKey); wStr != "" {
-				if w, err := strconv.Atoi(wStr); err == nil && w > 0 {
-					weight = w
-				}
-			}
-			lb.AddWorker(cfg.name, url, cfg.color, weight, cfg.maxLoad)
-			log.Printf("Added worker: %s -> %s (weight=%d, maxLoad=%d)", cfg.name, url, weight, cfg.maxLoad)
-		}
-	}
-
-	// Create cancellable context for graceful shutdown
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	// Start background goroutines with cancellable context
-	go lb.HealthCheck(ctx, 5*time.Second)
-	go lb.StartBroadcast(ctx, 1*time.Second)
-
+// newMux builds the LB's HTTP routes
+func newMux() *http.ServeMux {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/task", handleTask)
-	mux.HandleFunc("/api/task", handleTask)
+	mux.Handle("/task", rateLimitMiddleware(http.HandlerFunc(handleTask)))
+	mux.Handle("/api/task", rateLimitMiddleware(http.HandlerFunc(handleTask)))
 	mux.HandleFunc("/status", handleStatus)
 	mux.HandleFunc("/api/status", handleStatus)
 	mux.HandleFunc("/algorithm", handleAlgorithm)
 	mux.HandleFunc("/api/algorithm", handleAlgorithm)
+	mux.HandleFunc("/algorithm/report", handleAlgorithmReport)
+	mux.HandleFunc("/api/algorithm/report", handleAlgorithmReport)
+	mux.HandleFunc("/algorithm/lru-worker", handleLRUWorkerConfig)
+	mux.HandleFunc("/api/algorithm/lru-worker", handleLRUWorkerConfig)
 	mux.HandleFunc("/health", handleHealth)
 	mux.HandleFunc("/api/health", handleHealth)
+	mux.HandleFunc("/settings", handleSettings)
+	mux.HandleFunc("/api/settings", handleSettings)
+	mux.HandleFunc("/broadcast/now", handleBroadcastNow)
+	mux.HandleFunc("/api/broadcast/now", handleBroadcastNow)
+	mux.HandleFunc("/healthcheck/now", handleHealthCheckNow)
+	mux.HandleFunc("/api/healthcheck/now", handleHealthCheckNow)
+	mux.HandleFunc("/rolling-restart", handleRollingRestart)
+	mux.HandleFunc("/api/rolling-restart", handleRollingRestart)
+	mux.HandleFunc("/experiments", handleExperiments)
+	mux.HandleFunc("/api/experiments", handleExperiments)
+	mux.HandleFunc("/experiments/current", handleCurrentExperiment)
+	mux.HandleFunc("/api/experiments/current", handleCurrentExperiment)
+	mux.HandleFunc("/header-rules", handleHeaderRules)
+	mux.HandleFunc("/api/header-rules", handleHeaderRules)
+	mux.HandleFunc("/snapshot", handleSnapshots)
+	mux.HandleFunc("/api/snapshot", handleSnapshots)
+	mux.HandleFunc("/snapshot/", handleSnapshot)
+	mux.HandleFunc("/api/snapshot/", handleSnapshot)
+	mux.HandleFunc("/transaction", handleTransaction)
+	mux.HandleFunc("/api/transaction", handleTransaction)
+	mux.HandleFunc("/timeseries", handleTimeseries)
+	mux.HandleFunc("/api/timeseries", handleTimeseries)
+	mux.HandleFunc("/heatmap", handleHeatmap)
+	mux.HandleFunc("/api/heatmap", handleHeatmap)
+	mux.HandleFunc("/stats", handleStats)
+	mux.HandleFunc("/api/stats", handleStats)
+	mux.HandleFunc("/stats/tags", handleTagStats)
+	mux.HandleFunc("/api/stats/tags", handleTagStats)
+	mux.HandleFunc("/summary/by-runtime", handleRuntimeSummary)
+	mux.HandleFunc("/api/summary/by-runtime", handleRuntimeSummary)
+	mux.HandleFunc("/sessions", handleSessions)
+	mux.HandleFunc("/api/sessions", handleSessions)
+	mux.HandleFunc("/sessions/", handleSession)
+	mux.HandleFunc("/api/sessions/", handleSession)
+	mux.HandleFunc("/compare", handleCompare)
+	mux.HandleFunc("/api/compare", handleCompare)
+	mux.HandleFunc("/journal/status", handleJournalStatus)
+	mux.HandleFunc("/api/journal/status", handleJournalStatus)
+	mux.HandleFunc("/capacity", handleCapacity)
+	mux.HandleFunc("/api/capacity", handleCapacity)
+	mux.HandleFunc("/ratelimit/shares", handleRateLimitShares)
+	mux.HandleFunc("/api/ratelimit/shares", handleRateLimitShares)
+	mux.HandleFunc("/selftest", handleSelfTest)
+	mux.HandleFunc("/api/selftest", handleSelfTest)
+	mux.HandleFunc("/events", handleEvents)
+	mux.HandleFunc("/api/events", handleEvents)
+	mux.HandleFunc("/annotations", handleAnnotations)
+	mux.HandleFunc("/api/annotations", handleAnnotations)
+	mux.HandleFunc("/debug/resources", handleDebugResources)
+	mux.HandleFunc("/debug/cleanup", handleDebugCleanup)
+	mux.HandleFunc("/debug/phases", handleDebugPhases)
+	mux.HandleFunc("/startup-report", handleStartupReport)
+	mux.HandleFunc("/api/startup-report", handleStartupReport)
+	mux.HandleFunc("/sandbox/health", handleSandboxHealth)
+	mux.HandleFunc("/api/sandbox/health", handleSandboxHealth)
 	mux.HandleFunc("/api/config/ranges", handleConfigRanges)
 	mux.HandleFunc("/ws", handleWebSocket)
 	mux.HandleFunc("/api/ws", handleWebSocket)
+	mux.HandleFunc("/ws/clients", handleWSClients)
+	mux.HandleFunc("/api/ws/clients", handleWSClients)
+	mux.HandleFunc("/workers", handleAddWorker)
+	mux.HandleFunc("/api/workers", handleAddWorker)
 	// Worker routes - use segment matching for safety
 	mux.HandleFunc("/workers/", func(w http.ResponseWriter, r *http.Request) {
 		// Route based on path segments to avoid misrouting worker names containing "config"
 		path := strings.TrimPrefix(r.URL.Path, "/workers/")
 		parts := strings.Split(strings.TrimSuffix(path, "/"), "/")
-		if len(parts) == 2 && parts[1] == "config" {
+		switch {
+		case len(parts) == 1 && parts[0] == "config" && (r.Method == http.MethodPut || r.Method == http.MethodPost):
+			// A pool-wide push; GET still reaches a worker named "config"
+			handleWorkersConfig(w, r)
+		case len(parts) == 2 && parts[1] == "config":
 			handleWorkerConfig(w, r)
-		} else {
+		case len(parts) == 2 && parts[1] == "circuit":
+			handleWorkerCircuit(w, r, parts[0])
+		case len(parts) == 2 && parts[1] == "schedule":
+			handleWorkerSchedule(w, r, parts[0])
+		case len(parts) == 2 && parts[1] == "logs":
+			handleWorkerLogs(w, r, parts[0])
+		case len(parts) == 2 && parts[1] == "rename":
+			handleWorkerRename(w, r, parts[0])
+		case len(parts) == 2 && parts[1] == "replay":
+			handleWorkerReplay(w, r, parts[0])
+		case len(parts) == 2 && parts[1] == "schema":
+			handleWorkerSchema(w, r, parts[0])
+		default:
 			handleWorker(w, r)
 		}
 	})
 	mux.HandleFunc("/api/workers/", func(w http.ResponseWriter, r *http.Request) {
 		path := strings.TrimPrefix(r.URL.Path, "/api/workers/")
 		parts := strings.Split(strings.TrimSuffix(path, "/"), "/")
-		if len(parts) == 2 && parts[1] == "config" {
+		switch {
+		case len(parts) == 1 && parts[0] == "config" && (r.Method == http.MethodPut || r.Method == http.MethodPost):
+			// A pool-wide push; GET still reaches a worker named "config"
+			handleWorkersConfig(w, r)
+		case len(parts) == 2 && parts[1] == "config":
 			handleWorkerConfig(w, r)
-		} else {
+		case len(parts) == 2 && parts[1] == "circuit":
+			handleWorkerCircuit(w, r, parts[0])
+		case len(parts) == 2 && parts[1] == "schedule":
+			handleWorkerSchedule(w, r, parts[0])
+		case len(parts) == 2 && parts[1] == "logs":
+			handleWorkerLogs(w, r, parts[0])
+		case len(parts) == 2 && parts[1] == "rename":
+			handleWorkerRename(w, r, parts[0])
+		case len(parts) == 2 && parts[1] == "replay":
+			handleWorkerReplay(w, r, parts[0])
+		case len(parts) == 2 && parts[1] == "schema":
+			handleWorkerSchema(w, r, parts[0])
+		default:
 			handleWorker(w, r)
 		}
 	})
-	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/metrics", lb.MetricsHandler())
+	mux.HandleFunc("/metrics/workers", handleWorkerMetrics)
+	return mux
+}
+
+func main() {
+	var listen listenFlags
+	flag.Var(&listen, "listen", "address to listen on (host:port, IPv6 hosts in brackets); repeatable, overrides "+listenAddrsEnvVar)
+	flag.Parse()
+
+	lb = NewLoadBalancerWithRegistry(getEnv("LB_ALGORITHM", "round-robin"), prometheus.DefaultRegisterer, prometheus.DefaultGatherer)
+
+	generic, errs := parseWorkers(os.Getenv(workersEnvVar))
+	for _, err := range errs {
+		log.Printf("Warning: skipping worker: %v", err)
+	}
+	legacy := legacyWorkerDefs(os.Getenv, log.Printf)
+	workerConfigs, overridden := mergeWorkerDefs(legacy, generic)
+	for _, name := range overridden {
+		log.Printf("Warning: %s defines %s, overriding its legacy env vars", workersEnvVar, name)
+	}
+	log.Printf("Loaded %d workers: %d from %s, %d from legacy env vars", len(workerConfigs), len(generic), workersEnvVar, len(legacy)-len(overridden))
+
+	// Optionally shuffle the add order; LB_SEED makes the order reproducible
+	if getEnv("LB_SHUFFLE_WORKERS", "false") == "true" {
+		seed := time.Now().UnixNano()
+		if v, err := strconv.ParseInt(getEnv("LB_SEED", ""), 10, 64); err == nil {
+			seed = v
+		}
+		rng := rand.New(rand.NewSource(seed))
+		rng.Shuffle(len(workerConfigs), func(i, j int) {
+			workerConfigs[i], workerConfigs[j] = workerConfigs[j], workerConfigs[i]
+		})
+		log.Printf("Shuffled worker add order (seed %d)", seed)
+	}
+
+	for _, cfg := range workerConfigs {
+		status, _ := lb.registerWorker(cfg)
+		log.Printf("Added worker: %s -> %s (weight=%d, maxLoad=%d)", status.Name, status.URL, status.Weight, status.MaxLoad)
+	}
+
+	lb.metrics.buildInfo.WithLabelValues(version, lb.instanceID).Set(1)
+	log.Printf("Load balancer %s (version %s)", lb.instanceID, version)
+
+	// Synthetic probe traffic (also adjustable at runtime via /settings)
+	if getEnv("LB_PROBE_ENABLED", "false") == "true" {
+		lb.probeEnabled = true
+	}
+	if rps, err := strconv.ParseFloat(getEnv("LB_PROBE_RPS", ""), 64); err == nil && rps > 0 && rps <= maxProbeRps {
+		lb.probeRps = rps
+	}
+	if ms, err := strconv.ParseInt(getEnv("LB_UPSTREAM_TIMEOUT_MS", ""), 10, 64); err == nil && ms > 0 {
+		lb.upstreamTimeout = time.Duration(ms) * time.Millisecond
+	}
+	if n, err := strconv.ParseInt(getEnv("LB_MAX_UPSTREAM_BODY_BYTES", ""), 10, 64); err == nil && n >= minMaxUpstreamBodyBytes {
+		lb.maxUpstreamBody = n
+	}
+	lb.bodyTooLargeTrips = getEnv("LB_BODY_TOO_LARGE_TRIPS_CIRCUIT", "false") == "true"
+	if mode := getEnv("LB_MALFORMED_RESPONSE_MODE", ""); validMalformedMode(mode) {
+		lb.malformedMode = mode
+	}
+	lb.malformedTrips = getEnv("LB_MALFORMED_TRIPS_CIRCUIT", "false") == "true"
+	if ms, err := strconv.ParseInt(getEnv("LB_CIRCUIT_RESET_INTERVAL_MS", ""), 10, 64); err == nil && ms >= 1 {
+		lb.circuitResetInterval = time.Duration(ms) * time.Millisecond
+	}
+	// LB_CIRCUIT_COOLDOWN is the same knob as a duration ("10s")
+	if d, err := time.ParseDuration(getEnv("LB_CIRCUIT_COOLDOWN", "")); err == nil && d >= time.Millisecond {
+		lb.circuitResetInterval = d
+	}
+	if d, err := time.ParseDuration(getEnv("LB_CIRCUIT_MAX_COOLDOWN", "")); err == nil && d >= lb.circuitResetInterval {
+		lb.circuitMaxCooldown = d
+	}
+	if lb.circuitMaxCooldown < lb.circuitResetInterval {
+		lb.circuitMaxCooldown = lb.circuitResetInterval
+	}
+	if d, err := time.ParseDuration(getEnv("LB_MAX_HEALTH_BACKOFF", "")); err == nil && d >= 0 {
+		lb.maxHealthBackoff = d
+	}
+	if d, err := time.ParseDuration(getEnv("LB_RESOURCE_CHECK_TTL", "")); err == nil && d >= 0 {
+		lb.resourceCheckTTL = d
+	}
+	if n, err := strconv.Atoi(getEnv("LB_BROADCAST_SUMMARY_THRESHOLD", "")); err == nil && n >= 0 {
+		lb.broadcastSummaryThreshold = n
+	}
+	if n, err := strconv.Atoi(getEnv("LB_BROADCAST_TOP_N", "")); err == nil && n >= 0 {
+		lb.broadcastTopN = n
+	}
+	if mode := getEnv("LB_IDENTITY_CHECK", ""); validIdentityMode(mode) {
+		lb.identityMode = mode
+	}
+	if detail := getEnv("LB_RESPONSE_DETAIL", ""); validResponseDetail(detail) {
+		lb.defaultDetail = detail
+	}
+	if f, err := strconv.ParseFloat(getEnv("LB_DISTRIBUTION_THRESHOLD", ""), 64); err == nil && f > 0 {
+		lb.distributionThreshold = f
+	}
+	if n, err := strconv.ParseInt(getEnv("LB_DISTRIBUTION_MIN_REQUESTS", ""), 10, 64); err == nil && n >= 1 {
+		lb.distributionMinRequests = n
+	}
+	if ms, err := strconv.ParseInt(getEnv("LB_SLOW_REQUEST_MS", ""), 10, 64); err == nil && ms >= 0 {
+		lb.slowRequest = time.Duration(ms) * time.Millisecond
+	}
+	if n, err := strconv.Atoi(getEnv("LB_PHASE_SAMPLE_RATE", "")); err == nil && n >= 0 {
+		lb.phases.configure(n)
+	}
+	ceiling, window := lb.rateLimit.config()
+	if rps, err := strconv.ParseFloat(getEnv("LB_RATE_CEILING_RPS", ""), 64); err == nil && rps >= 0 {
+		ceiling = rps
+	}
+	if d, err := time.ParseDuration(getEnv("LB_RATE_WINDOW", "")); err == nil && d >= minRateWindow && d <= maxRateWindow {
+		window = d
+	}
+	lb.rateLimit.configure(ceiling, window)
+	if proxies, err := parseTrustedProxies(getEnv("LB_TRUSTED_PROXIES", "")); err == nil {
+		lb.trustedProxies = proxies
+	} else {
+		log.Printf("Ignoring LB_TRUSTED_PROXIES: %v", err)
+	}
+	ipRPS, ipBurst := lb.ipLimit.config()
+	if rps, err := strconv.ParseFloat(getEnv("LB_RATE_LIMIT_RPS", ""), 64); err == nil && rps >= 0 {
+		ipRPS = rps
+	}
+	if n, err := strconv.Atoi(getEnv("LB_RATE_LIMIT_BURST", "")); err == nil && n > 0 {
+		ipBurst = n
+	}
+	lb.ipLimit.configure(ipRPS, ipBurst)
+	lb.retryQueueFull = getEnv("LB_RETRY_ON_QUEUE_FULL", "true") == "true"
+	lb.retryOverloaded = getEnv("LB_RETRY_ON_OVERLOADED", "false") == "true"
+	if n, err := strconv.Atoi(getEnv("LB_MAX_RETRIES", "")); err == nil && n >= 0 && n <= maxTaskRetries {
+		lb.maxRetries = n
+	}
+	if ms, err := strconv.ParseInt(getEnv("LB_ALGORITHM_WARMUP_MS", ""), 10, 64); err == nil && ms >= 0 {
+		lb.sessions.warmup = time.Duration(ms) * time.Millisecond
+	}
+	if ms, err := strconv.ParseInt(getEnv(wsSessionIdleEnvVar, ""), 10, 64); err == nil && ms > 0 {
+		lb.wsSessions.idle = time.Duration(ms) * time.Millisecond
+	}
+	if ms, err := strconv.ParseInt(getEnv(workerMetricsCacheEnvVar, ""), 10, 64); err == nil && ms >= 0 {
+		lb.workerMetrics.ttl = time.Duration(ms) * time.Millisecond
+	}
+	if path := getEnv(snapshotFileEnvVar, ""); path != "" {
+		if err := lb.snapshots.load(path); err != nil {
+			log.Printf("Ignoring %s: %v", snapshotFileEnvVar, err)
+		}
+	}
+
+	// Create cancellable context for graceful shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8000"
+	// Optionally verify the pool once it is configured, before serving traffic
+	if getEnv("STARTUP_VERIFY", "false") == "true" {
+		report, err := lb.VerifyPool(ctx, getEnv("STARTUP_VERIFY_STRICT", "false") == "true")
+		logStartupReport(report)
+		if err != nil {
+			log.Fatalf("Exiting: %v", err)
+		}
 	}
 
-	handler := corsMiddleware(mux)
+	// Start background goroutines with cancellable context
+	go lb.HealthCheck(ctx, defaultHealthInterval)
+	go lb.StartCleanup(ctx, defaultCleanupInterval)
+	go lb.StartSampler(ctx)
+	go lb.StartProber(ctx)
+	go lb.StartFairness(ctx)
+	go lb.StartVerifier(ctx)
+	go lb.StartScheduler(ctx)
+	go lb.StartBroadcast(ctx, defaultBroadcastInterval)
+	go lb.StartShedder(ctx)
+
+	mux := newMux()
 
-	server := &http.Server{
-		Addr:    fmt.Sprintf(":%s", port),
-		Handler: handler,
+	handler := newHandler(mux)
+
+	addrs, err := resolveListenAddrs(listen, os.Getenv(listenAddrsEnvVar), getEnv("PORT", "8000"))
+	if err != nil {
+		log.Fatalf("Invalid listen configuration: %v", err)
 	}
+	servers, err := listenAll(addrs, handler)
+	if err != nil {
+		log.Fatalf("Exiting: %v", err)
+	}
+	lb.setListenAddrs(servers.Addrs())
 
 	// Handle shutdown signals
+	stopped := make(chan struct{})
 	go func() {
+		defer close(stopped)
 		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 		<-sigChan
 		log.Println("Received shutdown signal, stopping...")
+		lb.shuttingDown.Store(true)
 		cancel() // Stop HealthCheck and StartBroadcast goroutines
 
 		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer shutdownCancel()
-		if err := server.Shutdown(shutdownCtx); err != nil {
+		if err := servers.Shutdown(shutdownCtx); err != nil {
 			log.Printf("HTTP server shutdown error: %v", err)
 		}
+		lb.stopControl()
+		if err := lb.journal.Flush(shutdownCtx); err != nil {
+			log.Printf("Journal flush error: %v", err)
+		}
 	}()
 
-	log.Printf("Load balancer starting on port %s with algorithm %s", port, lb.algorithm)
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	log.Printf("Load balancer listening on %s with algorithm %s", strings.Join(servers.Addrs(), ", "), lb.algorithm)
+	if err := servers.Serve(); err != nil {
 		log.Fatal(err)
 	}
+	<-stopped
 	log.Println("Load balancer stopped")
 }
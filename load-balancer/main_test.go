@@ -2,17 +2,21 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"io"
+	"fmt"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
-	"strings"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/network-sandbox/load-balancer/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestNewLoadBalancer(t *testing.T) {
@@ -84,7 +88,7 @@ func TestGetHealthyWorkers(t *testing.T) {
 	lb.workers[1].Healthy = false
 
 	// Open circuit for worker-3
-	lb.workers[2].CircuitOpen = true
+	lb.openCircuitLocked(lb.workers[2])
 
 	healthy := lb.getHealthyWorkers()
 
@@ -125,6 +129,58 @@ func TestRoundRobinSelection(t *testing.T) {
 	}
 }
 
+func TestRoundRobinAcrossMembershipChanges(t *testing.T) {
+	lb := NewLoadBalancer("round-robin")
+	t.Cleanup(lb.stopControl)
+	for i := 1; i <= 3; i++ {
+		lb.AddWorker(fmt.Sprintf("worker-%d", i), "http://localhost:8081", "", 1)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	var last *Worker
+	pick := func() *Worker {
+		w := lb.SelectWorker()
+		if w == nil {
+			return nil
+		}
+		if w == last && len(lb.getHealthyWorkers()) > 1 {
+			t.Fatalf("%s selected twice in a row while others were eligible", w.Name)
+		}
+		last = w
+		return w
+	}
+
+	for step := 0; step < 500; step++ {
+		// Change the eligible set, then stop mid-cycle so the next change
+		// lands with the cursor somewhere inside the pool
+		switch n := len(lb.workers); {
+		case n < 8 && rng.Intn(5) == 0:
+			lb.AddWorker(fmt.Sprintf("worker-%d", n+1), "http://localhost:8081", "", 1)
+		default:
+			w := lb.workers[rng.Intn(n)]
+			enabled := !w.Enabled
+			lb.UpdateWorker(w.Name, &enabled, nil)
+		}
+		for i := rng.Intn(4); i > 0; i-- {
+			pick()
+		}
+
+		// Over one full cycle every eligible worker is picked exactly once
+		eligible := lb.getHealthyWorkers()
+		counts := make(map[string]int)
+		for range eligible {
+			if w := pick(); w != nil {
+				counts[w.Name]++
+			}
+		}
+		for _, w := range eligible {
+			if counts[w.Name] != 1 {
+				t.Fatalf("step %d: counts over a cycle of %d = %v, want each eligible worker once", step, len(eligible), counts)
+			}
+		}
+	}
+}
+
 func TestLeastConnectionsSelection(t *testing.T) {
 	lb := NewLoadBalancer("least-connections")
 	lb.AddWorker("worker-1", "http://localhost:8081", "#FF0000", 1)
@@ -244,7 +300,7 @@ func TestCircuitBreaker(t *testing.T) {
 		lb.recordFailure(worker)
 	}
 
-	if !worker.CircuitOpen {
+	if !worker.circuitOpen() {
 		t.Error("circuit should be open after threshold failures")
 	}
 }
@@ -466,7 +522,7 @@ func TestCORSMiddleware(t *testing.T) {
 		t.Error("CORS header not set correctly")
 	}
 
-	if w.Header().Get("Access-Control-Allow-Methods") != "GET, POST, PUT, OPTIONS" {
+	if w.Header().Get("Access-Control-Allow-Methods") != "GET, POST, PUT, PATCH, DELETE, OPTIONS" {
 		t.Error("CORS methods header not set correctly")
 	}
 
@@ -671,7 +727,7 @@ func TestWorkerRequestCounters(t *testing.T) {
 func TestCircuitBreakerRecovery(t *testing.T) {
 	lb := NewLoadBalancer("round-robin")
 	lb.circuitThreshold = 2
-	lb.circuitRecovery = 50 * time.Millisecond
+	lb.circuitResetInterval = 50 * time.Millisecond
 	lb.AddWorker("test-worker", "http://localhost:8080", "#FF0000", 1)
 
 	worker := lb.workers[0]
@@ -681,7 +737,7 @@ func TestCircuitBreakerRecovery(t *testing.T) {
 		lb.recordFailure(worker)
 	}
 
-	if !worker.CircuitOpen {
+	if !worker.circuitOpen() {
 		t.Error("circuit should be open")
 	}
 
@@ -807,4 +863,182 @@ func TestWorkerWithZeroWeight(t *testing.T) {
 	if selected.Name == "worker-1" && lb.workers[1].Weight > 0 {
 		t.Error("worker with 0 weight should not be selected when others have weight")
 	}
-}
\ No newline at end of file
+}
+
+func TestForwardDeadlineBudgetFastFail(t *testing.T) {
+	var gotBudget string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Mirrors the Go worker: a 800ms task cannot fit the budget
+		gotBudget = r.Header.Get(deadlineHeader)
+		budget, _ := strconv.Atoi(gotBudget)
+		if budget < 800 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusGatewayTimeout)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Deadline budget exceeded", "reason": "deadline_exceeded"})
+			return
+		}
+		time.Sleep(800 * time.Millisecond)
+	}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer("round-robin")
+	lb.upstreamTimeout = 500 * time.Millisecond
+	lb.AddWorker("worker-1", backend.URL, "#FF0000", 1)
+	before := testutil.ToFloat64(lb.metrics.requestsTotal.WithLabelValues("worker-1", "timeout"))
+
+	start := time.Now()
+	_, code, err := lb.forwardTask(context.Background(), TaskRequest{ID: "t1", Weight: 1}, time.Now().Add(-100*time.Millisecond))
+	if time.Since(start) > 300*time.Millisecond {
+		t.Errorf("fast-fail took %v", time.Since(start))
+	}
+
+	if err == nil || code != http.StatusGatewayTimeout {
+		t.Fatalf("code = %d, err = %v, want 504", code, err)
+	}
+	if budget, _ := strconv.Atoi(gotBudget); budget <= 0 || budget > 400 {
+		t.Errorf("propagated budget = %q, want remaining budget after 100ms queueing", gotBudget)
+	}
+	worker := lb.workers[0]
+	if worker.FailedRequests != 1 {
+		t.Errorf("failedRequests = %d, want 1", worker.FailedRequests)
+	}
+	if worker.ConsecFailures != 0 {
+		t.Errorf("consecFailures = %d, worker fast-fail should not count towards the circuit", worker.ConsecFailures)
+	}
+	if got := testutil.ToFloat64(lb.metrics.requestsTotal.WithLabelValues("worker-1", "timeout")) - before; got != 1 {
+		t.Errorf("timeout requests = %v, want 1", got)
+	}
+}
+
+func TestForwardDeadlineExpiredBeforeForwarding(t *testing.T) {
+	var called int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&called, 1)
+	}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer("round-robin")
+	lb.upstreamTimeout = 50 * time.Millisecond
+	lb.AddWorker("worker-1", backend.URL, "#FF0000", 1)
+
+	_, code, _ := lb.forwardTask(context.Background(), TaskRequest{ID: "t1"}, time.Now().Add(-time.Second))
+	if code != http.StatusGatewayTimeout {
+		t.Errorf("code = %d, want %d", code, http.StatusGatewayTimeout)
+	}
+	if atomic.LoadInt32(&called) != 0 {
+		t.Error("worker should not be called once the budget is spent")
+	}
+}
+
+func patchWorker(name, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodPatch, "/api/workers/"+name, bytes.NewBufferString(body)))
+	return rec
+}
+
+func TestPatchWorkerValidatesBeforeApplying(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", "http://localhost:8081", "#FF0000", 3)
+
+	tests := []struct {
+		name  string
+		path  string
+		body  string
+		field string
+	}{
+		{"zero weight", "worker-1", `{"enabled":false,"weight":0}`, "weight"},
+		{"negative weight", "worker-1", `{"enabled":false,"weight":-2}`, "weight"},
+		{"invalid color", "worker-1", `{"weight":5,"color":"red"}`, "color"},
+		{"wrong type", "worker-1", `{"weight":5,"enabled":"no"}`, "body"},
+		{"unknown field in strict mode", "worker-1?strict=true", `{"weight":5,"wieght":6}`, "body"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := patchWorker(tt.path, tt.body)
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status code = %d, want %d", rec.Code, http.StatusBadRequest)
+			}
+			var resp struct{ Field string }
+			json.NewDecoder(rec.Body).Decode(&resp)
+			if resp.Field != tt.field {
+				t.Errorf("field = %q, want %q", resp.Field, tt.field)
+			}
+			if w := lb.workers[0]; !w.Enabled || w.Weight != 3 || w.revision != 0 {
+				t.Errorf("worker changed by rejected patch: enabled=%v weight=%d revision=%d", w.Enabled, w.Weight, w.revision)
+			}
+		})
+	}
+
+	// Unknown fields are ignored outside strict mode
+	if rec := patchWorker("worker-1", `{"weight":5,"wieght":6}`); rec.Code != http.StatusOK {
+		t.Errorf("lenient patch: status code = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestPatchWorkerReturnsUpdatedWorker(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	t.Cleanup(lb.stopControl)
+	lb.AddWorker("worker-1", "http://localhost:8081", "#FF0000", 1)
+
+	rec := patchWorker("worker-1", `{"enabled":false,"weight":4,"displayName":"Primary"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status code = %d, body %s", rec.Code, rec.Body.String())
+	}
+	var got api.WorkerStatus
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "worker-1" || got.Enabled || got.Weight != 4 || got.DisplayName != "Primary" || got.Color != "#FF0000" || got.Revision != 1 {
+		t.Errorf("patched worker = %+v", got)
+	}
+
+	workers := lb.GetStatus()["workers"].([]map[string]interface{})
+	if workers[0]["revision"] != int64(1) {
+		t.Errorf("status revision = %v, want 1", workers[0]["revision"])
+	}
+	if rec := patchWorker("nope", `{"weight":2}`); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown worker: status code = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestPatchWorkerRevisionUnderConcurrency(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", "http://localhost:8081", "#FF0000", 1)
+
+	const patches = 50
+	revisions := make(chan api.WorkerStatus, patches)
+	var wg sync.WaitGroup
+	for i := 1; i <= patches; i++ {
+		wg.Add(1)
+		go func(weight int) {
+			defer wg.Done()
+			rec := patchWorker("worker-1", `{"weight":`+strconv.Itoa(weight)+`}`)
+			var s api.WorkerStatus
+			json.NewDecoder(rec.Body).Decode(&s)
+			revisions <- s
+		}(i)
+	}
+	wg.Wait()
+	close(revisions)
+
+	// Every patch gets its own revision and reports the weight it applied
+	seen := make(map[int64]bool)
+	var last api.WorkerStatus
+	for s := range revisions {
+		if seen[s.Revision] {
+			t.Errorf("revision %d returned twice", s.Revision)
+		}
+		seen[s.Revision] = true
+		if s.Revision > last.Revision {
+			last = s
+		}
+	}
+	for r := int64(1); r <= patches; r++ {
+		if !seen[r] {
+			t.Errorf("revision %d missing", r)
+		}
+	}
+	if w := lb.workers[0]; w.revision != patches || w.Weight != last.Weight {
+		t.Errorf("final revision=%d weight=%d, want %d and the weight of the last patch (%d)", w.revision, w.Weight, patches, last.Weight)
+	}
+}
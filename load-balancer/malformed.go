@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// Malformed response modes: what the LB does with a 2xx task response whose
+// body is not a JSON object
+const (
+	// malformedLenient answers with {} plus the LB fields
+	malformedLenient = "lenient"
+	// malformedStrict fails the task with 502
+	malformedStrict = "strict"
+	// malformedPassthrough forwards the body as is, with the LB fields in
+	// headers
+	malformedPassthrough = "passthrough"
+)
+
+// maxMalformedSample bounds the part of a malformed body kept for status
+const maxMalformedSample = 256
+
+// Headers carrying the LB fields of a passed-through response
+const (
+	workerHeader         = "X-LB-Worker"
+	workerColorHeader    = "X-LB-Worker-Color"
+	processingTimeHeader = "X-LB-Processing-Time-Ms"
+	upstreamTotalHeader  = "X-LB-Upstream-Total-Ms"
+	retriesHeader        = "X-LB-Retries"
+)
+
+// malformedOutcome is the request and journal outcome of a task failed in
+// strict mode
+const malformedOutcome = "malformed_response"
+
+// MalformedSummary is a worker's count of malformed responses and a sample
+// of the last one
+type MalformedSummary = api.MalformedSummary
+
+// malformedLog counts a worker's malformed responses
+type malformedLog struct {
+	mu     sync.Mutex
+	count  int64
+	sample string
+	at     time.Time
+}
+
+func (l *malformedLog) record(body []byte, at time.Time) {
+	sample := body
+	if len(sample) > maxMalformedSample {
+		sample = sample[:maxMalformedSample]
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.count++
+	l.sample = strings.ToValidUTF8(string(sample), "")
+	l.at = at.UTC()
+}
+
+// snapshot returns the summary, or nil if the worker never sent a malformed
+// response
+func (l *malformedLog) snapshot() *MalformedSummary {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.count == 0 {
+		return nil
+	}
+	return &MalformedSummary{Count: l.count, LastSample: l.sample, LastAt: l.at}
+}
+
+// malformedResponse is returned by forwardTo in strict mode
+type malformedResponse struct {
+	worker string
+}
+
+func (e *malformedResponse) Error() string {
+	return "Worker " + e.worker + " returned a malformed response"
+}
+
+// passthroughResponse is a malformed body forwarded as is, with the LB
+// fields that would have been added to it
+type passthroughResponse struct {
+	contentType      string
+	worker           string
+	workerColor      string
+	processingTimeMs int
+	upstreamTotalMs  int64
+	retries          int
+}
+
+type passthroughKey struct{}
+
+// withPassthrough returns ctx carrying p, which forwardTo fills when it
+// passes a malformed body through
+func withPassthrough(ctx context.Context, p *passthroughResponse) context.Context {
+	return context.WithValue(ctx, passthroughKey{}, p)
+}
+
+// setPassthrough fills the passthroughResponse carried by ctx and reports
+// whether there was one
+func setPassthrough(ctx context.Context, p passthroughResponse) bool {
+	dst, ok := ctx.Value(passthroughKey{}).(*passthroughResponse)
+	if ok {
+		*dst = p
+	}
+	return ok
+}
+
+// writeHeaders sets the content type and LB field headers of a
+// passed-through response. It does nothing if nothing was passed through.
+func (p *passthroughResponse) writeHeaders(h http.Header) {
+	if p.worker == "" {
+		return
+	}
+	if p.contentType != "" {
+		h.Set("Content-Type", p.contentType)
+	} else {
+		h.Del("Content-Type")
+	}
+	h.Set(workerHeader, p.worker)
+	h.Set(workerColorHeader, p.workerColor)
+	h.Set(processingTimeHeader, strconv.Itoa(p.processingTimeMs))
+	h.Set(upstreamTotalHeader, strconv.FormatInt(p.upstreamTotalMs, 10))
+	h.Set(retriesHeader, strconv.Itoa(p.retries))
+}
+
+// validMalformedMode reports whether mode is a malformed response mode
+func validMalformedMode(mode string) bool {
+	switch mode {
+	case malformedLenient, malformedStrict, malformedPassthrough:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/network-sandbox/load-balancer/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const htmlErrorPage = "<html><body><h1>Internal Server Error</h1>" + "padding padding padding padding padding padding padding padding padding padding padding padding padding padding padding padding padding padding padding padding padding padding padding padding padding padding padding padding" + "</body></html>"
+
+func newMalformedLB(t *testing.T, mode string, trips bool) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, htmlErrorPage)
+	}))
+	t.Cleanup(srv.Close)
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+	s := lb.Settings()
+	s.MalformedResponseMode, s.MalformedTripsCircuit, s.CircuitThreshold = mode, trips, 2
+	if _, err := lb.UpdateSettings(s); err != nil {
+		t.Fatalf("UpdateSettings: %v", err)
+	}
+}
+
+func TestMalformedResponseModes(t *testing.T) {
+	t.Run("lenient", func(t *testing.T) {
+		newMalformedLB(t, malformedLenient, false)
+		rec := doTask(nil)
+		var body map[string]interface{}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || rec.Code != http.StatusOK || body["worker"] != "worker-1" {
+			t.Fatalf("lenient: %d %v %v", rec.Code, body, err)
+		}
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		newMalformedLB(t, malformedStrict, false)
+		for i := 0; i < 3; i++ {
+			if rec := doTask(nil); rec.Code != http.StatusBadGateway {
+				t.Fatalf("strict: %d, want 502", rec.Code)
+			}
+		}
+		if lb.workers[0].circuitOpen() {
+			t.Error("circuit opened although malformedTripsCircuit is off")
+		}
+		if got := testutil.ToFloat64(lb.metrics.requestsTotal.WithLabelValues("worker-1", malformedOutcome)); got != 3 {
+			t.Errorf("malformed_response requests = %v, want 3", got)
+		}
+
+		newMalformedLB(t, malformedStrict, true)
+		doTask(nil)
+		doTask(nil)
+		if !lb.workers[0].circuitOpen() {
+			t.Error("circuit still closed with malformedTripsCircuit on")
+		}
+	})
+
+	t.Run("passthrough", func(t *testing.T) {
+		newMalformedLB(t, malformedPassthrough, false)
+		rec := doTask(nil)
+		if rec.Code != http.StatusOK || rec.Body.String() != htmlErrorPage {
+			t.Fatalf("passthrough: %d %q", rec.Code, rec.Body.String())
+		}
+		h := rec.Header()
+		if h.Get("Content-Type") != "text/html; charset=utf-8" || h.Get(workerHeader) != "worker-1" || h.Get(workerColorHeader) != "#FF0000" || h.Get(processingTimeHeader) == "" {
+			t.Errorf("passthrough headers = %v", h)
+		}
+	})
+
+	// Every mode counts the malformed response and keeps a sample
+	srv := httptest.NewServer(newMux())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/api/workers/worker-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var status api.WorkerStatus
+	json.NewDecoder(resp.Body).Decode(&status)
+	m := status.Malformed
+	if m == nil || m.Count != 1 || len(m.LastSample) != maxMalformedSample || !strings.HasPrefix(htmlErrorPage, m.LastSample) {
+		t.Errorf("malformed summary = %+v", m)
+	}
+	if got := testutil.ToFloat64(lb.metrics.malformedResponses.WithLabelValues("worker-1", malformedPassthrough)); got != 1 {
+		t.Errorf("malformed responses = %v, want 1", got)
+	}
+
+	s := lb.Settings()
+	s.MalformedResponseMode = "ignore"
+	if err := validateSettings(s); err == nil || err.(*SettingsError).Field != "malformedResponseMode" {
+		t.Errorf("invalid mode: err = %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// Display metadata limits
+const (
+	maxDisplayNameLen = 64
+	maxDescriptionLen = 256
+	maxIconLen        = 64
+)
+
+// workerPalette is the ordered set of colors assigned to workers added
+// without one. It starts with the colors of the built-in workers so custom
+// workers pick the remaining ones first.
+var workerPalette = []string{
+	"#3B82F6", "#6366F1", "#F97316", "#EAB308", "#10B981", "#14B8A6",
+	"#EC4899", "#8B5CF6", "#EF4444", "#22C55E", "#06B6D4", "#F59E0B",
+	"#84CC16", "#D946EF", "#0EA5E9", "#F43F5E",
+}
+
+var hexColorPattern = regexp.MustCompile(`^#(?:[0-9A-Fa-f]{3}|[0-9A-Fa-f]{6})$`)
+
+// MetadataError describes a worker metadata field that failed validation
+type MetadataError struct {
+	Field   string
+	Message string
+}
+
+func (e *MetadataError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// validateWorkerMetadata checks the display fields that are set and returns
+// the first violation
+func validateWorkerMetadata(color, displayName, description, icon *string) error {
+	switch {
+	case color != nil && !hexColorPattern.MatchString(*color):
+		return &MetadataError{"color", "must be a hex color (#RGB or #RRGGBB)"}
+	case displayName != nil && utf8.RuneCountInString(*displayName) > maxDisplayNameLen:
+		return &MetadataError{"displayName", fmt.Sprintf("must be at most %d characters", maxDisplayNameLen)}
+	case description != nil && utf8.RuneCountInString(*description) > maxDescriptionLen:
+		return &MetadataError{"description", fmt.Sprintf("must be at most %d characters", maxDescriptionLen)}
+	case icon != nil && utf8.RuneCountInString(*icon) > maxIconLen:
+		return &MetadataError{"icon", fmt.Sprintf("must be at most %d characters", maxIconLen)}
+	}
+	return nil
+}
+
+// normalizeColor expands #RGB to #RRGGBB and upper-cases the digits so that
+// equal colors compare equal
+func normalizeColor(color string) string {
+	color = strings.ToUpper(color)
+	if len(color) == 4 {
+		return "#" + strings.Repeat(color[1:2], 2) + strings.Repeat(color[2:3], 2) + strings.Repeat(color[3:4], 2)
+	}
+	return color
+}
+
+// nextColorLocked returns the first palette color not used by any worker.
+// Once the palette is exhausted, colors are generated by rotating the hue
+// until an unused one is found. Must be called with lb.mu held.
+func (lb *LoadBalancer) nextColorLocked() string {
+	used := make(map[string]bool, len(lb.workers))
+	for _, w := range lb.workers {
+		used[normalizeColor(w.Color)] = true
+	}
+	for _, c := range workerPalette {
+		if !used[c] {
+			return c
+		}
+	}
+	for i := 0; ; i++ {
+		// Golden-angle steps spread consecutive hues far apart
+		c := hslColor(float64(i)*137.508, 0.65, 0.5)
+		if !used[c] {
+			return c
+		}
+	}
+}
+
+// hslColor converts a hue in degrees plus saturation and lightness to #RRGGBB
+func hslColor(h, s, l float64) string {
+	h = math.Mod(h, 360)
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - c/2
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	return fmt.Sprintf("#%02X%02X%02X", int((r+m)*255+0.5), int((g+m)*255+0.5), int((b+m)*255+0.5))
+}
+
+// SetWorkerMetadata updates the display fields of the named worker; nil
+// fields are left unchanged. The values must already be validated.
+func (lb *LoadBalancer) SetWorkerMetadata(name string, update api.WorkerUpdate) bool {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	for _, w := range lb.workers {
+		if w.Name == name {
+			applyMetadataLocked(w, update)
+			w.revision++
+			return true
+		}
+	}
+	return false
+}
+
+// applyMetadataLocked applies the metadata fields of update to w. Must be
+// called with lb.mu held.
+func applyMetadataLocked(w *Worker, update api.WorkerUpdate) {
+	if update.Color != nil {
+		w.Color = normalizeColor(*update.Color)
+	}
+	if update.DisplayName != nil {
+		w.DisplayName = *update.DisplayName
+	}
+	if update.Description != nil {
+		w.Description = *update.Description
+	}
+	if update.Icon != nil {
+		w.Icon = *update.Icon
+	}
+	if update.Runtime != nil {
+		w.Runtime = *update.Runtime
+	}
+	if update.HealthPath != nil {
+		w.HealthPath = *update.HealthPath
+		if w.HealthPath == "" {
+			w.HealthPath = defaultHealthPath
+		}
+	}
+}
+
+func writeMetadataError(w http.ResponseWriter, err *MetadataError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(api.ErrorResponse{Error: err.Message, Field: err.Field})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/network-sandbox/load-balancer/api"
+	lbclient "github.com/network-sandbox/load-balancer/client"
+)
+
+func strPtr(s string) *string { return &s }
+
+func TestWorkerMetadataValidation(t *testing.T) {
+	c := newInProcessLB(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		update api.WorkerUpdate
+		field  string
+	}{
+		{"color without hash", api.WorkerUpdate{Color: strPtr("FF0000")}, "color"},
+		{"color wrong length", api.WorkerUpdate{Color: strPtr("#FF00")}, "color"},
+		{"color not hex", api.WorkerUpdate{Color: strPtr("#GG0000")}, "color"},
+		{"display name too long", api.WorkerUpdate{DisplayName: strPtr(fmt.Sprintf("%065d", 0))}, "displayName"},
+		{"description too long", api.WorkerUpdate{Description: strPtr(fmt.Sprintf("%0257d", 0))}, "description"},
+		{"icon too long", api.WorkerUpdate{Icon: strPtr(fmt.Sprintf("%065d", 0))}, "icon"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := c.UpdateWorker(ctx, "worker-1", tt.update)
+			var apiErr *lbclient.APIError
+			if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+				t.Fatalf("err = %v, want 400", err)
+			}
+			if apiErr.Body.Field != tt.field {
+				t.Errorf("field = %q, want %q", apiErr.Body.Field, tt.field)
+			}
+		})
+	}
+
+	_, err := c.AddWorker(ctx, lbclient.AddWorkerRequest{Name: "w", URL: "http://127.0.0.1:1", Color: "red"})
+	var apiErr *lbclient.APIError
+	if !errors.As(err, &apiErr) || apiErr.Body.Field != "color" {
+		t.Errorf("AddWorker with invalid color: err = %v", err)
+	}
+
+	// Rejected updates leave the worker untouched
+	status, err := c.Status(ctx)
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	if got := status.Workers[0]; got.Color != "#FF0000" || got.DisplayName != "" {
+		t.Errorf("worker changed by rejected update: %+v", got)
+	}
+}
+
+func TestWorkerColorAutoAssignment(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("go-worker-1", "http://localhost:8081", "#3B82F6", 1)
+	lb.AddWorker("go-worker-2", "http://localhost:8082", "#6366f1", 1)
+
+	seen := map[string]string{"#3B82F6": "go-worker-1", "#6366F1": "go-worker-2"}
+	for i := 0; i < len(workerPalette)+10; i++ {
+		name := fmt.Sprintf("custom-%d", i)
+		status, ok := lb.registerWorker(api.AddWorkerRequest{Name: name, URL: "http://localhost:9000"})
+		if !ok {
+			t.Fatalf("registerWorker(%s) failed", name)
+		}
+		if !hexColorPattern.MatchString(status.Color) {
+			t.Fatalf("%s color = %q, not a hex color", name, status.Color)
+		}
+		if other, dup := seen[status.Color]; dup {
+			t.Fatalf("%s got color %s already used by %s", name, status.Color, other)
+		}
+		seen[status.Color] = name
+	}
+}
+
+func TestWorkerMetadataRoundTrip(t *testing.T) {
+	c := newInProcessLB(t)
+	ctx := context.Background()
+
+	added, err := c.AddWorker(ctx, lbclient.AddWorkerRequest{
+		Name:        "worker-2",
+		URL:         "http://127.0.0.1:1",
+		DisplayName: "Worker Two",
+		Icon:        "server",
+	})
+	if err != nil {
+		t.Fatalf("AddWorker: %v", err)
+	}
+	if added.DisplayName != "Worker Two" || added.Icon != "server" || added.Color == "" || added.Color == "#FF0000" {
+		t.Errorf("AddWorker = %+v", added)
+	}
+
+	update := api.WorkerUpdate{
+		Color:       strPtr("#0af"),
+		DisplayName: strPtr("Primary"),
+		Description: strPtr("Handles the bulk of traffic"),
+		Icon:        strPtr("bolt"),
+	}
+	if _, err := c.UpdateWorker(ctx, "worker-1", update); err != nil {
+		t.Fatalf("UpdateWorker: %v", err)
+	}
+	// A partial update keeps the other fields
+	if _, err := c.UpdateWorker(ctx, "worker-1", api.WorkerUpdate{Icon: strPtr("star")}); err != nil {
+		t.Fatalf("UpdateWorker: %v", err)
+	}
+
+	status, err := c.Status(ctx)
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	got := status.Workers[0]
+	want := api.WorkerStatus{Color: "#00AAFF", DisplayName: "Primary", Description: "Handles the bulk of traffic", Icon: "star"}
+	if got.Color != want.Color || got.DisplayName != want.DisplayName || got.Description != want.Description || got.Icon != want.Icon {
+		t.Errorf("status worker = %+v, want metadata %+v", got, want)
+	}
+
+	if _, err := c.UpdateWorker(ctx, "nope", update); err == nil {
+		t.Error("UpdateWorker on unknown worker should fail")
+	}
+}
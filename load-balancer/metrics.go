@@ -0,0 +1,585 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// lbMetrics holds the Prometheus collectors of one LoadBalancer. They are
+// registered with the instance's registerer, so several load balancers can
+// live in one process without conflicting registrations.
+type lbMetrics struct {
+	// Requests
+	requestsTotal           *prometheus.CounterVec
+	requestDuration         *prometheus.HistogramVec
+	workerHealth            *prometheus.GaugeVec
+	workerActiveConnections *prometheus.GaugeVec
+	deadlineExceeded        *prometheus.CounterVec
+
+	// Routing hints
+	requireWorkerTotal *prometheus.CounterVec
+	preferWorkerTotal  *prometheus.CounterVec
+	// stickyAffinityTotal counts sticky lookups by outcome
+	stickyAffinityTotal *prometheus.CounterVec
+
+	// Upstream responses
+	upstreamBodyTooLarge *prometheus.CounterVec
+	upstreamTTFB         *prometheus.HistogramVec
+	upstreamTotal        *prometheus.HistogramVec
+	upstreamConnReuse    *prometheus.GaugeVec
+	upstreamRejections   *prometheus.CounterVec
+	rejectionRetries     *prometheus.CounterVec
+	failureRetries       *prometheus.CounterVec
+
+	// Selection fairness
+	distributionCV          prometheus.Gauge
+	distributionMaxMinRatio prometheus.Gauge
+	distributionShare       *prometheus.GaugeVec
+	distributionCoverage    *prometheus.GaugeVec
+
+	// Algorithm sessions
+	sessionRequestCV  *prometheus.GaugeVec
+	sessionLatencyP95 *prometheus.GaugeVec
+	sessionErrorRate  *prometheus.GaugeVec
+
+	// WebSocket hub
+	wsConnects     prometheus.Counter
+	wsNormalCloses prometheus.Counter
+	wsErrorCloses  *prometheus.CounterVec
+	wsMessagesSent prometheus.Counter
+	wsBytesSent    prometheus.Counter
+	wsLifetime     prometheus.Histogram
+	wsResumes      *prometheus.CounterVec
+
+	// Request journal
+	journalLines   prometheus.Counter
+	journalBytes   prometheus.Counter
+	journalDropped prometheus.Counter
+
+	// Task de-duplication
+	dedupHits *prometheus.CounterVec
+
+	// Task tags
+	taskTags *prometheus.CounterVec
+
+	// Load shedding
+	shedLevel   prometheus.Gauge
+	shedActions *prometheus.CounterVec
+	// Tasks over their client's share of the pool rate ceiling
+	rateCeilingRejected prometheus.Counter
+	// Tasks over their client address's token bucket
+	ipRateLimited prometheus.Counter
+
+	// Tasks that found no eligible worker
+	selectionFailed *prometheus.CounterVec
+
+	// Resources
+	storeSize           *prometheus.GaugeVec
+	upstreamConnections *prometheus.GaugeVec
+	connFlushes         *prometheus.CounterVec
+
+	pacingDecisions *prometheus.CounterVec
+
+	malformedResponses *prometheus.CounterVec
+
+	rollingRestarts *prometheus.CounterVec
+
+	panics *prometheus.CounterVec
+
+	distributionAnomalies *prometheus.CounterVec
+
+	retryDecisions *prometheus.CounterVec
+
+	identityMismatches *prometheus.CounterVec
+
+	circuitState *prometheus.GaugeVec
+	// workerLatencyEWMA is the latency least-latency routes on
+	workerLatencyEWMA *prometheus.GaugeVec
+
+	workerRenamed *prometheus.CounterVec
+	// scrapeMu is held for reading by scrapes and for writing while a
+	// rename moves series, so no scrape sees a half-moved worker
+	scrapeMu sync.RWMutex
+
+	// Requests to the LB's own routes
+	httpRequests *prometheus.CounterVec
+	httpDuration *prometheus.HistogramVec
+
+	// The LB process itself
+	buildInfo *prometheus.GaugeVec
+}
+
+// newLBMetrics creates the collectors of lb and registers them with reg
+func newLBMetrics(reg prometheus.Registerer, lb *LoadBalancer) *lbMetrics {
+	f := promauto.With(reg)
+	m := &lbMetrics{
+		requestsTotal: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "lb_requests_total",
+				Help: "Total requests processed by worker",
+			},
+			[]string{"worker", "status"},
+		),
+		requestDuration: f.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "lb_request_duration_ms",
+				Help:    "Request duration in milliseconds",
+				Buckets: prometheus.ExponentialBuckets(1, 2, 15),
+			},
+			[]string{"worker"},
+		),
+		workerHealth: f.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "lb_worker_health",
+				Help: "Worker health status (1=healthy, 0=unhealthy)",
+			},
+			[]string{"worker"},
+		),
+		workerActiveConnections: f.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "lb_worker_active_connections",
+				Help: "Active connections per worker",
+			},
+			[]string{"worker"},
+		),
+		deadlineExceeded: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "lb_deadline_exceeded_total",
+				Help: "Requests that ran out of deadline budget, by where the deadline was enforced",
+			},
+			[]string{"worker", "source"},
+		),
+
+		requireWorkerTotal: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "lb_require_worker_total",
+				Help: "Requests carrying X-LB-Require-Worker by outcome (routed, conflict)",
+			},
+			[]string{"outcome"},
+		),
+		preferWorkerTotal: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "lb_prefer_worker_total",
+				Help: "Requests carrying X-LB-Prefer-Worker by outcome (routed, fallback)",
+			},
+			[]string{"outcome"},
+		),
+		stickyAffinityTotal: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "lb_sticky_affinity_total",
+				Help: "Sticky selections by outcome (hit: routed to the session's worker, miss: routed round-robin, rebind: session moved to another worker)",
+			},
+			[]string{"outcome"},
+		),
+
+		upstreamBodyTooLarge: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "lb_upstream_body_too_large_total",
+				Help: "Upstream responses aborted because the body exceeded the configured size cap",
+			},
+			[]string{"worker"},
+		),
+		upstreamTTFB: f.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "lb_upstream_ttfb_ms",
+				Help:    "Time from sending a task to a worker until the first response byte, in milliseconds",
+				Buckets: prometheus.ExponentialBuckets(1, 2, 15),
+			},
+			[]string{"worker"},
+		),
+		upstreamTotal: f.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "lb_upstream_total_ms",
+				Help:    "Time from sending a task to a worker until its response body was fully read, in milliseconds",
+				Buckets: prometheus.ExponentialBuckets(1, 2, 15),
+			},
+			[]string{"worker"},
+		),
+		upstreamConnReuse: f.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "lb_upstream_conn_reuse_ratio",
+				Help: "Fraction of upstream requests to the worker that reused a pooled connection",
+			},
+			[]string{"worker"},
+		),
+		upstreamRejections: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "lb_upstream_rejections_total",
+				Help: "Tasks workers turned away for lack of capacity, by reason (queue_full, overloaded, draining)",
+			},
+			[]string{"worker", "reason"},
+		),
+		rejectionRetries: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "lb_rejection_retries_total",
+				Help: "Rejected tasks retried on another worker, by the rejecting worker and reason",
+			},
+			[]string{"worker", "reason"},
+		),
+		failureRetries: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "lb_failure_retries_total",
+				Help: "Failed tasks retried on another worker, by the failing worker",
+			},
+			[]string{"worker"},
+		),
+
+		distributionCV: f.NewGauge(prometheus.GaugeOpts{
+			Name: "lb_distribution_cv",
+			Help: "Coefficient of variation of per-worker request counts over the last fairness window, among workers eligible for the whole window",
+		}),
+		distributionMaxMinRatio: f.NewGauge(prometheus.GaugeOpts{
+			Name: "lb_distribution_max_min_ratio",
+			Help: "Ratio of the largest to the smallest per-worker request share over the last fairness window (+Inf if a worker got none)",
+		}),
+		distributionShare: f.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "lb_distribution_share",
+				Help: "Worker's share of requests over the last fairness window, among workers eligible for the whole window",
+			},
+			[]string{"worker"},
+		),
+		distributionCoverage: f.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "lb_distribution_coverage",
+				Help: "Fraction of the last fairness window the worker was eligible for selection",
+			},
+			[]string{"worker"},
+		),
+
+		sessionRequestCV: f.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "lb_algorithm_session_request_cv",
+				Help: "Coefficient of variation of per-worker request counts in the last completed session of each algorithm",
+			},
+			[]string{"algorithm"},
+		),
+		sessionLatencyP95: f.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "lb_algorithm_session_latency_p95_ms",
+				Help: "p95 request latency in the last completed session of each algorithm",
+			},
+			[]string{"algorithm"},
+		),
+		sessionErrorRate: f.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "lb_algorithm_session_error_rate",
+				Help: "Error rate in the last completed session of each algorithm",
+			},
+			[]string{"algorithm"},
+		),
+
+		wsConnects: f.NewCounter(
+			prometheus.CounterOpts{
+				Name: "lb_ws_connects_total",
+				Help: "WebSocket status clients connected",
+			},
+		),
+		wsNormalCloses: f.NewCounter(
+			prometheus.CounterOpts{
+				Name: "lb_ws_normal_closes_total",
+				Help: "WebSocket clients that disconnected with a close frame",
+			},
+		),
+		wsErrorCloses: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "lb_ws_error_closes_total",
+				Help: "WebSocket connections closed or refused on error, by category (write_timeout, write_error, read_error, origin_rejected)",
+			},
+			[]string{"category"},
+		),
+		wsMessagesSent: f.NewCounter(
+			prometheus.CounterOpts{
+				Name: "lb_ws_messages_sent_total",
+				Help: "Status messages sent to WebSocket clients",
+			},
+		),
+		wsBytesSent: f.NewCounter(
+			prometheus.CounterOpts{
+				Name: "lb_ws_sent_bytes_total",
+				Help: "Bytes of status messages sent to WebSocket clients",
+			},
+		),
+		wsLifetime: f.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "lb_ws_connection_lifetime_seconds",
+				Help:    "How long WebSocket clients stayed connected",
+				Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+			},
+		),
+		wsResumes: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "lb_ws_resumes_total",
+				Help: "WebSocket session resumptions, by result (replayed, resync)",
+			},
+			[]string{"result"},
+		),
+
+		journalLines: f.NewCounter(
+			prometheus.CounterOpts{
+				Name: "lb_journal_lines_total",
+				Help: "Request journal lines written",
+			},
+		),
+		journalBytes: f.NewCounter(
+			prometheus.CounterOpts{
+				Name: "lb_journal_written_bytes_total",
+				Help: "Bytes written to the request journal",
+			},
+		),
+		journalDropped: f.NewCounter(
+			prometheus.CounterOpts{
+				Name: "lb_journal_dropped_total",
+				Help: "Request journal entries dropped because the write buffer was full",
+			},
+		),
+
+		dedupHits: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "lb_dedup_hits_total",
+				Help: "Duplicate tasks answered from the original request, by policy",
+			},
+			[]string{"policy"},
+		),
+
+		taskTags: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "lb_task_tags_total",
+				Help: "Tasks by tag key and value, with values beyond the cardinality limit in overflow buckets",
+			},
+			[]string{"key", "value"},
+		),
+
+		shedLevel: f.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "lb_shed_level",
+				Help: "Current load shedding level (0 none, 1 probes, 2 broadcasts, 3 low_priority)",
+			},
+		),
+		shedActions: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "lb_shed_actions_total",
+				Help: "Work shed because the LB is overloaded, by category (probe, broadcast, task)",
+			},
+			[]string{"category"},
+		),
+		rateCeilingRejected: f.NewCounter(
+			prometheus.CounterOpts{
+				Name: "lb_rate_ceiling_rejected_total",
+				Help: "Tasks answered 429 for exceeding their client's fair share of the pool rate ceiling",
+			},
+		),
+		ipRateLimited: f.NewCounter(
+			prometheus.CounterOpts{
+				Name: "lb_ip_rate_limited_total",
+				Help: "Tasks answered 429 because their client address ran out of rate limit tokens",
+			},
+		),
+
+		selectionFailed: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "lb_selection_failed_total",
+				Help: "Tasks that found no eligible worker, by the most common exclusion reason",
+			},
+			[]string{"dominant_reason"},
+		),
+
+		storeSize: f.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "lb_store_size",
+				Help: "Number of entries held in each bounded internal store",
+			},
+			[]string{"store"},
+		),
+		upstreamConnections: f.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "lb_upstream_connections",
+				Help: "Upstream connections per worker host by state (active, idle)",
+			},
+			[]string{"host", "state"},
+		),
+		connFlushes: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "lb_upstream_conn_flushes_total",
+				Help: "Forced flushes of a worker's idle connections after a refused connection, timeout or DNS failure",
+			},
+			[]string{"worker", "reason"},
+		),
+
+		pacingDecisions: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "lb_pacing_decisions_total",
+				Help: "Tasks that would have exceeded a worker's paced rate, by decision (diverted, delayed, forced)",
+			},
+			[]string{"worker", "decision"},
+		),
+
+		malformedResponses: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "lb_malformed_responses_total",
+				Help: "2xx task responses whose body was not a JSON object, by worker and the mode applied",
+			},
+			[]string{"worker", "mode"},
+		),
+
+		rollingRestarts: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "lb_rolling_restarts_total",
+				Help: "Finished rolling restarts, by outcome (completed, failed, aborted)",
+			},
+			[]string{"outcome"},
+		),
+
+		panics: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "lb_panics_total",
+				Help: "Panics recovered from HTTP handlers, by route",
+			},
+			[]string{"handler"},
+		),
+
+		distributionAnomalies: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "lb_distribution_anomaly_total",
+				Help: "Verification windows whose per-worker request distribution deviated from the active algorithm's expectation, by algorithm",
+			},
+			[]string{"algorithm"},
+		),
+
+		retryDecisions: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "lb_retry_decisions_total",
+				Help: "How retries of rejected tasks were scheduled (hint_other_worker, hint_same_worker, backoff, beyond_deadline)",
+			},
+			[]string{"decision"},
+		),
+
+		identityMismatches: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "lb_worker_identity_mismatch_total",
+				Help: "Worker responses reporting a name other than the worker's configured one, by where it was reported (health, task)",
+			},
+			[]string{"worker", "source"},
+		),
+
+		circuitState: f.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "lb_circuit_state",
+				Help: "Circuit breaker state per worker (0 closed, 1 open, 2 half-open)",
+			},
+			[]string{"worker"},
+		),
+		workerLatencyEWMA: f.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "lb_worker_latency_ewma_ms",
+				Help: "Exponentially weighted mean latency of the tasks each worker served, in milliseconds",
+			},
+			[]string{"worker"},
+		),
+
+		workerRenamed: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "lb_worker_renamed_total",
+				Help: "Worker renames; histograms of the old name restart under the new one",
+			},
+			[]string{"from", "to"},
+		),
+
+		httpRequests: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "lb_http_requests_total",
+				Help: "Requests to the LB's HTTP routes by route pattern, method and status code",
+			},
+			[]string{"path", "method", "code"},
+		),
+		httpDuration: f.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "lb_http_request_duration_ms",
+				Help:    "Time the LB took to answer a request to one of its HTTP routes, in milliseconds",
+				Buckets: prometheus.ExponentialBuckets(1, 2, 15),
+			},
+			[]string{"path", "method"},
+		),
+
+		buildInfo: f.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "lb_build_info",
+				Help: "Always 1; labelled with the LB version and instance ID",
+			},
+			[]string{"version", "instance"},
+		),
+	}
+
+	f.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "lb_inflight_requests",
+			Help: "Requests currently being proxied to workers",
+		},
+		func() float64 { return float64(lb.InFlight()) },
+	)
+	f.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "lb_ws_clients",
+			Help: "Connected WebSocket status clients",
+		},
+		func() float64 { return float64(atomic.LoadInt32(&lb.wsClientCount)) },
+	)
+	f.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "lb_broadcast_queue_depth",
+			Help: "Status broadcasts waiting to be sent",
+		},
+		func() float64 { return float64(atomic.LoadInt32(&lb.broadcastPending)) },
+	)
+	return m
+}
+
+// workerCounters, workerGauges and workerHistograms return the collectors
+// with a worker label
+func (m *lbMetrics) workerCounters() []*prometheus.CounterVec {
+	return []*prometheus.CounterVec{
+		m.requestsTotal, m.deadlineExceeded, m.upstreamBodyTooLarge, m.upstreamRejections, m.rejectionRetries,
+		m.failureRetries, m.connFlushes, m.pacingDecisions, m.malformedResponses, m.identityMismatches,
+	}
+}
+
+func (m *lbMetrics) workerGauges() []*prometheus.GaugeVec {
+	return []*prometheus.GaugeVec{
+		m.workerHealth, m.workerActiveConnections, m.upstreamConnReuse, m.distributionShare,
+		m.distributionCoverage, m.circuitState, m.workerLatencyEWMA,
+	}
+}
+
+// workerHistograms is keyed by metric name
+func (m *lbMetrics) workerHistograms() map[string]*prometheus.HistogramVec {
+	return map[string]*prometheus.HistogramVec{
+		"lb_request_duration_ms": m.requestDuration,
+		"lb_upstream_ttfb_ms":    m.upstreamTTFB,
+		"lb_upstream_total_ms":   m.upstreamTotal,
+	}
+}
+
+// deleteWorker drops every series labelled with the named worker, so a
+// removed worker leaves no stale gauges behind
+func (m *lbMetrics) deleteWorker(name string) {
+	labels := prometheus.Labels{"worker": name}
+	for _, v := range m.workerCounters() {
+		v.DeletePartialMatch(labels)
+	}
+	for _, v := range m.workerGauges() {
+		v.DeletePartialMatch(labels)
+	}
+	for _, v := range m.workerHistograms() {
+		v.DeletePartialMatch(labels)
+	}
+}
+
+// MetricsHandler serves the metrics of this load balancer
+func (lb *LoadBalancer) MetricsHandler() http.Handler {
+	return promhttp.InstrumentMetricHandler(lb.registerer, promhttp.HandlerFor(lb.metrics.guard(lb.gatherer), promhttp.HandlerOpts{}))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scrape(t *testing.T, h http.Handler) string {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestMetricsPerInstance(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer backend.Close()
+
+	// Two load balancers in one process must not conflict on registration
+	a := NewLoadBalancer("round-robin")
+	b := NewLoadBalancer("round-robin")
+	a.AddWorker("worker-a", backend.URL, "", 1)
+	b.AddWorker("worker-b", backend.URL, "", 1)
+	for i := 0; i < 2; i++ {
+		if _, code, err := a.forwardTo(context.Background(), a.workers[0], TaskRequest{ID: "t"}, time.Now()); err != nil {
+			t.Fatalf("forwardTo: %d %v", code, err)
+		}
+	}
+	if _, code, err := b.forwardTo(context.Background(), b.workers[0], TaskRequest{ID: "t"}, time.Now()); err != nil {
+		t.Fatalf("forwardTo: %d %v", code, err)
+	}
+
+	gotA, gotB := scrape(t, a.MetricsHandler()), scrape(t, b.MetricsHandler())
+	if !strings.Contains(gotA, `lb_requests_total{status="success",worker="worker-a"} 2`) || strings.Contains(gotA, "worker-b") {
+		t.Errorf("LB a metrics should only count its own requests:\n%s", gotA)
+	}
+	if !strings.Contains(gotB, `lb_requests_total{status="success",worker="worker-b"} 1`) || strings.Contains(gotB, "worker-a") {
+		t.Errorf("LB b metrics should only count its own requests:\n%s", gotB)
+	}
+	if !strings.Contains(gotA, "lb_inflight_requests 0") {
+		t.Error("instance gauges should be served from the instance's registry")
+	}
+}
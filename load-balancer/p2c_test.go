@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// maxLoadAfter starts worker-0 with a backlog, makes picks selections
+// without completing any and returns the highest resulting load
+func maxLoadAfter(algorithm string, picks int) int32 {
+	lb := NewLoadBalancer(algorithm)
+	for i := 0; i < 10; i++ {
+		lb.AddWorker(fmt.Sprintf("worker-%d", i), fmt.Sprintf("http://localhost:%d", 9000+i), "#FF0000", 1)
+		lb.workers[i].MaxLoad = 0 // no load limit, so the backlog can build up
+	}
+	atomic.StoreInt32(&lb.workers[0].CurrentLoad, 100)
+	for i := 0; i < picks; i++ {
+		atomic.AddInt32(&lb.SelectWorker().CurrentLoad, 1)
+	}
+	var max int32
+	for _, w := range lb.workers {
+		if n := atomic.LoadInt32(&w.CurrentLoad); n > max {
+			max = n
+		}
+	}
+	return max
+}
+
+func TestP2CBalancesSkewedLoad(t *testing.T) {
+	// 1100 requests over 10 workers is 110 each at best; random keeps
+	// adding a tenth of the picks to the worker that is already behind
+	p2c, random := maxLoadAfter("p2c", 1000), maxLoadAfter("random", 1000)
+	if p2c >= random {
+		t.Errorf("max load p2c = %d, random = %d; want p2c lower", p2c, random)
+	}
+	if p2c > 125 {
+		t.Errorf("max load p2c = %d, want close to 110", p2c)
+	}
+}
+
+func TestP2CSingleWorker(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", "http://localhost:8081", "#FF0000", 1)
+	lb.AddWorker("worker-2", "http://localhost:8082", "#00FF00", 1)
+	lb.workers[1].Healthy = false
+
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/algorithm", bytes.NewBufferString(`{"algorithm":"p2c"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("set algorithm: %d %s", rec.Code, rec.Body)
+	}
+	for i := 0; i < 10; i++ {
+		if w := lb.SelectWorker(); w == nil || w.Name != "worker-1" {
+			t.Fatalf("selected %v, want the only healthy worker", w)
+		}
+	}
+}
+
+func BenchmarkSelect10000(b *testing.B) {
+	for _, algorithm := range []string{"least-connections", "p2c"} {
+		b.Run(algorithm, func(b *testing.B) {
+			lb := NewLoadBalancer(algorithm)
+			for i := 0; i < 10000; i++ {
+				lb.AddWorker(fmt.Sprintf("worker-%d", i), "http://localhost:8081", "#FF0000", 1)
+			}
+			lb.mu.Lock()
+			defer lb.mu.Unlock()
+			available := lb.eligibleWorkersLocked()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				lb.selectFromLocked(available)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Burst pacing. When enabled, every worker gets a leaky bucket that drains at
+// its rate: the rate configured on the worker (paceRate) or, when none is,
+// the rate at which it accepted tasks over the last pacingWindow while also
+// rejecting some. A task that would overflow the chosen worker's bucket is
+// diverted to another candidate with room, or when there is none delayed by
+// at most PacingMaxDelayMs. Tasks that would wait longer are forced through.
+const (
+	defaultPacingMaxDelay = 50 * time.Millisecond
+	maxPacingMaxDelayMs   = 1000
+	defaultPacingBurst    = 1
+	maxPacingBurst        = 1000
+	maxPaceRate           = 100000
+	pacingWindow          = 10 // seconds
+)
+
+// Pacing decisions
+const (
+	paceDiverted = "diverted"
+	paceDelayed  = "delayed"
+	paceForced   = "forced"
+)
+
+// pacingConfig is the pacing part of the settings
+type pacingConfig struct {
+	enabled  bool
+	maxDelay time.Duration
+	burst    int
+}
+
+// paceBucket counts one second of a worker's outcomes
+type paceBucket struct {
+	sec      int64
+	accepted int
+	rejected int
+}
+
+// workerPacer is a worker's leaky bucket and recent acceptance history
+type workerPacer struct {
+	mu        sync.Mutex
+	rate      float64
+	level     float64
+	drainedAt time.Time
+	window    [pacingWindow]paceBucket
+}
+
+// setRate configures the worker's rate in tasks per second; 0 uses the
+// observed rate
+func (p *workerPacer) setRate(rate float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rate = rate
+}
+
+func (p *workerPacer) configuredRate() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rate
+}
+
+// observe records whether the worker accepted or rejected a task
+func (p *workerPacer) observe(now time.Time, rejected bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sec := now.Unix()
+	b := &p.window[sec%pacingWindow]
+	if b.sec != sec {
+		*b = paceBucket{sec: sec}
+	}
+	if rejected {
+		b.rejected++
+	} else {
+		b.accepted++
+	}
+}
+
+// rateLocked returns the rate the worker is paced at, or 0 if it is not.
+// Without a configured rate a worker is only paced once it has rejected a
+// task within the window, at the rate it accepted tasks meanwhile.
+func (p *workerPacer) rateLocked(now time.Time) float64 {
+	if p.rate > 0 {
+		return p.rate
+	}
+	sec := now.Unix()
+	accepted, rejected, oldest := 0, 0, sec
+	for _, b := range p.window {
+		if b.sec > sec-pacingWindow && b.sec <= sec && (b.accepted > 0 || b.rejected > 0) {
+			accepted += b.accepted
+			rejected += b.rejected
+			if b.sec < oldest {
+				oldest = b.sec
+			}
+		}
+	}
+	if rejected == 0 || accepted == 0 {
+		return 0
+	}
+	return float64(accepted) / float64(sec-oldest+1)
+}
+
+// drainLocked empties the bucket at rate up to now
+func (p *workerPacer) drainLocked(now time.Time, rate float64) {
+	if !p.drainedAt.IsZero() {
+		p.level -= now.Sub(p.drainedAt).Seconds() * rate
+		if p.level < 0 {
+			p.level = 0
+		}
+	}
+	p.drainedAt = now
+}
+
+// wait returns how long a task sent now would have to wait to fit the
+// bucket
+func (p *workerPacer) wait(now time.Time, burst int) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	rate := p.rateLocked(now)
+	if rate <= 0 {
+		return 0
+	}
+	p.drainLocked(now, rate)
+	over := p.level + 1 - float64(burst)
+	if over <= 0 {
+		return 0
+	}
+	return time.Duration(over / rate * float64(time.Second))
+}
+
+// add puts a task into the bucket
+func (p *workerPacer) add(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if rate := p.rateLocked(now); rate > 0 {
+		p.drainLocked(now, rate)
+		p.level++
+	}
+}
+
+// paceLocked applies pacing to pick, the worker the algorithm chose among
+// candidates, and returns the worker to send the task to and how long to
+// wait first. Candidates may be nil for a pinned task, which is never
+// diverted. Must be called with lb.mu held.
+func (lb *LoadBalancer) paceLocked(pick *Worker, candidates []*Worker) (*Worker, time.Duration) {
+	cfg := lb.pacing
+	if !cfg.enabled {
+		return pick, 0
+	}
+	now := lb.clock.Now()
+	wait := pick.pacer.wait(now, cfg.burst)
+	if wait == 0 {
+		pick.pacer.add(now)
+		return pick, 0
+	}
+
+	// Prefer a candidate with room; otherwise the one that frees up first
+	chosen, chosenWait := pick, wait
+	var roomy []*Worker
+	for _, w := range candidates {
+		if w == pick {
+			continue
+		}
+		d := w.pacer.wait(now, cfg.burst)
+		if d == 0 {
+			roomy = append(roomy, w)
+		} else if d < chosenWait {
+			chosen, chosenWait = w, d
+		}
+	}
+	if len(roomy) > 0 {
+		next := lb.selectFromLocked(roomy)
+		next.pacer.add(now)
+		lb.metrics.pacingDecisions.WithLabelValues(pick.Name, paceDiverted).Inc()
+		return next, 0
+	}
+	chosen.pacer.add(now)
+	if chosenWait > cfg.maxDelay {
+		lb.metrics.pacingDecisions.WithLabelValues(chosen.Name, paceForced).Inc()
+		return chosen, 0
+	}
+	lb.metrics.pacingDecisions.WithLabelValues(chosen.Name, paceDelayed).Inc()
+	return chosen, chosenWait
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// rateLimitedWorker accepts tasks at rate per second of the LB clock with a
+// burst of burst and rejects the rest with queue_full
+type rateLimitedWorker struct {
+	mu       sync.Mutex
+	rate     float64
+	tokens   float64
+	last     time.Time
+	rejected int
+}
+
+func newRateLimitedWorker(t *testing.T, clk *fakeClock, rate, burst float64) (*httptest.Server, *rateLimitedWorker) {
+	t.Helper()
+	rw := &rateLimitedWorker{rate: rate, tokens: burst, last: clk.Now()}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw.mu.Lock()
+		now := clk.Now()
+		rw.tokens += now.Sub(rw.last).Seconds() * rw.rate
+		if rw.tokens > burst {
+			rw.tokens = burst
+		}
+		rw.last = now
+		ok := rw.tokens >= 1
+		if ok {
+			rw.tokens--
+		} else {
+			rw.rejected++
+		}
+		rw.mu.Unlock()
+		if !ok {
+			w.Header().Set(rejectReasonHeader, rejectQueueFull)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(api.TaskResponse{ID: "t"})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, rw
+}
+
+// burstRejections sends n tasks at one instant of a fake clock to two
+// workers accepting 50/s and 200/s and returns how many they rejected. A
+// task the pacer delays moves the clock on to the end of its delay.
+func burstRejections(t *testing.T, n int, pacing bool) int {
+	clk := newFakeClock()
+	rates := map[string]float64{"worker-a": 50, "worker-b": 200}
+	a, aw := newRateLimitedWorker(t, clk, rates["worker-a"], 3)
+	b, bw := newRateLimitedWorker(t, clk, rates["worker-b"], 3)
+	lb = NewLoadBalancer("round-robin")
+	lb.clock = clk
+	lb.AddWorker("worker-a", a.URL, "#FF0000", 1)
+	lb.AddWorker("worker-b", b.URL, "#00FF00", 1)
+	s := lb.Settings()
+	s.CircuitThreshold = 1000
+	s.RetryOnQueueFull = false
+	s.PacingEnabled = pacing
+	s.PacingBurst = 2
+	if _, err := lb.UpdateSettings(s); err != nil {
+		t.Fatalf("UpdateSettings: %v", err)
+	}
+	for name, rate := range rates {
+		rate := rate
+		lb.PatchWorker(name, api.WorkerUpdate{PaceRate: &rate})
+	}
+
+	for i := 0; i < n; i++ {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			doTask(nil)
+		}()
+		select {
+		case <-done:
+		case <-clk.added:
+			clk.mu.Lock()
+			delay := clk.timers[len(clk.timers)-1].deadline.Sub(clk.now)
+			clk.mu.Unlock()
+			clk.Advance(delay)
+			<-done
+		}
+	}
+	return aw.rejected + bw.rejected
+}
+
+func TestPacingReducesBurstRejections(t *testing.T) {
+	baseline := burstRejections(t, 20, false)
+	paced := burstRejections(t, 20, true)
+	// Unpaced, each worker takes its burst of 3 and rejects the rest;
+	// paced, every task is diverted or delayed until a worker has room
+	if baseline != 14 || paced != 0 {
+		t.Errorf("rejections: %d paced vs %d unpaced, want 0 vs 14", paced, baseline)
+	}
+
+	var delayed float64
+	for _, name := range []string{"worker-a", "worker-b"} {
+		delayed += testutil.ToFloat64(lb.metrics.pacingDecisions.WithLabelValues(name, paceDelayed))
+	}
+	if delayed == 0 {
+		t.Error("no task was delayed")
+	}
+}
+
+func TestPacingDecisions(t *testing.T) {
+	lb := NewLoadBalancer("round-robin")
+	lb.clock = newFakeClock()
+	lb.AddWorker("worker-a", "http://a", "#FF0000", 1)
+	lb.AddWorker("worker-b", "http://b", "#00FF00", 1)
+	s := lb.Settings()
+	s.PacingEnabled = true
+	lb.UpdateSettings(s)
+	a, b := lb.workers[0], lb.workers[1]
+	a.pacer.setRate(10)
+	b.pacer.setRate(10)
+
+	pace := func() (string, time.Duration) {
+		lb.mu.Lock()
+		defer lb.mu.Unlock()
+		w, d := lb.paceLocked(a, []*Worker{a, b})
+		return w.Name, d
+	}
+	steps := []struct {
+		worker string
+		delay  time.Duration
+	}{
+		{"worker-a", 0},
+		// worker-a is full, worker-b has room
+		{"worker-b", 0},
+		// Both full: worker-a frees up in 100ms, beyond the 50ms bound
+		{"worker-a", 0},
+	}
+	for i, step := range steps {
+		if w, d := pace(); w != step.worker || d != step.delay {
+			t.Errorf("step %d: %s after %v, want %s after %v", i, w, d, step.worker, step.delay)
+		}
+	}
+	s.PacingMaxDelayMs = 500
+	lb.UpdateSettings(s)
+	if w, d := pace(); w != "worker-b" || d != 100*time.Millisecond {
+		t.Errorf("bounded delay: %s after %v, want worker-b after 100ms", w, d)
+	}
+
+	m := lb.metrics
+	for _, c := range []struct {
+		worker, decision string
+	}{{"worker-a", paceDiverted}, {"worker-a", paceForced}, {"worker-b", paceDelayed}} {
+		if got := testutil.ToFloat64(m.pacingDecisions.WithLabelValues(c.worker, c.decision)); got != 1 {
+			t.Errorf("%s %s = %v, want 1", c.worker, c.decision, got)
+		}
+	}
+}
+
+func TestPacingObservedRate(t *testing.T) {
+	clk := newFakeClock()
+	var p workerPacer
+	if d := p.wait(clk.Now(), 1); d != 0 {
+		t.Fatalf("wait without history = %v, want 0", d)
+	}
+	// 4 accepted and a rejection within the last two seconds: 2/s
+	for i := 0; i < 4; i++ {
+		p.observe(clk.Now(), false)
+	}
+	clk.Advance(time.Second)
+	p.observe(clk.Now(), true)
+	p.add(clk.Now())
+	if d := p.wait(clk.Now(), 1); d != 500*time.Millisecond {
+		t.Errorf("wait = %v, want 500ms at 2/s", d)
+	}
+	// Once the rejection leaves the window the worker is no longer paced
+	clk.Advance(pacingWindow * time.Second)
+	if d := p.wait(clk.Now(), 1); d != 0 {
+		t.Errorf("wait after the window = %v, want 0", d)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Task phase profiling. One in phaseSampleRate tasks is timed through the
+// phases of handleTask: decoding and validating the request, selecting a
+// worker, waiting (pacing delays and retry backoff), the upstream calls and
+// writing the response, which includes the bookkeeping before it. The
+// phases of a sampled task add up to its total, feed per-phase histograms
+// summarised at GET /debug/phases and are attached to its recent-requests
+// entry.
+const (
+	phaseDecode   = "decode"
+	phaseSelect   = "select"
+	phaseQueue    = "queue"
+	phaseUpstream = "upstream"
+	phaseWrite    = "write"
+)
+
+// taskPhases lists the phases in the order a task goes through them
+var taskPhases = []string{phaseDecode, phaseSelect, phaseQueue, phaseUpstream, phaseWrite}
+
+// defaultPhaseSampleRate times one in this many tasks
+const defaultPhaseSampleRate = 100
+
+// phaseTimer times the phases of one sampled task. A nil *phaseTimer, the
+// one unsampled tasks carry, ignores every call.
+type phaseTimer struct {
+	mu      sync.Mutex
+	start   time.Time
+	last    time.Time
+	waiting time.Duration
+	d       map[string]time.Duration
+}
+
+// mark attributes the time since the previous mark to phase, less what was
+// spent waiting meanwhile, which goes to phaseQueue
+func (p *phaseTimer) mark(phase string) {
+	if p == nil {
+		return
+	}
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	elapsed := now.Sub(p.last)
+	waited := p.waiting
+	if waited > elapsed {
+		waited = elapsed
+	}
+	p.d[phaseQueue] += waited
+	p.d[phase] += elapsed - waited
+	p.last, p.waiting = now, 0
+}
+
+// waited records a wait of d inside the current phase
+func (p *phaseTimer) waited(d time.Duration) {
+	if p == nil || d <= 0 {
+		return
+	}
+	p.mu.Lock()
+	p.waiting += d
+	p.mu.Unlock()
+}
+
+// reached reports whether phase was marked
+func (p *phaseTimer) reached(phase string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.d[phase]
+	return ok
+}
+
+// PhaseBreakdown is the time a sampled task spent in each phase
+type PhaseBreakdown struct {
+	DecodeMs   float64 `json:"decodeMs"`
+	SelectMs   float64 `json:"selectMs"`
+	QueueMs    float64 `json:"queueMs"`
+	UpstreamMs float64 `json:"upstreamMs"`
+	WriteMs    float64 `json:"writeMs"`
+	TotalMs    float64 `json:"totalMs"`
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// breakdown returns the phases timed so far
+func (p *phaseTimer) breakdown() PhaseBreakdown {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return PhaseBreakdown{
+		DecodeMs:   durationMs(p.d[phaseDecode]),
+		SelectMs:   durationMs(p.d[phaseSelect]),
+		QueueMs:    durationMs(p.d[phaseQueue]),
+		UpstreamMs: durationMs(p.d[phaseUpstream]),
+		WriteMs:    durationMs(p.d[phaseWrite]),
+		TotalMs:    durationMs(p.last.Sub(p.start)),
+	}
+}
+
+// phaseProfiler decides which tasks are timed and accumulates their phases
+type phaseProfiler struct {
+	rate     int64
+	requests int64
+	sampled  int64
+	phases   map[string]*rollingStats
+	total    rollingStats
+}
+
+func newPhaseProfiler() *phaseProfiler {
+	p := &phaseProfiler{rate: defaultPhaseSampleRate, phases: make(map[string]*rollingStats, len(taskPhases))}
+	for _, phase := range taskPhases {
+		p.phases[phase] = &rollingStats{}
+	}
+	return p
+}
+
+// configure sets the sample rate; 0 times no task
+func (p *phaseProfiler) configure(rate int) {
+	atomic.StoreInt64(&p.rate, int64(rate))
+}
+
+func (p *phaseProfiler) sampleRate() int {
+	return int(atomic.LoadInt64(&p.rate))
+}
+
+// sample counts a task received at start and returns a timer for it if it
+// is one of the sampled, nil otherwise
+func (p *phaseProfiler) sample(start time.Time) *phaseTimer {
+	n := atomic.AddInt64(&p.requests, 1)
+	rate := atomic.LoadInt64(&p.rate)
+	if rate <= 0 || n%rate != 0 {
+		return nil
+	}
+	atomic.AddInt64(&p.sampled, 1)
+	return &phaseTimer{start: start, last: start, d: make(map[string]time.Duration, len(taskPhases))}
+}
+
+// observe adds the phases of a sampled task to the histograms
+func (p *phaseProfiler) observe(t *phaseTimer) PhaseBreakdown {
+	t.mu.Lock()
+	for _, phase := range taskPhases {
+		p.phases[phase].observe(t.d[phase], false)
+	}
+	p.total.observe(t.last.Sub(t.start), false)
+	t.mu.Unlock()
+	return t.breakdown()
+}
+
+// finishPhases closes the last phase of a sampled task, accounts it and,
+// if it was forwarded and so has one, attaches the breakdown to its
+// recent-requests entry
+func (lb *LoadBalancer) finishPhases(requestID string, t *phaseTimer) {
+	if t == nil {
+		return
+	}
+	t.mark(phaseWrite)
+	b := lb.phases.observe(t)
+	if t.reached(phaseUpstream) {
+		lb.recent.setPhases(requestID, b)
+	}
+}
+
+// PhaseStats summarises the sampled durations of one phase
+type PhaseStats struct {
+	Phase  string  `json:"phase"`
+	Count  int64   `json:"count"`
+	MeanMs float64 `json:"meanMs"`
+	P50Ms  float64 `json:"p50Ms"`
+	P95Ms  float64 `json:"p95Ms"`
+	P99Ms  float64 `json:"p99Ms"`
+}
+
+// PhaseReport is the GET /debug/phases document
+type PhaseReport struct {
+	SampleRate int          `json:"sampleRate"`
+	Requests   int64        `json:"requests"`
+	Sampled    int64        `json:"sampled"`
+	Phases     []PhaseStats `json:"phases"`
+	Total      PhaseStats   `json:"total"`
+}
+
+func phaseStats(phase string, snap statsSnapshot) PhaseStats {
+	s := PhaseStats{
+		Phase: phase,
+		Count: snap.Requests,
+		P50Ms: snap.quantile(0.5),
+		P95Ms: snap.quantile(0.95),
+		P99Ms: snap.quantile(0.99),
+	}
+	if snap.Requests > 0 {
+		s.MeanMs = snap.LatencySumMs / float64(snap.Requests)
+	}
+	return s
+}
+
+// report returns the sampling counters and the summary of every phase
+func (p *phaseProfiler) report() PhaseReport {
+	r := PhaseReport{
+		SampleRate: p.sampleRate(),
+		Requests:   atomic.LoadInt64(&p.requests),
+		Sampled:    atomic.LoadInt64(&p.sampled),
+		Phases:     make([]PhaseStats, 0, len(taskPhases)),
+		Total:      phaseStats("total", p.total.snapshot()),
+	}
+	for _, phase := range taskPhases {
+		r.Phases = append(r.Phases, phaseStats(phase, p.phases[phase].snapshot()))
+	}
+	return r
+}
+
+// handleDebugPhases は handleTask の各フェーズ (decode/select/queue/upstream/write) の所要時間の集計を返す HTTP ハンドラです。
+// phaseSampleRate 件に 1 件の割合でサンプリングされたタスクのみを計測し、総リクエスト数とサンプル数も返します。
+func handleDebugPhases(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lb.phases.report())
+}
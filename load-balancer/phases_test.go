@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPhaseSampling(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", newDelayStub(t, "worker-1", 20*time.Millisecond).URL, "#FF0000", 1)
+	lb.phases.configure(4)
+
+	var ids []string
+	for i := 0; i < 20; i++ {
+		rec := doTask(nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("task %d: status %d", i, rec.Code)
+		}
+		ids = append(ids, rec.Header().Get(requestIDHeader))
+	}
+
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/phases", nil))
+	var report PhaseReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.SampleRate != 4 || report.Requests != 20 || report.Sampled != 5 {
+		t.Fatalf("report: rate %d, %d requests, %d sampled; want 4, 20, 5", report.SampleRate, report.Requests, report.Sampled)
+	}
+	if report.Total.Count != 5 || len(report.Phases) != len(taskPhases) {
+		t.Fatalf("report: %d totals, %d phases", report.Total.Count, len(report.Phases))
+	}
+	for _, p := range report.Phases {
+		if p.Count != 5 {
+			t.Errorf("phase %s: %d samples, want 5", p.Phase, p.Count)
+		}
+	}
+
+	// Only the sampled tasks carry a breakdown, whose phases add up to it
+	sampled := 0
+	for _, id := range ids {
+		e, ok := lb.recent.find(id)
+		if !ok {
+			t.Fatalf("%s not in the recent requests", id)
+		}
+		if e.Phases == nil {
+			continue
+		}
+		sampled++
+		p := e.Phases
+		sum := p.DecodeMs + p.SelectMs + p.QueueMs + p.UpstreamMs + p.WriteMs
+		if math.Abs(sum-p.TotalMs) > 0.01 {
+			t.Errorf("%s: phases add up to %.3fms, total %.3fms", id, sum, p.TotalMs)
+		}
+		if p.UpstreamMs < 20 || p.TotalMs < float64(e.LatencyMs) {
+			t.Errorf("%s: upstream %.3fms, total %.3fms, latency %dms", id, p.UpstreamMs, p.TotalMs, e.LatencyMs)
+		}
+	}
+	if sampled != 5 {
+		t.Errorf("%d recent requests with phases, want 5", sampled)
+	}
+
+	// 0 turns the sampling off
+	lb.phases.configure(0)
+	for i := 0; i < 8; i++ {
+		doTask(nil)
+	}
+	if r := lb.phases.report(); r.Requests != 28 || r.Sampled != 5 {
+		t.Errorf("sampling off: %d requests, %d sampled", r.Requests, r.Sampled)
+	}
+}
+
+func TestPhaseQueueWait(t *testing.T) {
+	timer := &phaseTimer{start: time.Now(), d: make(map[string]time.Duration)}
+	timer.last = timer.start
+	time.Sleep(30 * time.Millisecond)
+	timer.waited(20 * time.Millisecond)
+	timer.mark(phaseSelect)
+	b := timer.breakdown()
+	if b.QueueMs != 20 || b.SelectMs < 10 || math.Abs(b.QueueMs+b.SelectMs-b.TotalMs) > 0.01 {
+		t.Errorf("breakdown = %+v, want the wait under queue", b)
+	}
+
+	var nilTimer *phaseTimer
+	nilTimer.waited(time.Second)
+	nilTimer.mark(phaseSelect)
+}
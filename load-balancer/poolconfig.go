@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// poolConfigTimeout bounds a pool-wide config push, each phase of an atomic
+// one included
+const poolConfigTimeout = 5 * time.Second
+
+// PoolConfigFailure is a worker that did not accept a pushed config
+type PoolConfigFailure struct {
+	Worker string `json:"worker"`
+	Error  string `json:"error"`
+}
+
+// PoolConfigResult is the response of PUT /workers/config. Aborted is set
+// when an atomic push was rejected by the dry run, in which case nothing was
+// applied and Failed lists the workers that rejected it.
+type PoolConfigResult struct {
+	Applied []string            `json:"applied"`
+	Failed  []PoolConfigFailure `json:"failed"`
+	Aborted bool                `json:"aborted,omitempty"`
+}
+
+// PushConfig sends body, a config document or partial patch, to the /config
+// endpoint of every worker matching selector, concurrently. When atomic is
+// set every worker first validates it with a dry run, and a single rejection
+// aborts the push. It returns false if no worker matches.
+func (lb *LoadBalancer) PushConfig(ctx context.Context, body []byte, selector map[string]string, atomic bool) (PoolConfigResult, bool) {
+	lb.mu.RLock()
+	var targets []string
+	for _, w := range lb.workers {
+		if w.matchesLabels(selector) {
+			targets = append(targets, w.Name)
+		}
+	}
+	lb.mu.RUnlock()
+	if len(targets) == 0 {
+		return PoolConfigResult{}, false
+	}
+
+	if atomic {
+		res := lb.fanOutConfig(ctx, targets, "/config?dry_run=true", body)
+		if len(res.Failed) > 0 {
+			res.Applied = []string{}
+			res.Aborted = true
+			return res, true
+		}
+	}
+	res := lb.fanOutConfig(ctx, targets, "/config", body)
+	lb.emitEvent("pool_config", fmt.Sprintf("Config pushed to %d of %d workers", len(res.Applied), len(targets)), map[string]interface{}{
+		"applied": res.Applied,
+		"failed":  res.Failed,
+		"atomic":  atomic,
+	})
+	return res, true
+}
+
+// fanOutConfig PUTs body to endpoint on every target within
+// poolConfigTimeout and sorts them into applied and failed, in pool order
+func (lb *LoadBalancer) fanOutConfig(ctx context.Context, targets []string, endpoint string, body []byte) PoolConfigResult {
+	ctx, cancel := context.WithTimeout(ctx, poolConfigTimeout)
+	defer cancel()
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, name := range targets {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			resp, err := lb.callWorker(ctx, name, http.MethodPut, endpoint, bytes.NewReader(body))
+			if err == nil && (resp.status < 200 || resp.status > 299) {
+				err = workerConfigError(resp)
+			}
+			errs[i] = err
+		}(i, name)
+	}
+	wg.Wait()
+
+	res := PoolConfigResult{Applied: []string{}, Failed: []PoolConfigFailure{}}
+	for i, name := range targets {
+		if errs[i] != nil {
+			res.Failed = append(res.Failed, PoolConfigFailure{Worker: name, Error: errs[i].Error()})
+		} else {
+			res.Applied = append(res.Applied, name)
+		}
+	}
+	return res
+}
+
+// workerConfigError describes a worker's rejection of a config, using the
+// error it reported when there is one
+func workerConfigError(resp *workerResponse) error {
+	var body struct {
+		Error  string      `json:"error"`
+		Detail interface{} `json:"detail"`
+	}
+	if json.Unmarshal(resp.body, &body) == nil {
+		switch detail := body.Detail.(type) {
+		case string:
+			body.Error = detail
+		case map[string]interface{}:
+			if msg, ok := detail["error"].(string); ok {
+				body.Error = msg
+			}
+		}
+	}
+	msg := body.Error
+	if msg == "" {
+		msg = strings.TrimSpace(string(resp.body))
+	}
+	if msg == "" {
+		msg = http.StatusText(resp.status)
+	}
+	return fmt.Errorf("status %d: %s", resp.status, msg)
+}
+
+// poolConfigCode maps the outcome of a push to the HTTP status code
+func poolConfigCode(res PoolConfigResult) int {
+	switch {
+	case res.Aborted:
+		return http.StatusConflict
+	case len(res.Failed) == 0:
+		return http.StatusOK
+	case len(res.Applied) > 0:
+		return http.StatusMultiStatus
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// handleWorkersConfig は PUT /workers/config で設定ドキュメントまたは部分パッチをプール内の全ワーカーの /config へ並行して送る HTTP ハンドラです。
+// ?selector=key=value,... でラベルが一致するワーカーに絞り込めます。結果は {"applied": [...], "failed": [{"worker","error"}]} をプール順で返し、
+// 全て成功なら 200、一部失敗なら 207、全て失敗なら 502、一致するワーカーがなければ 404 を返します。
+// ?atomic=true の場合はまず全ワーカーに dry_run=true で検証させ、1 台でも拒否すれば何も適用せずに aborted: true と拒否したワーカーを 409 で返します。
+func handleWorkersConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	selector, err := parseLabels(q.Get("selector"))
+	if err != nil {
+		writeMetadataError(w, &MetadataError{"selector", err.Error()})
+		return
+	}
+	atomic := false
+	if raw := q.Get("atomic"); raw != "" {
+		if atomic, err = strconv.ParseBool(raw); err != nil {
+			writeMetadataError(w, &MetadataError{"atomic", "must be true or false"})
+			return
+		}
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeMetadataError(w, &MetadataError{"body", err.Error()})
+		return
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(body, &doc); err != nil || doc == nil {
+		writeMetadataError(w, &MetadataError{"body", "must be a JSON object"})
+		return
+	}
+
+	res, ok := lb.PushConfig(r.Context(), body, selector, atomic)
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(api.ErrorResponse{Error: "No workers match the selector", Field: "selector"})
+		return
+	}
+	w.WriteHeader(poolConfigCode(res))
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// pushTarget emulates a worker's /config: a dry run rejects a failure_rate
+// above maxFailureRate, a real update applies whatever it is sent
+type pushTarget struct {
+	mu             sync.Mutex
+	maxFailureRate float64
+	dryRuns        int
+	applied        map[string]interface{}
+}
+
+func newPushTarget(t *testing.T, maxFailureRate float64) (*httptest.Server, *pushTarget) {
+	t.Helper()
+	pt := &pushTarget{maxFailureRate: maxFailureRate}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var cfg map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&cfg)
+		pt.mu.Lock()
+		defer pt.mu.Unlock()
+		if r.URL.Query().Get("dry_run") == "true" {
+			pt.dryRuns++
+			if rate, _ := cfg["failure_rate"].(float64); rate > pt.maxFailureRate {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "failure_rate out of range", "field": "failure_rate"})
+				return
+			}
+			json.NewEncoder(w).Encode(cfg)
+			return
+		}
+		pt.applied = cfg
+		json.NewEncoder(w).Encode(cfg)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, pt
+}
+
+func pushConfig(t *testing.T, query, body string) (int, PoolConfigResult) {
+	t.Helper()
+	srv := httptest.NewServer(newMux())
+	defer srv.Close()
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/api/workers/config"+query, strings.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var res PoolConfigResult
+	json.NewDecoder(resp.Body).Decode(&res)
+	return resp.StatusCode, res
+}
+
+func TestPoolConfigPush(t *testing.T) {
+	a, aw := newPushTarget(t, 1)
+	b, bw := newPushTarget(t, 1)
+	c, cw := newPushTarget(t, 1)
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-a", a.URL, "#FF0000", 1)
+	lb.AddWorker("worker-b", b.URL, "#00FF00", 1)
+	lb.AddWorker("worker-c", c.URL, "#0000FF", 1)
+	lb.SetWorkerLabels("worker-a", map[string]string{"zone": "east"})
+	lb.SetWorkerLabels("worker-b", map[string]string{"zone": "east"})
+
+	code, res := pushConfig(t, "", `{"response_delay_ms": 250}`)
+	if code != http.StatusOK || strings.Join(res.Applied, ",") != "worker-a,worker-b,worker-c" || len(res.Failed) != 0 {
+		t.Fatalf("push: %d %+v, want 200 applied by every worker in pool order", code, res)
+	}
+	for _, pt := range []*pushTarget{aw, bw, cw} {
+		if pt.applied["response_delay_ms"] != 250.0 || pt.dryRuns != 0 {
+			t.Errorf("worker config = %v after %d dry runs, want response_delay_ms 250 and no dry run", pt.applied, pt.dryRuns)
+		}
+	}
+
+	code, res = pushConfig(t, "?selector=zone=east", `{"failure_rate": 0.5}`)
+	if code != http.StatusOK || strings.Join(res.Applied, ",") != "worker-a,worker-b" {
+		t.Errorf("selector push: %d %+v, want 200 applied by worker-a and worker-b", code, res)
+	}
+	if cw.applied["failure_rate"] != nil {
+		t.Errorf("worker-c got %v outside the selector", cw.applied)
+	}
+
+	if code, _ := pushConfig(t, "?selector=zone=west", `{}`); code != http.StatusNotFound {
+		t.Errorf("push matching no worker: %d, want 404", code)
+	}
+	if code, _ := pushConfig(t, "", `[1]`); code != http.StatusBadRequest {
+		t.Errorf("push of a non-object: %d, want 400", code)
+	}
+}
+
+func TestPoolConfigPartialFailure(t *testing.T) {
+	a, aw := newPushTarget(t, 1)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-a", a.URL, "#FF0000", 1)
+	lb.AddWorker("worker-b", down.URL, "#00FF00", 1)
+
+	code, res := pushConfig(t, "", `{"queue_size": 80}`)
+	if code != http.StatusMultiStatus {
+		t.Fatalf("status = %d, want 207", code)
+	}
+	if len(res.Applied) != 1 || res.Applied[0] != "worker-a" || aw.applied["queue_size"] != 80.0 {
+		t.Errorf("applied = %v, want worker-a", res.Applied)
+	}
+	if len(res.Failed) != 1 || res.Failed[0].Worker != "worker-b" || res.Failed[0].Error == "" {
+		t.Errorf("failed = %+v, want worker-b with an error", res.Failed)
+	}
+
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-b", down.URL, "#00FF00", 1)
+	if code, _ := pushConfig(t, "", `{"queue_size": 80}`); code != http.StatusBadGateway {
+		t.Errorf("push failing everywhere: %d, want 502", code)
+	}
+}
+
+func TestPoolConfigAtomicAbort(t *testing.T) {
+	a, aw := newPushTarget(t, 1)
+	b, bw := newPushTarget(t, 0.3)
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-a", a.URL, "#FF0000", 1)
+	lb.AddWorker("worker-b", b.URL, "#00FF00", 1)
+
+	code, res := pushConfig(t, "?atomic=true", `{"failure_rate": 0.5}`)
+	if code != http.StatusConflict || !res.Aborted {
+		t.Fatalf("status = %d aborted %v, want 409 aborted", code, res.Aborted)
+	}
+	if len(res.Applied) != 0 || len(res.Failed) != 1 || res.Failed[0].Worker != "worker-b" ||
+		!strings.Contains(res.Failed[0].Error, "failure_rate out of range") {
+		t.Errorf("result = %+v, want only worker-b's rejection", res)
+	}
+	if aw.applied != nil || bw.applied != nil {
+		t.Errorf("aborted push applied %v and %v", aw.applied, bw.applied)
+	}
+
+	code, res = pushConfig(t, "?atomic=true", `{"failure_rate": 0.2}`)
+	if code != http.StatusOK || len(res.Applied) != 2 || aw.dryRuns != 2 || bw.applied["failure_rate"] != 0.2 {
+		t.Errorf("valid atomic push: %d %+v, want applied after a dry run on both", code, res)
+	}
+}
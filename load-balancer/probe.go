@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// Default synthetic probe settings
+const (
+	defaultProbeRps = 0.2
+	maxProbeRps     = 10
+	// probeIdleRecheck is how often a disabled prober re-reads the settings
+	probeIdleRecheck = time.Second
+)
+
+// ProbeSummary is the result summary of a worker's synthetic probes
+type ProbeSummary = api.ProbeSummary
+
+// probeState tracks the synthetic probes sent to one worker. Probe results
+// are also recorded in stats (so the rolling windows have data without client
+// traffic) and separately here so reports on client traffic can exclude them.
+type probeState struct {
+	inFlight int32
+
+	mu      sync.Mutex
+	summary ProbeSummary
+	stats   rollingStats
+}
+
+// record stores the result of one probe
+func (p *probeState) record(at time.Time, latency time.Duration, err error) {
+	p.stats.observe(latency, err != nil)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.summary.Sent++
+	p.summary.LastLatencyMs = latency.Milliseconds()
+	p.summary.LastAt = &at
+	p.summary.LastError = ""
+	if err != nil {
+		p.summary.Failed++
+		p.summary.LastError = err.Error()
+	}
+}
+
+// snapshot returns the summary, or nil if no probe has completed
+func (p *probeState) snapshot() *ProbeSummary {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.summary.Sent == 0 {
+		return nil
+	}
+	s := p.summary
+	return &s
+}
+
+// probeWorker sends one synthetic task directly to w, bypassing selection.
+// It does not count towards TotalRequests or the request metrics. A probe is
+// skipped if the previous one to the same worker is still in flight.
+func (lb *LoadBalancer) probeWorker(ctx context.Context, w *Worker, seq int64) {
+	if !atomic.CompareAndSwapInt32(&w.probe.inFlight, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&w.probe.inFlight, 0)
+
+	lb.mu.RLock()
+	timeout := lb.upstreamTimeout
+	lb.mu.RUnlock()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	body, _ := json.Marshal(TaskRequest{ID: fmt.Sprintf("probe-%s-%d", w.Name, seq), Weight: 0.1, Synthetic: true})
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, w.URL+"/task", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(syntheticHeader, "true")
+
+	start := time.Now()
+	resp, err := lb.client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+	}
+	if errors.Is(ctx.Err(), context.Canceled) {
+		// Shutting down; don't record an error the worker didn't cause
+		return
+	}
+	latency := time.Since(start)
+	w.stats.observe(latency, err != nil)
+	w.probe.record(lb.clock.Now().UTC(), latency, err)
+}
+
+// StartProber sends synthetic probes to every enabled worker at the
+// configured rate. Rate and enablement are re-read before every tick.
+func (lb *LoadBalancer) StartProber(ctx context.Context) {
+	var seq int64
+	for {
+		lb.mu.RLock()
+		enabled, rps := lb.probeEnabled, lb.probeRps
+		lb.mu.RUnlock()
+
+		interval := probeIdleRecheck
+		if enabled {
+			interval = time.Duration(float64(time.Second) / rps)
+		}
+		timer := lb.clock.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+		if !enabled {
+			continue
+		}
+		if lb.shedding(shedProbes) {
+			lb.metrics.shedActions.WithLabelValues(shedActionProbe).Inc()
+			continue
+		}
+
+		seq++
+		lb.mu.RLock()
+		for _, w := range lb.workers {
+			if w.Enabled && !w.Draining {
+				go lb.probeWorker(ctx, w, seq)
+			}
+		}
+		lb.mu.RUnlock()
+	}
+}
+
+// snapshotClientStats returns the cumulative stats of every worker with
+// synthetic probe traffic removed
+func (lb *LoadBalancer) snapshotClientStats() map[string]statsSnapshot {
+	lb.mu.RLock()
+	workers := make([]*Worker, len(lb.workers))
+	copy(workers, lb.workers)
+	lb.mu.RUnlock()
+
+	out := make(map[string]statsSnapshot, len(workers))
+	for _, w := range workers {
+		out[w.Name] = w.stats.snapshot().sub(w.probe.stats.snapshot())
+	}
+	return out
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// newProbeStub counts task requests flagged synthetic in both the header and
+// the body; failing stubs return 500
+func newProbeStub(t *testing.T, failing bool, probes *int32) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var task api.TaskRequest
+		json.NewDecoder(r.Body).Decode(&task)
+		if task.Synthetic && r.Header.Get(syntheticHeader) == "true" {
+			atomic.AddInt32(probes, 1)
+		}
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": task.ID})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestProberPopulatesWindows(t *testing.T) {
+	var okProbes, badProbes int32
+	good := newProbeStub(t, false, &okProbes)
+	bad := newProbeStub(t, true, &badProbes)
+
+	t.Setenv("LB_TIMESERIES_RETENTION", "1m")
+	clk := newFakeClock()
+	lb = NewLoadBalancer("round-robin")
+	t.Cleanup(lb.stopControl)
+	lb.clock = clk
+	lb.AddWorker("worker-1", good.URL, "#FF0000", 1)
+	lb.AddWorker("worker-2", bad.URL, "#00FF00", 1)
+	lb.AddWorker("worker-3", good.URL, "#0000FF", 1)
+	f := false
+	lb.UpdateWorker("worker-3", &f, nil)
+
+	s := lb.Settings()
+	s.ProbeEnabled = true
+	s.ProbeRps = 1
+	if _, err := lb.UpdateSettings(s); err != nil {
+		t.Fatalf("UpdateSettings: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lb.StartProber(ctx)
+
+	lb.sampleTimeseries() // baseline
+	for i := int32(1); i <= 3; i++ {
+		clk.waitForTimer(t)
+		clk.Advance(time.Second)
+		waitForHits(t, &okProbes, i)
+		waitForHits(t, &badProbes, i)
+		waitForProbes(t, lb.workers[0], int64(i))
+		waitForProbes(t, lb.workers[1], int64(i))
+		lb.sampleTimeseries()
+	}
+
+	_, rps := getTimeseries(t, "metric=rps&worker=worker-1")
+	_, errs := getTimeseries(t, "metric=errors&worker=worker-2")
+	if last := rps.Values[len(rps.Values)-1]; last == nil || *last != 1 {
+		t.Errorf("worker-1 rps = %v, want 1", deref(rps.Values))
+	}
+	if last := errs.Values[len(errs.Values)-1]; last == nil || *last != 1 {
+		t.Errorf("worker-2 error rate = %v, want 1", deref(errs.Values))
+	}
+
+	for _, w := range lb.workers {
+		if w.TotalRequests != 0 || w.FailedRequests != 0 {
+			t.Errorf("%s counters = %d/%d, probes must not count", w.Name, w.TotalRequests, w.FailedRequests)
+		}
+	}
+	if lb.workers[2].stats.snapshot().Requests != 0 {
+		t.Error("disabled worker was probed")
+	}
+
+	// Probe results are summarized in status
+	workers := lb.GetStatus()["workers"].([]map[string]interface{})
+	p1, _ := workers[0]["probe"].(*ProbeSummary)
+	p2, _ := workers[1]["probe"].(*ProbeSummary)
+	if p1 == nil || p1.Sent != 3 || p1.Failed != 0 {
+		t.Errorf("worker-1 probe = %+v, want 3 sent", p1)
+	}
+	if p2 == nil || p2.Failed != 3 || p2.LastError != "status 500" {
+		t.Errorf("worker-2 probe = %+v, want 3 failed", p2)
+	}
+	if _, ok := workers[2]["probe"]; ok {
+		t.Error("disabled worker should have no probe summary")
+	}
+
+	// Algorithm sessions only report client traffic
+	report := lb.AlgorithmReport()
+	if got := report[len(report)-1].Requests; got != 0 {
+		t.Errorf("session requests = %d, want 0", got)
+	}
+}
+
+func TestProberDisabled(t *testing.T) {
+	var probes int32
+	srv := newProbeStub(t, false, &probes)
+
+	clk := newFakeClock()
+	lb = NewLoadBalancer("round-robin")
+	lb.clock = clk
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lb.StartProber(ctx)
+
+	for i := 0; i < 3; i++ {
+		clk.waitForTimer(t)
+		clk.Advance(probeIdleRecheck)
+	}
+	clk.waitForTimer(t)
+	if got := atomic.LoadInt32(&probes); got != 0 {
+		t.Errorf("probes sent while disabled = %d", got)
+	}
+
+	s := lb.Settings()
+	s.ProbeRps = 0
+	if _, err := lb.UpdateSettings(s); err == nil {
+		t.Error("probeRps 0 should be rejected")
+	}
+}
+
+// waitForProbes polls until n probes to w have been recorded
+func waitForProbes(t *testing.T, w *Worker, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if p := w.probe.snapshot(); p != nil && p.Sent >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s probes = %+v, want %d", w.Name, w.probe.snapshot(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
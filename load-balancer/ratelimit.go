@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Pool rate ceiling. With rateCeilingRps set, the pool admits at most
+// rateCeilingRps * rateWindowMs tasks per accounting window, shared fairly
+// between the clients sending them: every window each client's demand is
+// estimated as the larger of what it sent in the previous window and what it
+// has sent so far in this one, and the ceiling is divided with max-min
+// fairness, so a client asking for less than an equal share gets all it
+// asks for and the rest is split evenly between the others. A task beyond
+// its client's share, or beyond the ceiling, is answered 429 before a
+// worker is selected. Clients are told apart by X-API-Key, or without one
+// by their address as clientAddr sees it.
+const (
+	apiKeyHeader         = "X-API-Key"
+	defaultRateWindow    = time.Second
+	minRateWindow        = 100 * time.Millisecond
+	maxRateWindow        = time.Minute
+	rateCeilingExceeded  = "rate_ceiling"
+	rateCeilingErrorText = "Pool rate ceiling reached; this client is over its fair share"
+)
+
+// rateClient is one client's count in the current and previous window
+type rateClient struct {
+	prev     int64
+	demand   int64
+	admitted int64
+	rejected int64
+}
+
+// rateLimiter enforces the pool rate ceiling
+type rateLimiter struct {
+	mu       sync.Mutex
+	ceiling  float64
+	window   time.Duration
+	start    time.Time
+	clients  map[string]*rateClient
+	admitted int64
+	rejected int64
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{window: defaultRateWindow, clients: make(map[string]*rateClient)}
+}
+
+// configure sets the ceiling in tasks per second, 0 for none, and the
+// accounting window. A change starts a new window with no history.
+func (l *rateLimiter) configure(ceiling float64, window time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if ceiling == l.ceiling && window == l.window {
+		return
+	}
+	l.ceiling, l.window = ceiling, window
+	l.start = time.Time{}
+	l.clients = make(map[string]*rateClient)
+	l.admitted, l.rejected = 0, 0
+}
+
+func (l *rateLimiter) config() (float64, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ceiling, l.window
+}
+
+// rollLocked moves to the window now is in. A client's demand becomes its
+// previous demand if the window that ended was the one before; clients that
+// sent nothing in it are forgotten. Must be called with l.mu held.
+func (l *rateLimiter) rollLocked(now time.Time) {
+	if l.start.IsZero() {
+		l.start = now
+		return
+	}
+	n := now.Sub(l.start) / l.window
+	if n < 1 {
+		return
+	}
+	for id, c := range l.clients {
+		if n > 1 || c.demand == 0 {
+			delete(l.clients, id)
+			continue
+		}
+		*c = rateClient{prev: c.demand}
+	}
+	l.start = l.start.Add(n * l.window)
+	l.admitted, l.rejected = 0, 0
+}
+
+// capacityLocked is the number of tasks the ceiling admits per window. Must
+// be called with l.mu held.
+func (l *rateLimiter) capacityLocked() float64 {
+	return l.ceiling * l.window.Seconds()
+}
+
+// sharesLocked divides the window's capacity between the clients by max-min
+// fairness over their estimated demand. Must be called with l.mu held.
+func (l *rateLimiter) sharesLocked() map[string]float64 {
+	ids := make([]string, 0, len(l.clients))
+	for id := range l.clients {
+		ids = append(ids, id)
+	}
+	demand := func(id string) float64 {
+		c := l.clients[id]
+		return float64(max(c.prev, c.demand))
+	}
+	sort.Slice(ids, func(i, j int) bool { return demand(ids[i]) < demand(ids[j]) })
+
+	shares := make(map[string]float64, len(ids))
+	remaining := l.capacityLocked()
+	for i, id := range ids {
+		share := math.Min(demand(id), remaining/float64(len(ids)-i))
+		shares[id] = share
+		remaining -= share
+	}
+	return shares
+}
+
+// admit counts a task of client at now and reports whether it is within the
+// client's share and the ceiling. The client's share is returned either
+// way.
+func (l *rateLimiter) admit(client string, now time.Time) (bool, ClientShare) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ceiling <= 0 {
+		return true, ClientShare{}
+	}
+	l.rollLocked(now)
+	c := l.clients[client]
+	if c == nil {
+		c = &rateClient{}
+		l.clients[client] = c
+	}
+	c.demand++
+	share := l.sharesLocked()[client]
+	ok := float64(c.admitted) < share && float64(l.admitted) < l.capacityLocked()
+	if ok {
+		c.admitted++
+		l.admitted++
+	} else {
+		c.rejected++
+		l.rejected++
+	}
+	return ok, l.clientShareLocked(client, c, share)
+}
+
+func (l *rateLimiter) clientShareLocked(id string, c *rateClient, share float64) ClientShare {
+	return ClientShare{
+		Client:         id,
+		DemandRps:      float64(max(c.prev, c.demand)) / l.window.Seconds(),
+		ShareRps:       share / l.window.Seconds(),
+		Admitted:       c.admitted,
+		Rejected:       c.rejected,
+		PreviousDemand: c.prev,
+	}
+}
+
+// ClientShare is one client's part of the pool rate ceiling in the current
+// window. DemandRps is the rate it is estimated to ask for and ShareRps the
+// rate it is allowed; Admitted and Rejected count its tasks in the window
+// and PreviousDemand the tasks it sent in the previous one.
+type ClientShare struct {
+	Client         string  `json:"client"`
+	DemandRps      float64 `json:"demandRps"`
+	ShareRps       float64 `json:"shareRps"`
+	Admitted       int64   `json:"admitted"`
+	Rejected       int64   `json:"rejected"`
+	PreviousDemand int64   `json:"previousDemand"`
+}
+
+// RateLimitShares is the GET /ratelimit/shares document
+type RateLimitShares struct {
+	CeilingRps  float64       `json:"ceilingRps"`
+	WindowMs    int64         `json:"windowMs"`
+	WindowStart *time.Time    `json:"windowStart,omitempty"`
+	Admitted    int64         `json:"admitted"`
+	Rejected    int64         `json:"rejected"`
+	Clients     []ClientShare `json:"clients"`
+}
+
+// shares returns the clients' shares of the window now is in
+func (l *rateLimiter) shares(now time.Time) RateLimitShares {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := RateLimitShares{CeilingRps: l.ceiling, WindowMs: l.window.Milliseconds(), Clients: []ClientShare{}}
+	if l.ceiling <= 0 {
+		return s
+	}
+	l.rollLocked(now)
+	start := l.start.UTC()
+	s.WindowStart = &start
+	s.Admitted, s.Rejected = l.admitted, l.rejected
+	for id, share := range l.sharesLocked() {
+		s.Clients = append(s.Clients, l.clientShareLocked(id, l.clients[id], share))
+	}
+	sort.Slice(s.Clients, func(i, j int) bool { return s.Clients[i].Client < s.Clients[j].Client })
+	return s
+}
+
+// retryAfter is how long until the window now is in ends
+func (l *rateLimiter) retryAfter(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.start.Add(l.window).Sub(now)
+}
+
+// rateClientID names the client of r: its API key, hashed so the key is
+// not shown in the shares, or else its address as clientAddr sees it
+func (lb *LoadBalancer) rateClientID(r *http.Request) string {
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		return fmt.Sprintf("key:%08x", h.Sum32())
+	}
+	return lb.clientAddr(r)
+}
+
+// limitTask enforces the pool rate ceiling on r. A task over its client's
+// share is answered 429 with the share and true is returned.
+func (lb *LoadBalancer) limitTask(w http.ResponseWriter, r *http.Request) bool {
+	now := lb.clock.Now()
+	ok, share := lb.rateLimit.admit(lb.rateClientID(r), now)
+	if ok {
+		return false
+	}
+	lb.metrics.rateCeilingRejected.Inc()
+	retry := lb.rateLimit.retryAfter(now)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":  rateCeilingErrorText,
+		"reason": rateCeilingExceeded,
+		"share":  share,
+	})
+	return true
+}
+
+// handleRateLimitShares はプール全体のレート上限と、現在の集計ウィンドウにおけるクライアントごとの推定需要・公平な割り当て・受理数・拒否数を返す HTTP ハンドラです。
+// rateCeilingRps が 0 の場合は clients が空になります。
+func handleRateLimitShares(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lb.rateLimit.shares(lb.clock.Now()))
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sendClientTasks sends n tasks as each client, one client after the
+// other, and returns how many of each were answered 429
+func sendClientTasks(t *testing.T, demand []struct {
+	key string
+	n   int
+}) map[string]int {
+	t.Helper()
+	rejected := map[string]int{}
+	for _, d := range demand {
+		for i := 0; i < d.n; i++ {
+			switch rec := doTask(map[string]string{apiKeyHeader: d.key}); rec.Code {
+			case http.StatusOK:
+			case http.StatusTooManyRequests:
+				rejected[d.key]++
+			default:
+				t.Fatalf("%s task %d: status %d", d.key, i, rec.Code)
+			}
+		}
+	}
+	return rejected
+}
+
+func TestRateCeilingFairShares(t *testing.T) {
+	clk := newFakeClock()
+	lb = NewLoadBalancer("round-robin")
+	lb.clock = clk
+	srv, hits := newCountingStub(t, "worker-1", 0)
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+	lb.rateLimit.configure(30, time.Second)
+
+	// c asks for far more than the ceiling, a and b for less than an equal
+	// share each; the first window sees them first come, first served
+	demand := []struct {
+		key string
+		n   int
+	}{{"client-c", 40}, {"client-b", 10}, {"client-a", 4}}
+	rejected := sendClientTasks(t, demand)
+	if got := atomic.LoadInt32(hits); got != 30 || rejected["client-c"]+rejected["client-b"]+rejected["client-a"] != 24 {
+		t.Fatalf("first window: %d forwarded, rejected %v; want the ceiling of 30", got, rejected)
+	}
+
+	// From the next window on, a and b get all they ask for and c the rest
+	clk.Advance(time.Second)
+	rejected = sendClientTasks(t, demand)
+	if rejected["client-a"] != 0 || rejected["client-b"] != 0 || rejected["client-c"] != 24 {
+		t.Errorf("second window rejected %v, want only 24 of client-c", rejected)
+	}
+	if got := atomic.LoadInt32(hits); got != 60 {
+		t.Errorf("%d tasks reached the worker, want 60", got)
+	}
+
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ratelimit/shares", nil))
+	var shares RateLimitShares
+	if err := json.NewDecoder(rec.Body).Decode(&shares); err != nil {
+		t.Fatal(err)
+	}
+	if shares.CeilingRps != 30 || shares.Admitted != 30 || shares.Rejected != 24 || len(shares.Clients) != 3 {
+		t.Fatalf("shares = %+v", shares)
+	}
+	got := map[float64]ClientShare{}
+	for _, c := range shares.Clients {
+		got[c.DemandRps] = c
+	}
+	for demandRps, wantShare := range map[float64]float64{4: 4, 10: 10, 40: 16} {
+		c := got[demandRps]
+		if c.ShareRps != wantShare || c.Admitted != int64(wantShare) {
+			t.Errorf("client demanding %v rps: %+v, want a share of %v", demandRps, c, wantShare)
+		}
+	}
+
+	// The 429 carries the client's share and when to retry
+	rec = doTask(map[string]string{apiKeyHeader: "client-c"})
+	var body struct {
+		Reason string      `json:"reason"`
+		Share  ClientShare `json:"share"`
+	}
+	json.NewDecoder(rec.Body).Decode(&body)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" || body.Reason != rateCeilingExceeded || body.Share.ShareRps != 16 || body.Share.Rejected != 25 {
+		t.Errorf("rejection: %d Retry-After %q %+v", rec.Code, rec.Header().Get("Retry-After"), body)
+	}
+
+	// Without a ceiling nothing is held back
+	lb.rateLimit.configure(0, time.Second)
+	if rejected := sendClientTasks(t, demand); len(rejected) != 0 {
+		t.Errorf("no ceiling: rejected %v", rejected)
+	}
+}
+
+func TestRateCeilingClientAddress(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.clock = newFakeClock()
+	lb.AddWorker("worker-1", newDelayStub(t, "worker-1", 0).URL, "#FF0000", 1)
+	lb.rateLimit.configure(100, time.Second)
+	clients := func() []string {
+		rec := httptest.NewRecorder()
+		newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ratelimit/shares", nil))
+		var shares RateLimitShares
+		json.NewDecoder(rec.Body).Decode(&shares)
+		var names []string
+		for _, c := range shares.Clients {
+			names = append(names, c.Client)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	// Tasks from one peer are one client whatever they forward
+	for _, ip := range []string{"203.0.113.7", "203.0.113.8"} {
+		doTask(map[string]string{"X-Forwarded-For": ip})
+	}
+	if got := clients(); !reflect.DeepEqual(got, []string{"192.0.2.1"}) {
+		t.Errorf("untrusted peer: clients %v, want the peer only", got)
+	}
+
+	// Behind a trusted proxy the forwarded addresses are the clients
+	lb.trustedProxies, _ = parseTrustedProxies("192.0.2.1")
+	for _, ip := range []string{"203.0.113.7", "203.0.113.8"} {
+		doTask(map[string]string{"X-Forwarded-For": ip})
+	}
+	if got := clients(); !reflect.DeepEqual(got, []string{"192.0.2.1", "203.0.113.7", "203.0.113.8"}) {
+		t.Errorf("trusted proxy: clients %v", got)
+	}
+}
+
+func TestRateCeilingSettings(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	for body, field := range map[string]string{
+		`{"rateCeilingRps": -1}`: "rateCeilingRps",
+		`{"rateWindowMs": 50}`:   "rateWindowMs",
+		`{"rateWindowMs": 0}`:    "rateWindowMs",
+	} {
+		rec := httptest.NewRecorder()
+		handleSettings(rec, httptest.NewRequest(http.MethodPut, "/settings", bytes.NewBufferString(body)))
+		var e SettingsError
+		json.NewDecoder(rec.Body).Decode(&e)
+		if rec.Code != http.StatusBadRequest || e.Field != field {
+			t.Errorf("%s: %d %+v, want 400 on %s", body, rec.Code, e, field)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handleSettings(rec, httptest.NewRequest(http.MethodPut, "/settings", bytes.NewBufferString(`{"rateCeilingRps": 200, "rateWindowMs": 500}`)))
+	if ceiling, window := lb.rateLimit.config(); rec.Code != http.StatusOK || ceiling != 200 || window != 500*time.Millisecond {
+		t.Errorf("settings: %d, ceiling %v, window %s", rec.Code, ceiling, window)
+	}
+}
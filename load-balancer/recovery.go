@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// recoverMiddleware turns a panic in a handler of mux into a 500 with the
+// request ID, logs its stack and counts it by route. Counters a handler keeps
+// in defers, such as worker load, are settled before it runs.
+func recoverMiddleware(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			_, pattern := mux.Handler(r)
+			if pattern == "" {
+				pattern = "unknown"
+			}
+			requestID := w.Header().Get(requestIDHeader)
+			if requestID == "" {
+				requestID = r.Header.Get(requestIDHeader)
+			}
+			if requestID == "" {
+				requestID = newRequestID()
+			}
+			lb.metrics.panics.WithLabelValues(pattern).Inc()
+			log.Printf("Panic in %s %s (request %s): %v\n%s", r.Method, pattern, requestID, p, debug.Stack())
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set(requestIDHeader, requestID)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(api.ErrorResponse{Error: "Internal server error", RequestID: requestID})
+		}()
+		mux.ServeHTTP(w, r)
+	})
+}
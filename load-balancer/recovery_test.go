@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/network-sandbox/load-balancer/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRecoverSelectorPanic(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", newRejectingWorker(t, rejectQueueFull, false).URL, "#FF0000", 1)
+	lb.AddWorker("worker-2", newRejectingWorker(t, rejectQueueFull, false).URL, "#00FF00", 1)
+	// The first pick works; retrying the rejected task hits the bug
+	var picks int32
+	lb.selectHook = func(available []*Worker) *Worker {
+		if atomic.AddInt32(&picks, 1) > 1 {
+			var bug []*Worker
+			return bug[len(available)]
+		}
+		return available[0]
+	}
+	handler := recoverMiddleware(newMux())
+
+	send := func(requestID string) (*httptest.ResponseRecorder, api.ErrorResponse) {
+		req := httptest.NewRequest(http.MethodPost, "/task", bytes.NewBufferString(`{"id":"t","weight":1}`))
+		if requestID != "" {
+			req.Header.Set(requestIDHeader, requestID)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		var body api.ErrorResponse
+		json.NewDecoder(rec.Body).Decode(&body)
+		return rec, body
+	}
+
+	rec, body := send("req-1")
+	if rec.Code != http.StatusInternalServerError || body.Error == "" || body.RequestID != "req-1" {
+		t.Fatalf("response = %d %+v, want 500 with request ID req-1", rec.Code, body)
+	}
+	if got := testutil.ToFloat64(lb.metrics.panics.WithLabelValues("/task")); got != 1 {
+		t.Errorf("panics{/task} = %v, want 1", got)
+	}
+
+	// Nothing is left held: not the lock, not the load of the worker that
+	// was forwarded to before the panic
+	lb.GetStatus()
+	for _, w := range lb.workers {
+		if load := atomic.LoadInt32(&w.CurrentLoad); load != 0 {
+			t.Errorf("%s load = %d after the panic, want 0", w.Name, load)
+		}
+	}
+	if n := atomic.LoadInt64(&lb.inFlight); n != 0 {
+		t.Errorf("in flight = %d, want 0", n)
+	}
+
+	// A request without an ID gets one generated
+	rec, body = send("")
+	if rec.Code != http.StatusInternalServerError || body.RequestID == "" || rec.Header().Get(requestIDHeader) != body.RequestID {
+		t.Errorf("response without a request ID = %d %+v", rec.Code, body)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// rejectReasonHeader carries the reason a worker turned a task away with 503
+const rejectReasonHeader = "X-Worker-Reject-Reason"
+
+// Worker rejection reasons
+const (
+	rejectQueueFull  = "queue_full"
+	rejectOverloaded = "overloaded"
+	// rejectDraining is a worker the LB told to drain or disable. Its tasks
+	// are always retried elsewhere.
+	rejectDraining = "draining"
+)
+
+// maxRecentRejections is how many rejections are kept per worker for status
+const maxRecentRejections = 10
+
+// maxRejectionBody bounds how much of a 503 body is read to find the reason
+const maxRejectionBody = 4 << 10
+
+// Rejection is one task a worker turned away
+type Rejection = api.Rejection
+
+// workerRejection is returned by forwardTo when the worker rejected the task
+// for lack of capacity
+type workerRejection struct {
+	worker     string
+	reason     string
+	retryAfter time.Duration
+}
+
+func (e *workerRejection) Error() string {
+	return fmt.Sprintf("Worker %s rejected the task (%s)", e.worker, e.reason)
+}
+
+// Task retries: a failed task is retried up to maxRetries times, each time
+// on a worker that has not failed it yet
+const (
+	defaultMaxRetries = 2
+	maxTaskRetries    = 10
+)
+
+// workerFailure is returned by forwardTo when the worker failed the task:
+// the request errored or the worker answered 5xx
+type workerFailure struct {
+	worker string
+	msg    string
+}
+
+func (e *workerFailure) Error() string {
+	return e.msg
+}
+
+// rejectionReason returns the rejection reason of a 503 response from its
+// header, falling back to the body's reason field. Other 503s (and unknown
+// reasons) return "".
+func rejectionReason(resp *http.Response) string {
+	reason := resp.Header.Get(rejectReasonHeader)
+	if reason == "" {
+		var body struct {
+			Reason string `json:"reason"`
+		}
+		if raw, err := readLimited(resp.Body, maxRejectionBody); err == nil {
+			json.Unmarshal(raw, &body)
+		}
+		reason = body.Reason
+	}
+	if reason != rejectQueueFull && reason != rejectOverloaded && reason != rejectDraining {
+		return ""
+	}
+	return reason
+}
+
+// rejectionLog keeps the most recent rejections of a worker
+type rejectionLog struct {
+	mu     sync.Mutex
+	recent []Rejection
+}
+
+func (l *rejectionLog) record(reason string, at time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.recent = append(l.recent, Rejection{Reason: reason, At: at.UTC()})
+	if len(l.recent) > maxRecentRejections {
+		l.recent = l.recent[len(l.recent)-maxRecentRejections:]
+	}
+}
+
+// snapshot returns the recent rejections, oldest first, or nil if none
+func (l *rejectionLog) snapshot() []Rejection {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.recent) == 0 {
+		return nil
+	}
+	return append([]Rejection(nil), l.recent...)
+}
+
+// retriesRejection reports whether a rejection for reason is retried on
+// another worker
+func (lb *LoadBalancer) retriesRejection(reason string) bool {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	switch reason {
+	case rejectQueueFull:
+		return lb.retryQueueFull
+	case rejectOverloaded:
+		return lb.retryOverloaded
+	case rejectDraining:
+		return true
+	}
+	return false
+}
+
+// forwardWithRetry forwards the task to worker and, up to maxRetries times,
+// retries it on another worker selected with the same hints when the
+// attempt fails: the worker errored or answered 5xx, or rejected the task
+// for a reason the retry policy covers. Workers that already failed the task
+// are excluded. A rejected task whose worker is the only eligible one is
+// tried again on that worker, after the wait planRetry schedules within the
+// request's deadline. Every attempt shares that deadline, so retries never
+// extend it. Requests pinned to a worker are never retried.
+func (lb *LoadBalancer) forwardWithRetry(ctx context.Context, h routeHints, worker *Worker, task TaskRequest, received time.Time) ([]byte, int, error) {
+	body, code, err := lb.forwardTo(ctx, worker, task, received)
+	if worker == nil || h.require != "" {
+		return body, code, err
+	}
+	lb.mu.RLock()
+	maxRetries := lb.maxRetries
+	lb.mu.RUnlock()
+
+	excluded := h
+	excluded.exclude = append([]string(nil), h.exclude...)
+	for retry := 1; retry <= maxRetries; retry++ {
+		var rej *workerRejection
+		var failure *workerFailure
+		rejected := errors.As(err, &rej)
+		switch {
+		case rejected && lb.retriesRejection(rej.reason):
+		case errors.As(err, &failure):
+		default:
+			return body, code, err
+		}
+
+		excluded.exclude = append(excluded.exclude, worker.Name)
+		next, _, _ := lb.selectWorker(excluded)
+		lb.mu.RLock()
+		eligible := lb.eligibleWorkersLocked()
+		remaining := upstreamTimeoutFrom(ctx, lb.upstreamTimeout) - time.Since(received)
+		lb.mu.RUnlock()
+		if next == nil {
+			if !rejected || len(eligible) != 1 || eligible[0] != worker {
+				return body, code, err
+			}
+			next = worker
+		}
+		if remaining <= 0 {
+			return body, code, err
+		}
+
+		if rejected {
+			p := planRetry(retry, next == worker, rej.retryAfter, remaining, retryJitter)
+			annotateRetry(ctx, &RetryDecision{
+				Decision:     p.decision,
+				Worker:       next.Name,
+				WaitMs:       p.wait.Milliseconds(),
+				RetryAfterMs: rej.retryAfter.Milliseconds(),
+			})
+			lb.metrics.retryDecisions.WithLabelValues(p.decision).Inc()
+			if p.decision == retryBeyondDeadline || !lb.sleepCtx(ctx, p.wait) {
+				return body, code, err
+			}
+			h.phases.waited(p.wait)
+			lb.metrics.rejectionRetries.WithLabelValues(worker.Name, rej.reason).Inc()
+		} else {
+			lb.metrics.failureRetries.WithLabelValues(worker.Name).Inc()
+		}
+		worker.stats.retried()
+		worker = next
+		body, code, err = lb.forwardTo(ctx, worker, task, received)
+	}
+	return body, code, err
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/network-sandbox/load-balancer/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newRejectingWorker answers every task the way the worker does when it
+// turns a task away: 503 with the reason in the header and the body, or only
+// in the body if headerless is set
+func newRejectingWorker(t *testing.T, reason string, headerless bool) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !headerless {
+			w.Header().Set(rejectReasonHeader, reason)
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": "rejected", "worker": "rejecter", "reason": reason})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestWorkerRejections(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer ok.Close()
+
+	tests := []struct {
+		name       string
+		reason     string
+		headerless bool
+		headers    map[string]string
+		retryQueue bool
+		wantCode   int
+		wantRetry  bool
+	}{
+		{"queue full is retried", rejectQueueFull, false, nil, true, http.StatusOK, true},
+		{"reason from body only", rejectQueueFull, true, nil, true, http.StatusOK, true},
+		{"overloaded is not retried", rejectOverloaded, false, nil, true, http.StatusServiceUnavailable, false},
+		{"retry disabled", rejectQueueFull, false, nil, false, http.StatusServiceUnavailable, false},
+		{"pinned request is not retried", rejectQueueFull, false, map[string]string{requireWorkerHeader: "rejecter"}, true, http.StatusServiceUnavailable, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb = NewLoadBalancer("round-robin")
+			lb.AddWorker("rejecter", newRejectingWorker(t, tt.reason, tt.headerless).URL, "#FF0000", 1)
+			lb.AddWorker("spare", ok.URL, "#00FF00", 1)
+			s := lb.Settings()
+			s.RetryOnQueueFull = tt.retryQueue
+			lb.UpdateSettings(s)
+
+			headers := tt.headers
+			if headers == nil {
+				headers = map[string]string{preferWorkerHeader: "rejecter"}
+			}
+			rec := doTask(headers)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status code = %d, want %d (%s)", rec.Code, tt.wantCode, rec.Body.String())
+			}
+			if tt.wantCode == http.StatusOK && servedBy(t, rec) != "spare" {
+				t.Error("retry should be served by the other worker")
+			}
+
+			m := lb.metrics
+			if got := testutil.ToFloat64(m.upstreamRejections.WithLabelValues("rejecter", tt.reason)); got != 1 {
+				t.Errorf("rejections{%s} = %v, want 1", tt.reason, got)
+			}
+			if got := testutil.ToFloat64(m.requestsTotal.WithLabelValues("rejecter", "rejected")); got != 1 {
+				t.Errorf("requests{rejected} = %v, want 1", got)
+			}
+			wantRetries := 0.0
+			if tt.wantRetry {
+				wantRetries = 1
+			}
+			if got := testutil.ToFloat64(m.rejectionRetries.WithLabelValues("rejecter", tt.reason)); got != wantRetries {
+				t.Errorf("retries = %v, want %v", got, wantRetries)
+			}
+			if got := lb.workers[0].stats.snapshot().Retries; float64(got) != wantRetries {
+				t.Errorf("worker retries = %d, want %v", got, wantRetries)
+			}
+
+			rejections := lb.GetStatus()["workers"].([]map[string]interface{})[0]["rejections"].([]Rejection)
+			if len(rejections) != 1 || rejections[0].Reason != tt.reason {
+				t.Errorf("status rejections = %+v, want one %s", rejections, tt.reason)
+			}
+		})
+	}
+}
+
+func TestUnexplained503IsNotARejection(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+
+	if rec := doTask(nil); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status code = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if got := testutil.ToFloat64(lb.metrics.requestsTotal.WithLabelValues("worker-1", "error")); got != 1 {
+		t.Errorf("requests{error} = %v, want 1", got)
+	}
+	if r := lb.workers[0].rejections.snapshot(); r != nil {
+		t.Errorf("rejections = %+v, want none", r)
+	}
+}
+
+func TestFailedTaskRetriedOnAnotherWorker(t *testing.T) {
+	var calls int32
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer down.Close()
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer ok.Close()
+
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("down", down.URL, "#FF0000", 1)
+	lb.AddWorker("spare", ok.URL, "#00FF00", 1)
+	rec := doTask(map[string]string{preferWorkerHeader: "down"})
+	var resp api.TaskResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status code = %d, err = %v", rec.Code, err)
+	}
+	if resp.Worker != "spare" || resp.Retries != 1 {
+		t.Errorf("served by %q after %d retries, want spare after 1", resp.Worker, resp.Retries)
+	}
+	w := lb.workers[0]
+	if w.FailedRequests != 1 || w.ConsecFailures != 1 || w.stats.snapshot().Retries != 1 {
+		t.Errorf("down: failed = %d, consecutive = %d, retries = %d", w.FailedRequests, w.ConsecFailures, w.stats.snapshot().Retries)
+	}
+	if got := testutil.ToFloat64(lb.metrics.failureRetries.WithLabelValues("down")); got != 1 {
+		t.Errorf("failure retries = %v, want 1", got)
+	}
+
+	// Every worker fails: each is tried once, up to maxRetries retries
+	lb = NewLoadBalancer("round-robin")
+	for _, name := range []string{"down-1", "down-2", "down-3", "down-4"} {
+		lb.AddWorker(name, down.URL, "#FF0000", 1)
+	}
+	for _, tt := range []struct{ maxRetries, want int32 }{{2, 3}, {0, 1}} {
+		s := lb.Settings()
+		s.MaxRetries = int(tt.maxRetries)
+		if _, err := lb.UpdateSettings(s); err != nil {
+			t.Fatalf("UpdateSettings: %v", err)
+		}
+		atomic.StoreInt32(&calls, 0)
+		if rec := doTask(nil); rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("maxRetries %d: status code = %d", tt.maxRetries, rec.Code)
+		}
+		if got := atomic.LoadInt32(&calls); got != tt.want {
+			t.Errorf("maxRetries %d: %d attempts, want %d", tt.maxRetries, got, tt.want)
+		}
+	}
+
+	s := lb.Settings()
+	s.MaxRetries = maxTaskRetries + 1
+	if _, err := lb.UpdateSettings(s); err == nil {
+		t.Error("maxRetries above the limit should be rejected")
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/network-sandbox/load-balancer/api"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// workerRenameConflict is returned when a rename would clash with another
+// worker
+type workerRenameConflict struct {
+	name string
+}
+
+func (e *workerRenameConflict) Error() string {
+	return fmt.Sprintf("Worker %s already exists", e.name)
+}
+
+// guard returns g wrapped so that a gather never runs while a rename moves
+// series
+func (m *lbMetrics) guard(g prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		m.scrapeMu.RLock()
+		defer m.scrapeMu.RUnlock()
+		return g.Gather()
+	})
+}
+
+// collectWorkerSeries returns the label sets and samples of c's series labelled
+// with the named worker
+func collectWorkerSeries(c prometheus.Collector, worker string) []*dto.Metric {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	var out []*dto.Metric
+	for metric := range ch {
+		var m dto.Metric
+		if metric.Write(&m) != nil {
+			continue
+		}
+		for _, l := range m.GetLabel() {
+			if l.GetName() == "worker" && l.GetValue() == worker {
+				out = append(out, &m)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// renamedLabels returns m's labels with the worker label set to to
+func renamedLabels(m *dto.Metric, to string) (old, renamed prometheus.Labels) {
+	old, renamed = prometheus.Labels{}, prometheus.Labels{}
+	for _, l := range m.GetLabel() {
+		old[l.GetName()] = l.GetValue()
+		renamed[l.GetName()] = l.GetValue()
+	}
+	renamed["worker"] = to
+	return old, renamed
+}
+
+// moveWorkerLocked moves the series of worker from to worker to: counters
+// carry their totals over and gauges their values, so rate() and current
+// readings continue under the new name. Histogram observations cannot be
+// carried over; their old series are dropped and the names of the
+// histograms returned. Must be called with scrapeMu held.
+func (m *lbMetrics) moveWorkerLocked(from, to string) []string {
+	for _, v := range m.workerCounters() {
+		for _, s := range collectWorkerSeries(v, from) {
+			old, renamed := renamedLabels(s, to)
+			v.Delete(old)
+			v.With(renamed).Add(s.GetCounter().GetValue())
+		}
+	}
+	for _, v := range m.workerGauges() {
+		for _, s := range collectWorkerSeries(v, from) {
+			old, renamed := renamedLabels(s, to)
+			v.Delete(old)
+			v.With(renamed).Set(s.GetGauge().GetValue())
+		}
+	}
+	var restarted []string
+	for name, v := range m.workerHistograms() {
+		if v.DeletePartialMatch(prometheus.Labels{"worker": from}) > 0 {
+			restarted = append(restarted, name)
+		}
+	}
+	sort.Strings(restarted)
+	m.workerRenamed.WithLabelValues(from, to).Inc()
+	return restarted
+}
+
+// RenameWorker renames a worker and moves its metric series, LRU state,
+// sticky sessions and latency heatmap to the new name. It refuses with a *workerBusy while the
+// worker has requests in flight unless force is set, and with a
+// *workerRenameConflict if the new name is taken. Scrapes see either the
+// old or the new series, never both or neither.
+func (lb *LoadBalancer) RenameWorker(from, to string, force bool) (api.WorkerStatus, bool, error) {
+	lb.metrics.scrapeMu.Lock()
+	defer lb.metrics.scrapeMu.Unlock()
+
+	lb.mu.Lock()
+	w := lb.findWorkerLocked(from)
+	if w == nil {
+		lb.mu.Unlock()
+		return api.WorkerStatus{}, false, nil
+	}
+	if from == to {
+		defer lb.mu.Unlock()
+		return lb.workerStatusLocked(w), true, nil
+	}
+	if lb.findWorkerLocked(to) != nil {
+		lb.mu.Unlock()
+		return api.WorkerStatus{}, true, &workerRenameConflict{name: to}
+	}
+	if n := atomic.LoadInt32(&w.CurrentLoad); n > 0 && !force {
+		lb.mu.Unlock()
+		return api.WorkerStatus{}, true, &workerBusy{worker: from, inFlight: n}
+	}
+	w.Name = to
+	w.revision++
+	if lb.lru.hot == from {
+		lb.lru.hot = to
+	}
+	status := lb.workerStatusLocked(w)
+	lb.mu.Unlock()
+
+	restarted := lb.metrics.moveWorkerLocked(from, to)
+	lb.stickySessions.rename(from, to)
+	lb.heatmap.rename(from, to)
+	lb.resourceScores.Delete(from)
+	msg := fmt.Sprintf("Worker %s renamed to %s", from, to)
+	if len(restarted) > 0 {
+		msg += "; " + strings.Join(restarted, ", ") + " restart under the new name"
+	}
+	lb.emitEvent("worker_renamed", msg, map[string]interface{}{
+		"from":      from,
+		"to":        to,
+		"restarted": restarted,
+	})
+	return status, true, nil
+}
+
+// handleWorkerRename は POST /workers/{name}/rename で {"name": "<新しい名前>"} を受け取り、ワーカーの名前を変更する HTTP ハンドラです。
+// カウンターとゲージのメトリクス系列は新しい名前へ値ごと移し、移せないヒストグラムは worker_renamed イベントと lb_worker_renamed_total に記録します。
+// 処理中のリクエストがある場合は ?force=true がない限り 409、新しい名前が使われている場合も 409 を返します。
+func handleWorkerRename(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeMetadataError(w, &MetadataError{"body", err.Error()})
+		return
+	}
+	if req.Name = strings.TrimSpace(req.Name); req.Name == "" || strings.Contains(req.Name, "/") {
+		writeMetadataError(w, &MetadataError{"name", "must be non-empty and contain no '/'"})
+		return
+	}
+
+	status, found, err := lb.RenameWorker(name, req.Name, r.URL.Query().Get("force") == "true")
+	if !found {
+		http.Error(w, "Worker not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(api.ErrorResponse{Error: err.Error(), Worker: name})
+		return
+	}
+	json.NewEncoder(w).Encode(status)
+	lb.BroadcastStatus()
+}
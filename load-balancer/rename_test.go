@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func renameWorker(name, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/workers/"+name+"/rename", bytes.NewBufferString(body)))
+	return rec
+}
+
+func TestRenameWorkerMovesSeries(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	lb = NewLoadBalancerWithRegistry("round-robin", reg, reg)
+	lb.AddWorker("old", newDelayStub(t, "old", 0).URL, "#FF0000", 1)
+	lb.AddWorker("other", newDelayStub(t, "other", 0).URL, "#00FF00", 1)
+	for i := 0; i < 4; i++ {
+		doTask(map[string]string{requireWorkerHeader: "old"})
+	}
+	lb.metrics.workerHealth.WithLabelValues("old").Set(1)
+
+	// Traffic to the other worker and scrapes keep running during the rename
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var scrapeErrs atomic.Int32
+	srv := httptest.NewServer(lb.MetricsHandler())
+	defer srv.Close()
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				doTask(map[string]string{requireWorkerHeader: "other"})
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			resp, err := http.Get(srv.URL)
+			if err != nil {
+				scrapeErrs.Add(1)
+				continue
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			// A scrape sees the worker under exactly one name
+			text := string(body)
+			o := strings.Contains(text, `lb_requests_total{status="success",worker="old"} 4`)
+			n := strings.Contains(text, `lb_requests_total{status="success",worker="new"} 4`)
+			if resp.StatusCode != http.StatusOK || o == n {
+				scrapeErrs.Add(1)
+			}
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	rec := renameWorker("old", `{"name":"new"}`)
+	time.Sleep(20 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("rename status = %d: %s", rec.Code, rec.Body)
+	}
+	if n := scrapeErrs.Load(); n != 0 {
+		t.Errorf("%d scrapes failed or saw the worker under both or neither name", n)
+	}
+
+	m := lb.metrics
+	if got := testutil.ToFloat64(m.requestsTotal.WithLabelValues("new", "success")); got != 4 {
+		t.Errorf("requests under the new name = %v, want 4", got)
+	}
+	if got := testutil.ToFloat64(m.workerHealth.WithLabelValues("new")); got != 1 {
+		t.Errorf("health under the new name = %v, want 1", got)
+	}
+	for _, s := range collectWorkerSeries(m.requestsTotal, "old") {
+		t.Errorf("series left under the old name: %v", s)
+	}
+	if s := collectWorkerSeries(m.requestDuration, "old"); len(s) != 0 {
+		t.Errorf("histogram series left under the old name: %v", s)
+	}
+	if got := testutil.ToFloat64(m.workerRenamed.WithLabelValues("old", "new")); got != 1 {
+		t.Errorf("rename marker = %v, want 1", got)
+	}
+	if _, err := reg.Gather(); err != nil {
+		t.Errorf("gather after rename: %v", err)
+	}
+
+	var renamed []Event
+	for _, e := range lb.events.since(0, 0) {
+		if e.Type == "worker_renamed" {
+			renamed = append(renamed, e)
+		}
+	}
+	if len(renamed) != 1 || renamed[0].Data["from"] != "old" || renamed[0].Data["to"] != "new" {
+		t.Fatalf("rename events = %+v", renamed)
+	}
+	if restarted, _ := renamed[0].Data["restarted"].([]string); len(restarted) == 0 || restarted[0] != "lb_request_duration_ms" {
+		t.Errorf("restarted histograms = %v", renamed[0].Data["restarted"])
+	}
+
+	// The worker keeps serving under its new name
+	if got := servedBy(t, doTask(map[string]string{requireWorkerHeader: "new"})); got != "new" {
+		t.Errorf("served by %q, want new", got)
+	}
+	if got := testutil.ToFloat64(m.requestsTotal.WithLabelValues("new", "success")); got != 5 {
+		t.Errorf("requests under the new name = %v, want 5", got)
+	}
+}
+
+func TestRenameWorkerConflicts(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("a", "http://localhost:8081", "#FF0000", 1)
+	lb.AddWorker("b", "http://localhost:8082", "#00FF00", 1)
+
+	for body, want := range map[string]int{
+		`{"name":"b"}`:   http.StatusConflict,
+		`{"name":""}`:    http.StatusBadRequest,
+		`{"name":"x/y"}`: http.StatusBadRequest,
+		`nope`:           http.StatusBadRequest,
+	} {
+		if rec := renameWorker("a", body); rec.Code != want {
+			t.Errorf("%s: status = %d, want %d", body, rec.Code, want)
+		}
+	}
+	if rec := renameWorker("missing", `{"name":"c"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown worker status = %d", rec.Code)
+	}
+
+	atomic.StoreInt32(&lb.workers[0].CurrentLoad, 1)
+	rec := renameWorker("a", `{"name":"c"}`)
+	var resp map[string]string
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if rec.Code != http.StatusConflict || resp["worker"] != "a" {
+		t.Errorf("busy worker: %d %v", rec.Code, resp)
+	}
+	rec = httptest.NewRecorder()
+	newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/workers/a/rename?force=true", bytes.NewBufferString(`{"name":"c"}`)))
+	if rec.Code != http.StatusOK || lb.workers[0].Name != "c" {
+		t.Errorf("forced rename: %d, name %q", rec.Code, lb.workers[0].Name)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Task replay for debugging: POST /workers/{name}/replay re-runs a task
+// against a chosen worker, bypassing selection. The task comes from the
+// body or, by request ID, from the recent-requests buffer, in which case
+// the original outcome is returned next to the new one.
+const (
+	recentRequestCapacity = 256
+	// recentResponseLimit caps the response body kept per recent request;
+	// larger ones are kept without it
+	recentResponseLimit = 8 << 10
+	replayBurst         = 5
+	replayWindow        = time.Minute
+	replayHeader        = "X-LB-Replay"
+)
+
+// RecentRequest is a completed task kept in the recent-requests buffer
+type RecentRequest struct {
+	RequestID string          `json:"requestId"`
+	At        time.Time       `json:"at"`
+	Task      TaskRequest     `json:"task"`
+	Worker    string          `json:"worker,omitempty"`
+	Status    int             `json:"status"`
+	Outcome   string          `json:"outcome"`
+	LatencyMs int64           `json:"latencyMs"`
+	Error     string          `json:"error,omitempty"`
+	Response  json.RawMessage `json:"response,omitempty"`
+	// Phases is the phase breakdown of a task sampled for profiling
+	Phases *PhaseBreakdown `json:"phases,omitempty"`
+}
+
+// recentRequests is a ring of the last recentRequestCapacity tasks
+type recentRequests struct {
+	mu      sync.Mutex
+	entries []RecentRequest
+	next    int
+}
+
+func newRecentRequests() *recentRequests {
+	return &recentRequests{entries: make([]RecentRequest, 0, recentRequestCapacity)}
+}
+
+func (b *recentRequests) add(e RecentRequest) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.entries) < recentRequestCapacity {
+		b.entries = append(b.entries, e)
+		return
+	}
+	b.entries[b.next] = e
+	b.next = (b.next + 1) % recentRequestCapacity
+}
+
+// find returns the most recent entry with the request ID
+func (b *recentRequests) find(id string) (RecentRequest, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := len(b.entries) - 1; i >= 0; i-- {
+		e := b.entries[(b.next+i)%len(b.entries)]
+		if e.RequestID == id {
+			return e, true
+		}
+	}
+	return RecentRequest{}, false
+}
+
+// setPhases attaches a phase breakdown to the most recent entry with the
+// request ID
+func (b *recentRequests) setPhases(id string, p PhaseBreakdown) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := len(b.entries) - 1; i >= 0; i-- {
+		e := &b.entries[(b.next+i)%len(b.entries)]
+		if e.RequestID == id {
+			e.Phases = &p
+			return
+		}
+	}
+}
+
+func (b *recentRequests) size() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.entries)
+}
+
+func (b *recentRequests) bounds() storeBounds {
+	return storeBounds{Capacity: recentRequestCapacity}
+}
+
+// sweep is a no-op: old entries are overwritten by the ring
+func (b *recentRequests) sweep(now time.Time) int { return 0 }
+
+// recordRecent adds a completed task to the recent-requests buffer
+func (lb *LoadBalancer) recordRecent(id string, received time.Time, task TaskRequest, attempts *attemptLog, code int, body []byte, err error) {
+	e := RecentRequest{
+		RequestID: id,
+		At:        received.UTC(),
+		Task:      task,
+		Worker:    lastAttemptWorker(attempts),
+		Status:    code,
+		Outcome:   attemptOutcome(code, err),
+		LatencyMs: time.Since(received).Milliseconds(),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	} else if len(body) <= recentResponseLimit && json.Valid(body) {
+		e.Response = append(json.RawMessage(nil), body...)
+	}
+	lb.recent.add(e)
+}
+
+// replayLimiter allows replayBurst replays per sliding replayWindow
+type replayLimiter struct {
+	mu sync.Mutex
+	at []time.Time
+}
+
+// allow records a replay at now if one is allowed, and otherwise returns
+// how long until the next one is
+func (l *replayLimiter) allow(now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	kept := l.at[:0]
+	for _, t := range l.at {
+		if now.Sub(t) < replayWindow {
+			kept = append(kept, t)
+		}
+	}
+	l.at = kept
+	if len(l.at) >= replayBurst {
+		return false, replayWindow - now.Sub(l.at[0])
+	}
+	l.at = append(l.at, now)
+	return true, 0
+}
+
+// ReplayResult is the outcome of one replay
+type ReplayResult struct {
+	Status    int             `json:"status"`
+	Outcome   string          `json:"outcome"`
+	LatencyMs int64           `json:"latencyMs"`
+	Error     string          `json:"error,omitempty"`
+	Response  json.RawMessage `json:"response,omitempty"`
+}
+
+// ReplayResponse is the body of POST /workers/{name}/replay. Original is
+// the buffered request that was replayed, if any.
+type ReplayResponse struct {
+	Worker    string         `json:"worker"`
+	Task      TaskRequest    `json:"task"`
+	Accounted bool           `json:"accounted"`
+	Replay    ReplayResult   `json:"replay"`
+	Original  *RecentRequest `json:"original,omitempty"`
+}
+
+// Replay sends task to the named worker without selection. An accounted
+// replay goes through the normal forwarding path and counts towards the
+// worker's stats, metrics and circuit like any task. Otherwise it is sent
+// as a synthetic task marked with X-LB-Replay and leaves them untouched.
+func (lb *LoadBalancer) Replay(ctx context.Context, name string, task TaskRequest, account bool) (ReplayResult, bool) {
+	lb.mu.RLock()
+	w := lb.findWorkerLocked(name)
+	lb.mu.RUnlock()
+	if w == nil {
+		return ReplayResult{}, false
+	}
+
+	start := time.Now()
+	var res ReplayResult
+	if account {
+		out, code, err := lb.forwardTo(withAttemptLog(ctx, &attemptLog{}), w, task, start)
+		res = ReplayResult{Status: code, Outcome: attemptOutcome(code, err), Response: out}
+		if err != nil {
+			res.Error = err.Error()
+		}
+	} else {
+		task.Synthetic = true
+		body, _ := json.Marshal(task)
+		resp, err := lb.callWorkerWith(ctx, name, http.MethodPost, "/task", bytes.NewReader(body), map[string]string{replayHeader: "true"})
+		switch {
+		case err != nil:
+			res = ReplayResult{Status: http.StatusBadGateway, Outcome: "error", Error: err.Error()}
+		case resp.status >= 300:
+			res = ReplayResult{Status: resp.status, Outcome: "error", Error: fmt.Sprintf("worker returned status %d", resp.status)}
+			if resp.status == http.StatusGatewayTimeout {
+				res.Outcome = "timeout"
+			}
+		default:
+			res = ReplayResult{Status: resp.status, Outcome: "success"}
+		}
+		if err == nil && json.Valid(resp.body) {
+			res.Response = resp.body
+		}
+	}
+	res.LatencyMs = time.Since(start).Milliseconds()
+	return res, true
+}
+
+// handleWorkerReplay は POST /workers/{name}/replay でタスクを選択を経ずに指定したワーカーへ再実行するデバッグ用の HTTP ハンドラです。
+// ボディにはタスクそのもの ({"id": ..., "weight": ...}) か、直近のリクエストのバッファにある {"requestId": "..."} を指定します。
+// バッファから再実行した場合は元の結果 (original) を新しい結果 (replay) と並べて返します。
+// 既定では X-LB-Replay を付けた synthetic なタスクとして送り、ワーカーの統計・メトリクス・サーキットには数えません。?account=true で通常のタスクと同じく数えます。
+// 再実行は 1 分あたり 5 回までで、超えると Retry-After 付きの 429 を返し、実行のたびに replay イベントを記録します。
+func handleWorkerReplay(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		RequestID string `json:"requestId"`
+		TaskRequest
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeMetadataError(w, &MetadataError{"body", err.Error()})
+		return
+	}
+	if lb.workerURL(name) == "" {
+		http.Error(w, "Worker not found", http.StatusNotFound)
+		return
+	}
+	task := req.TaskRequest
+	var original *RecentRequest
+	if req.RequestID != "" {
+		e, ok := lb.recent.find(req.RequestID)
+		if !ok {
+			http.Error(w, "Request not in the recent-requests buffer", http.StatusNotFound)
+			return
+		}
+		task, original = e.Task, &e
+	}
+	if ok, retry := lb.replays.allow(time.Now()); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+		http.Error(w, "Replay rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	account := r.URL.Query().Get("account") == "true"
+	res, found := lb.Replay(r.Context(), name, task, account)
+	if !found {
+		http.Error(w, "Worker not found", http.StatusNotFound)
+		return
+	}
+	data := map[string]interface{}{
+		"worker":    name,
+		"taskId":    task.ID,
+		"accounted": account,
+		"status":    res.Status,
+		"outcome":   res.Outcome,
+		"remote":    r.RemoteAddr,
+	}
+	if original != nil {
+		data["requestId"] = original.RequestID
+	}
+	lb.emitEvent("replay", fmt.Sprintf("Task %s replayed on %s: %s", task.ID, name, res.Outcome), data)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ReplayResponse{Worker: name, Task: task, Accounted: account, Replay: res, Original: original})
+}
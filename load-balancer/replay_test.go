@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func replayOn(name, query, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/workers/"+name+"/replay"+query, bytes.NewBufferString(body)))
+	return rec
+}
+
+func TestReplayBufferedFailure(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+	var replays int32
+	var lastTask TaskRequest
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(replayHeader) == "true" {
+			atomic.AddInt32(&replays, 1)
+		}
+		lastTask = TaskRequest{}
+		json.NewDecoder(r.Body).Decode(&lastTask)
+		json.NewEncoder(w).Encode(map[string]interface{}{"worker": "go-worker-1", "id": lastTask.ID})
+	}))
+	defer healthy.Close()
+	lb.AddWorker("python-worker-1", broken.URL, "#FF0000", 1)
+	lb.AddWorker("go-worker-1", healthy.URL, "#00FF00", 1)
+
+	req := httptest.NewRequest(http.MethodPost, "/task", bytes.NewBufferString(`{"id":"task-7","weight":2}`))
+	req.Header.Set(requestIDHeader, "req-1")
+	req.Header.Set(requireWorkerHeader, "python-worker-1")
+	rec := httptest.NewRecorder()
+	handleTask(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("original status = %d, want 503", rec.Code)
+	}
+
+	target := lb.workers[1]
+	before := target.stats.snapshot()
+	rec = replayOn("go-worker-1", "", `{"requestId":"req-1"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("replay status = %d: %s", rec.Code, rec.Body)
+	}
+	var resp ReplayResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if o := resp.Original; o == nil || o.RequestID != "req-1" || o.Worker != "python-worker-1" || o.Outcome != "error" || o.Status != http.StatusServiceUnavailable || o.Error == "" {
+		t.Errorf("original = %+v", resp.Original)
+	}
+	if r := resp.Replay; r.Outcome != "success" || r.Status != http.StatusOK || !bytes.Contains(r.Response, []byte(`"task-7"`)) {
+		t.Errorf("replay = %+v", resp.Replay)
+	}
+	if resp.Worker != "go-worker-1" || resp.Task.ID != "task-7" || resp.Task.Weight != 2 || resp.Accounted {
+		t.Errorf("response = %+v", resp)
+	}
+	if atomic.LoadInt32(&replays) != 1 || !lastTask.Synthetic {
+		t.Errorf("worker saw %d replays, synthetic = %v", replays, lastTask.Synthetic)
+	}
+
+	// The replay left the worker's accounting alone
+	if atomic.LoadInt64(&target.TotalRequests) != 0 || target.stats.snapshot().Requests != before.Requests {
+		t.Errorf("replay counted: total %d, stats %d", target.TotalRequests, target.stats.snapshot().Requests)
+	}
+	if got := testutil.ToFloat64(lb.metrics.requestsTotal.WithLabelValues("go-worker-1", "success")); got != 0 {
+		t.Errorf("requests metric = %v, want 0", got)
+	}
+
+	// An accounted replay of a raw task counts like any task
+	rec = replayOn("go-worker-1", "?account=true", `{"id":"task-8","weight":1}`)
+	resp = ReplayResponse{}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if rec.Code != http.StatusOK || resp.Original != nil || !resp.Accounted || resp.Replay.Outcome != "success" {
+		t.Errorf("accounted replay: %d %+v", rec.Code, resp)
+	}
+	if atomic.LoadInt64(&target.TotalRequests) != 1 || lastTask.Synthetic {
+		t.Errorf("accounted replay: total %d, synthetic %v", target.TotalRequests, lastTask.Synthetic)
+	}
+
+	var audited int
+	for _, e := range lb.events.since(0, 0) {
+		if e.Type == "replay" {
+			audited++
+		}
+	}
+	if audited != 2 {
+		t.Errorf("%d replay events, want 2", audited)
+	}
+}
+
+func TestReplayErrors(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", newDelayStub(t, "worker-1", 0).URL, "#FF0000", 1)
+
+	if rec := replayOn("missing", "", `{"id":"t"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown worker: %d", rec.Code)
+	}
+	if rec := replayOn("worker-1", "", `{"requestId":"nope"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown request: %d", rec.Code)
+	}
+	if rec := replayOn("worker-1", "", `nope`); rec.Code != http.StatusBadRequest {
+		t.Errorf("bad body: %d", rec.Code)
+	}
+
+	for i := 0; i < replayBurst; i++ {
+		if rec := replayOn("worker-1", "", `{"id":"t","weight":1}`); rec.Code != http.StatusOK {
+			t.Fatalf("replay %d: %d", i, rec.Code)
+		}
+	}
+	rec := replayOn("worker-1", "", `{"id":"t","weight":1}`)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("over the limit: %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
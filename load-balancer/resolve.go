@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Worker hostnames are docker-compose service names whose addresses change
+// when a container is recreated. Every new upstream connection resolves its
+// host through the tracker's lookup hook, so dropping the idle connections
+// of a host is enough to make the next attempt resolve it afresh.
+const resolveRefreshTimeout = 2 * time.Second
+
+// Connection failure reasons that trigger a flush
+const (
+	connFailureRefused = "refused"
+	connFailureTimeout = "timeout"
+	connFailureDNS     = "dns"
+)
+
+// lookupFunc resolves a hostname to its addresses
+type lookupFunc func(ctx context.Context, host string) ([]string, error)
+
+// connFailureReason classifies err as a DNS failure, a refused connection or
+// a timeout, or returns "" when a fresh resolution would not help
+func connFailureReason(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return connFailureDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return connFailureRefused
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return connFailureTimeout
+	}
+	return ""
+}
+
+// resolve looks host up through the lookup hook and records the first
+// address as the host's last resolved IP
+func (t *connTracker) resolve(ctx context.Context, host string) ([]string, error) {
+	t.mu.Lock()
+	lookup := t.lookup
+	t.mu.Unlock()
+	ips, err := lookup(ctx, host)
+	if err == nil && len(ips) == 0 {
+		err = &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	t.resolved[host] = ips[0]
+	t.mu.Unlock()
+	return ips, nil
+}
+
+// dial resolves the host of addr and dials its addresses in order
+func (t *connTracker) dial(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return d.DialContext(ctx, network, addr)
+	}
+	if net.ParseIP(host) != nil {
+		t.mu.Lock()
+		t.resolved[host] = host
+		t.mu.Unlock()
+		return d.DialContext(ctx, network, addr)
+	}
+	ips, err := t.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var firstErr error
+	for _, ip := range ips {
+		conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// resolvedIP returns the address host last resolved to, or ""
+func (t *connTracker) resolvedIP(host string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.resolved[host]
+}
+
+// flushIdle closes the connections to addr that are not serving a request
+// and returns how many it closed. A connection picked up by a request right
+// as it is closed fails that request like any other dead connection.
+func (t *connTracker) flushIdle(addr string) int {
+	t.mu.Lock()
+	var idle []*trackedConn
+	for c := range t.conns[addr] {
+		if atomic.LoadInt32(&c.inUse) == 0 {
+			idle = append(idle, c)
+		}
+	}
+	t.mu.Unlock()
+	for _, c := range idle {
+		c.Close()
+	}
+	return len(idle)
+}
+
+// setLookup replaces the resolver used for new connections
+func (m *resourceManager) setLookup(lookup lookupFunc) {
+	m.conns.mu.Lock()
+	m.conns.lookup = lookup
+	m.conns.mu.Unlock()
+}
+
+// workerHost returns the hostname and dial address of a worker URL
+func workerHost(rawURL string) (host, addr string, ok bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return "", "", false
+	}
+	return u.Hostname(), hostKey(u), true
+}
+
+// flushUpstream drops the idle connections to w after a connection failure
+// that a fresh resolution may fix. With resolve set the host is also looked
+// up again right away so the worker detail shows the new address.
+func (lb *LoadBalancer) flushUpstream(w *Worker, err error, resolve bool) {
+	reason := connFailureReason(err)
+	if reason == "" {
+		return
+	}
+	host, addr, ok := workerHost(w.URL)
+	if !ok {
+		return
+	}
+	n := lb.resources.conns.flushIdle(addr)
+	lb.metrics.connFlushes.WithLabelValues(w.Name, reason).Inc()
+	if resolve && net.ParseIP(host) == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), resolveRefreshTimeout)
+		defer cancel()
+		if _, err := lb.resources.conns.resolve(ctx, host); err != nil {
+			log.Printf("Failed to re-resolve %s: %v", host, err)
+		}
+	}
+	if n > 0 {
+		log.Printf("Flushed %d idle connections to %s after %s failure: %v", n, w.Name, reason, err)
+	}
+}
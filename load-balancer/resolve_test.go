@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/network-sandbox/load-balancer/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// stubResolver answers every lookup with the address the test sets
+type stubResolver struct {
+	mu      sync.Mutex
+	ip      string
+	lookups int
+}
+
+func (r *stubResolver) lookup(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	return []string{r.ip}, nil
+}
+
+func (r *stubResolver) set(ip string) {
+	r.mu.Lock()
+	r.ip = ip
+	r.mu.Unlock()
+}
+
+// newServerAt starts handler on addr
+func newServerAt(t *testing.T, addr string, handler http.Handler) *httptest.Server {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("listen on %s: %v", addr, err)
+	}
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Listener = ln
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestReresolveAfterConnFailure(t *testing.T) {
+	// The old container answers until it is "recreated", after which it
+	// hangs; the new one listens on another address but the same port
+	var hang atomic.Bool
+	stop := make(chan struct{})
+	defer close(stop)
+	var gate sync.WaitGroup
+	gate.Add(2)
+	old := newServerAt(t, "127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hang.Load() {
+			<-stop
+			return
+		}
+		gate.Done()
+		gate.Wait()
+		json.NewEncoder(w).Encode(api.TaskResponse{ID: "t", Worker: "old"})
+	}))
+	port := strconv.Itoa(old.Listener.Addr().(*net.TCPAddr).Port)
+	var served int32
+	newServerAt(t, "127.0.0.2:"+port, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&served, 1)
+		json.NewEncoder(w).Encode(api.TaskResponse{ID: "t", Worker: "new"})
+	}))
+
+	resolver := &stubResolver{ip: "127.0.0.1"}
+	lb = NewLoadBalancer("round-robin")
+	lb.resources.setLookup(resolver.lookup)
+	lb.AddWorker("worker-1", "http://worker-1.test:"+port, "#FF0000", 1)
+	s := lb.Settings()
+	s.UpstreamTimeoutMs = 200
+	lb.UpdateSettings(s)
+
+	// Two concurrent tasks leave two idle connections to the old address
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			doTask(nil)
+		}()
+	}
+	wg.Wait()
+	if status, _ := lb.WorkerStatus("worker-1"); status.ResolvedIP != "127.0.0.1" {
+		t.Fatalf("resolved IP = %q, want 127.0.0.1", status.ResolvedIP)
+	}
+
+	hang.Store(true)
+	resolver.set("127.0.0.2")
+	if rec := doTask(nil); rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("task on the pinned connection: %d, want 504", rec.Code)
+	}
+	// Without the flush the second idle connection would time out too
+	if rec := doTask(nil); rec.Code != http.StatusOK || atomic.LoadInt32(&served) != 1 {
+		t.Fatalf("task after the flush: %d, want 200 from the new container", rec.Code)
+	}
+	if got := testutil.ToFloat64(lb.metrics.connFlushes.WithLabelValues("worker-1", connFailureTimeout)); got != 1 {
+		t.Errorf("timeout flushes = %v, want 1", got)
+	}
+
+	srv := httptest.NewServer(newMux())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/api/workers/worker-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var status api.WorkerStatus
+	json.NewDecoder(resp.Body).Decode(&status)
+	if status.ResolvedIP != "127.0.0.2" {
+		t.Errorf("worker detail resolvedIP = %q, want 127.0.0.2", status.ResolvedIP)
+	}
+}
+
+func TestHealthCheckRefreshesResolution(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	port := strconv.Itoa(down.Listener.Addr().(*net.TCPAddr).Port)
+	down.Close()
+
+	resolver := &stubResolver{ip: "127.0.0.1"}
+	lb = NewLoadBalancer("round-robin")
+	lb.resources.setLookup(resolver.lookup)
+	lb.AddWorker("worker-1", "http://worker-1.test:"+port, "#FF0000", 1)
+	w := lb.workers[0]
+
+	lb.checkWorker(w)
+	if got := testutil.ToFloat64(lb.metrics.connFlushes.WithLabelValues("worker-1", connFailureRefused)); got != 1 {
+		t.Fatalf("refused flushes = %v, want 1", got)
+	}
+	// One lookup to dial and one to refresh
+	if resolver.lookups != 2 {
+		t.Errorf("lookups = %d, want 2", resolver.lookups)
+	}
+
+	resolver.set("127.0.0.3")
+	lb.checkWorker(w)
+	if status, _ := lb.WorkerStatus("worker-1"); status.ResolvedIP != "127.0.0.3" {
+		t.Errorf("resolved IP = %q, want 127.0.0.3", status.ResolvedIP)
+	}
+}
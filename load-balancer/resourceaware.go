@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The resource-aware algorithm routes on the load the workers report
+// themselves rather than on the LB's view of it. Before a selection the
+// candidates' /health is fetched, at most once per resourceCheckTTL per
+// worker, and the worker with the lowest
+// currentLoad/maxConcurrent + queueDepth/queueSize wins. This is separate
+// from the health check loop, which only decides whether a worker is up.
+const (
+	defaultResourceCheckTTL = 200 * time.Millisecond
+	resourceCheckTimeout    = 100 * time.Millisecond
+)
+
+// resourceScore is the cached result of one resource check; ok is false
+// when the worker could not be checked
+type resourceScore struct {
+	score     float64
+	ok        bool
+	checkedAt time.Time
+}
+
+// resourceHealth are the fields of a worker's /health the score is built
+// from. MaxConcurrent and QueueSize are the worker's limits; when a worker
+// does not report them, its MaxLoad stands in for the first and the queue
+// term is left out.
+type resourceHealth struct {
+	CurrentLoad   float64 `json:"currentLoad"`
+	QueueDepth    float64 `json:"queueDepth"`
+	MaxConcurrent float64 `json:"maxConcurrent"`
+	QueueSize     float64 `json:"queueSize"`
+}
+
+// score returns the worker's utilisation from the health fields
+func (h resourceHealth) score(maxLoad int) float64 {
+	limit := h.MaxConcurrent
+	if limit <= 0 {
+		limit = float64(maxLoad)
+	}
+	var s float64
+	if limit > 0 {
+		s += h.CurrentLoad / limit
+	}
+	if h.QueueSize > 0 {
+		s += h.QueueDepth / h.QueueSize
+	}
+	return s
+}
+
+// checkResources fetches the worker's /health and returns its score. This is
+// always /health, whatever the worker's HealthPath: the score needs the load
+// figures of its body, not just liveness.
+func (lb *LoadBalancer) checkResources(ctx context.Context, url string, maxLoad int) (float64, bool) {
+	ctx, cancel := context.WithTimeout(ctx, resourceCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/health", nil)
+	if err != nil {
+		return 0, false
+	}
+	resp, err := lb.healthClient.Do(req)
+	if err != nil {
+		return 0, false
+	}
+	defer resp.Body.Close()
+	body, err := readLimited(resp.Body, maxHealthBody)
+	var h resourceHealth
+	if err != nil || json.Unmarshal(body, &h) != nil {
+		return 0, false
+	}
+	return h.score(maxLoad), true
+}
+
+// refreshResourceScores checks, in parallel, every eligible worker whose
+// cached score is older than resourceCheckTTL. It is called before the
+// selection, without lb.mu, so a slow worker delays the request by at most
+// resourceCheckTimeout and never blocks the pool. Workers without a URL,
+// such as those of the self-test sandbox, are not checked.
+func (lb *LoadBalancer) refreshResourceScores(ctx context.Context) {
+	type target struct {
+		name, url string
+		maxLoad   int
+	}
+	lb.mu.RLock()
+	ttl := lb.resourceCheckTTL
+	now := lb.clock.Now()
+	var stale []target
+	for _, w := range lb.workers {
+		if w.URL == "" || !isEligible(w) {
+			continue
+		}
+		if v, ok := lb.resourceScores.Load(w.Name); ok && now.Sub(v.(resourceScore).checkedAt) < ttl {
+			continue
+		}
+		stale = append(stale, target{w.Name, w.URL, w.MaxLoad})
+	}
+	lb.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, t := range stale {
+		wg.Add(1)
+		go func(t target) {
+			defer wg.Done()
+			score, ok := lb.checkResources(ctx, t.url, t.maxLoad)
+			lb.resourceScores.Store(t.name, resourceScore{score: score, ok: ok, checkedAt: lb.clock.Now()})
+		}(t)
+	}
+	wg.Wait()
+}
+
+// routesOnResources reports whether a request with hints h is routed by the
+// resource-aware algorithm
+func (lb *LoadBalancer) routesOnResources(h routeHints) bool {
+	if h.algorithm != "" {
+		return h.algorithm == "resource-aware"
+	}
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.algorithm == "resource-aware"
+}
+
+// resourceAware picks the candidate with the lowest cached score. Workers
+// that could not be checked rank last; ties, including a pool none of which
+// could be checked, go to the one with the fewest requests in flight. Must
+// be called with lb.mu held.
+func (lb *LoadBalancer) resourceAware(workers []*Worker) *Worker {
+	var tied []*Worker
+	best := math.Inf(1)
+	for _, w := range workers {
+		score := math.Inf(1)
+		if v, ok := lb.resourceScores.Load(w.Name); ok && v.(resourceScore).ok {
+			score = v.(resourceScore).score
+		}
+		switch {
+		case score < best:
+			best, tied = score, []*Worker{w}
+		case score == best:
+			tied = append(tied, w)
+		}
+	}
+	return lb.leastConnections(tied)
+}
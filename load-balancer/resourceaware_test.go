@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newResourceWorker returns a worker whose /health reports the given load
+// and counts how often it was asked
+func newResourceWorker(t *testing.T, health *resourceHealth, hits *int32) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		json.NewEncoder(w).Encode(health)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestResourceAware(t *testing.T) {
+	clk := newFakeClock()
+	lb = NewLoadBalancer("resource-aware")
+	lb.clock = clk
+	var hits [3]int32
+	loads := []*resourceHealth{
+		{CurrentLoad: 8, MaxConcurrent: 10, QueueDepth: 0, QueueSize: 100},  // 0.8
+		{CurrentLoad: 2, MaxConcurrent: 10, QueueDepth: 50, QueueSize: 100}, // 0.7
+		{CurrentLoad: 1, MaxConcurrent: 4, QueueDepth: 5, QueueSize: 100},   // 0.3
+	}
+	for i, name := range []string{"worker-1", "worker-2", "worker-3"} {
+		lb.AddWorker(name, newResourceWorker(t, loads[i], &hits[i]).URL, "#FF0000", 1)
+	}
+
+	if w := lb.SelectWorker(); w.Name != "worker-3" {
+		t.Fatalf("selected %s, want the least utilised worker-3", w.Name)
+	}
+
+	// Scores are reused within the TTL
+	loads[2].CurrentLoad = 4
+	for i := 0; i < 5; i++ {
+		if w := lb.SelectWorker(); w.Name != "worker-3" {
+			t.Fatalf("selected %s within the TTL, want the cached worker-3", w.Name)
+		}
+	}
+	for i := range hits {
+		if got := atomic.LoadInt32(&hits[i]); got != 1 {
+			t.Errorf("worker-%d checked %d times within the TTL, want 1", i+1, got)
+		}
+	}
+
+	clk.Advance(defaultResourceCheckTTL)
+	if w := lb.SelectWorker(); w.Name != "worker-2" {
+		t.Errorf("selected %s after the TTL, want worker-2", w.Name)
+	}
+	if got := atomic.LoadInt32(&hits[0]); got != 2 {
+		t.Errorf("worker-1 checked %d times, want 2", got)
+	}
+}
+
+func TestResourceAwareUncheckable(t *testing.T) {
+	lb = NewLoadBalancer("resource-aware")
+	var hits int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(slow.Close)
+	lb.AddWorker("slow", slow.URL, "#FF0000", 1)
+	lb.AddWorker("busy", newResourceWorker(t, &resourceHealth{CurrentLoad: 9, MaxConcurrent: 10}, &hits).URL, "#00FF00", 1)
+
+	// A worker that does not answer within the timeout ranks last
+	start := time.Now()
+	if w := lb.SelectWorker(); w.Name != "busy" {
+		t.Errorf("selected %s, want the worker that answered", w.Name)
+	}
+	if d := time.Since(start); d > 5*resourceCheckTimeout {
+		t.Errorf("selection took %s", d)
+	}
+
+	// Without limits in the report the worker's MaxLoad stands in
+	h := resourceHealth{CurrentLoad: 3}
+	if got := h.score(6); got != 0.5 {
+		t.Errorf("score = %v, want 0.5", got)
+	}
+
+	// Nothing checkable: fewest requests in flight
+	lb = NewLoadBalancer("resource-aware")
+	lb.AddWorker("a", "http://127.0.0.1:1", "#FF0000", 1)
+	lb.AddWorker("b", "http://127.0.0.1:1", "#00FF00", 1)
+	atomic.StoreInt32(&lb.workers[0].CurrentLoad, 2)
+	if w := lb.SelectWorker(); w.Name != "b" {
+		t.Errorf("selected %s, want the less loaded b", w.Name)
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultCleanupInterval is how often the background sweep evicts expired
+// entries from the bounded internal stores
+const defaultCleanupInterval = time.Minute
+
+// Upstream connection pool defaults. All worker traffic shares one
+// transport, so keep-alive connections are reused across tasks, health
+// checks and proxied calls; Go's default of two idle connections per host
+// is far too few for a busy worker.
+const (
+	defaultMaxIdleConns        = 256
+	defaultMaxIdleConnsPerHost = 64
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultDialTimeout         = 10 * time.Second
+	defaultDialKeepAlive       = 30 * time.Second
+)
+
+// transportConfig are the tunables of the shared upstream transport
+type transportConfig struct {
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+	dialTimeout         time.Duration
+}
+
+func defaultTransportConfig() transportConfig {
+	return transportConfig{
+		maxIdleConns:        defaultMaxIdleConns,
+		maxIdleConnsPerHost: defaultMaxIdleConnsPerHost,
+		idleConnTimeout:     defaultIdleConnTimeout,
+		dialTimeout:         defaultDialTimeout,
+	}
+}
+
+// transportConfigFromEnv reads LB_MAX_IDLE_CONNS, LB_MAX_IDLE_CONNS_PER_HOST,
+// LB_IDLE_CONN_TIMEOUT_MS and LB_DIAL_TIMEOUT_MS over the defaults
+func transportConfigFromEnv() transportConfig {
+	cfg := defaultTransportConfig()
+	if n, err := strconv.Atoi(getEnv("LB_MAX_IDLE_CONNS", "")); err == nil && n >= 0 {
+		cfg.maxIdleConns = n
+	}
+	if n, err := strconv.Atoi(getEnv("LB_MAX_IDLE_CONNS_PER_HOST", "")); err == nil && n > 0 {
+		cfg.maxIdleConnsPerHost = n
+	}
+	if ms, err := strconv.ParseInt(getEnv("LB_IDLE_CONN_TIMEOUT_MS", ""), 10, 64); err == nil && ms >= 0 {
+		cfg.idleConnTimeout = time.Duration(ms) * time.Millisecond
+	}
+	if ms, err := strconv.ParseInt(getEnv("LB_DIAL_TIMEOUT_MS", ""), 10, 64); err == nil && ms > 0 {
+		cfg.dialTimeout = time.Duration(ms) * time.Millisecond
+	}
+	return cfg
+}
+
+// storeBounds describes the limits of a bounded store
+type storeBounds struct {
+	Capacity int   `json:"capacity"`
+	Floor    int   `json:"floor"`
+	MaxAgeMs int64 `json:"maxAgeMs,omitempty"`
+}
+
+// boundedStore is an internal store that can be inspected and swept
+type boundedStore interface {
+	size() int
+	bounds() storeBounds
+	sweep(now time.Time) int
+}
+
+// managedStore tracks sweep bookkeeping for a registered store
+type managedStore struct {
+	name        string
+	store       boundedStore
+	lastSweep   time.Time
+	lastEvicted int
+}
+
+// StoreStats is the /debug/resources view of one store
+type StoreStats struct {
+	storeBounds
+	Size        int        `json:"size"`
+	LastCleanup *time.Time `json:"lastCleanup"`
+	LastEvicted int        `json:"lastEvicted"`
+}
+
+// ConnStats counts upstream connections to one worker host
+type ConnStats struct {
+	Open   int `json:"open"`
+	Active int `json:"active"`
+	Idle   int `json:"idle"`
+}
+
+// ResourceReport is the response of GET /debug/resources
+type ResourceReport struct {
+	Connections map[string]ConnStats  `json:"connections"`
+	Stores      map[string]StoreStats `json:"stores"`
+	LastCleanup *time.Time            `json:"lastCleanup"`
+	CleanupRuns int64                 `json:"cleanupRuns"`
+}
+
+// resourceManager owns the registered stores and upstream connection tracking
+type resourceManager struct {
+	mu          sync.Mutex
+	stores      []*managedStore
+	lastCleanup time.Time
+	cleanupRuns int64
+	conns       *connTracker
+	transport   *http.Transport
+	dialer      *net.Dialer
+}
+
+func newResourceManager() *resourceManager {
+	conns := &connTracker{
+		open:     make(map[string]int),
+		active:   make(map[string]int),
+		conns:    make(map[string]map[*trackedConn]struct{}),
+		resolved: make(map[string]string),
+		lookup:   net.DefaultResolver.LookupHost,
+	}
+	m := &resourceManager{conns: conns, dialer: &net.Dialer{KeepAlive: defaultDialKeepAlive}}
+	m.transport = conns.newTransport(m.dialer)
+	m.configureTransport(transportConfigFromEnv())
+	return m
+}
+
+// configureTransport applies cfg to the shared transport. It must be called
+// before the transport is first used.
+func (m *resourceManager) configureTransport(cfg transportConfig) {
+	m.transport.MaxIdleConns = cfg.maxIdleConns
+	m.transport.MaxIdleConnsPerHost = cfg.maxIdleConnsPerHost
+	m.transport.IdleConnTimeout = cfg.idleConnTimeout
+	m.dialer.Timeout = cfg.dialTimeout
+}
+
+// register adds a store to the report and cleanup sweeps
+func (m *resourceManager) register(name string, s boundedStore) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stores = append(m.stores, &managedStore{name: name, store: s})
+}
+
+// client returns an HTTP client whose connections are tracked
+func (m *resourceManager) client() *http.Client {
+	return &http.Client{Transport: &trackedRoundTripper{base: m.transport, conns: m.conns}}
+}
+
+// timeoutClient returns an HTTP client on the shared transport whose
+// requests time out after timeout
+func (m *resourceManager) timeoutClient(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: m.transport, Timeout: timeout}
+}
+
+// Resources reports connection counts and the size of every bounded store
+func (lb *LoadBalancer) Resources() ResourceReport {
+	m := lb.resources
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	report := ResourceReport{
+		Connections: m.conns.snapshot(),
+		Stores:      make(map[string]StoreStats, len(m.stores)),
+		CleanupRuns: m.cleanupRuns,
+	}
+	if !m.lastCleanup.IsZero() {
+		t := m.lastCleanup
+		report.LastCleanup = &t
+	}
+	for _, ms := range m.stores {
+		st := StoreStats{storeBounds: ms.store.bounds(), Size: ms.store.size(), LastEvicted: ms.lastEvicted}
+		if !ms.lastSweep.IsZero() {
+			t := ms.lastSweep
+			st.LastCleanup = &t
+		}
+		report.Stores[ms.name] = st
+	}
+	lb.metrics.updateResourceGauges(report)
+	return report
+}
+
+// Cleanup sweeps every registered store, closes idle upstream connections and
+// returns the number of entries evicted per store
+func (lb *LoadBalancer) Cleanup() map[string]int {
+	m := lb.resources
+	now := lb.clock.Now()
+	evicted := make(map[string]int)
+
+	m.mu.Lock()
+	for _, ms := range m.stores {
+		n := ms.store.sweep(now)
+		ms.lastSweep = now
+		ms.lastEvicted = n
+		evicted[ms.name] = n
+	}
+	m.lastCleanup = now
+	m.cleanupRuns++
+	m.mu.Unlock()
+
+	m.transport.CloseIdleConnections()
+	lb.Resources()
+	return evicted
+}
+
+// StartCleanup periodically sweeps the bounded stores
+func (lb *LoadBalancer) StartCleanup(ctx context.Context, interval time.Duration) {
+	for {
+		timer := lb.clock.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+			lb.Cleanup()
+		}
+	}
+}
+
+func (m *lbMetrics) updateResourceGauges(report ResourceReport) {
+	for name, st := range report.Stores {
+		m.storeSize.WithLabelValues(name).Set(float64(st.Size))
+	}
+	for host, c := range report.Connections {
+		m.upstreamConnections.WithLabelValues(host, "active").Set(float64(c.Active))
+		m.upstreamConnections.WithLabelValues(host, "idle").Set(float64(c.Idle))
+	}
+}
+
+// connTracker counts open connections (via the dialer) and connections in
+// use (via httptrace) per upstream host. It also keeps the open connections
+// themselves so a host's idle ones can be flushed, and the address each
+// hostname last resolved to.
+type connTracker struct {
+	mu       sync.Mutex
+	open     map[string]int
+	active   map[string]int
+	conns    map[string]map[*trackedConn]struct{}
+	resolved map[string]string
+	lookup   lookupFunc
+}
+
+func (t *connTracker) add(m map[string]int, host string, delta int) {
+	t.mu.Lock()
+	m[host] += delta
+	t.mu.Unlock()
+}
+
+func (t *connTracker) snapshot() map[string]ConnStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make(map[string]ConnStats, len(t.open))
+	hosts := make([]string, 0, len(t.open))
+	for h := range t.open {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	for _, h := range hosts {
+		c := ConnStats{Open: t.open[h], Active: t.active[h]}
+		if c.Idle = c.Open - c.Active; c.Idle < 0 {
+			c.Idle = 0
+		}
+		out[h] = c
+	}
+	return out
+}
+
+func (t *connTracker) newTransport(dialer *net.Dialer) *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := t.dial(ctx, dialer, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		tc := &trackedConn{Conn: conn}
+		tc.onClose = func() { t.untrack(addr, tc) }
+		t.track(addr, tc)
+		return tc, nil
+	}
+	return tr
+}
+
+func (t *connTracker) track(addr string, c *trackedConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.open[addr]++
+	if t.conns[addr] == nil {
+		t.conns[addr] = make(map[*trackedConn]struct{})
+	}
+	t.conns[addr][c] = struct{}{}
+}
+
+func (t *connTracker) untrack(addr string, c *trackedConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.open[addr]--
+	delete(t.conns[addr], c)
+	if len(t.conns[addr]) == 0 {
+		delete(t.conns, addr)
+	}
+}
+
+// trackedConn decrements the open count exactly once when closed. inUse is
+// non-zero while a request holds the connection.
+type trackedConn struct {
+	net.Conn
+	once    sync.Once
+	onClose func()
+	inUse   int32
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.onClose)
+	return c.Conn.Close()
+}
+
+// trackedRoundTripper marks a connection active from GotConn until the
+// response body is closed
+type trackedRoundTripper struct {
+	base  http.RoundTripper
+	conns *connTracker
+}
+
+func (rt *trackedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := hostKey(req.URL)
+	var state int32 // 0: no conn, 1: active, 2: released
+	var conn atomic.Pointer[trackedConn]
+	release := func() {
+		if atomic.CompareAndSwapInt32(&state, 1, 2) {
+			rt.conns.add(rt.conns.active, host, -1)
+			if c := conn.Load(); c != nil {
+				atomic.AddInt32(&c.inUse, -1)
+			}
+		}
+	}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if atomic.CompareAndSwapInt32(&state, 0, 1) {
+				if c, ok := info.Conn.(*trackedConn); ok {
+					atomic.AddInt32(&c.inUse, 1)
+					conn.Store(c)
+				}
+				rt.conns.add(rt.conns.active, host, 1)
+			}
+		},
+	}
+	resp, err := rt.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// hostKey returns host:port as used by the dialer
+func hostKey(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// handleDebugResources は内部リソースの使用状況を返す HTTP ハンドラです。
+// ワーカーホストごとの上流コネクション数 (active/idle) と、各有界ストアのサイズ・上限・最終クリーンアップ時刻を返します。
+func handleDebugResources(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lb.Resources())
+}
+
+// handleDebugCleanup は全ストアの掃除を即時実行する HTTP ハンドラです。
+// 期限切れエントリを下限まで削除し、アイドル状態の上流コネクションを閉じた上で、削除件数と最新のリソース状況を返します。
+func handleDebugCleanup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	evicted := lb.Cleanup()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"evicted":   evicted,
+		"resources": lb.Resources(),
+	})
+}
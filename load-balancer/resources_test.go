@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCleanupSoak(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true})
+	}))
+	defer srv.Close()
+
+	clk := newFakeClock()
+	lb = NewLoadBalancer("round-robin")
+	lb.clock = clk
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+
+	for i := 0; i < 2*defaultEventCapacity; i++ {
+		lb.emitEvent("soak", "filler", nil)
+	}
+	for i := 0; i < 20; i++ {
+		if _, code, err := lb.ForwardRequest(TaskRequest{Weight: 1}); err != nil {
+			t.Fatalf("ForwardRequest: %d %v", code, err)
+		}
+	}
+
+	before := lb.Resources()
+	if got := before.Stores["events"].Size; got != defaultEventCapacity {
+		t.Fatalf("events size = %d, want capacity %d", got, defaultEventCapacity)
+	}
+	host := hostKey(mustParseURL(t, srv.URL))
+	if c := before.Connections[host]; c.Open == 0 || c.Active != 0 || c.Idle != c.Open {
+		t.Fatalf("connections before cleanup = %+v, want idle-only", c)
+	}
+
+	// Nothing has expired yet, so only idle connections go
+	if evicted := lb.Cleanup(); evicted["events"] != 0 {
+		t.Fatalf("evicted = %v, want no events evicted", evicted)
+	}
+
+	clk.Advance(2 * defaultEventMaxAge)
+	evicted := lb.Cleanup()
+	if evicted["events"] != defaultEventCapacity-defaultEventFloor {
+		t.Errorf("evicted events = %d, want %d", evicted["events"], defaultEventCapacity-defaultEventFloor)
+	}
+
+	after := lb.Resources()
+	events := after.Stores["events"]
+	if events.Size != defaultEventFloor {
+		t.Errorf("events size = %d, want floor %d", events.Size, defaultEventFloor)
+	}
+	if events.LastCleanup == nil || !events.LastCleanup.Equal(clk.Now()) {
+		t.Errorf("events lastCleanup = %v, want %v", events.LastCleanup, clk.Now())
+	}
+	if after.CleanupRuns != 2 {
+		t.Errorf("cleanupRuns = %d, want 2", after.CleanupRuns)
+	}
+	if c := after.Connections[host]; c.Open != 0 || c.Idle != 0 {
+		t.Errorf("connections after cleanup = %+v, want none", c)
+	}
+	if got := testutil.ToFloat64(lb.metrics.storeSize.WithLabelValues("events")); got != defaultEventFloor {
+		t.Errorf("lb_store_size{store=events} = %v, want %d", got, defaultEventFloor)
+	}
+}
+
+func TestHandleDebugCleanup(t *testing.T) {
+	clk := newFakeClock()
+	lb = NewLoadBalancer("round-robin")
+	lb.clock = clk
+	for i := 0; i < 100; i++ {
+		lb.emitEvent("soak", "filler", nil)
+	}
+	clk.Advance(defaultEventMaxAge + time.Second)
+
+	rec := httptest.NewRecorder()
+	handleDebugCleanup(rec, httptest.NewRequest(http.MethodGet, "/debug/cleanup", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET status code = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+
+	rec = httptest.NewRecorder()
+	handleDebugCleanup(rec, httptest.NewRequest(http.MethodPost, "/debug/cleanup", bytes.NewReader(nil)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status code = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var resp struct {
+		Evicted   map[string]int `json:"evicted"`
+		Resources ResourceReport `json:"resources"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if resp.Evicted["events"] != 100-defaultEventFloor {
+		t.Errorf("evicted events = %d, want %d", resp.Evicted["events"], 100-defaultEventFloor)
+	}
+	if resp.Resources.Stores["events"].Size != defaultEventFloor {
+		t.Errorf("events size = %d, want %d", resp.Resources.Stores["events"].Size, defaultEventFloor)
+	}
+}
+
+func mustParseURL(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// forwardSequential sends n tasks one after another and returns how many of
+// them went out on a reused connection
+func forwardSequential(tb testing.TB, lb *LoadBalancer, n int) int {
+	tb.Helper()
+	var reused int
+	ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				reused++
+			}
+		},
+	})
+	for i := 0; i < n; i++ {
+		if _, code, err := lb.forwardTask(ctx, TaskRequest{ID: "t", Weight: 1}, time.Now()); err != nil {
+			tb.Fatalf("task %d: %d %v", i, code, err)
+		}
+	}
+	return reused
+}
+
+func TestConnectionReuse(t *testing.T) {
+	lb := NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", newDelayStub(t, "worker-1", 0).URL, "#FF0000", 1)
+
+	if reused := forwardSequential(t, lb, 100); reused != 99 {
+		t.Errorf("%d of 100 sequential tasks reused a connection, want 99", reused)
+	}
+	if c := lb.Resources().Connections; len(c) != 1 {
+		t.Errorf("connections = %+v, want one host", c)
+	} else {
+		for host, stats := range c {
+			if stats.Open != 1 {
+				t.Errorf("%s has %d open connections, want 1", host, stats.Open)
+			}
+		}
+	}
+
+	// Proxied calls share the pool
+	before := lb.Resources().Connections
+	for i := 0; i < 5; i++ {
+		if _, err := lb.callWorker(context.Background(), "worker-1", http.MethodGet, "/config", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for host, stats := range lb.Resources().Connections {
+		if stats.Open != before[host].Open {
+			t.Errorf("%s: %d open connections after proxied calls, want %d", host, stats.Open, before[host].Open)
+		}
+	}
+}
+
+func TestTransportConfigFromEnv(t *testing.T) {
+	t.Setenv("LB_MAX_IDLE_CONNS_PER_HOST", "8")
+	t.Setenv("LB_IDLE_CONN_TIMEOUT_MS", "1500")
+	t.Setenv("LB_DIAL_TIMEOUT_MS", "bogus")
+	cfg := transportConfigFromEnv()
+	want := defaultTransportConfig()
+	want.maxIdleConnsPerHost, want.idleConnTimeout = 8, 1500*time.Millisecond
+	if cfg != want {
+		t.Errorf("config = %+v, want %+v", cfg, want)
+	}
+	m := newResourceManager()
+	if m.transport.MaxIdleConnsPerHost != 8 || m.transport.IdleConnTimeout != 1500*time.Millisecond || m.dialer.Timeout != defaultDialTimeout {
+		t.Errorf("transport not configured from the environment")
+	}
+}
+
+// BenchmarkSequentialForward sends 1,000 sequential tasks per iteration and
+// fails unless all but the first reuse a pooled connection
+func BenchmarkSequentialForward(b *testing.B) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"worker":"worker-1"}`))
+	}))
+	defer srv.Close()
+	lb := NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+	forwardSequential(b, lb, 1)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if reused := forwardSequential(b, lb, 1000); reused != 1000 {
+			b.Fatalf("%d of 1000 tasks reused a connection", reused)
+		}
+	}
+}
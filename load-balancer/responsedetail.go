@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Response detail levels: how much a successful /task response carries.
+// Clients choose one with X-LB-Response-Detail, otherwise the
+// responseDetail setting applies. Error responses are not affected.
+const (
+	responseDetailHeader = "X-LB-Response-Detail"
+	// detailNone answers 204 with the LB fields in headers and no body
+	detailNone = "none"
+	// detailBasic forwards the worker's body untouched, with the LB fields
+	// in headers
+	detailBasic = "basic"
+	// detailFull merges the LB fields into the worker's body
+	detailFull = "full"
+)
+
+func validResponseDetail(detail string) bool {
+	return detail == detailNone || detail == detailBasic || detail == detailFull
+}
+
+// responseDetail returns the detail level r asks for, or the default
+func (lb *LoadBalancer) responseDetail(r *http.Request) (string, error) {
+	if raw := strings.TrimSpace(r.Header.Get(responseDetailHeader)); raw != "" {
+		if !validResponseDetail(raw) {
+			return "", fmt.Errorf("Invalid %s: must be one of none, basic, full", responseDetailHeader)
+		}
+		return raw, nil
+	}
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.defaultDetail, nil
+}
+
+type responseDetailKey struct{}
+
+// withResponseDetail returns ctx carrying the detail level forwardTo answers
+// with
+func withResponseDetail(ctx context.Context, detail string) context.Context {
+	return context.WithValue(ctx, responseDetailKey{}, detail)
+}
+
+// responseDetailFrom returns the detail level carried by ctx, full if none
+func responseDetailFrom(ctx context.Context) string {
+	if detail, ok := ctx.Value(responseDetailKey{}).(string); ok {
+		return detail
+	}
+	return detailFull
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const detailWorkerBody = `{"worker":"worker-1","result":{"id":"t","items":["a","b","c","d","e","f","g","h"],"score":0.75},"processedBy":"go"}`
+
+// newDetailLB builds a one-worker pool whose worker answers
+// detailWorkerBody, or 500 while failing is set
+func newDetailLB(tb testing.TB, failing *atomic.Bool) {
+	tb.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing != nil && failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(detailWorkerBody))
+	}))
+	tb.Cleanup(srv.Close)
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+}
+
+func TestResponseDetail(t *testing.T) {
+	var failing atomic.Bool
+	newDetailLB(t, &failing)
+	success := func() float64 {
+		return testutil.ToFloat64(lb.metrics.requestsTotal.WithLabelValues("worker-1", "success"))
+	}
+
+	rec := doTask(map[string]string{responseDetailHeader: detailNone})
+	if rec.Code != http.StatusNoContent || rec.Body.Len() != 0 {
+		t.Fatalf("none: %d %q", rec.Code, rec.Body.String())
+	}
+	h := rec.Header()
+	if h.Get("Content-Type") != "" || h.Get(workerHeader) != "worker-1" || h.Get(workerColorHeader) != "#FF0000" || h.Get(processingTimeHeader) == "" {
+		t.Errorf("none headers = %v", h)
+	}
+
+	rec = doTask(map[string]string{responseDetailHeader: detailBasic})
+	if rec.Code != http.StatusOK || rec.Body.String() != detailWorkerBody {
+		t.Fatalf("basic: %d %q", rec.Code, rec.Body.String())
+	}
+	if h := rec.Header(); h.Get("Content-Type") != "application/json" || h.Get(workerHeader) != "worker-1" {
+		t.Errorf("basic headers = %v", h)
+	}
+
+	rec = doTask(map[string]string{responseDetailHeader: detailFull})
+	var body map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("full: %d %v", rec.Code, err)
+	}
+	if body["workerColor"] != "#FF0000" || body["processedBy"] != "go" || rec.Header().Get(workerHeader) != "" {
+		t.Errorf("full body = %v, headers = %v", body, rec.Header())
+	}
+
+	// The level does not change what is counted
+	if got := success(); got != 3 {
+		t.Errorf("success requests = %v, want 3", got)
+	}
+	if got := atomic.LoadInt64(&lb.workers[0].TotalRequests); got != 3 {
+		t.Errorf("TotalRequests = %d, want 3", got)
+	}
+
+	// The setting is the default, the header overrides it
+	s := lb.Settings()
+	s.ResponseDetail = detailNone
+	if _, err := lb.UpdateSettings(s); err != nil {
+		t.Fatalf("UpdateSettings: %v", err)
+	}
+	if rec := doTask(nil); rec.Code != http.StatusNoContent {
+		t.Errorf("default none: %d", rec.Code)
+	}
+	if rec := doTask(map[string]string{responseDetailHeader: detailBasic}); rec.Code != http.StatusOK || rec.Body.String() != detailWorkerBody {
+		t.Errorf("basic over default none: %d %q", rec.Code, rec.Body.String())
+	}
+	s.ResponseDetail = "verbose"
+	if _, err := lb.UpdateSettings(s); err == nil {
+		t.Error("responseDetail = verbose should be rejected")
+	}
+	if rec := doTask(map[string]string{responseDetailHeader: "verbose"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid header: %d, want 400", rec.Code)
+	}
+
+	// Errors keep their body
+	failing.Store(true)
+	rec = doTask(map[string]string{responseDetailHeader: detailNone})
+	body = nil
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || rec.Code != http.StatusServiceUnavailable || body["error"] == nil {
+		t.Errorf("error with none: %d %v %v", rec.Code, body, err)
+	}
+}
+
+// BenchmarkTaskResponseDetail measures a /task round trip at each detail
+// level
+func BenchmarkTaskResponseDetail(b *testing.B) {
+	for _, detail := range []string{detailNone, detailBasic, detailFull} {
+		b.Run(detail, func(b *testing.B) {
+			newDetailLB(b, nil)
+			headers := map[string]string{responseDetailHeader: detail}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				doTask(headers)
+			}
+		})
+	}
+}
+
+func TestResponseDetailAllocations(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs 10k requests per level")
+	}
+	allocs := func(detail string) float64 {
+		newDetailLB(t, nil)
+		headers := map[string]string{responseDetailHeader: detail}
+		return testing.AllocsPerRun(10000, func() { doTask(headers) })
+	}
+	none, full := allocs(detailNone), allocs(detailFull)
+	if full-none < 10 {
+		t.Errorf("allocations per request: none = %.0f, full = %.0f; want none measurably lower", none, full)
+	}
+	t.Logf("allocations per request: none = %.0f, full = %.0f", none, full)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Backoff of a retry whose failed attempt carried no Retry-After hint: the
+// n-th retry waits between half and all of retryBackoffBase * 2^(n-1),
+// capped at retryBackoffMax
+const (
+	retryBackoffBase = 50 * time.Millisecond
+	retryBackoffMax  = 2 * time.Second
+)
+
+// Retry scheduling decisions recorded in the attempt chain
+const (
+	retryHintOtherWorker = "hint_other_worker"
+	retryHintSameWorker  = "hint_same_worker"
+	retryBackoff         = "backoff"
+	retryBeyondDeadline  = "beyond_deadline"
+)
+
+// RetryDecision records how the retry after a rejected attempt was
+// scheduled. Decision is hint_other_worker (sent at once since the hint only
+// concerns the worker that gave it), hint_same_worker (the only eligible
+// worker is tried again after its hint), backoff (no hint) or
+// beyond_deadline (the wait would not fit in the request's remaining
+// deadline, so there was no retry).
+type RetryDecision struct {
+	Decision     string `json:"decision"`
+	Worker       string `json:"worker"`
+	WaitMs       int64  `json:"waitMs"`
+	RetryAfterMs int64  `json:"retryAfterMs,omitempty"`
+}
+
+// retryPlan is a scheduled retry
+type retryPlan struct {
+	decision string
+	wait     time.Duration
+}
+
+// planRetry schedules the attempt-th retry of a rejected task. hint is the
+// Retry-After of the rejection (0 if none) and remaining what is left of the
+// request's deadline; jitter returns a number in [0, 1).
+func planRetry(attempt int, sameWorker bool, hint, remaining time.Duration, jitter func() float64) retryPlan {
+	var p retryPlan
+	switch {
+	case hint > 0 && !sameWorker:
+		p = retryPlan{decision: retryHintOtherWorker}
+	case hint > 0:
+		p = retryPlan{decision: retryHintSameWorker, wait: hint}
+	default:
+		d := retryBackoffBase << (attempt - 1)
+		if d > retryBackoffMax || d <= 0 {
+			d = retryBackoffMax
+		}
+		p = retryPlan{decision: retryBackoff, wait: d/2 + time.Duration(jitter()*float64(d/2))}
+	}
+	if p.wait >= remaining {
+		p.decision = retryBeyondDeadline
+	}
+	return p
+}
+
+// parseRetryAfter returns the delay of a Retry-After header, in seconds or
+// as an HTTP date, or 0 if it is absent or invalid
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(v); err == nil {
+		if s <= 0 {
+			return 0
+		}
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// sleepCtx waits d on the LB clock and reports whether it elapsed before ctx
+// was done
+func (lb *LoadBalancer) sleepCtx(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := lb.clock.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C():
+		return true
+	}
+}
+
+// annotateRetry attaches a retry decision to the last attempt logged in ctx
+func annotateRetry(ctx context.Context, d *RetryDecision) {
+	if l, ok := ctx.Value(attemptLogKey{}).(*attemptLog); ok && len(l.attempts) > 0 {
+		l.attempts[len(l.attempts)-1].Retry = d
+	}
+}
+
+// retryJitter is the jitter of the retry backoff; tests replace it
+var retryJitter = rand.Float64
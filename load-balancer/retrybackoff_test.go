@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPlanRetry(t *testing.T) {
+	half := func() float64 { return 0.5 }
+	tests := []struct {
+		name       string
+		attempt    int
+		sameWorker bool
+		hint       time.Duration
+		remaining  time.Duration
+		want       retryPlan
+	}{
+		{"hinted other worker goes at once", 1, false, 2 * time.Second, time.Second, retryPlan{retryHintOtherWorker, 0}},
+		{"hinted same worker waits the hint", 1, true, time.Second, 3 * time.Second, retryPlan{retryHintSameWorker, time.Second}},
+		{"hinted same worker beyond the deadline", 1, true, 2 * time.Second, time.Second, retryPlan{retryBeyondDeadline, 2 * time.Second}},
+		// 50ms halved plus half of the other half
+		{"unhinted backs off", 1, false, 0, time.Second, retryPlan{retryBackoff, 37500 * time.Microsecond}},
+		{"unhinted backoff grows", 3, true, 0, time.Second, retryPlan{retryBackoff, 150 * time.Millisecond}},
+		{"unhinted backoff is capped", 20, true, 0, 5 * time.Second, retryPlan{retryBackoff, 1500 * time.Millisecond}},
+		{"unhinted beyond the deadline", 1, true, 0, 20 * time.Millisecond, retryPlan{retryBeyondDeadline, 37500 * time.Microsecond}},
+	}
+	for _, tt := range tests {
+		if got := planRetry(tt.attempt, tt.sameWorker, tt.hint, tt.remaining, half); got != tt.want {
+			t.Errorf("%s: %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for v, want := range map[string]time.Duration{
+		"3":                             3 * time.Second,
+		"":                              0,
+		"-1":                            0,
+		"soon":                          0,
+		"Thu, 01 Jan 2026 00:00:05 GMT": 5 * time.Second,
+		"Wed, 31 Dec 2025 23:59:00 GMT": 0,
+	} {
+		if got := parseRetryAfter(v, now); got != want {
+			t.Errorf("Retry-After %q = %v, want %v", v, got, want)
+		}
+	}
+}
+
+// newFlakyWorker rejects its first task with queue_full and the given
+// Retry-After, then serves tasks
+func newFlakyWorker(t *testing.T, retryAfter string) *httptest.Server {
+	t.Helper()
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.Header().Set(rejectReasonHeader, rejectQueueFull)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestRetryHonorsRetryAfter(t *testing.T) {
+	clk := newFakeClock()
+	lb = NewLoadBalancer("round-robin")
+	lb.clock = clk
+	lb.AddWorker("only", newFlakyWorker(t, "1").URL, "#FF0000", 1)
+
+	// The only eligible worker is retried once its hint has passed
+	log := &attemptLog{}
+	done := make(chan int, 1)
+	go func() {
+		_, code, _ := lb.forwardWithRetry(withAttemptLog(context.Background(), log), routeHints{}, lb.workers[0], TaskRequest{ID: "t", Weight: 1}, time.Now())
+		done <- code
+	}()
+	clk.waitForTimer(t)
+	select {
+	case code := <-done:
+		t.Fatalf("retried before the hint passed: %d", code)
+	case <-time.After(20 * time.Millisecond):
+	}
+	clk.Advance(time.Second)
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 after the hinted retry", code)
+	}
+	want := RetryDecision{Decision: retryHintSameWorker, Worker: "only", WaitMs: 1000, RetryAfterMs: 1000}
+	if len(log.attempts) != 2 || log.attempts[0].Retry == nil || *log.attempts[0].Retry != want || log.attempts[1].Retry != nil {
+		t.Errorf("attempts = %+v, want the first annotated with %+v", log.attempts, want)
+	}
+
+	// A hint longer than the remaining deadline ends the request instead
+	lb = NewLoadBalancer("round-robin")
+	lb.clock = clk
+	lb.AddWorker("only", newFlakyWorker(t, "2").URL, "#FF0000", 1)
+	s := lb.Settings()
+	s.UpstreamTimeoutMs = 1000
+	lb.UpdateSettings(s)
+	log = &attemptLog{}
+	if _, code, _ := lb.forwardWithRetry(withAttemptLog(context.Background(), log), routeHints{}, lb.workers[0], TaskRequest{ID: "t", Weight: 1}, time.Now()); code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want the rejection", code)
+	}
+	if len(log.attempts) != 1 || log.attempts[0].Retry == nil || log.attempts[0].Retry.Decision != retryBeyondDeadline {
+		t.Errorf("attempts = %+v, want one marked beyond_deadline", log.attempts)
+	}
+
+	// Another worker is tried at once despite the hint
+	spare := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer spare.Close()
+	lb = NewLoadBalancer("round-robin")
+	lb.clock = clk
+	lb.AddWorker("flaky", newFlakyWorker(t, "5").URL, "#FF0000", 1)
+	lb.AddWorker("spare", spare.URL, "#00FF00", 1)
+	log = &attemptLog{}
+	if _, code, _ := lb.forwardWithRetry(withAttemptLog(context.Background(), log), routeHints{}, lb.workers[0], TaskRequest{ID: "t", Weight: 1}, time.Now()); code != http.StatusOK {
+		t.Errorf("status = %d, want 200 from spare", code)
+	}
+	if len(log.attempts) != 2 || log.attempts[0].Retry == nil || log.attempts[0].Retry.Decision != retryHintOtherWorker || log.attempts[1].Worker != "spare" {
+		t.Errorf("attempts = %+v, want an immediate retry on spare", log.attempts)
+	}
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// Rolling restarts. The enabled workers are restarted batchSize at a time:
+// each one is drained (disabled, then given drainTimeout to finish its
+// in-flight tasks), its restart hook is called, and once it has been seen
+// down and then healthy again within timeout it is enabled again. A worker
+// that fails to come back stops the whole run.
+const (
+	defaultRollingTimeout      = 60 * time.Second
+	defaultRollingDrainTimeout = 10 * time.Second
+	defaultRestartHook         = "{url}/crash?mode=exit"
+	defaultRollingPoll         = 100 * time.Millisecond
+)
+
+// Phases of a worker during a rolling restart
+const (
+	rollPending    = "pending"
+	rollDraining   = "draining"
+	rollRestarting = "restarting"
+	rollWaiting    = "waiting"
+	rollDone       = "done"
+	rollFailed     = "failed"
+	rollAborted    = "aborted"
+)
+
+// States of a rolling restart
+const (
+	rollingIdle      = "idle"
+	rollingRunning   = "running"
+	rollingCompleted = "completed"
+	rollingFailed    = "failed"
+	rollingAborted   = "aborted"
+	rollingPlanned   = "planned"
+)
+
+// RollingRestartRequest is the body of POST /rolling-restart. Workers
+// limits the run to the named workers; by default every enabled worker is
+// restarted, in pool order. HookURL may contain {url} and {name}. DryRun
+// validates the run and returns its plan without starting it.
+type RollingRestartRequest struct {
+	BatchSize      int      `json:"batchSize"`
+	TimeoutMs      int64    `json:"timeoutMs"`
+	DrainTimeoutMs int64    `json:"drainTimeoutMs"`
+	HookURL        string   `json:"hookUrl"`
+	Workers        []string `json:"workers"`
+	DryRun         bool     `json:"dryRun,omitempty"`
+}
+
+// RollingWorker is one worker's progress through a rolling restart
+type RollingWorker struct {
+	Name       string     `json:"name"`
+	Phase      string     `json:"phase"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+// RollingRestart is the state of the current or last rolling restart. Batch
+// is the 1-based batch in progress. A dry run returns the planned state,
+// with every worker pending.
+type RollingRestart struct {
+	ID         int64           `json:"id"`
+	State      string          `json:"state"`
+	DryRun     bool            `json:"dryRun,omitempty"`
+	BatchSize  int             `json:"batchSize"`
+	Batch      int             `json:"batch"`
+	Batches    int             `json:"batches"`
+	HookURL    string          `json:"hookUrl"`
+	Workers    []RollingWorker `json:"workers"`
+	Error      string          `json:"error,omitempty"`
+	StartedAt  *time.Time      `json:"startedAt,omitempty"`
+	FinishedAt *time.Time      `json:"finishedAt,omitempty"`
+}
+
+// errRollingInProgress is returned when a rolling restart is already running
+var errRollingInProgress = errors.New("a rolling restart is already in progress")
+
+// rollingRestarter runs at most one rolling restart at a time
+type rollingRestarter struct {
+	mu      sync.Mutex
+	seq     int64
+	state   RollingRestart
+	cancel  context.CancelFunc
+	done    chan struct{}
+	poll    time.Duration
+	running atomic.Bool
+}
+
+func newRollingRestarter() *rollingRestarter {
+	return &rollingRestarter{state: RollingRestart{State: rollingIdle, Workers: []RollingWorker{}}, poll: defaultRollingPoll}
+}
+
+// snapshot returns a copy of the state
+func (r *rollingRestarter) snapshot() RollingRestart {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.state
+	s.Workers = append([]RollingWorker(nil), r.state.Workers...)
+	return s
+}
+
+// setPhase moves worker i to phase, recording err when it failed
+func (r *rollingRestarter) setPhase(i int, phase string, err error) RollingWorker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w := &r.state.Workers[i]
+	now := time.Now().UTC()
+	if w.StartedAt == nil {
+		w.StartedAt = &now
+	}
+	w.Phase = phase
+	switch phase {
+	case rollDone, rollFailed, rollAborted:
+		w.FinishedAt = &now
+	}
+	if err != nil {
+		w.Error = err.Error()
+	}
+	return *w
+}
+
+// validateRollingRestart fills in the defaults of req and checks it against
+// the plan it would restart
+func validateRollingRestart(req *RollingRestartRequest, plan []string) error {
+	if req.BatchSize == 0 {
+		req.BatchSize = 1
+	}
+	if req.TimeoutMs == 0 {
+		req.TimeoutMs = defaultRollingTimeout.Milliseconds()
+	}
+	if req.DrainTimeoutMs == 0 {
+		req.DrainTimeoutMs = defaultRollingDrainTimeout.Milliseconds()
+	}
+	if req.HookURL == "" {
+		req.HookURL = defaultRestartHook
+	}
+	switch {
+	case len(plan) == 0:
+		return &MetadataError{"workers", "no enabled worker to restart"}
+	case req.BatchSize < 1 || req.BatchSize > len(plan):
+		return &MetadataError{"batchSize", fmt.Sprintf("must be between 1 and %d", len(plan))}
+	case req.TimeoutMs < 0:
+		return &MetadataError{"timeoutMs", "must be positive"}
+	case req.DrainTimeoutMs < 0:
+		return &MetadataError{"drainTimeoutMs", "must be positive"}
+	}
+	if u, err := url.Parse(restartHookURL(req.HookURL, "x", "http://worker")); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return &MetadataError{"hookUrl", "must be an http(s) URL, optionally built from {url} and {name}"}
+	}
+	return nil
+}
+
+// restartHookURL expands the {name} and {url} placeholders of hook
+func restartHookURL(hook, name, workerURL string) string {
+	return strings.NewReplacer("{name}", name, "{url}", workerURL).Replace(hook)
+}
+
+// rollingPlanLocked returns the workers req restarts, in pool order. Must be
+// called with lb.mu held.
+func (lb *LoadBalancer) rollingPlanLocked(names []string) ([]string, []string) {
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+	var plan []string
+	for _, w := range lb.workers {
+		if len(names) > 0 && !wanted[w.Name] {
+			continue
+		}
+		delete(wanted, w.Name)
+		if w.Enabled {
+			plan = append(plan, w.Name)
+		}
+	}
+	var unknown []string
+	for _, name := range names {
+		if wanted[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	return plan, unknown
+}
+
+// planRollingRestart validates req, filling in its defaults, and returns the
+// workers it restarts
+func (lb *LoadBalancer) planRollingRestart(req *RollingRestartRequest) ([]string, error) {
+	lb.mu.RLock()
+	plan, unknown := lb.rollingPlanLocked(req.Workers)
+	lb.mu.RUnlock()
+	if len(unknown) > 0 {
+		return nil, &MetadataError{"workers", "unknown workers: " + strings.Join(unknown, ", ")}
+	}
+	if err := validateRollingRestart(req, plan); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// newRollingState returns the state of a run of req over plan before any
+// worker was touched
+func newRollingState(req RollingRestartRequest, plan []string) RollingRestart {
+	s := RollingRestart{
+		BatchSize: req.BatchSize,
+		Batches:   (len(plan) + req.BatchSize - 1) / req.BatchSize,
+		HookURL:   req.HookURL,
+		Workers:   make([]RollingWorker, len(plan)),
+	}
+	for i, name := range plan {
+		s.Workers[i] = RollingWorker{Name: name, Phase: rollPending}
+	}
+	return s
+}
+
+// PlanRollingRestart validates req like StartRollingRestart and returns the
+// run it would start, without starting it
+func (lb *LoadBalancer) PlanRollingRestart(req RollingRestartRequest) (RollingRestart, error) {
+	plan, err := lb.planRollingRestart(&req)
+	if err != nil {
+		return RollingRestart{}, err
+	}
+	if lb.rolling.running.Load() {
+		return RollingRestart{}, errRollingInProgress
+	}
+	s := newRollingState(req, plan)
+	s.State = rollingPlanned
+	s.DryRun = true
+	return s, nil
+}
+
+// StartRollingRestart starts a rolling restart in the background and returns
+// its initial state
+func (lb *LoadBalancer) StartRollingRestart(req RollingRestartRequest) (RollingRestart, error) {
+	plan, err := lb.planRollingRestart(&req)
+	if err != nil {
+		return RollingRestart{}, err
+	}
+
+	r := lb.rolling
+	if !r.running.CompareAndSwap(false, true) {
+		return RollingRestart{}, errRollingInProgress
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	now := time.Now().UTC()
+	r.mu.Lock()
+	r.seq++
+	r.state = newRollingState(req, plan)
+	r.state.ID = r.seq
+	r.state.State = rollingRunning
+	r.state.StartedAt = &now
+	r.cancel = cancel
+	r.done = make(chan struct{})
+	r.mu.Unlock()
+
+	lb.emitEvent("rolling_restart", fmt.Sprintf("Rolling restart of %d workers started", len(plan)), map[string]interface{}{
+		"id":        r.seq,
+		"workers":   plan,
+		"batchSize": req.BatchSize,
+	})
+	go lb.runRollingRestart(ctx, req)
+	return r.snapshot(), nil
+}
+
+// AbortRollingRestart stops the running rolling restart and waits for it to
+// stop. The workers it was restarting stay drained. It returns false if no
+// rolling restart was running.
+func (lb *LoadBalancer) AbortRollingRestart() (RollingRestart, bool) {
+	r := lb.rolling
+	r.mu.Lock()
+	cancel, done := r.cancel, r.done
+	r.mu.Unlock()
+	if !r.running.Load() || cancel == nil {
+		return r.snapshot(), false
+	}
+	cancel()
+	<-done
+	return r.snapshot(), true
+}
+
+// RollingRestartStatus returns the state of the current or last rolling
+// restart
+func (lb *LoadBalancer) RollingRestartStatus() RollingRestart {
+	return lb.rolling.snapshot()
+}
+
+// runRollingRestart restarts the planned workers batch by batch
+func (lb *LoadBalancer) runRollingRestart(ctx context.Context, req RollingRestartRequest) {
+	r := lb.rolling
+	s := r.snapshot()
+	state, msg := rollingCompleted, ""
+	for start := 0; start < len(s.Workers); start += req.BatchSize {
+		end := min(start+req.BatchSize, len(s.Workers))
+		r.mu.Lock()
+		r.state.Batch = start/req.BatchSize + 1
+		r.mu.Unlock()
+
+		errs := make([]error, end-start)
+		var wg sync.WaitGroup
+		for i := start; i < end; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i-start] = lb.restartWorker(ctx, i, s.Workers[i].Name, req)
+			}(i)
+		}
+		wg.Wait()
+
+		if ctx.Err() != nil {
+			state, msg = rollingAborted, "aborted"
+			break
+		}
+		if err := errors.Join(errs...); err != nil {
+			state, msg = rollingFailed, err.Error()
+			break
+		}
+	}
+
+	// Workers never reached stay as they were
+	now := time.Now().UTC()
+	r.mu.Lock()
+	r.state.State = state
+	if state != rollingCompleted {
+		r.state.Error = msg
+	}
+	r.state.FinishedAt = &now
+	id := r.state.ID
+	r.cancel = nil
+	close(r.done)
+	r.mu.Unlock()
+	r.running.Store(false)
+
+	lb.metrics.rollingRestarts.WithLabelValues(state).Inc()
+	data := map[string]interface{}{"id": id, "state": state}
+	if msg != "" {
+		data["error"] = msg
+	}
+	lb.emitEvent("rolling_restart", "Rolling restart "+state, data)
+}
+
+// restartWorker takes worker i of the run through drain, restart, wait and
+// undrain. On abort or failure the worker is left drained.
+func (lb *LoadBalancer) restartWorker(ctx context.Context, i int, name string, req RollingRestartRequest) error {
+	r := lb.rolling
+	fail := func(err error) error {
+		phase := rollFailed
+		if ctx.Err() != nil {
+			phase, err = rollAborted, nil
+		}
+		lb.emitRollingPhase(r.setPhase(i, phase, err))
+		return err
+	}
+
+	lb.emitRollingPhase(r.setPhase(i, rollDraining, nil))
+	if !lb.setWorkerEnabled(name, false) {
+		return fail(fmt.Errorf("%s: worker removed", name))
+	}
+	lb.waitDrained(ctx, name, time.Duration(req.DrainTimeoutMs)*time.Millisecond)
+	if ctx.Err() != nil {
+		return fail(nil)
+	}
+
+	lb.emitRollingPhase(r.setPhase(i, rollRestarting, nil))
+	workerURL := lb.workerURL(name)
+	if workerURL == "" {
+		return fail(fmt.Errorf("%s: worker removed", name))
+	}
+	if err := lb.callRestartHook(ctx, restartHookURL(req.HookURL, name, workerURL)); err != nil {
+		return fail(fmt.Errorf("%s: %v", name, err))
+	}
+
+	lb.emitRollingPhase(r.setPhase(i, rollWaiting, nil))
+	timeout := time.Duration(req.TimeoutMs) * time.Millisecond
+	if err := lb.waitRestarted(ctx, lb.workerHealthURL(name), timeout); err != nil {
+		return fail(fmt.Errorf("%s: %v", name, err))
+	}
+
+	lb.setWorkerEnabled(name, true)
+	lb.emitRollingPhase(r.setPhase(i, rollDone, nil))
+	return nil
+}
+
+// emitRollingPhase reports a worker's progress to event log subscribers
+func (lb *LoadBalancer) emitRollingPhase(w RollingWorker) {
+	data := map[string]interface{}{"worker": w.Name, "phase": w.Phase}
+	msg := fmt.Sprintf("Rolling restart: worker %s %s", w.Name, w.Phase)
+	if w.Error != "" {
+		data["error"] = w.Error
+		msg += ": " + w.Error
+	}
+	lb.emitEvent("rolling_restart", msg, data)
+}
+
+// setWorkerEnabled drains or undrains the named worker and broadcasts the
+// change. It returns false if there is no such worker.
+func (lb *LoadBalancer) setWorkerEnabled(name string, enabled bool) bool {
+	if _, ok := lb.PatchWorker(name, api.WorkerUpdate{Enabled: &enabled}); !ok {
+		return false
+	}
+	lb.BroadcastStatus()
+	return true
+}
+
+// waitDrained waits up to timeout for the named worker to finish its
+// in-flight tasks
+func (lb *LoadBalancer) waitDrained(ctx context.Context, name string, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		lb.mu.RLock()
+		w := lb.findWorkerLocked(name)
+		idle := w == nil || atomic.LoadInt32(&w.CurrentLoad) == 0
+		lb.mu.RUnlock()
+		if idle || !sleepCtx(ctx, lb.rolling.poll) {
+			return
+		}
+	}
+}
+
+// callRestartHook asks a worker to restart. A worker exiting may drop the
+// connection before it answers, so only an error status fails the call.
+func (lb *LoadBalancer) callRestartHook(ctx context.Context, hook string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("restart hook returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// waitRestarted waits up to timeout for the worker whose health check is at
+// healthURL to fail a probe and then pass one
+func (lb *LoadBalancer) waitRestarted(ctx context.Context, healthURL string, timeout time.Duration) error {
+	lb.mu.RLock()
+	client := lb.resources.timeoutClient(lb.healthTimeout)
+	lb.mu.RUnlock()
+	probe := func() bool {
+		resp, err := client.Get(healthURL)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}
+
+	deadline := time.Now().Add(timeout)
+	wentDown := false
+	for time.Now().Before(deadline) {
+		if healthy := probe(); !healthy {
+			wentDown = true
+		} else if wentDown {
+			return nil
+		}
+		if !sleepCtx(ctx, lb.rolling.poll) {
+			return ctx.Err()
+		}
+	}
+	if !wentDown {
+		return fmt.Errorf("did not go down within %v", timeout)
+	}
+	return fmt.Errorf("did not come back within %v", timeout)
+}
+
+// sleepCtx sleeps for d and reports whether ctx is still live
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// handleRollingRestart はワーカーを順番に再起動するローリングリスタートの HTTP ハンドラです。
+// POST で {"batchSize", "timeoutMs", "drainTimeoutMs", "hookUrl", "workers"} を受け取り、有効なワーカーを batchSize 台ずつドレインしてから再起動フック (既定 {url}/crash?mode=exit) を呼び、
+// ヘルスチェックが一度失敗してから再び成功するのを timeoutMs (既定 60000) まで待ってドレインを解除します。戻らないワーカーがあればそこで中止して失敗を報告します。
+// 開始すると 202 と状態を返し、既に実行中なら 409 を返します。進捗は rolling_restart イベントとして WebSocket に流れます。
+// GET は現在 (または直近) の実行状態を返し、DELETE は実行を中止します。中止時に処理中だったワーカーは再起動途中ではなくドレインされたまま残ります。
+// ?dryRun=true または "dryRun": true では同じ検証だけを行い、開始せずイベントも記録せずに、state "planned" の計画 (対象ワーカーとバッチ数) を 200 で返します。
+func handleRollingRestart(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(lb.RollingRestartStatus())
+	case http.MethodPost:
+		var req RollingRestartRequest
+		if r.ContentLength != 0 {
+			dec := json.NewDecoder(r.Body)
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&req); err != nil {
+				writeMetadataError(w, &MetadataError{"body", err.Error()})
+				return
+			}
+		}
+		dryRun, err := dryRunQuery(r)
+		if err != nil {
+			writeMetadataError(w, err.(*MetadataError))
+			return
+		}
+		start := lb.StartRollingRestart
+		if dryRun || req.DryRun {
+			start = lb.PlanRollingRestart
+		}
+		state, err := start(req)
+		var me *MetadataError
+		switch {
+		case errors.As(err, &me):
+			writeMetadataError(w, me)
+			return
+		case err != nil:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(api.ErrorResponse{Error: err.Error()})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !state.DryRun {
+			w.WriteHeader(http.StatusAccepted)
+		}
+		json.NewEncoder(w).Encode(state)
+	case http.MethodDelete:
+		state, ok := lb.AbortRollingRestart()
+		w.Header().Set("Content-Type", "application/json")
+		if !ok {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(api.ErrorResponse{Error: "No rolling restart in progress"})
+			return
+		}
+		json.NewEncoder(w).Encode(state)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
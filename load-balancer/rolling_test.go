@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// restartStub emulates a worker restarted by /crash: its /health fails from
+// the crash until downFor has passed, or for good if downFor is 0
+type restartStub struct {
+	mu      sync.Mutex
+	downFor time.Duration
+	upAt    time.Time
+	down    bool
+	crashes int32
+}
+
+func newRestartStub(t *testing.T, downFor time.Duration) (*httptest.Server, *restartStub) {
+	t.Helper()
+	rs := &restartStub{downFor: downFor}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rs.mu.Lock()
+		defer rs.mu.Unlock()
+		switch r.URL.Path {
+		case "/crash":
+			atomic.AddInt32(&rs.crashes, 1)
+			rs.down, rs.upAt = true, time.Now().Add(rs.downFor)
+			w.WriteHeader(http.StatusAccepted)
+		case "/health":
+			if rs.down && (rs.downFor == 0 || time.Now().Before(rs.upAt)) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			rs.down = false
+			w.WriteHeader(http.StatusOK)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, rs
+}
+
+func rollingRequest(t *testing.T, mux http.Handler, method, body string) (int, RollingRestart) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(method, "/api/rolling-restart", strings.NewReader(body)))
+	var state RollingRestart
+	json.NewDecoder(rec.Body).Decode(&state)
+	return rec.Code, state
+}
+
+// waitForRolling polls until the rolling restart leaves the running state
+func waitForRolling(t *testing.T) RollingRestart {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s := lb.RollingRestartStatus()
+		if s.State != rollingRunning {
+			return s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("rolling restart still running: %+v", s)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func workersEnabled() map[string]bool {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	enabled := map[string]bool{}
+	for _, w := range lb.workers {
+		enabled[w.Name] = w.Enabled
+	}
+	return enabled
+}
+
+func TestRollingRestart(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	t.Cleanup(lb.stopControl)
+	lb.rolling.poll = 5 * time.Millisecond
+	var stubs []*restartStub
+	for _, name := range []string{"worker-1", "worker-2", "worker-3"} {
+		srv, rs := newRestartStub(t, 30*time.Millisecond)
+		stubs = append(stubs, rs)
+		lb.AddWorker(name, srv.URL, "#FF0000", 1)
+	}
+	mux := newMux()
+
+	if code, s := rollingRequest(t, mux, http.MethodGet, ""); code != http.StatusOK || s.State != rollingIdle {
+		t.Errorf("before any run: %d %q, want 200 idle", code, s.State)
+	}
+	if code, _ := rollingRequest(t, mux, http.MethodPost, `{"batchSize": 4}`); code != http.StatusBadRequest {
+		t.Errorf("batch larger than the pool: %d, want 400", code)
+	}
+	if code, _ := rollingRequest(t, mux, http.MethodPost, `{"workers": ["worker-9"]}`); code != http.StatusBadRequest {
+		t.Errorf("unknown worker: %d, want 400", code)
+	}
+
+	// A dry run returns the plan without touching a worker
+	events := len(lb.events.since(0, 0))
+	for _, target := range []string{"/api/rolling-restart?dryRun=true", "/api/rolling-restart"} {
+		body := `{"batchSize": 2}`
+		if !strings.Contains(target, "?") {
+			body = `{"batchSize": 2, "dryRun": true}`
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, target, strings.NewReader(body)))
+		var plan RollingRestart
+		json.NewDecoder(rec.Body).Decode(&plan)
+		if rec.Code != http.StatusOK || !plan.DryRun || plan.State != rollingPlanned || plan.Batches != 2 || len(plan.Workers) != 3 || plan.Workers[2].Phase != rollPending {
+			t.Errorf("dry run %s: %d %+v", body, rec.Code, plan)
+		}
+	}
+	if len(lb.events.since(0, 0)) != events || lb.RollingRestartStatus().State != rollingIdle || atomic.LoadInt32(&stubs[0].crashes) != 0 {
+		t.Error("a dry run must not start the restart")
+	}
+
+	code, s := rollingRequest(t, mux, http.MethodPost, `{"batchSize": 2, "timeoutMs": 2000}`)
+	if code != http.StatusAccepted || s.Batches != 2 || len(s.Workers) != 3 {
+		t.Fatalf("start: %d %+v, want 202 with 3 workers in 2 batches", code, s)
+	}
+	if code, _ := rollingRequest(t, mux, http.MethodPost, `{}`); code != http.StatusConflict {
+		t.Errorf("second start while running: %d, want 409", code)
+	}
+	if code, _ := rollingRequest(t, mux, http.MethodPost, `{"dryRun": true}`); code != http.StatusConflict {
+		t.Errorf("dry run while running: %d, want 409", code)
+	}
+
+	s = waitForRolling(t)
+	if s.State != rollingCompleted {
+		t.Fatalf("state = %q (%s), want completed", s.State, s.Error)
+	}
+	for i, w := range s.Workers {
+		if w.Phase != rollDone || atomic.LoadInt32(&stubs[i].crashes) != 1 {
+			t.Errorf("%s: phase %q after %d crashes, want done after 1", w.Name, w.Phase, stubs[i].crashes)
+		}
+	}
+	for name, on := range workersEnabled() {
+		if !on {
+			t.Errorf("%s still drained after the run", name)
+		}
+	}
+
+	// Every worker went through each phase, in order
+	phases := map[string][]string{}
+	for _, ev := range lb.events.since(0, 0) {
+		if name, ok := ev.Data["worker"].(string); ok && ev.Type == "rolling_restart" {
+			phases[name] = append(phases[name], ev.Data["phase"].(string))
+		}
+	}
+	for _, name := range []string{"worker-1", "worker-2", "worker-3"} {
+		if got := strings.Join(phases[name], ","); got != "draining,restarting,waiting,done" {
+			t.Errorf("%s phases = %s", name, got)
+		}
+	}
+}
+
+func TestRollingRestartWorkerDoesNotReturn(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	t.Cleanup(lb.stopControl)
+	lb.rolling.poll = 5 * time.Millisecond
+	a, _ := newRestartStub(t, 10*time.Millisecond)
+	b, _ := newRestartStub(t, 0)
+	c, cs := newRestartStub(t, 10*time.Millisecond)
+	lb.AddWorker("worker-1", a.URL, "#FF0000", 1)
+	lb.AddWorker("worker-2", b.URL, "#00FF00", 1)
+	lb.AddWorker("worker-3", c.URL, "#0000FF", 1)
+
+	if _, err := lb.StartRollingRestart(RollingRestartRequest{TimeoutMs: 100}); err != nil {
+		t.Fatal(err)
+	}
+	s := waitForRolling(t)
+	if s.State != rollingFailed || !strings.Contains(s.Error, "worker-2") {
+		t.Fatalf("state = %q (%s), want failed on worker-2", s.State, s.Error)
+	}
+	want := []string{rollDone, rollFailed, rollPending}
+	for i, w := range s.Workers {
+		if w.Phase != want[i] {
+			t.Errorf("%s phase = %q, want %q", w.Name, w.Phase, want[i])
+		}
+	}
+	if atomic.LoadInt32(&cs.crashes) != 0 {
+		t.Error("worker-3 was restarted after worker-2 failed")
+	}
+	if enabled := workersEnabled(); !enabled["worker-1"] || enabled["worker-2"] || !enabled["worker-3"] {
+		t.Errorf("enabled = %v, want only the failed worker-2 drained", enabled)
+	}
+}
+
+func TestRollingRestartAbort(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	t.Cleanup(lb.stopControl)
+	lb.rolling.poll = 5 * time.Millisecond
+	a, _ := newRestartStub(t, 0)
+	b, bs := newRestartStub(t, 0)
+	lb.AddWorker("worker-1", a.URL, "#FF0000", 1)
+	lb.AddWorker("worker-2", b.URL, "#00FF00", 1)
+	mux := newMux()
+
+	if code, _ := rollingRequest(t, mux, http.MethodDelete, ""); code != http.StatusConflict {
+		t.Errorf("abort with nothing running: %d, want 409", code)
+	}
+	if code, _ := rollingRequest(t, mux, http.MethodPost, `{"timeoutMs": 10000}`); code != http.StatusAccepted {
+		t.Fatalf("start: %d, want 202", code)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for lb.RollingRestartStatus().Workers[0].Phase != rollWaiting {
+		if time.Now().After(deadline) {
+			t.Fatalf("worker-1 never reached waiting: %+v", lb.RollingRestartStatus())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	code, s := rollingRequest(t, mux, http.MethodDelete, "")
+	if code != http.StatusOK || s.State != rollingAborted {
+		t.Fatalf("abort: %d %q, want 200 aborted", code, s.State)
+	}
+	if s.Workers[0].Phase != rollAborted || s.Workers[1].Phase != rollPending || atomic.LoadInt32(&bs.crashes) != 0 {
+		t.Errorf("workers after abort = %+v", s.Workers)
+	}
+	if enabled := workersEnabled(); enabled["worker-1"] || !enabled["worker-2"] {
+		t.Errorf("enabled = %v, want only worker-1 left drained", enabled)
+	}
+}
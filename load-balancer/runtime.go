@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// RuntimeSummary aggregates the workers of one runtime
+type RuntimeSummary = api.RuntimeSummary
+
+// unknownRuntime is the runtime of a worker whose name names none of
+// knownRuntimes and that has no explicit one
+const unknownRuntime = "unknown"
+
+// knownRuntimes maps the name segments that identify a worker
+// implementation to its runtime
+var knownRuntimes = map[string]string{
+	"go":     "go",
+	"golang": "go",
+	"rust":   "rust",
+	"python": "python",
+	"py":     "python",
+}
+
+var runtimePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,31}$`)
+
+// inferRuntime returns the runtime named by the first known segment of a
+// worker name ("go-worker-1", "worker-rust-2"), or unknownRuntime
+func inferRuntime(name string) string {
+	for _, seg := range strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return r == '-' || r == '_' || r == '.' || r == ' '
+	}) {
+		if rt, ok := knownRuntimes[seg]; ok {
+			return rt
+		}
+	}
+	return unknownRuntime
+}
+
+// runtime returns the worker's explicit runtime or the one inferred from its
+// name
+func (w *Worker) runtime() string {
+	if w.Runtime != "" {
+		return w.Runtime
+	}
+	return inferRuntime(w.Name)
+}
+
+// validateRuntime checks an explicit runtime; "" is allowed and means
+// inferred
+func validateRuntime(rt string) error {
+	if rt != "" && !runtimePattern.MatchString(rt) {
+		return &MetadataError{"runtime", "must be 1-32 lowercase letters, digits, '.', '_' or '-'"}
+	}
+	return nil
+}
+
+// runtimeSummaryLocked aggregates the workers' cumulative stats by runtime,
+// sorted by runtime. Must be called with lb.mu held.
+func (lb *LoadBalancer) runtimeSummaryLocked() []RuntimeSummary {
+	type group struct {
+		summary RuntimeSummary
+		stats   statsSnapshot
+	}
+	groups := make(map[string]*group)
+	for _, w := range lb.workers {
+		rt := w.runtime()
+		g, ok := groups[rt]
+		if !ok {
+			g = &group{summary: RuntimeSummary{Runtime: rt}}
+			groups[rt] = g
+		}
+		g.summary.Workers++
+		if w.Healthy {
+			g.summary.HealthyWorkers++
+		}
+		g.stats.add(w.stats.snapshot())
+	}
+
+	out := make([]RuntimeSummary, 0, len(groups))
+	for _, g := range groups {
+		s := g.summary
+		s.Requests, s.Errors = g.stats.Requests, g.stats.Errors
+		if s.Requests > 0 {
+			rate := float64(s.Requests-s.Errors) / float64(s.Requests)
+			p50, p95, p99 := g.stats.quantile(0.5), g.stats.quantile(0.95), g.stats.quantile(0.99)
+			s.SuccessRate, s.P50LatencyMs, s.P95LatencyMs, s.P99LatencyMs = &rate, &p50, &p95, &p99
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Runtime < out[j].Runtime })
+	return out
+}
+
+// RuntimeSummary returns the workers aggregated by runtime
+func (lb *LoadBalancer) RuntimeSummary() []RuntimeSummary {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.runtimeSummaryLocked()
+}
+
+// handleRuntimeSummary は GET /summary/by-runtime でワーカーをランタイム (go, rust, python など) ごとに集計し、
+// リクエスト数・成功率・レイテンシのパーセンタイル・正常なワーカー数を返す HTTP ハンドラです。
+// リクエストがまだないランタイムの成功率とパーセンタイルは null になります。
+func handleRuntimeSummary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lb.RuntimeSummary())
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+func TestInferRuntime(t *testing.T) {
+	for name, want := range map[string]string{
+		"go-worker-1":     "go",
+		"worker-rust-2":   "rust",
+		"python_worker":   "python",
+		"Py.Worker":       "python",
+		"golang-svc":      "go",
+		"worker-3":        unknownRuntime,
+		"gopher":          unknownRuntime,
+		"node-worker-go1": unknownRuntime,
+	} {
+		if got := inferRuntime(name); got != want {
+			t.Errorf("inferRuntime(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestRuntimeOverride(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", "http://localhost:8081", "#FF0000", 1)
+	if s, _ := lb.WorkerStatus("worker-1"); s.Runtime != unknownRuntime {
+		t.Fatalf("runtime = %q, want %q", s.Runtime, unknownRuntime)
+	}
+
+	zig := "zig"
+	if s, _ := lb.PatchWorker("worker-1", api.WorkerUpdate{Runtime: &zig}); s.Runtime != "zig" {
+		t.Errorf("runtime after PATCH = %q, want zig", s.Runtime)
+	}
+	empty := ""
+	if s, _ := lb.PatchWorker("worker-1", api.WorkerUpdate{Runtime: &empty}); s.Runtime != unknownRuntime {
+		t.Errorf("runtime after reset = %q, want the inferred one", s.Runtime)
+	}
+	bad := "Node JS"
+	if err := validateWorkerUpdate(api.WorkerUpdate{Runtime: &bad}); err == nil {
+		t.Error("an invalid runtime should be rejected")
+	}
+
+	// Registration takes an explicit runtime over the name
+	status, ok := lb.registerWorker(api.AddWorkerRequest{Name: "go-worker-9", URL: "http://localhost:8089", Runtime: "tinygo"})
+	if !ok || status.Runtime != "tinygo" {
+		t.Errorf("registered runtime = %q, want tinygo", status.Runtime)
+	}
+}
+
+func TestRuntimeSummary(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("go-worker-1", "http://localhost:8081", "#FF0000", 1)
+	lb.AddWorker("go-worker-2", "http://localhost:8082", "#00FF00", 1)
+	lb.AddWorker("rust-worker-1", "http://localhost:8083", "#0000FF", 1)
+	lb.AddWorker("python-worker-1", "http://localhost:8084", "#FFFF00", 1)
+	lb.workers[3].Healthy = false
+
+	// go: 3 + 1 requests, one failed; rust: 2 slow ones; python: none
+	for _, ms := range []int{3, 3, 3} {
+		lb.workers[0].stats.observe(time.Duration(ms)*time.Millisecond, false)
+	}
+	lb.workers[1].stats.observe(3*time.Millisecond, true)
+	lb.workers[2].stats.observe(150*time.Millisecond, false)
+	lb.workers[2].stats.observe(150*time.Millisecond, false)
+
+	rec := httptest.NewRecorder()
+	handleRuntimeSummary(rec, httptest.NewRequest(http.MethodGet, "/summary/by-runtime", nil))
+	var got []RuntimeSummary
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status code = %d, err = %v", rec.Code, err)
+	}
+	if len(got) != 3 || got[0].Runtime != "go" || got[1].Runtime != "python" || got[2].Runtime != "rust" {
+		t.Fatalf("summary = %+v, want go, python, rust", got)
+	}
+
+	goSum := got[0]
+	if goSum.Workers != 2 || goSum.HealthyWorkers != 2 || goSum.Requests != 4 || goSum.Errors != 1 {
+		t.Errorf("go = %+v", goSum)
+	}
+	if goSum.SuccessRate == nil || *goSum.SuccessRate != 0.75 {
+		t.Errorf("go success rate = %v, want 0.75", goSum.SuccessRate)
+	}
+	// All four in the 2-5ms bucket: p50 interpolates to its middle
+	if goSum.P50LatencyMs == nil || math.Abs(*goSum.P50LatencyMs-3.5) > 1e-9 || *goSum.P99LatencyMs > 5 {
+		t.Errorf("go latency p50 = %v, p99 = %v", goSum.P50LatencyMs, goSum.P99LatencyMs)
+	}
+	if rust := got[2]; rust.Requests != 2 || *rust.SuccessRate != 1 || *rust.P50LatencyMs < 100 || *rust.P95LatencyMs > 200 {
+		t.Errorf("rust = %+v", rust)
+	}
+
+	// No traffic: counts, but no rates
+	py := got[1]
+	if py.Workers != 1 || py.HealthyWorkers != 0 || py.Requests != 0 || py.SuccessRate != nil || py.P50LatencyMs != nil {
+		t.Errorf("python = %+v, want one unhealthy worker and no rates", py)
+	}
+
+	if s, ok := lb.GetStatus()["runtimes"].([]RuntimeSummary); !ok || len(s) != 3 {
+		t.Errorf("status runtimes = %v", lb.GetStatus()["runtimes"])
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sandboxProbeTimeout bounds the whole /sandbox/health probe round
+const sandboxProbeTimeout = 2 * time.Second
+
+// staleCheckFactor is how many health intervals may pass without a check
+// before a worker's health data is reported as stale
+const staleCheckFactor = 3
+
+// Component status values used in the sandbox health report
+const (
+	componentOK       = "ok"
+	componentDegraded = "degraded"
+	componentFailed   = "failed"
+	componentSkipped  = "skipped"
+)
+
+// WorkerProbe is the informational result of probing one worker's /health
+type WorkerProbe struct {
+	Name           string `json:"name"`
+	URL            string `json:"url"`
+	Status         string `json:"status"`
+	HTTPStatus     int    `json:"httpStatus,omitempty"`
+	ReportedStatus string `json:"reportedStatus,omitempty"`
+	LatencyMs      int64  `json:"latencyMs"`
+	Error          string `json:"error,omitempty"`
+}
+
+// SandboxHealth is the roll-up returned by GET /sandbox/health
+type SandboxHealth struct {
+	Healthy    bool                   `json:"healthy"`
+	Status     string                 `json:"status"`
+	CheckedAt  time.Time              `json:"checkedAt"`
+	DurationMs int64                  `json:"durationMs"`
+	Components map[string]interface{} `json:"components"`
+}
+
+// probeWorkers concurrently probes every worker's /health endpoint. Results
+// are informational only and never change worker state.
+func (lb *LoadBalancer) probeWorkers(ctx context.Context) []WorkerProbe {
+	lb.mu.RLock()
+	targets := make([]WorkerProbe, len(lb.workers))
+	for i, w := range lb.workers {
+		targets[i] = WorkerProbe{Name: w.Name, URL: w.URL}
+	}
+	lb.mu.RUnlock()
+
+	client := lb.resources.timeoutClient(0)
+	var wg sync.WaitGroup
+	for i := range targets {
+		wg.Add(1)
+		go func(p *WorkerProbe) {
+			defer wg.Done()
+			start := time.Now()
+			defer func() { p.LatencyMs = time.Since(start).Milliseconds() }()
+
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL+"/health", nil)
+			if err != nil {
+				p.Status, p.Error = componentFailed, err.Error()
+				return
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				p.Status, p.Error = componentFailed, err.Error()
+				return
+			}
+			defer resp.Body.Close()
+			p.HTTPStatus = resp.StatusCode
+
+			var health HealthResponse
+			json.NewDecoder(resp.Body).Decode(&health)
+			p.ReportedStatus = health.Status
+
+			switch {
+			case resp.StatusCode != http.StatusOK || health.Status == "unhealthy":
+				p.Status = componentFailed
+			case health.Status == "degraded":
+				p.Status = componentDegraded
+			default:
+				p.Status = componentOK
+			}
+		}(&targets[i])
+	}
+	wg.Wait()
+	return targets
+}
+
+// activeFeatures lists the features currently overriding normal routing
+func (lb *LoadBalancer) activeFeatures() []string {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	features := make([]string, 0)
+	for _, w := range lb.workers {
+		if !w.Enabled {
+			features = append(features, "disabled:"+w.Name)
+		}
+	}
+	return features
+}
+
+// SandboxHealth probes all workers and combines the results with the LB's own
+// view of the pool into a single report.
+func (lb *LoadBalancer) SandboxHealth(ctx context.Context) SandboxHealth {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, sandboxProbeTimeout)
+	defer cancel()
+	probes := lb.probeWorkers(ctx)
+
+	lb.mu.RLock()
+	total := len(lb.workers)
+	healthy, openCircuits := 0, 0
+	for _, w := range lb.workers {
+		if w.Healthy && w.Enabled && !w.circuitOpen() {
+			healthy++
+		}
+		if w.circuitOpen() {
+			openCircuits++
+		}
+	}
+	interval, startedAt := lb.healthInterval, lb.healthStartedAt
+	lastChecked := make(map[string]time.Time, total)
+	for _, w := range lb.workers {
+		lastChecked[w.Name] = w.LastChecked
+	}
+	algorithm := lb.algorithm
+	lb.mu.RUnlock()
+
+	ready := total > 0 && !lb.shuttingDown.Load()
+	lbComponent := map[string]interface{}{
+		"status":       componentOK,
+		"ready":        ready,
+		"algorithm":    algorithm,
+		"shuttingDown": lb.shuttingDown.Load(),
+	}
+	if !ready {
+		lbComponent["status"] = componentFailed
+	}
+
+	poolComponent := map[string]interface{}{
+		"status":       componentOK,
+		"healthy":      healthy,
+		"total":        total,
+		"openCircuits": openCircuits,
+	}
+	switch {
+	case healthy == 0:
+		poolComponent["status"] = componentFailed
+	case healthy < total:
+		poolComponent["status"] = componentDegraded
+	}
+
+	registration := map[string]interface{}{"status": componentSkipped}
+	if !startedAt.IsZero() {
+		staleAfter := staleCheckFactor * interval
+		stale := make([]string, 0)
+		for name, checked := range lastChecked {
+			if checked.IsZero() && time.Since(startedAt) < staleAfter {
+				continue
+			}
+			if time.Since(checked) > staleAfter {
+				stale = append(stale, name)
+			}
+		}
+		registration = map[string]interface{}{
+			"status":       componentOK,
+			"staleAfterMs": staleAfter.Milliseconds(),
+			"stale":        stale,
+		}
+		if len(stale) > 0 {
+			registration["status"] = componentDegraded
+		}
+	}
+
+	features := lb.activeFeatures()
+	featureComponent := map[string]interface{}{"status": componentOK, "active": features}
+	if len(features) > 0 {
+		featureComponent["status"] = componentDegraded
+	}
+
+	reachable, probesOK := 0, true
+	for _, p := range probes {
+		if p.Status != componentFailed {
+			reachable++
+		}
+		if p.Status != componentOK {
+			probesOK = false
+		}
+	}
+
+	report := SandboxHealth{
+		CheckedAt: start.UTC(),
+		Components: map[string]interface{}{
+			"loadBalancer": lbComponent,
+			"pool":         poolComponent,
+			"workers":      probes,
+			"registration": registration,
+			"features":     featureComponent,
+		},
+	}
+	switch {
+	case !ready || healthy == 0 || reachable == 0:
+		report.Status = componentFailed
+	case probesOK && poolComponent["status"] == componentOK &&
+		registration["status"] != componentDegraded && len(features) == 0:
+		report.Status = componentOK
+		report.Healthy = true
+	default:
+		report.Status = componentDegraded
+	}
+	report.DurationMs = time.Since(start).Milliseconds()
+	return report
+}
+
+// sandboxHealthCode maps an aggregate status to the HTTP status code
+func sandboxHealthCode(status string) int {
+	switch status {
+	case componentOK:
+		return http.StatusOK
+	case componentDegraded:
+		return http.StatusMultiStatus
+	default:
+		return http.StatusServiceUnavailable
+	}
+}
+
+// handleSandboxHealth はサンドボックス全体のヘルスを集約して返す HTTP ハンドラです。
+// 全ワーカーの /health を並行してプローブし、LB の準備状態・プール概要・ヘルスチェックの鮮度・有効な機能を合わせて評価します。
+// すべて正常なら 200、一部異常なら 207、利用不可なら 503 を返し、?verbose=false の場合は {"healthy": bool} のみを返します。
+func handleSandboxHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report := lb.SandboxHealth(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(sandboxHealthCode(report.Status))
+	if r.URL.Query().Get("verbose") == "false" {
+		json.NewEncoder(w).Encode(map[string]bool{"healthy": report.Healthy})
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newHealthStub starts a worker stub whose /health answers with the given
+// HTTP status and reported health status.
+func newHealthStub(t *testing.T, code int, status string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(HealthResponse{Status: status})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestSandboxHealthAggregate(t *testing.T) {
+	tests := []struct {
+		name     string
+		stubs    []int
+		statuses []string
+		wantCode int
+	}{
+		{"all healthy", []int{200, 200}, []string{"healthy", "healthy"}, http.StatusOK},
+		{"one degraded", []int{200, 200}, []string{"healthy", "degraded"}, http.StatusMultiStatus},
+		{"one failing", []int{200, 500}, []string{"healthy", "unhealthy"}, http.StatusMultiStatus},
+		{"all failing", []int{500, 503}, []string{"unhealthy", "unhealthy"}, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb = NewLoadBalancer("round-robin")
+			for i, code := range tt.stubs {
+				srv := newHealthStub(t, code, tt.statuses[i])
+				lb.AddWorker("worker-"+string(rune('1'+i)), srv.URL, "#FF0000", 1)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/sandbox/health", nil)
+			rec := httptest.NewRecorder()
+			handleSandboxHealth(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status code = %d, want %d", rec.Code, tt.wantCode)
+			}
+
+			var report struct {
+				Healthy    bool `json:"healthy"`
+				Components struct {
+					Workers []WorkerProbe `json:"workers"`
+					Pool    struct {
+						Total int `json:"total"`
+					} `json:"pool"`
+				} `json:"components"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if report.Healthy != (tt.wantCode == http.StatusOK) {
+				t.Errorf("healthy = %v for code %d", report.Healthy, tt.wantCode)
+			}
+			if report.Components.Pool.Total != len(tt.stubs) {
+				t.Errorf("pool total = %d, want %d", report.Components.Pool.Total, len(tt.stubs))
+			}
+			if len(report.Components.Workers) != len(tt.stubs) {
+				t.Fatalf("expected %d worker probes, got %d", len(tt.stubs), len(report.Components.Workers))
+			}
+			for i, p := range report.Components.Workers {
+				if p.HTTPStatus != tt.stubs[i] {
+					t.Errorf("%s httpStatus = %d, want %d", p.Name, p.HTTPStatus, tt.stubs[i])
+				}
+				if p.ReportedStatus != tt.statuses[i] {
+					t.Errorf("%s reportedStatus = %q, want %q", p.Name, p.ReportedStatus, tt.statuses[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSandboxHealthDoesNotChangeWorkerState(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	srv := newHealthStub(t, http.StatusInternalServerError, "unhealthy")
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+
+	for i := 0; i < 5; i++ {
+		lb.SandboxHealth(httptest.NewRequest(http.MethodGet, "/", nil).Context())
+	}
+
+	w := lb.workers[0]
+	if !w.Healthy || w.circuitOpen() || w.ConsecFailures != 0 {
+		t.Errorf("probe changed worker state: healthy=%v circuitOpen=%v consecFailures=%d",
+			w.Healthy, w.circuitOpen(), w.ConsecFailures)
+	}
+}
+
+func TestSandboxHealthUnreachableAndDisabledWorkers(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	t.Cleanup(lb.stopControl)
+	srv := newHealthStub(t, http.StatusOK, "healthy")
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+	lb.AddWorker("worker-2", "http://127.0.0.1:1", "#00FF00", 1)
+	disabled := false
+	lb.UpdateWorker("worker-2", &disabled, nil)
+
+	report := lb.SandboxHealth(httptest.NewRequest(http.MethodGet, "/", nil).Context())
+	if report.Status != componentDegraded {
+		t.Fatalf("status = %s, want %s", report.Status, componentDegraded)
+	}
+	features := report.Components["features"].(map[string]interface{})
+	active := features["active"].([]string)
+	if len(active) != 1 || active[0] != "disabled:worker-2" {
+		t.Errorf("active features = %v, want [disabled:worker-2]", active)
+	}
+	probes := report.Components["workers"].([]WorkerProbe)
+	if probes[1].Status != componentFailed || probes[1].Error == "" {
+		t.Errorf("unreachable worker probe = %+v, want failed with error", probes[1])
+	}
+}
+
+func TestSandboxHealthStaleRegistration(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	srv := newHealthStub(t, http.StatusOK, "healthy")
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+	lb.healthInterval = 10 * time.Millisecond
+	lb.healthStartedAt = time.Now().Add(-time.Second)
+	lb.workers[0].LastChecked = time.Now().Add(-time.Second)
+
+	report := lb.SandboxHealth(httptest.NewRequest(http.MethodGet, "/", nil).Context())
+	registration := report.Components["registration"].(map[string]interface{})
+	if registration["status"] != componentDegraded {
+		t.Errorf("registration status = %v, want %s", registration["status"], componentDegraded)
+	}
+	if sandboxHealthCode(report.Status) != http.StatusMultiStatus {
+		t.Errorf("code = %d, want %d", sandboxHealthCode(report.Status), http.StatusMultiStatus)
+	}
+}
+
+func TestSandboxHealthNonVerbose(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	srv := newHealthStub(t, http.StatusOK, "healthy")
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+
+	req := httptest.NewRequest(http.MethodGet, "/sandbox/health?verbose=false", nil)
+	rec := httptest.NewRecorder()
+	handleSandboxHealth(rec, req)
+
+	var body map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(body) != 1 || body["healthy"] != true {
+		t.Errorf("body = %v, want {healthy: true}", body)
+	}
+}
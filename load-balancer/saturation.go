@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// Per-worker load limits. A worker with MaxLoad tasks in flight is saturated
+// and skipped by every algorithm until one of them finishes. When the only
+// workers that could take a task are saturated the LB answers 429 with a
+// Retry-After rather than 503: the pool is busy, not broken.
+
+// saturated reports whether w has MaxLoad tasks in flight. A MaxLoad of 0
+// is no limit.
+func (w *Worker) saturated() bool {
+	return w.MaxLoad > 0 && atomic.LoadInt32(&w.CurrentLoad) >= int32(w.MaxLoad)
+}
+
+// withoutSaturated splits the candidates into those with room for a task
+// and the saturated ones
+func withoutSaturated(available []*Worker) (free, saturated []*Worker) {
+	free = available[:0]
+	for _, w := range available {
+		if w.saturated() {
+			saturated = append(saturated, w)
+		} else {
+			free = append(free, w)
+		}
+	}
+	return free, saturated
+}
+
+// saturated reports whether some worker could have taken the task but for
+// its load. Saturation is checked last, so such a worker passed every other
+// check.
+func (e *noEligibleWorkers) saturated() bool {
+	for _, reason := range e.excluded {
+		if reason == excludedSaturated {
+			return true
+		}
+	}
+	return false
+}
+
+// saturatedRetryAfter returns the Retry-After, in seconds, for a task the
+// saturated workers of e turned away: the expected latency of the quickest
+// of them, at least a second
+func (lb *LoadBalancer) saturatedRetryAfter(e *noEligibleWorkers) string {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	quickest := math.Inf(1)
+	for _, w := range lb.workers {
+		if e.excluded[w.Name] != excludedSaturated {
+			continue
+		}
+		if _, expected, ok := w.latency.snapshot(); ok && expected < quickest {
+			quickest = expected
+		}
+	}
+	seconds := 1
+	if !math.IsInf(quickest, 1) && quickest > 1000 {
+		seconds = int(math.Ceil(quickest / 1000))
+	}
+	return strconv.Itoa(seconds)
+}
+
+// writeSaturated answers a task no worker had room for
+func (lb *LoadBalancer) writeSaturated(w http.ResponseWriter, e *noEligibleWorkers) {
+	lb.metrics.requestsTotal.WithLabelValues("none", "saturated").Inc()
+	w.Header().Set("Retry-After", lb.saturatedRetryAfter(e))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(api.ErrorResponse{Error: "All workers are at their maximum load", Excluded: e.excluded})
+}
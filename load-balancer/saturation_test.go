@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/network-sandbox/load-balancer/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMaxLoadEnforced(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	release := make(chan struct{})
+	lb.AddWorker("worker-1", newBlockingWorker(t, "worker-1", release).URL, "#FF0000", 1)
+	lb.AddWorker("worker-2", newBlockingWorker(t, "worker-2", closedChan()).URL, "#00FF00", 1)
+	lb.SetWorkerMaxLoad("worker-1", 1)
+	lb.SetWorkerMaxLoad("worker-2", 1)
+
+	// worker-1 holds one task, so the next ones go to worker-2
+	done := startBlockedTask(t, lb.workers[0])
+	for i := 0; i < 3; i++ {
+		if rec := doTask(nil); rec.Code != http.StatusOK || servedBy(t, rec) != "worker-2" {
+			t.Fatalf("task %d: status %d, want worker-2 while worker-1 is saturated", i, rec.Code)
+		}
+	}
+	workers := lb.GetStatus()["workers"].([]map[string]interface{})
+	if workers[0]["saturated"] != true || workers[1]["saturated"] != false {
+		t.Errorf("saturated = %v, %v, want true, false", workers[0]["saturated"], workers[1]["saturated"])
+	}
+
+	// With worker-2 saturated as well, tasks get 429 rather than 503
+	saturated := lb.metrics.requestsTotal.WithLabelValues("none", "saturated")
+	atomic.StoreInt32(&lb.workers[1].CurrentLoad, 1)
+	rec := doTask(nil)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("all saturated: status %d, Retry-After %q, want 429 with Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	var body api.ErrorResponse
+	json.NewDecoder(rec.Body).Decode(&body)
+	if body.Excluded["worker-1"] != excludedSaturated || body.Excluded["worker-2"] != excludedSaturated {
+		t.Errorf("excluded = %v, want both saturated", body.Excluded)
+	}
+	if got := testutil.ToFloat64(saturated); got != 1 {
+		t.Errorf("saturated requests = %v, want 1", got)
+	}
+
+	// Requiring a saturated worker is a 429 too
+	if rec := doTask(map[string]string{requireWorkerHeader: "worker-1"}); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("required saturated worker: status %d, want 429", rec.Code)
+	}
+
+	// A pool that is down, not busy, is still a 503
+	atomic.StoreInt32(&lb.workers[1].CurrentLoad, 0)
+	lb.mu.Lock()
+	lb.workers[0].Healthy, lb.workers[1].Healthy = false, false
+	lb.mu.Unlock()
+	if rec := doTask(nil); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("unhealthy pool: status %d, want 503", rec.Code)
+	}
+	close(release)
+	<-done
+}
+
+func TestLRUWorkerHandsOverFromSaturatedWorker(t *testing.T) {
+	lb := newLRUTestBalancer(LRUWorkerConfig{LoadThreshold: 1, WindowMs: 60000, SwitchOn: lruSwitchTime, Order: lruOrderPool})
+	if w := lb.SelectWorker(); w.Name != "worker-1" {
+		t.Fatalf("first selection = %s, want worker-1", w.Name)
+	}
+	// Only the load limit stops worker-1, so the next in order takes over
+	atomic.StoreInt32(&lb.workers[0].CurrentLoad, int32(lb.workers[0].MaxLoad))
+	if w := lb.SelectWorker(); w.Name != "worker-2" {
+		t.Errorf("selection with worker-1 saturated = %s, want worker-2", w.Name)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// scheduleTickInterval is how often the scheduler re-evaluates the windows
+const scheduleTickInterval = time.Second
+
+// Schedule actions
+const (
+	scheduleDisable = "disable"
+	scheduleDegrade = "degrade"
+	scheduleFail    = "fail"
+)
+
+// degradeWeightDivisor is how much a degrade window divides the weight by
+const degradeWeightDivisor = 4
+
+// ScheduleWindow is one repeating availability window
+type ScheduleWindow = api.ScheduleWindow
+
+// WorkerSchedule is a worker's schedule and its current state
+type WorkerSchedule = api.WorkerSchedule
+
+// workerSchedule is the scheduler state kept on a Worker. saved holds the
+// values to restore when a window ends.
+type workerSchedule struct {
+	windows     []ScheduleWindow
+	active      map[string]bool
+	savedEnable bool
+	savedWeight int
+}
+
+// validateSchedule checks every window and returns the first violation
+func validateSchedule(windows []ScheduleWindow) error {
+	for i, sw := range windows {
+		field := func(name string) string { return fmt.Sprintf("windows[%d].%s", i, name) }
+		switch {
+		case sw.PeriodMs < scheduleTickInterval.Milliseconds():
+			return &MetadataError{field("periodMs"), fmt.Sprintf("must be at least %d", scheduleTickInterval.Milliseconds())}
+		case sw.DurationMs <= 0 || sw.DurationMs >= sw.PeriodMs:
+			return &MetadataError{field("durationMs"), "must be positive and shorter than periodMs"}
+		case sw.OffsetMs < 0 || sw.OffsetMs >= sw.PeriodMs:
+			return &MetadataError{field("offsetMs"), "must be in [0, periodMs)"}
+		case sw.Action != scheduleDisable && sw.Action != scheduleDegrade && sw.Action != scheduleFail:
+			return &MetadataError{field("action"), "must be disable, degrade or fail"}
+		}
+	}
+	return nil
+}
+
+// windowPhase returns how far into its period sw is at t. Periods are
+// aligned to the Unix epoch so schedules line up with wall-clock boundaries.
+func windowPhase(sw ScheduleWindow, t time.Time) time.Duration {
+	period := time.Duration(sw.PeriodMs) * time.Millisecond
+	phase := (time.Duration(t.UnixNano()) - time.Duration(sw.OffsetMs)*time.Millisecond) % period
+	if phase < 0 {
+		phase += period
+	}
+	return phase
+}
+
+// windowActive reports whether sw is inside its window at t
+func windowActive(sw ScheduleWindow, t time.Time) bool {
+	return windowPhase(sw, t) < time.Duration(sw.DurationMs)*time.Millisecond
+}
+
+// nextTransition returns the earliest time after t at which any window
+// starts or ends
+func nextTransition(windows []ScheduleWindow, t time.Time) *time.Time {
+	var next *time.Time
+	for _, sw := range windows {
+		phase := windowPhase(sw, t)
+		duration := time.Duration(sw.DurationMs) * time.Millisecond
+		wait := time.Duration(sw.PeriodMs)*time.Millisecond - phase
+		if phase < duration {
+			wait = duration - phase
+		}
+		at := t.Add(wait).UTC()
+		if next == nil || at.Before(*next) {
+			next = &at
+		}
+	}
+	return next
+}
+
+// scheduleTransition is one action starting or ending on a worker
+type scheduleTransition struct {
+	worker string
+	action string
+	start  bool
+}
+
+// applyActionLocked starts or ends action on w through the same paths as
+// manual updates. Must be called with lb.mu held.
+func (lb *LoadBalancer) applyActionLocked(w *Worker, action string, start bool) {
+	s := w.schedule
+	switch action {
+	case scheduleDisable:
+		enabled := s.savedEnable
+		if start {
+			s.savedEnable = w.Enabled
+			enabled = false
+		}
+		lb.updateWorkerLocked(w, &enabled, nil)
+	case scheduleDegrade:
+		weight := s.savedWeight
+		if start {
+			s.savedWeight = w.Weight
+			weight = w.Weight / degradeWeightDivisor
+			if weight < 1 {
+				weight = 1
+			}
+		}
+		lb.updateWorkerLocked(w, nil, &weight)
+	case scheduleFail:
+		w.scheduledFail = start
+	}
+	if start {
+		s.active[action] = true
+	} else {
+		delete(s.active, action)
+	}
+	w.revision++
+}
+
+// applySchedules starts and ends scheduled actions for the time now and
+// emits an event for each transition
+func (lb *LoadBalancer) applySchedules(now time.Time) {
+	var transitions []scheduleTransition
+	lb.mu.Lock()
+	for _, w := range lb.workers {
+		if w.schedule == nil {
+			continue
+		}
+		want := make(map[string]bool)
+		for _, sw := range w.schedule.windows {
+			if windowActive(sw, now) {
+				want[sw.Action] = true
+			}
+		}
+		for _, action := range []string{scheduleDisable, scheduleDegrade, scheduleFail} {
+			if want[action] != w.schedule.active[action] {
+				lb.applyActionLocked(w, action, want[action])
+				transitions = append(transitions, scheduleTransition{w.Name, action, want[action]})
+			}
+		}
+	}
+	lb.mu.Unlock()
+
+	lb.emitScheduleEvents(transitions, now)
+}
+
+func (lb *LoadBalancer) emitScheduleEvents(transitions []scheduleTransition, now time.Time) {
+	for _, t := range transitions {
+		phase := "ended"
+		if t.start {
+			phase = "started"
+		}
+		data := map[string]interface{}{"worker": t.worker, "action": t.action, "phase": phase}
+		if s, ok := lb.WorkerSchedule(t.worker); ok && s.NextTransition != nil {
+			data["nextTransition"] = s.NextTransition
+		}
+		lb.emitEvent("schedule", fmt.Sprintf("Worker %s scheduled %s %s", t.worker, t.action, phase), data)
+	}
+}
+
+// SetWorkerSchedule replaces the schedule of the named worker, ending any
+// active scheduled actions first. An empty list cancels the schedule. The
+// windows must already be validated.
+func (lb *LoadBalancer) SetWorkerSchedule(name string, windows []ScheduleWindow) bool {
+	now := lb.clock.Now()
+	var transitions []scheduleTransition
+	lb.mu.Lock()
+	var worker *Worker
+	for _, w := range lb.workers {
+		if w.Name == name {
+			worker = w
+		}
+	}
+	if worker == nil {
+		lb.mu.Unlock()
+		return false
+	}
+	if worker.schedule != nil {
+		active := make([]string, 0, len(worker.schedule.active))
+		for action := range worker.schedule.active {
+			active = append(active, action)
+		}
+		sort.Strings(active)
+		for _, action := range active {
+			lb.applyActionLocked(worker, action, false)
+			transitions = append(transitions, scheduleTransition{name, action, false})
+		}
+		worker.schedule = nil
+	}
+	if len(windows) > 0 {
+		worker.schedule = &workerSchedule{windows: windows, active: make(map[string]bool)}
+	}
+	lb.mu.Unlock()
+
+	lb.emitScheduleEvents(transitions, now)
+	lb.applySchedules(now)
+	return true
+}
+
+// WorkerSchedule returns the schedule of the named worker
+func (lb *LoadBalancer) WorkerSchedule(name string) (WorkerSchedule, bool) {
+	now := lb.clock.Now()
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	for _, w := range lb.workers {
+		if w.Name == name {
+			return w.scheduleStatusLocked(now), true
+		}
+	}
+	return WorkerSchedule{}, false
+}
+
+// scheduleStatusLocked returns the worker's schedule as reported in status.
+// Must be called with lb.mu held.
+func (w *Worker) scheduleStatusLocked(now time.Time) WorkerSchedule {
+	s := WorkerSchedule{Windows: []ScheduleWindow{}, Active: []string{}}
+	if w.schedule == nil {
+		return s
+	}
+	s.Windows = append(s.Windows, w.schedule.windows...)
+	for action := range w.schedule.active {
+		s.Active = append(s.Active, action)
+	}
+	sort.Strings(s.Active)
+	s.NextTransition = nextTransition(w.schedule.windows, now)
+	return s
+}
+
+// StartScheduler applies worker schedules every scheduleTickInterval
+func (lb *LoadBalancer) StartScheduler(ctx context.Context) {
+	for {
+		timer := lb.clock.NewTimer(scheduleTickInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+			lb.applySchedules(lb.clock.Now())
+		}
+	}
+}
+
+// handleWorkerSchedule はワーカーの稼働スケジュールを取得・設定・解除する HTTP ハンドラです。
+// PUT では {"windows": [{"periodMs", "offsetMs", "durationMs", "action": "disable|degrade|fail"}]} を受け取り、
+// 周期は Unix エポック基準で揃えられます。DELETE でスケジュールを解除し、実行中のアクションは即座に元に戻します。
+func handleWorkerSchedule(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			Windows []ScheduleWindow `json:"windows"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := validateSchedule(req.Windows); err != nil {
+			writeMetadataError(w, err.(*MetadataError))
+			return
+		}
+		if !lb.SetWorkerSchedule(name, req.Windows) {
+			http.Error(w, "Worker not found", http.StatusNotFound)
+			return
+		}
+		defer lb.BroadcastStatus()
+	case http.MethodDelete:
+		if !lb.SetWorkerSchedule(name, nil) {
+			http.Error(w, "Worker not found", http.StatusNotFound)
+			return
+		}
+		defer lb.BroadcastStatus()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s, ok := lb.WorkerSchedule(name)
+	if !ok {
+		http.Error(w, "Worker not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
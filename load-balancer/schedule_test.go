@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func scheduleEvents() []Event {
+	var out []Event
+	for _, e := range lb.events.since(0, 1000) {
+		if e.Type == "schedule" {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func putSchedule(name, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/api/workers/"+name+"/schedule", bytes.NewBufferString(body)))
+	return rec
+}
+
+func TestSchedulePeriodicToggling(t *testing.T) {
+	clk := newFakeClock()
+	lb = NewLoadBalancer("round-robin")
+	t.Cleanup(lb.stopControl)
+	lb.clock = clk
+	lb.AddWorker("worker-1", "http://localhost:8081", "#FF0000", 8)
+	lb.AddWorker("worker-2", "http://localhost:8082", "#00FF00", 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lb.StartScheduler(ctx)
+	clk.waitForTimer(t)
+
+	// Disabled for the first 3s and degraded for 5s starting at 2s of every 10s
+	rec := putSchedule("worker-1", `{"windows":[
+		{"periodMs":10000,"offsetMs":0,"durationMs":3000,"action":"disable"},
+		{"periodMs":10000,"offsetMs":2000,"durationMs":5000,"action":"degrade"}]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT schedule: %d %s", rec.Code, rec.Body.String())
+	}
+	var s WorkerSchedule
+	json.NewDecoder(rec.Body).Decode(&s)
+	if len(s.Windows) != 2 || len(s.Active) != 1 || s.Active[0] != scheduleDisable {
+		t.Fatalf("schedule = %+v, want disable active", s)
+	}
+	if want := clk.Now().Add(2 * time.Second); s.NextTransition == nil || !s.NextTransition.Equal(want) {
+		t.Errorf("next transition = %v, want %v", s.NextTransition, want)
+	}
+
+	type state struct {
+		enabled bool
+		weight  int
+	}
+	current := func() state {
+		lb.mu.RLock()
+		defer lb.mu.RUnlock()
+		return state{lb.workers[0].Enabled, lb.workers[0].Weight}
+	}
+	want := map[int]state{
+		0: {false, 8}, 1: {false, 8}, 2: {false, 2}, 3: {true, 2}, 6: {true, 2},
+		7: {true, 8}, 9: {true, 8}, 10: {false, 8}, 12: {false, 2}, 13: {true, 2}, 17: {true, 8},
+	}
+	for sec := 0; sec <= 17; sec++ {
+		if sec > 0 {
+			clk.Advance(time.Second)
+			clk.waitForTimer(t)
+		}
+		if w, ok := want[sec]; ok {
+			if got := current(); got != w {
+				t.Errorf("t=%ds: state = %+v, want %+v", sec, got, w)
+			}
+		}
+	}
+
+	events := scheduleEvents()
+	var phases []string
+	for _, e := range events {
+		phases = append(phases, e.Data["action"].(string)+" "+e.Data["phase"].(string))
+	}
+	wantPhases := []string{
+		"disable started", "degrade started", "disable ended", "degrade ended",
+		"disable started", "degrade started", "disable ended", "degrade ended",
+	}
+	if len(phases) != len(wantPhases) {
+		t.Fatalf("events = %v, want %v", phases, wantPhases)
+	}
+	for i := range wantPhases {
+		if phases[i] != wantPhases[i] {
+			t.Errorf("event %d = %q, want %q", i, phases[i], wantPhases[i])
+		}
+	}
+	if events[0].Data["worker"] != "worker-1" || events[0].Data["nextTransition"] == nil {
+		t.Errorf("event data = %v, want worker and nextTransition", events[0].Data)
+	}
+
+	// Only worker-2 is eligible while worker-1 is disabled
+	clk.Advance(3 * time.Second)
+	clk.waitForTimer(t)
+	lb.mu.RLock()
+	eligible := len(lb.eligibleWorkersLocked())
+	lb.mu.RUnlock()
+	if eligible != 1 {
+		t.Errorf("eligible workers at t=20s = %d, want 1", eligible)
+	}
+}
+
+func TestScheduleCancelRestores(t *testing.T) {
+	clk := newFakeClock()
+	lb = NewLoadBalancer("round-robin")
+	t.Cleanup(lb.stopControl)
+	lb.clock = clk
+	lb.AddWorker("worker-1", "http://localhost:8081", "#FF0000", 4)
+
+	if rec := putSchedule("worker-1", `{"windows":[
+		{"periodMs":60000,"offsetMs":0,"durationMs":30000,"action":"disable"},
+		{"periodMs":60000,"offsetMs":0,"durationMs":30000,"action":"degrade"}]}`); rec.Code != http.StatusOK {
+		t.Fatalf("PUT schedule: %d %s", rec.Code, rec.Body.String())
+	}
+	if w := lb.workers[0]; w.Enabled || w.Weight != 1 {
+		t.Fatalf("enabled=%v weight=%d, want disabled and degraded", w.Enabled, w.Weight)
+	}
+	if s := lb.GetStatus()["workers"].([]map[string]interface{})[0]["schedule"]; s == nil {
+		t.Error("status should include the schedule")
+	}
+
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/workers/worker-1/schedule", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("DELETE schedule: %d", rec.Code)
+	}
+	if w := lb.workers[0]; !w.Enabled || w.Weight != 4 {
+		t.Errorf("enabled=%v weight=%d after cancel, want restored", w.Enabled, w.Weight)
+	}
+	if s := lb.GetStatus()["workers"].([]map[string]interface{})[0]["schedule"]; s != nil {
+		t.Errorf("status schedule = %v after cancel, want none", s)
+	}
+	if n := len(scheduleEvents()); n != 4 {
+		t.Errorf("schedule events = %d, want 4", n)
+	}
+}
+
+func TestScheduleFailAction(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+	lb = NewLoadBalancer("round-robin")
+	lb.clock = newFakeClock()
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+
+	putSchedule("worker-1", `{"windows":[{"periodMs":60000,"offsetMs":0,"durationMs":30000,"action":"fail"}]}`)
+	if rec := doTask(nil); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status code during fail window = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	lb.clock.(*fakeClock).Advance(30 * time.Second)
+	lb.applySchedules(lb.clock.Now())
+	if rec := doTask(nil); rec.Code != http.StatusOK {
+		t.Errorf("status code after fail window = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestScheduleValidation(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", "http://localhost:8081", "#FF0000", 1)
+
+	for body, field := range map[string]string{
+		`{"windows":[{"periodMs":10,"durationMs":5,"action":"disable"}]}`:                  "windows[0].periodMs",
+		`{"windows":[{"periodMs":10000,"durationMs":10000,"action":"disable"}]}`:           "windows[0].durationMs",
+		`{"windows":[{"periodMs":10000,"offsetMs":-1,"durationMs":5,"action":"disable"}]}`: "windows[0].offsetMs",
+		`{"windows":[{"periodMs":10000,"durationMs":5,"action":"reboot"}]}`:                "windows[0].action",
+	} {
+		rec := putSchedule("worker-1", body)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status code = %d, want %d", body, rec.Code, http.StatusBadRequest)
+			continue
+		}
+		var resp struct{ Field string }
+		json.NewDecoder(rec.Body).Decode(&resp)
+		if resp.Field != field {
+			t.Errorf("%s: field = %q, want %q", body, resp.Field, field)
+		}
+	}
+	if rec := putSchedule("missing", `{"windows":[]}`); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown worker: status code = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// version is the LB build version, set at build time with
+// -ldflags "-X main.version=..."
+var version = "dev"
+
+// selfSampleInterval is the minimum age of a cached self-metrics sample
+// before it is refreshed
+const selfSampleInterval = time.Second
+
+// SelfMetrics describes the LB process itself
+type SelfMetrics = api.SelfMetrics
+
+// selfSampler caches the last self-metrics sample
+type selfSampler struct {
+	mu          sync.Mutex
+	last        SelfMetrics
+	sampled     bool
+	pauseTotal  uint64
+	pauseSample time.Time
+}
+
+// newInstanceID returns LB_INSTANCE_ID, or the hostname plus a random suffix
+func newInstanceID() string {
+	if id := os.Getenv("LB_INSTANCE_ID"); id != "" {
+		return id
+	}
+	b := make([]byte, 3)
+	rand.Read(b)
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "lb"
+	}
+	return host + "-" + hex.EncodeToString(b)
+}
+
+// InFlight returns the number of requests currently being proxied
+func (lb *LoadBalancer) InFlight() int64 {
+	return atomic.LoadInt64(&lb.inFlight)
+}
+
+// SelfMetrics returns a sample of the LB's own resource usage. Samples are
+// taken at most once per selfSampleInterval; calls in between return the
+// cached sample.
+func (lb *LoadBalancer) SelfMetrics() SelfMetrics {
+	s := &lb.self
+	now := lb.clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sampled && now.Sub(s.last.SampledAt) < selfSampleInterval {
+		return s.last
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	// Fraction of wall time spent in GC pauses since the previous sample
+	wall := time.Now()
+	var pauseRate float64
+	if elapsed := wall.Sub(s.pauseSample); s.sampled && elapsed > 0 {
+		pauseRate = float64(mem.PauseTotalNs-s.pauseTotal) / float64(elapsed)
+	}
+	s.pauseTotal, s.pauseSample = mem.PauseTotalNs, wall
+
+	s.last = SelfMetrics{
+		InstanceID:       lb.instanceID,
+		Version:          version,
+		UptimeSeconds:    time.Since(lb.startedAt).Seconds(),
+		Goroutines:       runtime.NumGoroutine(),
+		HeapAllocBytes:   mem.HeapAlloc,
+		HeapInuseBytes:   mem.HeapInuse,
+		GCPauseRate:      pauseRate,
+		InFlightRequests: lb.InFlight(),
+		WSClients:        int(atomic.LoadInt32(&lb.wsClientCount)),
+		BroadcastQueue:   int(atomic.LoadInt32(&lb.broadcastPending)),
+		SampledAt:        now.UTC(),
+	}
+	s.sampled = true
+	return s.last
+}
+
+// parseStatusExclude parses ?exclude=lb,lruWorker into the set of top-level
+// status fields to omit
+func parseStatusExclude(raw string) []string {
+	var out []string
+	for _, f := range strings.Split(raw, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// filterStatus returns status without the excluded top-level fields. The
+// input map is not modified.
+func filterStatus(status map[string]interface{}, exclude []string) map[string]interface{} {
+	if len(exclude) == 0 {
+		return status
+	}
+	out := make(map[string]interface{}, len(status))
+	for k, v := range status {
+		out[k] = v
+	}
+	for _, f := range exclude {
+		delete(out, f)
+	}
+	return out
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSelfMetricsInStatus(t *testing.T) {
+	clk := newFakeClock()
+	lb = NewLoadBalancer("round-robin")
+	lb.clock = clk
+	lb.AddWorker("worker-1", "http://localhost:8081", "#FF0000", 1)
+
+	status := lb.GetStatus()
+	self, ok := status["lb"].(*SelfMetrics)
+	if !ok {
+		t.Fatalf("status lb = %T, want *SelfMetrics", status["lb"])
+	}
+	if self.InstanceID == "" || self.Version == "" {
+		t.Errorf("instance/version = %q/%q", self.InstanceID, self.Version)
+	}
+	if self.Goroutines <= 0 || self.HeapAllocBytes == 0 || self.HeapInuseBytes == 0 {
+		t.Errorf("implausible runtime figures: %+v", self)
+	}
+	if self.UptimeSeconds < 0 || self.GCPauseRate < 0 || self.InFlightRequests < 0 || self.WSClients < 0 || self.BroadcastQueue < 0 {
+		t.Errorf("negative figures: %+v", self)
+	}
+
+	// Rapid calls reuse the cached sample
+	for i := 0; i < 5; i++ {
+		again := lb.GetStatus()["lb"].(*SelfMetrics)
+		if !again.SampledAt.Equal(self.SampledAt) || again.Goroutines != self.Goroutines {
+			t.Fatalf("call %d resampled: %v vs %v", i, again.SampledAt, self.SampledAt)
+		}
+	}
+	clk.Advance(time.Second)
+	if next := lb.GetStatus()["lb"].(*SelfMetrics); !next.SampledAt.After(self.SampledAt) {
+		t.Errorf("sample not refreshed after %v", selfSampleInterval)
+	}
+}
+
+func TestStatusExcludeFields(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+
+	decode := func(query string) map[string]json.RawMessage {
+		rec := httptest.NewRecorder()
+		handleStatus(rec, httptest.NewRequest(http.MethodGet, "/status"+query, nil))
+		var body map[string]json.RawMessage
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return body
+	}
+
+	if _, ok := decode("")["lb"]; !ok {
+		t.Error("lb section missing by default")
+	}
+	body := decode("?exclude=lb,settings")
+	if _, ok := body["lb"]; ok {
+		t.Error("lb section present despite exclude")
+	}
+	if _, ok := body["settings"]; ok {
+		t.Error("settings present despite exclude")
+	}
+	if _, ok := body["workers"]; !ok {
+		t.Error("workers missing")
+	}
+}
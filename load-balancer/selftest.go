@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// selfTestDraws is the number of selections made by the sampling checks
+const selfTestDraws = 10000
+
+// selfTestTolerance is how far a worker's observed share of the draws may
+// stray from its expected share
+const selfTestTolerance = 0.03
+
+// selfTestTimeout bounds a single selection in the termination check
+const selfTestTimeout = time.Second
+
+// maxCounterexamples caps the counterexamples reported per check
+const maxCounterexamples = 5
+
+// weightAwareAlgorithms are the algorithms that must never pick a weight-zero
+// worker while a worker with positive weight is eligible
+var weightAwareAlgorithms = map[string]bool{"weighted": true, "smooth-weighted": true}
+
+// SelfTestCheck is the outcome of one invariant check on one pool shape
+type SelfTestCheck struct {
+	Check           string   `json:"check"`
+	Pool            string   `json:"pool"`
+	Passed          bool     `json:"passed"`
+	Counterexamples []string `json:"counterexamples,omitempty"`
+}
+
+// AlgorithmSelfTest is the outcome of every check for one algorithm
+type AlgorithmSelfTest struct {
+	Algorithm string          `json:"algorithm"`
+	Passed    bool            `json:"passed"`
+	Checks    []SelfTestCheck `json:"checks"`
+}
+
+// SelfTestReport is the result of running the self-test against the pool
+type SelfTestReport struct {
+	Passed     bool                `json:"passed"`
+	Pool       []string            `json:"pool"`
+	Algorithms []AlgorithmSelfTest `json:"algorithms"`
+}
+
+// selector draws one worker; nil means nothing was eligible
+type selector func() *Worker
+
+// selfTestPool is a named pool shape the checks are run against
+type selfTestPool struct {
+	name    string
+	workers []*Worker
+}
+
+func isEligible(w *Worker) bool {
+	return w.Healthy && w.Enabled && !w.Draining && !w.circuitOpen()
+}
+
+func describeWorker(w *Worker) string {
+	return fmt.Sprintf("%s (weight=%d healthy=%v enabled=%v circuitOpen=%v)", w.Name, w.Weight, w.Healthy, w.Enabled, w.circuitOpen())
+}
+
+// checkEligibleOnly draws from the pool and reports any selection of a
+// worker that is ineligible or not in the pool at all
+func checkEligibleOnly(pool []*Worker, sel selector) []string {
+	members := make(map[*Worker]bool, len(pool))
+	for _, w := range pool {
+		members[w] = true
+	}
+	var out []string
+	for i := 0; i < selfTestDraws && len(out) < maxCounterexamples; i++ {
+		w := sel()
+		switch {
+		case w == nil:
+		case !members[w]:
+			out = append(out, fmt.Sprintf("draw %d returned %s, which is not in the pool", i, w.Name))
+		case !isEligible(w):
+			out = append(out, fmt.Sprintf("draw %d returned ineligible worker %s", i, describeWorker(w)))
+		}
+	}
+	return out
+}
+
+// checkWeightZero reports selections of a weight-zero worker while an
+// eligible worker with positive weight exists. It only applies to
+// weightAwareAlgorithms.
+func checkWeightZero(pool []*Worker, sel selector) []string {
+	positive := false
+	for _, w := range pool {
+		if isEligible(w) && w.Weight > 0 {
+			positive = true
+		}
+	}
+	if !positive {
+		return nil
+	}
+	var out []string
+	for i := 0; i < selfTestDraws && len(out) < maxCounterexamples; i++ {
+		if w := sel(); w != nil && w.Weight <= 0 {
+			out = append(out, fmt.Sprintf("draw %d returned weight-zero worker %s", i, describeWorker(w)))
+		}
+	}
+	return out
+}
+
+// checkTerminates reports a selection that does not return within
+// selfTestTimeout, and a result that does not match the pool: nil when no
+// worker is eligible, a worker otherwise. A selection that never returns is
+// left running.
+func checkTerminates(pool []*Worker, sel selector) []string {
+	anyEligible := false
+	for _, w := range pool {
+		if isEligible(w) {
+			anyEligible = true
+		}
+	}
+	done := make(chan *Worker, 1)
+	panicked := make(chan interface{}, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				panicked <- r
+			}
+		}()
+		done <- sel()
+	}()
+	timer := time.NewTimer(selfTestTimeout)
+	defer timer.Stop()
+	select {
+	case w := <-done:
+		switch {
+		case w == nil && anyEligible:
+			return []string{"selection returned no worker although some are eligible"}
+		case w != nil && !anyEligible:
+			return []string{fmt.Sprintf("selection returned %s although no worker is eligible", describeWorker(w))}
+		}
+		return nil
+	case r := <-panicked:
+		return []string{fmt.Sprintf("selection panicked: %v", r)}
+	case <-timer.C:
+		return []string{fmt.Sprintf("selection did not return within %s", selfTestTimeout)}
+	}
+}
+
+// expectedShares returns the share of draws each eligible worker should get
+// from algorithm in a pool whose load does not change between draws, or nil
+// when the algorithm has no fixed expectation. least-connections,
+// lru-worker and ip-hash concentrate on one worker by design and are not
+// sampled.
+func expectedShares(algorithm string, pool []*Worker) map[string]float64 {
+	var eligible []*Worker
+	total := 0
+	for _, w := range pool {
+		if isEligible(w) {
+			eligible = append(eligible, w)
+			total += w.Weight
+		}
+	}
+	if len(eligible) == 0 {
+		return nil
+	}
+	shares := make(map[string]float64, len(eligible))
+	switch algorithm {
+	case "round-robin", "random":
+		for _, w := range eligible {
+			shares[w.Name] = 1 / float64(len(eligible))
+		}
+	case "weighted", "smooth-weighted":
+		if total <= 0 {
+			return nil
+		}
+		for _, w := range eligible {
+			shares[w.Name] = float64(w.Weight) / float64(total)
+		}
+	default:
+		return nil
+	}
+	return shares
+}
+
+// checkDistribution makes selfTestDraws selections and reports every worker
+// whose observed share differs from expected by more than selfTestTolerance
+func checkDistribution(sel selector, expected map[string]float64) []string {
+	if expected == nil {
+		return nil
+	}
+	counts := make(map[string]int, len(expected))
+	for i := 0; i < selfTestDraws; i++ {
+		if w := sel(); w != nil {
+			counts[w.Name]++
+		}
+	}
+	names := make([]string, 0, len(expected))
+	for name := range expected {
+		names = append(names, name)
+	}
+	for name := range counts {
+		if _, ok := expected[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var out []string
+	for _, name := range names {
+		got := float64(counts[name]) / selfTestDraws
+		if math.Abs(got-expected[name]) > selfTestTolerance && len(out) < maxCounterexamples {
+			out = append(out, fmt.Sprintf("%s got %.3f of %d draws, expected %.3f", name, got, selfTestDraws, expected[name]))
+		}
+	}
+	return out
+}
+
+// snapshotPool copies the selection-relevant state of the live workers
+func (lb *LoadBalancer) snapshotPool() ([]*Worker, LRUWorkerConfig) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return clonePool(lb.workers, nil), lb.lru.config
+}
+
+// clonePool copies the selection-relevant fields of each worker, applying
+// mutate to the copies
+func clonePool(pool []*Worker, mutate func(i int, w *Worker)) []*Worker {
+	out := make([]*Worker, len(pool))
+	for i, w := range pool {
+		c := &Worker{
+			Name:         w.Name,
+			Weight:       w.Weight,
+			MaxLoad:      w.MaxLoad,
+			Healthy:      w.Healthy,
+			Enabled:      w.Enabled,
+			CircuitState: w.CircuitState,
+			CurrentLoad:  atomic.LoadInt32(&w.CurrentLoad),
+		}
+		if mutate != nil {
+			mutate(i, c)
+		}
+		out[i] = c
+	}
+	return out
+}
+
+// selfTestPools derives the pool shapes to test from a snapshot of the live
+// pool: the snapshot itself, an empty pool, and shapes that have broken
+// selectors in the past
+func selfTestPools(live []*Worker) []selfTestPool {
+	pools := []selfTestPool{
+		{name: "live", workers: clonePool(live, nil)},
+		{name: "empty"},
+	}
+	if len(live) == 0 {
+		return pools
+	}
+	first := -1
+	eligible := 0
+	for i, w := range live {
+		if isEligible(w) {
+			eligible++
+			if first < 0 {
+				first = i
+			}
+		}
+	}
+	pools = append(pools,
+		selfTestPool{name: "all-weights-zero", workers: clonePool(live, func(_ int, w *Worker) { w.Weight = 0 })},
+		selfTestPool{name: "none-eligible", workers: clonePool(live, func(_ int, w *Worker) { w.Enabled = false })},
+	)
+	if eligible >= 2 {
+		pools = append(pools,
+			selfTestPool{name: "one-weight-zero", workers: clonePool(live, func(i int, w *Worker) {
+				if i == first {
+					w.Weight = 0
+				}
+			})},
+			selfTestPool{name: "one-draining", workers: clonePool(live, func(i int, w *Worker) {
+				if i == first {
+					w.Enabled = false
+				}
+			})},
+		)
+	}
+	return pools
+}
+
+// sandboxSelector returns a selector running algorithm over a private copy of
+// pool. The sandbox has no metrics, events or stats, so drawing from it does
+// not affect the live load balancer.
+func sandboxSelector(algorithm string, pool []*Worker, lru LRUWorkerConfig) ([]*Worker, selector) {
+	sb := &LoadBalancer{
+		workers:   clonePool(pool, nil),
+		algorithm: algorithm,
+		lru:       lruWorkerState{config: lru},
+		clock:     realClock{},
+	}
+	return sb.workers, func() *Worker {
+		w, _, _ := sb.selectWorker(routeHints{})
+		return w
+	}
+}
+
+// runSelfTestCheck runs one check on a fresh sandbox, turning a panicking
+// selector into a counterexample
+func runSelfTestCheck(name, algorithm string, p selfTestPool, lru LRUWorkerConfig) (res SelfTestCheck) {
+	res = SelfTestCheck{Check: name, Pool: p.name}
+	defer func() {
+		if r := recover(); r != nil {
+			res.Counterexamples = append(res.Counterexamples, fmt.Sprintf("selection panicked: %v", r))
+		}
+		res.Passed = len(res.Counterexamples) == 0
+	}()
+	pool, sel := sandboxSelector(algorithm, p.workers, lru)
+	switch name {
+	case "eligible-only":
+		res.Counterexamples = checkEligibleOnly(pool, sel)
+	case "weight-zero-excluded":
+		res.Counterexamples = checkWeightZero(pool, sel)
+	case "terminates":
+		res.Counterexamples = checkTerminates(pool, sel)
+	case "distribution":
+		res.Counterexamples = checkDistribution(sel, expectedShares(algorithm, pool))
+	}
+	return res
+}
+
+// SelfTest runs every available algorithm through the invariant checks
+// against shapes derived from a snapshot of the current pool
+func (lb *LoadBalancer) SelfTest() SelfTestReport {
+	live, lru := lb.snapshotPool()
+	report := SelfTestReport{Passed: true, Pool: make([]string, 0, len(live))}
+	for _, w := range live {
+		report.Pool = append(report.Pool, w.Name)
+	}
+	pools := selfTestPools(live)
+	for _, algo := range availableAlgorithms {
+		checks := []string{"eligible-only", "terminates", "distribution"}
+		if weightAwareAlgorithms[algo] {
+			checks = append(checks, "weight-zero-excluded")
+		}
+		res := AlgorithmSelfTest{Algorithm: algo, Passed: true}
+		for _, p := range pools {
+			for _, name := range checks {
+				c := runSelfTestCheck(name, algo, p, lru)
+				res.Passed = res.Passed && c.Passed
+				res.Checks = append(res.Checks, c)
+			}
+		}
+		report.Passed = report.Passed && res.Passed
+		report.Algorithms = append(report.Algorithms, res)
+	}
+	return report
+}
+
+// handleSelfTest はアルゴリズムの不変条件を検査するセルフテストを実行する HTTP ハンドラです。
+// 現在のワーカープールのスナップショットから派生させた複数のプール形状に対して各アルゴリズムを検査し、
+// アルゴリズムごとの合否と反例を返します。実際のカウンタやトラフィックには影響しません。
+func handleSelfTest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lb.SelfTest())
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func selfTestFixture() []*Worker {
+	return []*Worker{
+		{Name: "worker-1", Weight: 1, MaxLoad: 3, Healthy: true, Enabled: true},
+		{Name: "worker-2", Weight: 3, MaxLoad: 3, Healthy: true, Enabled: true},
+		{Name: "worker-3", Weight: 2, MaxLoad: 3, Healthy: false, Enabled: true},
+		{Name: "worker-4", Weight: 2, MaxLoad: 3, Healthy: true, Enabled: true, CircuitState: circuitOpen},
+	}
+}
+
+func TestSelectorInvariants(t *testing.T) {
+	for _, algo := range availableAlgorithms {
+		for _, p := range selfTestPools(selfTestFixture()) {
+			checks := map[string]func() []string{
+				"eligible-only": func() []string {
+					pool, sel := sandboxSelector(algo, p.workers, defaultLRUWorkerConfig())
+					return checkEligibleOnly(pool, sel)
+				},
+				"terminates": func() []string {
+					pool, sel := sandboxSelector(algo, p.workers, defaultLRUWorkerConfig())
+					return checkTerminates(pool, sel)
+				},
+				"distribution": func() []string {
+					pool, sel := sandboxSelector(algo, p.workers, defaultLRUWorkerConfig())
+					return checkDistribution(sel, expectedShares(algo, pool))
+				},
+			}
+			if weightAwareAlgorithms[algo] {
+				checks["weight-zero-excluded"] = func() []string {
+					pool, sel := sandboxSelector(algo, p.workers, defaultLRUWorkerConfig())
+					return checkWeightZero(pool, sel)
+				}
+			}
+			for name, check := range checks {
+				if got := check(); len(got) > 0 {
+					t.Errorf("%s on %s pool: %s failed: %v", algo, p.name, name, got)
+				}
+			}
+		}
+	}
+}
+
+func TestSelfTestChecksReportCounterexamples(t *testing.T) {
+	pool := selfTestFixture()
+	always := func(w *Worker) selector { return func() *Worker { return w } }
+
+	if got := checkEligibleOnly(pool, always(pool[2])); len(got) != maxCounterexamples || !strings.Contains(got[0], "ineligible worker worker-3") {
+		t.Errorf("eligible-only counterexamples = %v", got)
+	}
+	if got := checkEligibleOnly(pool, always(&Worker{Name: "stranger"})); len(got) == 0 || !strings.Contains(got[0], "not in the pool") {
+		t.Errorf("eligible-only counterexamples = %v", got)
+	}
+
+	pool[0].Weight = 0
+	if got := checkWeightZero(pool, always(pool[0])); len(got) == 0 || !strings.Contains(got[0], "weight-zero worker worker-1") {
+		t.Errorf("weight-zero counterexamples = %v", got)
+	}
+
+	if got := checkTerminates(nil, always(pool[0])); len(got) != 1 || !strings.Contains(got[0], "no worker is eligible") {
+		t.Errorf("terminates counterexamples = %v", got)
+	}
+	if got := checkTerminates(pool, func() *Worker { panic("index out of range") }); len(got) != 1 || !strings.Contains(got[0], "panicked") {
+		t.Errorf("terminates counterexamples = %v", got)
+	}
+
+	expected := map[string]float64{"worker-1": 0.5, "worker-2": 0.5}
+	if got := checkDistribution(always(pool[1]), expected); len(got) != 2 || !strings.Contains(got[0], "worker-1 got 0.000") {
+		t.Errorf("distribution counterexamples = %v", got)
+	}
+}
+
+func TestHandleSelfTest(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	t.Cleanup(lb.stopControl)
+	lb.AddWorker("worker-1", "http://localhost:8081", "#FF0000", 1)
+	lb.AddWorker("worker-2", "http://localhost:8082", "#00FF00", 3)
+	disabled := false
+	lb.UpdateWorker("worker-2", &disabled, nil)
+	lb.AddWorker("worker-3", "http://localhost:8083", "#0000FF", 2)
+
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/selftest", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status code = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var report SelfTestReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if !report.Passed || len(report.Algorithms) != len(availableAlgorithms) || len(report.Pool) != 3 {
+		t.Fatalf("report = %+v, want all %d algorithms passing on 3 workers", report, len(availableAlgorithms))
+	}
+	pools := map[string]bool{}
+	for _, c := range report.Algorithms[0].Checks {
+		pools[c.Pool] = true
+	}
+	for _, p := range []string{"live", "empty", "all-weights-zero", "none-eligible", "one-weight-zero", "one-draining"} {
+		if !pools[p] {
+			t.Errorf("report has no checks on the %s pool", p)
+		}
+	}
+
+	// The live pool is untouched
+	if lb.roundRobinIdx != 0 || lb.lru.hot != "" {
+		t.Errorf("selection state changed: roundRobinIdx=%d lru.hot=%q", lb.roundRobinIdx, lb.lru.hot)
+	}
+	for _, w := range lb.workers {
+		if w.TotalRequests != 0 || w.stats.snapshot().Requests != 0 {
+			t.Errorf("%s counters changed", w.Name)
+		}
+	}
+	if !lb.workers[0].Enabled || lb.workers[1].Enabled || lb.workers[2].Weight != 2 {
+		t.Error("worker configuration changed")
+	}
+
+	rec = httptest.NewRecorder()
+	newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/selftest", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET status code = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// Settings is the runtime-tunable configuration of the load balancer
+type Settings = api.Settings
+
+// Default health check settings
+const (
+	defaultHealthInterval   = 5 * time.Second
+	defaultHealthTimeout    = 2 * time.Second
+	minHealthInterval       = 500 * time.Millisecond
+	defaultMaxHealthBackoff = time.Minute
+)
+
+// SettingsError describes a settings field that failed validation
+type SettingsError struct {
+	Field   string `json:"field"`
+	Message string `json:"error"`
+}
+
+func (e *SettingsError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// validateSettings checks every field and returns the first violation
+func validateSettings(s Settings) error {
+	switch {
+	case s.CircuitThreshold < 1:
+		return &SettingsError{"circuitThreshold", "must be at least 1"}
+	case s.CircuitResetIntervalMs < 1:
+		return &SettingsError{"circuitResetIntervalMs", "must be positive"}
+	case s.CircuitMaxCooldownMs < s.CircuitResetIntervalMs:
+		return &SettingsError{"circuitMaxCooldownMs", "must be at least circuitResetIntervalMs"}
+	case time.Duration(s.HealthIntervalMs)*time.Millisecond < minHealthInterval:
+		return &SettingsError{"healthIntervalMs", fmt.Sprintf("must be at least %d", minHealthInterval.Milliseconds())}
+	case time.Duration(s.BroadcastIntervalMs)*time.Millisecond < minBroadcastInterval:
+		return &SettingsError{"broadcastIntervalMs", fmt.Sprintf("must be at least %d", minBroadcastInterval.Milliseconds())}
+	case s.HealthTimeoutMs < 1:
+		return &SettingsError{"healthTimeoutMs", "must be positive"}
+	case s.MaxHealthBackoffMs < 0:
+		return &SettingsError{"maxHealthBackoffMs", "must not be negative"}
+	case s.HealthRise < 1:
+		return &SettingsError{"healthRise", "must be at least 1"}
+	case s.HealthFall < 1:
+		return &SettingsError{"healthFall", "must be at least 1"}
+	case s.UpstreamTimeoutMs < 1:
+		return &SettingsError{"upstreamTimeoutMs", "must be positive"}
+	case s.ProbeRps <= 0 || s.ProbeRps > maxProbeRps:
+		return &SettingsError{"probeRps", fmt.Sprintf("must be greater than 0 and at most %d", maxProbeRps)}
+	case s.MaxUpstreamBodyBytes < minMaxUpstreamBodyBytes:
+		return &SettingsError{"maxUpstreamBodyBytes", fmt.Sprintf("must be at least %d", minMaxUpstreamBodyBytes)}
+	case s.JournalEnabled && s.JournalPath == "":
+		return &SettingsError{"journalPath", "is required when the journal is enabled"}
+	case s.JournalMaxBytes < minJournalMaxBytes:
+		return &SettingsError{"journalMaxBytes", fmt.Sprintf("must be at least %d", minJournalMaxBytes)}
+	case s.JournalSampleRate < 0 || s.JournalSampleRate > 1:
+		return &SettingsError{"journalSampleRate", "must be between 0 and 1"}
+	case s.DedupWindowMs < 0 || s.DedupWindowMs > maxDedupWindowMs:
+		return &SettingsError{"dedupWindowMs", fmt.Sprintf("must be between 0 and %d", maxDedupWindowMs)}
+	case s.DedupPolicy != dedupReplay && s.DedupPolicy != dedupReject:
+		return &SettingsError{"dedupPolicy", "must be one of replay, reject"}
+	case s.ShedMaxGoroutines < 0:
+		return &SettingsError{"shedMaxGoroutines", "must not be negative"}
+	case s.ShedMaxHeapBytes < 0:
+		return &SettingsError{"shedMaxHeapBytes", "must not be negative"}
+	case s.ShedMaxSchedLatencyMs < 0:
+		return &SettingsError{"shedMaxSchedLatencyMs", "must not be negative"}
+	case s.TagCardinalityLimit < 1 || s.TagCardinalityLimit > maxTagCardinalityLimit:
+		return &SettingsError{"tagCardinalityLimit", fmt.Sprintf("must be between 1 and %d", maxTagCardinalityLimit)}
+	case s.TagOverflowPolicy != tagOverflowHash && s.TagOverflowPolicy != tagOverflowReject:
+		return &SettingsError{"tagOverflowPolicy", "must be one of hash, reject"}
+	case s.PacingMaxDelayMs < 0 || s.PacingMaxDelayMs > maxPacingMaxDelayMs:
+		return &SettingsError{"pacingMaxDelayMs", fmt.Sprintf("must be between 0 and %d", maxPacingMaxDelayMs)}
+	case s.PacingBurst < 1 || s.PacingBurst > maxPacingBurst:
+		return &SettingsError{"pacingBurst", fmt.Sprintf("must be between 1 and %d", maxPacingBurst)}
+	case !validMalformedMode(s.MalformedResponseMode):
+		return &SettingsError{"malformedResponseMode", "must be one of lenient, strict, passthrough"}
+	case s.DistributionThreshold <= 0:
+		return &SettingsError{"distributionThreshold", "must be positive"}
+	case s.DistributionMinRequests < 1:
+		return &SettingsError{"distributionMinRequests", "must be at least 1"}
+	case s.SlowRequestMs < 0:
+		return &SettingsError{"slowRequestMs", "must not be negative"}
+	case !validIdentityMode(s.IdentityCheck):
+		return &SettingsError{"identityCheck", "must be one of off, warn, strict"}
+	case s.MaxRetries < 0 || s.MaxRetries > maxTaskRetries:
+		return &SettingsError{"maxRetries", fmt.Sprintf("must be between 0 and %d", maxTaskRetries)}
+	case !validResponseDetail(s.ResponseDetail):
+		return &SettingsError{"responseDetail", "must be one of none, basic, full"}
+	case s.ResourceCheckTTLMs < 0:
+		return &SettingsError{"resourceCheckTtlMs", "must not be negative"}
+	case s.BroadcastSummaryThreshold < 0:
+		return &SettingsError{"broadcastSummaryThreshold", "must not be negative"}
+	case s.BroadcastTopN < 0:
+		return &SettingsError{"broadcastTopN", "must not be negative"}
+	case s.PhaseSampleRate < 0:
+		return &SettingsError{"phaseSampleRate", "must not be negative"}
+	case s.RateCeilingRps < 0:
+		return &SettingsError{"rateCeilingRps", "must not be negative"}
+	case time.Duration(s.RateWindowMs)*time.Millisecond < minRateWindow || time.Duration(s.RateWindowMs)*time.Millisecond > maxRateWindow:
+		return &SettingsError{"rateWindowMs", fmt.Sprintf("must be between %d and %d", minRateWindow.Milliseconds(), maxRateWindow.Milliseconds())}
+	}
+	return nil
+}
+
+// settingsLocked returns the current settings. Must be called with lb.mu held.
+func (lb *LoadBalancer) settingsLocked() Settings {
+	jc := lb.journal.config()
+	tagLimit, tagPolicy := lb.tags.config()
+	ceiling, window := lb.rateLimit.config()
+	return Settings{
+		CircuitThreshold:          lb.circuitThreshold,
+		CircuitResetIntervalMs:    lb.circuitResetInterval.Milliseconds(),
+		CircuitMaxCooldownMs:      lb.circuitMaxCooldown.Milliseconds(),
+		HealthIntervalMs:          lb.healthInterval.Milliseconds(),
+		HealthTimeoutMs:           lb.healthTimeout.Milliseconds(),
+		MaxHealthBackoffMs:        lb.maxHealthBackoff.Milliseconds(),
+		BroadcastIntervalMs:       lb.broadcastInterval.Milliseconds(),
+		HealthRise:                lb.healthRise,
+		HealthFall:                lb.healthFall,
+		UpstreamTimeoutMs:         lb.upstreamTimeout.Milliseconds(),
+		ProbeEnabled:              lb.probeEnabled,
+		ProbeRps:                  lb.probeRps,
+		MaxUpstreamBodyBytes:      lb.maxUpstreamBody,
+		BodyTooLargeTripsCircuit:  lb.bodyTooLargeTrips,
+		RetryOnQueueFull:          lb.retryQueueFull,
+		RetryOnOverloaded:         lb.retryOverloaded,
+		MaxRetries:                lb.maxRetries,
+		JournalEnabled:            jc.enabled,
+		JournalPath:               jc.path,
+		JournalMaxBytes:           jc.maxBytes,
+		JournalSampleRate:         jc.sampleRate,
+		DedupWindowMs:             lb.dedupWindow.Milliseconds(),
+		DedupPolicy:               lb.dedupPolicy,
+		ShedMaxGoroutines:         lb.shedThresholds.goroutines,
+		ShedMaxHeapBytes:          lb.shedThresholds.heapBytes,
+		ShedMaxSchedLatencyMs:     lb.shedThresholds.schedLatency.Milliseconds(),
+		TagCardinalityLimit:       tagLimit,
+		TagOverflowPolicy:         tagPolicy,
+		PacingEnabled:             lb.pacing.enabled,
+		PacingMaxDelayMs:          lb.pacing.maxDelay.Milliseconds(),
+		PacingBurst:               lb.pacing.burst,
+		MalformedResponseMode:     lb.malformedMode,
+		MalformedTripsCircuit:     lb.malformedTrips,
+		DistributionThreshold:     lb.distributionThreshold,
+		DistributionMinRequests:   lb.distributionMinRequests,
+		SlowRequestMs:             lb.slowRequest.Milliseconds(),
+		IdentityCheck:             lb.identityMode,
+		ResponseDetail:            lb.defaultDetail,
+		ResourceCheckTTLMs:        lb.resourceCheckTTL.Milliseconds(),
+		BroadcastSummaryThreshold: lb.broadcastSummaryThreshold,
+		BroadcastTopN:             lb.broadcastTopN,
+		PhaseSampleRate:           lb.phases.sampleRate(),
+		RateCeilingRps:            ceiling,
+		RateWindowMs:              window.Milliseconds(),
+	}
+}
+
+// Settings returns the current runtime settings
+func (lb *LoadBalancer) Settings() Settings {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.settingsLocked()
+}
+
+// applySettingsLocked stores s and returns the fields that changed as
+// {field: {"from": old, "to": new}}. Must be called with lb.mu held.
+func (lb *LoadBalancer) applySettingsLocked(s Settings) map[string]interface{} {
+	old := lb.settingsLocked()
+	lb.circuitThreshold = s.CircuitThreshold
+	lb.circuitResetInterval = time.Duration(s.CircuitResetIntervalMs) * time.Millisecond
+	lb.circuitMaxCooldown = time.Duration(s.CircuitMaxCooldownMs) * time.Millisecond
+	if interval := time.Duration(s.HealthIntervalMs) * time.Millisecond; interval != lb.healthInterval {
+		lb.healthInterval = interval
+		lb.wakeHealthLoopsLocked()
+	}
+	if interval := time.Duration(s.BroadcastIntervalMs) * time.Millisecond; interval != lb.broadcastInterval {
+		lb.broadcastInterval = interval
+		lb.broadcastLoop.wake()
+	}
+	lb.healthTimeout = time.Duration(s.HealthTimeoutMs) * time.Millisecond
+	lb.maxHealthBackoff = time.Duration(s.MaxHealthBackoffMs) * time.Millisecond
+	lb.healthRise = s.HealthRise
+	lb.healthFall = s.HealthFall
+	lb.upstreamTimeout = time.Duration(s.UpstreamTimeoutMs) * time.Millisecond
+	lb.probeEnabled = s.ProbeEnabled
+	lb.probeRps = s.ProbeRps
+	lb.maxUpstreamBody = s.MaxUpstreamBodyBytes
+	lb.bodyTooLargeTrips = s.BodyTooLargeTripsCircuit
+	lb.malformedMode = s.MalformedResponseMode
+	lb.malformedTrips = s.MalformedTripsCircuit
+	lb.distributionThreshold = s.DistributionThreshold
+	lb.distributionMinRequests = s.DistributionMinRequests
+	lb.slowRequest = time.Duration(s.SlowRequestMs) * time.Millisecond
+	lb.identityMode = s.IdentityCheck
+	if lb.identityMode == identityOff {
+		for _, w := range lb.workers {
+			w.misconfigured = false
+		}
+	}
+	lb.defaultDetail = s.ResponseDetail
+	lb.resourceCheckTTL = time.Duration(s.ResourceCheckTTLMs) * time.Millisecond
+	lb.broadcastSummaryThreshold = s.BroadcastSummaryThreshold
+	lb.broadcastTopN = s.BroadcastTopN
+	lb.retryQueueFull = s.RetryOnQueueFull
+	lb.retryOverloaded = s.RetryOnOverloaded
+	lb.maxRetries = s.MaxRetries
+	lb.dedupWindow = time.Duration(s.DedupWindowMs) * time.Millisecond
+	lb.dedupPolicy = s.DedupPolicy
+	lb.shedThresholds = shedThresholds{
+		goroutines:   s.ShedMaxGoroutines,
+		heapBytes:    s.ShedMaxHeapBytes,
+		schedLatency: time.Duration(s.ShedMaxSchedLatencyMs) * time.Millisecond,
+	}
+	lb.tags.configure(s.TagCardinalityLimit, s.TagOverflowPolicy)
+	lb.phases.configure(s.PhaseSampleRate)
+	lb.rateLimit.configure(s.RateCeilingRps, time.Duration(s.RateWindowMs)*time.Millisecond)
+	lb.pacing = pacingConfig{
+		enabled:  s.PacingEnabled,
+		maxDelay: time.Duration(s.PacingMaxDelayMs) * time.Millisecond,
+		burst:    s.PacingBurst,
+	}
+	lb.journal.configure(journalConfig{
+		enabled:    s.JournalEnabled,
+		path:       s.JournalPath,
+		maxBytes:   s.JournalMaxBytes,
+		sampleRate: s.JournalSampleRate,
+	})
+
+	var before, after map[string]interface{}
+	b, _ := json.Marshal(old)
+	json.Unmarshal(b, &before)
+	a, _ := json.Marshal(s)
+	json.Unmarshal(a, &after)
+	changed := make(map[string]interface{})
+	for k, v := range after {
+		if before[k] != v {
+			changed[k] = map[string]interface{}{"from": before[k], "to": v}
+		}
+	}
+	return changed
+}
+
+// UpdateSettings validates and atomically applies new settings. Changes take
+// effect for subsequent evaluations; in-progress failure counters are kept.
+func (lb *LoadBalancer) UpdateSettings(s Settings) (map[string]interface{}, error) {
+	if err := validateSettings(s); err != nil {
+		return nil, err
+	}
+	lb.mu.Lock()
+	changed := lb.applySettingsLocked(s)
+	lb.mu.Unlock()
+
+	if len(changed) > 0 {
+		lb.emitEvent("settings", "Settings updated", map[string]interface{}{"changed": changed})
+	}
+	return changed, nil
+}
+
+// handleSettings は実行時設定の取得・更新を行う HTTP ハンドラです。
+// GET では現在の Settings を返し、PUT/POST では指定されたフィールドのみを現在値に上書きして検証し、一括で反映します。
+// 未知のフィールドや検証エラーの場合は 400 と {"field": ..., "error": ...} を返し、反映後は監査イベントを記録して状態をブロードキャストします。
+func handleSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(lb.Settings())
+
+	case http.MethodPut, http.MethodPost:
+		s := lb.Settings()
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&s); err != nil {
+			writeSettingsError(w, &SettingsError{"body", err.Error()})
+			return
+		}
+		changed, err := lb.UpdateSettings(s)
+		if err != nil {
+			writeSettingsError(w, err.(*SettingsError))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"settings": lb.Settings(),
+			"changed":  changed,
+		})
+		lb.BroadcastStatus()
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeSettingsError(w http.ResponseWriter, err *SettingsError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(err)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitForHits polls until the counter reaches want
+func waitForHits(t *testing.T, hits *int32, want int32) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(hits) < want {
+		if time.Now().After(deadline) {
+			t.Fatalf("health hits = %d, want %d", atomic.LoadInt32(hits), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSettingsHealthIntervalAppliesImmediately(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	clk := newFakeClock()
+	lb := NewLoadBalancer("round-robin")
+	lb.clock = clk
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lb.HealthCheck(ctx, time.Second)
+	clk.waitForTimer(t)
+
+	s := lb.Settings()
+	s.HealthIntervalMs = 5000
+	if _, err := lb.UpdateSettings(s); err != nil {
+		t.Fatalf("UpdateSettings: %v", err)
+	}
+	clk.waitForTimer(t)
+
+	// The pending wait is restarted with the new interval
+	clk.Advance(time.Second)
+	time.Sleep(20 * time.Millisecond)
+	if got := atomic.LoadInt32(&hits); got != 0 {
+		t.Fatalf("health hits after 1s = %d, want 0", got)
+	}
+	clk.Advance(4 * time.Second)
+	waitForHits(t, &hits, 1)
+	clk.waitForTimer(t)
+	// The next tick is skipped while this check is still in flight
+	for atomic.LoadInt32(&lb.workers[0].checking) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// A shorter interval counts from the last check
+	clk.Advance(200 * time.Millisecond)
+	s.HealthIntervalMs = 500
+	lb.UpdateSettings(s)
+	clk.waitForTimer(t)
+	clk.Advance(300 * time.Millisecond)
+	waitForHits(t, &hits, 2)
+}
+
+func TestSettingsThresholdChangeMidStreak(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	lb := NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+	w := lb.workers[0]
+
+	lb.checkWorker(w)
+	lb.checkWorker(w)
+	if w.circuitOpen() {
+		t.Fatal("circuit should still be closed after 2 failures with threshold 3")
+	}
+
+	s := lb.Settings()
+	s.CircuitThreshold = 5
+	s.HealthFall = 5
+	if _, err := lb.UpdateSettings(s); err != nil {
+		t.Fatalf("UpdateSettings: %v", err)
+	}
+
+	// The streak is kept; the new threshold applies from here on
+	lb.checkWorker(w)
+	if w.ConsecFailures != 3 {
+		t.Errorf("ConsecFailures = %d, want 3", w.ConsecFailures)
+	}
+	if w.circuitOpen() || !w.Healthy {
+		t.Error("worker should stay healthy below the raised threshold")
+	}
+	lb.checkWorker(w)
+	lb.checkWorker(w)
+	if !w.circuitOpen() || w.Healthy {
+		t.Error("circuit should open at the new threshold")
+	}
+}
+
+func TestSettingsHealthRise(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	lb := NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+	w := lb.workers[0]
+	w.Healthy = false
+
+	s := lb.Settings()
+	s.HealthRise = 2
+	lb.UpdateSettings(s)
+
+	lb.checkWorker(w)
+	if w.Healthy {
+		t.Fatal("worker should need 2 successes to become healthy")
+	}
+	lb.checkWorker(w)
+	if !w.Healthy {
+		t.Fatal("worker should be healthy after 2 successes")
+	}
+}
+
+func TestHandleSettings(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		wantCode  int
+		wantField string
+	}{
+		{"partial update", `{"circuitThreshold": 4}`, http.StatusOK, ""},
+		{"invalid threshold", `{"circuitThreshold": 0}`, http.StatusBadRequest, "circuitThreshold"},
+		{"interval too short", `{"healthIntervalMs": 100}`, http.StatusBadRequest, "healthIntervalMs"},
+		{"unknown field", `{"bogus": 1}`, http.StatusBadRequest, "body"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb = NewLoadBalancer("round-robin")
+			before := lb.Settings()
+
+			req := httptest.NewRequest(http.MethodPut, "/settings", bytes.NewBufferString(tt.body))
+			rec := httptest.NewRecorder()
+			handleSettings(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status code = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if tt.wantCode != http.StatusOK {
+				var e SettingsError
+				json.NewDecoder(rec.Body).Decode(&e)
+				if e.Field != tt.wantField {
+					t.Errorf("field = %q, want %q", e.Field, tt.wantField)
+				}
+				if lb.Settings() != before {
+					t.Error("settings should be unchanged after a rejected update")
+				}
+				return
+			}
+
+			if got := lb.Settings().CircuitThreshold; got != 4 {
+				t.Errorf("CircuitThreshold = %d, want 4", got)
+			}
+			if got := lb.Settings().HealthIntervalMs; got != before.HealthIntervalMs {
+				t.Errorf("HealthIntervalMs = %d, want unchanged %d", got, before.HealthIntervalMs)
+			}
+			events := lb.events.since(0, 0)
+			if len(events) != 1 || events[0].Type != "settings" {
+				t.Fatalf("events = %+v, want one settings event", events)
+			}
+			if _, ok := events[0].Data["changed"].(map[string]interface{})["circuitThreshold"]; !ok {
+				t.Errorf("event data = %v, want circuitThreshold change", events[0].Data)
+			}
+		})
+	}
+}
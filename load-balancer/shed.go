@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// Load shedding levels. Each level also sheds everything the lower ones do,
+// so escalation drops the least important work first and recovery restores
+// it last.
+const (
+	shedNone = iota
+	// shedProbes skips synthetic probe ticks
+	shedProbes
+	// shedBroadcasts sends periodic status broadcasts only every
+	// shedBroadcastEvery ticks and none after individual tasks
+	shedBroadcasts
+	// shedLowPriority rejects tasks sent with X-LB-Priority: low
+	shedLowPriority
+)
+
+var shedLevelNames = []string{"none", "probes", "broadcasts", "low_priority"}
+
+const (
+	shedInterval       = time.Second
+	shedBroadcastEvery = 5
+	// shedRecoveryRatio is the fraction of each threshold every reading must
+	// be below before a level is given up
+	shedRecoveryRatio = 0.8
+)
+
+// Shed action categories for lb_shed_actions_total
+const (
+	shedActionProbe     = "probe"
+	shedActionBroadcast = "broadcast"
+	shedActionTask      = "task"
+)
+
+// priorityHeader marks a task's priority; only "low" tasks are shed
+const (
+	priorityHeader = "X-LB-Priority"
+	priorityLow    = "low"
+)
+
+// ShedStatus is the load shedding level reported in /status
+type ShedStatus = api.ShedStatus
+
+// selfHealth is a reading of the LB's own load
+type selfHealth struct {
+	Goroutines   int
+	HeapBytes    uint64
+	SchedLatency time.Duration
+}
+
+// selfHealthSource provides the readings load shedding is based on
+type selfHealthSource interface {
+	readSelfHealth() selfHealth
+}
+
+// runtimeSelfHealth reads the LB's self-metrics sample and measures how long
+// a new goroutine waits to be scheduled
+type runtimeSelfHealth struct {
+	lb *LoadBalancer
+}
+
+func (r runtimeSelfHealth) readSelfHealth() selfHealth {
+	self := r.lb.SelfMetrics()
+	start := time.Now()
+	scheduled := make(chan struct{})
+	go close(scheduled)
+	<-scheduled
+	return selfHealth{
+		Goroutines:   self.Goroutines,
+		HeapBytes:    self.HeapAllocBytes,
+		SchedLatency: time.Since(start),
+	}
+}
+
+// shedThresholds are the self-health limits; zero disables a limit
+type shedThresholds struct {
+	goroutines   int
+	heapBytes    int64
+	schedLatency time.Duration
+}
+
+// exceeded describes the first reading in h above scale times its threshold,
+// or returns "" if there is none
+func (t shedThresholds) exceeded(h selfHealth, scale float64) string {
+	switch {
+	case t.goroutines > 0 && float64(h.Goroutines) > scale*float64(t.goroutines):
+		return fmt.Sprintf("goroutines %d > %d", h.Goroutines, t.goroutines)
+	case t.heapBytes > 0 && float64(h.HeapBytes) > scale*float64(t.heapBytes):
+		return fmt.Sprintf("heap %d > %d bytes", h.HeapBytes, t.heapBytes)
+	case t.schedLatency > 0 && float64(h.SchedLatency) > scale*float64(t.schedLatency):
+		return fmt.Sprintf("scheduler latency %s > %s", h.SchedLatency, t.schedLatency)
+	}
+	return ""
+}
+
+// shedder holds the current shedding level. The level is read on hot paths
+// and is atomic; reason is guarded by mu.
+type shedder struct {
+	level  atomic.Int32
+	source selfHealthSource
+	mu     sync.Mutex
+	reason string
+}
+
+// shedding reports whether the LB sheds at level or above
+func (lb *LoadBalancer) shedding(level int) bool {
+	return int(lb.shed.level.Load()) >= level
+}
+
+// ShedStatus returns the current shedding level
+func (lb *LoadBalancer) ShedStatus() ShedStatus {
+	level := int(lb.shed.level.Load())
+	lb.shed.mu.Lock()
+	defer lb.shed.mu.Unlock()
+	return ShedStatus{Level: level, Name: shedLevelNames[level], Reason: lb.shed.reason}
+}
+
+// evaluateShed takes a self-health reading and moves the shedding level one
+// step up when a threshold is exceeded, or one step down when every reading
+// is comfortably below its threshold
+func (lb *LoadBalancer) evaluateShed() {
+	lb.mu.RLock()
+	t := lb.shedThresholds
+	lb.mu.RUnlock()
+	h := lb.shed.source.readSelfHealth()
+
+	lb.shed.mu.Lock()
+	from := int(lb.shed.level.Load())
+	to := from
+	reason := t.exceeded(h, 1)
+	switch {
+	case reason != "":
+		if from < shedLowPriority {
+			to = from + 1
+			lb.shed.reason = reason
+		}
+	case from > shedNone && t.exceeded(h, shedRecoveryRatio) == "":
+		to = from - 1
+		if to == shedNone {
+			lb.shed.reason = ""
+		}
+	}
+	lb.shed.level.Store(int32(to))
+	lb.shed.mu.Unlock()
+	if to == from {
+		return
+	}
+
+	lb.metrics.shedLevel.Set(float64(to))
+	msg := fmt.Sprintf("Load shedding %s -> %s", shedLevelNames[from], shedLevelNames[to])
+	if reason != "" {
+		msg += " (" + reason + ")"
+	}
+	log.Print(msg)
+	lb.emitEvent("shed_level_changed", msg, map[string]interface{}{
+		"from":   shedLevelNames[from],
+		"to":     shedLevelNames[to],
+		"reason": reason,
+	})
+}
+
+// StartShedder evaluates load shedding every shedInterval
+func (lb *LoadBalancer) StartShedder(ctx context.Context) {
+	for {
+		timer := lb.clock.NewTimer(shedInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+			lb.evaluateShed()
+		}
+	}
+}
+
+// shedTask rejects a low-priority task with 503 while low-priority tasks are
+// being shed, and reports whether it did
+func (lb *LoadBalancer) shedTask(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get(priorityHeader) != priorityLow || !lb.shedding(shedLowPriority) {
+		return false
+	}
+	lb.metrics.shedActions.WithLabelValues(shedActionTask).Inc()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(map[string]string{"error": "Load balancer is overloaded; low-priority tasks are being shed"})
+	return true
+}
+
+// broadcastAfterTask broadcasts the status after a task unless broadcasts are
+// being shed
+func (lb *LoadBalancer) broadcastAfterTask() {
+	if lb.shedding(shedBroadcasts) {
+		lb.metrics.shedActions.WithLabelValues(shedActionBroadcast).Inc()
+		return
+	}
+	lb.BroadcastStatus()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeSelfHealth returns whatever reading the test sets
+type fakeSelfHealth struct {
+	reading selfHealth
+}
+
+func (f *fakeSelfHealth) readSelfHealth() selfHealth { return f.reading }
+
+func newShedLB(t *testing.T) (*LoadBalancer, *fakeSelfHealth) {
+	t.Helper()
+	lb := NewLoadBalancer("round-robin")
+	fake := &fakeSelfHealth{}
+	lb.shed.source = fake
+	s := lb.Settings()
+	s.ShedMaxGoroutines, s.ShedMaxSchedLatencyMs = 1000, 100
+	if _, err := lb.UpdateSettings(s); err != nil {
+		t.Fatalf("UpdateSettings: %v", err)
+	}
+	return lb, fake
+}
+
+func TestShedEscalationAndRecovery(t *testing.T) {
+	lb, fake := newShedLB(t)
+
+	steps := []struct {
+		reading selfHealth
+		want    string
+	}{
+		{selfHealth{Goroutines: 500}, "none"},
+		{selfHealth{Goroutines: 1500}, "probes"},
+		{selfHealth{Goroutines: 500, SchedLatency: 200 * time.Millisecond}, "broadcasts"},
+		{selfHealth{Goroutines: 1500}, "low_priority"},
+		{selfHealth{Goroutines: 1500}, "low_priority"},
+		// Below the thresholds but not by enough to recover
+		{selfHealth{Goroutines: 900}, "low_priority"},
+		{selfHealth{Goroutines: 500}, "broadcasts"},
+		{selfHealth{Goroutines: 500}, "probes"},
+		{selfHealth{Goroutines: 500}, "none"},
+		{selfHealth{Goroutines: 500}, "none"},
+	}
+	for i, step := range steps {
+		fake.reading = step.reading
+		lb.evaluateShed()
+		if got := lb.ShedStatus().Name; got != step.want {
+			t.Fatalf("step %d: level = %s, want %s", i, got, step.want)
+		}
+	}
+
+	var transitions []string
+	for _, e := range lb.events.since(0, 0) {
+		if e.Type == "shed_level_changed" {
+			transitions = append(transitions, e.Data["to"].(string))
+		}
+	}
+	if got := strings.Join(transitions, ","); got != "probes,broadcasts,low_priority,broadcasts,probes,none" {
+		t.Errorf("transitions = %s", got)
+	}
+	if got := testutil.ToFloat64(lb.metrics.shedLevel); got != 0 {
+		t.Errorf("shed level gauge = %v, want 0", got)
+	}
+}
+
+func TestShedLowPriorityTasks(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"t"}`))
+	}))
+	defer srv.Close()
+	var fake *fakeSelfHealth
+	lb, fake = newShedLB(t)
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+
+	fake.reading = selfHealth{Goroutines: 5000}
+	for i := 0; i < 3; i++ {
+		lb.evaluateShed()
+	}
+	status := lb.GetStatus()["shed"].(ShedStatus)
+	if status.Level != shedLowPriority || status.Reason != "goroutines 5000 > 1000" {
+		t.Fatalf("shed status = %+v", status)
+	}
+
+	if rec := doTask(map[string]string{priorityHeader: priorityLow}); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("low-priority task: %d, want 503", rec.Code)
+	}
+	if rec := doTask(nil); rec.Code != http.StatusOK {
+		t.Errorf("normal task: %d, want 200", rec.Code)
+	}
+	m := lb.metrics
+	if got := testutil.ToFloat64(m.shedActions.WithLabelValues(shedActionTask)); got != 1 {
+		t.Errorf("shed tasks = %v, want 1", got)
+	}
+	// The normal task's broadcast is shed too
+	if got := testutil.ToFloat64(m.shedActions.WithLabelValues(shedActionBroadcast)); got != 1 {
+		t.Errorf("shed broadcasts = %v, want 1", got)
+	}
+
+	s := lb.Settings()
+	s.ShedMaxHeapBytes = -1
+	if _, err := lb.UpdateSettings(s); err == nil || err.(*SettingsError).Field != "shedMaxHeapBytes" {
+		t.Errorf("negative threshold: err = %v", err)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import "sync/atomic"
+
+// smoothWeighted picks a candidate with nginx's smooth weighted round-robin:
+// every candidate's currentWeight grows by its Weight, the one with the
+// highest currentWeight wins and gives back the total weight. Over one cycle
+// of total-weight picks each worker is chosen Weight times, and the picks
+// are interleaved instead of coming in runs: weights 5, 2, 1 give
+// a b a a c a b a. Workers with no weight are only picked when every
+// candidate has none. Must be called with lb.mu held.
+func (lb *LoadBalancer) smoothWeighted(workers []*Worker) *Worker {
+	var best *Worker
+	var bestWeight, total int64
+	for _, w := range workers {
+		if w.Weight <= 0 {
+			continue
+		}
+		total += int64(w.Weight)
+		cw := atomic.AddInt64(&w.currentWeight, int64(w.Weight))
+		if best == nil || cw > bestWeight {
+			best, bestWeight = w, cw
+		}
+	}
+	if best == nil {
+		return lb.roundRobin(workers)
+	}
+	atomic.AddInt64(&best.currentWeight, -total)
+	return best
+}
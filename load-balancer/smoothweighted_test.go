@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSmoothWeightedSequence(t *testing.T) {
+	lb := NewLoadBalancer("smooth-weighted")
+	for i, weight := range []int{5, 2, 1} {
+		name := string(rune('a' + i))
+		lb.AddWorker(name, fmt.Sprintf("http://localhost:808%d", i+1), "#FF0000", weight)
+	}
+
+	var picks []string
+	for i := 0; i < 16; i++ {
+		picks = append(picks, lb.SelectWorker().Name)
+	}
+	if got, want := strings.Join(picks, " "), "a b a a c a b a a b a a c a b a"; got != want {
+		t.Errorf("picks = %s, want %s", got, want)
+	}
+}
+
+func TestSmoothWeightedEqualWeights(t *testing.T) {
+	lb := NewLoadBalancer("smooth-weighted")
+	for i := 1; i <= 4; i++ {
+		lb.AddWorker(fmt.Sprintf("worker-%d", i), fmt.Sprintf("http://localhost:808%d", i), "#FF0000", 3)
+	}
+
+	counts := make(map[string]int)
+	prev := ""
+	for i := 0; i < 100; i++ {
+		w := lb.SelectWorker()
+		if w.Name == prev {
+			t.Fatalf("pick %d: %s selected twice in a row", i, w.Name)
+		}
+		prev = w.Name
+		counts[w.Name]++
+	}
+	for name, n := range counts {
+		if n != 25 {
+			t.Errorf("%s picked %d times, want 25", name, n)
+		}
+	}
+
+	// Weight-zero workers are skipped while another has weight
+	lb.workers[0].Weight = 0
+	for i := 0; i < 12; i++ {
+		if w := lb.SelectWorker(); w.Name == "worker-1" {
+			t.Fatalf("pick %d: weight-zero worker selected", i)
+		}
+	}
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// maxSnapshots bounds the number of named pool snapshots kept
+const maxSnapshots = 16
+
+// snapshotFileEnvVar names the file snapshots are persisted to. Unset, they
+// are kept in memory only and lost on restart.
+const snapshotFileEnvVar = "LB_SNAPSHOT_FILE"
+
+// snapshotNamePattern is what a snapshot name may consist of
+var snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// errSnapshotLimit is returned when taking a new snapshot would exceed
+// maxSnapshots
+var errSnapshotLimit = fmt.Errorf("at most %d snapshots are kept; delete one first", maxSnapshots)
+
+// SnapshotWorker is the configuration of a worker captured in a snapshot:
+// the fields a transaction's updateWorker step can restore
+type SnapshotWorker struct {
+	Name        string `json:"name"`
+	Enabled     bool   `json:"enabled"`
+	Weight      int    `json:"weight"`
+	Color       string `json:"color"`
+	DisplayName string `json:"displayName"`
+	Description string `json:"description"`
+	Icon        string `json:"icon"`
+}
+
+// PoolSnapshot is the pool configuration saved under a name
+type PoolSnapshot struct {
+	Name      string           `json:"name"`
+	TakenAt   time.Time        `json:"takenAt"`
+	Algorithm string           `json:"algorithm"`
+	Settings  Settings         `json:"settings"`
+	LRUWorker LRUWorkerConfig  `json:"lruWorker"`
+	Workers   []SnapshotWorker `json:"workers"`
+}
+
+// SnapshotChange is a field whose value differs from the snapshot. Field is
+// dotted for nested values, e.g. settings.healthIntervalMs.
+type SnapshotChange struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// WorkerDiff lists the changed fields of a worker present in both states
+type WorkerDiff struct {
+	Worker  string           `json:"worker"`
+	Changes []SnapshotChange `json:"changes"`
+}
+
+// SnapshotDiff is the drift of the current pool from a snapshot. Added and
+// Removed are workers only in the current state or only in the snapshot.
+type SnapshotDiff struct {
+	Snapshot string           `json:"snapshot"`
+	TakenAt  time.Time        `json:"takenAt"`
+	Changed  bool             `json:"changed"`
+	Added    []string         `json:"added"`
+	Removed  []string         `json:"removed"`
+	Pool     []SnapshotChange `json:"pool"`
+	Workers  []WorkerDiff     `json:"workers"`
+}
+
+// SnapshotRestore is the response of POST /snapshot/{name}/restore. Missing
+// lists snapshot workers no longer in the pool, which a transaction cannot
+// bring back; Extra lists workers added since, which are left as they are.
+// A dry run has Changes, the diff the restore would make, instead of
+// Transaction.
+type SnapshotRestore struct {
+	Snapshot    string             `json:"snapshot"`
+	DryRun      bool               `json:"dryRun,omitempty"`
+	Transaction *TransactionResult `json:"transaction,omitempty"`
+	Changes     *SnapshotDiff      `json:"changes,omitempty"`
+	Missing     []string           `json:"missing"`
+	Extra       []string           `json:"extra"`
+}
+
+// snapshotStore keeps the named snapshots, and rewrites them all to path
+// after each change when path is set
+type snapshotStore struct {
+	mu     sync.Mutex
+	byName map[string]PoolSnapshot
+	path   string
+}
+
+func newSnapshotStore() *snapshotStore {
+	return &snapshotStore{byName: make(map[string]PoolSnapshot)}
+}
+
+// put saves s, replacing a snapshot of the same name
+func (st *snapshotStore) put(s PoolSnapshot) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.byName[s.Name]; !ok && len(st.byName) >= maxSnapshots {
+		return errSnapshotLimit
+	}
+	st.byName[s.Name] = s
+	st.saveLocked()
+	return nil
+}
+
+func (st *snapshotStore) get(name string) (PoolSnapshot, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s, ok := st.byName[name]
+	return s, ok
+}
+
+func (st *snapshotStore) remove(name string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	_, ok := st.byName[name]
+	delete(st.byName, name)
+	if ok {
+		st.saveLocked()
+	}
+	return ok
+}
+
+// load reads the snapshots saved in path, if it exists, and persists every
+// later change there. On error nothing is loaded and persistence stays off,
+// so an unreadable file is not overwritten.
+func (st *snapshotStore) load(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var saved []PoolSnapshot
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &saved); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, s := range saved {
+		if len(st.byName) >= maxSnapshots {
+			break
+		}
+		st.byName[s.Name] = s
+	}
+	st.path = path
+	return nil
+}
+
+// saveLocked writes the snapshots to st.path through a temporary file, so a
+// crash never leaves a partial file. Errors are logged: the snapshots are
+// still kept in memory. Must be called with st.mu held.
+func (st *snapshotStore) saveLocked() {
+	if st.path == "" {
+		return
+	}
+	saved := make([]PoolSnapshot, 0, len(st.byName))
+	for _, s := range st.byName {
+		saved = append(saved, s)
+	}
+	raw, err := json.Marshal(saved)
+	if err == nil {
+		tmp := st.path + ".tmp"
+		if err = os.WriteFile(tmp, raw, 0o644); err == nil {
+			err = os.Rename(tmp, st.path)
+		}
+	}
+	if err != nil {
+		log.Printf("Snapshots: %v", err)
+	}
+}
+
+// list returns the snapshots, oldest first
+func (st *snapshotStore) list() []PoolSnapshot {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	out := make([]PoolSnapshot, 0, len(st.byName))
+	for _, s := range st.byName {
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].TakenAt.Equal(out[j].TakenAt) {
+			return out[i].TakenAt.Before(out[j].TakenAt)
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// captureLocked returns the current pool configuration as a snapshot named
+// name. Must be called with lb.mu held.
+func (lb *LoadBalancer) captureLocked(name string) PoolSnapshot {
+	s := PoolSnapshot{
+		Name:      name,
+		TakenAt:   lb.clock.Now().UTC(),
+		Algorithm: lb.algorithm,
+		Settings:  lb.settingsLocked(),
+		LRUWorker: lb.lru.config,
+		Workers:   make([]SnapshotWorker, 0, len(lb.workers)),
+	}
+	for _, w := range lb.workers {
+		s.Workers = append(s.Workers, SnapshotWorker{
+			Name:        w.Name,
+			Enabled:     w.Enabled,
+			Weight:      w.Weight,
+			Color:       w.Color,
+			DisplayName: w.DisplayName,
+			Description: w.Description,
+			Icon:        w.Icon,
+		})
+	}
+	return s
+}
+
+// patchSnapshotWorker returns sw with update applied the way PatchWorker
+// applies it to a worker
+func patchSnapshotWorker(sw SnapshotWorker, update api.WorkerUpdate) SnapshotWorker {
+	if update.Enabled != nil {
+		sw.Enabled = *update.Enabled
+	}
+	if update.Weight != nil && *update.Weight > 0 {
+		sw.Weight = *update.Weight
+	}
+	if update.Color != nil {
+		sw.Color = normalizeColor(*update.Color)
+	}
+	if update.DisplayName != nil {
+		sw.DisplayName = *update.DisplayName
+	}
+	if update.Description != nil {
+		sw.Description = *update.Description
+	}
+	if update.Icon != nil {
+		sw.Icon = *update.Icon
+	}
+	return sw
+}
+
+// TakeSnapshot saves the current pool configuration under name
+func (lb *LoadBalancer) TakeSnapshot(name string) (PoolSnapshot, error) {
+	if !snapshotNamePattern.MatchString(name) {
+		return PoolSnapshot{}, &MetadataError{"name", "must be 1-64 letters, digits, '.', '_' or '-'"}
+	}
+	lb.mu.RLock()
+	s := lb.captureLocked(name)
+	lb.mu.RUnlock()
+	if err := lb.snapshots.put(s); err != nil {
+		return PoolSnapshot{}, err
+	}
+	lb.emitEvent("snapshot", fmt.Sprintf("Snapshot %s taken", name), map[string]interface{}{"name": name, "workers": len(s.Workers)})
+	return s, nil
+}
+
+// DiffSnapshot compares the current pool configuration with the named
+// snapshot. It returns false if there is no such snapshot.
+func (lb *LoadBalancer) DiffSnapshot(name string) (SnapshotDiff, bool) {
+	saved, ok := lb.snapshots.get(name)
+	if !ok {
+		return SnapshotDiff{}, false
+	}
+	lb.mu.RLock()
+	current := lb.captureLocked(name)
+	lb.mu.RUnlock()
+	return diffSnapshots(saved, current), true
+}
+
+// diffSnapshots returns how after differs from before
+func diffSnapshots(before, after PoolSnapshot) SnapshotDiff {
+	d := SnapshotDiff{
+		Snapshot: before.Name,
+		TakenAt:  before.TakenAt,
+		Added:    []string{},
+		Removed:  []string{},
+		Pool:     []SnapshotChange{},
+		Workers:  []WorkerDiff{},
+	}
+	if before.Algorithm != after.Algorithm {
+		d.Pool = append(d.Pool, SnapshotChange{"algorithm", before.Algorithm, after.Algorithm})
+	}
+	d.Pool = append(d.Pool, diffFields("settings.", before.Settings, after.Settings)...)
+	d.Pool = append(d.Pool, diffFields("lruWorker.", before.LRUWorker, after.LRUWorker)...)
+
+	saved := make(map[string]SnapshotWorker, len(before.Workers))
+	for _, w := range before.Workers {
+		saved[w.Name] = w
+	}
+	for _, w := range after.Workers {
+		prev, ok := saved[w.Name]
+		if !ok {
+			d.Added = append(d.Added, w.Name)
+			continue
+		}
+		delete(saved, w.Name)
+		if changes := diffFields("", prev, w); len(changes) > 0 {
+			d.Workers = append(d.Workers, WorkerDiff{Worker: w.Name, Changes: changes})
+		}
+	}
+	for _, w := range before.Workers {
+		if _, ok := saved[w.Name]; ok {
+			d.Removed = append(d.Removed, w.Name)
+		}
+	}
+	d.Changed = len(d.Added)+len(d.Removed)+len(d.Pool)+len(d.Workers) > 0
+	return d
+}
+
+// diffFields compares the JSON fields of two values of the same struct type,
+// in field name order
+func diffFields(prefix string, before, after interface{}) []SnapshotChange {
+	var b, a map[string]interface{}
+	raw, _ := json.Marshal(before)
+	json.Unmarshal(raw, &b)
+	raw, _ = json.Marshal(after)
+	json.Unmarshal(raw, &a)
+
+	keys := make([]string, 0, len(a))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var changes []SnapshotChange
+	for _, k := range keys {
+		if !reflect.DeepEqual(b[k], a[k]) {
+			changes = append(changes, SnapshotChange{prefix + k, b[k], a[k]})
+		}
+	}
+	return changes
+}
+
+// restoreSteps returns the transaction that restores saved, with the
+// missing and extra workers filled in on res
+func (lb *LoadBalancer) restoreSteps(saved PoolSnapshot) ([]TransactionStep, SnapshotRestore) {
+	settings, _ := json.Marshal(saved.Settings)
+	lru, _ := json.Marshal(saved.LRUWorker)
+	steps := []TransactionStep{
+		{Op: txSetAlgorithm, Algorithm: saved.Algorithm},
+		{Op: txSettings, Settings: settings},
+		{Op: txLRUWorker, LRUWorker: lru},
+	}
+
+	res := SnapshotRestore{Snapshot: saved.Name, Missing: []string{}, Extra: []string{}}
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	inSnapshot := make(map[string]bool, len(saved.Workers))
+	for _, sw := range saved.Workers {
+		inSnapshot[sw.Name] = true
+		if lb.findWorkerLocked(sw.Name) == nil {
+			res.Missing = append(res.Missing, sw.Name)
+			continue
+		}
+		sw := sw
+		steps = append(steps, TransactionStep{Op: txUpdateWorker, Worker: sw.Name, Update: &api.WorkerUpdate{
+			Enabled:     &sw.Enabled,
+			Weight:      &sw.Weight,
+			Color:       &sw.Color,
+			DisplayName: &sw.DisplayName,
+			Description: &sw.Description,
+			Icon:        &sw.Icon,
+		}})
+	}
+	for _, w := range lb.workers {
+		if !inSnapshot[w.Name] {
+			res.Extra = append(res.Extra, w.Name)
+		}
+	}
+	return steps, res
+}
+
+// RestoreSnapshot applies the named snapshot as a single transaction. It
+// returns false if there is no such snapshot, and the *TransactionError of
+// the transaction if it was rejected.
+func (lb *LoadBalancer) RestoreSnapshot(name string) (SnapshotRestore, bool, error) {
+	saved, ok := lb.snapshots.get(name)
+	if !ok {
+		return SnapshotRestore{}, false, nil
+	}
+	steps, res := lb.restoreSteps(saved)
+	tx, err := lb.ApplyTransaction(steps)
+	if err != nil {
+		return SnapshotRestore{}, true, err
+	}
+	res.Transaction = &tx
+	lb.emitEvent("snapshot", fmt.Sprintf("Snapshot %s restored", name), map[string]interface{}{
+		"name":    name,
+		"missing": res.Missing,
+		"extra":   res.Extra,
+	})
+	return res, true, nil
+}
+
+// PlanRestore validates restoring the named snapshot like RestoreSnapshot and
+// returns the changes it would make, without applying anything
+func (lb *LoadBalancer) PlanRestore(name string) (SnapshotRestore, bool, error) {
+	saved, ok := lb.snapshots.get(name)
+	if !ok {
+		return SnapshotRestore{}, false, nil
+	}
+	steps, res := lb.restoreSteps(saved)
+	plan, err := lb.PlanTransaction(steps)
+	if err != nil {
+		return SnapshotRestore{}, true, err
+	}
+	res.DryRun = true
+	res.Changes = &plan.Changes
+	return res, true, nil
+}
+
+// handleSnapshots は POST /snapshot で現在のプール構成 (アルゴリズム、設定、lruWorker、各ワーカーの enabled・weight・表示用メタデータ) を {"name"} の名前で保存し、GET で保存済みのスナップショットを古い順に返す HTTP ハンドラです。
+// 同じ名前なら上書きし、保存数が上限 (16) に達している場合は 409 を返します。LB_SNAPSHOT_FILE を設定するとスナップショットはそのファイルに保存され、再起動後も残ります。
+func handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(lb.snapshots.list())
+	case http.MethodPost:
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeMetadataError(w, &MetadataError{"body", err.Error()})
+			return
+		}
+		s, err := lb.TakeSnapshot(req.Name)
+		var me *MetadataError
+		switch {
+		case errors.As(err, &me):
+			writeMetadataError(w, me)
+			return
+		case err != nil:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(api.ErrorResponse{Error: err.Error(), Field: "name"})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(s)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSnapshot は /snapshot/{name} 以下の HTTP ハンドラです。
+// GET /snapshot/{name} は保存内容を、GET /snapshot/{name}/diff は現在の状態との差分 (追加・削除されたワーカー、変更されたフィールドの before/after) を返し、DELETE /snapshot/{name} は削除します。
+// POST /snapshot/{name}/restore は保存した構成を通常のトランザクションとして一括適用します。スナップショット後に追加されたワーカーはそのまま残し "extra" として、プールにないワーカーは "missing" として返します。
+// ?dryRun=true では何も変更せずに、復元した場合の変更を "changes" に差分として返します。
+func handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api"), "/snapshot/")
+	name, action, _ := strings.Cut(strings.TrimSuffix(path, "/"), "/")
+	if name == "" {
+		http.Error(w, "Snapshot name required", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		s, ok := lb.snapshots.get(name)
+		if !ok {
+			http.Error(w, "Snapshot not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	case action == "" && r.Method == http.MethodDelete:
+		if !lb.snapshots.remove(name) {
+			http.Error(w, "Snapshot not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case action == "diff" && r.Method == http.MethodGet:
+		d, ok := lb.DiffSnapshot(name)
+		if !ok {
+			http.Error(w, "Snapshot not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d)
+	case action == "restore" && r.Method == http.MethodPost:
+		dryRun, err := dryRunQuery(r)
+		if err != nil {
+			writeMetadataError(w, err.(*MetadataError))
+			return
+		}
+		restore := lb.RestoreSnapshot
+		if dryRun {
+			restore = lb.PlanRestore
+		}
+		res, ok, err := restore(name)
+		if !ok {
+			http.Error(w, "Snapshot not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(err)
+			return
+		}
+		json.NewEncoder(w).Encode(res)
+		if !dryRun {
+			lb.BroadcastStatus()
+		}
+	case action == "" || action == "diff" || action == "restore":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+func snapshotRequest(t *testing.T, method, path, body string, out interface{}) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+	if out != nil {
+		json.NewDecoder(rec.Body).Decode(out)
+	}
+	return rec.Code
+}
+
+func TestSnapshotDiffAndRestore(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	t.Cleanup(lb.stopControl)
+	lb.AddWorker("worker-1", "http://127.0.0.1:1", "#FF0000", 1)
+	lb.AddWorker("worker-2", "http://127.0.0.1:2", "#00FF00", 1)
+
+	if code := snapshotRequest(t, http.MethodPost, "/api/snapshot", `{"name": "baseline"}`, nil); code != http.StatusCreated {
+		t.Fatalf("snapshot: %d, want 201", code)
+	}
+	lb.mu.RLock()
+	baseline := lb.captureLocked("baseline")
+	lb.mu.RUnlock()
+
+	// Drift: algorithm, a setting, two workers and a new one
+	_, err := lb.ApplyTransaction([]TransactionStep{
+		{Op: txSetAlgorithm, Algorithm: "least-connections"},
+		{Op: txSettings, Settings: json.RawMessage(`{"healthIntervalMs": 9000}`)},
+		{Op: txUpdateWorker, Worker: "worker-1", Update: &api.WorkerUpdate{Weight: ptr(5), DisplayName: ptr("Primary")}},
+		{Op: txUpdateWorker, Worker: "worker-2", Update: &api.WorkerUpdate{Enabled: ptr(false)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb.AddWorker("worker-3", "http://127.0.0.1:3", "#0000FF", 1)
+
+	var d SnapshotDiff
+	if code := snapshotRequest(t, http.MethodGet, "/snapshot/baseline/diff", "", &d); code != http.StatusOK {
+		t.Fatalf("diff: %d, want 200", code)
+	}
+	wantPool := []SnapshotChange{
+		{"algorithm", "round-robin", "least-connections"},
+		{"settings.healthIntervalMs", float64(baseline.Settings.HealthIntervalMs), 9000.0},
+	}
+	wantWorkers := []WorkerDiff{
+		{"worker-1", []SnapshotChange{{"displayName", "", "Primary"}, {"weight", 1.0, 5.0}}},
+		{"worker-2", []SnapshotChange{{"enabled", true, false}}},
+	}
+	if !d.Changed || !reflect.DeepEqual(d.Added, []string{"worker-3"}) || len(d.Removed) != 0 {
+		t.Errorf("diff workers: changed %v, added %v, removed %v", d.Changed, d.Added, d.Removed)
+	}
+	if !reflect.DeepEqual(d.Pool, wantPool) {
+		t.Errorf("pool changes = %+v, want %+v", d.Pool, wantPool)
+	}
+	if !reflect.DeepEqual(d.Workers, wantWorkers) {
+		t.Errorf("worker changes = %+v, want %+v", d.Workers, wantWorkers)
+	}
+
+	var res SnapshotRestore
+	if code := snapshotRequest(t, http.MethodPost, "/api/snapshot/baseline/restore", "", &res); code != http.StatusOK {
+		t.Fatalf("restore: %d, want 200", code)
+	}
+	if !reflect.DeepEqual(res.Extra, []string{"worker-3"}) || len(res.Missing) != 0 || res.Transaction.Algorithm != "round-robin" {
+		t.Errorf("restore = %+v", res)
+	}
+	lb.mu.RLock()
+	restored := lb.captureLocked("baseline")
+	lb.mu.RUnlock()
+	restored.TakenAt, restored.Workers = baseline.TakenAt, restored.Workers[:2]
+	if !reflect.DeepEqual(restored, baseline) {
+		t.Errorf("restored state = %+v, want %+v", restored, baseline)
+	}
+	if d, _ := lb.DiffSnapshot("baseline"); len(d.Pool) != 0 || len(d.Workers) != 0 {
+		t.Errorf("diff after restore = %+v, want only worker-3 added", d)
+	}
+}
+
+func TestSnapshotRestoreDryRun(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", "http://127.0.0.1:1", "#FF0000", 1)
+	lb.AddWorker("worker-2", "http://127.0.0.1:2", "#00FF00", 1)
+	if _, err := lb.TakeSnapshot("baseline"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := lb.ApplyTransaction([]TransactionStep{
+		{Op: txSetAlgorithm, Algorithm: "random"},
+		{Op: txUpdateWorker, Worker: "worker-1", Update: &api.WorkerUpdate{Weight: ptr(3), Icon: ptr("star")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb.mu.RLock()
+	before := lb.captureLocked("")
+	lb.mu.RUnlock()
+	events := len(lb.events.since(0, 0))
+
+	var plan SnapshotRestore
+	if code := snapshotRequest(t, http.MethodPost, "/api/snapshot/baseline/restore?dryRun=true", "", &plan); code != http.StatusOK {
+		t.Fatalf("dry run: %d, want 200", code)
+	}
+	if !plan.DryRun || plan.Transaction != nil || plan.Changes == nil {
+		t.Fatalf("dry run = %+v", plan)
+	}
+	lb.mu.RLock()
+	unchanged := lb.captureLocked("")
+	lb.mu.RUnlock()
+	unchanged.TakenAt = before.TakenAt
+	if !reflect.DeepEqual(unchanged, before) || len(lb.events.since(0, 0)) != events {
+		t.Errorf("dry run changed the state or recorded events")
+	}
+
+	var res SnapshotRestore
+	if code := snapshotRequest(t, http.MethodPost, "/api/snapshot/baseline/restore", "", &res); code != http.StatusOK {
+		t.Fatalf("restore: %d, want 200", code)
+	}
+	lb.mu.RLock()
+	after := lb.captureLocked("")
+	lb.mu.RUnlock()
+	var want SnapshotDiff
+	raw, _ := json.Marshal(diffSnapshots(before, after))
+	json.Unmarshal(raw, &want)
+	if !reflect.DeepEqual(plan.Changes.Pool, want.Pool) || !reflect.DeepEqual(plan.Changes.Workers, want.Workers) || len(want.Workers) != 1 {
+		t.Errorf("planned changes = %+v, want %+v", plan.Changes, want)
+	}
+	if res.DryRun || res.Changes != nil || res.Transaction == nil {
+		t.Errorf("restore = %+v", res)
+	}
+}
+
+func TestSnapshotLimitAndErrors(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	for i := 0; i < maxSnapshots; i++ {
+		if _, err := lb.TakeSnapshot(fmt.Sprintf("s%d", i)); err != nil {
+			t.Fatalf("snapshot %d: %v", i, err)
+		}
+	}
+	if code := snapshotRequest(t, http.MethodPost, "/snapshot", `{"name": "one-too-many"}`, nil); code != http.StatusConflict {
+		t.Errorf("snapshot over the limit: %d, want 409", code)
+	}
+	if code := snapshotRequest(t, http.MethodPost, "/snapshot", `{"name": "s0"}`, nil); code != http.StatusCreated {
+		t.Errorf("overwriting a snapshot at the limit: %d, want 201", code)
+	}
+	if code := snapshotRequest(t, http.MethodDelete, "/snapshot/s1", "", nil); code != http.StatusNoContent {
+		t.Errorf("delete: %d, want 204", code)
+	}
+	if code := snapshotRequest(t, http.MethodPost, "/snapshot", `{"name": "one-too-many"}`, nil); code != http.StatusCreated {
+		t.Errorf("snapshot after a delete: %d, want 201", code)
+	}
+	if code := snapshotRequest(t, http.MethodPost, "/snapshot", `{"name": "bad/name"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("invalid name: %d, want 400", code)
+	}
+	for _, path := range []string{"/snapshot/missing/diff", "/snapshot/s1"} {
+		if code := snapshotRequest(t, http.MethodGet, path, "", nil); code != http.StatusNotFound {
+			t.Errorf("GET %s: %d, want 404", path, code)
+		}
+	}
+}
+
+func TestSnapshotsSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshots.json")
+	lb = NewLoadBalancer("round-robin")
+	t.Cleanup(lb.stopControl)
+	if err := lb.snapshots.load(path); err != nil {
+		t.Fatalf("load without a file: %v", err)
+	}
+	lb.AddWorker("worker-1", "http://127.0.0.1:1", "#FF0000", 3)
+	for _, name := range []string{"baseline", "scratch"} {
+		if code := snapshotRequest(t, http.MethodPost, "/snapshot", fmt.Sprintf(`{"name": %q}`, name), nil); code != http.StatusCreated {
+			t.Fatalf("snapshot %s: %d, want 201", name, code)
+		}
+	}
+	if code := snapshotRequest(t, http.MethodDelete, "/snapshot/scratch", "", nil); code != http.StatusNoContent {
+		t.Fatalf("delete: %d, want 204", code)
+	}
+	saved, _ := lb.snapshots.get("baseline")
+
+	// A new process loads what the old one left
+	restarted := newSnapshotStore()
+	if err := restarted.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := restarted.list(); len(got) != 1 || !reflect.DeepEqual(got[0], saved) {
+		t.Errorf("after restart = %+v, want only %+v", got, saved)
+	}
+
+	// A corrupt file is reported and left alone
+	os.WriteFile(path, []byte("{"), 0o644)
+	broken := newSnapshotStore()
+	if err := broken.load(path); err == nil {
+		t.Error("corrupt file loaded without an error")
+	}
+	broken.put(PoolSnapshot{Name: "new"})
+	if raw, _ := os.ReadFile(path); string(raw) != "{" {
+		t.Errorf("corrupt file overwritten with %s", raw)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// syntheticHeader marks LB-generated tasks so workers can exclude them from
+// their stats
+const syntheticHeader = "X-LB-Synthetic"
+
+// StartupCheck is the verification result for one worker
+type StartupCheck struct {
+	Worker       string `json:"worker"`
+	HealthOK     bool   `json:"healthOk"`
+	HealthStatus string `json:"healthStatus,omitempty"`
+	TaskOK       bool   `json:"taskOk"`
+	LatencyMs    int64  `json:"latencyMs"`
+	Error        string `json:"error,omitempty"`
+	MarkedDown   bool   `json:"markedDown"`
+}
+
+// Passed reports whether both the health probe and the synthetic task passed
+func (c StartupCheck) Passed() bool { return c.HealthOK && c.TaskOK }
+
+// StartupReport is the result of startup warm-pool verification
+type StartupReport struct {
+	Enabled    bool           `json:"enabled"`
+	Strict     bool           `json:"strict"`
+	StartedAt  time.Time      `json:"startedAt"`
+	DurationMs int64          `json:"durationMs"`
+	Passed     bool           `json:"passed"`
+	Workers    []StartupCheck `json:"workers"`
+}
+
+// VerifyPool probes every worker's /health and sends it one synthetic task.
+// Synthetic tasks bypass selection and are not counted in TotalRequests or
+// Prometheus. Failing workers are marked unhealthy. In strict mode an error
+// is returned if any worker failed.
+func (lb *LoadBalancer) VerifyPool(ctx context.Context, strict bool) (StartupReport, error) {
+	lb.mu.RLock()
+	workers := make([]*Worker, len(lb.workers))
+	copy(workers, lb.workers)
+	timeout := lb.healthTimeout
+	lb.mu.RUnlock()
+
+	report := StartupReport{
+		Enabled:   true,
+		Strict:    strict,
+		StartedAt: lb.clock.Now().UTC(),
+		Workers:   make([]StartupCheck, len(workers)),
+	}
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i, w := range workers {
+		wg.Add(1)
+		go func(i int, w *Worker) {
+			defer wg.Done()
+			report.Workers[i] = lb.verifyWorker(ctx, w, timeout)
+		}(i, w)
+	}
+	wg.Wait()
+
+	report.Passed = true
+	lb.mu.Lock()
+	for i, c := range report.Workers {
+		if !c.Passed() {
+			report.Passed = false
+			workers[i].Healthy = false
+			report.Workers[i].MarkedDown = true
+		}
+	}
+	report.DurationMs = time.Since(start).Milliseconds()
+	lb.startupReport = &report
+	lb.mu.Unlock()
+
+	for _, c := range report.Workers {
+		if c.MarkedDown {
+			lb.metrics.workerHealth.WithLabelValues(c.Worker).Set(0)
+		}
+	}
+
+	if strict && !report.Passed {
+		return report, fmt.Errorf("startup verification failed")
+	}
+	return report, nil
+}
+
+func (lb *LoadBalancer) verifyWorker(ctx context.Context, w *Worker, timeout time.Duration) (check StartupCheck) {
+	check.Worker = w.Name
+	client := lb.resources.timeoutClient(timeout)
+	start := time.Now()
+	defer func() { check.LatencyMs = time.Since(start).Milliseconds() }()
+
+	lb.mu.RLock()
+	healthURL := w.healthURL()
+	lb.mu.RUnlock()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, healthURL, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		check.Error = "health: " + err.Error()
+		return check
+	}
+	var health HealthResponse
+	json.NewDecoder(resp.Body).Decode(&health)
+	resp.Body.Close()
+	check.HealthStatus = health.Status
+	if resp.StatusCode != http.StatusOK {
+		check.Error = fmt.Sprintf("health: status %d", resp.StatusCode)
+		return check
+	}
+	check.HealthOK = true
+
+	body, _ := json.Marshal(TaskRequest{ID: "startup-verify-" + w.Name, Weight: 0.1, Synthetic: true})
+	req, _ = http.NewRequestWithContext(ctx, http.MethodPost, w.URL+"/task", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(syntheticHeader, "true")
+	lb.mu.RLock()
+	client.Timeout = lb.upstreamTimeout
+	lb.mu.RUnlock()
+	resp, err = client.Do(req)
+	if err != nil {
+		check.Error = "task: " + err.Error()
+		return check
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		check.Error = fmt.Sprintf("task: status %d", resp.StatusCode)
+		return check
+	}
+	check.TaskOK = true
+	return check
+}
+
+// StartupReport returns the startup verification report, if one was run
+func (lb *LoadBalancer) StartupReport() StartupReport {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	if lb.startupReport == nil {
+		return StartupReport{Workers: []StartupCheck{}}
+	}
+	return *lb.startupReport
+}
+
+// logStartupReport logs a per-worker pass/fail table
+func logStartupReport(report StartupReport) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Startup verification (strict=%v):\n", report.Strict)
+	fmt.Fprintf(&b, "  %-20s %-6s %-6s %-6s %8s  %s\n", "WORKER", "HEALTH", "TASK", "RESULT", "LATENCY", "ERROR")
+	for _, c := range report.Workers {
+		result := "PASS"
+		if !c.Passed() {
+			result = "FAIL"
+		}
+		fmt.Fprintf(&b, "  %-20s %-6v %-6v %-6s %6dms  %s\n", c.Worker, c.HealthOK, c.TaskOK, result, c.LatencyMs, c.Error)
+	}
+	log.Print(b.String())
+}
+
+// handleStartupReport は起動時のワーカープール検証結果を返す HTTP ハンドラです。
+// STARTUP_VERIFY が無効で検証が行われていない場合は enabled=false のレポートを返します。
+func handleStartupReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lb.StartupReport())
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newVerifyStub serves /health and /task; failing stubs return 500 for
+// both. It counts synthetic task requests.
+func newVerifyStub(t *testing.T, failing bool, synthetic *int32) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/task" && r.Header.Get(syntheticHeader) == "true" {
+			atomic.AddInt32(synthetic, 1)
+		}
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "healthy"})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestVerifyPool(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		name := "lenient"
+		if strict {
+			name = "strict"
+		}
+		t.Run(name, func(t *testing.T) {
+			var synthetic int32
+			good := newVerifyStub(t, false, &synthetic)
+			bad := newVerifyStub(t, true, &synthetic)
+
+			lb = NewLoadBalancer("round-robin")
+			lb.AddWorker("good", good.URL, "#00FF00", 1)
+			lb.AddWorker("bad", bad.URL, "#FF0000", 1)
+			before := testutil.ToFloat64(lb.metrics.requestsTotal.WithLabelValues("good", "success"))
+
+			report, err := lb.VerifyPool(context.Background(), strict)
+			if strict && err == nil {
+				t.Error("strict verification should fail")
+			}
+			if !strict && err != nil {
+				t.Errorf("lenient verification returned %v", err)
+			}
+
+			if report.Passed || len(report.Workers) != 2 {
+				t.Fatalf("report = %+v", report)
+			}
+			if c := report.Workers[0]; !c.Passed() || c.MarkedDown {
+				t.Errorf("good worker check = %+v", c)
+			}
+			if c := report.Workers[1]; c.Passed() || !c.MarkedDown || c.Error == "" {
+				t.Errorf("bad worker check = %+v", c)
+			}
+			if !lb.workers[0].Healthy || lb.workers[1].Healthy {
+				t.Error("only the failing worker should be marked unhealthy")
+			}
+
+			// Synthetic tasks are sent but never counted
+			if synthetic != 1 {
+				t.Errorf("synthetic tasks = %d, want 1 (health failed on the bad worker)", synthetic)
+			}
+			if lb.workers[0].TotalRequests != 0 {
+				t.Errorf("TotalRequests = %d, want 0", lb.workers[0].TotalRequests)
+			}
+			if got := testutil.ToFloat64(lb.metrics.requestsTotal.WithLabelValues("good", "success")); got != before {
+				t.Errorf("lb_requests_total changed by %v", got-before)
+			}
+
+			rec := httptest.NewRecorder()
+			handleStartupReport(rec, httptest.NewRequest(http.MethodGet, "/startup-report", nil))
+			var got StartupReport
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !got.Enabled || got.Strict != strict || len(got.Workers) != 2 {
+				t.Errorf("/startup-report = %+v", got)
+			}
+		})
+	}
+}
+
+func TestStartupReportNotRun(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	rec := httptest.NewRecorder()
+	handleStartupReport(rec, httptest.NewRequest(http.MethodGet, "/startup-report", nil))
+	var got StartupReport
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.Enabled {
+		t.Error("report should not be enabled when verification was not run")
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultSessionCapacity is the number of algorithm sessions kept for the
+// efficiency report
+const defaultSessionCapacity = 20
+
+// defaultAlgorithmWarmup is how long a session started by an algorithm switch
+// is marked as warming up
+const defaultAlgorithmWarmup = 10 * time.Second
+
+// statsLatencyBuckets are the upper bounds (ms) of the per-worker latency
+// histogram; the last bucket is unbounded
+var statsLatencyBuckets = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000, 30000}
+
+// statsSnapshot is a point-in-time copy of a worker's cumulative stats
+type statsSnapshot struct {
+	Requests     int64
+	Errors       int64
+	Retries      int64
+	LatencySumMs float64
+	Buckets      []int64
+}
+
+// sub returns the stats accumulated between prev and s
+func (s statsSnapshot) sub(prev statsSnapshot) statsSnapshot {
+	d := statsSnapshot{
+		Requests:     s.Requests - prev.Requests,
+		Errors:       s.Errors - prev.Errors,
+		Retries:      s.Retries - prev.Retries,
+		LatencySumMs: s.LatencySumMs - prev.LatencySumMs,
+		Buckets:      make([]int64, len(s.Buckets)),
+	}
+	for i := range s.Buckets {
+		d.Buckets[i] = s.Buckets[i]
+		if i < len(prev.Buckets) {
+			d.Buckets[i] -= prev.Buckets[i]
+		}
+	}
+	return d
+}
+
+// add merges o into s
+func (s *statsSnapshot) add(o statsSnapshot) {
+	s.Requests += o.Requests
+	s.Errors += o.Errors
+	s.Retries += o.Retries
+	s.LatencySumMs += o.LatencySumMs
+	if s.Buckets == nil {
+		s.Buckets = make([]int64, len(statsLatencyBuckets)+1)
+	}
+	for i := range o.Buckets {
+		s.Buckets[i] += o.Buckets[i]
+	}
+}
+
+// quantile estimates the q-quantile latency by interpolating inside the
+// histogram bucket that contains it
+func (s statsSnapshot) quantile(q float64) float64 {
+	var total int64
+	for _, c := range s.Buckets {
+		total += c
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := q * float64(total)
+	var seen int64
+	for i, c := range s.Buckets {
+		if c == 0 || float64(seen+c) < rank {
+			seen += c
+			continue
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = statsLatencyBuckets[i-1]
+		}
+		if i == len(statsLatencyBuckets) {
+			return lower
+		}
+		upper := statsLatencyBuckets[i]
+		return lower + (upper-lower)*(rank-float64(seen))/float64(c)
+	}
+	return statsLatencyBuckets[len(statsLatencyBuckets)-1]
+}
+
+// rollingStats are cumulative per-worker request statistics
+type rollingStats struct {
+	mu   sync.Mutex
+	snap statsSnapshot
+}
+
+// observe records one forwarded request
+func (r *rollingStats) observe(latency time.Duration, failed bool) {
+	ms := float64(latency) / float64(time.Millisecond)
+	i := sort.SearchFloat64s(statsLatencyBuckets, ms)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.snap.Buckets == nil {
+		r.snap.Buckets = make([]int64, len(statsLatencyBuckets)+1)
+	}
+	r.snap.Requests++
+	if failed {
+		r.snap.Errors++
+	}
+	r.snap.LatencySumMs += ms
+	r.snap.Buckets[i]++
+}
+
+// retried records that a request rejected by this worker was retried
+// elsewhere
+func (r *rollingStats) retried() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.snap.Retries++
+}
+
+// snapshot returns a copy of the cumulative stats
+func (r *rollingStats) snapshot() statsSnapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.snap
+	s.Buckets = make([]int64, len(statsLatencyBuckets)+1)
+	copy(s.Buckets, r.snap.Buckets)
+	return s
+}
+
+// AlgorithmSession is the efficiency report of one period during which an
+// algorithm was active
+type AlgorithmSession struct {
+	Algorithm         string           `json:"algorithm"`
+	StartedAt         time.Time        `json:"startedAt"`
+	EndedAt           *time.Time       `json:"endedAt"`
+	DurationMs        int64            `json:"durationMs"`
+	StartSeq          int64            `json:"startSeq"`
+	EndSeq            int64            `json:"endSeq,omitempty"`
+	Requests          int64            `json:"requests"`
+	WorkerRequests    map[string]int64 `json:"workerRequests"`
+	RequestCV         float64          `json:"requestCv"`
+	MeanLatencyMs     float64          `json:"meanLatencyMs"`
+	P95LatencyMs      float64          `json:"p95LatencyMs"`
+	ErrorRate         float64          `json:"errorRate"`
+	RetriesPerRequest float64          `json:"retriesPerRequest"`
+	// WarmupEndsAt is when the warm-up after an algorithm switch ends; nil
+	// for the initial session. Figures gathered while WarmingUp reflect the
+	// algorithm still settling, more so when Handoff is empty (cold start).
+	WarmupEndsAt *time.Time `json:"warmupEndsAt"`
+	WarmingUp    bool       `json:"warmingUp"`
+	// Handoff describes the state taken over from the previous algorithm
+	Handoff []string `json:"handoff"`
+
+	start map[string]statsSnapshot
+}
+
+// sessionStore keeps the completed sessions in a ring and the active one
+type sessionStore struct {
+	mu       sync.Mutex
+	done     []AlgorithmSession
+	capacity int
+	warmup   time.Duration
+	current  *AlgorithmSession
+}
+
+func newSessionStore(capacity int) *sessionStore {
+	return &sessionStore{capacity: capacity, warmup: defaultAlgorithmWarmup}
+}
+
+func (s *sessionStore) size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.done)
+}
+
+func (s *sessionStore) bounds() storeBounds {
+	return storeBounds{Capacity: s.capacity, Floor: s.capacity}
+}
+
+// sweep is a no-op: sessions are only evicted by the ring bound
+func (s *sessionStore) sweep(now time.Time) int { return 0 }
+
+// snapshotWorkerStats returns the cumulative stats of every worker
+func (lb *LoadBalancer) snapshotWorkerStats() map[string]statsSnapshot {
+	lb.mu.RLock()
+	workers := make([]*Worker, len(lb.workers))
+	copy(workers, lb.workers)
+	lb.mu.RUnlock()
+
+	out := make(map[string]statsSnapshot, len(workers))
+	for _, w := range workers {
+		out[w.Name] = w.stats.snapshot()
+	}
+	return out
+}
+
+// startSession closes the active session (if any) and opens a new one for
+// algorithm. seq is the audit event that marks the boundary and handoff the
+// state taken over from the previous algorithm. A session that replaces
+// another starts with a warm-up period.
+func (lb *LoadBalancer) startSession(algorithm string, seq int64, handoff []string) {
+	now := lb.clock.Now().UTC()
+	stats := lb.snapshotClientStats()
+
+	s := lb.sessions
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cur := s.current; cur != nil {
+		report := cur.report(stats, now)
+		report.EndedAt = &now
+		report.EndSeq = seq
+		if len(s.done) == s.capacity {
+			copy(s.done, s.done[1:])
+			s.done = s.done[:len(s.done)-1]
+		}
+		s.done = append(s.done, report)
+		lb.metrics.sessionRequestCV.WithLabelValues(report.Algorithm).Set(report.RequestCV)
+		lb.metrics.sessionLatencyP95.WithLabelValues(report.Algorithm).Set(report.P95LatencyMs)
+		lb.metrics.sessionErrorRate.WithLabelValues(report.Algorithm).Set(report.ErrorRate)
+	}
+	next := &AlgorithmSession{Algorithm: algorithm, StartedAt: now, StartSeq: seq, Handoff: handoff, start: stats}
+	if s.current != nil {
+		end := now.Add(s.warmup)
+		next.WarmupEndsAt = &end
+	}
+	s.current = next
+}
+
+// report computes the session's efficiency figures from the stats
+// accumulated since the session started
+func (cur *AlgorithmSession) report(stats map[string]statsSnapshot, now time.Time) AlgorithmSession {
+	r := AlgorithmSession{
+		Algorithm:      cur.Algorithm,
+		StartedAt:      cur.StartedAt,
+		DurationMs:     now.Sub(cur.StartedAt).Milliseconds(),
+		StartSeq:       cur.StartSeq,
+		WorkerRequests: make(map[string]int64, len(stats)),
+		WarmupEndsAt:   cur.WarmupEndsAt,
+		WarmingUp:      cur.WarmupEndsAt != nil && now.Before(*cur.WarmupEndsAt),
+		Handoff:        cur.Handoff,
+	}
+	if r.Handoff == nil {
+		r.Handoff = []string{}
+	}
+
+	var total statsSnapshot
+	for name, snap := range stats {
+		d := snap.sub(cur.start[name])
+		r.WorkerRequests[name] = d.Requests
+		total.add(d)
+	}
+	r.Requests = total.Requests
+	r.RequestCV = coefficientOfVariation(r.WorkerRequests)
+	if total.Requests > 0 {
+		r.MeanLatencyMs = total.LatencySumMs / float64(total.Requests)
+		r.ErrorRate = float64(total.Errors) / float64(total.Requests)
+		r.RetriesPerRequest = float64(total.Retries) / float64(total.Requests)
+		r.P95LatencyMs = total.quantile(0.95)
+	}
+	return r
+}
+
+// coefficientOfVariation returns stddev/mean of the counts (0 if mean is 0)
+func coefficientOfVariation(counts map[string]int64) float64 {
+	if len(counts) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, c := range counts {
+		sum += float64(c)
+	}
+	mean := sum / float64(len(counts))
+	if mean == 0 {
+		return 0
+	}
+	var sq float64
+	for _, c := range counts {
+		sq += (float64(c) - mean) * (float64(c) - mean)
+	}
+	return math.Sqrt(sq/float64(len(counts))) / mean
+}
+
+// AlgorithmReport returns the completed sessions (oldest first) followed by
+// the active one
+func (lb *LoadBalancer) AlgorithmReport() []AlgorithmSession {
+	now := lb.clock.Now().UTC()
+	stats := lb.snapshotClientStats()
+
+	s := lb.sessions
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]AlgorithmSession, 0, len(s.done)+1)
+	out = append(out, s.done...)
+	if s.current != nil {
+		out = append(out, s.current.report(stats, now))
+	}
+	return out
+}
+
+// handleAlgorithmReport はアルゴリズムごとの効率レポートを返す HTTP ハンドラです。
+// アルゴリズム切替で区切られたセッションごとに、ワーカー間リクエスト数の変動係数・平均/p95 レイテンシ・エラー率・リクエストあたりリトライ数を古い順に返します。
+// 最後の要素は現在アクティブなセッション (endedAt が null) です。アルゴリズム切替直後のセッションは warmupEndsAt までウォームアップ中 (warmingUp) として示され、
+// handoff には前のアルゴリズムから引き継いだ状態が入ります。
+func handleAlgorithmReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sessions": lb.AlgorithmReport(),
+	})
+}
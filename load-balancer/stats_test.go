@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAlgorithmReportSessions(t *testing.T) {
+	fast := newDelayStub(t, "fast", 0)
+	slow := newDelayStub(t, "slow", 30*time.Millisecond)
+
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("fast", fast.URL, "#FF0000", 1)
+	lb.AddWorker("slow", slow.URL, "#00FF00", 1)
+
+	run := func(n int) {
+		for i := 0; i < n; i++ {
+			if _, code, err := lb.ForwardRequest(TaskRequest{Weight: 1}); err != nil {
+				t.Fatalf("ForwardRequest: %d %v", code, err)
+			}
+		}
+	}
+
+	run(10)
+	lb.SetAlgorithm("least-connections")
+	// Sequential requests never overlap, so least-connections keeps
+	// choosing the first worker
+	run(10)
+
+	req := httptest.NewRequest(http.MethodGet, "/algorithm/report", nil)
+	rec := httptest.NewRecorder()
+	handleAlgorithmReport(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status code = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var body struct {
+		Sessions []AlgorithmSession `json:"sessions"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	if len(body.Sessions) != 2 {
+		t.Fatalf("sessions = %d, want 2", len(body.Sessions))
+	}
+	rr, lc := body.Sessions[0], body.Sessions[1]
+	if rr.Algorithm != "round-robin" || lc.Algorithm != "least-connections" {
+		t.Fatalf("session order = %s, %s", rr.Algorithm, lc.Algorithm)
+	}
+	if rr.EndedAt == nil || lc.EndedAt != nil {
+		t.Errorf("only the first session should be closed: %v, %v", rr.EndedAt, lc.EndedAt)
+	}
+	if rr.EndSeq == 0 || rr.EndSeq != lc.StartSeq {
+		t.Errorf("session boundary seq = %d/%d, want the algorithm change event", rr.EndSeq, lc.StartSeq)
+	}
+	if rr.Requests != 10 || lc.Requests != 10 {
+		t.Errorf("requests = %d/%d, want 10/10", rr.Requests, lc.Requests)
+	}
+	if rr.WorkerRequests["fast"] != 5 || lc.WorkerRequests["fast"] != 10 {
+		t.Errorf("worker requests = %v / %v", rr.WorkerRequests, lc.WorkerRequests)
+	}
+
+	// Round-robin spreads evenly but pays for the slow worker
+	if rr.RequestCV >= lc.RequestCV {
+		t.Errorf("request CV rr=%.2f lc=%.2f, want rr < lc", rr.RequestCV, lc.RequestCV)
+	}
+	if rr.MeanLatencyMs <= lc.MeanLatencyMs || rr.P95LatencyMs <= lc.P95LatencyMs {
+		t.Errorf("latency rr=%.1f/%.1f lc=%.1f/%.1f, want rr slower",
+			rr.MeanLatencyMs, rr.P95LatencyMs, lc.MeanLatencyMs, lc.P95LatencyMs)
+	}
+	if rr.ErrorRate != 0 || lc.ErrorRate != 0 {
+		t.Errorf("error rate = %v/%v, want 0", rr.ErrorRate, lc.ErrorRate)
+	}
+}
+
+func TestAlgorithmSessionRingBound(t *testing.T) {
+	lb := NewLoadBalancer("round-robin")
+	algos := []string{"random", "weighted"}
+	for i := 0; i < defaultSessionCapacity+5; i++ {
+		lb.SetAlgorithm(algos[i%2])
+	}
+	// Setting the same algorithm again is not a new session
+	lb.SetAlgorithm(algos[(defaultSessionCapacity+4)%2])
+
+	report := lb.AlgorithmReport()
+	if len(report) != defaultSessionCapacity+1 {
+		t.Fatalf("sessions = %d, want %d completed + active", len(report), defaultSessionCapacity)
+	}
+	for i := 1; i < len(report); i++ {
+		if report[i].StartSeq <= report[i-1].StartSeq {
+			t.Fatalf("sessions out of order at %d", i)
+		}
+	}
+}
+
+func TestStatsSnapshotQuantile(t *testing.T) {
+	var r rollingStats
+	for i := 0; i < 95; i++ {
+		r.observe(3*time.Millisecond, false)
+	}
+	for i := 0; i < 5; i++ {
+		r.observe(150*time.Millisecond, true)
+	}
+	s := r.snapshot()
+	if p := s.quantile(0.95); p < 2 || p > 5 {
+		t.Errorf("p95 = %.1f, want within the 2-5ms bucket", p)
+	}
+	if p := s.quantile(0.99); p < 100 || p > 200 {
+		t.Errorf("p99 = %.1f, want within the 100-200ms bucket", p)
+	}
+	if s.Errors != 5 || s.Requests != 100 {
+		t.Errorf("errors/requests = %d/%d", s.Errors, s.Requests)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"container/list"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sticky sessions: with the sticky algorithm a request carrying a session
+// ID, from the X-Session-ID header, the task's sessionId or the LB_SESSION
+// cookie in that order, is routed to the worker the session is bound to
+// while that worker is eligible. Otherwise it is routed round-robin and the
+// session is (re)bound to the worker that answered, which the response
+// cookie then names. Moving a session off its worker, e.g. because the
+// worker's circuit opened, raises a session_rebind event.
+const (
+	sessionCookieName = "LB_SESSION"
+	sessionHeader     = "X-Session-ID"
+	maxSessionIDLen   = 128
+	defaultSessionTTL = 30 * time.Minute
+	stickyCapacity    = 10000
+)
+
+// Outcomes of a sticky selection of a request carrying a session, the
+// labels of lb_sticky_affinity_total
+const (
+	stickyHit    = "hit"
+	stickyMiss   = "miss"
+	stickyRebind = "rebind"
+)
+
+// StickySession is one session of GET /sessions
+type StickySession struct {
+	ID        string    `json:"id"`
+	Worker    string    `json:"worker"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type stickyEntry struct {
+	id      string
+	worker  string
+	expires time.Time
+}
+
+// stickySessions maps session IDs to workers. Entries expire ttl after the
+// request that last used them. It is bounded: when full and nothing has
+// expired, binding a new session evicts the least recently used one.
+type stickySessions struct {
+	mu         sync.RWMutex
+	sessionMap map[string]*list.Element
+	// order holds the *stickyEntry values, most recently bound first
+	order    *list.List
+	ttl      time.Duration
+	capacity int
+}
+
+func newStickySessions(ttl time.Duration) *stickySessions {
+	return &stickySessions{sessionMap: make(map[string]*list.Element), order: list.New(), ttl: ttl, capacity: stickyCapacity}
+}
+
+// sessionTTLFromEnv reads SESSION_TTL_SECONDS
+func sessionTTLFromEnv() time.Duration {
+	if n, err := strconv.Atoi(getEnv("SESSION_TTL_SECONDS", "")); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return defaultSessionTTL
+}
+
+func (s *stickySessions) size() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.sessionMap)
+}
+
+func (s *stickySessions) bounds() storeBounds {
+	return storeBounds{Capacity: s.capacity, MaxAgeMs: s.ttl.Milliseconds()}
+}
+
+// sweep evicts the expired sessions
+func (s *stickySessions) sweep(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sweepLocked(now)
+}
+
+func (s *stickySessions) sweepLocked(now time.Time) int {
+	n := 0
+	for id, el := range s.sessionMap {
+		if !now.Before(el.Value.(*stickyEntry).expires) {
+			s.order.Remove(el)
+			delete(s.sessionMap, id)
+			n++
+		}
+	}
+	return n
+}
+
+// lookup returns the worker the session is bound to, if it has not expired
+func (s *stickySessions) lookup(id string, now time.Time) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	el, ok := s.sessionMap[id]
+	if !ok || !now.Before(el.Value.(*stickyEntry).expires) {
+		return "", false
+	}
+	return el.Value.(*stickyEntry).worker, true
+}
+
+// bind binds the session to worker for another ttl and returns the worker
+// it was bound to before, "" if none
+func (s *stickySessions) bind(id, worker string, now time.Time) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.sessionMap[id]; ok {
+		e := el.Value.(*stickyEntry)
+		prev := e.worker
+		if !now.Before(e.expires) {
+			prev = ""
+		}
+		e.worker, e.expires = worker, now.Add(s.ttl)
+		s.order.MoveToFront(el)
+		return prev
+	}
+	if len(s.sessionMap) >= s.capacity && s.sweepLocked(now) == 0 {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.sessionMap, oldest.Value.(*stickyEntry).id)
+	}
+	s.sessionMap[id] = s.order.PushFront(&stickyEntry{id: id, worker: worker, expires: now.Add(s.ttl)})
+	return ""
+}
+
+// evict removes the session and reports whether it existed
+func (s *stickySessions) evict(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.sessionMap[id]
+	if ok {
+		s.order.Remove(el)
+		delete(s.sessionMap, id)
+	}
+	return ok
+}
+
+// rename moves the sessions bound to worker from to worker to
+func (s *stickySessions) rename(from, to string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, el := range s.sessionMap {
+		if e := el.Value.(*stickyEntry); e.worker == from {
+			e.worker = to
+		}
+	}
+}
+
+// list returns the live sessions sorted by ID
+func (s *stickySessions) list(now time.Time) []StickySession {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]StickySession, 0, len(s.sessionMap))
+	for id, el := range s.sessionMap {
+		if e := el.Value.(*stickyEntry); now.Before(e.expires) {
+			out = append(out, StickySession{ID: id, Worker: e.worker, ExpiresAt: e.expires.UTC()})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// requestSession returns the session ID of r: its X-Session-ID header, or
+// else its LB_SESSION cookie. The task's sessionId, which ranks between
+// them, is applied by handleTask once the body is decoded.
+func requestSession(r *http.Request) (string, error) {
+	id := strings.TrimSpace(r.Header.Get(sessionHeader))
+	if id == "" {
+		return sessionCookie(r), nil
+	}
+	return id, validateSessionID(id, sessionHeader)
+}
+
+// validateSessionID checks the length of a client-chosen session ID
+func validateSessionID(id, source string) error {
+	if len(id) > maxSessionIDLen {
+		return fmt.Errorf("Invalid %s: must be at most %d characters", source, maxSessionIDLen)
+	}
+	return nil
+}
+
+// sessionCookie returns the LB_SESSION cookie of r, or ""
+func sessionCookie(r *http.Request) string {
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+func newSessionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// sticky picks the worker the session is bound to when it is a candidate,
+// otherwise the next one round-robin. Must be called with lb.mu held.
+func (lb *LoadBalancer) sticky(workers []*Worker, session string) *Worker {
+	if session == "" {
+		return lb.roundRobin(workers)
+	}
+	if name, ok := lb.stickySessions.lookup(session, lb.clock.Now()); ok {
+		for _, w := range workers {
+			if w.Name == name {
+				lb.metrics.stickyAffinityTotal.WithLabelValues(stickyHit).Inc()
+				return w
+			}
+		}
+	}
+	lb.metrics.stickyAffinityTotal.WithLabelValues(stickyMiss).Inc()
+	return lb.roundRobin(workers)
+}
+
+// bindSession binds the request's session, or a new one, to the worker that
+// answered and sets the cookie when the request was routed with the sticky
+// algorithm. Pinned requests leave the session alone.
+func (lb *LoadBalancer) bindSession(w http.ResponseWriter, h routeHints, worker string) {
+	lb.mu.RLock()
+	algorithm := lb.algorithm
+	lb.mu.RUnlock()
+	if h.algorithm != "" {
+		algorithm = h.algorithm
+	}
+	if algorithm != "sticky" || worker == "" || h.require != "" {
+		return
+	}
+	id := h.session
+	if id == "" {
+		id = newSessionID()
+	}
+	if prev := lb.stickySessions.bind(id, worker, lb.clock.Now()); prev != "" && prev != worker {
+		lb.metrics.stickyAffinityTotal.WithLabelValues(stickyRebind).Inc()
+		lb.emitEvent("session_rebind", fmt.Sprintf("Session %s moved from %s to %s", id, prev, worker), map[string]interface{}{
+			"session": id,
+			"from":    prev,
+			"to":      worker,
+		})
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(lb.stickySessions.ttl.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// handleSessions は GET /sessions で sticky アルゴリズムのセッション (X-Session-ID ヘッダー、タスクの sessionId または LB_SESSION クッキー) とワーカーの対応を返す HTTP ハンドラです。
+func handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ttlSeconds": int(lb.stickySessions.ttl.Seconds()),
+		"sessions":   lb.stickySessions.list(lb.clock.Now()),
+	})
+}
+
+// handleSession は DELETE /sessions/{id} でセッションを 1 件削除する HTTP ハンドラです。
+// 削除されたセッションの次のリクエストはラウンドロビンで振り分けられ、新しいワーカーに結び付けられます。
+func handleSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/api")
+	id = strings.Trim(strings.TrimPrefix(id, "/sessions/"), "/")
+	if id == "" {
+		http.Error(w, "Session id required", http.StatusBadRequest)
+		return
+	}
+	if !lb.stickySessions.evict(id) {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
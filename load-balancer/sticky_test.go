@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// doStickyTask sends a task with the session cookie, if any, and returns the
+// worker that served it and the session cookie of the response
+func doStickyTask(t *testing.T, session string) (string, string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/task", bytes.NewBufferString(`{"id":"t","weight":1}`))
+	if session != "" {
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: session})
+	}
+	rec := httptest.NewRecorder()
+	handleTask(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status code = %d: %s", rec.Code, rec.Body)
+	}
+	var cookie string
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == sessionCookieName {
+			cookie = c.Value
+		}
+	}
+	return servedBy(t, rec), cookie
+}
+
+func listSessions(t *testing.T) []StickySession {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleSessions(rec, httptest.NewRequest(http.MethodGet, "/sessions", nil))
+	var resp struct {
+		Sessions []StickySession `json:"sessions"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return resp.Sessions
+}
+
+func TestStickySessions(t *testing.T) {
+	clk := newFakeClock()
+	lb = NewLoadBalancer("sticky")
+	lb.clock = clk
+	lb.stickySessions = newStickySessions(time.Minute)
+	for _, name := range []string{"worker-1", "worker-2", "worker-3"} {
+		lb.AddWorker(name, newDelayStub(t, name, 0).URL, "#FF0000", 1)
+	}
+
+	// A request without a session gets one bound to the worker that served it
+	home, session := doStickyTask(t, "")
+	if session == "" {
+		t.Fatal("no session cookie set")
+	}
+	for i := 0; i < 5; i++ {
+		if got, cookie := doStickyTask(t, session); got != home || cookie != session {
+			t.Fatalf("request %d served by %s with cookie %q, want %s with %q", i, got, cookie, home, session)
+		}
+	}
+	if s := listSessions(t); len(s) != 1 || s[0].ID != session || s[0].Worker != home || !s[0].ExpiresAt.Equal(clk.Now().Add(time.Minute)) {
+		t.Errorf("sessions = %+v", s)
+	}
+
+	// The session moves when its worker is no longer eligible
+	lb.mu.Lock()
+	lb.findWorkerLocked(home).Healthy = false
+	lb.mu.Unlock()
+	moved, cookie := doStickyTask(t, session)
+	if moved == home || cookie != session {
+		t.Fatalf("served by %s with cookie %q after %s went down", moved, cookie, home)
+	}
+	lb.mu.Lock()
+	lb.findWorkerLocked(home).Healthy = true
+	lb.mu.Unlock()
+	if got, _ := doStickyTask(t, session); got != moved {
+		t.Errorf("served by %s, want the session to stay on %s", got, moved)
+	}
+
+	// An unknown session is bound like a new one under its own ID
+	if _, cookie := doStickyTask(t, "client-chosen"); cookie != "client-chosen" {
+		t.Errorf("cookie = %q, want the request's session", cookie)
+	}
+
+	// Eviction
+	rec := httptest.NewRecorder()
+	handleSession(rec, httptest.NewRequest(http.MethodDelete, "/sessions/"+session, nil))
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	rec = httptest.NewRecorder()
+	handleSession(rec, httptest.NewRequest(http.MethodDelete, "/api/sessions/"+session, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("second DELETE status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if s := listSessions(t); len(s) != 1 || s[0].ID != "client-chosen" {
+		t.Errorf("sessions after eviction = %+v", s)
+	}
+
+	// Sessions expire after the TTL
+	clk.Advance(time.Minute)
+	if s := listSessions(t); len(s) != 0 {
+		t.Errorf("sessions after the TTL = %+v", s)
+	}
+	if n := lb.stickySessions.sweep(clk.Now()); n != 1 || lb.stickySessions.size() != 0 {
+		t.Errorf("sweep evicted %d, %d left", n, lb.stickySessions.size())
+	}
+}
+
+func TestStickyCookieOnlyWithSticky(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", newDelayStub(t, "worker-1", 0).URL, "#FF0000", 1)
+	if _, cookie := doStickyTask(t, ""); cookie != "" {
+		t.Errorf("round-robin set a session cookie %q", cookie)
+	}
+}
+
+// doSessionTask sends a task with the session in the X-Session-ID header, or
+// in the body as sessionId when inBody is set, and returns the response
+func doSessionTask(session string, inBody bool) *httptest.ResponseRecorder {
+	body := `{"id":"t","weight":1}`
+	if inBody {
+		body = `{"id":"t","weight":1,"sessionId":"` + session + `"}`
+	}
+	req := httptest.NewRequest(http.MethodPost, "/task", bytes.NewBufferString(body))
+	if !inBody {
+		req.Header.Set(sessionHeader, session)
+	}
+	rec := httptest.NewRecorder()
+	handleTask(rec, req)
+	return rec
+}
+
+func TestStickySessionHeaderAndRebind(t *testing.T) {
+	lb = NewLoadBalancer("sticky")
+	lb.circuitThreshold = 1
+	lb.circuitResetInterval = time.Hour
+	for _, name := range []string{"worker-1", "worker-2", "worker-3"} {
+		lb.AddWorker(name, newDelayStub(t, name, 0).URL, "#FF0000", 1)
+	}
+	affinity := func(outcome string) float64 {
+		return testutil.ToFloat64(lb.metrics.stickyAffinityTotal.WithLabelValues(outcome))
+	}
+
+	home := servedBy(t, doSessionTask("alice", false))
+	for i := 0; i < 3; i++ {
+		if got := servedBy(t, doSessionTask("alice", false)); got != home {
+			t.Fatalf("header session served by %s, want %s", got, home)
+		}
+		if got := servedBy(t, doSessionTask("alice", true)); got != home {
+			t.Fatalf("body session served by %s, want %s", got, home)
+		}
+	}
+	if affinity(stickyMiss) != 1 || affinity(stickyHit) != 6 {
+		t.Errorf("affinity: %v misses, %v hits, want 1 and 6", affinity(stickyMiss), affinity(stickyHit))
+	}
+	if n := lb.GetStatus()["stickySessions"]; n != 1 {
+		t.Errorf("status stickySessions = %v, want 1", n)
+	}
+
+	// The header wins over the body
+	req := httptest.NewRequest(http.MethodPost, "/task", bytes.NewBufferString(`{"id":"t","weight":1,"sessionId":"bob"}`))
+	req.Header.Set(sessionHeader, "alice")
+	rec := httptest.NewRecorder()
+	handleTask(rec, req)
+	if got := servedBy(t, rec); got != home || lb.stickySessions.size() != 1 {
+		t.Errorf("served by %s with %d sessions, want %s and the header's session", got, lb.stickySessions.size(), home)
+	}
+
+	// An open circuit moves the session, which is recorded
+	lb.mu.Lock()
+	w := lb.findWorkerLocked(home)
+	lb.mu.Unlock()
+	lb.recordFailure(w)
+	moved := servedBy(t, doSessionTask("alice", false))
+	if moved == home {
+		t.Fatalf("still served by %s with its circuit open", home)
+	}
+	if got := servedBy(t, doSessionTask("alice", false)); got != moved {
+		t.Errorf("served by %s after the rebind, want %s", got, moved)
+	}
+	var rebinds []Event
+	for _, e := range lb.events.since(0, 0) {
+		if e.Type == "session_rebind" {
+			rebinds = append(rebinds, e)
+		}
+	}
+	if len(rebinds) != 1 || rebinds[0].Data["from"] != home || rebinds[0].Data["to"] != moved || affinity(stickyRebind) != 1 {
+		t.Errorf("rebind events = %+v, metric %v", rebinds, affinity(stickyRebind))
+	}
+
+	// Oversized session IDs are refused
+	long := strings.Repeat("x", maxSessionIDLen+1)
+	for _, inBody := range []bool{false, true} {
+		if rec := doSessionTask(long, inBody); rec.Code != http.StatusBadRequest {
+			t.Errorf("oversized session (body %v): status %d, want 400", inBody, rec.Code)
+		}
+	}
+}
+
+func TestStickySessionsLRU(t *testing.T) {
+	now := time.Now()
+	s := newStickySessions(time.Minute)
+	s.capacity = 3
+	s.bind("a", "worker-1", now)
+	s.bind("b", "worker-1", now)
+	s.bind("c", "worker-2", now)
+	// Using a makes b the least recently used
+	if prev := s.bind("a", "worker-2", now); prev != "worker-1" {
+		t.Errorf("rebinding a returned %q, want worker-1", prev)
+	}
+	s.bind("d", "worker-3", now)
+	if _, ok := s.lookup("b", now); ok || s.size() != 3 {
+		t.Errorf("b kept with %d sessions, want it evicted", s.size())
+	}
+	for _, id := range []string{"a", "c", "d"} {
+		if _, ok := s.lookup(id, now); !ok {
+			t.Errorf("%s evicted", id)
+		}
+	}
+
+	// Expired sessions go before live ones
+	later := now.Add(time.Minute)
+	s.bind("a", "worker-1", later.Add(-time.Second))
+	s.bind("e", "worker-1", later)
+	if _, ok := s.lookup("a", later); !ok || s.size() != 2 {
+		t.Errorf("a evicted or %d sessions, want only the expired ones dropped", s.size())
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newDelayStub returns a worker that answers each task as name after delay,
+// or gives up when the LB cancels the request
+func newDelayStub(t *testing.T, name string, delay time.Duration) *httptest.Server {
+	t.Helper()
+	srv, _ := newCountingStub(t, name, delay)
+	return srv
+}
+
+// newCountingStub is newDelayStub that also counts the tasks it receives
+func newCountingStub(t *testing.T, name string, delay time.Duration) (*httptest.Server, *int32) {
+	t.Helper()
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"worker": name})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// Task tag limits, checked when a task arrives
+const (
+	maxTaskTags    = 8
+	maxTagKeyLen   = 32
+	maxTagValueLen = 64
+)
+
+// Per-tag accounting bounds. At most tagKeyCapacity keys and, per key,
+// TagCardinalityLimit values are accounted under their own name; the rest
+// are rejected or hashed into tagOverflowBuckets buckets.
+const (
+	tagKeyCapacity             = 64
+	tagOverflowBuckets         = 16
+	defaultTagCardinalityLimit = 100
+	maxTagCardinalityLimit     = 10000
+)
+
+// Tag overflow policies
+const (
+	tagOverflowHash   = "hash"
+	tagOverflowReject = "reject"
+)
+
+// validTagKey reports whether k is a non-empty tag key of [A-Za-z0-9_.-]
+func validTagKey(k string) bool {
+	if k == "" || len(k) > maxTagKeyLen {
+		return false
+	}
+	for _, c := range k {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == '.', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validateTags checks the number and size of a task's tags
+func validateTags(tags map[string]string) error {
+	if len(tags) > maxTaskTags {
+		return fmt.Errorf("at most %d tags are allowed", maxTaskTags)
+	}
+	for k, v := range tags {
+		if !validTagKey(k) {
+			return fmt.Errorf("tag key %q must be 1-%d characters of [A-Za-z0-9_.-]", k, maxTagKeyLen)
+		}
+		if len(v) > maxTagValueLen {
+			return fmt.Errorf("tag %s: value must be at most %d characters", k, maxTagValueLen)
+		}
+	}
+	return nil
+}
+
+// tagOverflowName returns the overflow bucket s is accounted under
+func tagOverflowName(s string) string {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return fmt.Sprintf("overflow-%02x", h.Sum32()%tagOverflowBuckets)
+}
+
+// tagCardinalityError is returned by admit when the reject policy turns a
+// task away
+type tagCardinalityError struct {
+	key string
+}
+
+func (e *tagCardinalityError) Error() string {
+	if e.key == "" {
+		return fmt.Sprintf("tag key limit reached (%d)", tagKeyCapacity)
+	}
+	return fmt.Sprintf("tag %s: value cardinality limit reached", e.key)
+}
+
+// tagStats accounts tasks per tag key and value
+type tagStats struct {
+	mu     sync.Mutex
+	keys   map[string]map[string]*rollingStats
+	limit  int
+	policy string
+}
+
+func newTagStats() *tagStats {
+	return &tagStats{
+		keys:   make(map[string]map[string]*rollingStats),
+		limit:  defaultTagCardinalityLimit,
+		policy: tagOverflowHash,
+	}
+}
+
+func (s *tagStats) size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, values := range s.keys {
+		n += len(values)
+	}
+	return n
+}
+
+func (s *tagStats) bounds() storeBounds {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return storeBounds{Capacity: (tagKeyCapacity + tagOverflowBuckets) * (s.limit + tagOverflowBuckets)}
+}
+
+// sweep is a no-op: tag stats are cumulative and bounded by cardinality
+func (s *tagStats) sweep(now time.Time) int { return 0 }
+
+// configure sets the cardinality limit and overflow policy. Values already
+// accounted are kept.
+func (s *tagStats) configure(limit int, policy string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit, s.policy = limit, policy
+}
+
+// config returns the cardinality limit and overflow policy
+func (s *tagStats) config() (int, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.limit, s.policy
+}
+
+// admit returns the names tags are accounted under, creating their entries.
+// Under the reject policy a tag beyond the cardinality limits fails the whole
+// task and nothing is created.
+func (s *tagStats) admit(tags map[string]string) (map[string]string, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]string, len(tags))
+	for k, v := range tags {
+		values, known := s.keys[k]
+		switch {
+		case !known && len(s.keys) >= tagKeyCapacity:
+			if s.policy == tagOverflowReject {
+				return nil, &tagCardinalityError{}
+			}
+			k, v = tagOverflowName(k), tagOverflowName(v)
+		case values[v] == nil && len(values) >= s.limit:
+			if s.policy == tagOverflowReject {
+				return nil, &tagCardinalityError{key: k}
+			}
+			v = tagOverflowName(v)
+		}
+		out[k] = v
+	}
+	for k, v := range out {
+		if s.keys[k] == nil {
+			s.keys[k] = make(map[string]*rollingStats)
+		}
+		if s.keys[k][v] == nil {
+			s.keys[k][v] = &rollingStats{}
+		}
+	}
+	return out, nil
+}
+
+// observe records a task accounted under the names admit returned
+func (s *tagStats) observe(accounted map[string]string, latency time.Duration, failed bool) {
+	s.mu.Lock()
+	stats := make([]*rollingStats, 0, len(accounted))
+	for k, v := range accounted {
+		stats = append(stats, s.keys[k][v])
+	}
+	s.mu.Unlock()
+	for _, st := range stats {
+		st.observe(latency, failed)
+	}
+}
+
+// TagValueStats summarises the tasks carrying one tag value
+type TagValueStats struct {
+	Value         string  `json:"value"`
+	Requests      int64   `json:"requests"`
+	Errors        int64   `json:"errors"`
+	MeanLatencyMs float64 `json:"meanLatencyMs"`
+	P50LatencyMs  float64 `json:"p50LatencyMs"`
+	P95LatencyMs  float64 `json:"p95LatencyMs"`
+}
+
+// report returns the stats of every value of key, most requested first
+func (s *tagStats) report(key string) []TagValueStats {
+	s.mu.Lock()
+	values := make(map[string]*rollingStats, len(s.keys[key]))
+	for v, st := range s.keys[key] {
+		values[v] = st
+	}
+	s.mu.Unlock()
+
+	out := make([]TagValueStats, 0, len(values))
+	for v, st := range values {
+		snap := st.snapshot()
+		tv := TagValueStats{
+			Value:        v,
+			Requests:     snap.Requests,
+			Errors:       snap.Errors,
+			P50LatencyMs: snap.quantile(0.5),
+			P95LatencyMs: snap.quantile(0.95),
+		}
+		if snap.Requests > 0 {
+			tv.MeanLatencyMs = snap.LatencySumMs / float64(snap.Requests)
+		}
+		out = append(out, tv)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Requests != out[j].Requests {
+			return out[i].Requests > out[j].Requests
+		}
+		return out[i].Value < out[j].Value
+	})
+	return out
+}
+
+// keyNames returns the accounted tag keys in order
+func (s *tagStats) keyNames() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]string, 0, len(s.keys))
+	for k := range s.keys {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// admitTags validates a task's tags and accounts them, writing a 400 and
+// returning false when the task must be turned away
+func (lb *LoadBalancer) admitTags(w http.ResponseWriter, tags map[string]string) (map[string]string, bool) {
+	err := validateTags(tags)
+	var accounted map[string]string
+	if err == nil {
+		accounted, err = lb.tags.admit(tags)
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(api.ErrorResponse{Error: err.Error(), Field: "tags"})
+		return nil, false
+	}
+	for k, v := range accounted {
+		lb.metrics.taskTags.WithLabelValues(k, v).Inc()
+	}
+	return accounted, true
+}
+
+// handleTagStats は GET /stats/tags?key=<key> でタグ値ごとのタスク数、エラー数、レイテンシの平均と p50/p95 を返す HTTP ハンドラです。
+// key を省略した場合は集計中のタグキーの一覧を返します。
+func handleTagStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": lb.tags.keyNames()})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"key":    key,
+		"values": lb.tags.report(key),
+	})
+}
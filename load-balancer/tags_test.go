@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/network-sandbox/load-balancer/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newTagEchoWorker answers every task with the tags it received
+func newTagEchoWorker(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var task TaskRequest
+		json.NewDecoder(r.Body).Decode(&task)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(api.TaskResponse{ID: task.ID, Worker: "worker-1", Tags: task.Tags})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func postTaggedTask(tags string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	body := fmt.Sprintf(`{"id":"t","weight":1,"tags":%s}`, tags)
+	handleTask(rec, httptest.NewRequest(http.MethodPost, "/task", bytes.NewBufferString(body)))
+	return rec
+}
+
+func setTagLimits(t *testing.T, limit int, policy string) {
+	t.Helper()
+	s := lb.Settings()
+	s.TagCardinalityLimit, s.TagOverflowPolicy = limit, policy
+	if _, err := lb.UpdateSettings(s); err != nil {
+		t.Fatalf("UpdateSettings: %v", err)
+	}
+}
+
+func TestTaskTagsPropagation(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", newTagEchoWorker(t).URL, "#FF0000", 1)
+
+	rec := postTaggedTask(`{"scenario":"burst-1","team":"blue"}`)
+	var resp api.TaskResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("task: %d %v", rec.Code, err)
+	}
+	if resp.Tags["scenario"] != "burst-1" || resp.Tags["team"] != "blue" {
+		t.Errorf("echoed tags = %v", resp.Tags)
+	}
+	postTaggedTask(`{"scenario":"burst-1"}`)
+	postTaggedTask(`{"scenario":"steady"}`)
+
+	srv := httptest.NewServer(newMux())
+	defer srv.Close()
+	res, err := http.Get(srv.URL + "/api/stats/tags?key=scenario")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var report struct {
+		Key    string          `json:"key"`
+		Values []TagValueStats `json:"values"`
+	}
+	json.NewDecoder(res.Body).Decode(&report)
+	if len(report.Values) != 2 || report.Values[0].Value != "burst-1" || report.Values[0].Requests != 2 || report.Values[1].Requests != 1 {
+		t.Fatalf("report = %+v", report)
+	}
+	if report.Values[0].MeanLatencyMs <= 0 || report.Values[0].P95LatencyMs <= 0 {
+		t.Errorf("latency summary = %+v", report.Values[0])
+	}
+	if got := testutil.ToFloat64(lb.metrics.taskTags.WithLabelValues("team", "blue")); got != 1 {
+		t.Errorf("team=blue counter = %v, want 1", got)
+	}
+}
+
+func TestTaskTagsValidation(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", newTagEchoWorker(t).URL, "#FF0000", 1)
+
+	tooMany := make([]string, maxTaskTags+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf(`"k%d":"v"`, i)
+	}
+	for name, tags := range map[string]string{
+		"count":      "{" + strings.Join(tooMany, ",") + "}",
+		"key chars":  `{"team name":"blue"}`,
+		"key length": fmt.Sprintf(`{"%s":"v"}`, strings.Repeat("k", maxTagKeyLen+1)),
+		"value":      fmt.Sprintf(`{"k":"%s"}`, strings.Repeat("v", maxTagValueLen+1)),
+	} {
+		rec := postTaggedTask(tags)
+		var body api.ErrorResponse
+		json.NewDecoder(rec.Body).Decode(&body)
+		if rec.Code != http.StatusBadRequest || body.Field != "tags" {
+			t.Errorf("%s: %d %+v, want 400 on tags", name, rec.Code, body)
+		}
+	}
+}
+
+func TestTaskTagsCardinality(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", newTagEchoWorker(t).URL, "#FF0000", 1)
+	setTagLimits(t, 2, tagOverflowHash)
+
+	for _, v := range []string{"a", "b", "c", "d", "a"} {
+		if rec := postTaggedTask(fmt.Sprintf(`{"user":"%s"}`, v)); rec.Code != http.StatusOK {
+			t.Fatalf("user=%s: %d", v, rec.Code)
+		}
+	}
+	values := map[string]int64{}
+	for _, v := range lb.tags.report("user") {
+		values[v.Value] = v.Requests
+	}
+	if values["a"] != 2 || values["b"] != 1 || values[tagOverflowName("c")] == 0 || values[tagOverflowName("d")] == 0 {
+		t.Errorf("values = %v, want c and d in overflow buckets", values)
+	}
+	if len(values) > 2+tagOverflowBuckets {
+		t.Errorf("%d values accounted, want at most %d", len(values), 2+tagOverflowBuckets)
+	}
+
+	setTagLimits(t, 2, tagOverflowReject)
+	if rec := postTaggedTask(`{"user":"e"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("new value under reject: %d, want 400", rec.Code)
+	}
+	if rec := postTaggedTask(`{"user":"b"}`); rec.Code != http.StatusOK {
+		t.Errorf("known value under reject: %d, want 200", rec.Code)
+	}
+
+	s := lb.Settings()
+	s.TagOverflowPolicy = "drop"
+	if err := validateSettings(s); err == nil || err.(*SettingsError).Field != "tagOverflowPolicy" {
+		t.Errorf("policy: err = %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// Default and minimum broadcast interval
+const (
+	defaultBroadcastInterval = time.Second
+	minBroadcastInterval     = 100 * time.Millisecond
+)
+
+// loopTicker paces a background loop whose interval is a runtime setting.
+// The loop waits for the interval to pass since its last tick, and starts
+// waiting again whenever the interval changes or a run is triggered from
+// outside it, so both take effect immediately.
+type loopTicker struct {
+	mu       sync.Mutex
+	anchor   time.Time // when the loop started or last ticked
+	lastTick time.Time
+	reset    chan struct{}
+}
+
+func newLoopTicker() *loopTicker {
+	return &loopTicker{reset: make(chan struct{}, 1)}
+}
+
+// wake makes the loop recompute its wait
+func (t *loopTicker) wake() {
+	select {
+	case t.reset <- struct{}{}:
+	default:
+	}
+}
+
+// ticked records a run at now and restarts the wait for the next one
+func (t *loopTicker) ticked(now time.Time) {
+	t.mu.Lock()
+	t.anchor, t.lastTick = now, now
+	t.mu.Unlock()
+	t.wake()
+}
+
+// due returns how long after now the next tick is due
+func (t *loopTicker) due(now time.Time, interval time.Duration) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return interval - now.Sub(t.anchor)
+}
+
+// mark records a tick at now without restarting the wait, for a loop whose
+// status stands for others that do the work
+func (t *loopTicker) mark(now time.Time) {
+	t.mu.Lock()
+	t.lastTick = now
+	t.mu.Unlock()
+}
+
+func (t *loopTicker) last() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lastTick
+}
+
+// runLoop calls tick every interval() until ctx is done
+func (lb *LoadBalancer) runLoop(ctx context.Context, t *loopTicker, interval func() time.Duration, tick func()) {
+	t.mu.Lock()
+	t.anchor = lb.clock.Now()
+	t.mu.Unlock()
+	for {
+		if wait := t.due(lb.clock.Now(), interval()); wait > 0 {
+			timer := lb.clock.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-t.reset:
+				timer.Stop()
+				continue
+			case <-timer.C():
+			}
+		}
+		t.ticked(lb.clock.Now())
+		// Drop the wake-up of our own tick
+		select {
+		case <-t.reset:
+		default:
+		}
+		tick()
+	}
+}
+
+// LoopStatus is a background loop's entry in the status document
+type LoopStatus = api.LoopStatus
+
+func loopStatus(t *loopTicker, interval time.Duration) LoopStatus {
+	s := LoopStatus{IntervalMs: interval.Milliseconds()}
+	if last := t.last(); !last.IsZero() {
+		last = last.UTC()
+		s.LastTick = &last
+	}
+	return s
+}
+
+// loopsLocked returns the status of the broadcast and health check loops.
+// Must be called with lb.mu held.
+func (lb *LoadBalancer) loopsLocked() api.Loops {
+	return api.Loops{
+		Broadcast:   loopStatus(lb.broadcastLoop, lb.broadcastInterval),
+		HealthCheck: loopStatus(lb.healthLoop, lb.healthInterval),
+	}
+}
+
+// BroadcastNow broadcasts the status right away and restarts the broadcast
+// interval
+func (lb *LoadBalancer) BroadcastNow() {
+	lb.broadcastLoop.ticked(lb.clock.Now())
+	lb.BroadcastStatus()
+}
+
+// HealthCheckNow checks every worker right away, returning once all checks
+// are done, and restarts every worker's health check interval. A worker
+// whose previous check is still in flight is not probed again.
+func (lb *LoadBalancer) HealthCheckNow() {
+	now := lb.clock.Now()
+	lb.healthLoop.ticked(now)
+	lb.mu.RLock()
+	workers := make([]*Worker, len(lb.workers))
+	copy(workers, lb.workers)
+	for _, w := range workers {
+		if w.healthLoop != nil {
+			w.healthLoop.ticked(now)
+		}
+	}
+	lb.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		if !w.beginCheck() {
+			continue
+		}
+		wg.Add(1)
+		go func(w *Worker) {
+			defer wg.Done()
+			defer w.endCheck()
+			lb.checkWorker(w)
+		}(w)
+	}
+	wg.Wait()
+}
+
+// handleBroadcastNow は POST /broadcast/now で状態のブロードキャストを即座に実行する HTTP ハンドラです。
+// 定期ブロードキャストの間隔はこの時点から数え直され、実行後のループ状態を返します。
+func handleBroadcastNow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	lb.BroadcastNow()
+	lb.mu.RLock()
+	status := loopStatus(lb.broadcastLoop, lb.broadcastInterval)
+	lb.mu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleHealthCheckNow は POST /healthcheck/now で全ワーカーのヘルスチェックを即座に実行する HTTP ハンドラです。
+// 全てのチェックが終わってから、ループ状態と各ワーカーのヘルス状態を返します。定期チェックの間隔はこの時点から数え直されます。
+func handleHealthCheckNow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	lb.HealthCheckNow()
+	lb.mu.RLock()
+	status := loopStatus(lb.healthLoop, lb.healthInterval)
+	workers := make(map[string]string, len(lb.workers))
+	for _, wk := range lb.workers {
+		workers[wk.Name] = wk.healthStateLocked()
+	}
+	lb.mu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"intervalMs": status.IntervalMs,
+		"lastTick":   status.LastTick,
+		"workers":    workers,
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// waitForTick polls until the loop's last tick is at want
+func waitForTick(t *testing.T, loop *loopTicker, want time.Time) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !loop.last().Equal(want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("last tick = %v, want %v", loop.last(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBroadcastIntervalAppliesWithoutRestart(t *testing.T) {
+	clk := newFakeClock()
+	lb := NewLoadBalancer("round-robin")
+	lb.clock = clk
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lb.StartBroadcast(ctx, time.Second)
+	clk.waitForTimer(t)
+
+	clk.Advance(time.Second)
+	waitForTick(t, lb.broadcastLoop, clk.Now())
+	clk.waitForTimer(t)
+
+	s := lb.Settings()
+	s.BroadcastIntervalMs = 200
+	if _, err := lb.UpdateSettings(s); err != nil {
+		t.Fatalf("UpdateSettings: %v", err)
+	}
+	clk.waitForTimer(t)
+	for i := 0; i < 3; i++ {
+		clk.Advance(200 * time.Millisecond)
+		waitForTick(t, lb.broadcastLoop, clk.Now())
+		clk.waitForTimer(t)
+	}
+
+	loops := lb.GetStatus()["loops"].(api.Loops)
+	if loops.Broadcast.IntervalMs != 200 || !loops.Broadcast.LastTick.Equal(clk.Now()) {
+		t.Errorf("broadcast loop = %+v, want 200ms and last tick at %v", loops.Broadcast, clk.Now())
+	}
+	if loops.HealthCheck.LastTick != nil {
+		t.Errorf("health check loop never ran but reports a tick at %v", loops.HealthCheck.LastTick)
+	}
+
+	s.BroadcastIntervalMs = 50
+	var se *SettingsError
+	if _, err := lb.UpdateSettings(s); !errors.As(err, &se) || se.Field != "broadcastIntervalMs" {
+		t.Errorf("50ms broadcast interval: %v, want a broadcastIntervalMs error", err)
+	}
+}
+
+func TestHealthCheckNow(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	clk := newFakeClock()
+	lb = NewLoadBalancer("round-robin")
+	lb.clock = clk
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lb.HealthCheck(ctx, time.Second)
+	clk.waitForTimer(t)
+	clk.Advance(600 * time.Millisecond)
+
+	mux := newMux()
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/healthcheck/now", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	var resp struct {
+		LastTick time.Time         `json:"lastTick"`
+		Workers  map[string]string `json:"workers"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if atomic.LoadInt32(&hits) != 1 || !resp.LastTick.Equal(clk.Now()) || resp.Workers["worker-1"] != healthStateHealthy {
+		t.Errorf("after the run: %d checks, response %+v", atomic.LoadInt32(&hits), resp)
+	}
+
+	// The loop's next check is a full interval after the triggered one
+	clk.waitForTimer(t)
+	clk.Advance(600 * time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Fatalf("checks 600ms after the run = %d, want 1", got)
+	}
+	clk.Advance(400 * time.Millisecond)
+	waitForHits(t, &hits, 2)
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/broadcast/now", nil))
+	if rec.Code != http.StatusOK || !lb.broadcastLoop.last().Equal(clk.Now()) {
+		t.Errorf("broadcast now: %d, last tick %v", rec.Code, lb.broadcastLoop.last())
+	}
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthcheck/now", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: %d, want 405", rec.Code)
+	}
+}
+
+// newStalledWorker returns a worker whose health endpoint blocks until
+// release is closed, counting the probes it receives
+func newStalledWorker(t *testing.T, hits *int32, release chan struct{}) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestUnboundedGoroutines(t *testing.T) {
+	var hits int32
+	release := make(chan struct{})
+	defer close(release)
+	lb := NewLoadBalancer("round-robin")
+	lb.healthTimeout = 10 * time.Second
+	for i := 0; i < 10; i++ {
+		lb.AddWorker(fmt.Sprintf("worker-%d", i), newStalledWorker(t, &hits, release).URL, "#FF0000", 1)
+	}
+
+	initial := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		for _, w := range lb.workers {
+			lb.startCheck(w)
+		}
+	}
+	waitForHits(t, &hits, 10)
+	if n := runtime.NumGoroutine(); n > initial+300 {
+		t.Errorf("%d goroutines after 100 ticks against stalled workers, started with %d", n, initial)
+	}
+	if got := atomic.LoadInt32(&hits); got != 10 {
+		t.Errorf("stalled workers got %d probes, want one each", got)
+	}
+}
+
+func TestHealthCheckAfterSlowProbe(t *testing.T) {
+	var hits int32
+	release := make(chan struct{})
+	clk := newFakeClock()
+	lb := NewLoadBalancer("round-robin")
+	lb.clock = clk
+	lb.healthTimeout = 10 * time.Second
+	lb.AddWorker("worker-1", newStalledWorker(t, &hits, release).URL, "#FF0000", 1)
+	w := lb.workers[0]
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lb.HealthCheck(ctx, time.Second)
+	clk.waitForTimer(t)
+
+	clk.Advance(time.Second)
+	waitForHits(t, &hits, 1)
+	clk.waitForTimer(t)
+
+	// The probe is still running: this tick skips the worker
+	clk.Advance(time.Second)
+	waitForTick(t, lb.healthLoop, clk.Now())
+	clk.waitForTimer(t)
+	time.Sleep(20 * time.Millisecond)
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Fatalf("probes while the first is in flight = %d, want 1", got)
+	}
+
+	close(release)
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&w.checking) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("slow probe never completed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	clk.Advance(time.Second)
+	waitForHits(t, &hits, 2)
+}
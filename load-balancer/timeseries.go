@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Timeseries sampling. One sample per metric per worker (plus the pool) is
+// taken every timeseriesInterval and kept for the retention period, so memory
+// is bounded by (workers+1) × len(timeseriesMetrics) × retention/interval
+// float64 values plus one int64 timestamp per slot: with 6 workers and the
+// maximum 15 minute retention that is 7 × 3 × 900 × 8 B + 900 × 8 B ≈ 158 KB.
+const (
+	timeseriesInterval         = time.Second
+	defaultTimeseriesRetention = 5 * time.Minute
+	maxTimeseriesRetention     = 15 * time.Minute
+	defaultTimeseriesWindow    = 60 * time.Second
+)
+
+// timeseriesMetrics are the sampled metrics, in storage order
+var timeseriesMetrics = []string{"rps", "latency", "errors"}
+
+// workerSeries holds one ring per metric for a worker (or the pool)
+type workerSeries struct {
+	values  [][]float64
+	prev    statsSnapshot
+	hasPrev bool
+}
+
+// timeseriesStore is a set of aligned ring buffers sharing one timestamp ring
+type timeseriesStore struct {
+	mu       sync.Mutex
+	capacity int
+	times    []int64
+	next     int
+	filled   int
+	workers  map[string]*workerSeries
+	pool     *workerSeries
+}
+
+func newTimeseriesStore(retention time.Duration) *timeseriesStore {
+	if retention <= 0 {
+		retention = defaultTimeseriesRetention
+	}
+	if retention > maxTimeseriesRetention {
+		retention = maxTimeseriesRetention
+	}
+	capacity := int(retention / timeseriesInterval)
+	s := &timeseriesStore{
+		capacity: capacity,
+		times:    make([]int64, capacity),
+		workers:  make(map[string]*workerSeries),
+	}
+	s.pool = s.newSeries()
+	return s
+}
+
+// timeseriesRetentionFromEnv reads LB_TIMESERIES_RETENTION (e.g. "10m")
+func timeseriesRetentionFromEnv() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("LB_TIMESERIES_RETENTION")); err == nil {
+		return d
+	}
+	return defaultTimeseriesRetention
+}
+
+// newSeries allocates rings pre-filled with NaN (no sample)
+func (s *timeseriesStore) newSeries() *workerSeries {
+	ws := &workerSeries{values: make([][]float64, len(timeseriesMetrics))}
+	for m := range ws.values {
+		ws.values[m] = make([]float64, s.capacity)
+		for i := range ws.values[m] {
+			ws.values[m][i] = math.NaN()
+		}
+	}
+	return ws
+}
+
+// record appends one aligned sample for every worker and the pool. Series of
+// workers missing from stats are dropped.
+func (s *timeseriesStore) record(now time.Time, stats map[string]statsSnapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name := range s.workers {
+		if _, ok := stats[name]; !ok {
+			delete(s.workers, name)
+		}
+	}
+
+	dt := timeseriesInterval.Seconds()
+	var pool statsSnapshot
+	poolHasDelta := false
+	for name, snap := range stats {
+		ws, ok := s.workers[name]
+		if !ok {
+			ws = s.newSeries()
+			s.workers[name] = ws
+		}
+		if ws.hasPrev {
+			d := snap.sub(ws.prev)
+			pool.add(d)
+			poolHasDelta = true
+			ws.set(s.next, d, dt)
+		} else {
+			ws.clear(s.next)
+		}
+		ws.prev, ws.hasPrev = snap, true
+	}
+	if poolHasDelta {
+		s.pool.set(s.next, pool, dt)
+	} else {
+		s.pool.clear(s.next)
+	}
+
+	s.times[s.next] = now.Truncate(timeseriesInterval).UnixMilli()
+	s.next = (s.next + 1) % s.capacity
+	if s.filled < s.capacity {
+		s.filled++
+	}
+}
+
+// set stores the rates derived from a per-interval delta at slot i
+func (ws *workerSeries) set(i int, d statsSnapshot, dt float64) {
+	ws.values[0][i] = float64(d.Requests) / dt
+	ws.values[1][i] = math.NaN()
+	ws.values[2][i] = 0
+	if d.Requests > 0 {
+		ws.values[1][i] = d.LatencySumMs / float64(d.Requests)
+		ws.values[2][i] = float64(d.Errors) / float64(d.Requests)
+	}
+}
+
+func (ws *workerSeries) clear(i int) {
+	for m := range ws.values {
+		ws.values[m][i] = math.NaN()
+	}
+}
+
+// window returns the last n samples of metric m for worker ("" for the pool)
+// in chronological order; missing samples are nil
+func (s *timeseriesStore) window(worker string, m int, n int) ([]int64, []*float64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ws := s.pool
+	if worker != "" {
+		var ok bool
+		if ws, ok = s.workers[worker]; !ok {
+			return nil, nil, false
+		}
+	}
+	if n > s.filled {
+		n = s.filled
+	}
+	times := make([]int64, n)
+	values := make([]*float64, n)
+	start := (s.next - n + s.capacity) % s.capacity
+	for k := 0; k < n; k++ {
+		i := (start + k) % s.capacity
+		times[k] = s.times[i]
+		if v := ws.values[m][i]; !math.IsNaN(v) {
+			values[k] = &v
+		}
+	}
+	return times, values, true
+}
+
+// meanLatency returns the request-weighted mean latency (ms) of worker over
+// the last n samples, and false when it served no requests in that time
+func (s *timeseriesStore) meanLatency(worker string, n int) (float64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ws, ok := s.workers[worker]
+	if !ok {
+		return 0, false
+	}
+	if n > s.filled {
+		n = s.filled
+	}
+	var sum, weight float64
+	for k := 1; k <= n; k++ {
+		i := (s.next - k + s.capacity) % s.capacity
+		rps, latency := ws.values[0][i], ws.values[1][i]
+		if math.IsNaN(rps) || math.IsNaN(latency) || rps == 0 {
+			continue
+		}
+		sum += rps * latency
+		weight += rps
+	}
+	if weight == 0 {
+		return 0, false
+	}
+	return sum / weight, true
+}
+
+func (s *timeseriesStore) size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return (len(s.workers) + 1) * len(timeseriesMetrics) * s.filled
+}
+
+func (s *timeseriesStore) bounds() storeBounds {
+	return storeBounds{
+		Capacity: s.capacity,
+		Floor:    s.capacity,
+		MaxAgeMs: (time.Duration(s.capacity) * timeseriesInterval).Milliseconds(),
+	}
+}
+
+// sweep is a no-op: old samples are overwritten by the ring
+func (s *timeseriesStore) sweep(now time.Time) int { return 0 }
+
+// sampleTimeseries records one sample from the workers' rolling stats
+func (lb *LoadBalancer) sampleTimeseries() {
+	lb.timeseries.record(lb.clock.Now(), lb.snapshotWorkerStats())
+}
+
+// StartSampler samples the timeseries once per timeseriesInterval
+func (lb *LoadBalancer) StartSampler(ctx context.Context) {
+	for {
+		timer := lb.clock.NewTimer(timeseriesInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+			lb.sampleTimeseries()
+		}
+	}
+}
+
+// handleTimeseries はダッシュボードのスパークライン用に時系列データを返す HTTP ハンドラです。
+// ?metric=rps|latency|errors (既定 rps)、?window=60s (保持期間まで)、?worker=<name> (省略時はプール全体) を指定でき、
+// 時刻を揃えた timestamps (Unix ミリ秒) と values (サンプルが無い点は null) の配列を返します。
+func handleTimeseries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+
+	metric := q.Get("metric")
+	if metric == "" {
+		metric = "rps"
+	}
+	m := -1
+	for i, name := range timeseriesMetrics {
+		if name == metric {
+			m = i
+		}
+	}
+	if m < 0 {
+		http.Error(w, "Invalid metric", http.StatusBadRequest)
+		return
+	}
+
+	window := defaultTimeseriesWindow
+	if raw := q.Get("window"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d < timeseriesInterval {
+			http.Error(w, "Invalid window", http.StatusBadRequest)
+			return
+		}
+		window = d
+	}
+
+	worker := q.Get("worker")
+	times, values, ok := lb.timeseries.window(worker, m, int(window/timeseriesInterval))
+	if !ok {
+		http.Error(w, "Worker not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"metric":     metric,
+		"worker":     worker,
+		"intervalMs": timeseriesInterval.Milliseconds(),
+		"timestamps": times,
+		"values":     values,
+	})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type timeseriesBody struct {
+	Metric     string     `json:"metric"`
+	Worker     string     `json:"worker"`
+	Timestamps []int64    `json:"timestamps"`
+	Values     []*float64 `json:"values"`
+}
+
+func getTimeseries(t *testing.T, query string) (int, timeseriesBody) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleTimeseries(rec, httptest.NewRequest(http.MethodGet, "/timeseries?"+query, nil))
+	var body timeseriesBody
+	if rec.Code == http.StatusOK {
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+	}
+	return rec.Code, body
+}
+
+func newTimeseriesLB(t *testing.T, retention time.Duration) *fakeClock {
+	t.Setenv("LB_TIMESERIES_RETENTION", retention.String())
+	clk := newFakeClock()
+	lb = NewLoadBalancer("round-robin")
+	lb.clock = clk
+	lb.AddWorker("worker-1", "http://localhost:8081", "#FF0000", 1)
+	lb.AddWorker("worker-2", "http://localhost:8082", "#00FF00", 1)
+	return clk
+}
+
+func TestTimeseriesAlignment(t *testing.T) {
+	clk := newTimeseriesLB(t, time.Minute)
+	w1, w2 := lb.workers[0], lb.workers[1]
+
+	lb.sampleTimeseries() // baseline
+	for i := 0; i < 3; i++ {
+		clk.Advance(time.Second)
+		for j := 0; j < 4; j++ {
+			w1.stats.observe(10*time.Millisecond, j == 0)
+		}
+		if i > 0 {
+			w2.stats.observe(30*time.Millisecond, false)
+		}
+		lb.sampleTimeseries()
+	}
+
+	_, r1 := getTimeseries(t, "metric=rps&worker=worker-1")
+	_, r2 := getTimeseries(t, "metric=rps&worker=worker-2")
+	_, pool := getTimeseries(t, "metric=rps&window=2s")
+	if len(r1.Timestamps) != 4 || len(pool.Timestamps) != 2 {
+		t.Fatalf("lengths = %d/%d, want 4 and 2", len(r1.Timestamps), len(pool.Timestamps))
+	}
+	for i := range r1.Timestamps {
+		if r1.Timestamps[i] != r2.Timestamps[i] {
+			t.Fatalf("timestamps not aligned: %v vs %v", r1.Timestamps, r2.Timestamps)
+		}
+		if i > 0 && r1.Timestamps[i]-r1.Timestamps[i-1] != 1000 {
+			t.Fatalf("timestamps not 1s apart: %v", r1.Timestamps)
+		}
+	}
+	if r1.Values[0] != nil {
+		t.Errorf("baseline sample = %v, want null", *r1.Values[0])
+	}
+	if *r1.Values[3] != 4 || *r2.Values[1] != 0 || *r2.Values[3] != 1 {
+		t.Errorf("rps = %v / %v", deref(r1.Values), deref(r2.Values))
+	}
+	if *pool.Values[1] != 5 {
+		t.Errorf("pool rps = %v, want 5", *pool.Values[1])
+	}
+
+	_, errs := getTimeseries(t, "metric=errors&worker=worker-1")
+	if *errs.Values[3] != 0.25 {
+		t.Errorf("error rate = %v, want 0.25", *errs.Values[3])
+	}
+	_, lat := getTimeseries(t, "metric=latency&worker=worker-2")
+	if lat.Values[1] != nil || *lat.Values[3] != 30 {
+		t.Errorf("latency = %v, want null then 30", deref(lat.Values))
+	}
+}
+
+func TestTimeseriesRetentionEviction(t *testing.T) {
+	clk := newTimeseriesLB(t, 5*time.Second)
+	var first int64
+	for i := 0; i < 8; i++ {
+		if i == 3 {
+			first = clk.Now().UnixMilli()
+		}
+		lb.sampleTimeseries()
+		clk.Advance(time.Second)
+	}
+
+	_, body := getTimeseries(t, "worker=worker-1&window=15m")
+	if len(body.Timestamps) != 5 {
+		t.Fatalf("samples = %d, want retention of 5", len(body.Timestamps))
+	}
+	if body.Timestamps[0] != first {
+		t.Errorf("oldest sample = %d, want %d", body.Timestamps[0], first)
+	}
+	if got := lb.Resources().Stores["timeseries"].Size; got != 3*3*5 {
+		t.Errorf("store size = %d, want %d", got, 3*3*5)
+	}
+}
+
+func TestTimeseriesRemovedWorker(t *testing.T) {
+	newTimeseriesLB(t, time.Minute)
+	lb.sampleTimeseries()
+	if code, _ := getTimeseries(t, "worker=worker-2"); code != http.StatusOK {
+		t.Fatalf("status code = %d, want %d", code, http.StatusOK)
+	}
+
+	lb.mu.Lock()
+	lb.workers = lb.workers[:1]
+	lb.mu.Unlock()
+	lb.sampleTimeseries()
+
+	if code, _ := getTimeseries(t, "worker=worker-2"); code != http.StatusNotFound {
+		t.Errorf("removed worker status code = %d, want %d", code, http.StatusNotFound)
+	}
+	if code, _ := getTimeseries(t, "metric=bogus"); code != http.StatusBadRequest {
+		t.Errorf("invalid metric status code = %d, want %d", code, http.StatusBadRequest)
+	}
+}
+
+func deref(values []*float64) []interface{} {
+	out := make([]interface{}, len(values))
+	for i, v := range values {
+		if v != nil {
+			out[i] = *v
+		}
+	}
+	return out
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// Transaction step operations
+const (
+	txSetAlgorithm = "setAlgorithm"
+	txUpdateWorker = "updateWorker"
+	txSettings     = "settings"
+	txLRUWorker    = "lruWorker"
+)
+
+// TransactionStep is one mutation of a transaction. Op selects which of the
+// other fields is used: setAlgorithm takes Algorithm, updateWorker takes
+// Worker and Update, settings and lruWorker take the fields to change in
+// Settings or LRUWorker, applied over the result of the earlier steps.
+type TransactionStep struct {
+	Op        string            `json:"op"`
+	Algorithm string            `json:"algorithm,omitempty"`
+	Worker    string            `json:"worker,omitempty"`
+	Update    *api.WorkerUpdate `json:"update,omitempty"`
+	Settings  json.RawMessage   `json:"settings,omitempty"`
+	LRUWorker json.RawMessage   `json:"lruWorker,omitempty"`
+}
+
+// TransactionRequest is the body of POST /transaction. DryRun validates
+// the steps and returns the changes they would make without applying them.
+type TransactionRequest struct {
+	Steps  []TransactionStep `json:"steps"`
+	DryRun bool              `json:"dryRun,omitempty"`
+}
+
+// TransactionError reports the first step of a transaction that failed
+// validation. Nothing of the transaction has been applied.
+type TransactionError struct {
+	Step    int    `json:"step"`
+	Op      string `json:"op"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"error"`
+}
+
+func (e *TransactionError) Error() string {
+	return fmt.Sprintf("step %d (%s): %s", e.Step, e.Op, e.Message)
+}
+
+// TransactionResult is the state after a transaction was applied
+type TransactionResult struct {
+	Applied   int                `json:"applied"`
+	Algorithm string             `json:"algorithm"`
+	Settings  Settings           `json:"settings"`
+	LRUWorker LRUWorkerConfig    `json:"lruWorker"`
+	Workers   []api.WorkerStatus `json:"workers"`
+}
+
+// workerPatch is a validated updateWorker step
+type workerPatch struct {
+	worker *Worker
+	update api.WorkerUpdate
+}
+
+// decodeOver decodes raw over v, rejecting unknown fields
+func decodeOver(raw json.RawMessage, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// findWorkerLocked returns the named worker. Must be called with lb.mu held.
+func (lb *LoadBalancer) findWorkerLocked(name string) *Worker {
+	for _, w := range lb.workers {
+		if w.Name == name {
+			return w
+		}
+	}
+	return nil
+}
+
+// txPlan is a validated transaction, ready to be applied
+type txPlan struct {
+	steps      int
+	prevAlgo   string
+	algo       string
+	settings   Settings
+	lru        LRUWorkerConfig
+	lruChanged bool
+	patches    []workerPatch
+}
+
+// planTransactionLocked validates every step against the state left by the
+// steps before it and returns what applying them would set. Must be called
+// with lb.mu held.
+func (lb *LoadBalancer) planTransactionLocked(steps []TransactionStep) (txPlan, error) {
+	p := txPlan{
+		steps:    len(steps),
+		prevAlgo: lb.algorithm,
+		algo:     lb.algorithm,
+		settings: lb.settingsLocked(),
+		lru:      lb.lru.config,
+	}
+	fail := func(i int, op, field, msg string) (txPlan, error) {
+		return txPlan{}, &TransactionError{Step: i, Op: op, Field: field, Message: msg}
+	}
+	for i, s := range steps {
+		switch s.Op {
+		case txSetAlgorithm:
+			if _, ok := validAlgorithms[s.Algorithm]; !ok {
+				return fail(i, s.Op, "algorithm", "Invalid algorithm")
+			}
+			p.algo = s.Algorithm
+		case txUpdateWorker:
+			w := lb.findWorkerLocked(s.Worker)
+			if w == nil {
+				return fail(i, s.Op, "worker", "Worker not found")
+			}
+			if s.Update == nil {
+				return fail(i, s.Op, "update", "is required")
+			}
+			if err := validateWorkerUpdate(*s.Update); err != nil {
+				me := err.(*MetadataError)
+				return fail(i, s.Op, "update."+me.Field, me.Message)
+			}
+			p.patches = append(p.patches, workerPatch{w, *s.Update})
+		case txSettings:
+			if err := decodeOver(s.Settings, &p.settings); err != nil {
+				return fail(i, s.Op, "settings", err.Error())
+			}
+			if err := validateSettings(p.settings); err != nil {
+				se := err.(*SettingsError)
+				return fail(i, s.Op, "settings."+se.Field, se.Message)
+			}
+		case txLRUWorker:
+			if err := decodeOver(s.LRUWorker, &p.lru); err != nil {
+				return fail(i, s.Op, "lruWorker", err.Error())
+			}
+			if msg := p.lru.Validate(); msg != "" {
+				return fail(i, s.Op, "lruWorker", msg)
+			}
+			p.lruChanged = true
+		default:
+			return fail(i, s.Op, "op", "Unknown operation")
+		}
+	}
+	return p, nil
+}
+
+// previewLocked returns the pool configuration as it would be after p was
+// applied. Must be called with lb.mu held.
+func (lb *LoadBalancer) previewLocked(p txPlan) PoolSnapshot {
+	s := lb.captureLocked("")
+	s.Algorithm = p.algo
+	s.Settings = p.settings
+	if p.lruChanged {
+		s.LRUWorker = p.lru
+	}
+	for _, patch := range p.patches {
+		for i := range s.Workers {
+			if s.Workers[i].Name == patch.worker.Name {
+				s.Workers[i] = patchSnapshotWorker(s.Workers[i], patch.update)
+			}
+		}
+	}
+	return s
+}
+
+// TransactionPlan is the response of a dry-run transaction: the changes it
+// would make, in the form of a snapshot diff
+type TransactionPlan struct {
+	DryRun  bool         `json:"dryRun"`
+	Steps   int          `json:"steps"`
+	Changes SnapshotDiff `json:"changes"`
+}
+
+// PlanTransaction validates steps like ApplyTransaction and returns the
+// changes they would make, without applying anything
+func (lb *LoadBalancer) PlanTransaction(steps []TransactionStep) (TransactionPlan, error) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	p, err := lb.planTransactionLocked(steps)
+	if err != nil {
+		return TransactionPlan{}, err
+	}
+	return TransactionPlan{
+		DryRun:  true,
+		Steps:   p.steps,
+		Changes: diffSnapshots(lb.captureLocked(""), lb.previewLocked(p)),
+	}, nil
+}
+
+// ApplyTransaction validates every step against the state left by the steps
+// before it and then applies them all while holding lb.mu, so no request or
+// status read sees an intermediate state. If any step fails validation
+// nothing is applied and a *TransactionError is returned. A successful
+// transaction is recorded as a single event.
+func (lb *LoadBalancer) ApplyTransaction(steps []TransactionStep) (TransactionResult, error) {
+	lb.mu.Lock()
+	p, err := lb.planTransactionLocked(steps)
+	if err != nil {
+		lb.mu.Unlock()
+		return TransactionResult{}, err
+	}
+
+	var handoff []string
+	if p.algo != p.prevAlgo {
+		handoff = lb.handoffLocked(p.prevAlgo, p.algo)
+	}
+	lb.algorithm = p.algo
+	changed := lb.applySettingsLocked(p.settings)
+	if p.lruChanged {
+		lb.lru = lruWorkerState{config: p.lru}
+	}
+	var touched []string
+	for _, patch := range p.patches {
+		lb.updateWorkerLocked(patch.worker, patch.update.Enabled, patch.update.Weight)
+		if patch.update.Draining != nil {
+			lb.setDrainingLocked(patch.worker, *patch.update.Draining)
+		}
+		applyMetadataLocked(patch.worker, patch.update)
+		applyHealthRuleLocked(patch.worker, patch.update)
+		applyRequestTimeoutLocked(patch.worker, patch.update)
+		if patch.update.CircuitThreshold != nil {
+			patch.worker.CircuitThreshold = *patch.update.CircuitThreshold
+		}
+		patch.worker.revision++
+		touched = append(touched, patch.worker.Name)
+	}
+	res := TransactionResult{
+		Applied:   len(steps),
+		Algorithm: lb.algorithm,
+		Settings:  lb.settingsLocked(),
+		LRUWorker: lb.lru.config,
+		Workers:   make([]api.WorkerStatus, 0, len(lb.workers)),
+	}
+	for _, w := range lb.workers {
+		res.Workers = append(res.Workers, lb.workerStatusLocked(w))
+	}
+	lb.mu.Unlock()
+
+	data := map[string]interface{}{
+		"steps":   len(steps),
+		"changed": changed,
+		"workers": touched,
+	}
+	if p.algo != p.prevAlgo {
+		data["algorithm"] = map[string]interface{}{"from": p.prevAlgo, "to": p.algo, "handoff": handoff}
+		logHandoff(p.prevAlgo, p.algo, handoff)
+	}
+	e := lb.emitEvent("transaction", fmt.Sprintf("Transaction of %d steps applied", len(steps)), data)
+	if p.algo != p.prevAlgo {
+		lb.startSession(p.algo, e.Seq, handoff)
+	}
+	return res, nil
+}
+
+// dryRunQuery reports whether the request asks for a dry run with
+// ?dryRun=true. A dry run validates and plans an operation like the real one
+// but changes nothing and records no event.
+func dryRunQuery(r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("dryRun")
+	if v == "" {
+		return false, nil
+	}
+	dryRun, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, &MetadataError{"dryRun", "must be true or false"}
+	}
+	return dryRun, nil
+}
+
+// handleTransaction は複数の変更をまとめて適用するトランザクションの HTTP ハンドラです。
+// POST で {"steps": [...]} を受け取り、setAlgorithm・updateWorker・settings・lruWorker の各ステップを順に検証してから単一のロック内で一括適用し、
+// 適用後の状態を返してブロードキャストは 1 回だけ行います。いずれかのステップが検証に失敗した場合は何も適用せず、400 と最初に失敗したステップを返します。
+// ?dryRun=true または "dryRun": true では同じ検証だけを行い、何も変更せずイベントも記録せずに、適用した場合の変更をスナップショットと同じ差分形式で返します。
+func handleTransaction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dryRun, err := dryRunQuery(r)
+	if err != nil {
+		writeMetadataError(w, err.(*MetadataError))
+		return
+	}
+	var req TransactionRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeMetadataError(w, &MetadataError{"body", err.Error()})
+		return
+	}
+	if len(req.Steps) == 0 {
+		writeMetadataError(w, &MetadataError{"steps", "must not be empty"})
+		return
+	}
+
+	if dryRun || req.DryRun {
+		plan, err := lb.PlanTransaction(req.Steps)
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(err)
+			return
+		}
+		json.NewEncoder(w).Encode(plan)
+		return
+	}
+
+	res, err := lb.ApplyTransaction(req.Steps)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(err)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+	lb.BroadcastStatus()
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+func postTransaction(body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/transaction", bytes.NewBufferString(body)))
+	return rec
+}
+
+func transactionEvents() []Event {
+	var out []Event
+	for _, e := range lb.events.since(0, 1000) {
+		if e.Type == "transaction" {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func TestTransactionApplied(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	t.Cleanup(lb.stopControl)
+	lb.AddWorker("worker-1", "http://localhost:8081", "#FF0000", 1)
+	lb.AddWorker("worker-2", "http://localhost:8082", "#00FF00", 1)
+
+	rec := postTransaction(`{"steps":[
+		{"op":"setAlgorithm","algorithm":"weighted"},
+		{"op":"updateWorker","worker":"worker-1","update":{"weight":5,"displayName":"Primary"}},
+		{"op":"updateWorker","worker":"worker-2","update":{"enabled":false}},
+		{"op":"settings","settings":{"circuitThreshold":7}},
+		{"op":"settings","settings":{"upstreamTimeoutMs":1500}},
+		{"op":"lruWorker","lruWorker":{"windowMs":2000}}]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status code = %d, want %d (%s)", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	var res TransactionResult
+	json.NewDecoder(rec.Body).Decode(&res)
+	if res.Applied != 6 || res.Algorithm != "weighted" {
+		t.Errorf("result = %+v, want 6 steps and weighted", res)
+	}
+	// Later settings steps build on earlier ones
+	if res.Settings.CircuitThreshold != 7 || res.Settings.UpstreamTimeoutMs != 1500 {
+		t.Errorf("settings = %+v", res.Settings)
+	}
+	if res.LRUWorker.WindowMs != 2000 || res.LRUWorker.SwitchOn != defaultLRUWorkerConfig().SwitchOn {
+		t.Errorf("lru config = %+v, want only windowMs changed", res.LRUWorker)
+	}
+	if w := res.Workers[0]; w.Weight != 5 || w.DisplayName != "Primary" || w.Revision != 1 {
+		t.Errorf("worker-1 = %+v", w)
+	}
+	if res.Workers[1].Enabled {
+		t.Error("worker-2 should be disabled")
+	}
+	if lb.algorithm != "weighted" || lb.circuitThreshold != 7 {
+		t.Error("the load balancer should hold the new state")
+	}
+
+	events := transactionEvents()
+	if len(events) != 1 {
+		t.Fatalf("transaction events = %d, want 1", len(events))
+	}
+	for _, e := range lb.events.since(0, 1000) {
+		if e.Type == "algorithm" || e.Type == "settings" {
+			t.Errorf("unexpected %s event; a transaction is recorded as one event", e.Type)
+		}
+	}
+	if algo := events[0].Data["algorithm"].(map[string]interface{}); algo["from"] != "round-robin" || algo["to"] != "weighted" {
+		t.Errorf("event algorithm = %v", algo)
+	}
+	if report := lb.AlgorithmReport(); report[len(report)-1].Algorithm != "weighted" {
+		t.Error("a new algorithm session should start")
+	}
+}
+
+func TestTransactionRollback(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps string
+		step  int
+		field string
+	}{
+		{"invalid settings", `{"op":"settings","settings":{"circuitThreshold":0}}`, 2, "settings.circuitThreshold"},
+		{"unknown settings field", `{"op":"settings","settings":{"circuitTreshold":2}}`, 2, "settings"},
+		{"unknown worker", `{"op":"updateWorker","worker":"nope","update":{"weight":2}}`, 2, "worker"},
+		{"invalid weight", `{"op":"updateWorker","worker":"worker-1","update":{"weight":0}}`, 2, "update.weight"},
+		{"invalid lru config", `{"op":"lruWorker","lruWorker":{"order":"random"}}`, 2, "lruWorker"},
+		{"unknown op", `{"op":"reboot"}`, 2, "op"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb = NewLoadBalancer("round-robin")
+			lb.AddWorker("worker-1", "http://localhost:8081", "#FF0000", 1)
+			before := lb.GetStatus()
+
+			rec := postTransaction(`{"steps":[
+				{"op":"setAlgorithm","algorithm":"random"},
+				{"op":"settings","settings":{"healthRise":4}},
+				` + tt.steps + `,
+				{"op":"updateWorker","worker":"worker-1","update":{"enabled":false}}]}`)
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status code = %d, want %d", rec.Code, http.StatusBadRequest)
+			}
+			var txErr TransactionError
+			json.NewDecoder(rec.Body).Decode(&txErr)
+			if txErr.Step != tt.step || txErr.Field != tt.field || txErr.Message == "" {
+				t.Errorf("error = %+v, want step %d field %q", txErr, tt.step, tt.field)
+			}
+
+			after := lb.GetStatus()
+			if after["algorithm"] != before["algorithm"] || lb.healthRise != 1 || !lb.workers[0].Enabled || lb.workers[0].revision != 0 {
+				t.Error("a failed transaction must leave the state untouched")
+			}
+			if n := len(transactionEvents()); n != 0 {
+				t.Errorf("transaction events = %d, want 0", n)
+			}
+		})
+	}
+
+	if rec := postTransaction(`{"steps":[]}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("empty transaction: status code = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestTransactionDryRun(t *testing.T) {
+	payload := `"steps":[
+		{"op":"setAlgorithm","algorithm":"weighted"},
+		{"op":"updateWorker","worker":"worker-1","update":{"weight":5,"color":"#abcdef","displayName":"Primary"}},
+		{"op":"updateWorker","worker":"worker-2","update":{"enabled":false}},
+		{"op":"settings","settings":{"circuitThreshold":7}},
+		{"op":"lruWorker","lruWorker":{"windowMs":2000}}]`
+	lb = NewLoadBalancer("round-robin")
+	t.Cleanup(lb.stopControl)
+	lb.AddWorker("worker-1", "http://localhost:8081", "#FF0000", 1)
+	lb.AddWorker("worker-2", "http://localhost:8082", "#00FF00", 1)
+	lb.mu.RLock()
+	before := lb.captureLocked("")
+	lb.mu.RUnlock()
+	events := len(lb.events.since(0, 0))
+
+	var plans []TransactionPlan
+	for _, rec := range []*httptest.ResponseRecorder{
+		postTransaction(`{` + payload + `,"dryRun":true}`),
+		func() *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/transaction?dryRun=true", bytes.NewBufferString(`{`+payload+`}`)))
+			return rec
+		}(),
+	} {
+		if rec.Code != http.StatusOK {
+			t.Fatalf("dry run: %d %s", rec.Code, rec.Body.String())
+		}
+		var plan TransactionPlan
+		json.NewDecoder(rec.Body).Decode(&plan)
+		plans = append(plans, plan)
+	}
+	lb.mu.RLock()
+	unchanged := lb.captureLocked("")
+	lb.mu.RUnlock()
+	unchanged.TakenAt = before.TakenAt
+	if !reflect.DeepEqual(unchanged, before) || lb.workers[0].revision != 0 {
+		t.Errorf("state after dry runs = %+v, want %+v", unchanged, before)
+	}
+	if n := len(lb.events.since(0, 0)); n != events {
+		t.Errorf("events = %d after dry runs, want %d", n, events)
+	}
+
+	if rec := postTransaction(`{` + payload + `}`); rec.Code != http.StatusOK {
+		t.Fatalf("apply: %d %s", rec.Code, rec.Body.String())
+	}
+	lb.mu.RLock()
+	after := lb.captureLocked("")
+	lb.mu.RUnlock()
+	// Round-trip the real diff through JSON like the plans
+	var want SnapshotDiff
+	raw, _ := json.Marshal(diffSnapshots(before, after))
+	json.Unmarshal(raw, &want)
+	for i, plan := range plans {
+		if !plan.DryRun || plan.Steps != 5 || !plan.Changes.Changed {
+			t.Errorf("plan %d = %+v", i, plan)
+		}
+		if !reflect.DeepEqual(plan.Changes.Pool, want.Pool) || !reflect.DeepEqual(plan.Changes.Workers, want.Workers) ||
+			!reflect.DeepEqual(plan.Changes.Added, want.Added) || !reflect.DeepEqual(plan.Changes.Removed, want.Removed) {
+			t.Errorf("plan %d changes = %+v, want %+v", i, plan.Changes, want)
+		}
+	}
+
+	// A dry run is validated like the real transaction
+	rec := postTransaction(`{"steps":[{"op":"updateWorker","worker":"nope","update":{}}],"dryRun":true}`)
+	var txErr TransactionError
+	json.NewDecoder(rec.Body).Decode(&txErr)
+	if rec.Code != http.StatusBadRequest || txErr.Field != "worker" {
+		t.Errorf("invalid dry run: %d %+v, want 400 on worker", rec.Code, txErr)
+	}
+	rec = httptest.NewRecorder()
+	newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/transaction?dryRun=maybe", bytes.NewBufferString(`{`+payload+`}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("dryRun=maybe: %d, want 400", rec.Code)
+	}
+}
+
+func TestTransactionsSerialize(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", "http://localhost:8081", "#FF0000", 1)
+
+	// Each transaction sets an algorithm together with a matching threshold
+	// and weight; no reader may ever see a mix of two transactions
+	algos := []string{"round-robin", "weighted", "random", "least-connections"}
+	stop := make(chan struct{})
+	var mixed []string
+	var readers sync.WaitGroup
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			lb.mu.RLock()
+			algo, threshold, weight := lb.algorithm, lb.circuitThreshold, lb.workers[0].Weight
+			lb.mu.RUnlock()
+			if threshold != 3 && (threshold != weight || algos[threshold%len(algos)] != algo) {
+				mixed = append(mixed, fmt.Sprintf("%s/%d/%d", algo, threshold, weight))
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 4; i < 24; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			_, err := lb.ApplyTransaction([]TransactionStep{
+				{Op: txSetAlgorithm, Algorithm: algos[n%len(algos)]},
+				{Op: txSettings, Settings: json.RawMessage(fmt.Sprintf(`{"circuitThreshold":%d}`, n))},
+				{Op: txUpdateWorker, Worker: "worker-1", Update: &api.WorkerUpdate{Weight: &n}},
+			})
+			if err != nil {
+				t.Errorf("transaction %d: %v", n, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+
+	if len(mixed) > 0 {
+		t.Errorf("observed intermediate states: %v", mixed[:1])
+	}
+	if lb.workers[0].revision != 20 {
+		t.Errorf("revision = %d, want 20", lb.workers[0].revision)
+	}
+	if n := len(transactionEvents()); n != 20 {
+		t.Errorf("transaction events = %d, want 20", n)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Client identity for limits. X-Forwarded-For is set by whoever sends the
+// request, so the limits key on the peer address and only believe the
+// header when the peer is one of the trusted proxies (LB_TRUSTED_PROXIES,
+// comma-separated addresses or CIDRs). The header is then read from the
+// right, skipping trusted hops, up to the first address a trusted proxy
+// vouches for.
+
+// parseTrustedProxies parses a comma-separated list of addresses and CIDRs
+func parseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if strings.Contains(field, "/") {
+			p, err := netip.ParsePrefix(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %v", field, err)
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", field, err)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// trustedProxy reports whether addr is one of the trusted proxies
+func (lb *LoadBalancer) trustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range lb.trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the address limits account r to: the host of
+// RemoteAddr, or when that is a trusted proxy the nearest untrusted entry of
+// X-Forwarded-For
+func (lb *LoadBalancer) clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	hop, err := netip.ParseAddr(host)
+	if err != nil || !lb.trustedProxy(hop) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		hop = addr
+		if !lb.trustedProxy(addr) {
+			break
+		}
+	}
+	return hop.Unmap().String()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientAddr(t *testing.T) {
+	lb := NewLoadBalancer("round-robin")
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb.trustedProxies = proxies
+
+	tests := []struct {
+		remoteAddr, forwarded, want string
+	}{
+		// An untrusted peer's header is ignored
+		{"198.51.100.9:1234", "203.0.113.7", "198.51.100.9"},
+		{"[2001:db8::1]:1234", "203.0.113.7", "2001:db8::1"},
+		// A trusted proxy vouches for the hop before it
+		{"192.0.2.1:1234", "203.0.113.7", "203.0.113.7"},
+		{"[::ffff:192.0.2.1]:1234", "203.0.113.7", "203.0.113.7"},
+		// Trusted hops are skipped, addresses the client added before them are not believed
+		{"10.0.0.5:1234", "1.2.3.4, 203.0.113.7, 10.1.1.1", "203.0.113.7"},
+		{"10.0.0.5:1234", "10.2.2.2, 10.1.1.1", "10.2.2.2"},
+		// Without a usable header the proxy itself is the client
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		{"192.0.2.1:1234", "203.0.113.7, junk", "192.0.2.1"},
+		{"pipe", "203.0.113.7", "pipe"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/task", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if got := lb.clientAddr(r); got != tt.want {
+			t.Errorf("clientAddr(%q, %q) = %q, want %q", tt.remoteAddr, tt.forwarded, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"10.0.0.0/33", "proxy.local"} {
+		if _, err := parseTrustedProxies(bad); err == nil {
+			t.Errorf("parseTrustedProxies(%q) accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// Per-request upstream timeouts. A task's deadline is the upstreamTimeoutMs
+// setting unless the request asks for another with X-Timeout-Ms, which is
+// clamped to maxRequestTimeout, and a worker with a RequestTimeout of its
+// own caps it. A task that runs out of it is answered 504 naming the worker
+// and the time elapsed, and counted as a timeout rather than an error. The
+// upstream call is bound to the client's request as well: a client that
+// disconnects or gives up aborts it at once, and the task is answered 499
+// without counting against the worker.
+const (
+	timeoutHeader     = "X-Timeout-Ms"
+	maxRequestTimeout = 5 * time.Minute
+
+	// statusClientClosedRequest is the nginx status of a request whose
+	// client went away before it was answered
+	statusClientClosedRequest = 499
+)
+
+// parseRequestTimeout returns the timeout r asks for, 0 if none
+func parseRequestTimeout(r *http.Request) (time.Duration, error) {
+	raw := strings.TrimSpace(r.Header.Get(timeoutHeader))
+	if raw == "" {
+		return 0, nil
+	}
+	ms, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || ms <= 0 {
+		return 0, fmt.Errorf("Invalid %s: must be a positive number of milliseconds", timeoutHeader)
+	}
+	if ms > maxRequestTimeout.Milliseconds() {
+		return maxRequestTimeout, nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+type upstreamTimeoutKey struct{}
+
+// withUpstreamTimeout returns ctx carrying the timeout forwardTo uses
+// instead of the setting
+func withUpstreamTimeout(ctx context.Context, d time.Duration) context.Context {
+	if d <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, upstreamTimeoutKey{}, d)
+}
+
+// upstreamTimeoutFrom returns the timeout carried by ctx, def if none
+func upstreamTimeoutFrom(ctx context.Context, def time.Duration) time.Duration {
+	if d, ok := ctx.Value(upstreamTimeoutKey{}).(time.Duration); ok {
+		return d
+	}
+	return def
+}
+
+// workerTimeout is a task that ran out of its deadline on a worker
+type workerTimeout struct {
+	worker  string
+	elapsed time.Duration
+	msg     string
+}
+
+func (e *workerTimeout) Error() string {
+	return e.msg
+}
+
+// clientClosed is a task whose client went away while a worker ran it
+type clientClosed struct {
+	worker string
+}
+
+func (e *clientClosed) Error() string {
+	return "Client closed request"
+}
+
+// validateWorkerRequestTimeout checks the requestTimeoutMs of a worker
+// update; 0 leaves the task's deadline uncapped
+func validateWorkerRequestTimeout(ms *int64) error {
+	if ms != nil && (*ms < 0 || time.Duration(*ms)*time.Millisecond > maxRequestTimeout) {
+		return &MetadataError{"requestTimeoutMs", fmt.Sprintf("must be between 0 and %d", maxRequestTimeout.Milliseconds())}
+	}
+	return nil
+}
+
+// applyRequestTimeoutLocked applies the request timeout of update to w.
+// Must be called with lb.mu held.
+func applyRequestTimeoutLocked(w *Worker, update api.WorkerUpdate) {
+	if update.RequestTimeoutMs != nil {
+		w.RequestTimeout = time.Duration(*update.RequestTimeoutMs) * time.Millisecond
+	}
+}
+
+// SetWorkerRequestTimeout caps the deadline of the tasks forwarded to the
+// named worker; 0 removes the cap. It returns false if there is no such
+// worker or d is out of range.
+func (lb *LoadBalancer) SetWorkerRequestTimeout(name string, d time.Duration) bool {
+	ms := d.Milliseconds()
+	if validateWorkerRequestTimeout(&ms) != nil {
+		return false
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	w := lb.findWorkerLocked(name)
+	if w == nil {
+		return false
+	}
+	applyRequestTimeoutLocked(w, api.WorkerUpdate{RequestTimeoutMs: &ms})
+	w.revision++
+	return true
+}
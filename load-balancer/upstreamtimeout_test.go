@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRequestTimeoutHeader(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", newDelayStub(t, "worker-1", 300*time.Millisecond).URL, "#FF0000", 1)
+	timeouts := lb.metrics.requestsTotal.WithLabelValues("worker-1", "timeout")
+	errs := lb.metrics.requestsTotal.WithLabelValues("worker-1", "error")
+
+	start := time.Now()
+	rec := doTask(map[string]string{timeoutHeader: "100"})
+	if d := time.Since(start); d > 250*time.Millisecond {
+		t.Errorf("request took %s with a 100ms timeout", d)
+	}
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want 504", rec.Code)
+	}
+	var body api.ErrorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Worker != "worker-1" || body.ElapsedMs < 100 || body.Error == "" {
+		t.Errorf("body = %+v, want the worker and the elapsed time", body)
+	}
+
+	// A timeout counts against the circuit, under its own label
+	if got := testutil.ToFloat64(timeouts); got != 1 {
+		t.Errorf("timeout requests = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(errs); got != 0 {
+		t.Errorf("error requests = %v, want 0", got)
+	}
+	if w := lb.workers[0]; w.ConsecFailures != 1 || w.FailedRequests != 1 {
+		t.Errorf("consecFailures = %d, failedRequests = %d, want 1", w.ConsecFailures, w.FailedRequests)
+	}
+
+	// Without the header the setting applies
+	lb.upstreamTimeout = 50 * time.Millisecond
+	if rec := doTask(nil); rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("status with the setting = %d, want 504", rec.Code)
+	}
+	if rec := doTask(map[string]string{timeoutHeader: "5000"}); rec.Code != http.StatusOK {
+		t.Errorf("status with a longer timeout = %d, want 200", rec.Code)
+	}
+}
+
+func TestClientTimeoutCancelsUpstream(t *testing.T) {
+	cancelled := make(chan time.Duration, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server notices the LB hanging up only once the body is read
+		io.Copy(io.Discard, r.Body)
+		start := time.Now()
+		select {
+		case <-time.After(500 * time.Millisecond):
+			json.NewEncoder(w).Encode(map[string]string{"worker": "worker-1"})
+		case <-r.Context().Done():
+			cancelled <- time.Since(start)
+		}
+	}))
+	defer srv.Close()
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodPost, "/task", bytes.NewBufferString(`{"id":"t","weight":1}`)).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	handleTask(rec, req)
+	if d := time.Since(start); d > 250*time.Millisecond {
+		t.Errorf("request took %s after its client gave up at 50ms", d)
+	}
+	if rec.Code != statusClientClosedRequest {
+		t.Fatalf("status = %d, want 499", rec.Code)
+	}
+	select {
+	case d := <-cancelled:
+		if d > 250*time.Millisecond {
+			t.Errorf("worker call cancelled after %s", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("worker call was not cancelled")
+	}
+
+	// The worker did nothing wrong
+	if w := lb.workers[0]; w.ConsecFailures != 0 || w.FailedRequests != 0 {
+		t.Errorf("consecFailures = %d, failedRequests = %d, want 0", w.ConsecFailures, w.FailedRequests)
+	}
+	if got := testutil.ToFloat64(lb.metrics.requestsTotal.WithLabelValues("worker-1", "cancelled")); got != 1 {
+		t.Errorf("cancelled requests = %v, want 1", got)
+	}
+}
+
+func TestWorkerRequestTimeout(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", newDelayStub(t, "worker-1", 300*time.Millisecond).URL, "#FF0000", 1)
+
+	rec := patchWorker("worker-1", `{"requestTimeoutMs":100}`)
+	var status api.WorkerStatus
+	json.NewDecoder(rec.Body).Decode(&status)
+	if rec.Code != http.StatusOK || status.RequestTimeoutMs != 100 {
+		t.Fatalf("patch: %d %+v", rec.Code, status)
+	}
+
+	// The worker's cap wins over a longer request timeout
+	start := time.Now()
+	if rec := doTask(map[string]string{timeoutHeader: "5000"}); rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want 504", rec.Code)
+	}
+	if d := time.Since(start); d > 250*time.Millisecond {
+		t.Errorf("request took %s with a 100ms worker timeout", d)
+	}
+
+	for _, body := range []string{`{"requestTimeoutMs":-1}`, `{"requestTimeoutMs":600000}`} {
+		rec := patchWorker("worker-1", body)
+		var e api.ErrorResponse
+		json.NewDecoder(rec.Body).Decode(&e)
+		if rec.Code != http.StatusBadRequest || e.Field != "requestTimeoutMs" {
+			t.Errorf("%s: %d %+v, want 400 naming the field", body, rec.Code, e)
+		}
+	}
+
+	// 0 removes the cap
+	if !lb.SetWorkerRequestTimeout("worker-1", 0) {
+		t.Fatal("SetWorkerRequestTimeout failed")
+	}
+	if rec := doTask(nil); rec.Code != http.StatusOK {
+		t.Errorf("status without the cap = %d, want 200", rec.Code)
+	}
+}
+
+func TestParseRequestTimeout(t *testing.T) {
+	tests := []struct {
+		header string
+		want   time.Duration
+		ok     bool
+	}{
+		{"", 0, true},
+		{"250", 250 * time.Millisecond, true},
+		{"86400000", maxRequestTimeout, true},
+		{"0", 0, false},
+		{"-5", 0, false},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/task", nil)
+		r.Header.Set(timeoutHeader, tt.header)
+		got, err := parseRequestTimeout(r)
+		if got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("%q: got %s, %v", tt.header, got, err)
+		}
+	}
+
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", "http://localhost:8081", "#FF0000", 1)
+	if rec := doTask(map[string]string{timeoutHeader: "soon"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid header status = %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+// connReuse counts how many upstream requests reused a connection
+type connReuse struct {
+	reused int64
+	total  int64
+}
+
+// record counts one request and returns the reuse ratio so far
+func (c *connReuse) record(reused bool) float64 {
+	if reused {
+		atomic.AddInt64(&c.reused, 1)
+	}
+	total := atomic.AddInt64(&c.total, 1)
+	return float64(atomic.LoadInt64(&c.reused)) / float64(total)
+}
+
+// upstreamTiming is what the client trace observed for one upstream request
+type upstreamTiming struct {
+	start     time.Time
+	gotConn   bool
+	reused    bool
+	firstByte time.Time
+}
+
+// withTrace returns ctx with a client trace that fills t
+func (t *upstreamTiming) withTrace(ctx context.Context) context.Context {
+	t.start = time.Now()
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.gotConn, t.reused = true, info.Reused
+		},
+		GotFirstResponseByte: func() {
+			t.firstByte = time.Now()
+		},
+	})
+}
+
+// ttfb returns the time to the first response byte, or 0 if none arrived
+func (t *upstreamTiming) ttfb() time.Duration {
+	if t.firstByte.IsZero() {
+		return 0
+	}
+	return t.firstByte.Sub(t.start)
+}
+
+// observe publishes the timing of a completed request to worker w
+func (t *upstreamTiming) observe(m *lbMetrics, w *Worker, total time.Duration) {
+	if !t.firstByte.IsZero() {
+		m.upstreamTTFB.WithLabelValues(w.Name).Observe(float64(t.ttfb().Milliseconds()))
+	}
+	m.upstreamTotal.WithLabelValues(w.Name).Observe(float64(total.Milliseconds()))
+	if t.gotConn {
+		m.upstreamConnReuse.WithLabelValues(w.Name).Set(w.conns.record(t.reused))
+	}
+}
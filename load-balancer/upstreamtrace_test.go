@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func histogramSum(t *testing.T, h *prometheus.HistogramVec, worker string) (float64, uint64) {
+	t.Helper()
+	var m dto.Metric
+	if err := h.WithLabelValues(worker).(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleSum(), m.GetHistogram().GetSampleCount()
+}
+
+func TestUpstreamTTFBAndTotalDiverge(t *testing.T) {
+	const delay = 150 * time.Millisecond
+	slowStart := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer slowStart.Close()
+	slowFinish := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":`))
+		w.(http.Flusher).Flush()
+		time.Sleep(delay)
+		w.Write([]byte(`true}`))
+	}))
+	defer slowFinish.Close()
+
+	lb := NewLoadBalancer("round-robin")
+	lb.AddWorker("trace-slow-start", slowStart.URL, "#FF0000", 1)
+	lb.AddWorker("trace-slow-finish", slowFinish.URL, "#00FF00", 1)
+
+	type timings struct {
+		TTFBMs     int64 `json:"ttfbMs"`
+		TotalMs    int64 `json:"upstreamTotalMs"`
+		ConnReused bool  `json:"connReused"`
+	}
+	forward := func(w *Worker) timings {
+		body, code, err := lb.forwardTo(context.Background(), w, TaskRequest{ID: "t"}, time.Now())
+		if err != nil || code != http.StatusOK {
+			t.Fatalf("forwardTo(%s) = %d, %v", w.Name, code, err)
+		}
+		var got timings
+		json.Unmarshal(body, &got)
+		return got
+	}
+
+	start := forward(lb.workers[0])
+	if start.TTFBMs < delay.Milliseconds() || start.TotalMs-start.TTFBMs > 50 {
+		t.Errorf("slow start: ttfb=%dms total=%dms, want both around %v", start.TTFBMs, start.TotalMs, delay)
+	}
+	ttfbBefore, nBefore := histogramSum(t, lb.metrics.upstreamTTFB, "trace-slow-finish")
+	totalBefore, _ := histogramSum(t, lb.metrics.upstreamTotal, "trace-slow-finish")
+	finish := forward(lb.workers[1])
+	if finish.TTFBMs > 50 || finish.TotalMs < delay.Milliseconds() {
+		t.Errorf("slow finish: ttfb=%dms total=%dms, want a fast first byte and a slow body", finish.TTFBMs, finish.TotalMs)
+	}
+
+	ttfb, n := histogramSum(t, lb.metrics.upstreamTTFB, "trace-slow-finish")
+	total, _ := histogramSum(t, lb.metrics.upstreamTotal, "trace-slow-finish")
+	if ttfb, n, total = ttfb-ttfbBefore, n-nBefore, total-totalBefore; n != 1 || ttfb > 50 || total < float64(delay.Milliseconds()) {
+		t.Errorf("slow finish histograms: ttfb=%v (n=%d) total=%v", ttfb, n, total)
+	}
+
+	// The second request to the same worker reuses the pooled connection
+	if again := forward(lb.workers[0]); !again.ConnReused {
+		t.Error("second request should reuse the connection")
+	}
+	if ratio := testutil.ToFloat64(lb.metrics.upstreamConnReuse.WithLabelValues("trace-slow-start")); ratio != 0.5 {
+		t.Errorf("conn reuse ratio = %v, want 0.5", ratio)
+	}
+}
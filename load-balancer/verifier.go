@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// The distribution verifier compares the requests each worker got over
+// consecutive windows of defaultVerifyWindow with what the active algorithm
+// should have produced. Pool membership is sampled every
+// fairnessSampleInterval to tell whether the expectation held for the whole
+// window.
+const (
+	defaultVerifyWindow            = time.Minute
+	defaultDistributionThreshold   = 0.1
+	defaultDistributionMinRequests = 200
+)
+
+// Verdicts of a verification window and why a window was skipped
+const (
+	verdictOK      = "ok"
+	verdictAnomaly = "anomaly"
+	verdictSkipped = "skipped"
+
+	skipChurn     = "churn"
+	skipLowVolume = "low_volume"
+	skipNoModel   = "no_model"
+)
+
+// DistributionShare is a worker's part of a distribution verdict
+type DistributionShare = api.DistributionShare
+
+// DistributionVerdict is the outcome of verifying one window
+type DistributionVerdict = api.DistributionVerdict
+
+// verifyWindow is what the verifier knows about a completed window: the
+// requests per worker, the shares expected from the algorithm and pool at
+// its start (see expectedShares) and whether membership changed while it
+// lasted
+type verifyWindow struct {
+	algorithm string
+	counts    map[string]int64
+	shares    map[string]float64
+	churn     bool
+}
+
+// verifyDistribution judges a window. Churn, pools or algorithms without a
+// fixed expectation and fewer than minRequests requests skip it.
+func verifyDistribution(win verifyWindow, threshold float64, minRequests int64) DistributionVerdict {
+	v := DistributionVerdict{Algorithm: win.algorithm, Threshold: threshold, Verdict: verdictSkipped}
+	for _, c := range win.counts {
+		v.Requests += c
+	}
+	shares := win.shares
+	switch {
+	case win.churn:
+		v.SkipReason = skipChurn
+	case shares == nil:
+		v.SkipReason = skipNoModel
+	case v.Requests < minRequests:
+		v.SkipReason = skipLowVolume
+	}
+	if v.SkipReason != "" {
+		return v
+	}
+
+	names := make([]string, 0, len(win.counts))
+	for name := range win.counts {
+		names = append(names, name)
+	}
+	for name := range shares {
+		if _, ok := win.counts[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	n := float64(v.Requests)
+	var chi2 float64
+	for _, name := range names {
+		observed := float64(win.counts[name])
+		expected := shares[name] * n
+		// A worker expected to get nothing that got requests counts as if
+		// half a request was expected, which still dwarfs any threshold
+		if expected == 0 {
+			if observed == 0 {
+				continue
+			}
+			expected = 0.5
+		}
+		chi2 += (observed - expected) * (observed - expected) / expected
+		v.Workers = append(v.Workers, DistributionShare{
+			Worker:   name,
+			Requests: win.counts[name],
+			Observed: observed / n,
+			Expected: shares[name],
+		})
+	}
+	v.Deviation = chi2 / n
+	v.Verdict = verdictOK
+	if v.Deviation > threshold {
+		v.Verdict = verdictAnomaly
+	}
+	return v
+}
+
+// distributionVerifier accumulates the current window
+type distributionVerifier struct {
+	mu         sync.Mutex
+	interval   time.Duration
+	start      time.Time
+	counts     map[string]int64
+	algorithm  string
+	membership string
+	shares     map[string]float64
+	churn      bool
+	last       *DistributionVerdict
+}
+
+func newDistributionVerifier() *distributionVerifier {
+	return &distributionVerifier{interval: defaultVerifyWindow}
+}
+
+// membershipLocked describes what the expectation depends on: the
+// algorithm and the eligible workers with their weights. Must be called with
+// lb.mu held.
+func (lb *LoadBalancer) membershipLocked() string {
+	eligible := lb.eligibleWorkersLocked()
+	parts := make([]string, 0, len(eligible))
+	for _, w := range eligible {
+		parts = append(parts, w.Name+"="+strconv.Itoa(w.Weight))
+	}
+	sort.Strings(parts)
+	return lb.algorithm + ":" + strings.Join(parts, ",")
+}
+
+// sampleDistribution checks that membership has not changed and, once the
+// window has lasted the verification interval, judges and restarts it
+func (lb *LoadBalancer) sampleDistribution() {
+	now := lb.clock.Now().UTC()
+	stats := lb.snapshotClientStats()
+	lb.mu.RLock()
+	membership := lb.membershipLocked()
+	algorithm := lb.algorithm
+	shares := expectedShares(algorithm, lb.workers)
+	threshold, minRequests := lb.distributionThreshold, lb.distributionMinRequests
+	lb.mu.RUnlock()
+
+	d := lb.verifier
+	d.mu.Lock()
+	if d.counts == nil {
+		d.resetLocked(now, stats, algorithm, membership, shares)
+		d.mu.Unlock()
+		return
+	}
+	if membership != d.membership || len(stats) != len(d.counts) {
+		d.churn = true
+	}
+	if now.Sub(d.start) < d.interval {
+		d.mu.Unlock()
+		return
+	}
+
+	win := verifyWindow{algorithm: d.algorithm, shares: d.shares, churn: d.churn, counts: make(map[string]int64, len(stats))}
+	for name, snap := range stats {
+		start, seen := d.counts[name]
+		if !seen {
+			win.churn = true
+		}
+		win.counts[name] = snap.Requests - start
+	}
+	v := verifyDistribution(win, threshold, minRequests)
+	v.WindowStart, v.WindowEnd = d.start, now
+	d.last = &v
+	d.resetLocked(now, stats, algorithm, membership, shares)
+	d.mu.Unlock()
+
+	if v.Verdict == verdictAnomaly {
+		lb.metrics.distributionAnomalies.WithLabelValues(v.Algorithm).Inc()
+		lb.emitEvent("distribution_anomaly", fmt.Sprintf("Warning: request distribution deviates from %s (%.3f > %.3f)", v.Algorithm, v.Deviation, v.Threshold), map[string]interface{}{
+			"algorithm": v.Algorithm,
+			"deviation": v.Deviation,
+			"threshold": v.Threshold,
+			"requests":  v.Requests,
+			"workers":   v.Workers,
+		})
+	}
+}
+
+func (d *distributionVerifier) resetLocked(now time.Time, stats map[string]statsSnapshot, algorithm, membership string, shares map[string]float64) {
+	d.start = now
+	d.algorithm, d.membership, d.shares = algorithm, membership, shares
+	d.churn = false
+	d.counts = make(map[string]int64, len(stats))
+	for name, snap := range stats {
+		d.counts[name] = snap.Requests
+	}
+}
+
+// DistributionVerdict returns the verdict of the last completed window, or
+// nil if no window has completed yet
+func (lb *LoadBalancer) DistributionVerdict() *DistributionVerdict {
+	lb.verifier.mu.Lock()
+	defer lb.verifier.mu.Unlock()
+	return lb.verifier.last
+}
+
+// StartVerifier samples membership every fairnessSampleInterval and verifies
+// the distribution at the end of each window
+func (lb *LoadBalancer) StartVerifier(ctx context.Context) {
+	for {
+		timer := lb.clock.NewTimer(fairnessSampleInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+			lb.sampleDistribution()
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestVerifyDistribution(t *testing.T) {
+	even := map[string]float64{"a": 0.5, "b": 0.5}
+	tests := []struct {
+		name    string
+		win     verifyWindow
+		verdict string
+		reason  string
+	}{
+		{"even round-robin", verifyWindow{algorithm: "round-robin", counts: map[string]int64{"a": 150, "b": 150}, shares: even}, verdictOK, ""},
+		// chi2 = 2 * 50^2 / 150 = 33.3 over 300 requests: 0.11
+		{"skewed round-robin", verifyWindow{algorithm: "round-robin", counts: map[string]int64{"a": 200, "b": 100}, shares: even}, verdictAnomaly, ""},
+		{"random noise", verifyWindow{algorithm: "random", counts: map[string]int64{"a": 160, "b": 140}, shares: even}, verdictOK, ""},
+		{"weighted in proportion", verifyWindow{algorithm: "weighted", counts: map[string]int64{"a": 300, "b": 100}, shares: map[string]float64{"a": 0.75, "b": 0.25}}, verdictOK, ""},
+		{"weighted ignoring weights", verifyWindow{algorithm: "weighted", counts: map[string]int64{"a": 200, "b": 200}, shares: map[string]float64{"a": 0.75, "b": 0.25}}, verdictAnomaly, ""},
+		{"ineligible worker served", verifyWindow{algorithm: "round-robin", counts: map[string]int64{"a": 140, "b": 140, "c": 20}, shares: even}, verdictAnomaly, ""},
+		{"starved worker", verifyWindow{algorithm: "round-robin", counts: map[string]int64{"a": 300}, shares: even}, verdictAnomaly, ""},
+		{"churn", verifyWindow{algorithm: "round-robin", counts: map[string]int64{"a": 300, "b": 0}, shares: even, churn: true}, verdictSkipped, skipChurn},
+		{"low volume", verifyWindow{algorithm: "round-robin", counts: map[string]int64{"a": 150, "b": 0}, shares: even}, verdictSkipped, skipLowVolume},
+		{"no model", verifyWindow{algorithm: "least-connections", counts: map[string]int64{"a": 300, "b": 0}}, verdictSkipped, skipNoModel},
+	}
+	for _, tt := range tests {
+		v := verifyDistribution(tt.win, defaultDistributionThreshold, defaultDistributionMinRequests)
+		if v.Verdict != tt.verdict || v.SkipReason != tt.reason {
+			t.Errorf("%s: verdict %s %q (deviation %.3f), want %s %q", tt.name, v.Verdict, v.SkipReason, v.Deviation, tt.verdict, tt.reason)
+		}
+	}
+
+	v := verifyDistribution(verifyWindow{algorithm: "round-robin", counts: map[string]int64{"a": 300}, shares: even}, 0.1, 1)
+	if v.Deviation != 1 || len(v.Workers) != 2 || v.Workers[1].Worker != "b" || v.Workers[1].Expected != 0.5 || v.Workers[1].Observed != 0 {
+		t.Errorf("starved worker: deviation %v, workers %+v", v.Deviation, v.Workers)
+	}
+}
+
+func TestDistributionVerifierWindow(t *testing.T) {
+	clk := newFakeClock()
+	lb = NewLoadBalancer("round-robin")
+	t.Cleanup(lb.stopControl)
+	lb.clock = clk
+	lb.AddWorker("worker-1", "http://localhost:8081", "#FF0000", 1)
+	lb.AddWorker("worker-2", "http://localhost:8082", "#00FF00", 1)
+	lb.AddWorker("worker-3", "http://localhost:8083", "#0000FF", 1)
+
+	// runWindow spreads the counts over a window, calling during() halfway
+	runWindow := func(counts [3]int, during func()) *DistributionVerdict {
+		lb.sampleDistribution()
+		for s := 1; s <= 60; s++ {
+			clk.Advance(time.Second)
+			for i, n := range counts {
+				for k := 0; k < n/60; k++ {
+					lb.workers[i].stats.observe(time.Millisecond, false)
+				}
+			}
+			if s == 30 && during != nil {
+				during()
+			}
+			lb.sampleDistribution()
+		}
+		return lb.DistributionVerdict()
+	}
+
+	v := runWindow([3]int{600, 120, 120}, nil)
+	if v == nil || v.Verdict != verdictAnomaly || v.Requests != 840 {
+		t.Fatalf("skewed window: %+v", v)
+	}
+	if got := testutil.ToFloat64(lb.metrics.distributionAnomalies.WithLabelValues("round-robin")); got != 1 {
+		t.Errorf("anomalies = %v, want 1", got)
+	}
+	if e := lb.events.since(0, 0); len(e) == 0 || e[len(e)-1].Type != "distribution_anomaly" {
+		t.Errorf("no distribution_anomaly event: %+v", e)
+	}
+	if status := lb.GetStatus(); status["distribution"] != v {
+		t.Errorf("status distribution = %v, want the last verdict", status["distribution"])
+	}
+
+	// The same skew while a worker is disabled halfway is not judged
+	v = runWindow([3]int{600, 120, 120}, func() {
+		f := false
+		lb.UpdateWorker("worker-3", &f, nil)
+	})
+	if v.Verdict != verdictSkipped || v.SkipReason != skipChurn {
+		t.Errorf("window with churn: %s %q", v.Verdict, v.SkipReason)
+	}
+
+	// The window after the change has a stable pool again
+	v = runWindow([3]int{60, 60, 0}, nil)
+	if v.Verdict != verdictSkipped || v.SkipReason != skipLowVolume {
+		t.Errorf("quiet window: %s %q", v.Verdict, v.SkipReason)
+	}
+	v = runWindow([3]int{300, 300, 0}, nil)
+	if v.Verdict != verdictOK {
+		t.Errorf("even window over the remaining workers: %s %q (deviation %.3f)", v.Verdict, v.SkipReason, v.Deviation)
+	}
+	if got := testutil.ToFloat64(lb.metrics.distributionAnomalies.WithLabelValues("round-robin")); got != 1 {
+		t.Errorf("anomalies = %v after skipped and clean windows, want 1", got)
+	}
+}
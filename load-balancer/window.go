@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Recent worker statistics. Besides its lifetime counters every worker
+// counts the tasks it served in a ring of windowSlots one-second buckets,
+// so the status can show what it is doing now: its rate, error rate and
+// latency percentiles over the last windowSlots seconds. A bucket is
+// reused, and its counts dropped, once its second has left the window.
+const windowSlots = 60
+
+// windowBucket counts the tasks of one second
+type windowBucket struct {
+	start    int64 // unix seconds
+	requests int64
+	errors   int64
+	latency  []int64
+}
+
+// recentWindow is a worker's ring of one-second buckets
+type recentWindow struct {
+	mu      sync.Mutex
+	buckets [windowSlots]windowBucket
+}
+
+// observe records a task that finished at now
+func (rw *recentWindow) observe(now time.Time, latency time.Duration, failed bool) {
+	ms := float64(latency) / float64(time.Millisecond)
+	i := sort.SearchFloat64s(statsLatencyBuckets, ms)
+	sec := now.Unix()
+
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	b := &rw.buckets[sec%windowSlots]
+	if b.start != sec {
+		latency := b.latency
+		if latency == nil {
+			latency = make([]int64, len(statsLatencyBuckets)+1)
+		} else {
+			clear(latency)
+		}
+		*b = windowBucket{start: sec, latency: latency}
+	}
+	b.requests++
+	if failed {
+		b.errors++
+	}
+	b.latency[i]++
+}
+
+// WindowStats are a worker's figures over the window
+type WindowStats struct {
+	Rps       float64 `json:"rps"`
+	ErrorRate float64 `json:"errorRate"`
+	P50Ms     float64 `json:"p50Ms"`
+	P95Ms     float64 `json:"p95Ms"`
+	P99Ms     float64 `json:"p99Ms"`
+}
+
+// stats sums the buckets of the windowSlots seconds up to now
+func (rw *recentWindow) stats(now time.Time) WindowStats {
+	snap := statsSnapshot{Buckets: make([]int64, len(statsLatencyBuckets)+1)}
+	oldest := now.Unix() - windowSlots + 1
+
+	rw.mu.Lock()
+	for _, b := range rw.buckets {
+		if b.start < oldest || b.start > now.Unix() {
+			continue
+		}
+		snap.Requests += b.requests
+		snap.Errors += b.errors
+		for i, n := range b.latency {
+			snap.Buckets[i] += n
+		}
+	}
+	rw.mu.Unlock()
+
+	s := WindowStats{Rps: float64(snap.Requests) / windowSlots}
+	if snap.Requests > 0 {
+		s.ErrorRate = float64(snap.Errors) / float64(snap.Requests)
+		s.P50Ms = snap.quantile(0.5)
+		s.P95Ms = snap.quantile(0.95)
+		s.P99Ms = snap.quantile(0.99)
+	}
+	return s
+}
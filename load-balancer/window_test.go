@@ -0,0 +1,104 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRecentWindowStats(t *testing.T) {
+	var rw recentWindow
+	start := time.Unix(1700000000, 0)
+
+	// 90 tasks at 4ms and 10 failed ones at 150ms over ten seconds
+	for i := 0; i < 100; i++ {
+		at := start.Add(time.Duration(i%10) * time.Second)
+		if i < 90 {
+			rw.observe(at, 4*time.Millisecond, false)
+		} else {
+			rw.observe(at, 150*time.Millisecond, true)
+		}
+	}
+	s := rw.stats(start.Add(10 * time.Second))
+	near := func(got, want float64) bool { return math.Abs(got-want) < 1e-9 }
+	// p50 interpolates inside (2,5]ms, p95 and p99 inside (100,200]ms
+	if !near(s.Rps, 100.0/60) || !near(s.ErrorRate, 0.1) ||
+		!near(s.P50Ms, 2+3*50.0/90) || !near(s.P95Ms, 150) || !near(s.P99Ms, 190) {
+		t.Fatalf("stats = %+v", s)
+	}
+
+	// Only the last second's tasks are left 59s after it
+	s = rw.stats(start.Add(68 * time.Second))
+	if !near(s.Rps, 10.0/60) || !near(s.ErrorRate, 0.1) {
+		t.Errorf("59s after the last second: %+v, want its 10 tasks", s)
+	}
+	rw.observe(start.Add(70*time.Second), 40*time.Millisecond, false)
+	s = rw.stats(start.Add(70 * time.Second))
+	if !near(s.Rps, 1.0/60) || s.ErrorRate != 0 || s.P50Ms < 20 || s.P99Ms > 50 {
+		t.Errorf("a minute on: %+v, want the new task only", s)
+	}
+	if s = rw.stats(start.Add(130 * time.Second)); s.Rps != 0 || s.P99Ms != 0 {
+		t.Errorf("once every bucket is old: %+v, want nothing", s)
+	}
+}
+
+func TestRecentWindowSlotReuse(t *testing.T) {
+	var rw recentWindow
+	start := time.Unix(1700000000, 0)
+	for i := 0; i < 5; i++ {
+		rw.observe(start, 500*time.Millisecond, true)
+	}
+	// Same slot a minute later: the old counts are dropped, not added to
+	rw.observe(start.Add(time.Minute), time.Millisecond, false)
+	s := rw.stats(start.Add(time.Minute))
+	if s.Rps != 1.0/60 || s.ErrorRate != 0 || s.P99Ms > 1 {
+		t.Errorf("stats = %+v, want the one new task", s)
+	}
+}
+
+func TestRecentWindowConcurrent(t *testing.T) {
+	var rw recentWindow
+	now := time.Now()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				rw.observe(now, 10*time.Millisecond, i%5 == 0)
+				rw.stats(now)
+			}
+		}()
+	}
+	wg.Wait()
+	if s := rw.stats(now); s.Rps != 4000.0/60 || s.ErrorRate != 0.2 {
+		t.Errorf("stats = %+v, want 4000 tasks, a fifth failed", s)
+	}
+}
+
+func TestStatusRecentStats(t *testing.T) {
+	clk := newFakeClock()
+	lb = NewLoadBalancer("round-robin")
+	lb.clock = clk
+	lb.AddWorker("worker-1", newDelayStub(t, "worker-1", 0).URL, "#FF0000", 1)
+	for i := 0; i < 6; i++ {
+		doTask(nil)
+	}
+
+	workers := lb.GetStatus()["workers"].([]map[string]interface{})
+	if workers[0]["rps"] != 6.0/60 || workers[0]["errorRate"] != 0.0 || workers[0]["p50Ms"].(float64) <= 0 {
+		t.Errorf("status: rps %v, errorRate %v, p50Ms %v", workers[0]["rps"], workers[0]["errorRate"], workers[0]["p50Ms"])
+	}
+	status, _ := lb.WorkerStatus("worker-1")
+	if status.Rps != 6.0/60 || status.P99Ms < status.P50Ms {
+		t.Errorf("worker status = %+v", status)
+	}
+
+	// A minute later the tasks have aged out while the lifetime counters keep them
+	clk.Advance(time.Minute)
+	workers = lb.GetStatus()["workers"].([]map[string]interface{})
+	if workers[0]["rps"] != 0.0 || workers[0]["totalRequests"] != int64(6) {
+		t.Errorf("after a minute: rps %v, totalRequests %v", workers[0]["rps"], workers[0]["totalRequests"])
+	}
+}
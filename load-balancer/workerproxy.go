@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// handleWorkerLogs は /workers/{name}/logs への GET をワーカーの /logs へクエリパラメータごとプロキシする HTTP ハンドラです。
+// ワーカーが見つからない場合は 404、ワーカーへ到達できない場合は 502 を返します。
+func handleWorkerLogs(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	endpoint := "/logs"
+	if r.URL.RawQuery != "" {
+		endpoint += "?" + r.URL.RawQuery
+	}
+	proxyToWorker(w, r, name, endpoint, nil)
+}
+
+// handleWorkerSchema は /workers/{name}/schema への GET をワーカーの /schema へプロキシし、タスクスキーマを返す HTTP ハンドラです。
+// ワーカーが見つからない場合は 404、ワーカーへ到達できない場合は 502 を返します。
+func handleWorkerSchema(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	proxyToWorker(w, r, name, "/schema", nil)
+}
+
+// workerURL returns the URL of the named worker, or "" if there is none
+func (lb *LoadBalancer) workerURL(name string) string {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	if w := lb.findWorkerLocked(name); w != nil {
+		return w.URL
+	}
+	return ""
+}
+
+// errWorkerNotFound and errWorkerUnreachable are returned by callWorker
+var (
+	errWorkerNotFound    = errors.New("worker not found")
+	errWorkerUnreachable = errors.New("worker unreachable")
+)
+
+// workerResponse is a worker's response read within MaxUpstreamBodyBytes
+type workerResponse struct {
+	status      int
+	contentType string
+	body        []byte
+}
+
+// callWorker sends a request to endpoint on the named worker, sending body as
+// JSON when it is not nil, and reads the response. Requests are bounded by
+// ctx and a 5 second client timeout.
+func (lb *LoadBalancer) callWorker(ctx context.Context, workerName, method, endpoint string, body io.Reader) (*workerResponse, error) {
+	return lb.callWorkerWith(ctx, workerName, method, endpoint, body, nil)
+}
+
+// callWorkerWith is callWorker with extra request headers
+func (lb *LoadBalancer) callWorkerWith(ctx context.Context, workerName, method, endpoint string, body io.Reader, headers map[string]string) (*workerResponse, error) {
+	workerURL := lb.workerURL(workerName)
+	if workerURL == "" {
+		return nil, errWorkerNotFound
+	}
+
+	client := lb.resources.timeoutClient(5 * time.Second)
+	req, err := http.NewRequestWithContext(ctx, method, workerURL+endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errWorkerUnreachable, err)
+	}
+	defer resp.Body.Close()
+
+	// Read response body, bounded like task responses
+	respBody, err := readLimited(resp.Body, lb.Settings().MaxUpstreamBodyBytes)
+	if err == errBodyTooLarge {
+		lb.metrics.upstreamBodyTooLarge.WithLabelValues(workerName).Inc()
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &workerResponse{status: resp.StatusCode, contentType: resp.Header.Get("Content-Type"), body: respBody}, nil
+}
+
+// proxyToWorker forwards r to endpoint on the named worker and copies the
+// response back. A JSON object response gets a "worker" field added;
+// anything else is passed through. An unknown worker is a 404, an
+// unreachable one or an oversized response a 502.
+func proxyToWorker(w http.ResponseWriter, r *http.Request, workerName, endpoint string, body io.Reader) {
+	resp, err := lb.callWorker(r.Context(), workerName, r.Method, endpoint, body)
+	switch {
+	case err == nil:
+	case errors.Is(err, errWorkerNotFound):
+		http.Error(w, "Worker not found", http.StatusNotFound)
+		return
+	case errors.Is(err, errWorkerUnreachable):
+		http.Error(w, "Failed to reach worker", http.StatusBadGateway)
+		return
+	case err == errBodyTooLarge:
+		http.Error(w, "Worker response too large", http.StatusBadGateway)
+		return
+	default:
+		http.Error(w, "Failed to read worker response", http.StatusBadGateway)
+		return
+	}
+
+	// Try to decode as JSON and add worker field
+	var result map[string]interface{}
+	if err := json.Unmarshal(resp.body, &result); err == nil {
+		result["worker"] = workerName
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.status)
+		json.NewEncoder(w).Encode(result)
+	} else {
+		// If not JSON, copy raw response
+		if resp.contentType != "" {
+			w.Header().Set("Content-Type", resp.contentType)
+		} else {
+			w.Header().Set("Content-Type", "application/octet-stream")
+		}
+		w.WriteHeader(resp.status)
+		w.Write(resp.body)
+	}
+}
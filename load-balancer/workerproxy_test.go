@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWorkerLogsProxy(t *testing.T) {
+	var gotQuery string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/logs" {
+			http.NotFound(w, r)
+			return
+		}
+		gotQuery = r.URL.RawQuery
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"entries":[{"level":"warn","message":"Task rejected: queue full"}],"dropped":0}`))
+	}))
+	defer srv.Close()
+
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+	lb.AddWorker("worker-2", "http://127.0.0.1:1", "#00FF00", 1)
+	mux := newMux()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	rec := get("/api/workers/worker-1/logs?limit=200&level=warn")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status code = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if gotQuery != "limit=200&level=warn" {
+		t.Errorf("forwarded query = %q", gotQuery)
+	}
+	var body struct {
+		Worker  string
+		Entries []map[string]interface{}
+	}
+	json.NewDecoder(rec.Body).Decode(&body)
+	if body.Worker != "worker-1" || len(body.Entries) != 1 {
+		t.Errorf("body = %+v, want the worker's entries tagged with its name", body)
+	}
+
+	if rec := get("/workers/nope/logs"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown worker: status code = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := get("/workers/worker-2/logs"); rec.Code != http.StatusBadGateway {
+		t.Errorf("unreachable worker: status code = %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/workers/worker-1/logs", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status code = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestWorkerSchemaProxy(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/schema" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"enabled":true,"schema":{"type":"object","required":["id"]}}`))
+	}))
+	defer srv.Close()
+
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", srv.URL, "#FF0000", 1)
+	mux := newMux()
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/workers/worker-1/schema", nil))
+	var body struct {
+		Worker  string
+		Enabled bool
+		Schema  map[string]interface{}
+	}
+	json.NewDecoder(rec.Body).Decode(&body)
+	if rec.Code != http.StatusOK || body.Worker != "worker-1" || !body.Enabled || body.Schema["type"] != "object" {
+		t.Errorf("status %d, body %+v, want the worker's schema", rec.Code, body)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/workers/nope/schema", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown worker: status code = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
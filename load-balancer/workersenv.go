@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+// workersEnvVar defines workers without code changes. It holds either a JSON
+// array of AddWorkerRequest objects or the compact form
+//
+//	name=url[,weight=N][,maxLoad=N][,color=#RRGGBB][,healthPath=/path][,label.key=value];...
+//
+// In the JSON form an omitted or zero weight/maxLoad takes the default (weight
+// 1, defaultMaxLoad), as it does for POST /workers; the compact form only
+// accepts positive values.
+const workersEnvVar = "WORKERS"
+
+// legacyWorker is one of the fixed per-worker env vars (WORKER_GO_1_URL, ...)
+type legacyWorker struct {
+	envVar  string
+	name    string
+	color   string
+	weight  int
+	maxLoad int
+}
+
+var legacyWorkers = []legacyWorker{
+	{"WORKER_GO_1_URL", "go-worker-1", "#3B82F6", 5, 3},
+	{"WORKER_GO_2_URL", "go-worker-2", "#6366F1", 2, 3},
+	{"WORKER_RUST_1_URL", "rust-worker-1", "#F97316", 6, 3},
+	{"WORKER_RUST_2_URL", "rust-worker-2", "#EAB308", 1, 3},
+	{"WORKER_PYTHON_1_URL", "python-worker-1", "#10B981", 1, 3},
+	{"WORKER_PYTHON_2_URL", "python-worker-2", "#14B8A6", 3, 3},
+}
+
+// legacyWorkerDefs returns the workers configured through the fixed env vars,
+// with their <NAME>_WEIGHT and <NAME>_LABELS overrides applied
+func legacyWorkerDefs(getenv func(string) string, logf func(string, ...interface{})) []api.AddWorkerRequest {
+	var defs []api.AddWorkerRequest
+	for _, cfg := range legacyWorkers {
+		addr := getenv(cfg.envVar)
+		if addr == "" {
+			continue
+		}
+		prefix := strings.ToUpper(strings.ReplaceAll(cfg.name, "-", "_"))
+		def := api.AddWorkerRequest{Name: cfg.name, URL: addr, Color: cfg.color, Weight: cfg.weight, MaxLoad: cfg.maxLoad}
+		if wStr := getenv(prefix + "_WEIGHT"); wStr != "" {
+			if w, err := strconv.Atoi(wStr); err == nil && w > 0 {
+				def.Weight = w
+			}
+		}
+		if raw := getenv(prefix + "_LABELS"); raw != "" {
+			if labels, err := parseLabels(raw); err == nil {
+				def.Labels = labels
+			} else {
+				logf("Ignoring %s_LABELS: %v", prefix, err)
+			}
+		}
+		defs = append(defs, def)
+	}
+	return defs
+}
+
+// parseWorkers parses the WORKERS value. An invalid entry, or one naming a
+// worker an earlier entry already defines, is skipped with an error naming
+// it; the other entries are still returned. A JSON value that does not
+// parse as an array defines no worker.
+func parseWorkers(raw string) ([]api.AddWorkerRequest, []error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+
+	var defs []api.AddWorkerRequest
+	var where []string
+	var errs []error
+	if strings.HasPrefix(raw, "[") {
+		var entries []json.RawMessage
+		if err := json.Unmarshal([]byte(raw), &entries); err != nil {
+			return nil, []error{fmt.Errorf("%s: invalid JSON: %v", workersEnvVar, err)}
+		}
+		for i, entry := range entries {
+			w := fmt.Sprintf("%s[%d]", workersEnvVar, i)
+			def, err := parseWorkerJSON(entry)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", w, err))
+				continue
+			}
+			defs = append(defs, def)
+			where = append(where, w)
+		}
+	} else {
+		for i, seg := range strings.Split(raw, ";") {
+			seg = strings.TrimSpace(seg)
+			if seg == "" {
+				continue
+			}
+			w := fmt.Sprintf("%s segment %d (%q)", workersEnvVar, i+1, seg)
+			def, err := parseWorkerSegment(seg)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", w, err))
+				continue
+			}
+			defs = append(defs, def)
+			where = append(where, w)
+		}
+	}
+
+	seen := make(map[string]string)
+	unique := defs[:0]
+	for i, def := range defs {
+		if first, ok := seen[def.Name]; ok {
+			errs = append(errs, fmt.Errorf("%s: worker %q is already defined by %s", where[i], def.Name, first))
+			continue
+		}
+		seen[def.Name] = where[i]
+		unique = append(unique, def)
+	}
+	return unique, errs
+}
+
+// parseWorkerJSON parses one entry of the JSON form
+func parseWorkerJSON(entry json.RawMessage) (api.AddWorkerRequest, error) {
+	var def api.AddWorkerRequest
+	dec := json.NewDecoder(bytes.NewReader(entry))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&def); err != nil {
+		return def, fmt.Errorf("invalid JSON: %v", err)
+	}
+	return def, validateWorkerDef(def)
+}
+
+// parseWorkerSegment parses one "name=url,key=value,..." entry
+func parseWorkerSegment(seg string) (api.AddWorkerRequest, error) {
+	parts := strings.Split(seg, ",")
+	name, addr, ok := strings.Cut(parts[0], "=")
+	def := api.AddWorkerRequest{Name: strings.TrimSpace(name), URL: strings.TrimSpace(addr)}
+	if !ok || def.Name == "" || def.URL == "" {
+		return def, fmt.Errorf("expected name=url first, got %q", parts[0])
+	}
+	for _, opt := range parts[1:] {
+		k, v, ok := strings.Cut(strings.TrimSpace(opt), "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" {
+			return def, fmt.Errorf("expected key=value, got %q", opt)
+		}
+		switch {
+		case k == "weight" || k == "maxLoad":
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return def, fmt.Errorf("%s must be a positive integer, got %q", k, v)
+			}
+			if k == "weight" {
+				def.Weight = n
+			} else {
+				def.MaxLoad = n
+			}
+		case k == "color":
+			def.Color = v
+		case k == "healthPath":
+			def.HealthPath = v
+		case strings.HasPrefix(k, "label.") && len(k) > len("label."):
+			if def.Labels == nil {
+				def.Labels = make(map[string]string)
+			}
+			def.Labels[strings.TrimPrefix(k, "label.")] = v
+		default:
+			return def, fmt.Errorf("unknown option %q", k)
+		}
+	}
+	return def, validateWorkerDef(def)
+}
+
+// validateWorkerDef checks the fields shared by both WORKERS formats
+func validateWorkerDef(def api.AddWorkerRequest) error {
+	if def.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if err := validateWorkerURL(def.URL); err != nil {
+		return err
+	}
+	if def.Weight < 0 {
+		return fmt.Errorf("weight must not be negative, got %d", def.Weight)
+	}
+	if def.MaxLoad < 0 {
+		return fmt.Errorf("maxLoad must not be negative, got %d", def.MaxLoad)
+	}
+	if err := validateHealthPath(def.HealthPath); err != nil {
+		return fmt.Errorf("healthPath %s", err.(*MetadataError).Message)
+	}
+	var color *string
+	if def.Color != "" {
+		color = &def.Color
+	}
+	return validateWorkerMetadata(color, &def.DisplayName, &def.Description, &def.Icon)
+}
+
+// mergeWorkerDefs combines the legacy and WORKERS definitions. A WORKERS entry
+// replaces a legacy worker of the same name; overridden lists those names.
+// Legacy workers come first, in table order, followed by WORKERS in order.
+func mergeWorkerDefs(legacy, generic []api.AddWorkerRequest) (defs []api.AddWorkerRequest, overridden []string) {
+	names := make(map[string]bool, len(generic))
+	for _, def := range generic {
+		names[def.Name] = true
+	}
+	for _, def := range legacy {
+		if names[def.Name] {
+			overridden = append(overridden, def.Name)
+			continue
+		}
+		defs = append(defs, def)
+	}
+	return append(defs, generic...), overridden
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/network-sandbox/load-balancer/api"
+)
+
+func TestParseWorkersDSL(t *testing.T) {
+	defs, err := parseWorkers(" go-worker-3=http://go3:8080,weight=4,color=#AA00FF,maxLoad=5 ; rust-worker-3=http://rust3:8080,label.zone=b,healthPath=/ping ;")
+	if err != nil {
+		t.Fatalf("parseWorkers: %v", err)
+	}
+	want := []api.AddWorkerRequest{
+		{Name: "go-worker-3", URL: "http://go3:8080", Weight: 4, Color: "#AA00FF", MaxLoad: 5},
+		{Name: "rust-worker-3", URL: "http://rust3:8080", Labels: map[string]string{"zone": "b"}, HealthPath: "/ping"},
+	}
+	if !reflect.DeepEqual(defs, want) {
+		t.Errorf("defs = %+v, want %+v", defs, want)
+	}
+}
+
+func TestParseWorkersJSON(t *testing.T) {
+	defs, err := parseWorkers(`[
+		{"name":"go-worker-3","url":"http://go3:8080","weight":4,"color":"#AA00FF","maxLoad":5},
+		{"name":"py-worker-3","url":"https://py3:8443","labels":{"zone":"a"},"displayName":"Python 3"}
+	]`)
+	if err != nil {
+		t.Fatalf("parseWorkers: %v", err)
+	}
+	want := []api.AddWorkerRequest{
+		{Name: "go-worker-3", URL: "http://go3:8080", Weight: 4, Color: "#AA00FF", MaxLoad: 5},
+		{Name: "py-worker-3", URL: "https://py3:8443", Labels: map[string]string{"zone": "a"}, DisplayName: "Python 3"},
+	}
+	if !reflect.DeepEqual(defs, want) {
+		t.Errorf("defs = %+v, want %+v", defs, want)
+	}
+
+	if defs, err := parseWorkers("  "); err != nil || defs != nil {
+		t.Errorf("empty WORKERS = %v, %v; want nothing", defs, err)
+	}
+}
+
+func TestParseWorkersErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string // substrings of the error
+	}{
+		{"missing url", "a=http://a:1;b", `segment 2 ("b"): expected name=url first`},
+		{"bad weight", "a=http://a:1,weight=x", `segment 1 ("a=http://a:1,weight=x"): weight must be a positive integer, got "x"`},
+		{"zero maxLoad", "a=http://a:1,maxLoad=0", "maxLoad must be a positive integer"},
+		{"unknown option", "a=http://a:1,wieght=2", `unknown option "wieght"`},
+		{"bare option", "a=http://a:1,weight", `expected key=value, got "weight"`},
+		{"bad color", "a=http://a:1,color=purple", "color: must be a hex color"},
+		{"relative url", "a=a:1", `url must be an absolute http(s) URL, got "a:1"`},
+		{"relative healthPath", "a=http://a:1,healthPath=ping", "healthPath must be an absolute path"},
+		{"duplicate dsl", "a=http://a:1;b=http://b:1;a=http://a:2", `segment 3 ("a=http://a:2"): worker "a" is already defined by WORKERS segment 1`},
+		{"invalid json", `[{"name":"a",}]`, "WORKERS: invalid JSON"},
+		{"unknown json field", `[{"name":"a","url":"http://a:1","wieght":2}]`, `unknown field "wieght"`},
+		{"json missing name", `[{"url":"http://a:1"}]`, "WORKERS[0]: name is required"},
+		{"json negative weight", `[{"name":"a","url":"http://a:1"},{"name":"b","url":"http://b:1","weight":-1}]`, "WORKERS[1]: weight must not be negative"},
+		{"duplicate json", `[{"name":"a","url":"http://a:1"},{"name":"a","url":"http://a:2"}]`, `WORKERS[1]: worker "a" is already defined by WORKERS[0]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, errs := parseWorkers(tt.raw)
+			if len(errs) != 1 || !strings.Contains(errs[0].Error(), tt.want) {
+				t.Errorf("errs = %v, want one containing %q", errs, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseWorkersZeroWeightTakesDefault(t *testing.T) {
+	defs, errs := parseWorkers(`[{"name":"a","url":"http://a:1","weight":0},{"name":"b","url":"http://b:1"}]`)
+	if len(errs) != 0 || len(defs) != 2 {
+		t.Fatalf("defs %+v, errs %v; want both workers", defs, errs)
+	}
+	lb := NewLoadBalancer("round-robin")
+	for _, def := range defs {
+		status, ok := lb.registerWorker(def)
+		if !ok || status.Weight != 1 {
+			t.Errorf("%s registered = %+v, %v; want weight 1", def.Name, status, ok)
+		}
+	}
+}
+
+func TestParseWorkersSkipsInvalidEntries(t *testing.T) {
+	defs, errs := parseWorkers(`[
+		{"name":"py-worker-1","url":"http://py1:8080"},
+		{"name":"py-worker-2","url":"py2:8080"},
+		{"name":"py-worker-3","url":"http://py3:8080","wieght":2},
+		{"name":"py-worker-1","url":"http://other:8080"},
+		{"name":"py-worker-4","url":"http://py4:8080","weight":2}
+	]`)
+	var names []string
+	for _, d := range defs {
+		names = append(names, d.Name)
+	}
+	if want := []string{"py-worker-1", "py-worker-4"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("loaded %v, want %v", names, want)
+	}
+	if defs[0].URL != "http://py1:8080" {
+		t.Errorf("py-worker-1 = %+v, want the first definition", defs[0])
+	}
+	if len(errs) != 3 || !strings.HasPrefix(errs[0].Error(), "WORKERS[1]: url") ||
+		!strings.HasPrefix(errs[1].Error(), "WORKERS[2]: invalid JSON") ||
+		!strings.HasPrefix(errs[2].Error(), `WORKERS[3]: worker "py-worker-1" is already defined by WORKERS[0]`) {
+		t.Errorf("errs = %v", errs)
+	}
+
+	defs, errs = parseWorkers("a=http://a:1,weight=0;b=http://b:1")
+	if len(defs) != 1 || defs[0].Name != "b" || len(errs) != 1 {
+		t.Errorf("dsl: defs %+v, errs %v; want only b", defs, errs)
+	}
+}
+
+func TestMergeWorkerDefs(t *testing.T) {
+	env := map[string]string{
+		"WORKER_GO_1_URL":      "http://go1:8080",
+		"WORKER_RUST_1_URL":    "http://rust1:8080",
+		"RUST_WORKER_1_WEIGHT": "9",
+	}
+	var logged []string
+	legacy := legacyWorkerDefs(func(k string) string { return env[k] }, func(f string, a ...interface{}) { logged = append(logged, f) })
+	if len(legacy) != 2 || legacy[1].Weight != 9 || legacy[0].MaxLoad != 3 {
+		t.Fatalf("legacy defs = %+v", legacy)
+	}
+
+	generic, err := parseWorkers("go-worker-3=http://go3:8080;go-worker-1=http://other:8080,weight=7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defs, overridden := mergeWorkerDefs(legacy, generic)
+	var names []string
+	for _, d := range defs {
+		names = append(names, d.Name)
+	}
+	if want := []string{"rust-worker-1", "go-worker-3", "go-worker-1"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("merged order = %v, want %v", names, want)
+	}
+	if defs[2].URL != "http://other:8080" || defs[2].Weight != 7 {
+		t.Errorf("overriding def = %+v, want the WORKERS one", defs[2])
+	}
+	if !reflect.DeepEqual(overridden, []string{"go-worker-1"}) {
+		t.Errorf("overridden = %v, want [go-worker-1]", overridden)
+	}
+	if len(logged) != 0 {
+		t.Errorf("unexpected log lines: %v", logged)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsWriteTimeout bounds a single status write to a WebSocket client. A client
+// that cannot take a message within it is disconnected.
+const wsWriteTimeout = 5 * time.Second
+
+// WebSocket close reasons. wsCloseNormal is a close frame from the client;
+// the others label lb_ws_error_closes_total.
+const (
+	wsCloseNormal    = "normal"
+	wsWriteTimedOut  = "write_timeout"
+	wsWriteFailed    = "write_error"
+	wsReadFailed     = "read_error"
+	wsOriginRejected = "origin_rejected"
+)
+
+// wsClient is a connected WebSocket status client. Its counters are guarded
+// by lb.wsClientsMu, which is also held for every write to conn.
+type wsClient struct {
+	conn        *websocket.Conn
+	remoteAddr  string
+	connectedAt time.Time
+	exclude     []string
+	// full is set for clients subscribed with ?full=1, which are never
+	// sent the summary form
+	full      bool
+	sent      int64
+	sentBytes int64
+	// events is set for session clients, which are also sent every event;
+	// eventSeq is the last one they were sent
+	events   bool
+	session  *wsSession
+	eventSeq int64
+}
+
+// WSClientInfo describes a connected WebSocket client for /ws/clients
+type WSClientInfo struct {
+	RemoteAddr   string    `json:"remoteAddr"`
+	ConnectedAt  time.Time `json:"connectedAt"`
+	Exclude      []string  `json:"exclude"`
+	Full         bool      `json:"full"`
+	MessagesSent int64     `json:"messagesSent"`
+	BytesSent    int64     `json:"bytesSent"`
+}
+
+// wsWriteCloseReason classifies a failed write
+func wsWriteCloseReason(err error) string {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return wsWriteTimedOut
+	}
+	return wsWriteFailed
+}
+
+// wsReadCloseReason classifies the error that ended a client's read loop
+func wsReadCloseReason(err error) string {
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		return wsCloseNormal
+	}
+	return wsReadFailed
+}
+
+// sendWSLocked writes data to the client and counts it. Must be called with
+// lb.wsClientsMu held.
+func (lb *LoadBalancer) sendWSLocked(c *wsClient, data []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		return err
+	}
+	c.sent++
+	c.sentBytes += int64(len(data))
+	lb.metrics.wsMessagesSent.Inc()
+	lb.metrics.wsBytesSent.Add(float64(len(data)))
+	return nil
+}
+
+// addWSClient registers conn and sends it the current status in the full
+// form. With a session request the client is also sent its session and
+// events; see wsresume.go.
+func (lb *LoadBalancer) addWSClient(conn *websocket.Conn, exclude []string, full bool, session *wsSessionRequest) {
+	c := &wsClient{
+		conn:        conn,
+		remoteAddr:  conn.RemoteAddr().String(),
+		connectedAt: time.Now(),
+		exclude:     exclude,
+		full:        full,
+	}
+	lb.wsClientsMu.Lock()
+	defer lb.wsClientsMu.Unlock()
+	lb.wsClients[conn] = c
+	atomic.AddInt32(&lb.wsClientCount, 1)
+	lb.metrics.wsConnects.Inc()
+
+	data, _ := json.Marshal(filterStatus(withBroadcastMode(lb.GetStatus(), broadcastFull), exclude))
+	var err error
+	if session != nil {
+		err = lb.startWSSessionLocked(c, session, data)
+	} else {
+		err = lb.sendWSLocked(c, data)
+	}
+	if err != nil {
+		lb.removeWSClientLocked(conn, wsWriteCloseReason(err))
+	}
+}
+
+// removeWSClientLocked unregisters and closes conn, recording why it was
+// closed. Clients already removed are ignored, so a close is counted once
+// even when both the writer and the reader notice it. Must be called with
+// lb.wsClientsMu held.
+func (lb *LoadBalancer) removeWSClientLocked(conn *websocket.Conn, reason string) {
+	c, ok := lb.wsClients[conn]
+	if !ok {
+		return
+	}
+	delete(lb.wsClients, conn)
+	atomic.AddInt32(&lb.wsClientCount, -1)
+	if c.events {
+		atomic.AddInt32(&lb.wsEventClients, -1)
+	}
+	if c.session != nil {
+		lb.wsSessions.release(c.session, lb.clock.Now())
+	}
+	conn.Close()
+	if reason == wsCloseNormal {
+		lb.metrics.wsNormalCloses.Inc()
+	} else {
+		lb.metrics.wsErrorCloses.WithLabelValues(reason).Inc()
+	}
+	lb.metrics.wsLifetime.Observe(time.Since(c.connectedAt).Seconds())
+}
+
+// WSClients lists the connected WebSocket clients, oldest first
+func (lb *LoadBalancer) WSClients() []WSClientInfo {
+	lb.wsClientsMu.Lock()
+	defer lb.wsClientsMu.Unlock()
+	out := make([]WSClientInfo, 0, len(lb.wsClients))
+	for _, c := range lb.wsClients {
+		out = append(out, WSClientInfo{
+			RemoteAddr:   c.remoteAddr,
+			ConnectedAt:  c.connectedAt.UTC(),
+			Exclude:      append([]string{}, c.exclude...),
+			Full:         c.full,
+			MessagesSent: c.sent,
+			BytesSent:    c.sentBytes,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ConnectedAt.Before(out[j].ConnectedAt) })
+	return out
+}
+
+// handleWSClients は接続中の WebSocket クライアント一覧を返す HTTP ハンドラです。
+// 各クライアントのリモートアドレス、接続時刻、?exclude= で指定したフィルタ、送信メッセージ数とバイト数を接続の古い順に返します。
+func handleWSClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"clients": lb.WSClients(),
+	})
+}
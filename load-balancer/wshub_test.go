@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func dialWS(t *testing.T, srv *httptest.Server, query string, header http.Header) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws"+query, header)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatalf("initial status: %v", err)
+	}
+	return conn
+}
+
+func listWSClients(t *testing.T, srv *httptest.Server) []WSClientInfo {
+	t.Helper()
+	resp, err := http.Get(srv.URL + "/api/ws/clients")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct{ Clients []WSClientInfo }
+	json.NewDecoder(resp.Body).Decode(&body)
+	return body.Clients
+}
+
+// waitForWSClients polls until n clients are connected
+func waitForWSClients(t *testing.T, srv *httptest.Server, n int) []WSClientInfo {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		clients := listWSClients(t, srv)
+		if len(clients) == n {
+			return clients
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("clients = %+v, want %d", clients, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWSHubLifecycle(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.AddWorker("worker-1", "http://localhost:8081", "#FF0000", 1)
+	srv := httptest.NewServer(newMux())
+	defer srv.Close()
+
+	a := dialWS(t, srv, "?exclude=self", nil)
+	b := dialWS(t, srv, "", nil)
+	clients := waitForWSClients(t, srv, 2)
+	if got := clients[0].Exclude; len(got) != 1 || got[0] != "self" {
+		t.Errorf("first client exclude = %v, want [self]", got)
+	}
+	for _, c := range clients {
+		if c.RemoteAddr == "" || c.ConnectedAt.IsZero() || c.MessagesSent != 1 || c.BytesSent == 0 {
+			t.Errorf("client = %+v, want address, connect time and the initial message", c)
+		}
+	}
+
+	lb.BroadcastStatus()
+	a.ReadMessage()
+	b.ReadMessage()
+	m := lb.metrics
+	if got := testutil.ToFloat64(m.wsConnects); got != 2 {
+		t.Errorf("connects = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(m.wsMessagesSent); got != 4 {
+		t.Errorf("messages sent = %v, want 4", got)
+	}
+	var bytes int64
+	for _, c := range listWSClients(t, srv) {
+		bytes += c.BytesSent
+	}
+	if got := testutil.ToFloat64(m.wsBytesSent); got != float64(bytes) {
+		t.Errorf("bytes sent = %v, want %d", got, bytes)
+	}
+
+	// a closes cleanly, b drops the connection without a close frame
+	a.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	a.Close()
+	waitForWSClients(t, srv, 1)
+	b.Close()
+	waitForWSClients(t, srv, 0)
+
+	if got := testutil.ToFloat64(m.wsNormalCloses); got != 1 {
+		t.Errorf("normal closes = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.wsErrorCloses.WithLabelValues(wsReadFailed)); got != 1 {
+		t.Errorf("read error closes = %v, want 1", got)
+	}
+	if got := testutil.CollectAndCount(m.wsErrorCloses); got != 1 {
+		t.Errorf("error close categories = %d, want only read_error", got)
+	}
+	if !strings.Contains(scrape(t, lb.MetricsHandler()), "lb_ws_connection_lifetime_seconds_count 2") {
+		t.Error("both connection lifetimes should be observed")
+	}
+}
+
+func TestWSHubOriginRejected(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	srv := httptest.NewServer(newMux())
+	defer srv.Close()
+	t.Setenv("ALLOWED_ORIGINS", "http://dashboard.example")
+
+	header := http.Header{"Origin": []string{"http://elsewhere.example"}}
+	if _, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", header); err == nil {
+		t.Fatal("dial from a disallowed origin should fail")
+	}
+	if got := testutil.ToFloat64(lb.metrics.wsErrorCloses.WithLabelValues(wsOriginRejected)); got != 1 {
+		t.Errorf("origin rejected = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(lb.metrics.wsConnects); got != 0 {
+		t.Errorf("connects = %v, want 0", got)
+	}
+
+	header.Set("Origin", "http://dashboard.example")
+	dialWS(t, srv, "", header).Close()
+}
+
+func TestWSHubBrokenConnCountedOnce(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	srv := httptest.NewServer(newMux())
+	defer srv.Close()
+
+	conn := dialWS(t, srv, "", nil)
+	defer conn.Close()
+	waitForWSClients(t, srv, 1)
+
+	// Break the server side of the connection; the broadcast and the read
+	// loop both notice, but only one of them records the close
+	lb.wsClientsMu.Lock()
+	for c := range lb.wsClients {
+		c.UnderlyingConn().Close()
+	}
+	lb.wsClientsMu.Unlock()
+	lb.BroadcastStatus()
+
+	waitForWSClients(t, srv, 0)
+	m := lb.metrics
+	writeErrs := testutil.ToFloat64(m.wsErrorCloses.WithLabelValues(wsWriteFailed))
+	readErrs := testutil.ToFloat64(m.wsErrorCloses.WithLabelValues(wsReadFailed))
+	if writeErrs+readErrs != 1 {
+		t.Errorf("write errors = %v, read errors = %v, want the close counted once", writeErrs, readErrs)
+	}
+}
+
+func TestWSCloseReasons(t *testing.T) {
+	if got := wsWriteCloseReason(os.ErrDeadlineExceeded); got != wsWriteTimedOut {
+		t.Errorf("timeout write reason = %q, want %q", got, wsWriteTimedOut)
+	}
+	if got := wsWriteCloseReason(os.ErrClosed); got != wsWriteFailed {
+		t.Errorf("closed write reason = %q, want %q", got, wsWriteFailed)
+	}
+	if got := wsReadCloseReason(&websocket.CloseError{Code: websocket.CloseGoingAway}); got != wsCloseNormal {
+		t.Errorf("going away reason = %q, want %q", got, wsCloseNormal)
+	}
+	if got := wsReadCloseReason(&websocket.CloseError{Code: websocket.CloseAbnormalClosure}); got != wsReadFailed {
+		t.Errorf("abnormal close reason = %q, want %q", got, wsReadFailed)
+	}
+}
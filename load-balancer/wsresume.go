@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WebSocket sessions. A client connecting with ?session=1 is given a
+// resumption token and the current event sequence number, and is sent every
+// event as it is emitted. Reconnecting with ?resume=<token>&after=<seq>
+// replays the events it missed from the event store before it continues
+// live. Tokens expire once their session has been disconnected for the idle
+// period.
+const (
+	wsSessionCapacity    = 1000
+	defaultWSSessionIdle = 5 * time.Minute
+	wsSessionIdleEnvVar  = "LB_WS_SESSION_IDLE_MS"
+	wsMessageSession     = "session"
+	wsMessageEvent       = "event"
+	wsResumeReplayed     = "replayed"
+	wsResumeResync       = "resync"
+)
+
+// wsSessionMessage is the first message sent to a session client. The token
+// is omitted when the session store is full. ResyncRequired means the missed
+// events could not be replayed, either because the token is unknown or
+// because the event store rolled over, and the client must refetch /events.
+type wsSessionMessage struct {
+	Type           string `json:"type"`
+	Token          string `json:"token,omitempty"`
+	Seq            int64  `json:"seq"`
+	Resumed        bool   `json:"resumed,omitempty"`
+	ResyncRequired bool   `json:"resyncRequired,omitempty"`
+}
+
+// wsEventMessage carries one event to a session client
+type wsEventMessage struct {
+	Type  string `json:"type"`
+	Event Event  `json:"event"`
+}
+
+// wsSessionRequest is what a client asked for in its /ws query. A nil
+// request is a plain status client.
+type wsSessionRequest struct {
+	resume string
+	after  int64
+}
+
+// parseWSSessionRequest reads ?session=1 or ?resume=<token>&after=<seq>
+func parseWSSessionRequest(q url.Values) *wsSessionRequest {
+	if token := q.Get("resume"); token != "" {
+		after, _ := strconv.ParseInt(q.Get("after"), 10, 64)
+		return &wsSessionRequest{resume: token, after: after}
+	}
+	if on, _ := strconv.ParseBool(q.Get("session")); on {
+		return &wsSessionRequest{}
+	}
+	return nil
+}
+
+// wsSession is a resumable WebSocket session. lastSeen is when its last
+// connection closed; it is guarded by wsSessionStore.mu.
+type wsSession struct {
+	token     string
+	connected int
+	lastSeen  time.Time
+}
+
+// wsSessionStore holds the sessions by token. It is bounded: when full and
+// no session has expired, new sessions are not given a token.
+type wsSessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*wsSession
+	capacity int
+	idle     time.Duration
+}
+
+func newWSSessionStore(capacity int) *wsSessionStore {
+	return &wsSessionStore{
+		sessions: make(map[string]*wsSession),
+		capacity: capacity,
+		idle:     defaultWSSessionIdle,
+	}
+}
+
+func (s *wsSessionStore) size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+func (s *wsSessionStore) bounds() storeBounds {
+	return storeBounds{Capacity: s.capacity, MaxAgeMs: s.idle.Milliseconds()}
+}
+
+// sweep evicts the sessions that have been disconnected for the idle period
+func (s *wsSessionStore) sweep(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sweepLocked(now)
+}
+
+func (s *wsSessionStore) sweepLocked(now time.Time) int {
+	n := 0
+	for token, sess := range s.sessions {
+		if s.expiredLocked(sess, now) {
+			delete(s.sessions, token)
+			n++
+		}
+	}
+	return n
+}
+
+func (s *wsSessionStore) expiredLocked(sess *wsSession, now time.Time) bool {
+	return sess.connected == 0 && now.Sub(sess.lastSeen) >= s.idle
+}
+
+// open starts a connected session, or returns nil when the store is full
+func (s *wsSessionStore) open(now time.Time) *wsSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.sessions) >= s.capacity && s.sweepLocked(now) == 0 {
+		return nil
+	}
+	sess := &wsSession{token: newRequestID() + newRequestID(), connected: 1, lastSeen: now}
+	s.sessions[sess.token] = sess
+	return sess
+}
+
+// resume reconnects the session with the given token. It returns nil when
+// the token is unknown or has expired.
+func (s *wsSessionStore) resume(token string, now time.Time) *wsSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[token]
+	if !ok {
+		return nil
+	}
+	if s.expiredLocked(sess, now) {
+		delete(s.sessions, token)
+		return nil
+	}
+	sess.connected++
+	return sess
+}
+
+// release marks one connection of sess as closed, starting its idle period
+// once none are left
+func (s *wsSessionStore) release(sess *wsSession, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess.connected > 0 {
+		sess.connected--
+	}
+	sess.lastSeen = now
+}
+
+// startWSSessionLocked opens or resumes the session req asks for, sends the
+// session message, the status and any replayed events to c, and subscribes
+// it to live events. Must be called with lb.wsClientsMu held.
+func (lb *LoadBalancer) startWSSessionLocked(c *wsClient, req *wsSessionRequest, status []byte) error {
+	now := lb.clock.Now()
+	msg := wsSessionMessage{Type: wsMessageSession}
+	var replay []Event
+	if req.resume != "" {
+		if c.session = lb.wsSessions.resume(req.resume, now); c.session != nil {
+			msg.Resumed = true
+			var ok bool
+			replay, ok = lb.events.replay(req.after)
+			msg.ResyncRequired = !ok
+		} else {
+			msg.ResyncRequired = true
+		}
+		if msg.ResyncRequired {
+			lb.metrics.wsResumes.WithLabelValues(wsResumeResync).Inc()
+		} else {
+			lb.metrics.wsResumes.WithLabelValues(wsResumeReplayed).Inc()
+		}
+	}
+	if c.session == nil {
+		c.session = lb.wsSessions.open(now)
+	}
+	if c.session != nil {
+		msg.Token = c.session.token
+	}
+
+	// Events emitted from here on are pushed by pushWSEvents, which skips
+	// everything up to c.eventSeq
+	c.events = true
+	atomic.AddInt32(&lb.wsEventClients, 1)
+	msg.Seq = lb.events.latestSeq()
+	c.eventSeq = msg.Seq
+	if msg.Resumed && !msg.ResyncRequired {
+		c.eventSeq = req.after
+	}
+
+	data, _ := json.Marshal(msg)
+	if err := lb.sendWSLocked(c, data); err != nil {
+		return err
+	}
+	if err := lb.sendWSLocked(c, status); err != nil {
+		return err
+	}
+	return lb.sendWSEventsLocked(c, replay)
+}
+
+// sendWSEventsLocked sends the events c has not seen yet, in order. Must be
+// called with lb.wsClientsMu held.
+func (lb *LoadBalancer) sendWSEventsLocked(c *wsClient, events []Event) error {
+	for _, e := range events {
+		if e.Seq <= c.eventSeq {
+			continue
+		}
+		if e.Seq > c.eventSeq+1 {
+			// The client fell further behind than the event store reaches
+			if err := lb.sendWSResyncLocked(c); err != nil {
+				return err
+			}
+		}
+		data, err := json.Marshal(wsEventMessage{Type: wsMessageEvent, Event: e})
+		if err != nil {
+			return err
+		}
+		if err := lb.sendWSLocked(c, data); err != nil {
+			return err
+		}
+		c.eventSeq = e.Seq
+	}
+	return nil
+}
+
+// sendWSResyncLocked tells c that it missed events. Must be called with
+// lb.wsClientsMu held.
+func (lb *LoadBalancer) sendWSResyncLocked(c *wsClient) error {
+	msg := wsSessionMessage{Type: wsMessageSession, Seq: lb.events.latestSeq(), ResyncRequired: true}
+	if c.session != nil {
+		msg.Token = c.session.token
+	}
+	data, _ := json.Marshal(msg)
+	return lb.sendWSLocked(c, data)
+}
+
+// notifyWSEvents schedules a push of new events to the session clients.
+// Pushes run on their own goroutine since events are emitted with lb.mu held,
+// and coalesce while one is pending.
+func (lb *LoadBalancer) notifyWSEvents() {
+	if atomic.LoadInt32(&lb.wsEventClients) == 0 {
+		return
+	}
+	if lb.wsEventPending.CompareAndSwap(false, true) {
+		go lb.pushWSEvents()
+	}
+}
+
+// pushWSEvents sends every session client the events it has not seen yet
+func (lb *LoadBalancer) pushWSEvents() {
+	lb.wsClientsMu.Lock()
+	defer lb.wsClientsMu.Unlock()
+	lb.wsEventPending.Store(false)
+	var from int64 = -1
+	for _, c := range lb.wsClients {
+		if c.events && (from < 0 || c.eventSeq < from) {
+			from = c.eventSeq
+		}
+	}
+	if from < 0 {
+		return
+	}
+	events := lb.events.since(from, 0)
+	for conn, c := range lb.wsClients {
+		if !c.events {
+			continue
+		}
+		if err := lb.sendWSEventsLocked(c, events); err != nil {
+			lb.removeWSClientLocked(conn, wsWriteCloseReason(err))
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// wsMessage is any message a session client receives
+type wsMessage struct {
+	wsSessionMessage
+	Event     *Event `json:"event"`
+	Algorithm string `json:"algorithm"`
+}
+
+func readWSMessage(t *testing.T, conn *websocket.Conn) wsMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	var m wsMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatalf("decode %s: %v", data, err)
+	}
+	return m
+}
+
+// dialWSSession connects with the query and returns the session message,
+// having checked that the status follows it
+func dialWSSession(t *testing.T, srv *httptest.Server, query string) (*websocket.Conn, wsSessionMessage) {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws"+query, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	session := readWSMessage(t, conn)
+	if session.Type != wsMessageSession {
+		t.Fatalf("first message type = %q, want session", session.Type)
+	}
+	if status := readWSMessage(t, conn); status.Type != "" || status.Algorithm == "" {
+		t.Fatalf("second message = %+v, want the status", status)
+	}
+	return conn, session.wsSessionMessage
+}
+
+// readWSEvents reads n event messages and returns their messages
+func readWSEvents(t *testing.T, conn *websocket.Conn, n int) []string {
+	t.Helper()
+	var out []string
+	for len(out) < n {
+		m := readWSMessage(t, conn)
+		if m.Type != wsMessageEvent {
+			continue
+		}
+		out = append(out, m.Event.Message)
+	}
+	return out
+}
+
+func TestWSSessionResumeReplaysMissedEvents(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	srv := httptest.NewServer(newMux())
+	defer srv.Close()
+
+	conn, session := dialWSSession(t, srv, "?session=1")
+	if session.Token == "" || session.Resumed || session.ResyncRequired {
+		t.Fatalf("session = %+v, want a fresh token", session)
+	}
+	lb.emitEvent("test", "live-1", nil)
+	if got := readWSEvents(t, conn, 1); got[0] != "live-1" {
+		t.Fatalf("live event = %v", got)
+	}
+	seen := lb.events.latestSeq()
+	conn.Close()
+	waitForWSClients(t, srv, 0)
+
+	for i := 1; i <= 3; i++ {
+		lb.emitEvent("test", fmt.Sprintf("missed-%d", i), nil)
+	}
+	conn, resumed := dialWSSession(t, srv, fmt.Sprintf("?resume=%s&after=%d", session.Token, seen))
+	defer conn.Close()
+	if resumed.Token != session.Token || !resumed.Resumed || resumed.ResyncRequired || resumed.Seq != seen+3 {
+		t.Fatalf("resumed session = %+v", resumed)
+	}
+	if got := strings.Join(readWSEvents(t, conn, 3), ","); got != "missed-1,missed-2,missed-3" {
+		t.Errorf("replayed = %s", got)
+	}
+	lb.emitEvent("test", "live-2", nil)
+	if got := readWSEvents(t, conn, 1); got[0] != "live-2" {
+		t.Errorf("live event after replay = %v", got)
+	}
+	if got := testutil.ToFloat64(lb.metrics.wsResumes.WithLabelValues(wsResumeReplayed)); got != 1 {
+		t.Errorf("replayed resumes = %v, want 1", got)
+	}
+}
+
+func TestWSSessionResumeAfterRollover(t *testing.T) {
+	lb = NewLoadBalancer("round-robin")
+	lb.events = newEventStore(3)
+	srv := httptest.NewServer(newMux())
+	defer srv.Close()
+
+	conn, session := dialWSSession(t, srv, "?session=1")
+	conn.Close()
+	waitForWSClients(t, srv, 0)
+	for i := 0; i < 5; i++ {
+		lb.emitEvent("test", "missed", nil)
+	}
+
+	conn, resumed := dialWSSession(t, srv, fmt.Sprintf("?resume=%s&after=%d", session.Token, session.Seq))
+	defer conn.Close()
+	if !resumed.ResyncRequired || resumed.Token != session.Token || resumed.Seq != 5 {
+		t.Fatalf("resumed session = %+v, want resyncRequired at seq 5", resumed)
+	}
+	lb.emitEvent("test", "live", nil)
+	if got := readWSEvents(t, conn, 1); got[0] != "live" {
+		t.Errorf("first event after resync = %v, want only the live one", got)
+	}
+
+	unknown, fresh := dialWSSession(t, srv, "?resume=bogus&after=1")
+	defer unknown.Close()
+	if !fresh.ResyncRequired || fresh.Token == "" || fresh.Token == "bogus" {
+		t.Errorf("unknown token session = %+v, want resync with a new token", fresh)
+	}
+	if got := testutil.ToFloat64(lb.metrics.wsResumes.WithLabelValues(wsResumeResync)); got != 2 {
+		t.Errorf("resync resumes = %v, want 2", got)
+	}
+}
+
+func TestWSSessionStoreIdleExpiry(t *testing.T) {
+	s := newWSSessionStore(1)
+	s.idle = time.Minute
+	now := time.Now()
+	sess := s.open(now)
+	if s.open(now) != nil {
+		t.Fatal("a full store should not open more sessions")
+	}
+	// Connected sessions never expire
+	if s.sweep(now.Add(time.Hour)) != 0 {
+		t.Fatal("a connected session was evicted")
+	}
+	s.release(sess, now)
+	if s.resume(sess.token, now.Add(30*time.Second)) != sess {
+		t.Fatal("resume within the idle period failed")
+	}
+	s.release(sess, now.Add(30*time.Second))
+	if s.resume(sess.token, now.Add(90*time.Second)) != nil {
+		t.Error("resume after the idle period should fail")
+	}
+	if s.size() != 0 || s.open(now.Add(90*time.Second)) == nil {
+		t.Error("the expired session should make room")
+	}
+}
+
+func TestEventStoreReplay(t *testing.T) {
+	s := newEventStore(3)
+	if events, ok := s.replay(0); !ok || len(events) != 0 {
+		t.Errorf("empty replay = %v, %v", events, ok)
+	}
+	for i := 0; i < 4; i++ {
+		s.add(Event{})
+	}
+	if _, ok := s.replay(0); ok {
+		t.Error("replay past the oldest kept event should fail")
+	}
+	if events, ok := s.replay(1); !ok || len(events) != 3 || events[0].Seq != 2 {
+		t.Errorf("replay(1) = %v, %v", events, ok)
+	}
+	if _, ok := s.replay(9); ok {
+		t.Error("replay ahead of the log should fail")
+	}
+}
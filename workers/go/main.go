@@ -1,188 +1,2237 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"maps"
+	"math"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-// Configuration holds simulation parameters
+// Config is an immutable snapshot of the simulation parameters. Handlers
+// read one snapshot per request; updates build a new snapshot and swap it in.
+type Config struct {
+	MaxConcurrentRequests  int           `json:"max_concurrent_requests"`
+	ResponseDelayMs        int           `json:"response_delay_ms"`
+	FailureRate            float64       `json:"failure_rate"`
+	QueueSize              int           `json:"queue_size"`
+	DeadlinePolicy         string        `json:"deadline_policy"`
+	MaxCPUTasks            int           `json:"max_cpu_tasks"`
+	MaxBodyBytes           int64         `json:"max_body_bytes"`
+	MaxJSONDepth           int           `json:"max_json_depth"`
+	StrictDecode           bool          `json:"strict_decode"`
+	PerSourceMaxConcurrent int           `json:"per_source_max_concurrent"`
+	LogRedactFields        []string      `json:"log_redact_fields"`
+	TimestampFormat        string        `json:"timestamp_format"`
+	ResponseFieldStyle     string        `json:"response_field_style"`
+	MemoryPerTaskBytes     int64         `json:"memory_per_task_bytes"`
+	LeakBytesPerSecond     int64         `json:"leak_bytes_per_second"`
+	MemoryCeilingBytes     int64         `json:"memory_ceiling_bytes"`
+	TagOverrides           []TagOverride `json:"tag_overrides"`
+	// SharedResource names a resource shared by every worker configured with
+	// it; see tokenServer. Tasks wait up to SharedResourceTimeoutMs for one of
+	// its SharedResourceCapacity tokens, taken from the token server at
+	// SharedResourceURL or, when that is empty, from this worker's own.
+	SharedResource          string `json:"shared_resource"`
+	SharedResourceCapacity  int    `json:"shared_resource_capacity"`
+	SharedResourceURL       string `json:"shared_resource_url"`
+	SharedResourceTimeoutMs int    `json:"shared_resource_timeout_ms"`
+	// Stages, when set, replaces ResponseDelayMs with a pipeline of named
+	// stages run in order; see Stage
+	Stages []Stage `json:"stages,omitempty"`
+	// TaskSchema, when set, is enforced on every task body; see taskSchema.
+	// taskSchema is its compiled form.
+	TaskSchema json.RawMessage `json:"task_schema,omitempty"`
+	taskSchema *taskSchema
+	// Peers maps the names tasks may be forwarded to onto their base URLs;
+	// see forwardTask. MaxForwardDepth bounds how many hops a chain of
+	// forwarded tasks may take from the worker that received it first.
+	Peers           map[string]string `json:"peers,omitempty"`
+	MaxForwardDepth int               `json:"max_forward_depth"`
+}
+
+// Stage is one step of the simulated processing pipeline. Its delay is drawn
+// from Distribution with mean DelayMs and scaled by the task weight; after
+// it the task fails with FailureRate, skipping the remaining stages.
+type Stage struct {
+	Name         string  `json:"name"`
+	DelayMs      int     `json:"delay_ms"`
+	Distribution string  `json:"distribution,omitempty"`
+	FailureRate  float64 `json:"failure_rate,omitempty"`
+}
+
+// StageTiming is how long a task spent in a stage. Its fields are single
+// words so both response field styles encode it the same way.
+type StageTiming struct {
+	Name   string `json:"name"`
+	Ms     int64  `json:"ms"`
+	Failed bool   `json:"failed,omitempty"`
+}
+
+// TagOverride changes how tasks tagged key=value are processed: ExtraDelayMs
+// is added to their delay and FailureRate, when set, replaces the configured
+// one. Overrides are applied in order, so a later FailureRate wins.
+type TagOverride struct {
+	Key          string   `json:"key"`
+	Value        string   `json:"value"`
+	ExtraDelayMs int      `json:"extra_delay_ms"`
+	FailureRate  *float64 `json:"failure_rate,omitempty"`
+}
+
+// Configuration holds the current Config snapshot
 type Configuration struct {
-	MaxConcurrentRequests int     `json:"max_concurrent_requests"`
-	ResponseDelayMs       int     `json:"response_delay_ms"`
-	FailureRate           float64 `json:"failure_rate"`
-	QueueSize             int     `json:"queue_size"`
-	mu                    sync.RWMutex
+	current atomic.Pointer[Config]
 }
 
 // TaskRequest represents incoming task
 type TaskRequest struct {
-	ID     string  `json:"id"`
-	Weight float64 `json:"weight"`
+	ID     string            `json:"id"`
+	Weight float64           `json:"weight"`
+	Mode   string            `json:"mode,omitempty"`
+	Tags   map[string]string `json:"tags,omitempty"`
+	// ForwardTo names the peers the task is forwarded to after it has been
+	// processed, each forwarding it on while ForwardDepth hops remain
+	ForwardTo    []string `json:"forwardTo,omitempty"`
+	ForwardDepth int      `json:"forwardDepth,omitempty"`
 }
 
+// Task modes. sleep (the default) and io wait without using CPU; cpu burns a
+// core for the whole delay and is subject to the CPU fairness limit.
+const (
+	taskModeSleep = "sleep"
+	taskModeIO    = "io"
+	taskModeCPU   = "cpu"
+)
+
 // TaskResponse represents successful response
 type TaskResponse struct {
-	ID               string `json:"id"`
-	Worker           string `json:"worker"`
-	Color            string `json:"color"`
-	ProcessingTimeMs int64  `json:"processingTimeMs"`
-	Timestamp        string `json:"timestamp"`
+	ID               string            `json:"id"`
+	Worker           string            `json:"worker"`
+	Color            string            `json:"color"`
+	ProcessingTimeMs int64             `json:"processingTimeMs"`
+	Timestamp        string            `json:"timestamp"`
+	Tags             map[string]string `json:"tags,omitempty"`
+	// SharedWaitMs is how long the task waited for a shared resource token
+	SharedWaitMs *int64 `json:"sharedWaitMs,omitempty"`
+	// Stages are the pipeline stages the task went through; ProcessingTimeMs
+	// is then their sum
+	Stages []StageTiming `json:"stages,omitempty"`
+	// CallTree is set on a forwarded task: this worker and the peers it
+	// called. Partial is set when one of those calls failed.
+	CallTree *CallNode `json:"callTree,omitempty"`
+	Partial  bool      `json:"partial,omitempty"`
+}
+
+// Response formats. TimestampFormat selects how TaskResponse.timestamp is
+// written and ResponseFieldStyle the casing of multi-word field names; the
+// defaults are RFC 3339 and camelCase. ErrorResponse fields are single words,
+// so both styles encode it the same way.
+const (
+	timestampRFC3339    = "rfc3339"
+	timestampUnix       = "unix"
+	timestampUnixMillis = "unix_ms"
+	fieldStyleCamel     = "camel"
+	fieldStyleSnake     = "snake"
+)
+
+// Headers announcing the response format of /task so the LB can adapt
+const (
+	fieldStyleHeader      = "X-Worker-Field-Style"
+	timestampFormatHeader = "X-Worker-Timestamp-Format"
+)
+
+// taskResponseCamel and taskResponseSnake are the wire forms of TaskResponse
+type taskResponseCamel struct {
+	ID               string            `json:"id"`
+	Worker           string            `json:"worker"`
+	Color            string            `json:"color"`
+	ProcessingTimeMs int64             `json:"processingTimeMs"`
+	Timestamp        json.RawMessage   `json:"timestamp"`
+	Tags             map[string]string `json:"tags,omitempty"`
+	SharedWaitMs     *int64            `json:"sharedWaitMs,omitempty"`
+	Stages           []StageTiming     `json:"stages,omitempty"`
+	CallTree         *CallNode         `json:"callTree,omitempty"`
+	Partial          bool              `json:"partial,omitempty"`
+}
+
+type taskResponseSnake struct {
+	ID               string            `json:"id"`
+	Worker           string            `json:"worker"`
+	Color            string            `json:"color"`
+	ProcessingTimeMs int64             `json:"processing_time_ms"`
+	Timestamp        json.RawMessage   `json:"timestamp"`
+	Tags             map[string]string `json:"tags,omitempty"`
+	SharedWaitMs     *int64            `json:"shared_wait_ms,omitempty"`
+	Stages           []StageTiming     `json:"stages,omitempty"`
+	CallTree         *CallNode         `json:"call_tree,omitempty"`
+	Partial          bool              `json:"partial,omitempty"`
 }
 
 // ErrorResponse represents error response
 type ErrorResponse struct {
 	Error  string `json:"error"`
 	Worker string `json:"worker"`
+	Reason string `json:"reason,omitempty"`
+	// Stage is the pipeline stage that failed, and Stages the timings up to
+	// and including it
+	Stage  string        `json:"stage,omitempty"`
+	Stages []StageTiming `json:"stages,omitempty"`
+	// Violations lists how a task broke the task schema
+	Violations []string `json:"violations,omitempty"`
+}
+
+// rejectReasonHeader tells the LB why a task was turned away: with 503 for
+// rejectQueueFull, rejectOverloaded or rejectDraining, with 429 for rejectPerSourceLimit. The
+// same value is in the body's reason field.
+const rejectReasonHeader = "X-Worker-Reject-Reason"
+
+const (
+	rejectQueueFull      = "queue_full"
+	rejectOverloaded     = "overloaded"
+	rejectPerSourceLimit = "per_source_limit"
+	rejectDraining       = "draining"
+)
+
+// Headers identifying the source of a task for the per-source limit. A tenant
+// header wins over the forwarded client address.
+const (
+	tenantHeader       = "X-Tenant"
+	forwardedForHeader = "X-Forwarded-For"
+)
+
+// Per-source tracking bounds. Sources with nothing in flight are dropped after
+// sourceIdleTTL; once maxTrackedSources are tracked, further sources share the
+// overflowSource entry.
+const (
+	maxTrackedSources = 1024
+	sourceIdleTTL     = time.Minute
+	overflowSource    = "_overflow"
+)
+
+// deadlineHeader carries the LB's remaining time budget in milliseconds
+const deadlineHeader = "X-LB-Deadline-Ms"
+
+// Task body limits. Bodies larger than MaxBodyBytes are rejected with 413 and
+// JSON nested deeper than MaxJSONDepth with 400; weights above maxTaskWeight
+// are clamped so a bad request can't hold a slot for hours.
+const (
+	defaultMaxBodyBytes = 64 << 10
+	minMaxBodyBytes     = 1 << 10
+	maxMaxBodyBytes     = 16 << 20
+	defaultMaxJSONDepth = 32
+	maxMaxJSONDepth     = 1000
+	maxTaskWeight       = 100
+)
+
+// Deadline policies applied when the simulated delay exceeds the LB budget
+const (
+	deadlinePolicyFail    = "fail"
+	deadlinePolicyShorten = "shorten"
+)
+
+// Stage delay distributions, all with mean delay_ms. uniform draws from
+// [0, 2*delay_ms] and exponential has a long tail.
+const (
+	stageFixed       = "fixed"
+	stageUniform     = "uniform"
+	stageExponential = "exponential"
+	maxStages        = 16
+	stageFailed      = "stage_failed"
+)
+
+// Log levels, in increasing severity
+const (
+	logDebug = "debug"
+	logInfo  = "info"
+	logWarn  = "warn"
+	logError = "error"
+)
+
+var logSeverity = map[string]int{logDebug: 0, logInfo: 1, logWarn: 2, logError: 3}
+
+// Log ring bounds. The ring keeps the last LOG_RING_SIZE entries; GET /logs
+// returns defaultLogLimit of them unless asked for more.
+const (
+	defaultLogRingSize = 500
+	defaultLogLimit    = 100
+	redactedValue      = "[REDACTED]"
+)
+
+// Memory-pressure simulation. Each in-flight task holds MemoryPerTaskBytes and
+// a leak grows by LeakBytesPerSecond; together they never exceed
+// MemoryCeilingBytes, so the demo can't get the container OOM-killed.
+const (
+	defaultMemoryCeilingBytes = 256 << 20
+	maxMemoryCeilingBytes     = 4 << 30
+	leakInterval              = time.Second
+)
+
+// Shared resource simulation. A token is leased for sharedLeaseMs so one held
+// by a worker that died is eventually reclaimed; a task that can't get one
+// within the timeout fails with 503 and reason sharedResourceTimeout.
+const (
+	defaultSharedCapacity  = 10
+	defaultSharedTimeoutMs = 5000
+	sharedLeaseMs          = 60000
+	maxSharedResources     = 64
+	sharedResourceTimeout  = "shared_resource_timeout"
+	sharedResourceDown     = "shared_resource_unavailable"
+)
+
+// LogEntry is one structured log line kept in the worker's log ring
+type LogEntry struct {
+	Time    time.Time         `json:"time"`
+	Level   string            `json:"level"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// LogsResponse is the body of GET /logs, oldest entry first
+type LogsResponse struct {
+	Worker  string     `json:"worker"`
+	Entries []LogEntry `json:"entries"`
+	Dropped uint64     `json:"dropped"`
 }
 
-// HealthResponse represents health check response
+// HealthResponse represents health check response. Worker is the worker's
+// own name, which the LB checks against the name it was configured with.
 type HealthResponse struct {
-	Status      string `json:"status"`
-	CurrentLoad int32  `json:"currentLoad"`
-	QueueDepth  int    `json:"queueDepth"`
+	Worker               string     `json:"worker"`
+	Status               string     `json:"status"`
+	CurrentLoad          int32      `json:"currentLoad"`
+	QueueDepth           int        `json:"queueDepth"`
+	StartedReadyAt       *time.Time `json:"startedReadyAt,omitempty"`
+	SimulatedMemoryBytes int64      `json:"simulatedMemoryBytes"`
+	ExpectedLatencyMs    int64      `json:"expectedLatencyMs"`
+	// MaxConcurrent and QueueSize are the limits CurrentLoad and QueueDepth
+	// are measured against
+	MaxConcurrent int `json:"maxConcurrent"`
+	QueueSize     int `json:"queueSize"`
+}
+
+// Factors applied to the expected latency advertised in /health while the
+// worker is degraded or unhealthy
+const (
+	degradedLatencyFactor  = 1.5
+	unhealthyLatencyFactor = 2.0
+)
+
+// expectedLatencyMs is the latency a weight-1 task can expect: the configured
+// response delay, scaled up while the worker is degraded or unhealthy
+func expectedLatencyMs(cfg Config, status string) int64 {
+	ms := float64(cfg.ResponseDelayMs)
+	switch status {
+	case "degraded":
+		ms *= degradedLatencyFactor
+	case "unhealthy":
+		ms *= unhealthyLatencyFactor
+	}
+	return int64(math.Round(ms))
+}
+
+// MemoryStatus is the body of GET /memory and POST /memory/release
+type MemoryStatus struct {
+	Worker        string `json:"worker"`
+	RetainedBytes int64  `json:"retainedBytes"`
+	TaskBytes     int64  `json:"taskBytes"`
+	LeakBytes     int64  `json:"leakBytes"`
+	CeilingBytes  int64  `json:"ceilingBytes"`
+}
+
+// startupDelay is the delay before the worker reports ready: fixed when min
+// == max, otherwise drawn uniformly from [min, max]
+type startupDelay struct {
+	min, max time.Duration
+}
+
+// readiness tracks when the worker becomes ready after its startup delay. The
+// zero value is ready immediately.
+type readiness struct {
+	readyAt time.Time
+}
+
+// ready reports whether the startup delay has elapsed
+func (r readiness) ready() bool {
+	return !now().Before(r.readyAt)
+}
+
+// Control actions the LB sends to /control as it drains, disables and
+// enables the worker. While drained or disabled the worker reports not ready
+// and turns new tasks away with rejectDraining; tasks in flight finish.
+const (
+	controlDrain   = "drain"
+	controlDisable = "disable"
+	controlEnable  = "enable"
+)
+
+// controlRequest is the body of POST /control. Seq orders the requests of
+// one LB; a request older than the last one applied is ignored.
+type controlRequest struct {
+	Action   string    `json:"action"`
+	Deadline time.Time `json:"deadline"`
+	Seq      uint64    `json:"seq"`
+}
+
+// controlState is the last control action applied. The zero value is enabled.
+type controlState struct {
+	mu   sync.Mutex
+	last controlRequest
+}
+
+// apply records req unless it is older than the last request applied
+func (c *controlState) apply(req controlRequest) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if req.Seq != 0 && req.Seq < c.last.Seq {
+		return false
+	}
+	c.last = req
+	return true
+}
+
+// shedding returns the action the worker turns new tasks away for, if any
+func (c *controlState) shedding() (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.last.Action == controlDrain || c.last.Action == controlDisable {
+		return c.last.Action, true
+	}
+	return "", false
 }
 
 var (
 	config      *Configuration
 	workerName  string
 	workerColor string
+	startup     readiness
+
+	// now is the worker's clock; tests replace it with a fake
+	now = time.Now
+
+	// exit ends the process for /crash; tests replace it
+	exit = os.Exit
 
-	// Metrics
-	requestsTotal = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "worker_requests_total",
-			Help: "Total number of requests processed",
-		},
-		[]string{"worker", "status"},
-	)
-	requestDuration = prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "worker_request_duration_ms",
-			Help:    "Request duration in milliseconds",
-			Buckets: prometheus.ExponentialBuckets(1, 2, 10),
-		},
-		[]string{"worker"},
-	)
-	currentLoad = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "worker_current_load",
-			Help: "Current number of concurrent requests",
-		},
-		[]string{"worker"},
-	)
+	// metrics はワーカーの Prometheus メトリクスです。main() でグローバルレジストリに登録し直します。
+	metrics = newIsolatedWorkerMetrics()
 
 	// Concurrency control
 	activeRequests int32
 	requestQueue   chan struct{}
+	cpuSlots       cpuLimiter
+	sources        = newSourceLimiter()
+
+	// logs は直近のログエントリを保持するリングバッファです。
+	logs = newLogRing(defaultLogRingSize)
+
+	// memory はメモリ圧迫シミュレーションで保持しているバッファです。
+	memory = newMemorySim()
+
+	// tokens はこのワーカーが提供する共有リソースのトークンサーバーです。
+	tokens = newTokenServer()
+
+	// control は LB から /control で受け取った最新の制御アクションです。
+	control = &controlState{}
 )
 
-// init はパッケージで使用する Prometheus メトリクス（requestsTotal、requestDuration、currentLoad）を登録します。
-func init() {
-	prometheus.MustRegister(requestsTotal)
-	prometheus.MustRegister(requestDuration)
-	prometheus.MustRegister(currentLoad)
+// workerMetrics はワーカーの Prometheus メトリクスをまとめたものです。
+type workerMetrics struct {
+	requestsTotal    *prometheus.CounterVec
+	requestDuration  *prometheus.HistogramVec
+	currentLoad      *prometheus.GaugeVec
+	deadlineExceeded *prometheus.CounterVec
+	cpuSlotsInUse    *prometheus.GaugeVec
+	cpuSlotsLimit    *prometheus.GaugeVec
+	cpuSlotWait      *prometheus.HistogramVec
+	rejections       *prometheus.CounterVec
+	trackedSources   *prometheus.GaugeVec
+	simulatedMemory  *prometheus.GaugeVec
+	sharedWait       *prometheus.HistogramVec
+	stageDuration    *prometheus.HistogramVec
+	stageFailures    *prometheus.CounterVec
+	forwardCalls     *prometheus.CounterVec
+
+	registerer prometheus.Registerer
+	gatherer   prometheus.Gatherer
+}
+
+// newWorkerMetrics はメトリクスを生成して reg に登録し、/metrics では gatherer から収集します。
+func newWorkerMetrics(reg prometheus.Registerer, gatherer prometheus.Gatherer) *workerMetrics {
+	f := promauto.With(reg)
+	return &workerMetrics{
+		requestsTotal: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "worker_requests_total",
+				Help: "Total number of requests processed",
+			},
+			[]string{"worker", "status"},
+		),
+		requestDuration: f.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "worker_request_duration_ms",
+				Help:    "Request duration in milliseconds",
+				Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+			},
+			[]string{"worker"},
+		),
+		currentLoad: f.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "worker_current_load",
+				Help: "Current number of concurrent requests",
+			},
+			[]string{"worker"},
+		),
+		deadlineExceeded: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "worker_deadline_exceeded_total",
+				Help: "Tasks whose simulated delay exceeded the LB deadline budget",
+			},
+			[]string{"worker", "action"},
+		),
+		cpuSlotsInUse: f.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "worker_cpu_slots_in_use",
+				Help: "Number of cpu-mode tasks currently running",
+			},
+			[]string{"worker"},
+		),
+		cpuSlotsLimit: f.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "worker_cpu_slots_limit",
+				Help: "Maximum number of cpu-mode tasks allowed to run at once",
+			},
+			[]string{"worker"},
+		),
+		cpuSlotWait: f.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "worker_cpu_slot_wait_ms",
+				Help:    "Time cpu-mode tasks waited for a CPU slot in milliseconds",
+				Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+			},
+			[]string{"worker"},
+		),
+		rejections: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "worker_rejections_total",
+				Help: "Tasks turned away before processing, by reason (queue_full, overloaded, per_source_limit, draining)",
+			},
+			[]string{"worker", "reason"},
+		),
+		trackedSources: f.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "worker_tracked_sources",
+				Help: "Number of sources tracked by the per-source concurrency limit",
+			},
+			[]string{"worker"},
+		),
+		simulatedMemory: f.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "worker_simulated_memory_bytes",
+				Help: "Bytes retained by the memory-pressure simulation (in-flight tasks plus leak)",
+			},
+			[]string{"worker"},
+		),
+		sharedWait: f.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "worker_shared_resource_wait_ms",
+				Help:    "Time tasks waited for a shared resource token in milliseconds",
+				Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+			},
+			[]string{"worker", "resource"},
+		),
+		stageDuration: f.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "worker_stage_duration_ms",
+				Help:    "Time tasks spent in each pipeline stage in milliseconds",
+				Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+			},
+			[]string{"worker", "stage"},
+		),
+		stageFailures: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "worker_stage_failures_total",
+				Help: "Simulated failures by the pipeline stage they happened in",
+			},
+			[]string{"worker", "stage"},
+		),
+		forwardCalls: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "worker_forward_calls_total",
+				Help: "Calls of forwarded tasks to peers by outcome (success, failed, skipped)",
+			},
+			[]string{"worker", "outcome"},
+		),
+		registerer: reg,
+		gatherer:   gatherer,
+	}
+}
+
+// newIsolatedWorkerMetrics は専用のレジストリに登録したメトリクスを返します。
+// インスタンスごとにレジストリを分けることで、同一プロセス内で登録が衝突しないようにします。
+func newIsolatedWorkerMetrics() *workerMetrics {
+	reg := prometheus.NewRegistry()
+	return newWorkerMetrics(reg, reg)
+}
+
+// handler は /metrics 用の HTTP ハンドラを返します。
+func (m *workerMetrics) handler() http.Handler {
+	return promhttp.InstrumentMetricHandler(m.registerer, promhttp.HandlerFor(m.gatherer, promhttp.HandlerOpts{}))
+}
+
+// parseStartupDelay は STARTUP_DELAY_MS の値を解釈します。
+// "1500" のような固定値 (ミリ秒) か "uniform(500,3000)" のような一様分布の範囲を受け付け、空文字列は遅延なしとします。
+func parseStartupDelay(raw string) (startupDelay, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return startupDelay{}, nil
+	}
+	if strings.HasPrefix(raw, "uniform(") && strings.HasSuffix(raw, ")") {
+		parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(raw, "uniform("), ")"), ",")
+		if len(parts) != 2 {
+			return startupDelay{}, fmt.Errorf("invalid startup delay %q: want uniform(a,b)", raw)
+		}
+		a, errA := strconv.Atoi(strings.TrimSpace(parts[0]))
+		b, errB := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if errA != nil || errB != nil || a < 0 || b < a {
+			return startupDelay{}, fmt.Errorf("invalid startup delay %q: want 0 <= a <= b", raw)
+		}
+		return startupDelay{time.Duration(a) * time.Millisecond, time.Duration(b) * time.Millisecond}, nil
+	}
+	ms, err := strconv.Atoi(raw)
+	if err != nil || ms < 0 {
+		return startupDelay{}, fmt.Errorf("invalid startup delay %q: want milliseconds or uniform(a,b)", raw)
+	}
+	d := time.Duration(ms) * time.Millisecond
+	return startupDelay{d, d}, nil
+}
+
+// pick は遅延の範囲から 1 つの値を選び、さらに [0, jitter) の一様ジッターを加えます。
+// ジッターにより同時に起動した多数のワーカーの ready 時刻が揃わないようにします。
+func (d startupDelay) pick(rng *rand.Rand, jitter time.Duration) time.Duration {
+	delay := d.min
+	if d.max > d.min {
+		delay += time.Duration(rng.Int63n(int64(d.max-d.min) + 1))
+	}
+	if jitter > 0 {
+		delay += time.Duration(rng.Int63n(int64(jitter)))
+	}
+	return delay
+}
+
+// getEnvInt は環境変数 key を整数として読み取り、値が設定されていないか変換に失敗した場合は defaultVal を返します。
+func getEnvInt(key string, defaultVal int) int {
+	if val := os.Getenv(key); val != "" {
+		if i, err := strconv.Atoi(val); err == nil {
+			return i
+		}
+	}
+	return defaultVal
+}
+
+// getEnvFloatは指定した環境変数を読み取り、浮動小数点値に変換して返します。
+// 環境変数が設定されていないか有効な浮動小数点に変換できない場合はdefaultValを返します。
+func getEnvFloat(key string, defaultVal float64) float64 {
+	if val := os.Getenv(key); val != "" {
+		if f, err := strconv.ParseFloat(val, 64); err == nil {
+			return f
+		}
+	}
+	return defaultVal
+}
+
+// loadConfig は環境変数から初期 Configuration を構築して返します。
+// 使用する環境変数とデフォルト値: MAX_CONCURRENT_REQUESTS=10, RESPONSE_DELAY_MS=100, FAILURE_RATE=0.0, QUEUE_SIZE=50, DEADLINE_POLICY=fail, MAX_CPU_TASKS=GOMAXPROCS-1 (最小 1), PER_SOURCE_MAX_CONCURRENT=0 (無制限), LOG_REDACT_FIELDS= (カンマ区切り), TIMESTAMP_FORMAT=rfc3339, RESPONSE_FIELD_STYLE=camel, MEMORY_PER_TASK_BYTES=0, LEAK_BYTES_PER_SECOND=0, MEMORY_CEILING_BYTES=256MiB, STAGES= ("parse:5,fetch:40" のような name:delay_ms のカンマ区切り)。
+// 環境変数が未設定または無効な場合は対応するデフォルト値が使われます。
+// 値は安全な範囲にクランプされます。
+func loadConfig() Config {
+	maxConcurrent := getEnvInt("MAX_CONCURRENT_REQUESTS", 10)
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+
+	responseDelay := getEnvInt("RESPONSE_DELAY_MS", 100)
+	if responseDelay < 0 {
+		responseDelay = 0
+	}
+
+	failureRate := getEnvFloat("FAILURE_RATE", 0.0)
+	if failureRate < 0.0 {
+		failureRate = 0.0
+	} else if failureRate > 1.0 {
+		failureRate = 1.0
+	}
+
+	queueSize := getEnvInt("QUEUE_SIZE", 50)
+	if queueSize < 1 {
+		queueSize = 1
+	}
+
+	deadlinePolicy := os.Getenv("DEADLINE_POLICY")
+	if !validDeadlinePolicy(deadlinePolicy) {
+		deadlinePolicy = deadlinePolicyFail
+	}
+
+	maxCPUTasks := getEnvInt("MAX_CPU_TASKS", defaultMaxCPUTasks())
+	if maxCPUTasks < 1 {
+		maxCPUTasks = 1
+	}
+
+	maxBodyBytes := int64(getEnvInt("MAX_BODY_BYTES", defaultMaxBodyBytes))
+	if !validMaxBodyBytes(maxBodyBytes) {
+		maxBodyBytes = defaultMaxBodyBytes
+	}
+
+	maxJSONDepth := getEnvInt("MAX_JSON_DEPTH", defaultMaxJSONDepth)
+	if !validMaxJSONDepth(maxJSONDepth) {
+		maxJSONDepth = defaultMaxJSONDepth
+	}
+
+	var redact []string
+	for _, f := range strings.Split(os.Getenv("LOG_REDACT_FIELDS"), ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			redact = append(redact, f)
+		}
+	}
+
+	timestampFormat := os.Getenv("TIMESTAMP_FORMAT")
+	if !validTimestampFormat(timestampFormat) {
+		timestampFormat = timestampRFC3339
+	}
+
+	fieldStyle := os.Getenv("RESPONSE_FIELD_STYLE")
+	if !validFieldStyle(fieldStyle) {
+		fieldStyle = fieldStyleCamel
+	}
+
+	perSourceMax := getEnvInt("PER_SOURCE_MAX_CONCURRENT", 0)
+	if perSourceMax < 0 {
+		perSourceMax = 0
+	}
+
+	memoryPerTask := int64(getEnvInt("MEMORY_PER_TASK_BYTES", 0))
+	if memoryPerTask < 0 {
+		memoryPerTask = 0
+	}
+
+	leakRate := int64(getEnvInt("LEAK_BYTES_PER_SECOND", 0))
+	if leakRate < 0 {
+		leakRate = 0
+	}
+
+	memoryCeiling := int64(getEnvInt("MEMORY_CEILING_BYTES", defaultMemoryCeilingBytes))
+	if !validMemoryCeiling(memoryCeiling) {
+		memoryCeiling = defaultMemoryCeilingBytes
+	}
+
+	sharedCapacity := getEnvInt("SHARED_RESOURCE_CAPACITY", defaultSharedCapacity)
+	if sharedCapacity < 1 {
+		sharedCapacity = defaultSharedCapacity
+	}
+
+	sharedTimeout := getEnvInt("SHARED_RESOURCE_TIMEOUT_MS", defaultSharedTimeoutMs)
+	if sharedTimeout < 1 {
+		sharedTimeout = defaultSharedTimeoutMs
+	}
+
+	stages, err := parseStages(os.Getenv("STAGES"))
+	if err != nil || (stages != nil && !validStages(stages)) {
+		stages = nil
+	}
+
+	peers, err := parsePeers(os.Getenv("PEERS"))
+	if err != nil || !validPeers(peers) {
+		peers = nil
+	}
+
+	maxForwardDepth := getEnvInt("MAX_FORWARD_DEPTH", defaultMaxForwardDepth)
+	if !validMaxForwardDepth(maxForwardDepth) {
+		maxForwardDepth = defaultMaxForwardDepth
+	}
+
+	return Config{
+		MaxConcurrentRequests:   maxConcurrent,
+		ResponseDelayMs:         responseDelay,
+		FailureRate:             failureRate,
+		QueueSize:               queueSize,
+		DeadlinePolicy:          deadlinePolicy,
+		MaxCPUTasks:             maxCPUTasks,
+		MaxBodyBytes:            maxBodyBytes,
+		MaxJSONDepth:            maxJSONDepth,
+		StrictDecode:            os.Getenv("STRICT_DECODE") == "true",
+		PerSourceMaxConcurrent:  perSourceMax,
+		LogRedactFields:         redact,
+		TimestampFormat:         timestampFormat,
+		ResponseFieldStyle:      fieldStyle,
+		MemoryPerTaskBytes:      memoryPerTask,
+		LeakBytesPerSecond:      leakRate,
+		MemoryCeilingBytes:      memoryCeiling,
+		SharedResource:          os.Getenv("SHARED_RESOURCE"),
+		SharedResourceCapacity:  sharedCapacity,
+		SharedResourceURL:       strings.TrimSuffix(os.Getenv("SHARED_RESOURCE_URL"), "/"),
+		SharedResourceTimeoutMs: sharedTimeout,
+		Stages:                  stages,
+		Peers:                   peers,
+		MaxForwardDepth:         maxForwardDepth,
+	}
+}
+
+// newConfiguration は cfg を初期スナップショットとする Configuration を返します。
+func newConfiguration(cfg Config) *Configuration {
+	c := &Configuration{}
+	c.Store(cfg)
+	return c
+}
+
+// Store は cfg をそのまま現在のスナップショットとして置き換えます。
+func (c *Configuration) Store(cfg Config) {
+	c.current.Store(&cfg)
+}
+
+// Update は現在のスナップショットに newConfig の有効な値を重ねた新しいスナップショットを作成し、アトミックに差し替えます。
+// 無効な値 (範囲外や未知のポリシー) は無視され、現在値が維持されます。反映後のスナップショットを返します。
+// ゼロ値が有効なフィールドは newConfig の値がそのまま反映されるため、一部のフィールドだけを変える場合は Patch を使ってください。
+func (c *Configuration) Update(newConfig *Config) Config {
+	for {
+		old := c.current.Load()
+		next := mergeConfig(*old, newConfig)
+		if c.current.CompareAndSwap(old, &next) {
+			return next
+		}
+	}
+}
+
+// Patch は JSON の部分設定 body を現在のスナップショットに重ねた新しいスナップショットを作成し、アトミックに差し替えます。
+// body に含まれないフィールドは現在値が維持され、含まれるフィールドの無効な値は Update と同じく無視されます。反映後のスナップショットを返します。
+func (c *Configuration) Patch(body []byte) (Config, error) {
+	for {
+		old := c.current.Load()
+		patch, err := decodeConfigPatch(*old, body)
+		if err != nil {
+			return Config{}, err
+		}
+		next := mergeConfig(*old, &patch)
+		if c.current.CompareAndSwap(old, &next) {
+			return next, nil
+		}
+	}
+}
+
+// decodeConfigPatch は body を old の上にデコードし、mergeConfig に渡す設定を返します。スカラー値は body になければ old の値のままです。
+// スライス・マップ・タスクスキーマは body にある場合だけ設定され、なければ nil (mergeConfig が old の値を維持) になるため、old と共有されず、送られた値で丸ごと置き換わります。
+func decodeConfigPatch(old Config, body []byte) (Config, error) {
+	patch := old
+	patch.LogRedactFields, patch.TagOverrides, patch.Stages = nil, nil, nil
+	patch.Peers, patch.TaskSchema, patch.taskSchema = nil, nil, nil
+	err := json.Unmarshal(body, &patch)
+	return patch, err
+}
+
+// mergeConfig は old に newConfig の有効な値を重ねた設定を返します。無効な値は無視され、old の値が維持されます。
+func mergeConfig(old Config, newConfig *Config) Config {
+	next := old
+	if newConfig.MaxConcurrentRequests > 0 {
+		next.MaxConcurrentRequests = newConfig.MaxConcurrentRequests
+	}
+	if newConfig.ResponseDelayMs >= 0 {
+		next.ResponseDelayMs = newConfig.ResponseDelayMs
+	}
+	if newConfig.FailureRate >= 0 && newConfig.FailureRate <= 1 {
+		next.FailureRate = newConfig.FailureRate
+	}
+	if newConfig.QueueSize > 0 {
+		next.QueueSize = newConfig.QueueSize
+	}
+	if validDeadlinePolicy(newConfig.DeadlinePolicy) {
+		next.DeadlinePolicy = newConfig.DeadlinePolicy
+	}
+	if newConfig.MaxCPUTasks > 0 {
+		next.MaxCPUTasks = newConfig.MaxCPUTasks
+	}
+	if validMaxBodyBytes(newConfig.MaxBodyBytes) {
+		next.MaxBodyBytes = newConfig.MaxBodyBytes
+	}
+	if validMaxJSONDepth(newConfig.MaxJSONDepth) {
+		next.MaxJSONDepth = newConfig.MaxJSONDepth
+	}
+	next.StrictDecode = newConfig.StrictDecode
+	if newConfig.PerSourceMaxConcurrent >= 0 {
+		next.PerSourceMaxConcurrent = newConfig.PerSourceMaxConcurrent
+	}
+	if validTimestampFormat(newConfig.TimestampFormat) {
+		next.TimestampFormat = newConfig.TimestampFormat
+	}
+	if validFieldStyle(newConfig.ResponseFieldStyle) {
+		next.ResponseFieldStyle = newConfig.ResponseFieldStyle
+	}
+	if newConfig.MemoryPerTaskBytes >= 0 {
+		next.MemoryPerTaskBytes = newConfig.MemoryPerTaskBytes
+	}
+	if newConfig.LeakBytesPerSecond >= 0 {
+		next.LeakBytesPerSecond = newConfig.LeakBytesPerSecond
+	}
+	if validMemoryCeiling(newConfig.MemoryCeilingBytes) {
+		next.MemoryCeilingBytes = newConfig.MemoryCeilingBytes
+	}
+	if newConfig.TagOverrides != nil && validTagOverrides(newConfig.TagOverrides) {
+		next.TagOverrides = slices.Clone(newConfig.TagOverrides)
+	}
+	if newConfig.LogRedactFields != nil {
+		next.LogRedactFields = slices.Clone(newConfig.LogRedactFields)
+	}
+	if newConfig.SharedResource != "" {
+		next.SharedResource = newConfig.SharedResource
+	}
+	if newConfig.SharedResourceCapacity > 0 {
+		next.SharedResourceCapacity = newConfig.SharedResourceCapacity
+	}
+	if newConfig.SharedResourceURL != "" {
+		next.SharedResourceURL = strings.TrimSuffix(newConfig.SharedResourceURL, "/")
+	}
+	if newConfig.SharedResourceTimeoutMs > 0 {
+		next.SharedResourceTimeoutMs = newConfig.SharedResourceTimeoutMs
+	}
+	if newConfig.Stages != nil && validStages(newConfig.Stages) {
+		next.Stages = slices.Clone(newConfig.Stages)
+	}
+	if newConfig.Peers != nil && validPeers(newConfig.Peers) {
+		next.Peers = maps.Clone(newConfig.Peers)
+	}
+	if validMaxForwardDepth(newConfig.MaxForwardDepth) {
+		next.MaxForwardDepth = newConfig.MaxForwardDepth
+	}
+	if newConfig.TaskSchema != nil {
+		if schema, err := compileTaskSchema(newConfig.TaskSchema); err == nil {
+			next.TaskSchema, next.taskSchema = nil, schema
+			if schema != nil {
+				next.TaskSchema = slices.Clone(newConfig.TaskSchema)
+			}
+		}
+	}
+	return next
+}
+
+// checkConfig は newConfig のうち明示的に指定された値が無効なフィールドを探し、最初に見つかったフィールド名と理由を返します。
+// 0 や空文字列は未指定として扱います。全て妥当なら空文字列を返します。Update が黙って無視する値をドライランで報告するために使います。
+func checkConfig(newConfig *Config) (field, msg string) {
+	switch {
+	case newConfig.MaxConcurrentRequests < 0:
+		return "max_concurrent_requests", "must not be negative"
+	case newConfig.ResponseDelayMs < 0:
+		return "response_delay_ms", "must not be negative"
+	case newConfig.FailureRate < 0 || newConfig.FailureRate > 1:
+		return "failure_rate", "must be between 0 and 1"
+	case newConfig.QueueSize < 0:
+		return "queue_size", "must not be negative"
+	case newConfig.DeadlinePolicy != "" && !validDeadlinePolicy(newConfig.DeadlinePolicy):
+		return "deadline_policy", "must be fail or shorten"
+	case newConfig.MaxCPUTasks < 0:
+		return "max_cpu_tasks", "must not be negative"
+	case newConfig.MaxBodyBytes != 0 && !validMaxBodyBytes(newConfig.MaxBodyBytes):
+		return "max_body_bytes", fmt.Sprintf("must be between %d and %d", minMaxBodyBytes, maxMaxBodyBytes)
+	case newConfig.MaxJSONDepth != 0 && !validMaxJSONDepth(newConfig.MaxJSONDepth):
+		return "max_json_depth", fmt.Sprintf("must be between 1 and %d", maxMaxJSONDepth)
+	case newConfig.PerSourceMaxConcurrent < 0:
+		return "per_source_max_concurrent", "must not be negative"
+	case newConfig.TimestampFormat != "" && !validTimestampFormat(newConfig.TimestampFormat):
+		return "timestamp_format", "must be rfc3339, unix or unix_ms"
+	case newConfig.ResponseFieldStyle != "" && !validFieldStyle(newConfig.ResponseFieldStyle):
+		return "response_field_style", "must be camel or snake"
+	case newConfig.MemoryPerTaskBytes < 0:
+		return "memory_per_task_bytes", "must not be negative"
+	case newConfig.LeakBytesPerSecond < 0:
+		return "leak_bytes_per_second", "must not be negative"
+	case newConfig.MemoryCeilingBytes != 0 && !validMemoryCeiling(newConfig.MemoryCeilingBytes):
+		return "memory_ceiling_bytes", fmt.Sprintf("must be between 1 and %d", int64(maxMemoryCeilingBytes))
+	case !validTagOverrides(newConfig.TagOverrides):
+		return "tag_overrides", "every override needs a key, a non-negative extra_delay_ms and a failure_rate between 0 and 1"
+	case newConfig.SharedResourceCapacity < 0:
+		return "shared_resource_capacity", "must not be negative"
+	case newConfig.SharedResourceTimeoutMs < 0:
+		return "shared_resource_timeout_ms", "must not be negative"
+	case newConfig.Stages != nil && !validStages(newConfig.Stages):
+		return "stages", fmt.Sprintf("needs 1 to %d stages, each with a unique name, a non-negative delay_ms, a distribution of fixed, uniform or exponential and a failure_rate between 0 and 1", maxStages)
+	case !validPeers(newConfig.Peers):
+		return "peers", "every peer needs a name and an http or https URL"
+	case newConfig.MaxForwardDepth != 0 && !validMaxForwardDepth(newConfig.MaxForwardDepth):
+		return "max_forward_depth", fmt.Sprintf("must be between 1 and %d", maxMaxForwardDepth)
+	}
+	if newConfig.TaskSchema != nil {
+		if _, err := compileTaskSchema(newConfig.TaskSchema); err != nil {
+			return "task_schema", err.Error()
+		}
+	}
+	return "", ""
+}
+
+// Get は現在の設定スナップショットを返します。1 リクエスト内では一度だけ呼び出し、同じスナップショットを使ってください。
+func (c *Configuration) Get() Config {
+	return *c.current.Load()
+}
+
+// validTaskMode は mode が既知のタスクモード (未指定は sleep) かどうかを返します。
+func validTaskMode(mode string) bool {
+	return mode == "" || mode == taskModeSleep || mode == taskModeIO || mode == taskModeCPU
+}
+
+// validDeadlinePolicy は policy が既知のデッドラインポリシーかどうかを返します。
+func validDeadlinePolicy(policy string) bool {
+	return policy == deadlinePolicyFail || policy == deadlinePolicyShorten
+}
+
+// validTimestampFormat は format が既知のタイムスタンプ形式 (rfc3339, unix, unix_ms) かどうかを返します。
+func validTimestampFormat(format string) bool {
+	return format == timestampRFC3339 || format == timestampUnix || format == timestampUnixMillis
+}
+
+// validFieldStyle は style が既知のフィールド名スタイル (camel, snake) かどうかを返します。
+func validFieldStyle(style string) bool {
+	return style == fieldStyleCamel || style == fieldStyleSnake
+}
+
+// formatTimestamp は t を format に従った JSON 値として返します。未指定の場合は RFC 3339 (ナノ秒) の文字列です。
+func formatTimestamp(t time.Time, format string) json.RawMessage {
+	switch format {
+	case timestampUnix:
+		return json.RawMessage(strconv.FormatInt(t.Unix(), 10))
+	case timestampUnixMillis:
+		return json.RawMessage(strconv.FormatInt(t.UnixMilli(), 10))
+	default:
+		return json.RawMessage(strconv.Quote(t.UTC().Format(time.RFC3339Nano)))
+	}
+}
+
+// marshalTaskResponse は resp を cfg のフィールド名スタイルで、完了時刻 at を cfg のタイムスタンプ形式でエンコードします。
+// resp.Timestamp は使わず at から書き直します。既定の設定では TaskResponse をそのまま json.Marshal した結果と同一になります。
+func marshalTaskResponse(resp TaskResponse, at time.Time, cfg Config) ([]byte, error) {
+	ts := formatTimestamp(at, cfg.TimestampFormat)
+	if cfg.ResponseFieldStyle == fieldStyleSnake {
+		return json.Marshal(taskResponseSnake{resp.ID, resp.Worker, resp.Color, resp.ProcessingTimeMs, ts, resp.Tags, resp.SharedWaitMs, resp.Stages, resp.CallTree, resp.Partial})
+	}
+	return json.Marshal(taskResponseCamel{resp.ID, resp.Worker, resp.Color, resp.ProcessingTimeMs, ts, resp.Tags, resp.SharedWaitMs, resp.Stages, resp.CallTree, resp.Partial})
+}
+
+// setResponseFormatHeaders は /task の応答形式を示すヘッダーを設定します。
+func setResponseFormatHeaders(w http.ResponseWriter, cfg Config) {
+	style, format := cfg.ResponseFieldStyle, cfg.TimestampFormat
+	if style == "" {
+		style = fieldStyleCamel
+	}
+	if format == "" {
+		format = timestampRFC3339
+	}
+	w.Header().Set(fieldStyleHeader, style)
+	w.Header().Set(timestampFormatHeader, format)
+}
+
+// retryAfter は容量不足で断ったタスクを再送するまでの目安 (秒) を返します。処理中のタスクが終わる目安として response_delay_ms を切り上げ、最小 1 秒とします。
+func retryAfter(cfg Config) string {
+	return strconv.Itoa(max(1, (cfg.ResponseDelayMs+999)/1000))
+}
+
+// validTagOverrides は全てのオーバーライドにキーがあり、追加遅延が負でなく、故障率が 0〜1 の範囲かどうかを返します。
+func validTagOverrides(overrides []TagOverride) bool {
+	for _, o := range overrides {
+		if o.Key == "" || o.ExtraDelayMs < 0 || (o.FailureRate != nil && (*o.FailureRate < 0 || *o.FailureRate > 1)) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyTagOverrides は tags に一致するオーバーライドによる追加遅延と、故障率 (一致しなければ failureRate のまま) を返します。
+func applyTagOverrides(overrides []TagOverride, tags map[string]string, failureRate float64) (time.Duration, float64) {
+	var extra time.Duration
+	for _, o := range overrides {
+		if v, ok := tags[o.Key]; !ok || v != o.Value {
+			continue
+		}
+		extra += time.Duration(o.ExtraDelayMs) * time.Millisecond
+		if o.FailureRate != nil {
+			failureRate = *o.FailureRate
+		}
+	}
+	return extra, failureRate
+}
+
+// validStages はステージが 1〜maxStages 個あり、全てに重複しない名前、負でない遅延、既知の分布、0〜1 の故障率があるかどうかを返します。
+func validStages(stages []Stage) bool {
+	if len(stages) == 0 || len(stages) > maxStages {
+		return false
+	}
+	seen := make(map[string]bool, len(stages))
+	for _, st := range stages {
+		switch {
+		case st.Name == "" || seen[st.Name]:
+			return false
+		case st.DelayMs < 0 || st.FailureRate < 0 || st.FailureRate > 1:
+			return false
+		case st.Distribution != "" && st.Distribution != stageFixed && st.Distribution != stageUniform && st.Distribution != stageExponential:
+			return false
+		}
+		seen[st.Name] = true
+	}
+	return true
+}
+
+// parseStages は STAGES の値 ("parse:5,fetch:40") を固定分布のステージに変換します。空文字列は nil を返します。
+func parseStages(raw string) ([]Stage, error) {
+	var stages []Stage
+	for _, part := range strings.Split(raw, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		name, ms, ok := strings.Cut(part, ":")
+		delay, err := strconv.Atoi(strings.TrimSpace(ms))
+		if !ok || err != nil {
+			return nil, fmt.Errorf("invalid stage %q", part)
+		}
+		stages = append(stages, Stage{Name: strings.TrimSpace(name), DelayMs: delay})
+	}
+	return stages, nil
+}
+
+// planStages は重み weight のタスクが各ステージで費やす時間を分布から引いて返します。
+func planStages(stages []Stage, weight float64) []time.Duration {
+	planned := make([]time.Duration, len(stages))
+	for i, st := range stages {
+		mean := float64(st.DelayMs) * weight
+		switch st.Distribution {
+		case stageUniform:
+			mean *= 2 * rand.Float64()
+		case stageExponential:
+			mean *= rand.ExpFloat64()
+		}
+		planned[i] = time.Duration(mean * float64(time.Millisecond))
+	}
+	return planned
+}
+
+// runStages は計画した時間だけ各ステージを work で処理し、ステージ別の所要時間を返します。
+// ステージの後に故障率に従って失敗させ、失敗したステージ名を返して残りのステージは実行しません。
+func runStages(stages []Stage, planned []time.Duration, work func(time.Duration)) ([]StageTiming, string) {
+	timings := make([]StageTiming, 0, len(stages))
+	for i, st := range stages {
+		start := time.Now()
+		work(planned[i])
+		timing := StageTiming{Name: st.Name, Ms: time.Since(start).Milliseconds()}
+		metrics.stageDuration.WithLabelValues(workerName, st.Name).Observe(float64(timing.Ms))
+		if st.FailureRate > 0 && rand.Float64() < st.FailureRate {
+			timing.Failed = true
+			metrics.stageFailures.WithLabelValues(workerName, st.Name).Inc()
+			return append(timings, timing), st.Name
+		}
+		timings = append(timings, timing)
+	}
+	return timings, ""
+}
+
+// validMemoryCeiling は n がシミュレーションメモリの上限として許容範囲 (1 バイト〜4 GiB) 内かどうかを返します。
+func validMemoryCeiling(n int64) bool {
+	return n > 0 && n <= maxMemoryCeilingBytes
+}
+
+// validMaxBodyBytes は n がタスクボディ上限として許容範囲 (1 KiB〜16 MiB) 内かどうかを返します。
+func validMaxBodyBytes(n int64) bool {
+	return n >= minMaxBodyBytes && n <= maxMaxBodyBytes
+}
+
+// validMaxJSONDepth は n が JSON ネスト上限として許容範囲 (1〜1000) 内かどうかを返します。
+func validMaxJSONDepth(n int) bool {
+	return n >= 1 && n <= maxMaxJSONDepth
+}
+
+// defaultMaxCPUTasks は cpu モードタスクの既定同時実行数 (GOMAXPROCS-1、最小 1) を返します。
+// 1 コアを空けておくことで、/health や /metrics が CPU 処理の後ろで待たされないようにします。
+func defaultMaxCPUTasks() int {
+	if n := runtime.GOMAXPROCS(0) - 1; n > 1 {
+		return n
+	}
+	return 1
+}
+
+// cpuLimiter limits how many cpu-mode tasks run at once. Waiters are granted
+// slots in FIFO order. The limit is passed in on every call so configuration
+// changes apply immediately.
+type cpuLimiter struct {
+	mu      sync.Mutex
+	running int
+	waiters []chan struct{}
+}
+
+// acquire blocks until a CPU slot is free or ctx is done
+func (l *cpuLimiter) acquire(ctx context.Context, limit int) error {
+	l.mu.Lock()
+	if l.running < max(limit, 1) && len(l.waiters) == 0 {
+		l.running++
+		l.mu.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	l.waiters = append(l.waiters, ch)
+	l.mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for i, w := range l.waiters {
+			if w == ch {
+				l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+				return ctx.Err()
+			}
+		}
+		// The slot was granted while we were giving up; hand it on
+		l.running--
+		l.grantLocked(limit)
+		return ctx.Err()
+	}
+}
+
+// release frees a CPU slot and wakes the next waiters
+func (l *cpuLimiter) release(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running--
+	l.grantLocked(limit)
+}
+
+// grantLocked hands free slots to waiters in FIFO order
+func (l *cpuLimiter) grantLocked(limit int) {
+	for l.running < max(limit, 1) && len(l.waiters) > 0 {
+		close(l.waiters[0])
+		l.waiters = l.waiters[1:]
+		l.running++
+	}
+}
+
+// inUse returns the number of running cpu-mode tasks
+func (l *cpuLimiter) inUse() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.running
+}
+
+// sourceLimiter counts in-flight tasks per source. Entries are kept while a
+// source has tasks in flight and dropped once it has been idle for
+// sourceIdleTTL, so the map stays bounded by maxTrackedSources.
+type sourceLimiter struct {
+	mu      sync.Mutex
+	entries map[string]*sourceEntry
+}
+
+type sourceEntry struct {
+	inflight int
+	lastSeen time.Time
+}
+
+func newSourceLimiter() *sourceLimiter {
+	return &sourceLimiter{entries: make(map[string]*sourceEntry)}
+}
+
+// acquire takes a slot for key unless it already has limit tasks in flight.
+// It returns the key the slot was charged to, which must be passed to release.
+func (l *sourceLimiter) acquire(key string, limit int) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t := now()
+	e, ok := l.entries[key]
+	if !ok {
+		if len(l.entries) >= maxTrackedSources {
+			l.evictIdleLocked(t)
+		}
+		if len(l.entries) >= maxTrackedSources {
+			key = overflowSource
+			e = l.entries[key]
+		}
+		if e == nil {
+			e = &sourceEntry{}
+			l.entries[key] = e
+		}
+	}
+	e.lastSeen = t
+	if e.inflight >= limit {
+		return key, false
+	}
+	e.inflight++
+	return key, true
+}
+
+// release frees the slot taken by acquire
+func (l *sourceLimiter) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.entries[key]; ok {
+		e.inflight--
+		e.lastSeen = now()
+	}
+}
+
+// evictIdleLocked drops sources with nothing in flight that have been idle
+// for sourceIdleTTL
+func (l *sourceLimiter) evictIdleLocked(t time.Time) {
+	for k, e := range l.entries {
+		if e.inflight == 0 && t.Sub(e.lastSeen) >= sourceIdleTTL {
+			delete(l.entries, k)
+		}
+	}
+}
+
+// tracked returns the number of tracked sources after evicting idle ones
+func (l *sourceLimiter) tracked() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.evictIdleLocked(now())
+	return len(l.entries)
+}
+
+// sourceKey は per-source 制限に使う送信元キーを返します。
+// X-Tenant ヘッダーがあればその値、なければ X-Forwarded-For の先頭 (元のクライアント) のアドレス、どちらもなければ接続元のホストを使います。
+func sourceKey(r *http.Request) string {
+	if tenant := strings.TrimSpace(r.Header.Get(tenantHeader)); tenant != "" {
+		return "tenant:" + tenant
+	}
+	if fwd := r.Header.Get(forwardedForHeader); fwd != "" {
+		if client := strings.TrimSpace(strings.Split(fwd, ",")[0]); client != "" {
+			return "addr:" + client
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "addr:" + host
+}
+
+// logRing keeps the most recent log entries, overwriting the oldest once full
+type logRing struct {
+	mu      sync.Mutex
+	entries []LogEntry
+	next    int
+	full    bool
+	dropped uint64
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{entries: make([]LogEntry, max(size, 1))}
+}
+
+// add appends e, overwriting the oldest entry when the ring is full
+func (l *logRing) add(e LogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.full {
+		l.dropped++
+	}
+	l.entries[l.next] = e
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// tail returns up to limit of the newest entries at minLevel or above, oldest
+// first, and the number of entries overwritten so far
+func (l *logRing) tail(limit int, minLevel string) ([]LogEntry, uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := l.next
+	if l.full {
+		n = len(l.entries)
+	}
+	min := logSeverity[minLevel]
+	var out []LogEntry
+	for i := 1; i <= n && len(out) < limit; i++ {
+		e := l.entries[(l.next-i+len(l.entries))%len(l.entries)]
+		if logSeverity[e.Level] >= min {
+			out = append(out, e)
+		}
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out, l.dropped
+}
+
+// logEvent は標準ログに出力すると同時にログリングへ構造化エントリを記録します。
+func logEvent(level, msg string, fields map[string]string) {
+	if len(fields) > 0 {
+		log.Printf("[%s] %s %v", level, msg, fields)
+	} else {
+		log.Printf("[%s] %s", level, msg)
+	}
+	logs.add(LogEntry{Time: now().UTC(), Level: level, Message: msg, Fields: fields})
+}
+
+// redactEntries は fields に含まれるフィールドの値を伏せたエントリのコピーを返します。
+func redactEntries(entries []LogEntry, fields []string) []LogEntry {
+	if len(fields) == 0 {
+		return entries
+	}
+	out := make([]LogEntry, len(entries))
+	for i, e := range entries {
+		out[i] = e
+		if len(e.Fields) == 0 {
+			continue
+		}
+		redacted := make(map[string]string, len(e.Fields))
+		for k, v := range e.Fields {
+			if slices.Contains(fields, k) {
+				v = redactedValue
+			}
+			redacted[k] = v
+		}
+		out[i].Fields = redacted
+	}
+	return out
+}
+
+// memorySim holds the buffers of the memory-pressure simulation. Buffers are
+// written page by page when allocated so they count as resident memory.
+type memorySim struct {
+	mu        sync.Mutex
+	taskBytes int64
+	leak      [][]byte
+	leakBytes int64
+}
+
+func newMemorySim() *memorySim {
+	return &memorySim{}
+}
+
+// allocMemory は n バイトのバッファを確保し、ページごとに書き込んで実メモリを割り当てさせます。
+func allocMemory(n int64) []byte {
+	buf := make([]byte, n)
+	for i := 0; i < len(buf); i += os.Getpagesize() {
+		buf[i] = 1
+	}
+	return buf
+}
+
+// reserveLocked は上限 ceiling を超えない範囲で want バイトのうち確保できるバイト数を返します。m.mu を保持して呼び出してください。
+func (m *memorySim) reserveLocked(want, ceiling int64) int64 {
+	return max(min(want, ceiling-m.taskBytes-m.leakBytes), 0)
+}
+
+// acquireTask はタスク 1 件分のメモリを上限の範囲内で確保して返します。処理完了後に releaseTask に渡してください。
+func (m *memorySim) acquireTask(cfg Config) []byte {
+	if cfg.MemoryPerTaskBytes <= 0 {
+		return nil
+	}
+	m.mu.Lock()
+	n := m.reserveLocked(cfg.MemoryPerTaskBytes, cfg.MemoryCeilingBytes)
+	m.taskBytes += n
+	m.mu.Unlock()
+	m.report()
+	if n == 0 {
+		return nil
+	}
+	return allocMemory(n)
+}
+
+// releaseTask は acquireTask で確保したバッファを解放します。
+func (m *memorySim) releaseTask(buf []byte) {
+	if len(buf) == 0 {
+		return
+	}
+	m.mu.Lock()
+	m.taskBytes -= int64(len(buf))
+	m.mu.Unlock()
+	m.report()
+}
+
+// leakTick は 1 秒分のリーク (LeakBytesPerSecond) を上限の範囲内で追加します。
+func (m *memorySim) leakTick(cfg Config) {
+	if cfg.LeakBytesPerSecond <= 0 {
+		return
+	}
+	m.mu.Lock()
+	n := m.reserveLocked(cfg.LeakBytesPerSecond, cfg.MemoryCeilingBytes)
+	m.leakBytes += n
+	m.mu.Unlock()
+	if n == 0 {
+		return
+	}
+	buf := allocMemory(n)
+	m.mu.Lock()
+	m.leak = append(m.leak, buf)
+	m.mu.Unlock()
+	m.report()
+}
+
+// releaseLeak はリークしたバッファをすべて手放し、解放されたメモリを OS に返します。
+func (m *memorySim) releaseLeak() int64 {
+	m.mu.Lock()
+	freed := m.leakBytes
+	m.leak, m.leakBytes = nil, 0
+	m.mu.Unlock()
+	debug.FreeOSMemory()
+	m.report()
+	return freed
+}
+
+// retained はタスクとリークで保持しているバイト数を返します。
+func (m *memorySim) retained() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.taskBytes + m.leakBytes
+}
+
+// status は現在の保持状況を MemoryStatus として返します。
+func (m *memorySim) status(cfg Config) MemoryStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return MemoryStatus{
+		Worker:        workerName,
+		RetainedBytes: m.taskBytes + m.leakBytes,
+		TaskBytes:     m.taskBytes,
+		LeakBytes:     m.leakBytes,
+		CeilingBytes:  cfg.MemoryCeilingBytes,
+	}
+}
+
+// report は保持バイト数をゲージに反映します。
+func (m *memorySim) report() {
+	metrics.simulatedMemory.WithLabelValues(workerName).Set(float64(m.retained()))
+}
+
+// runLeak は leakInterval ごとに leakTick を呼び出し、ctx が終了すると戻ります。
+func (m *memorySim) runLeak(ctx context.Context) {
+	ticker := time.NewTicker(leakInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.leakTick(config.Get())
+		}
+	}
+}
+
+// tokenServer hands out the tokens of shared resources. Every worker serves
+// one at /acquire and /release; workers pointing SharedResourceURL at the same
+// one never hold more tokens of a resource than its capacity between them.
+type tokenServer struct {
+	mu    sync.Mutex
+	pools map[string]*tokenPool
+	seq   uint64
+}
+
+// tokenPool is one resource's leased tokens
+type tokenPool struct {
+	capacity int
+	leases   map[string]time.Time // token -> lease expiry
+	freed    chan struct{}        // closed and replaced when a token is released
+}
+
+// errTooManyResources is returned when a new resource would exceed maxSharedResources
+var errTooManyResources = errors.New("too many shared resources")
+
+func newTokenServer() *tokenServer {
+	return &tokenServer{pools: make(map[string]*tokenPool)}
+}
+
+// acquire は resource のトークンが空くまで待ってリース期間 lease で貸し出し、トークンを返します。
+// 容量は最後に指定された capacity に従います。空く前に ctx が終了した場合は ctx のエラーを返します。
+func (s *tokenServer) acquire(ctx context.Context, resource string, capacity int, lease time.Duration) (string, error) {
+	for {
+		s.mu.Lock()
+		p := s.pools[resource]
+		if p == nil {
+			if len(s.pools) >= maxSharedResources {
+				s.mu.Unlock()
+				return "", errTooManyResources
+			}
+			p = &tokenPool{leases: make(map[string]time.Time), freed: make(chan struct{})}
+			s.pools[resource] = p
+		}
+		p.capacity = capacity
+		t := now()
+		var expiry time.Time
+		for token, until := range p.leases {
+			if !until.After(t) {
+				delete(p.leases, token)
+				continue
+			}
+			if expiry.IsZero() || until.Before(expiry) {
+				expiry = until
+			}
+		}
+		if len(p.leases) < p.capacity {
+			s.seq++
+			token := fmt.Sprintf("%s-%d", resource, s.seq)
+			p.leases[token] = t.Add(lease)
+			s.mu.Unlock()
+			return token, nil
+		}
+		freed := p.freed
+		s.mu.Unlock()
+
+		// Try again once a token is released or the earliest lease expires
+		timer := time.NewTimer(expiry.Sub(t))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return "", ctx.Err()
+		case <-freed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// release は resource のトークンを返却し、貸し出し中だったかどうかを返します。
+func (s *tokenServer) release(resource, token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.pools[resource]
+	if p == nil {
+		return false
+	}
+	if _, ok := p.leases[token]; !ok {
+		return false
+	}
+	delete(p.leases, token)
+	close(p.freed)
+	p.freed = make(chan struct{})
+	return true
+}
+
+// inUse は resource の貸し出し中のトークン数を返します。
+func (s *tokenServer) inUse(resource string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p := s.pools[resource]; p != nil {
+		return len(p.leases)
+	}
+	return 0
+}
+
+// AcquireRequest is the body of POST /acquire
+type AcquireRequest struct {
+	Resource  string `json:"resource"`
+	Capacity  int    `json:"capacity"`
+	TimeoutMs int    `json:"timeout_ms"`
+	LeaseMs   int    `json:"lease_ms"`
+}
+
+// AcquireResponse is a token leased by POST /acquire
+type AcquireResponse struct {
+	Token    string `json:"token"`
+	Resource string `json:"resource"`
+	WaitMs   int64  `json:"waitMs"`
+	InUse    int    `json:"inUse"`
+	Capacity int    `json:"capacity"`
+}
+
+// ReleaseRequest is the body of POST /release
+type ReleaseRequest struct {
+	Resource string `json:"resource"`
+	Token    string `json:"token"`
+}
+
+// errSharedTimeout is returned when no shared resource token became free in time
+var errSharedTimeout = errors.New("timed out waiting for a shared resource token")
+
+// acquireShared は cfg.SharedResource のトークンを SharedResourceTimeoutMs まで待って取得し、返却する関数を返します。
+// SharedResourceURL が設定されていればそのトークンサーバーから、なければこのワーカー自身のトークンサーバーから取得します。
+func acquireShared(ctx context.Context, cfg Config) (func(), error) {
+	timeout := time.Duration(cfg.SharedResourceTimeoutMs) * time.Millisecond
+	lease := sharedLeaseMs * time.Millisecond
+	if cfg.SharedResourceURL == "" {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		token, err := tokens.acquire(ctx, cfg.SharedResource, cfg.SharedResourceCapacity, lease)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, errSharedTimeout
+		}
+		if err != nil {
+			return nil, err
+		}
+		return func() { tokens.release(cfg.SharedResource, token) }, nil
+	}
+
+	// The server bounds the wait; the client allows for the round trip
+	ctx, cancel := context.WithTimeout(ctx, timeout+2*time.Second)
+	defer cancel()
+	body, _ := json.Marshal(AcquireRequest{
+		Resource:  cfg.SharedResource,
+		Capacity:  cfg.SharedResourceCapacity,
+		TimeoutMs: cfg.SharedResourceTimeoutMs,
+		LeaseMs:   sharedLeaseMs,
+	})
+	resp, err := postJSON(ctx, cfg.SharedResourceURL+"/acquire", body)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, errSharedTimeout
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e ErrorResponse
+		json.NewDecoder(resp.Body).Decode(&e)
+		if e.Reason == sharedResourceTimeout {
+			return nil, errSharedTimeout
+		}
+		return nil, fmt.Errorf("token server returned %d: %s", resp.StatusCode, e.Error)
+	}
+	var granted AcquireResponse
+	if err := json.NewDecoder(resp.Body).Decode(&granted); err != nil {
+		return nil, fmt.Errorf("invalid token server response: %v", err)
+	}
+	url, resource := cfg.SharedResourceURL, cfg.SharedResource
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		body, _ := json.Marshal(ReleaseRequest{Resource: resource, Token: granted.Token})
+		resp, err := postJSON(ctx, url+"/release", body)
+		if err != nil {
+			logEvent(logWarn, "Failed to release shared resource token", map[string]string{"resource": resource, "error": err.Error()})
+			return
+		}
+		resp.Body.Close()
+	}, nil
+}
+
+// postJSON は body を JSON として url へ POST します。
+func postJSON(ctx context.Context, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return http.DefaultClient.Do(req)
+}
+
+// Task forwarding. A task with forwardTo is, once this worker has processed
+// it, forwarded as a derived sub-task to each named peer concurrently, and
+// the answers are combined into a call tree with the time of every hop. A
+// failed call is kept in the tree with its error and marks the response
+// partial rather than failing the task. X-Forward-Visited carries the names
+// along the chain so no peer is called twice on one path, and
+// X-Forward-Hop how far the chain is from its first worker, which stops
+// forwarding at MaxForwardDepth.
+const (
+	forwardVisitedHeader   = "X-Forward-Visited"
+	forwardHopHeader       = "X-Forward-Hop"
+	defaultMaxForwardDepth = 3
+	maxMaxForwardDepth     = 10
+	// forwardTimeout bounds a peer call when the task has no deadline budget
+	forwardTimeout = 10 * time.Second
+)
+
+// CallNode is one hop of a forwarded task: the peer the caller named, the
+// worker that answered and how long the call took including the calls it
+// made itself. A skipped peer was already on the path; a truncated node had
+// calls left that MaxForwardDepth cut off. Its fields are single words so
+// both response field styles encode it the same way.
+type CallNode struct {
+	Peer      string     `json:"peer,omitempty"`
+	Worker    string     `json:"worker,omitempty"`
+	Task      string     `json:"task"`
+	Ms        int64      `json:"ms"`
+	Status    int        `json:"status,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Skipped   bool       `json:"skipped,omitempty"`
+	Truncated bool       `json:"truncated,omitempty"`
+	Calls     []CallNode `json:"calls,omitempty"`
+}
+
+// parsePeers は PEERS 環境変数 ("name=url,name2=url2") を解析します。空文字列は nil を返します。
+func parsePeers(raw string) (map[string]string, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+	peers := make(map[string]string)
+	for _, pair := range strings.Split(raw, ",") {
+		name, url, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("peer %q: want name=url", pair)
+		}
+		peers[strings.TrimSpace(name)] = strings.TrimSuffix(strings.TrimSpace(url), "/")
+	}
+	return peers, nil
+}
+
+// validPeers は全てのピアに名前と http(s) の URL があるかどうかを返します。
+func validPeers(peers map[string]string) bool {
+	for name, url := range peers {
+		if name == "" || strings.Contains(name, ",") || !(strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")) {
+			return false
+		}
+	}
+	return true
+}
+
+func validMaxForwardDepth(n int) bool {
+	return n >= 1 && n <= maxMaxForwardDepth
+}
+
+// forwardVisited は X-Forward-Visited ヘッダーの名前の一覧を返します。
+func forwardVisited(r *http.Request) []string {
+	var out []string
+	for _, name := range strings.Split(r.Header.Get(forwardVisitedHeader), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// forwardTask は処理済みの task を ForwardTo のピアへ並行して転送し、このワーカーを根とする呼び出しツリーと、失敗した呼び出しがあったかどうかを返します。
+// 経路上にあるピアは呼ばずに skipped とし、MaxForwardDepth に達している場合は転送せずに truncated とします。
+func forwardTask(r *http.Request, cfg Config, task TaskRequest) (CallNode, bool) {
+	root := CallNode{Worker: workerName, Task: task.ID}
+	hop, _ := strconv.Atoi(r.Header.Get(forwardHopHeader))
+	if hop >= cfg.MaxForwardDepth {
+		root.Truncated = true
+		return root, false
+	}
+	visited := forwardVisited(r)
+	if len(visited) == 0 {
+		visited = []string{workerName}
+	}
+
+	timeout := forwardTimeout
+	if budget, ok := deadlineBudget(r); ok {
+		timeout = budget
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	root.Calls = make([]CallNode, len(task.ForwardTo))
+	var wg sync.WaitGroup
+	for i, peer := range task.ForwardTo {
+		sub := task
+		sub.ID = task.ID + "/" + peer
+		sub.ForwardDepth = task.ForwardDepth - 1
+		if slices.Contains(visited, peer) {
+			metrics.forwardCalls.WithLabelValues(workerName, "skipped").Inc()
+			root.Calls[i] = CallNode{Peer: peer, Task: sub.ID, Skipped: true, Error: "Already on the call path"}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			root.Calls[i] = callPeer(ctx, cfg, peer, sub, append(slices.Clone(visited), peer), hop+1)
+		}(i, peer)
+	}
+	wg.Wait()
+
+	return root, root.failed()
+}
+
+// failed reports whether a call in the tree below n failed
+func (n CallNode) failed() bool {
+	for _, c := range n.Calls {
+		if (c.Error != "" && !c.Skipped) || c.failed() {
+			return true
+		}
+	}
+	return false
+}
+
+// callPeer は派生タスク sub をピアへ送り、その応答を呼び出しツリーのノードにします。
+// ピアが自身の呼び出しツリーを返した場合はその呼び出しを子として引き継ぎます。
+func callPeer(ctx context.Context, cfg Config, peer string, sub TaskRequest, visited []string, hop int) (node CallNode) {
+	node = CallNode{Peer: peer, Task: sub.ID}
+	start := time.Now()
+	defer func() {
+		node.Ms = time.Since(start).Milliseconds()
+		outcome := "success"
+		if node.Error != "" {
+			outcome = "failed"
+			logEvent(logWarn, "Forwarded task failed", map[string]string{"task": sub.ID, "peer": peer, "error": node.Error})
+		}
+		metrics.forwardCalls.WithLabelValues(workerName, outcome).Inc()
+	}()
+
+	url, ok := cfg.Peers[peer]
+	if !ok {
+		node.Error = "Unknown peer"
+		return node
+	}
+	body, _ := json.Marshal(sub)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+"/task", bytes.NewReader(body))
+	if err != nil {
+		node.Error = err.Error()
+		return node
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(forwardVisitedHeader, strings.Join(visited, ","))
+	req.Header.Set(forwardHopHeader, strconv.Itoa(hop))
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set(deadlineHeader, strconv.FormatInt(time.Until(deadline).Milliseconds(), 10))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		node.Error = err.Error()
+		return node
+	}
+	defer resp.Body.Close()
+	node.Status = resp.StatusCode
+
+	// Both response field styles: the tree's own fields are single words
+	var out struct {
+		Worker        string    `json:"worker"`
+		Error         string    `json:"error"`
+		CallTree      *CallNode `json:"callTree"`
+		CallTreeSnake *CallNode `json:"call_tree"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil && resp.StatusCode < 300 {
+		node.Error = "Invalid response from peer"
+		return node
+	}
+	node.Worker = out.Worker
+	if resp.StatusCode >= 300 {
+		node.Error = out.Error
+		if node.Error == "" {
+			node.Error = fmt.Sprintf("Peer returned status %d", resp.StatusCode)
+		}
+		return node
+	}
+	tree := out.CallTree
+	if tree == nil {
+		tree = out.CallTreeSnake
+	}
+	if tree != nil {
+		node.Truncated, node.Calls = tree.Truncated, tree.Calls
+	}
+	return node
+}
+
+// burnCPU keeps the current goroutine busy for d
+func burnCPU(d time.Duration) {
+	deadline := time.Now().Add(d)
+	x := 1.0
+	for time.Now().Before(deadline) {
+		for i := 0; i < 1000; i++ {
+			x = x*1.0000001 + 1e-9
+		}
+	}
+	_ = x
+}
+
+// decodeTask はタスクボディを cfg の上限に従ってデコードします。
+// サイズ超過は 413、ネスト超過・未知フィールド (strict_decode 時) は 400、task_schema 違反は 422 (*schemaError) とし、reason に理由コードを返します。
+// 単なる JSON 不正の場合 reason は空です。
+func decodeTask(w http.ResponseWriter, r *http.Request, cfg Config) (TaskRequest, int, string, error) {
+	var task TaskRequest
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, cfg.MaxBodyBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return task, http.StatusRequestEntityTooLarge, "body_too_large",
+				fmt.Errorf("Request body exceeds %d bytes", cfg.MaxBodyBytes)
+		}
+		return task, http.StatusBadRequest, "", errors.New("Invalid request body")
+	}
+	if jsonDepthExceeds(body, cfg.MaxJSONDepth) {
+		return task, http.StatusBadRequest, "json_too_deep",
+			fmt.Errorf("Request body nesting exceeds depth %d", cfg.MaxJSONDepth)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if cfg.StrictDecode {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(&task); err != nil {
+		if cfg.StrictDecode && strings.HasPrefix(err.Error(), "json: unknown field") {
+			return task, http.StatusBadRequest, "unknown_field", fmt.Errorf("Invalid request body: %s", strings.TrimPrefix(err.Error(), "json: "))
+		}
+		return task, http.StatusBadRequest, "", errors.New("Invalid request body")
+	}
+	if cfg.taskSchema != nil {
+		var doc interface{}
+		json.Unmarshal(body, &doc)
+		if violations := cfg.taskSchema.validate(doc); len(violations) > 0 {
+			return task, http.StatusUnprocessableEntity, schemaViolation, &schemaError{violations: violations}
+		}
+	}
+	return task, http.StatusOK, "", nil
+}
+
+// jsonDepthExceeds は body の配列・オブジェクトのネストが max を超えるかどうかを返します。
+// 構文エラーは判定せず、後段のデコードに任せます。
+func jsonDepthExceeds(body []byte, max int) bool {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return false
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+			if depth > max {
+				return true
+			}
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+}
+
+// Task schema validation. task_schema is either a JSON Schema document,
+// limited to the keywords of taskSchema, or a simplified field spec
+// {"fields": {"id": "string", "weight": "number?"}} that lists the fields of
+// the task with their type, a trailing "?" marking a field optional. A
+// task breaking it is rejected with 422 and the list of violations.
+const (
+	schemaViolation     = "schema_violation"
+	maxSchemaViolations = 20
+)
+
+// taskSchema is a compiled JSON Schema. Only these keywords are supported;
+// any other is an error, as are unknown types and bad patterns.
+type taskSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Description          string                 `json:"description,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	Properties           map[string]*taskSchema `json:"properties,omitempty"`
+	AdditionalProperties *bool                  `json:"additionalProperties,omitempty"`
+	Items                *taskSchema            `json:"items,omitempty"`
+	Enum                 []interface{}          `json:"enum,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Maximum              *float64               `json:"maximum,omitempty"`
+	MinLength            *int                   `json:"minLength,omitempty"`
+	MaxLength            *int                   `json:"maxLength,omitempty"`
+	Pattern              string                 `json:"pattern,omitempty"`
+	pattern              *regexp.Regexp
+}
+
+// schemaError is a task body that broke the task schema
+type schemaError struct {
+	violations []string
+}
+
+func (e *schemaError) Error() string {
+	return fmt.Sprintf("Task violates the task schema: %s", strings.Join(e.violations, "; "))
+}
+
+var schemaTypes = map[string]bool{"string": true, "number": true, "integer": true, "boolean": true, "object": true, "array": true, "null": true}
+
+// compileTaskSchema は task_schema を検証してコンパイルします。null と {} はスキーマなし (nil) です。
+func compileTaskSchema(raw json.RawMessage) (*taskSchema, error) {
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null")) || bytes.Equal(trimmed, []byte("{}")) {
+		return nil, nil
+	}
+	var spec struct {
+		Fields map[string]string `json:"fields"`
+	}
+	if json.Unmarshal(trimmed, &spec) == nil && spec.Fields != nil {
+		return compileFieldSpec(spec.Fields)
+	}
+
+	var s taskSchema
+	dec := json.NewDecoder(bytes.NewReader(trimmed))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&s); err != nil {
+		return nil, fmt.Errorf("is not a valid schema: %s", strings.TrimPrefix(err.Error(), "json: "))
+	}
+	if err := s.compile(""); err != nil {
+		return nil, err
+	}
+	return &s, nil
 }
 
-// getEnvInt は環境変数 key を整数として読み取り、値が設定されていないか変換に失敗した場合は defaultVal を返します。
-func getEnvInt(key string, defaultVal int) int {
-	if val := os.Getenv(key); val != "" {
-		if i, err := strconv.Atoi(val); err == nil {
-			return i
+// compileFieldSpec は簡易フィールド指定を同等の JSON Schema に変換します。
+func compileFieldSpec(fields map[string]string) (*taskSchema, error) {
+	s := &taskSchema{Type: "object", Properties: make(map[string]*taskSchema, len(fields))}
+	for name, typ := range fields {
+		optional := strings.HasSuffix(typ, "?")
+		typ = strings.TrimSuffix(typ, "?")
+		if !schemaTypes[typ] {
+			return nil, fmt.Errorf("field %q has unknown type %q", name, typ)
+		}
+		s.Properties[name] = &taskSchema{Type: typ}
+		if !optional {
+			s.Required = append(s.Required, name)
 		}
 	}
-	return defaultVal
+	slices.Sort(s.Required)
+	return s, nil
 }
 
-// getEnvFloatは指定した環境変数を読み取り、浮動小数点値に変換して返します。
-// 環境変数が設定されていないか有効な浮動小数点に変換できない場合はdefaultValを返します。
-func getEnvFloat(key string, defaultVal float64) float64 {
-	if val := os.Getenv(key); val != "" {
-		if f, err := strconv.ParseFloat(val, 64); err == nil {
-			return f
+// compile はスキーマの整合性を検証し、pattern をコンパイルします。path はエラーメッセージ用の位置です。
+func (s *taskSchema) compile(path string) error {
+	at := schemaPath(path)
+	if s.Type != "" && !schemaTypes[s.Type] {
+		return fmt.Errorf("%s: unknown type %q", at, s.Type)
+	}
+	if s.Minimum != nil && s.Maximum != nil && *s.Minimum > *s.Maximum {
+		return fmt.Errorf("%s: minimum exceeds maximum", at)
+	}
+	if (s.MinLength != nil && *s.MinLength < 0) || (s.MaxLength != nil && *s.MaxLength < 0) {
+		return fmt.Errorf("%s: lengths must not be negative", at)
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("%s: invalid pattern: %v", at, err)
 		}
+		s.pattern = re
 	}
-	return defaultVal
+	for name, p := range s.Properties {
+		if p == nil {
+			return fmt.Errorf("%s/%s: schema must be an object", path, name)
+		}
+		if err := p.compile(path + "/" + name); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.compile(path + "/items")
+	}
+	return nil
 }
 
-// loadConfig は環境変数から初期 Configuration を構築して返します。
-// 使用する環境変数とデフォルト値: MAX_CONCURRENT_REQUESTS=10, RESPONSE_DELAY_MS=100, FAILURE_RATE=0.0, QUEUE_SIZE=50。
-// 環境変数が未設定または無効な場合は対応するデフォルト値が使われます。
-// 値は安全な範囲にクランプされます。
-func loadConfig() *Configuration {
-	maxConcurrent := getEnvInt("MAX_CONCURRENT_REQUESTS", 10)
-	if maxConcurrent < 1 {
-		maxConcurrent = 1
-	}
+// validate は doc がスキーマに適合しない箇所を最大 maxSchemaViolations 件返します。
+func (s *taskSchema) validate(doc interface{}) []string {
+	var out []string
+	s.check(doc, "", &out)
+	return out
+}
 
-	responseDelay := getEnvInt("RESPONSE_DELAY_MS", 100)
-	if responseDelay < 0 {
-		responseDelay = 0
+func (s *taskSchema) check(v interface{}, path string, out *[]string) {
+	add := func(format string, args ...interface{}) {
+		if len(*out) < maxSchemaViolations {
+			*out = append(*out, schemaPath(path)+": "+fmt.Sprintf(format, args...))
+		}
 	}
-
-	failureRate := getEnvFloat("FAILURE_RATE", 0.0)
-	if failureRate < 0.0 {
-		failureRate = 0.0
-	} else if failureRate > 1.0 {
-		failureRate = 1.0
+	if s.Type != "" && !schemaTypeMatches(s.Type, v) {
+		add("must be %s", s.Type)
+		return
 	}
-
-	queueSize := getEnvInt("QUEUE_SIZE", 50)
-	if queueSize < 1 {
-		queueSize = 1
+	if len(s.Enum) > 0 && !slices.ContainsFunc(s.Enum, func(e interface{}) bool { return reflect.DeepEqual(e, v) }) {
+		add("must be one of %v", s.Enum)
 	}
-
-	return &Configuration{
-		MaxConcurrentRequests: maxConcurrent,
-		ResponseDelayMs:       responseDelay,
-		FailureRate:           failureRate,
-		QueueSize:             queueSize,
+	switch v := v.(type) {
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			add("must be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			add("must be at most %v", *s.Maximum)
+		}
+	case string:
+		n := len([]rune(v))
+		if s.MinLength != nil && n < *s.MinLength {
+			add("must be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			add("must be at most %d characters", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			add("must match %s", s.Pattern)
+		}
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				add("missing required field %q", name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			if p, ok := s.Properties[name]; ok {
+				p.check(v[name], path+"/"+name, out)
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				add("unexpected field %q", name)
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.check(item, path+"/"+strconv.Itoa(i), out)
+			}
+		}
 	}
 }
 
-func (c *Configuration) Update(newConfig *Configuration) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if newConfig.MaxConcurrentRequests > 0 {
-		c.MaxConcurrentRequests = newConfig.MaxConcurrentRequests
-	}
-	if newConfig.ResponseDelayMs >= 0 {
-		c.ResponseDelayMs = newConfig.ResponseDelayMs
-	}
-	if newConfig.FailureRate >= 0 && newConfig.FailureRate <= 1 {
-		c.FailureRate = newConfig.FailureRate
+// schemaPath は JSON Pointer 形式の位置 path を表示用に返します。ルートは "/" です。
+func schemaPath(path string) string {
+	if path == "" {
+		return "/"
 	}
-	if newConfig.QueueSize > 0 {
-		c.QueueSize = newConfig.QueueSize
+	return path
+}
+
+// schemaTypeMatches は JSON の値 v が JSON Schema の型 typ かどうかを返します。
+func schemaTypeMatches(typ string, v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return typ == "null"
+	case bool:
+		return typ == "boolean"
+	case float64:
+		return typ == "number" || (typ == "integer" && v == math.Trunc(v))
+	case string:
+		return typ == "string"
+	case []interface{}:
+		return typ == "array"
+	case map[string]interface{}:
+		return typ == "object"
 	}
+	return false
 }
 
-func (c *Configuration) Get() Configuration {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	return Configuration{
-		MaxConcurrentRequests: c.MaxConcurrentRequests,
-		ResponseDelayMs:       c.ResponseDelayMs,
-		FailureRate:           c.FailureRate,
-		QueueSize:             c.QueueSize,
+// deadlineBudget は X-LB-Deadline-Ms ヘッダーから LB の残り時間予算を読み取ります。
+// ヘッダーが無いか不正な場合は ok=false を返します。
+func deadlineBudget(r *http.Request) (budget time.Duration, ok bool) {
+	val := r.Header.Get(deadlineHeader)
+	if val == "" {
+		return 0, false
 	}
+	ms, err := strconv.Atoi(val)
+	if err != nil || ms < 0 {
+		return 0, false
+	}
+	return time.Duration(ms) * time.Millisecond, true
 }
 
 // handleTask は POST /task リクエストを処理し、エントリーポイントのキュー受け入れと同時実行制御を行った上で疑似的な処理遅延と故障をシミュレートして JSON レスポンスを返します。
 // キューが満杯または同時実行上限超過時は 503 を、リクエストボディが不正な場合は 400 を、シミュレート故障時は 500 を返し、成功時は処理情報を含む TaskResponse を返します。
+// X-LB-Deadline-Ms ヘッダーで渡された予算を処理遅延が超える場合、DeadlinePolicy に従って遅延を短縮するか、スリープせずに 504 を返します。
+// mode=cpu のタスクはスリープの代わりに CPU を消費し、同時実行数は MaxCPUTasks に制限されます (超過分は FIFO で待機)。
+// 成功時の TaskResponse は timestamp_format と response_field_style に従ってエンコードし、使用した形式を X-Worker-Timestamp-Format / X-Worker-Field-Style ヘッダーで示します。
+// task_schema が設定されている場合、それに適合しないボディは違反の一覧 (violations) を付けた 422 (reason: schema_violation) で拒否します。
+// PerSourceMaxConcurrent が正の場合、送信元 (X-Tenant または X-Forwarded-For) ごとの処理中タスク数がこれを超えると 429 (reason: per_source_limit) を返します。
+// SharedResource が設定されている場合は処理前に共有リソースのトークンを取得し、待機時間を sharedWaitMs で返します。期限内に取得できなければ 503 (reason: shared_resource_timeout) を返します。
+// forwardTo と forwardDepth が指定されたタスクは処理後にピアへ転送し、各ホップの所要時間を含む callTree を返します。転送先の失敗は partial として応答に含めます。
 func handleTask(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -190,18 +2239,63 @@ func handleTask(w http.ResponseWriter, r *http.Request) {
 	}
 
 	cfg := config.Get()
+	setResponseFormatHeaders(w, cfg)
+
+	// A worker the LB drains or disabled takes no new tasks
+	if action, ok := control.shedding(); ok {
+		metrics.requestsTotal.WithLabelValues(workerName, "rejected").Inc()
+		metrics.rejections.WithLabelValues(workerName, rejectDraining).Inc()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(rejectReasonHeader, rejectDraining)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(ErrorResponse{
+			Error:  fmt.Sprintf("Worker is not accepting tasks (%s)", action),
+			Worker: workerName,
+			Reason: rejectDraining,
+		})
+		return
+	}
+
+	// Check the per-source limit before taking a global slot, so one source's
+	// burst is turned away without crowding out the others
+	if cfg.PerSourceMaxConcurrent > 0 {
+		key, ok := sources.acquire(sourceKey(r), cfg.PerSourceMaxConcurrent)
+		defer func() {
+			metrics.trackedSources.WithLabelValues(workerName).Set(float64(sources.tracked()))
+		}()
+		if !ok {
+			logEvent(logWarn, "Task rejected: per-source limit reached", map[string]string{"source": key})
+			metrics.requestsTotal.WithLabelValues(workerName, "rejected").Inc()
+			metrics.rejections.WithLabelValues(workerName, rejectPerSourceLimit).Inc()
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set(rejectReasonHeader, rejectPerSourceLimit)
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(ErrorResponse{
+				Error:  fmt.Sprintf("Per-source concurrency limit reached (%d)", cfg.PerSourceMaxConcurrent),
+				Worker: workerName,
+				Reason: rejectPerSourceLimit,
+			})
+			return
+		}
+		defer sources.release(key)
+	}
 
 	// Check queue capacity
 	select {
 	case requestQueue <- struct{}{}:
 		defer func() { <-requestQueue }()
 	default:
-		requestsTotal.WithLabelValues(workerName, "rejected").Inc()
+		logEvent(logWarn, "Task rejected: queue full", nil)
+		metrics.requestsTotal.WithLabelValues(workerName, "rejected").Inc()
+		metrics.rejections.WithLabelValues(workerName, rejectQueueFull).Inc()
 		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(rejectReasonHeader, rejectQueueFull)
+		w.Header().Set("Retry-After", retryAfter(cfg))
 		w.WriteHeader(http.StatusServiceUnavailable)
 		json.NewEncoder(w).Encode(ErrorResponse{
 			Error:  "Queue full - service overloaded",
 			Worker: workerName,
+			Reason: rejectQueueFull,
 		})
 		return
 	}
@@ -210,26 +2304,54 @@ func handleTask(w http.ResponseWriter, r *http.Request) {
 	current := atomic.AddInt32(&activeRequests, 1)
 	defer func() {
 		atomic.AddInt32(&activeRequests, -1)
-		currentLoad.WithLabelValues(workerName).Set(float64(atomic.LoadInt32(&activeRequests)))
+		metrics.currentLoad.WithLabelValues(workerName).Set(float64(atomic.LoadInt32(&activeRequests)))
 	}()
-	currentLoad.WithLabelValues(workerName).Set(float64(current))
+	metrics.currentLoad.WithLabelValues(workerName).Set(float64(current))
 
 	if int(current) > cfg.MaxConcurrentRequests {
 		// Note: defer will handle decrement, no need for explicit decrement here
-		requestsTotal.WithLabelValues(workerName, "overloaded").Inc()
+		logEvent(logWarn, "Task rejected: max concurrent requests exceeded", map[string]string{"load": strconv.Itoa(int(current))})
+		metrics.requestsTotal.WithLabelValues(workerName, "overloaded").Inc()
+		metrics.rejections.WithLabelValues(workerName, rejectOverloaded).Inc()
 		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(rejectReasonHeader, rejectOverloaded)
+		w.Header().Set("Retry-After", retryAfter(cfg))
 		w.WriteHeader(http.StatusServiceUnavailable)
 		json.NewEncoder(w).Encode(ErrorResponse{
 			Error:  fmt.Sprintf("Max concurrent requests exceeded (%d/%d)", current, cfg.MaxConcurrentRequests),
 			Worker: workerName,
+			Reason: rejectOverloaded,
 		})
 		return
 	}
 
-	// Parse request
-	var task TaskRequest
-	if err := json.NewDecoder(r.Body).Decode(&task); err != nil {
-		requestsTotal.WithLabelValues(workerName, "error").Inc()
+	// Parse request within the configured size, depth and strictness limits
+	task, status, reason, err := decodeTask(w, r, cfg)
+	if err != nil {
+		label := "body_rejected"
+		switch reason {
+		case "":
+			label = "error"
+		case schemaViolation:
+			label = schemaViolation
+		}
+		metrics.requestsTotal.WithLabelValues(workerName, label).Inc()
+		resp := ErrorResponse{
+			Error:  err.Error(),
+			Worker: workerName,
+			Reason: reason,
+		}
+		var invalid *schemaError
+		if errors.As(err, &invalid) {
+			resp.Violations = invalid.violations
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	if !validTaskMode(task.Mode) {
+		metrics.requestsTotal.WithLabelValues(workerName, "error").Inc()
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(ErrorResponse{
@@ -239,6 +2361,33 @@ func handleTask(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Take a token of the shared resource, if any, before processing
+	var sharedWait *int64
+	if cfg.SharedResource != "" {
+		waitStart := time.Now()
+		release, err := acquireShared(r.Context(), cfg)
+		waited := time.Since(waitStart).Milliseconds()
+		metrics.sharedWait.WithLabelValues(workerName, cfg.SharedResource).Observe(float64(waited))
+		if err != nil {
+			reason := sharedResourceDown
+			if err == errSharedTimeout {
+				reason = sharedResourceTimeout
+			}
+			logEvent(logWarn, "Task rejected: shared resource unavailable", map[string]string{"task": task.ID, "resource": cfg.SharedResource, "error": err.Error()})
+			metrics.requestsTotal.WithLabelValues(workerName, reason).Inc()
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(ErrorResponse{
+				Error:  fmt.Sprintf("Shared resource %s unavailable: %v", cfg.SharedResource, err),
+				Worker: workerName,
+				Reason: reason,
+			})
+			return
+		}
+		defer release()
+		sharedWait = &waited
+	}
+
 	startTime := time.Now()
 
 	// Simulate processing with delay
@@ -246,15 +2395,104 @@ func handleTask(w http.ResponseWriter, r *http.Request) {
 	if weight <= 0 {
 		weight = 1
 	}
+	if weight > maxTaskWeight {
+		logEvent(logWarn, fmt.Sprintf("Clamping weight %g to %d", weight, maxTaskWeight), map[string]string{"task": task.ID})
+		weight = maxTaskWeight
+	}
 	delay := time.Duration(float64(cfg.ResponseDelayMs)*weight) * time.Millisecond
-	time.Sleep(delay)
+	// A pipeline replaces the single delay; tag overrides extend its last stage
+	var planned []time.Duration
+	if len(cfg.Stages) > 0 {
+		planned = planStages(cfg.Stages, weight)
+		delay = 0
+		for _, d := range planned {
+			delay += d
+		}
+	}
+	extraDelay, failureRate := applyTagOverrides(cfg.TagOverrides, task.Tags, cfg.FailureRate)
+	delay += extraDelay
+	if planned != nil {
+		planned[len(planned)-1] += extraDelay
+	}
+
+	// Respect the LB's deadline budget instead of sleeping past it
+	if budget, ok := deadlineBudget(r); ok && delay > budget {
+		if cfg.DeadlinePolicy == deadlinePolicyShorten {
+			metrics.deadlineExceeded.WithLabelValues(workerName, "shortened").Inc()
+			for i := range planned {
+				planned[i] = time.Duration(float64(planned[i]) * float64(budget) / float64(delay))
+			}
+			delay = budget
+		} else {
+			logEvent(logWarn, "Task rejected: deadline budget exceeded", map[string]string{"task": task.ID, "budgetMs": strconv.FormatInt(budget.Milliseconds(), 10)})
+			metrics.deadlineExceeded.WithLabelValues(workerName, "rejected").Inc()
+			metrics.requestsTotal.WithLabelValues(workerName, "deadline_exceeded").Inc()
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusGatewayTimeout)
+			json.NewEncoder(w).Encode(ErrorResponse{
+				Error:  fmt.Sprintf("Deadline budget exceeded (%dms needed, %dms left)", delay.Milliseconds(), budget.Milliseconds()),
+				Worker: workerName,
+				Reason: "deadline_exceeded",
+			})
+			return
+		}
+	}
+
+	// Hold the simulated per-task memory until the task completes
+	buf := memory.acquireTask(cfg)
+	defer memory.releaseTask(buf)
+
+	work := time.Sleep
+	if task.Mode == taskModeCPU {
+		waitStart := time.Now()
+		if err := cpuSlots.acquire(r.Context(), cfg.MaxCPUTasks); err != nil {
+			metrics.requestsTotal.WithLabelValues(workerName, "cancelled").Inc()
+			return
+		}
+		metrics.cpuSlotWait.WithLabelValues(workerName).Observe(float64(time.Since(waitStart).Milliseconds()))
+		metrics.cpuSlotsInUse.WithLabelValues(workerName).Set(float64(cpuSlots.inUse()))
+		work = burnCPU
+	}
+	var stages []StageTiming
+	var failedStage string
+	if planned != nil {
+		stages, failedStage = runStages(cfg.Stages, planned, work)
+	} else {
+		work(delay)
+	}
+	if task.Mode == taskModeCPU {
+		cpuSlots.release(cfg.MaxCPUTasks)
+		metrics.cpuSlotsInUse.WithLabelValues(workerName).Set(float64(cpuSlots.inUse()))
+	}
 
 	processingTime := time.Since(startTime).Milliseconds()
-	requestDuration.WithLabelValues(workerName).Observe(float64(processingTime))
+	if stages != nil {
+		processingTime = 0
+		for _, st := range stages {
+			processingTime += st.Ms
+		}
+	}
+	metrics.requestDuration.WithLabelValues(workerName).Observe(float64(processingTime))
+
+	if failedStage != "" {
+		logEvent(logError, "Simulated failure in stage "+failedStage, map[string]string{"task": task.ID, "stage": failedStage})
+		metrics.requestsTotal.WithLabelValues(workerName, "failed").Inc()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{
+			Error:  "Simulated failure in stage " + failedStage,
+			Worker: workerName,
+			Reason: stageFailed,
+			Stage:  failedStage,
+			Stages: stages,
+		})
+		return
+	}
 
 	// Simulate failure based on failure rate
-	if rand.Float64() < cfg.FailureRate {
-		requestsTotal.WithLabelValues(workerName, "failed").Inc()
+	if rand.Float64() < failureRate {
+		logEvent(logError, "Simulated failure", map[string]string{"task": task.ID})
+		metrics.requestsTotal.WithLabelValues(workerName, "failed").Inc()
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(ErrorResponse{
@@ -264,23 +2502,44 @@ func handleTask(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Forward to the peers the task names, keeping what they answered
+	var callTree *CallNode
+	var partial bool
+	if len(task.ForwardTo) > 0 && task.ForwardDepth > 0 {
+		tree, p := forwardTask(r, cfg, task)
+		tree.Ms = time.Since(startTime).Milliseconds()
+		callTree, partial = &tree, p
+	}
+
 	// Success response
-	requestsTotal.WithLabelValues(workerName, "success").Inc()
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(TaskResponse{
+	metrics.requestsTotal.WithLabelValues(workerName, "success").Inc()
+	finishedAt := time.Now().UTC()
+	body, err := marshalTaskResponse(TaskResponse{
 		ID:               task.ID,
 		Worker:           workerName,
 		Color:            workerColor,
 		ProcessingTimeMs: processingTime,
-		Timestamp:        time.Now().UTC().Format(time.RFC3339Nano),
-	})
+		Timestamp:        finishedAt.Format(time.RFC3339Nano),
+		Tags:             task.Tags,
+		SharedWaitMs:     sharedWait,
+		Stages:           stages,
+		CallTree:         callTree,
+		Partial:          partial,
+	}, finishedAt, cfg)
+	if err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(body, '\n'))
 }
 
 // handleHealth は現在の同時処理数とキュー深度を評価してサービスのヘルス状態を判定し、JSON で結果を返します。
 //
 // 判定は現在の負荷比率（現在の同時処理数 / MaxConcurrentRequests）とキュー比率（キュー深度 / QueueSize）に基づき、
 // いずれかの比率が 0.9 以上で "unhealthy"、いずれかが 0.7 以上で "degraded"、それ以外は "healthy" を返します。
-// レスポンスは Content-Type: application/json を設定し、HealthResponse（Status, CurrentLoad, QueueDepth）をエンコードして返します.
+// レスポンスは Content-Type: application/json を設定し、HealthResponse（Worker, Status, CurrentLoad, QueueDepth と、その上限の MaxConcurrent, QueueSize）をエンコードして返します.
+// ExpectedLatencyMs は response_delay_ms を基に、degraded なら 1.5 倍、unhealthy なら 2 倍した想定レイテンシで、LB のルーティングが参照します。
 func handleHealth(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -296,6 +2555,8 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 	queueRatio := float64(queueDepth) / float64(cfg.QueueSize)
 
 	switch {
+	case !startup.ready():
+		status = "starting"
 	case loadRatio >= 0.9 || queueRatio >= 0.9:
 		status = "unhealthy"
 	case loadRatio >= 0.7 || queueRatio >= 0.7:
@@ -304,18 +2565,95 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 		status = "healthy"
 	}
 
+	resp := HealthResponse{
+		Worker:               workerName,
+		Status:               status,
+		CurrentLoad:          load,
+		QueueDepth:           queueDepth,
+		SimulatedMemoryBytes: memory.retained(),
+		ExpectedLatencyMs:    expectedLatencyMs(cfg, status),
+		MaxConcurrent:        cfg.MaxConcurrentRequests,
+		QueueSize:            cfg.QueueSize,
+	}
+	if !startup.readyAt.IsZero() {
+		readyAt := startup.readyAt.UTC()
+		resp.StartedReadyAt = &readyAt
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if status == "starting" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleReady は起動遅延 (STARTUP_DELAY_MS) の経過後に 200、それまでと LB から drain/disable を受けている間は 503 を返す HTTP ハンドラです。
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !startup.ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"ready": false, "readyAt": startup.readyAt.UTC()})
+		return
+	}
+	if action, ok := control.shedding(); ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"ready": false, "reason": action})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"ready": true})
+}
+
+// handleControl は POST /control で LB からの制御アクション (drain/disable/enable) を受け取る HTTP ハンドラです。
+// drain と disable の間は /ready が 503 を返し新しいタスクを断り、enable で元に戻ります。seq が最後に適用したものより古い要求は無視します。
+func handleControl(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req controlRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid control body", http.StatusBadRequest)
+		return
+	}
+	switch req.Action {
+	case controlDrain, controlDisable, controlEnable:
+	default:
+		http.Error(w, fmt.Sprintf("Unknown control action %q", req.Action), http.StatusBadRequest)
+		return
+	}
+
+	applied := control.apply(req)
+	if applied {
+		fields := map[string]string{"seq": strconv.FormatUint(req.Seq, 10)}
+		if !req.Deadline.IsZero() {
+			fields["deadline"] = req.Deadline.UTC().Format(time.RFC3339Nano)
+		}
+		if req.Action == controlDrain {
+			fields["inflight"] = strconv.Itoa(int(atomic.LoadInt32(&activeRequests)))
+		}
+		logEvent(logInfo, fmt.Sprintf("Control: %s requested by the load balancer", req.Action), fields)
+	} else {
+		logEvent(logDebug, fmt.Sprintf("Control: ignoring stale %s", req.Action), map[string]string{"seq": strconv.FormatUint(req.Seq, 10)})
+	}
+	_, shedding := control.shedding()
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(HealthResponse{
-		Status:      status,
-		CurrentLoad: load,
-		QueueDepth:  queueDepth,
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"worker":  workerName,
+		"action":  req.Action,
+		"applied": applied,
+		"ready":   startup.ready() && !shedding,
 	})
 }
 
 // handleConfig はランタイム設定の取得と更新を行う HTTP ハンドラです。
 // GET リクエストでは現在の設定を JSON で返します。
-// PUT または POST リクエストではリクエストボディの JSON を Configuration としてデコードし、妥当であれば設定を反映して更新後の設定を JSON で返し、更新内容をログに記録します。
+// PUT または POST リクエストではリクエストボディの JSON を現在の設定に重ねる部分設定として扱い (含まれないフィールドは現在値のまま)、妥当な値を反映して更新後の設定を JSON で返し、更新内容をログに記録します。
 // ボディのデコードに失敗した場合は 400 Bad Request を返します。
+// task_schema が不正なスキーマの場合は反映せず {"error","field"} を 400 で返します。null または {} を指定するとスキーマ検証を無効にします。
+// dry_run=true を指定すると設定は反映せず、明示された値を厳密に検証します。無効な値があれば {"error","field"} を 400 で、なければ反映後に得られる設定を 200 で返します。
 // その他の HTTP メソッドに対しては 405 Method Not Allowed を返します。
 func handleConfig(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
@@ -323,18 +2661,220 @@ func handleConfig(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(config.Get())
 	case http.MethodPut, http.MethodPost:
-		var newConfig Configuration
-		if err := json.NewDecoder(r.Body).Decode(&newConfig); err != nil {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid config body", http.StatusBadRequest)
+			return
+		}
+		current := config.Get()
+		newConfig, err := decodeConfigPatch(current, body)
+		if err != nil {
+			http.Error(w, "Invalid config body", http.StatusBadRequest)
+			return
+		}
+		if newConfig.TaskSchema != nil {
+			if _, err := compileTaskSchema(newConfig.TaskSchema); err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "task_schema " + err.Error(), "field": "task_schema"})
+				return
+			}
+		}
+		if dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run")); dryRun {
+			w.Header().Set("Content-Type", "application/json")
+			if field, msg := checkConfig(&newConfig); field != "" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": field + " " + msg, "field": field})
+				return
+			}
+			json.NewEncoder(w).Encode(mergeConfig(current, &newConfig))
+			return
+		}
+		updated, err := config.Patch(body)
+		if err != nil {
 			http.Error(w, "Invalid config body", http.StatusBadRequest)
 			return
 		}
-		config.Update(&newConfig)
+		metrics.cpuSlotsLimit.WithLabelValues(workerName).Set(float64(updated.MaxCPUTasks))
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(config.Get())
-		log.Printf("Config updated: %+v\n", config.Get())
+		json.NewEncoder(w).Encode(updated)
+		logEvent(logInfo, fmt.Sprintf("Config updated: %+v", updated), nil)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSchema は GET /schema で現在のタスクスキーマを返す HTTP ハンドラです。
+// 簡易フィールド指定も同等の JSON Schema に展開して返し、スキーマ未設定時は enabled が false になります。
+func handleSchema(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	schema := config.Get().taskSchema
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"worker":  workerName,
+		"enabled": schema != nil,
+		"schema":  schema,
+	})
+}
+
+// handleLogs は GET /logs でログリングの直近エントリを返す HTTP ハンドラです。
+// limit (既定 100、リングサイズが上限) と level (debug/info/warn/error、指定レベル以上を返す) で絞り込み、log_redact_fields に含まれるフィールドの値は伏せて返します。
+// limit や level が不正な場合は 400 を返します。
+func handleLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	limit := defaultLogLimit
+	if raw := q.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	level := q.Get("level")
+	if level == "" {
+		level = logDebug
+	}
+	if _, ok := logSeverity[level]; !ok {
+		http.Error(w, "level must be one of debug, info, warn, error", http.StatusBadRequest)
+		return
+	}
+
+	entries, dropped := logs.tail(limit, level)
+	if entries == nil {
+		entries = []LogEntry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LogsResponse{
+		Worker:  workerName,
+		Entries: redactEntries(entries, config.Get().LogRedactFields),
+		Dropped: dropped,
+	})
+}
+
+// handleMemory は GET /memory でメモリ圧迫シミュレーションの保持バイト数 (タスク分・リーク分) と上限を返す HTTP ハンドラです。
+func handleMemory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(memory.status(config.Get()))
+}
+
+// handleMemoryRelease は POST /memory/release でリークしたメモリを即座に解放し、解放後の状態を返す HTTP ハンドラです。
+// 実行中タスクが保持しているメモリはタスク完了時に解放されるため対象外です。
+func handleMemoryRelease(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	freed := memory.releaseLeak()
+	logEvent(logInfo, "Leaked memory released", map[string]string{"bytes": strconv.FormatInt(freed, 10)})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(memory.status(config.Get()))
+}
+
+// handleAcquire は POST /acquire で共有リソースのトークンを貸し出すトークンサーバーの HTTP ハンドラです。
+// ボディは {"resource", "capacity", "timeout_ms", "lease_ms"} で、capacity 個までのトークンが同時に貸し出されます。
+// 空きがなければ timeout_ms (既定 5000) まで待ち、取得できなければ reason shared_resource_timeout 付きの 503 を返します。
+// トークンは lease_ms (既定 60000) 経過すると返却されたものとみなされます。resource がないか capacity が 1 未満の場合は 400 を返します。
+func handleAcquire(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req AcquireRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Resource == "" || req.Capacity < 1 || req.TimeoutMs < 0 || req.LeaseMs < 0 {
+		http.Error(w, "Invalid acquire body: resource and a positive capacity are required", http.StatusBadRequest)
+		return
+	}
+	if req.TimeoutMs == 0 {
+		req.TimeoutMs = defaultSharedTimeoutMs
+	}
+	if req.LeaseMs == 0 {
+		req.LeaseMs = sharedLeaseMs
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(req.TimeoutMs)*time.Millisecond)
+	defer cancel()
+	token, err := tokens.acquire(ctx, req.Resource, req.Capacity, time.Duration(req.LeaseMs)*time.Millisecond)
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case err == nil:
+	case err == errTooManyResources:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: fmt.Sprintf("At most %d shared resources are supported", maxSharedResources), Worker: workerName})
+		return
 	default:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(ErrorResponse{
+			Error:  fmt.Sprintf("Timed out waiting for shared resource %s", req.Resource),
+			Worker: workerName,
+			Reason: sharedResourceTimeout,
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(AcquireResponse{
+		Token:    token,
+		Resource: req.Resource,
+		WaitMs:   time.Since(start).Milliseconds(),
+		InUse:    tokens.inUse(req.Resource),
+		Capacity: req.Capacity,
+	})
+}
+
+// handleRelease は POST /release で {"resource", "token"} のトークンを返却するトークンサーバーの HTTP ハンドラです。
+// 返却できれば {"released": true} を、貸し出し中でない (返却済みやリース切れの) トークンには 404 を返します。
+func handleRelease(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req ReleaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Resource == "" || req.Token == "" {
+		http.Error(w, "Invalid release body: resource and token are required", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !tokens.release(req.Resource, req.Token) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Token not leased", Worker: workerName})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]bool{"released": true})
+}
+
+// handleCrash は POST /crash?mode=exit でレスポンスを返した後にプロセスを終了する HTTP ハンドラです。
+// ローリングリスタートなどで、プロセスマネージャーやオーケストレーターによる再起動を試すために使います。mode は現在 exit のみで、それ以外は 400 を返します。
+func handleCrash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if mode := r.URL.Query().Get("mode"); mode != "exit" {
+		http.Error(w, "Invalid mode: must be exit", http.StatusBadRequest)
+		return
+	}
+	logEvent(logWarn, "Crash requested: exiting", nil)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"status": "exiting", "worker": workerName})
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
 	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		exit(1)
+	}()
 }
 
 // 設定されるヘッダー: Access-Control-Allow-Origin="*", Access-Control-Allow-Methods="GET, POST, PUT, OPTIONS", Access-Control-Allow-Headers="Content-Type".
@@ -354,14 +2894,16 @@ func corsMiddleware(next http.Handler) http.Handler {
 }
 
 // main はワーカー用の HTTP サーバーを初期化して起動します。
-// 環境変数から構成とワーカー情報を読み込み、要求キューとメトリクスを初期化し、/task、/health、/config、/metrics のハンドラを登録して CORS を適用します。
+// 環境変数から構成とワーカー情報を読み込み、起動遅延を決定し、要求キューとメトリクスを初期化し、/task、/health、/ready、/config、/logs、/memory、/crash、/metrics のハンドラを登録して CORS を適用します。
 // 指定したポート（PORT 環境変数、未指定時は 8080）でリクエストを受け付け、SIGINT/SIGTERM 受信時にグレースフルシャットダウンを行います。
 func main() {
 	// Note: As of Go 1.20+, the global random is automatically seeded
 	// No need for explicit rand.Seed call
 
 	// Load configuration
-	config = loadConfig()
+	config = newConfiguration(loadConfig())
+	logs = newLogRing(getEnvInt("LOG_RING_SIZE", defaultLogRingSize))
+	metrics = newWorkerMetrics(prometheus.DefaultRegisterer, prometheus.DefaultGatherer)
 	workerName = os.Getenv("WORKER_NAME")
 	if workerName == "" {
 		workerName = "go-worker-1"
@@ -371,15 +2913,48 @@ func main() {
 		workerColor = "#3B82F6" // Blue
 	}
 
+	// Startup delay: the listener opens immediately but /health and /ready
+	// report "starting" (503) until the delay has elapsed
+	delay, err := parseStartupDelay(os.Getenv("STARTUP_DELAY_MS"))
+	if err != nil {
+		log.Fatalf("STARTUP_DELAY_MS: %v", err)
+	}
+	seed := int64(getEnvInt("STARTUP_SEED", 0))
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	jitter := time.Duration(getEnvInt("STARTUP_JITTER_MS", 0)) * time.Millisecond
+	d := delay.pick(rand.New(rand.NewSource(seed)), jitter)
+	startup = readiness{readyAt: now().Add(d)}
+	if d > 0 {
+		logEvent(logInfo, fmt.Sprintf("Startup delay %v: ready at %s", d, startup.readyAt.UTC().Format(time.RFC3339Nano)), nil)
+	}
+
 	// Initialize request queue
-	requestQueue = make(chan struct{}, config.QueueSize)
+	cfg := config.Get()
+	requestQueue = make(chan struct{}, cfg.QueueSize)
+	metrics.cpuSlotsLimit.WithLabelValues(workerName).Set(float64(cfg.MaxCPUTasks))
+
+	// Memory-pressure simulation leak
+	leakCtx, stopLeak := context.WithCancel(context.Background())
+	defer stopLeak()
+	go memory.runLeak(leakCtx)
 
 	// Setup HTTP routes
 	mux := http.NewServeMux()
 	mux.HandleFunc("/task", handleTask)
 	mux.HandleFunc("/health", handleHealth)
+	mux.HandleFunc("/ready", handleReady)
+	mux.HandleFunc("/control", handleControl)
 	mux.HandleFunc("/config", handleConfig)
-	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/schema", handleSchema)
+	mux.HandleFunc("/logs", handleLogs)
+	mux.HandleFunc("/memory", handleMemory)
+	mux.HandleFunc("/memory/release", handleMemoryRelease)
+	mux.HandleFunc("/acquire", handleAcquire)
+	mux.HandleFunc("/release", handleRelease)
+	mux.HandleFunc("/crash", handleCrash)
+	mux.Handle("/metrics", metrics.handler())
 
 	handler := corsMiddleware(mux)
 
@@ -405,8 +2980,8 @@ func main() {
 	}()
 
 	log.Printf("Starting %s on port %s (color: %s)\n", workerName, port, workerColor)
-	log.Printf("Config: max_concurrent=%d, delay=%dms, failure_rate=%.2f, queue_size=%d\n",
-		config.MaxConcurrentRequests, config.ResponseDelayMs, config.FailureRate, config.QueueSize)
+	log.Printf("Config: max_concurrent=%d, delay=%dms, failure_rate=%.2f, queue_size=%d, deadline_policy=%s, max_cpu_tasks=%d\n",
+		cfg.MaxConcurrentRequests, cfg.ResponseDelayMs, cfg.FailureRate, cfg.QueueSize, cfg.DeadlinePolicy, cfg.MaxCPUTasks)
 
 	if err := server.ListenAndServe(); err != http.ErrServerClosed {
 		log.Fatalf("Server error: %v", err)
@@ -2,13 +2,22 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -109,69 +118,69 @@ func TestGetEnvFloat(t *testing.T) {
 }
 
 func TestConfigurationUpdate(t *testing.T) {
-	cfg := &Configuration{
+	cfg := newConfiguration(Config{
 		MaxConcurrentRequests: 10,
 		ResponseDelayMs:       100,
 		FailureRate:           0.0,
 		QueueSize:             50,
-	}
+	})
 
-	newCfg := &Configuration{
+	newCfg := &Config{
 		MaxConcurrentRequests: 20,
 		ResponseDelayMs:       200,
 		FailureRate:           0.1,
 		QueueSize:             100,
 	}
 
-	cfg.Update(newCfg)
+	got := cfg.Update(newCfg)
 
-	if cfg.MaxConcurrentRequests != 20 {
-		t.Errorf("MaxConcurrentRequests = %d, want 20", cfg.MaxConcurrentRequests)
+	if got.MaxConcurrentRequests != 20 {
+		t.Errorf("MaxConcurrentRequests = %d, want 20", got.MaxConcurrentRequests)
 	}
-	if cfg.ResponseDelayMs != 200 {
-		t.Errorf("ResponseDelayMs = %d, want 200", cfg.ResponseDelayMs)
+	if got.ResponseDelayMs != 200 {
+		t.Errorf("ResponseDelayMs = %d, want 200", got.ResponseDelayMs)
 	}
-	if cfg.FailureRate != 0.1 {
-		t.Errorf("FailureRate = %f, want 0.1", cfg.FailureRate)
+	if got.FailureRate != 0.1 {
+		t.Errorf("FailureRate = %f, want 0.1", got.FailureRate)
 	}
-	if cfg.QueueSize != 100 {
-		t.Errorf("QueueSize = %d, want 100", cfg.QueueSize)
+	if got.QueueSize != 100 {
+		t.Errorf("QueueSize = %d, want 100", got.QueueSize)
 	}
 }
 
 func TestConfigurationUpdateInvalidValues(t *testing.T) {
-	cfg := &Configuration{
+	cfg := newConfiguration(Config{
 		MaxConcurrentRequests: 10,
 		ResponseDelayMs:       100,
 		FailureRate:           0.0,
 		QueueSize:             50,
-	}
+	})
 
-	newCfg := &Configuration{
+	newCfg := &Config{
 		MaxConcurrentRequests: -1,  // Invalid
 		ResponseDelayMs:       -50, // Should be rejected
 		FailureRate:           1.5, // Invalid (> 1)
 		QueueSize:             0,   // Invalid
 	}
 
-	cfg.Update(newCfg)
+	got := cfg.Update(newCfg)
 
 	// Original values should be preserved for invalid inputs
-	if cfg.MaxConcurrentRequests != 10 {
-		t.Errorf("MaxConcurrentRequests should remain 10, got %d", cfg.MaxConcurrentRequests)
+	if got.MaxConcurrentRequests != 10 {
+		t.Errorf("MaxConcurrentRequests should remain 10, got %d", got.MaxConcurrentRequests)
 	}
-	if cfg.QueueSize != 50 {
-		t.Errorf("QueueSize should remain 50, got %d", cfg.QueueSize)
+	if got.QueueSize != 50 {
+		t.Errorf("QueueSize should remain 50, got %d", got.QueueSize)
 	}
 }
 
 func TestConfigurationGet(t *testing.T) {
-	cfg := &Configuration{
+	cfg := newConfiguration(Config{
 		MaxConcurrentRequests: 15,
 		ResponseDelayMs:       120,
 		FailureRate:           0.05,
 		QueueSize:             60,
-	}
+	})
 
 	got := cfg.Get()
 
@@ -190,11 +199,24 @@ func TestConfigurationGet(t *testing.T) {
 }
 
 func setupTestEnvironment() {
-	config = loadConfig()
+	config = newConfiguration(loadConfig())
 	workerName = "test-worker"
 	workerColor = "#FF0000"
-	requestQueue = make(chan struct{}, config.QueueSize)
+	requestQueue = make(chan struct{}, config.Get().QueueSize)
 	atomic.StoreInt32(&activeRequests, 0)
+	sources = newSourceLimiter()
+	memory = newMemorySim()
+	tokens = newTokenServer()
+	control = &controlState{}
+	startup = readiness{}
+	now = time.Now
+}
+
+// setConfig replaces the global configuration with a modified copy
+func setConfig(modify func(c *Config)) {
+	cfg := config.Get()
+	modify(&cfg)
+	config.Store(cfg)
 }
 
 func TestHandleHealthGet(t *testing.T) {
@@ -217,6 +239,13 @@ func TestHandleHealthGet(t *testing.T) {
 	if response.Status == "" {
 		t.Error("status should not be empty")
 	}
+	if response.Worker != workerName {
+		t.Errorf("worker = %q, want %q", response.Worker, workerName)
+	}
+	cfg := config.Get()
+	if response.MaxConcurrent != cfg.MaxConcurrentRequests || response.QueueSize != cfg.QueueSize {
+		t.Errorf("limits = %d/%d, want %d/%d", response.MaxConcurrent, response.QueueSize, cfg.MaxConcurrentRequests, cfg.QueueSize)
+	}
 }
 
 func TestHandleHealthMethodNotAllowed(t *testing.T) {
@@ -234,20 +263,24 @@ func TestHandleHealthMethodNotAllowed(t *testing.T) {
 
 func TestHandleHealthStatus(t *testing.T) {
 	setupTestEnvironment()
-	config.MaxConcurrentRequests = 10
-	config.QueueSize = 50
+	setConfig(func(c *Config) {
+		c.MaxConcurrentRequests = 10
+		c.QueueSize = 50
+		c.ResponseDelayMs = 100
+	})
 
 	tests := []struct {
-		name           string
-		currentLoad    int32
-		queueDepth     int
-		expectedStatus string
+		name            string
+		currentLoad     int32
+		queueDepth      int
+		expectedStatus  string
+		expectedLatency int64
 	}{
-		{"healthy", 2, 5, "healthy"},
-		{"degraded load", 7, 5, "degraded"},
-		{"degraded queue", 2, 36, "degraded"},
-		{"unhealthy load", 9, 5, "unhealthy"},
-		{"unhealthy queue", 2, 46, "unhealthy"},
+		{"healthy", 2, 5, "healthy", 100},
+		{"degraded load", 7, 5, "degraded", 150},
+		{"degraded queue", 2, 36, "degraded", 150},
+		{"unhealthy load", 9, 5, "unhealthy", 200},
+		{"unhealthy queue", 2, 46, "unhealthy", 200},
 	}
 
 	for _, tt := range tests {
@@ -278,6 +311,9 @@ func TestHandleHealthStatus(t *testing.T) {
 			if response.CurrentLoad != tt.currentLoad {
 				t.Errorf("currentLoad = %d, want %d", response.CurrentLoad, tt.currentLoad)
 			}
+			if response.ExpectedLatencyMs != tt.expectedLatency {
+				t.Errorf("expectedLatencyMs = %d, want %d", response.ExpectedLatencyMs, tt.expectedLatency)
+			}
 
 			// Clean up queue
 			for len(requestQueue) > 0 {
@@ -289,9 +325,11 @@ func TestHandleHealthStatus(t *testing.T) {
 
 func TestHandleTaskPost(t *testing.T) {
 	setupTestEnvironment()
-	config.MaxConcurrentRequests = 10
-	config.ResponseDelayMs = 10
-	config.FailureRate = 0.0
+	setConfig(func(c *Config) {
+		c.MaxConcurrentRequests = 10
+		c.ResponseDelayMs = 10
+		c.FailureRate = 0.0
+	})
 
 	taskReq := TaskRequest{
 		ID:     "test-task-1",
@@ -363,7 +401,9 @@ func TestHandleTaskInvalidJSON(t *testing.T) {
 
 func TestHandleTaskQueueFull(t *testing.T) {
 	setupTestEnvironment()
-	config.QueueSize = 2
+	setConfig(func(c *Config) {
+		c.QueueSize = 2
+	})
 
 	// Fill the queue
 	requestQueue = make(chan struct{}, 2)
@@ -390,13 +430,21 @@ func TestHandleTaskQueueFull(t *testing.T) {
 	if !bytes.Contains([]byte(response.Error), []byte("Queue full")) {
 		t.Errorf("error should mention queue full, got: %s", response.Error)
 	}
+	if response.Reason != rejectQueueFull || w.Header().Get(rejectReasonHeader) != rejectQueueFull {
+		t.Errorf("reason = %q, header = %q, want %q", response.Reason, w.Header().Get(rejectReasonHeader), rejectQueueFull)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want 1", got)
+	}
 }
 
 func TestHandleTaskMaxConcurrentExceeded(t *testing.T) {
 	setupTestEnvironment()
-	config.MaxConcurrentRequests = 2
-	config.ResponseDelayMs = 100
-	config.QueueSize = 10
+	setConfig(func(c *Config) {
+		c.MaxConcurrentRequests = 2
+		c.ResponseDelayMs = 100
+		c.QueueSize = 10
+	})
 
 	var wg sync.WaitGroup
 
@@ -429,15 +477,22 @@ func TestHandleTaskMaxConcurrentExceeded(t *testing.T) {
 	if w.Code != http.StatusServiceUnavailable {
 		t.Errorf("status code = %d, want %d", w.Code, http.StatusServiceUnavailable)
 	}
+	var response ErrorResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	if response.Reason != rejectOverloaded || w.Header().Get(rejectReasonHeader) != rejectOverloaded {
+		t.Errorf("reason = %q, header = %q, want %q", response.Reason, w.Header().Get(rejectReasonHeader), rejectOverloaded)
+	}
 
 	wg.Wait()
 }
 
 func TestHandleTaskWithWeight(t *testing.T) {
 	setupTestEnvironment()
-	config.MaxConcurrentRequests = 10
-	config.ResponseDelayMs = 10
-	config.FailureRate = 0.0
+	setConfig(func(c *Config) {
+		c.MaxConcurrentRequests = 10
+		c.ResponseDelayMs = 10
+		c.FailureRate = 0.0
+	})
 
 	tests := []struct {
 		name   string
@@ -446,7 +501,7 @@ func TestHandleTaskWithWeight(t *testing.T) {
 		{"weight 1.0", 1.0},
 		{"weight 2.0", 2.0},
 		{"weight 0.5", 0.5},
-		{"weight 0", 0.0}, // Should default to 1
+		{"weight 0", 0.0},         // Should default to 1
 		{"weight negative", -1.0}, // Should default to 1
 	}
 
@@ -475,7 +530,7 @@ func TestHandleTaskWithWeight(t *testing.T) {
 			if expectedWeight <= 0 {
 				expectedWeight = 1
 			}
-			expectedDelay := time.Duration(float64(config.ResponseDelayMs)*expectedWeight) * time.Millisecond
+			expectedDelay := time.Duration(float64(config.Get().ResponseDelayMs)*expectedWeight) * time.Millisecond
 
 			if duration < expectedDelay/2 {
 				t.Errorf("duration %v too short, expected around %v", duration, expectedDelay)
@@ -486,9 +541,11 @@ func TestHandleTaskWithWeight(t *testing.T) {
 
 func TestHandleTaskSimulatedFailure(t *testing.T) {
 	setupTestEnvironment()
-	config.MaxConcurrentRequests = 10
-	config.ResponseDelayMs = 10
-	config.FailureRate = 1.0 // Always fail
+	setConfig(func(c *Config) {
+		c.MaxConcurrentRequests = 10
+		c.ResponseDelayMs = 10
+		c.FailureRate = 1.0 // Always fail
+	})
 
 	taskReq := TaskRequest{
 		ID:     "test-task",
@@ -528,13 +585,13 @@ func TestHandleConfigGet(t *testing.T) {
 		t.Errorf("status code = %d, want %d", w.Code, http.StatusOK)
 	}
 
-	var response Configuration
+	var response Config
 	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
 		t.Fatalf("failed to decode response: %v", err)
 	}
 
 	// Verify config values
-	if response.MaxConcurrentRequests != config.MaxConcurrentRequests {
+	if response.MaxConcurrentRequests != config.Get().MaxConcurrentRequests {
 		t.Errorf("MaxConcurrentRequests mismatch")
 	}
 }
@@ -542,7 +599,7 @@ func TestHandleConfigGet(t *testing.T) {
 func TestHandleConfigPut(t *testing.T) {
 	setupTestEnvironment()
 
-	newCfg := Configuration{
+	newCfg := Config{
 		MaxConcurrentRequests: 20,
 		ResponseDelayMs:       200,
 		FailureRate:           0.2,
@@ -572,7 +629,7 @@ func TestHandleConfigPut(t *testing.T) {
 func TestHandleConfigPost(t *testing.T) {
 	setupTestEnvironment()
 
-	newCfg := Configuration{
+	newCfg := Config{
 		MaxConcurrentRequests: 15,
 		ResponseDelayMs:       150,
 		FailureRate:           0.15,
@@ -591,6 +648,90 @@ func TestHandleConfigPost(t *testing.T) {
 	}
 }
 
+func TestHandleConfigDryRun(t *testing.T) {
+	setupTestEnvironment()
+	before := config.Get()
+
+	body, _ := json.Marshal(Config{MaxConcurrentRequests: 20, ResponseDelayMs: 200, FailureRate: 0.2})
+	req := httptest.NewRequest(http.MethodPut, "/config?dry_run=true", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	handleConfig(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status code = %d, want %d", w.Code, http.StatusOK)
+	}
+	var preview Config
+	json.NewDecoder(w.Body).Decode(&preview)
+	if preview.MaxConcurrentRequests != 20 || preview.QueueSize != before.QueueSize {
+		t.Errorf("preview = %+v, want max_concurrent_requests 20 over the current config", preview)
+	}
+	if cfg := config.Get(); cfg.MaxConcurrentRequests != before.MaxConcurrentRequests {
+		t.Errorf("dry run applied the config: MaxConcurrentRequests = %d", cfg.MaxConcurrentRequests)
+	}
+
+	// Values a real update would silently ignore are rejected
+	for _, raw := range []string{
+		`{"failure_rate": 1.5}`,
+		`{"deadline_policy": "later"}`,
+		`{"max_body_bytes": 10}`,
+		`{"tag_overrides": [{"value": "x"}]}`,
+	} {
+		req := httptest.NewRequest(http.MethodPut, "/config?dry_run=true", strings.NewReader(raw))
+		w := httptest.NewRecorder()
+		handleConfig(w, req)
+		var resp map[string]string
+		json.NewDecoder(w.Body).Decode(&resp)
+		if w.Code != http.StatusBadRequest || resp["field"] == "" {
+			t.Errorf("%s: %d %v, want 400 naming the field", raw, w.Code, resp)
+		}
+	}
+}
+
+// putConfig sends body to handleConfig at target and returns the config it
+// answers with
+func putConfig(t *testing.T, target, body string) Config {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handleConfig(w, httptest.NewRequest(http.MethodPut, target, strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s %s: status %d", target, body, w.Code)
+	}
+	var got Config
+	json.NewDecoder(w.Body).Decode(&got)
+	return got
+}
+
+func TestHandleConfigPartialPatch(t *testing.T) {
+	setupTestEnvironment()
+	config.Update(&Config{ResponseDelayMs: 250, FailureRate: 0.2, LogRedactFields: []string{"token"}})
+	before := config.Get()
+
+	unchanged := func(what string, got Config) {
+		t.Helper()
+		if got.ResponseDelayMs != 250 || got.MaxConcurrentRequests != before.MaxConcurrentRequests ||
+			got.QueueSize != before.QueueSize || !slices.Equal(got.LogRedactFields, []string{"token"}) {
+			t.Errorf("%s = %+v, want the fields the patch left out unchanged", what, got)
+		}
+	}
+
+	// The dry run previews the patch over the current config
+	preview := putConfig(t, "/config?dry_run=true", `{"failure_rate": 0.3}`)
+	if preview.FailureRate != 0.3 {
+		t.Errorf("preview failure_rate = %v, want 0.3", preview.FailureRate)
+	}
+	unchanged("preview", preview)
+
+	updated := putConfig(t, "/config", `{"failure_rate": 0.3}`)
+	unchanged("updated", updated)
+	if cfg := config.Get(); cfg.FailureRate != 0.3 {
+		t.Errorf("failure_rate = %v, want 0.3", cfg.FailureRate)
+	}
+
+	// A field set to its zero value is applied
+	if cfg := putConfig(t, "/config", `{"response_delay_ms": 0}`); cfg.ResponseDelayMs != 0 || cfg.FailureRate != 0.3 {
+		t.Errorf("after response_delay_ms 0: %+v", cfg)
+	}
+}
+
 func TestHandleConfigInvalidJSON(t *testing.T) {
 	setupTestEnvironment()
 
@@ -660,10 +801,12 @@ func TestCORSPreflightRequest(t *testing.T) {
 
 func TestConcurrentTaskHandling(t *testing.T) {
 	setupTestEnvironment()
-	config.MaxConcurrentRequests = 50
-	config.ResponseDelayMs = 10
-	config.FailureRate = 0.0
-	config.QueueSize = 100
+	setConfig(func(c *Config) {
+		c.MaxConcurrentRequests = 50
+		c.ResponseDelayMs = 10
+		c.FailureRate = 0.0
+		c.QueueSize = 100
+	})
 
 	var wg sync.WaitGroup
 	successCount := int32(0)
@@ -815,12 +958,12 @@ func TestActiveRequestsTracking(t *testing.T) {
 }
 
 func TestConfigurationConcurrentAccess(t *testing.T) {
-	cfg := &Configuration{
+	cfg := newConfiguration(Config{
 		MaxConcurrentRequests: 10,
 		ResponseDelayMs:       100,
 		FailureRate:           0.0,
 		QueueSize:             50,
-	}
+	})
 
 	var wg sync.WaitGroup
 
@@ -838,7 +981,7 @@ func TestConfigurationConcurrentAccess(t *testing.T) {
 		wg.Add(1)
 		go func(val int) {
 			defer wg.Done()
-			newCfg := &Configuration{
+			newCfg := &Config{
 				MaxConcurrentRequests: val,
 				ResponseDelayMs:       val * 10,
 				FailureRate:           0.0,
@@ -857,10 +1000,74 @@ func TestConfigurationConcurrentAccess(t *testing.T) {
 	}
 }
 
+func TestConfigurationSnapshotConsistency(t *testing.T) {
+	// Every field of a snapshot is derived from the same n, so a reader that
+	// sees fields from two different updates detects a mixed snapshot.
+	snapshot := func(n int) *Config {
+		return &Config{
+			MaxConcurrentRequests: n,
+			ResponseDelayMs:       n * 10,
+			FailureRate:           float64(n) / 1000,
+			QueueSize:             n * 5,
+			DeadlinePolicy:        []string{deadlinePolicyFail, deadlinePolicyShorten}[n%2],
+			MaxCPUTasks:           n * 2,
+		}
+	}
+	cfg := newConfiguration(*snapshot(1))
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(offset int) {
+			defer wg.Done()
+			for n := 1 + offset; n < 1000; n += 4 {
+				cfg.Update(snapshot(n))
+			}
+		}(i)
+	}
+
+	mixed := make(chan Config, 1)
+	var readers sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				got := cfg.Get()
+				if !reflect.DeepEqual(got, *snapshot(got.MaxConcurrentRequests)) {
+					select {
+					case mixed <- got:
+					default:
+					}
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+
+	select {
+	case got := <-mixed:
+		t.Fatalf("observed mixed snapshot: %+v", got)
+	default:
+	}
+}
+
 func TestZeroWeightHandling(t *testing.T) {
 	setupTestEnvironment()
-	config.ResponseDelayMs = 10
-	config.FailureRate = 0.0
+	setConfig(func(c *Config) {
+		c.ResponseDelayMs = 10
+		c.FailureRate = 0.0
+	})
 
 	taskReq := TaskRequest{
 		ID:     "test-task",
@@ -886,17 +1093,1482 @@ func TestZeroWeightHandling(t *testing.T) {
 }
 
 func TestPrometheusMetricsRegistration(t *testing.T) {
-	// This test verifies that metrics are properly initialized
-	// The init() function should register metrics without panic
+	// Metrics live in per-instance registries, so creating several sets in
+	// one process must not panic and each set is scraped independently
+	a, b := newIsolatedWorkerMetrics(), newIsolatedWorkerMetrics()
+	if a.requestsTotal == nil || a.requestDuration == nil || a.currentLoad == nil {
+		t.Fatal("metrics not initialized")
+	}
+	a.requestsTotal.WithLabelValues("worker-a", "success").Inc()
+	b.requestsTotal.WithLabelValues("worker-b", "success").Add(2)
+
+	scrape := func(m *workerMetrics) string {
+		rec := httptest.NewRecorder()
+		m.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		return rec.Body.String()
+	}
+	gotA, gotB := scrape(a), scrape(b)
+	if !strings.Contains(gotA, `worker_requests_total{status="success",worker="worker-a"} 1`) || strings.Contains(gotA, "worker-b") {
+		t.Errorf("metrics a:\n%s", gotA)
+	}
+	if !strings.Contains(gotB, `worker_requests_total{status="success",worker="worker-b"} 2`) || strings.Contains(gotB, "worker-a") {
+		t.Errorf("metrics b:\n%s", gotB)
+	}
+}
+
+func TestHandleTaskDeadlineBudget(t *testing.T) {
+	setupTestEnvironment()
+	setConfig(func(c *Config) {
+		c.ResponseDelayMs = 800
+		c.FailureRate = 0.0
+	})
+
+	t.Run("fail fast", func(t *testing.T) {
+		setConfig(func(c *Config) {
+			c.DeadlinePolicy = deadlinePolicyFail
+		})
+		req := httptest.NewRequest(http.MethodPost, "/task", bytes.NewBufferString(`{"id":"t1","weight":1}`))
+		req.Header.Set(deadlineHeader, "50")
+		w := httptest.NewRecorder()
+
+		start := time.Now()
+		handleTask(w, req)
+
+		if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+			t.Errorf("fast-fail took %v, should not sleep", elapsed)
+		}
+		if w.Code != http.StatusGatewayTimeout {
+			t.Errorf("status code = %d, want %d", w.Code, http.StatusGatewayTimeout)
+		}
+		var resp ErrorResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if resp.Reason != "deadline_exceeded" {
+			t.Errorf("reason = %q, want deadline_exceeded", resp.Reason)
+		}
+	})
+
+	t.Run("shorten", func(t *testing.T) {
+		setConfig(func(c *Config) {
+			c.DeadlinePolicy = deadlinePolicyShorten
+		})
+		req := httptest.NewRequest(http.MethodPost, "/task", bytes.NewBufferString(`{"id":"t2","weight":1}`))
+		req.Header.Set(deadlineHeader, "50")
+		w := httptest.NewRecorder()
+
+		handleTask(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("status code = %d, want %d", w.Code, http.StatusOK)
+		}
+		var resp TaskResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if resp.ProcessingTimeMs >= 800 {
+			t.Errorf("processingTimeMs = %d, want shortened below 800", resp.ProcessingTimeMs)
+		}
+	})
+
+	t.Run("budget sufficient", func(t *testing.T) {
+		setConfig(func(c *Config) {
+			c.ResponseDelayMs = 10
+			c.DeadlinePolicy = deadlinePolicyFail
+		})
+		req := httptest.NewRequest(http.MethodPost, "/task", bytes.NewBufferString(`{"id":"t3","weight":1}`))
+		req.Header.Set(deadlineHeader, "500")
+		w := httptest.NewRecorder()
+
+		handleTask(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("status code = %d, want %d", w.Code, http.StatusOK)
+		}
+	})
+}
+
+func TestCPUFairnessLimitsCPUTasks(t *testing.T) {
+	setupTestEnvironment()
+	setConfig(func(c *Config) {
+		c.MaxConcurrentRequests = 50
+		c.ResponseDelayMs = 100
+		c.FailureRate = 0
+		c.MaxCPUTasks = 1
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/task", handleTask)
+	mux.HandleFunc("/health", handleHealth)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	const tasks = 5
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < tasks; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"id":"cpu-%d","weight":1,"mode":"cpu"}`, i)
+			resp, err := http.Post(srv.URL+"/task", "application/json", bytes.NewBufferString(body))
+			if err != nil {
+				t.Errorf("task %d: %v", i, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("task %d status = %d", i, resp.StatusCode)
+			}
+		}(i)
+	}
+	done := make(chan struct{})
+	go func() { wg.Wait(); close(done) }()
+
+	var peak int
+	var worstHealth time.Duration
+	for probing := true; probing; {
+		select {
+		case <-done:
+			probing = false
+		default:
+		}
+		if n := cpuSlots.inUse(); n > peak {
+			peak = n
+		}
+		t0 := time.Now()
+		resp, err := http.Get(srv.URL + "/health")
+		if err != nil {
+			t.Fatalf("health: %v", err)
+		}
+		resp.Body.Close()
+		if d := time.Since(t0); d > worstHealth {
+			worstHealth = d
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if peak > 1 {
+		t.Errorf("peak cpu tasks = %d, want at most 1", peak)
+	}
+	if elapsed := time.Since(start); elapsed < tasks*100*time.Millisecond {
+		t.Errorf("elapsed = %v, want cpu tasks serialized (>= %v)", elapsed, tasks*100*time.Millisecond)
+	}
+	if worstHealth >= 100*time.Millisecond {
+		t.Errorf("worst health latency = %v, want below one cpu task", worstHealth)
+	}
+}
+
+func TestCPULimiterFIFOAndCancel(t *testing.T) {
+	var l cpuLimiter
+	if err := l.acquire(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error)
+	go func() { cancelled <- l.acquire(ctx, 1) }()
+	waitForWaiters(t, &l, 1)
+
+	order := make(chan int, 2)
+	for i := 1; i <= 2; i++ {
+		go func(i int) {
+			l.acquire(context.Background(), 1)
+			order <- i
+			l.release(1)
+		}(i)
+		waitForWaiters(t, &l, i+1)
+	}
+
+	cancel()
+	if err := <-cancelled; err == nil {
+		t.Fatal("cancelled waiter should return an error")
+	}
+	l.release(1)
+	if first, second := <-order, <-order; first != 1 || second != 2 {
+		t.Errorf("grant order = %d, %d, want 1, 2", first, second)
+	}
+	if n := l.inUse(); n != 0 {
+		t.Errorf("inUse = %d, want 0", n)
+	}
+}
+
+func waitForWaiters(t *testing.T, l *cpuLimiter, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		l.mu.Lock()
+		got := len(l.waiters)
+		l.mu.Unlock()
+		if got >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("waiters = %d, want %d", got, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
 
-	// If we reach here, metrics were registered successfully
-	if requestsTotal == nil {
-		t.Error("requestsTotal metric not initialized")
+func TestHandleTaskInvalidMode(t *testing.T) {
+	setupTestEnvironment()
+	req := httptest.NewRequest(http.MethodPost, "/task", bytes.NewBufferString(`{"id":"t","mode":"gpu"}`))
+	w := httptest.NewRecorder()
+
+	handleTask(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status code = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestHandleTaskBodyLimits(t *testing.T) {
+	tests := []struct {
+		name       string
+		strict     bool
+		body       string
+		wantCode   int
+		wantReason string
+	}{
+		{"oversized", false, `{"id":"t","pad":"` + strings.Repeat("x", 2048) + `"}`, http.StatusRequestEntityTooLarge, "body_too_large"},
+		{"too deep", false, `{"id":"t","pad":` + strings.Repeat("[", 10) + strings.Repeat("]", 10) + `}`, http.StatusBadRequest, "json_too_deep"},
+		{"unknown field strict", true, `{"id":"t","bogus":1}`, http.StatusBadRequest, "unknown_field"},
+		{"unknown field lenient", false, `{"id":"t","bogus":1}`, http.StatusOK, ""},
+		{"malformed", true, `{"id":`, http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestEnvironment()
+			setConfig(func(c *Config) {
+				c.ResponseDelayMs = 1
+				c.FailureRate = 0
+				c.MaxBodyBytes = 1024
+				c.MaxJSONDepth = 5
+				c.StrictDecode = tt.strict
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/task", bytes.NewBufferString(tt.body))
+			w := httptest.NewRecorder()
+			handleTask(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status code = %d, want %d (%s)", w.Code, tt.wantCode, w.Body.String())
+			}
+			if tt.wantCode == http.StatusOK {
+				return
+			}
+			var resp ErrorResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if resp.Reason != tt.wantReason || resp.Error == "" {
+				t.Errorf("response = %+v, want reason %q", resp, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestHandleTaskClampsAbsurdWeight(t *testing.T) {
+	setupTestEnvironment()
+	setConfig(func(c *Config) {
+		c.ResponseDelayMs = 1
+		c.FailureRate = 0
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/task", bytes.NewBufferString(`{"id":"t","weight":1e9}`))
+	w := httptest.NewRecorder()
+	start := time.Now()
+	handleTask(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status code = %d, want %d", w.Code, http.StatusOK)
+	}
+	// 1ms x maxTaskWeight, not 1ms x 1e9
+	if elapsed := time.Since(start); elapsed > time.Duration(maxTaskWeight)*time.Millisecond+time.Second {
+		t.Errorf("took %v, weight was not clamped", elapsed)
+	}
+}
+
+func TestConfigurationUpdateBodyLimits(t *testing.T) {
+	cfg := newConfiguration(loadConfig())
+
+	got := cfg.Update(&Config{MaxBodyBytes: 4096, MaxJSONDepth: 8, StrictDecode: true})
+	if got.MaxBodyBytes != 4096 || got.MaxJSONDepth != 8 || !got.StrictDecode {
+		t.Errorf("config = %+v, want limits applied", got)
+	}
+
+	got = cfg.Update(&Config{MaxBodyBytes: 10, MaxJSONDepth: maxMaxJSONDepth + 1})
+	if got.MaxBodyBytes != 4096 || got.MaxJSONDepth != 8 {
+		t.Errorf("out-of-range limits should be ignored, got %+v", got)
+	}
+}
+
+func TestStrictDecodeSurvivesPartialUpdate(t *testing.T) {
+	setupTestEnvironment()
+	putConfig(t, "/config", `{"strict_decode": true}`)
+	if cfg := putConfig(t, "/config", `{"failure_rate": 0.1}`); !cfg.StrictDecode || cfg.FailureRate != 0.1 {
+		t.Errorf("after an unrelated update: %+v, want strict_decode still on", cfg)
+	}
+	if cfg := putConfig(t, "/config", `{"strict_decode": false}`); cfg.StrictDecode {
+		t.Error("strict_decode false was not applied")
+	}
+}
+
+func TestTaskSchema(t *testing.T) {
+	setupTestEnvironment()
+	setConfig(func(c *Config) {
+		c.ResponseDelayMs = 1
+		c.FailureRate = 0
+	})
+
+	// An invalid schema is refused at config time
+	for _, body := range []string{
+		`{"task_schema":{"type":"strin"}}`,
+		`{"task_schema":{"type":"string","pattern":"("}}`,
+		`{"task_schema":{"minimum":5,"maximum":1}}`,
+		`{"task_schema":{"type":"object","oneOf":[]}}`,
+		`{"task_schema":{"fields":{"id":"text"}}}`,
+	} {
+		w := httptest.NewRecorder()
+		handleConfig(w, httptest.NewRequest(http.MethodPut, "/config", bytes.NewBufferString(body)))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"field":"task_schema"`) {
+			t.Errorf("%s: status %d %s, want 400 naming task_schema", body, w.Code, w.Body.String())
+		}
+	}
+	if config.Get().taskSchema != nil {
+		t.Fatal("task schema enabled by default")
+	}
+
+	w := httptest.NewRecorder()
+	handleConfig(w, httptest.NewRequest(http.MethodPut, "/config", bytes.NewBufferString(
+		`{"task_schema":{"type":"object","required":["id"],"properties":{"id":{"type":"string","pattern":"^t-"},"weight":{"type":"integer","minimum":1,"maximum":10}}}}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("config status = %d: %s", w.Code, w.Body.String())
+	}
+
+	send := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleTask(w, httptest.NewRequest(http.MethodPost, "/task", bytes.NewBufferString(body)))
+		return w
+	}
+	if w := send(`{"id":"t-1","weight":3}`); w.Code != http.StatusOK {
+		t.Errorf("conforming task status = %d: %s", w.Code, w.Body.String())
+	}
+
+	rejected := metrics.requestsTotal.WithLabelValues(workerName, schemaViolation)
+	before := testutil.ToFloat64(rejected)
+	w = send(`{"id":"x-1","weight":2.5}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("violating task status = %d, want 422", w.Code)
+	}
+	var resp ErrorResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	want := []string{`/id: must match ^t-`, `/weight: must be integer`}
+	if resp.Reason != schemaViolation || !reflect.DeepEqual(resp.Violations, want) {
+		t.Errorf("response = %+v, want violations %q", resp, want)
 	}
-	if requestDuration == nil {
-		t.Error("requestDuration metric not initialized")
+	if got := testutil.ToFloat64(rejected) - before; got != 1 {
+		t.Errorf("%s requests = %v, want 1", schemaViolation, got)
 	}
-	if currentLoad == nil {
-		t.Error("currentLoad metric not initialized")
+	if w := send(`{"weight":1}`); w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), `missing required field \"id\"`) {
+		t.Errorf("missing id: %d %s", w.Code, w.Body.String())
 	}
-}
\ No newline at end of file
+
+	// An empty schema turns validation off again
+	config.Update(&Config{TaskSchema: json.RawMessage(`{}`)})
+	if w := send(`{"id":"x-1","weight":2.5}`); w.Code != http.StatusOK {
+		t.Errorf("status after clearing the schema = %d", w.Code)
+	}
+}
+
+func TestTaskSchemaFieldSpec(t *testing.T) {
+	setupTestEnvironment()
+	config.Update(&Config{TaskSchema: json.RawMessage(`{"fields":{"id":"string","weight":"number?"}}`)})
+
+	w := httptest.NewRecorder()
+	handleSchema(w, httptest.NewRequest(http.MethodGet, "/schema", nil))
+	var got struct {
+		Enabled bool
+		Schema  taskSchema
+	}
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Enabled || got.Schema.Type != "object" || !reflect.DeepEqual(got.Schema.Required, []string{"id"}) ||
+		got.Schema.Properties["weight"].Type != "number" {
+		t.Errorf("schema = %+v, want the fields as an object schema", got)
+	}
+
+	schema := config.Get().taskSchema
+	if v := schema.validate(map[string]interface{}{"id": "t"}); len(v) != 0 {
+		t.Errorf("optional weight: violations %v", v)
+	}
+	if v := schema.validate(map[string]interface{}{"id": 1.0, "weight": "heavy"}); len(v) != 2 {
+		t.Errorf("violations = %v, want 2", v)
+	}
+}
+
+func TestParseStartupDelay(t *testing.T) {
+	tests := []struct {
+		raw      string
+		min, max time.Duration
+		wantErr  bool
+	}{
+		{"", 0, 0, false},
+		{"1500", 1500 * time.Millisecond, 1500 * time.Millisecond, false},
+		{"uniform(500, 3000)", 500 * time.Millisecond, 3000 * time.Millisecond, false},
+		{"uniform(3000,500)", 0, 0, true},
+		{"uniform(1)", 0, 0, true},
+		{"-5", 0, 0, true},
+		{"soon", 0, 0, true},
+	}
+	for _, tt := range tests {
+		d, err := parseStartupDelay(tt.raw)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseStartupDelay(%q) err = %v, wantErr %v", tt.raw, err, tt.wantErr)
+			continue
+		}
+		if d.min != tt.min || d.max != tt.max {
+			t.Errorf("parseStartupDelay(%q) = %v..%v, want %v..%v", tt.raw, d.min, d.max, tt.min, tt.max)
+		}
+	}
+}
+
+func TestStartupDelayWindow(t *testing.T) {
+	d, _ := parseStartupDelay("uniform(500,3000)")
+	rng := rand.New(rand.NewSource(1))
+	jitter := 200 * time.Millisecond
+	var lo, hi time.Duration = time.Hour, 0
+	for i := 0; i < 2000; i++ {
+		got := d.pick(rng, jitter)
+		if got < 500*time.Millisecond || got >= 3200*time.Millisecond {
+			t.Fatalf("pick = %v, outside [500ms, 3.2s)", got)
+		}
+		if got < lo {
+			lo = got
+		}
+		if got > hi {
+			hi = got
+		}
+	}
+	// The whole window is used, not just one end
+	if lo > time.Second || hi < 2500*time.Millisecond {
+		t.Errorf("picks span %v..%v, want most of the window", lo, hi)
+	}
+
+	fixed, _ := parseStartupDelay("1500")
+	if got := fixed.pick(rng, 0); got != 1500*time.Millisecond {
+		t.Errorf("fixed pick = %v, want 1.5s", got)
+	}
+}
+
+func TestReadinessFlipsAfterStartupDelay(t *testing.T) {
+	setupTestEnvironment()
+	defer setupTestEnvironment()
+	clock := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+	startup = readiness{readyAt: clock.Add(2 * time.Second)}
+
+	check := func(wantCode int, wantStatus string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handleHealth(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+		var resp HealthResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		if w.Code != wantCode || resp.Status != wantStatus {
+			t.Errorf("health = %d %q, want %d %q", w.Code, resp.Status, wantCode, wantStatus)
+		}
+		if resp.StartedReadyAt == nil || !resp.StartedReadyAt.Equal(startup.readyAt) {
+			t.Errorf("startedReadyAt = %v, want %v", resp.StartedReadyAt, startup.readyAt)
+		}
+		w = httptest.NewRecorder()
+		handleReady(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		if w.Code != wantCode {
+			t.Errorf("ready = %d, want %d", w.Code, wantCode)
+		}
+	}
+
+	check(http.StatusServiceUnavailable, "starting")
+	clock = clock.Add(1999 * time.Millisecond)
+	check(http.StatusServiceUnavailable, "starting")
+	clock = clock.Add(time.Millisecond)
+	check(http.StatusOK, "healthy")
+}
+
+func TestControlActions(t *testing.T) {
+	setupTestEnvironment()
+	setConfig(func(c *Config) {
+		c.ResponseDelayMs = 1
+		c.FailureRate = 0
+	})
+
+	sendControl := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleControl(w, httptest.NewRequest(http.MethodPost, "/control", bytes.NewBufferString(body)))
+		return w
+	}
+	ready := func() int {
+		w := httptest.NewRecorder()
+		handleReady(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		return w.Code
+	}
+	task := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleTask(w, httptest.NewRequest(http.MethodPost, "/task", bytes.NewBufferString(`{"id":"t"}`)))
+		return w
+	}
+
+	if w := sendControl(`{"action":"drain","deadline":"2026-01-01T00:00:30Z","seq":2}`); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"applied":true`) {
+		t.Fatalf("drain: %d %s", w.Code, w.Body.String())
+	}
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("ready while draining = %d, want 503", code)
+	}
+	w := task()
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get(rejectReasonHeader) != rejectDraining {
+		t.Errorf("task while draining = %d %q, want 503 %s", w.Code, w.Header().Get(rejectReasonHeader), rejectDraining)
+	}
+
+	// A late request from before the drain changes nothing
+	if w := sendControl(`{"action":"enable","seq":1}`); !strings.Contains(w.Body.String(), `"applied":false`) {
+		t.Errorf("stale enable: %s", w.Body.String())
+	}
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("ready after a stale enable = %d, want 503", code)
+	}
+
+	sendControl(`{"action":"disable","seq":3}`)
+	sendControl(`{"action":"enable","seq":4}`)
+	if code := ready(); code != http.StatusOK {
+		t.Errorf("ready after enable = %d, want 200", code)
+	}
+	if w := task(); w.Code != http.StatusOK {
+		t.Errorf("task after enable = %d, want 200", w.Code)
+	}
+
+	if w := sendControl(`{"action":"pause"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown action = %d, want 400", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handleControl(w, httptest.NewRequest(http.MethodGet, "/control", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET = %d, want 405", w.Code)
+	}
+}
+
+func TestPerSourceLimitSurvivesPartialUpdate(t *testing.T) {
+	setupTestEnvironment()
+	putConfig(t, "/config", `{"per_source_max_concurrent": 2}`)
+	if cfg := putConfig(t, "/config", `{"response_delay_ms": 5}`); cfg.PerSourceMaxConcurrent != 2 {
+		t.Errorf("per_source_max_concurrent = %d after an unrelated update, want 2", cfg.PerSourceMaxConcurrent)
+	}
+	if cfg := putConfig(t, "/config", `{"per_source_max_concurrent": 0}`); cfg.PerSourceMaxConcurrent != 0 {
+		t.Errorf("per_source_max_concurrent = %d, want 0 turning the cap off", cfg.PerSourceMaxConcurrent)
+	}
+}
+
+func TestPerSourceLimitIsolatesTenants(t *testing.T) {
+	setupTestEnvironment()
+	metrics = newIsolatedWorkerMetrics()
+	setConfig(func(c *Config) {
+		c.MaxConcurrentRequests = 10
+		c.ResponseDelayMs = 200
+		c.FailureRate = 0
+		c.PerSourceMaxConcurrent = 2
+	})
+
+	send := func(tenant string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/task", bytes.NewBufferString(`{"id":"t","weight":1}`))
+		req.Header.Set("X-Tenant", tenant)
+		w := httptest.NewRecorder()
+		handleTask(w, req)
+		return w
+	}
+
+	// Tenant a bursts 6 tasks while tenant b sends 2 at the same time
+	var mu sync.Mutex
+	codes := map[string][]int{}
+	var wg sync.WaitGroup
+	for _, tenant := range []string{"a", "a", "a", "a", "a", "a", "b", "b"} {
+		wg.Add(1)
+		go func(tenant string) {
+			defer wg.Done()
+			w := send(tenant)
+			if w.Code == http.StatusTooManyRequests {
+				var resp ErrorResponse
+				json.NewDecoder(w.Body).Decode(&resp)
+				if resp.Reason != rejectPerSourceLimit || w.Header().Get(rejectReasonHeader) != rejectPerSourceLimit {
+					t.Errorf("reason = %q, header = %q, want %q", resp.Reason, w.Header().Get(rejectReasonHeader), rejectPerSourceLimit)
+				}
+			}
+			mu.Lock()
+			codes[tenant] = append(codes[tenant], w.Code)
+			mu.Unlock()
+		}(tenant)
+	}
+	wg.Wait()
+
+	count := func(tenant string, code int) int {
+		n := 0
+		for _, c := range codes[tenant] {
+			if c == code {
+				n++
+			}
+		}
+		return n
+	}
+	if ok, limited := count("a", http.StatusOK), count("a", http.StatusTooManyRequests); ok != 2 || limited != 4 {
+		t.Errorf("tenant a: %d ok, %d limited; want 2 and 4", ok, limited)
+	}
+	if ok := count("b", http.StatusOK); ok != 2 {
+		t.Errorf("tenant b: %d ok, want 2 (codes %v)", ok, codes["b"])
+	}
+	if got := testutil.ToFloat64(metrics.rejections.WithLabelValues(workerName, rejectPerSourceLimit)); got != 4 {
+		t.Errorf("per_source_limit rejections = %v, want 4", got)
+	}
+	if got := testutil.ToFloat64(metrics.trackedSources.WithLabelValues(workerName)); got != 2 {
+		t.Errorf("tracked sources = %v, want 2", got)
+	}
+
+	// The slots are freed once the tasks finish
+	if w := send("a"); w.Code != http.StatusOK {
+		t.Errorf("tenant a after the burst: status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestSourceKey(t *testing.T) {
+	tests := []struct {
+		tenant, forwarded, remote string
+		want                      string
+	}{
+		{"acme", "10.0.0.1", "192.0.2.1:1234", "tenant:acme"},
+		{"", "10.0.0.1, 10.0.0.2", "192.0.2.1:1234", "addr:10.0.0.1"},
+		{"", "", "192.0.2.1:1234", "addr:192.0.2.1"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/task", nil)
+		req.RemoteAddr = tt.remote
+		if tt.tenant != "" {
+			req.Header.Set(tenantHeader, tt.tenant)
+		}
+		if tt.forwarded != "" {
+			req.Header.Set(forwardedForHeader, tt.forwarded)
+		}
+		if got := sourceKey(req); got != tt.want {
+			t.Errorf("sourceKey(%+v) = %q, want %q", tt, got, tt.want)
+		}
+	}
+}
+
+func TestSourceLimiterBoundedAndEvictsIdle(t *testing.T) {
+	setupTestEnvironment()
+	defer setupTestEnvironment()
+	clock := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+
+	l := newSourceLimiter()
+	busy, _ := l.acquire("busy", 1)
+	for i := 1; i < maxTrackedSources; i++ {
+		key, _ := l.acquire(fmt.Sprintf("s%d", i), 1)
+		l.release(key)
+	}
+	if n := l.tracked(); n != maxTrackedSources {
+		t.Fatalf("tracked = %d, want %d", n, maxTrackedSources)
+	}
+
+	// With the map full and nothing idle long enough, new sources share the
+	// overflow entry
+	if key, ok := l.acquire("late", 1); key != overflowSource || !ok {
+		t.Errorf("acquire when full = %q %v, want %q", key, ok, overflowSource)
+	}
+	if _, ok := l.acquire("later", 1); ok {
+		t.Error("the overflow entry should be limited like any other source")
+	}
+	l.release(overflowSource)
+
+	// Idle sources are evicted; busy ones are kept
+	clock = clock.Add(sourceIdleTTL)
+	if n := l.tracked(); n != 1 {
+		t.Errorf("tracked after idle eviction = %d, want 1", n)
+	}
+	if _, ok := l.acquire(busy, 1); ok {
+		t.Error("a busy source must keep its in-flight count")
+	}
+}
+
+func TestLogRingRollover(t *testing.T) {
+	l := newLogRing(3)
+	for i := 1; i <= 5; i++ {
+		l.add(LogEntry{Level: logInfo, Message: fmt.Sprintf("m%d", i)})
+	}
+	entries, dropped := l.tail(10, logDebug)
+	if len(entries) != 3 || entries[0].Message != "m3" || entries[2].Message != "m5" {
+		t.Errorf("entries = %+v, want m3..m5 oldest first", entries)
+	}
+	if dropped != 2 {
+		t.Errorf("dropped = %d, want 2", dropped)
+	}
+	if entries, _ := l.tail(2, logDebug); len(entries) != 2 || entries[0].Message != "m4" {
+		t.Errorf("limited entries = %+v, want the newest two", entries)
+	}
+}
+
+func TestLogRingLevelFilter(t *testing.T) {
+	l := newLogRing(10)
+	for _, level := range []string{logDebug, logWarn, logInfo, logError, logWarn} {
+		l.add(LogEntry{Level: level, Message: level})
+	}
+	tests := map[string]int{logDebug: 5, logInfo: 4, logWarn: 3, logError: 1}
+	for level, want := range tests {
+		entries, _ := l.tail(10, level)
+		if len(entries) != want {
+			t.Errorf("level %s: %d entries, want %d", level, len(entries), want)
+		}
+		for _, e := range entries {
+			if logSeverity[e.Level] < logSeverity[level] {
+				t.Errorf("level %s returned a %s entry", level, e.Level)
+			}
+		}
+	}
+}
+
+func TestHandleLogs(t *testing.T) {
+	setupTestEnvironment()
+	logs = newLogRing(defaultLogRingSize)
+	defer func() { logs = newLogRing(defaultLogRingSize) }()
+	setConfig(func(c *Config) { c.LogRedactFields = []string{"source"} })
+
+	logEvent(logInfo, "started", nil)
+	logEvent(logWarn, "rejected", map[string]string{"source": "tenant:acme", "task": "t1"})
+
+	get := func(query string) (*httptest.ResponseRecorder, LogsResponse) {
+		w := httptest.NewRecorder()
+		handleLogs(w, httptest.NewRequest(http.MethodGet, "/logs"+query, nil))
+		var resp LogsResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w, resp
+	}
+
+	w, resp := get("?limit=200&level=warn")
+	if w.Code != http.StatusOK || len(resp.Entries) != 1 || resp.Worker != workerName {
+		t.Fatalf("logs = %d %+v, want the warn entry", w.Code, resp)
+	}
+	if f := resp.Entries[0].Fields; f["source"] != redactedValue || f["task"] != "t1" {
+		t.Errorf("fields = %v, want source redacted and task kept", f)
+	}
+	if entries, _ := logs.tail(1, logWarn); entries[0].Fields["source"] != "tenant:acme" {
+		t.Error("redaction must not modify the stored entry")
+	}
+	if _, resp := get(""); len(resp.Entries) != 2 {
+		t.Errorf("entries = %d, want 2", len(resp.Entries))
+	}
+
+	for _, query := range []string{"?limit=0", "?limit=x", "?level=verbose"} {
+		if w, _ := get(query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status code = %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestTaskResponseDefaultFormatUnchanged(t *testing.T) {
+	at := time.Date(2026, 3, 4, 5, 6, 7, 890123456, time.UTC)
+	resp := TaskResponse{ID: "t<1>", Worker: "w", Color: "#FF0000", ProcessingTimeMs: 42, Timestamp: at.Format(time.RFC3339Nano)}
+
+	var want bytes.Buffer
+	json.NewEncoder(&want).Encode(resp)
+	for _, cfg := range []Config{{}, {TimestampFormat: timestampRFC3339, ResponseFieldStyle: fieldStyleCamel}} {
+		got, err := marshalTaskResponse(resp, at, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(append(got, '\n')) != want.String() {
+			t.Errorf("%+v: got %s, want %s", cfg, got, want.String())
+		}
+	}
+}
+
+func TestTaskResponseFormats(t *testing.T) {
+	at := time.Date(2026, 3, 4, 5, 6, 7, 890123456, time.UTC)
+	resp := TaskResponse{ID: "t1", Worker: "w", Color: "#FF0000", ProcessingTimeMs: 42}
+
+	for _, style := range []string{fieldStyleCamel, fieldStyleSnake} {
+		for _, format := range []string{timestampRFC3339, timestampUnix, timestampUnixMillis} {
+			data, err := marshalTaskResponse(resp, at, Config{TimestampFormat: format, ResponseFieldStyle: style})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded map[string]interface{}
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				t.Fatalf("%s/%s: %v", style, format, err)
+			}
+
+			key := "processingTimeMs"
+			if style == fieldStyleSnake {
+				key = "processing_time_ms"
+			}
+			if decoded[key] != 42.0 || decoded["id"] != "t1" || decoded["worker"] != "w" || len(decoded) != 5 {
+				t.Errorf("%s/%s: %s", style, format, data)
+			}
+
+			var ts time.Time
+			switch v := decoded["timestamp"].(type) {
+			case string:
+				ts, err = time.Parse(time.RFC3339Nano, v)
+			case float64:
+				if format == timestampUnix {
+					ts = time.Unix(int64(v), 0)
+				} else {
+					ts = time.UnixMilli(int64(v))
+				}
+			}
+			want := map[string]time.Time{
+				timestampRFC3339:    at,
+				timestampUnix:       at.Truncate(time.Second),
+				timestampUnixMillis: at.Truncate(time.Millisecond),
+			}[format]
+			if err != nil || !ts.Equal(want) {
+				t.Errorf("%s/%s: timestamp %v round-trips to %v, want %v", style, format, decoded["timestamp"], ts, want)
+			}
+		}
+	}
+}
+
+func TestHandleTaskResponseFormat(t *testing.T) {
+	setupTestEnvironment()
+	setConfig(func(c *Config) {
+		c.ResponseDelayMs = 0
+		c.FailureRate = 0
+	})
+
+	w := httptest.NewRecorder()
+	handleConfig(w, httptest.NewRequest(http.MethodPut, "/config", bytes.NewBufferString(`{"timestamp_format":"unix_ms","response_field_style":"snake"}`)))
+	var cfg Config
+	json.NewDecoder(w.Body).Decode(&cfg)
+	if cfg.TimestampFormat != timestampUnixMillis || cfg.ResponseFieldStyle != fieldStyleSnake {
+		t.Fatalf("config = %+v, want the new formats", cfg)
+	}
+
+	w = httptest.NewRecorder()
+	handleTask(w, httptest.NewRequest(http.MethodPost, "/task", bytes.NewBufferString(`{"id":"t1"}`)))
+	if w.Header().Get(fieldStyleHeader) != fieldStyleSnake || w.Header().Get(timestampFormatHeader) != timestampUnixMillis {
+		t.Errorf("headers = %v, want the active formats", w.Header())
+	}
+	var body map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&body)
+	if _, ok := body["processing_time_ms"]; !ok {
+		t.Errorf("body = %v, want snake_case fields", body)
+	}
+	if _, ok := body["timestamp"].(float64); !ok {
+		t.Errorf("timestamp = %v, want unix milliseconds", body["timestamp"])
+	}
+
+	// Invalid values are ignored
+	w = httptest.NewRecorder()
+	handleConfig(w, httptest.NewRequest(http.MethodPut, "/config", bytes.NewBufferString(`{"timestamp_format":"iso","response_field_style":"kebab"}`)))
+	if got := config.Get(); got.TimestampFormat != timestampUnixMillis || got.ResponseFieldStyle != fieldStyleSnake {
+		t.Errorf("config = %+v, want invalid formats ignored", got)
+	}
+}
+
+func TestMemorySimTaskAccounting(t *testing.T) {
+	setupTestEnvironment()
+	metrics = newIsolatedWorkerMetrics()
+	const mib = 1 << 20
+	setConfig(func(c *Config) {
+		c.MaxConcurrentRequests = 10
+		c.ResponseDelayMs = 200
+		c.FailureRate = 0
+		c.MemoryPerTaskBytes = mib
+		c.MemoryCeilingBytes = 2*mib + mib/2
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			handleTask(w, httptest.NewRequest(http.MethodPost, "/task", bytes.NewBufferString(`{"id":"t","weight":1}`)))
+			if w.Code != http.StatusOK {
+				t.Errorf("status code = %d, want %d", w.Code, http.StatusOK)
+			}
+		}()
+	}
+
+	// All three tasks in flight: the third only gets what is left under the
+	// ceiling
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&activeRequests) < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if got := memory.retained(); got != 2*mib+mib/2 {
+		t.Errorf("retained = %d while in flight, want the ceiling %d", got, 2*mib+mib/2)
+	}
+	if got := testutil.ToFloat64(metrics.simulatedMemory.WithLabelValues(workerName)); got != 2*mib+mib/2 {
+		t.Errorf("gauge = %v while in flight", got)
+	}
+
+	w := httptest.NewRecorder()
+	handleHealth(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	var health HealthResponse
+	json.NewDecoder(w.Body).Decode(&health)
+	if health.SimulatedMemoryBytes != 2*mib+mib/2 {
+		t.Errorf("health simulatedMemoryBytes = %d", health.SimulatedMemoryBytes)
+	}
+
+	wg.Wait()
+	if got := memory.retained(); got != 0 {
+		t.Errorf("retained = %d after completion, want 0", got)
+	}
+	if got := testutil.ToFloat64(metrics.simulatedMemory.WithLabelValues(workerName)); got != 0 {
+		t.Errorf("gauge = %v after completion, want 0", got)
+	}
+}
+
+func TestMemoryLeakSurvivesPartialUpdate(t *testing.T) {
+	setupTestEnvironment()
+	metrics = newIsolatedWorkerMetrics()
+	const mib = 1 << 20
+	putConfig(t, "/config", `{"memory_per_task_bytes": 1024, "leak_bytes_per_second": 1048576}`)
+	cfg := putConfig(t, "/config", `{"failure_rate": 0.05}`)
+	if cfg.MemoryPerTaskBytes != 1024 || cfg.LeakBytesPerSecond != mib {
+		t.Fatalf("after an unrelated update: memory_per_task_bytes %d, leak_bytes_per_second %d", cfg.MemoryPerTaskBytes, cfg.LeakBytesPerSecond)
+	}
+	memory.leakTick(config.Get())
+	if got := memory.retained(); got != mib {
+		t.Errorf("leaked = %d, want the leak still running", got)
+	}
+}
+
+func TestMemoryLeakAndRelease(t *testing.T) {
+	setupTestEnvironment()
+	metrics = newIsolatedWorkerMetrics()
+	const mib = 1 << 20
+	setConfig(func(c *Config) {
+		c.LeakBytesPerSecond = mib
+		c.MemoryCeilingBytes = 2*mib + mib/2
+	})
+
+	for i := 0; i < 4; i++ {
+		memory.leakTick(config.Get())
+	}
+	if got := memory.retained(); got != 2*mib+mib/2 {
+		t.Fatalf("leaked = %d, want capped at %d", got, 2*mib+mib/2)
+	}
+
+	w := httptest.NewRecorder()
+	handleMemoryRelease(w, httptest.NewRequest(http.MethodGet, "/memory/release", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET status code = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+
+	w = httptest.NewRecorder()
+	handleMemoryRelease(w, httptest.NewRequest(http.MethodPost, "/memory/release", nil))
+	var status MemoryStatus
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if status.RetainedBytes != 0 || status.LeakBytes != 0 || status.CeilingBytes != 2*mib+mib/2 {
+		t.Errorf("status after release = %+v", status)
+	}
+	if got := testutil.ToFloat64(metrics.simulatedMemory.WithLabelValues(workerName)); got != 0 {
+		t.Errorf("gauge = %v after release, want 0", got)
+	}
+
+	// The leak resumes from zero
+	memory.leakTick(config.Get())
+	w = httptest.NewRecorder()
+	handleMemory(w, httptest.NewRequest(http.MethodGet, "/memory", nil))
+	json.NewDecoder(w.Body).Decode(&status)
+	if status.LeakBytes != mib || status.RetainedBytes != mib {
+		t.Errorf("status = %+v, want one tick of leak", status)
+	}
+}
+
+func TestTagOverridesAndEcho(t *testing.T) {
+	setupTestEnvironment()
+	metrics = newIsolatedWorkerMetrics()
+	failAll := 1.0
+	setConfig(func(c *Config) {
+		c.ResponseDelayMs = 0
+		c.FailureRate = 0
+		c.TagOverrides = []TagOverride{
+			{Key: "scenario", Value: "burst-1", ExtraDelayMs: 50},
+			{Key: "team", Value: "red", FailureRate: &failAll},
+		}
+	})
+
+	w := httptest.NewRecorder()
+	handleTask(w, httptest.NewRequest(http.MethodPost, "/task", bytes.NewBufferString(`{"id":"t","weight":1,"tags":{"scenario":"burst-1","team":"blue"}}`)))
+	var resp TaskResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if w.Code != http.StatusOK || resp.ProcessingTimeMs < 50 {
+		t.Errorf("burst-1 task: %d in %dms, want 200 after the 50ms override", w.Code, resp.ProcessingTimeMs)
+	}
+	if resp.Tags["scenario"] != "burst-1" || resp.Tags["team"] != "blue" {
+		t.Errorf("tags = %v, want them echoed", resp.Tags)
+	}
+
+	w = httptest.NewRecorder()
+	handleTask(w, httptest.NewRequest(http.MethodPost, "/task", bytes.NewBufferString(`{"id":"t","weight":1,"tags":{"team":"red"}}`)))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("team=red task: %d, want the failure rate override", w.Code)
+	}
+
+	// Invalid overrides are ignored as a whole
+	negative := -0.5
+	updated := config.Update(&Config{TagOverrides: []TagOverride{{Key: "team", Value: "red", FailureRate: &negative}}})
+	if len(updated.TagOverrides) != 2 {
+		t.Errorf("overrides = %+v, want the invalid update ignored", updated.TagOverrides)
+	}
+}
+
+// newTokenTestServer serves /task and the token server endpoints like a worker
+func newTokenTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/task", handleTask)
+	mux.HandleFunc("/acquire", handleAcquire)
+	mux.HandleFunc("/release", handleRelease)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func postBody(t *testing.T, url string, body interface{}) (*http.Response, map[string]interface{}) {
+	t.Helper()
+	data, _ := json.Marshal(body)
+	resp, err := http.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var decoded map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&decoded)
+	return resp, decoded
+}
+
+func TestTokenServerAcquireRelease(t *testing.T) {
+	setupTestEnvironment()
+	srv := newTokenTestServer(t)
+
+	resp, held := postBody(t, srv.URL+"/acquire", AcquireRequest{Resource: "db", Capacity: 1})
+	if resp.StatusCode != http.StatusOK || held["token"] == "" || held["inUse"] != 1.0 {
+		t.Fatalf("acquire: %d %v, want a token with 1 in use", resp.StatusCode, held)
+	}
+	resp, body := postBody(t, srv.URL+"/acquire", AcquireRequest{Resource: "db", Capacity: 1, TimeoutMs: 50})
+	if resp.StatusCode != http.StatusServiceUnavailable || body["reason"] != sharedResourceTimeout {
+		t.Errorf("acquire at capacity: %d %v, want 503 %s", resp.StatusCode, body, sharedResourceTimeout)
+	}
+
+	// A waiting acquirer gets the token as soon as it is released
+	done := make(chan map[string]interface{})
+	go func() {
+		_, body := postBody(t, srv.URL+"/acquire", AcquireRequest{Resource: "db", Capacity: 1, TimeoutMs: 2000})
+		done <- body
+	}()
+	time.Sleep(50 * time.Millisecond)
+	release := ReleaseRequest{Resource: "db", Token: held["token"].(string)}
+	if resp, _ := postBody(t, srv.URL+"/release", release); resp.StatusCode != http.StatusOK {
+		t.Errorf("release: %d, want 200", resp.StatusCode)
+	}
+	if waiter := <-done; waiter["token"] == nil || waiter["waitMs"].(float64) < 40 {
+		t.Errorf("waiter got %v, want a token after waiting for the release", waiter)
+	}
+	if resp, _ := postBody(t, srv.URL+"/release", release); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("second release: %d, want 404", resp.StatusCode)
+	}
+	if resp, _ := postBody(t, srv.URL+"/acquire", AcquireRequest{Resource: "db"}); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("acquire without capacity: %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestTokenServerLeaseExpiry(t *testing.T) {
+	setupTestEnvironment()
+	clock := time.Now()
+	now = func() time.Time { return clock }
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := tokens.acquire(ctx, "db", 1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokens.acquire(ctx, "db", 1, time.Second); err == nil {
+		t.Fatal("second token granted at capacity 1")
+	}
+	// The holder never released its token, but its lease ran out
+	clock = clock.Add(2 * time.Second)
+	if _, err := tokens.acquire(context.Background(), "db", 1, time.Second); err != nil {
+		t.Errorf("acquire after the lease expired: %v", err)
+	}
+}
+
+func TestSharedResourceCapsPoolThroughput(t *testing.T) {
+	setupTestEnvironment()
+	metrics = newIsolatedWorkerMetrics()
+	a := newTokenTestServer(t)
+	b := newTokenTestServer(t)
+	// Both workers take tokens from worker a's token server
+	setConfig(func(c *Config) {
+		c.ResponseDelayMs = 50
+		c.SharedResource = "db"
+		c.SharedResourceCapacity = 2
+		c.SharedResourceURL = a.URL
+	})
+
+	const tasks = 8
+	start := time.Now()
+	var wg sync.WaitGroup
+	var waited int32
+	for i := 0; i < tasks; i++ {
+		url := a.URL
+		if i%2 == 1 {
+			url = b.URL
+		}
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			resp, body := postBody(t, url+"/task", TaskRequest{ID: "t"})
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("task: %d %v", resp.StatusCode, body)
+				return
+			}
+			if ms, ok := body["sharedWaitMs"].(float64); ok && ms >= 40 {
+				atomic.AddInt32(&waited, 1)
+			}
+		}(url)
+	}
+	wg.Wait()
+
+	// Two at a time across both workers: four rounds of 50ms
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+		t.Errorf("%d tasks took %v, want at least 200ms at a shared capacity of 2", tasks, elapsed)
+	}
+	if waited < tasks/2 {
+		t.Errorf("%d tasks reported waiting for a token, want at least %d", waited, tasks/2)
+	}
+	if got := testutil.CollectAndCount(metrics.sharedWait); got != 1 {
+		t.Errorf("shared wait series = %d, want 1", got)
+	}
+	if n := tokens.inUse("db"); n != 0 {
+		t.Errorf("%d tokens still leased after the tasks finished", n)
+	}
+}
+
+func TestHandleCrash(t *testing.T) {
+	exited := make(chan int, 1)
+	exit = func(code int) { exited <- code }
+	defer func() { exit = os.Exit }()
+
+	rec := httptest.NewRecorder()
+	handleCrash(rec, httptest.NewRequest(http.MethodPost, "/crash?mode=panic", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("mode=panic: %d, want 400", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handleCrash(rec, httptest.NewRequest(http.MethodPost, "/crash?mode=exit", nil))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("mode=exit: %d, want 202", rec.Code)
+	}
+	select {
+	case code := <-exited:
+		if code != 1 {
+			t.Errorf("exit code = %d, want 1", code)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("worker did not exit")
+	}
+}
+
+func TestStagedPipeline(t *testing.T) {
+	setupTestEnvironment()
+	metrics = newIsolatedWorkerMetrics()
+	setConfig(func(c *Config) {
+		c.FailureRate = 0
+		c.Stages = []Stage{
+			{Name: "parse", DelayMs: 5},
+			{Name: "fetch", DelayMs: 20, Distribution: stageUniform},
+			{Name: "compute", DelayMs: 30},
+			{Name: "serialize", DelayMs: 5},
+		}
+	})
+
+	w := httptest.NewRecorder()
+	handleTask(w, httptest.NewRequest(http.MethodPost, "/task", bytes.NewBufferString(`{"id":"t","weight":2}`)))
+	var resp TaskResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("task: %d %v", w.Code, err)
+	}
+	var sum int64
+	var names []string
+	for _, st := range resp.Stages {
+		sum += st.Ms
+		names = append(names, st.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"parse", "fetch", "compute", "serialize"}) || sum != resp.ProcessingTimeMs {
+		t.Errorf("stages = %+v, sum %dms, want all four summing to %dms", resp.Stages, sum, resp.ProcessingTimeMs)
+	}
+	// The fixed stages scale with the weight
+	if resp.Stages[0].Ms < 10 || resp.Stages[2].Ms < 60 {
+		t.Errorf("parse %dms, compute %dms at weight 2, want at least 10ms and 60ms", resp.Stages[0].Ms, resp.Stages[2].Ms)
+	}
+	if n := testutil.CollectAndCount(metrics.stageDuration); n != 4 {
+		t.Errorf("stage histograms = %d, want 4", n)
+	}
+
+	// A failing middle stage ends the pipeline and is reported
+	setConfig(func(c *Config) {
+		c.Stages = []Stage{{Name: "parse", DelayMs: 1}, {Name: "fetch", DelayMs: 1, FailureRate: 1}, {Name: "compute", DelayMs: 1}}
+	})
+	w = httptest.NewRecorder()
+	handleTask(w, httptest.NewRequest(http.MethodPost, "/task", bytes.NewBufferString(`{"id":"t","weight":1}`)))
+	var errResp ErrorResponse
+	json.NewDecoder(w.Body).Decode(&errResp)
+	if w.Code != http.StatusInternalServerError || errResp.Stage != "fetch" || errResp.Reason != stageFailed {
+		t.Fatalf("failing stage: %d %+v, want 500 in fetch", w.Code, errResp)
+	}
+	if len(errResp.Stages) != 2 || errResp.Stages[0].Failed || !errResp.Stages[1].Failed {
+		t.Errorf("stages = %+v, want parse then the failed fetch", errResp.Stages)
+	}
+	if got := testutil.ToFloat64(metrics.stageFailures.WithLabelValues(workerName, "fetch")); got != 1 {
+		t.Errorf("fetch failures = %v, want 1", got)
+	}
+}
+
+func TestStagesValidation(t *testing.T) {
+	setupTestEnvironment()
+	valid := []Stage{{Name: "parse", DelayMs: 5}, {Name: "compute", DelayMs: 60, Distribution: stageExponential, FailureRate: 0.1}}
+	if field, _ := checkConfig(&Config{Stages: valid}); field != "" {
+		t.Errorf("valid stages rejected: %s", field)
+	}
+	for _, stages := range [][]Stage{
+		{},
+		{{Name: "parse", DelayMs: -1}},
+		{{Name: "", DelayMs: 5}},
+		{{Name: "parse", DelayMs: 5}, {Name: "parse", DelayMs: 5}},
+		{{Name: "parse", DelayMs: 5, Distribution: "normal"}},
+		{{Name: "parse", DelayMs: 5, FailureRate: 2}},
+	} {
+		if field, _ := checkConfig(&Config{Stages: stages}); field != "stages" {
+			t.Errorf("stages %+v: field %q, want stages", stages, field)
+		}
+		if updated := config.Update(&Config{ResponseDelayMs: -1, Stages: stages}); updated.Stages != nil {
+			t.Errorf("invalid stages %+v applied", stages)
+		}
+	}
+	if updated := config.Update(&Config{ResponseDelayMs: -1, Stages: valid}); !reflect.DeepEqual(updated.Stages, valid) {
+		t.Errorf("stages = %+v, want %+v", updated.Stages, valid)
+	}
+
+	t.Setenv("STAGES", "parse:5, fetch:40")
+	if got := loadConfig().Stages; !reflect.DeepEqual(got, []Stage{{Name: "parse", DelayMs: 5}, {Name: "fetch", DelayMs: 40}}) {
+		t.Errorf("STAGES = %+v", got)
+	}
+}
+
+// newPeerServers starts an in-process worker per name and registers them
+// all as peers; the instances share the globals, so the call tree tells
+// them apart by the peer name they were called under
+func newPeerServers(t *testing.T, names ...string) map[string]string {
+	t.Helper()
+	peers := make(map[string]string)
+	for _, name := range names {
+		srv := httptest.NewServer(http.HandlerFunc(handleTask))
+		t.Cleanup(srv.Close)
+		peers[name] = srv.URL
+	}
+	setConfig(func(c *Config) { c.Peers = peers })
+	return peers
+}
+
+func doForwardedTask(t *testing.T, body string) TaskResponse {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handleTask(w, httptest.NewRequest(http.MethodPost, "/task", bytes.NewBufferString(body)))
+	var resp TaskResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("task: %d %v", w.Code, err)
+	}
+	if resp.CallTree == nil {
+		t.Fatal("response has no call tree")
+	}
+	return resp
+}
+
+// callShape renders the peers of a call tree, skipped ones with a !, truncated ones with a …
+func callShape(n CallNode) string {
+	s := n.Peer
+	switch {
+	case n.Skipped:
+		s += "!"
+	case n.Truncated:
+		s += "…"
+	}
+	if len(n.Calls) > 0 {
+		var calls []string
+		for _, c := range n.Calls {
+			calls = append(calls, callShape(c))
+		}
+		s += "(" + strings.Join(calls, " ") + ")"
+	}
+	return s
+}
+
+func TestForwardCallTree(t *testing.T) {
+	setupTestEnvironment()
+	metrics = newIsolatedWorkerMetrics()
+	setConfig(func(c *Config) {
+		c.FailureRate = 0
+		c.ResponseDelayMs = 10
+	})
+	newPeerServers(t, "a", "b")
+
+	resp := doForwardedTask(t, `{"id":"t","weight":1,"forwardTo":["a","b"],"forwardDepth":2}`)
+	// a and b each forward on once more, skipping themselves
+	if got := callShape(*resp.CallTree); got != "(a(a! b) b(a b!))" {
+		t.Errorf("call tree = %s", got)
+	}
+	if resp.Partial {
+		t.Error("partial without a failed call")
+	}
+	root := resp.CallTree
+	if root.Worker != workerName || root.Task != "t" || root.Ms < resp.ProcessingTimeMs {
+		t.Errorf("root = %+v", root)
+	}
+	a := root.Calls[0]
+	if a.Task != "t/a" || a.Status != http.StatusOK || a.Ms < 20 || a.Calls[1].Task != "t/a/b" || a.Calls[1].Ms < 10 {
+		t.Errorf("a = %+v, want t/a taking its own and b's processing", a)
+	}
+	if got := testutil.ToFloat64(metrics.forwardCalls.WithLabelValues(workerName, "skipped")); got != 2 {
+		t.Errorf("skipped calls = %v, want 2", got)
+	}
+
+	// Snake case responses nest the same
+	setConfig(func(c *Config) { c.ResponseFieldStyle = fieldStyleSnake })
+	w := httptest.NewRecorder()
+	handleTask(w, httptest.NewRequest(http.MethodPost, "/task", bytes.NewBufferString(`{"id":"t","weight":1,"forwardTo":["a"],"forwardDepth":2}`)))
+	var snake struct {
+		CallTree *CallNode `json:"call_tree"`
+	}
+	json.NewDecoder(w.Body).Decode(&snake)
+	if snake.CallTree == nil || callShape(*snake.CallTree) != "(a(a!))" {
+		t.Errorf("snake call tree = %+v", snake.CallTree)
+	}
+}
+
+func TestForwardDepthLimit(t *testing.T) {
+	setupTestEnvironment()
+	metrics = newIsolatedWorkerMetrics()
+	setConfig(func(c *Config) {
+		c.FailureRate = 0
+		c.ResponseDelayMs = 0
+		c.MaxForwardDepth = 2
+	})
+	newPeerServers(t, "a", "b", "c")
+
+	// forwardDepth asks for three hops, the workers allow two
+	resp := doForwardedTask(t, `{"id":"t","weight":1,"forwardTo":["a","b","c"],"forwardDepth":3}`)
+	if got := callShape(*resp.CallTree); got != "(a(a! b… c…) b(a… b! c…) c(a… b… c!))" {
+		t.Errorf("call tree = %s", got)
+	}
+
+	// forwardDepth 1 stops after the first hop
+	resp = doForwardedTask(t, `{"id":"t","weight":1,"forwardTo":["a"],"forwardDepth":1}`)
+	if got := callShape(*resp.CallTree); got != "(a)" {
+		t.Errorf("call tree = %s", got)
+	}
+
+	// A task that never asks to be forwarded has no tree
+	w := httptest.NewRecorder()
+	handleTask(w, httptest.NewRequest(http.MethodPost, "/task", bytes.NewBufferString(`{"id":"t","weight":1,"forwardTo":["a"]}`)))
+	if strings.Contains(w.Body.String(), "callTree") {
+		t.Errorf("forwardDepth 0 answered %s", w.Body)
+	}
+}
+
+func TestForwardPartialFailure(t *testing.T) {
+	setupTestEnvironment()
+	metrics = newIsolatedWorkerMetrics()
+	setConfig(func(c *Config) {
+		c.FailureRate = 0
+		c.ResponseDelayMs = 0
+	})
+	peers := newPeerServers(t, "a")
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Simulated failure"})
+	}))
+	defer broken.Close()
+	peers["dead"], peers["broken"] = dead.URL, broken.URL
+	setConfig(func(c *Config) { c.Peers = peers })
+
+	resp := doForwardedTask(t, `{"id":"t","weight":1,"forwardTo":["a","missing","dead","broken"],"forwardDepth":1}`)
+	if !resp.Partial {
+		t.Error("not partial with three failed calls")
+	}
+	calls := resp.CallTree.Calls
+	if len(calls) != 4 || calls[0].Error != "" || calls[0].Worker != workerName {
+		t.Fatalf("calls = %+v, want a to succeed", calls)
+	}
+	if calls[1].Error != "Unknown peer" || calls[2].Error == "" || calls[2].Status != 0 {
+		t.Errorf("missing = %+v, dead = %+v", calls[1], calls[2])
+	}
+	if calls[3].Status != http.StatusInternalServerError || calls[3].Error != "Simulated failure" {
+		t.Errorf("broken = %+v", calls[3])
+	}
+	if got := testutil.ToFloat64(metrics.forwardCalls.WithLabelValues(workerName, "failed")); got != 3 {
+		t.Errorf("failed calls = %v, want 3", got)
+	}
+
+	// A failure further down makes the root partial too: gate only fails
+	// tasks that came through a
+	gate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(forwardVisited(r), "a") {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		handleTask(w, r)
+	}))
+	defer gate.Close()
+	peers["gate"] = gate.URL
+	setConfig(func(c *Config) { c.Peers = peers })
+	resp = doForwardedTask(t, `{"id":"t","weight":1,"forwardTo":["a","gate"],"forwardDepth":2}`)
+	if got := callShape(*resp.CallTree); got != "(a(a! gate) gate(a gate!))" || !resp.Partial {
+		t.Errorf("call tree = %s, partial %v", got, resp.Partial)
+	}
+	if c := resp.CallTree.Calls[0].Calls[1]; c.Status != http.StatusServiceUnavailable || c.Error != "Peer returned status 503" {
+		t.Errorf("a -> gate = %+v", c)
+	}
+}
+
+func TestPeersConfig(t *testing.T) {
+	setupTestEnvironment()
+	for _, peers := range []map[string]string{{"": "http://a"}, {"a": "a:8080"}, {"a,b": "http://a"}} {
+		if field, _ := checkConfig(&Config{Peers: peers}); field != "peers" {
+			t.Errorf("peers %v: field %q, want peers", peers, field)
+		}
+		if updated := config.Update(&Config{ResponseDelayMs: -1, Peers: peers}); updated.Peers != nil {
+			t.Errorf("invalid peers %v applied", peers)
+		}
+	}
+	if field, _ := checkConfig(&Config{MaxForwardDepth: 11}); field != "max_forward_depth" {
+		t.Errorf("max_forward_depth 11: field %q", field)
+	}
+
+	t.Setenv("PEERS", "rust-worker-1=http://rust-worker-1:8080/, python-worker-1=http://python-worker-1:8080")
+	t.Setenv("MAX_FORWARD_DEPTH", "0")
+	cfg := loadConfig()
+	if !reflect.DeepEqual(cfg.Peers, map[string]string{"rust-worker-1": "http://rust-worker-1:8080", "python-worker-1": "http://python-worker-1:8080"}) {
+		t.Errorf("PEERS = %v", cfg.Peers)
+	}
+	if cfg.MaxForwardDepth != defaultMaxForwardDepth {
+		t.Errorf("MAX_FORWARD_DEPTH 0 gave %d", cfg.MaxForwardDepth)
+	}
+}
@@ -8,6 +8,7 @@ from typing import Optional
 
 from fastapi import FastAPI, HTTPException, Response
 from fastapi.middleware.cors import CORSMiddleware
+from fastapi.responses import JSONResponse
 from prometheus_client import (
     CONTENT_TYPE_LATEST,
     Counter,
@@ -47,6 +48,23 @@ class HealthResponse(BaseModel):
     status: str
     currentLoad: int
     queueDepth: int
+    expectedLatencyMs: int = 0
+    worker: str = ""
+    maxConcurrent: int = 0
+    queueSize: int = 0
+
+
+# Factors applied to the advertised expected latency while degraded or unhealthy
+LATENCY_FACTORS = {"degraded": 1.5, "unhealthy": 2.0}
+
+
+def expected_latency_ms(response_delay_ms: int, status: str) -> int:
+    """
+    weight 1 のタスクの想定レイテンシ (ミリ秒) を返す。
+
+    response_delay_ms を基に、status が degraded なら 1.5 倍、unhealthy なら 2 倍する。
+    """
+    return round(response_delay_ms * LATENCY_FACTORS.get(status, 1.0))
 
 
 # Environment configuration
@@ -239,11 +257,12 @@ async def handle_health():
     - それ以外は "healthy"
     
     Returns:
-        HealthResponse: 現在のステータスを表す `status`、現在の同時処理数を示す `currentLoad`、およびキューの深さを示す `queueDepth` を含むオブジェクト。
+        HealthResponse: 現在のステータスを表す `status`、現在の同時処理数を示す `currentLoad`、キューの深さを示す `queueDepth`、ワーカー名 `worker`、ステータスに応じた想定レイテンシ `expectedLatencyMs`、および同時処理数とキューの上限 `maxConcurrent`・`queueSize` を含むオブジェクト。
     """
     with config_lock:
         max_concurrent = config.max_concurrent_requests
         max_queue = config.queue_size
+        response_delay_ms = config.response_delay_ms
 
     with requests_lock:
         load = active_requests
@@ -261,7 +280,15 @@ async def handle_health():
     else:
         status = "healthy"
 
-    return HealthResponse(status=status, currentLoad=load, queueDepth=depth)
+    return HealthResponse(
+        worker=WORKER_NAME,
+        status=status,
+        currentLoad=load,
+        queueDepth=depth,
+        expectedLatencyMs=expected_latency_ms(response_delay_ms, status),
+        maxConcurrent=max_concurrent,
+        queueSize=max_queue,
+    )
 
 
 @app.get("/config")
@@ -276,12 +303,46 @@ async def get_config():
         return config
 
 
+def check_config(new_config: Configuration) -> Optional[tuple[str, str]]:
+    """
+    update_config が黙って無視する値を探し、最初に見つかったフィールド名と理由を返す。全て妥当なら None。
+    """
+    if new_config.max_concurrent_requests < 0:
+        return "max_concurrent_requests", "must not be negative"
+    if new_config.response_delay_ms < 0:
+        return "response_delay_ms", "must not be negative"
+    if not 0.0 <= new_config.failure_rate <= 1.0:
+        return "failure_rate", "must be between 0 and 1"
+    if new_config.queue_size < 0:
+        return "queue_size", "must not be negative"
+    return None
+
+
+def merge_config(current: Configuration, new_config: Configuration) -> Configuration:
+    """
+    current に new_config の妥当な値を重ねた設定を、current を変更せずに返す。
+    """
+    merged = current.model_copy()
+    if new_config.max_concurrent_requests > 0:
+        merged.max_concurrent_requests = new_config.max_concurrent_requests
+    if new_config.response_delay_ms >= 0:
+        merged.response_delay_ms = new_config.response_delay_ms
+    if 0.0 <= new_config.failure_rate <= 1.0:
+        merged.failure_rate = new_config.failure_rate
+    if new_config.queue_size > 0:
+        merged.queue_size = new_config.queue_size
+    return merged
+
+
 @app.post("/config")
 @app.put("/config")
-async def update_config(new_config: Configuration):
+async def update_config(new_config: Configuration, dry_run: bool = False):
     """
     与えられた設定値を検証し、妥当なフィールドのみを現在のランタイム設定に反映して返す。
     
+    dry_run が真の場合は設定を反映せず、範囲外の値があれば {"error", "field"} を 400 で返し、
+    なければ反映後に得られる設定を返す。
+    
     Parameters:
         new_config (Configuration): 更新を試みる設定値。以下の検証が行われ、条件を満たすフィールドだけが適用される:
             - `max_concurrent_requests` が 0 より大きい場合に適用
@@ -296,6 +357,14 @@ async def update_config(new_config: Configuration):
         HTTPException: queue_size変更時にアクティブなリクエストがある場合は400エラー
     """
     global config, queue_semaphore
+    if dry_run:
+        invalid = check_config(new_config)
+        if invalid:
+            field, message = invalid
+            return JSONResponse(status_code=400, content={"error": f"{field} {message}", "field": field})
+        with config_lock:
+            return merge_config(config, new_config)
+
     with config_lock:
         if new_config.max_concurrent_requests > 0:
             config.max_concurrent_requests = new_config.max_concurrent_requests
@@ -13,12 +13,14 @@ from main import (
     TaskResponse,
     ErrorResponse,
     HealthResponse,
+    expected_latency_ms,
     load_config,
     config,
     active_requests,
     requests_lock,
     queue_depth,
     queue_depth_lock,
+    WORKER_NAME,
 )
 
 
@@ -230,6 +232,9 @@ class TestHealthEndpoint:
         assert isinstance(data["status"], str)
         assert isinstance(data["currentLoad"], int)
         assert isinstance(data["queueDepth"], int)
+        assert data["worker"] == WORKER_NAME
+        assert data["maxConcurrent"] > 0
+        assert data["queueSize"] > 0
 
     def test_health_endpoint_low_load(self, client, reset_state):
         """Test health endpoint with low load"""
@@ -243,6 +248,19 @@ class TestHealthEndpoint:
         data = response.json()
         assert data["currentLoad"] == 2
 
+    def test_health_endpoint_expected_latency(self, client, reset_state):
+        """Test health endpoint advertises the configured delay when healthy"""
+        response = client.get("/health")
+        data = response.json()
+        assert data["status"] == "healthy"
+        assert data["expectedLatencyMs"] == config.response_delay_ms
+
+    def test_expected_latency_under_degradation(self):
+        """Test expected latency grows with degradation"""
+        assert expected_latency_ms(100, "healthy") == 100
+        assert expected_latency_ms(100, "degraded") == 150
+        assert expected_latency_ms(100, "unhealthy") == 200
+
     def test_health_endpoint_multiple_requests(self, client, reset_state):
         """Test health endpoint handles multiple requests"""
         for _ in range(5):
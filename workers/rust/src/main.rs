@@ -1,5 +1,5 @@
 use axum::{
-    extract::State,
+    extract::{Query, State},
     http::StatusCode,
     response::IntoResponse,
     routing::{get, post},
@@ -34,6 +34,13 @@ struct Configuration {
     queue_size: i32,
 }
 
+/// `PUT /config` のクエリパラメータ。`dry_run=true` なら設定を反映せず検証だけを行う。
+#[derive(Debug, Default, Deserialize)]
+struct ConfigParams {
+    #[serde(default)]
+    dry_run: bool,
+}
+
 #[derive(Debug, Deserialize)]
 struct TaskRequest {
     id: String,
@@ -58,11 +65,29 @@ struct ErrorResponse {
 
 #[derive(Debug, Serialize)]
 struct HealthResponse {
+    worker: String,
     status: String,
     #[serde(rename = "currentLoad")]
     current_load: i32,
     #[serde(rename = "queueDepth")]
     queue_depth: i32,
+    #[serde(rename = "expectedLatencyMs")]
+    expected_latency_ms: i64,
+    #[serde(rename = "maxConcurrent")]
+    max_concurrent: i32,
+    #[serde(rename = "queueSize")]
+    queue_size: i32,
+}
+
+/// weight 1 のタスクの想定レイテンシ (ミリ秒)。`response_delay_ms` を基に、
+/// `degraded` なら 1.5 倍、`unhealthy` なら 2 倍する。
+fn expected_latency_ms(response_delay_ms: i32, status: &str) -> i64 {
+    let factor = match status {
+        "degraded" => 1.5,
+        "unhealthy" => 2.0,
+        _ => 1.0,
+    };
+    (response_delay_ms as f64 * factor).round() as i64
 }
 
 struct AppState {
@@ -318,7 +343,7 @@ async fn handle_task(
 /// - 比率が 0.7 以上なら `degraded`
 /// - それ以外は `healthy`
 ///
-/// 返却される JSON ペイロードは `HealthResponse` で、状態文字列、現在の負荷（in-flight リクエスト数）、キュー深度を含む。
+/// 返却される JSON ペイロードは `HealthResponse` で、状態文字列、現在の負荷（in-flight リクエスト数）、キュー深度、状態に応じた想定レイテンシ、同時処理数とキューの上限を含む。
 ///
 /// # Examples
 ///
@@ -351,9 +376,13 @@ async fn handle_health(State(state): State<Arc<AppState>>) -> impl IntoResponse
     };
 
     Json(HealthResponse {
+        worker: state.worker_name.clone(),
         status: status.to_string(),
         current_load: load,
         queue_depth,
+        expected_latency_ms: expected_latency_ms(config.response_delay_ms, status),
+        max_concurrent: config.max_concurrent_requests,
+        queue_size: config.queue_size,
     })
 }
 
@@ -375,6 +404,9 @@ async fn handle_config_get(State(state): State<Arc<AppState>>) -> impl IntoRespo
 ///
 /// 更新後の設定はログに記録され、クライアントへ JSON として返される。
 ///
+/// `dry_run=true` の場合は設定を反映せず、範囲外の値があれば `{"error", "field"}` を 400 で返し、
+/// なければ反映後に得られる設定を返す。
+///
 /// # Returns
 ///
 /// 更新後の `Configuration` を含む JSON レスポンス。
@@ -394,8 +426,42 @@ async fn handle_config_get(State(state): State<Arc<AppState>>) -> impl IntoRespo
 /// ```
 async fn handle_config_update(
     State(state): State<Arc<AppState>>,
+    Query(params): Query<ConfigParams>,
     Json(new_config): Json<Configuration>,
-) -> impl IntoResponse {
+) -> axum::response::Response {
+    if params.dry_run {
+        if let Some((field, message)) = check_config(&new_config) {
+            return (
+                StatusCode::BAD_REQUEST,
+                Json(serde_json::json!({ "error": format!("{} {}", field, message), "field": field })),
+            )
+                .into_response();
+        }
+        let mut preview = state.config.read().clone();
+        if new_config.max_concurrent_requests > 0 {
+            preview.max_concurrent_requests = new_config.max_concurrent_requests;
+        }
+        if new_config.response_delay_ms >= 0 {
+            preview.response_delay_ms = new_config.response_delay_ms;
+        }
+        if new_config.failure_rate >= 0.0 && new_config.failure_rate <= 1.0 {
+            preview.failure_rate = new_config.failure_rate;
+        }
+        if new_config.queue_size > 0 && new_config.queue_size < preview.queue_size {
+            return (
+                StatusCode::BAD_REQUEST,
+                Json(serde_json::json!({
+                    "error": "queue_size cannot be decreased at runtime",
+                    "field": "queue_size",
+                })),
+            )
+                .into_response();
+        }
+        if new_config.queue_size > 0 {
+            preview.queue_size = new_config.queue_size;
+        }
+        return Json(preview).into_response();
+    }
     let mut config = state.config.write();
     if new_config.max_concurrent_requests > 0 {
         config.max_concurrent_requests = new_config.max_concurrent_requests;
@@ -426,7 +492,24 @@ async fn handle_config_update(
         }
     }
     tracing::info!("Config updated: {:?}", *config);
-    Json(config.clone())
+    Json(config.clone()).into_response()
+}
+
+/// `handle_config_update` が黙って無視する範囲外の値を探し、最初に見つかったフィールド名と理由を返す。
+fn check_config(new_config: &Configuration) -> Option<(&'static str, &'static str)> {
+    if new_config.max_concurrent_requests < 0 {
+        return Some(("max_concurrent_requests", "must not be negative"));
+    }
+    if new_config.response_delay_ms < 0 {
+        return Some(("response_delay_ms", "must not be negative"));
+    }
+    if !(0.0..=1.0).contains(&new_config.failure_rate) {
+        return Some(("failure_rate", "must be between 0 and 1"));
+    }
+    if new_config.queue_size < 0 {
+        return Some(("queue_size", "must not be negative"));
+    }
+    None
 }
 
 /// Prometheus のメトリクスをレンダリングして HTTP レスポンスの本文を生成するハンドラ。